@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// decodePayload decompresses gzip payloads (the gateway's constrained-link
+// batches on <batch_topic>/gz) and returns other payloads unchanged
+func decodePayload(payload []byte) ([]byte, error) {
+	if len(payload) < 2 || payload[0] != 0x1f || payload[1] != 0x8b {
+		return payload, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// splitBatch returns the per-room payloads of a constrained-link batch or
+// building snapshot ({"gateway_id": ..., "rooms": [...]})
+func splitBatch(payload []byte) ([]json.RawMessage, bool) {
+	if len(payload) == 0 || payload[0] != '{' {
+		return nil, false
+	}
+	var batch struct {
+		GatewayID string            `json:"gateway_id"`
+		Rooms     []json.RawMessage `json:"rooms"`
+	}
+	if err := json.Unmarshal(payload, &batch); err != nil || batch.GatewayID == "" || batch.Rooms == nil {
+		return nil, false
+	}
+	return batch.Rooms, true
+}
+
+// batchRoomID returns the room_id of one batch entry for its record topic
+func batchRoomID(room json.RawMessage) string {
+	var fields struct {
+		RoomID interface{} `json:"room_id"`
+	}
+	json.Unmarshal(room, &fields)
+	return fmt.Sprint(fields.RoomID)
+}
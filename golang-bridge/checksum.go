@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checksumExt is appended to the SHA-256 sidecar of a finalized sink file.
+// Sidecars use the sha256sum format ("<hex>  <name>"), so a directory can
+// also be checked with sha256sum -c *.sha256 where the bridge is not
+// installed.
+const checksumExt = ".sha256"
+
+// finalizeFile runs once a sink has closed a file: it encrypts the file
+// when the sink has a sealer and writes the checksum sidecar of the final
+// file, so the checksum covers the bytes that are kept and uploaded
+func finalizeFile(path string, sealer *fileSealer) error {
+	if sealer != nil {
+		sealed, err := sealer.seal(path)
+		if err != nil {
+			return err
+		}
+		path = sealed
+	}
+	return writeChecksum(path)
+}
+
+// writeChecksum writes the sidecar of a file through a temporary file, so
+// a crash never leaves a truncated checksum that would fail verification
+func writeChecksum(path string) error {
+	checksum, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %s: %w", path, err)
+	}
+	line := fmt.Sprintf("%s  %s\n", checksum, filepath.Base(path))
+	tmp := path + checksumExt + ".tmp"
+	if err := os.WriteFile(tmp, []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write checksum of %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path+checksumExt); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write checksum of %s: %w", path, err)
+	}
+	return nil
+}
+
+// readChecksum returns the checksum recorded for a file, or an empty
+// string when it has no sidecar
+func readChecksum(path string) (string, error) {
+	data, err := os.ReadFile(path + checksumExt)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read checksum of %s: %w", path, err)
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 1 || len(fields[0]) != 64 || strings.Trim(strings.ToLower(fields[0]), "0123456789abcdef") != "" {
+		return "", fmt.Errorf("malformed checksum file %s%s", path, checksumExt)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// verifyChecksum compares a file with its sidecar; recorded reports
+// whether the file has one
+func verifyChecksum(path string) (recorded bool, err error) {
+	want, err := readChecksum(path)
+	if err != nil || want == "" {
+		return false, err
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return true, err
+	}
+	if got != want {
+		return true, fmt.Errorf("checksum mismatch: recorded %s, file has %s", want, got)
+	}
+	return true, nil
+}
+
+// runVerify implements `golang-bridge verify`: it checks every sink file
+// (Parquet or JSONL, plain or encrypted) under the given files or
+// directories against its checksum sidecar and reports files without one
+// and sidecars whose file is gone. It returns the process exit code: 1
+// when a file is corrupt or missing, or with -strict lacks a checksum.
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	strict := flags.Bool("strict", false, "fail on files without a checksum")
+	quiet := flags.Bool("q", false, "only print problems")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: golang-bridge verify [-strict] [-q] [FILE|DIR]...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{getEnv("OUTPUT_DIR", "/data/parquet")}
+	}
+
+	var ok, corrupt, unrecorded, orphaned int
+	for _, root := range paths {
+		files, sidecars, err := verifiableFiles(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			corrupt++
+			continue
+		}
+		for _, path := range files {
+			recorded, err := verifyChecksum(path)
+			switch {
+			case err != nil:
+				corrupt++
+				fmt.Printf("FAILED   %s: %v\n", path, err)
+			case !recorded:
+				unrecorded++
+				fmt.Printf("NO SUM   %s\n", path)
+			default:
+				ok++
+				if !*quiet {
+					fmt.Printf("OK       %s\n", path)
+				}
+			}
+		}
+		for _, sidecar := range sidecars {
+			if _, err := os.Stat(strings.TrimSuffix(sidecar, checksumExt)); errors.Is(err, fs.ErrNotExist) {
+				orphaned++
+				fmt.Printf("MISSING  %s: checksum without its file\n", strings.TrimSuffix(sidecar, checksumExt))
+			}
+		}
+	}
+
+	fmt.Printf("%d ok, %d failed, %d without checksum, %d missing\n", ok, corrupt, unrecorded, orphaned)
+	if corrupt > 0 || orphaned > 0 || *strict && unrecorded > 0 {
+		return 1
+	}
+	return 0
+}
+
+// verifiableFiles lists the sink files and the checksum sidecars under a
+// path. Files without a sidecar are usually still being written, or were
+// left behind by a crash before finalization.
+func verifiableFiles(path string) (files, sidecars []string, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil, nil
+	}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case uploadable(p):
+			files = append(files, p)
+		case strings.HasSuffix(p, checksumExt):
+			sidecars = append(sidecars, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list %s: %w", path, err)
+	}
+	sort.Strings(files)
+	sort.Strings(sidecars)
+	return files, sidecars, nil
+}
+
+// checksumLeftovers writes the sidecars of complete files of a sink that a
+// crash left without one (files are finalized at rotation, so the last
+// file before the crash never was)
+func checksumLeftovers(dir, prefix, ext string) {
+	stamp := "_[0-9][0-9][0-9][0-9][0-9][0-9][0-9][0-9]_*"
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+stamp+ext))
+	if err != nil {
+		return
+	}
+	for _, path := range matches {
+		if isOpenFile(path) {
+			continue
+		}
+		if _, err := os.Stat(path + checksumExt); err == nil {
+			continue
+		}
+		if ext == ".parquet" {
+			info, err := os.Stat(path)
+			if err != nil || !parquetComplete(path, info.Size()) {
+				continue
+			}
+		} else if !jsonlComplete(path) {
+			continue
+		}
+		if err := writeChecksum(path); err != nil {
+			log.Printf("[ERROR] %v", err)
+			continue
+		}
+		log.Printf("Recorded checksum of %s left without one", path)
+	}
+}
+
+// jsonlComplete reports whether a JSONL file ends with a full line
+func jsonlComplete(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, info.Size()-1); err != nil {
+		return false
+	}
+	return last[0] == '\n'
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// CodecConfig selects the payload codec of the messages on a topic filter.
+// The first matching entry wins; messages on other topics are decoded as
+// JSON, the gateway's own encoding. DescriptorSet and Message configure the
+// protobuf codec.
+type CodecConfig struct {
+	Topic string `yaml:"topic"`
+	Codec string `yaml:"codec"`
+	// DescriptorSet is a FileDescriptorSet (protoc --include_imports
+	// --descriptor_set_out) holding Message, the full name of the payload
+	// message type
+	DescriptorSet string `yaml:"descriptor_set,omitempty"`
+	Message       string `yaml:"message,omitempty"`
+}
+
+// Codec decodes the payload of a message into record fields. Numbers are
+// float64 as for JSON payloads, so sinks and transforms see the same
+// field types whatever the encoding.
+type Codec interface {
+	Name() string
+	Decode(topic string, payload []byte) (map[string]interface{}, error)
+}
+
+// codecFactories holds the codecs compiled into the bridge. Each codec
+// registers itself from its own file, so codecs can be left out of a build
+// with their build tag (e.g. -tags no_sparkplug); JSON is always built in.
+var codecFactories = map[string]func(CodecConfig) (Codec, error){
+	"json": func(CodecConfig) (Codec, error) { return jsonCodec{}, nil },
+}
+
+func registerCodec(name string, factory func(CodecConfig) (Codec, error)) {
+	codecFactories[name] = factory
+}
+
+func codecNames() string {
+	names := make([]string, 0, len(codecFactories))
+	for name := range codecFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// jsonCodec decodes JSON objects, the gateway's telemetry encoding
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "json" }
+
+func (jsonCodec) Decode(topic string, payload []byte) (map[string]interface{}, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// topicCodec is a codec bound to a topic filter
+type topicCodec struct {
+	filter string
+	codec  Codec
+}
+
+// codecTable picks the codec of a topic
+type codecTable struct {
+	entries []topicCodec
+}
+
+func newCodecTable(configs []CodecConfig) (*codecTable, error) {
+	t := &codecTable{}
+	for i, cc := range configs {
+		if cc.Topic == "" {
+			return nil, fmt.Errorf("codecs: entry %d: topic is required", i)
+		}
+		factory, ok := codecFactories[cc.Codec]
+		if !ok {
+			return nil, fmt.Errorf("codecs: %s: unknown codec %q (built in: %s)", cc.Topic, cc.Codec, codecNames())
+		}
+		codec, err := factory(cc)
+		if err != nil {
+			return nil, fmt.Errorf("codecs: %s: %w", cc.Topic, err)
+		}
+		t.entries = append(t.entries, topicCodec{filter: cc.Topic, codec: codec})
+		log.Printf("Decoding %s with the %s codec", cc.Topic, codec.Name())
+	}
+	return t, nil
+}
+
+// forTopic returns the codec of a topic, JSON unless configured otherwise
+func (t *codecTable) forTopic(topic string) Codec {
+	if t != nil {
+		for _, e := range t.entries {
+			if topicMatches(e.filter, topic) {
+				return e.codec
+			}
+		}
+	}
+	return jsonCodec{}
+}
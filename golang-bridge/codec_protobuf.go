@@ -0,0 +1,134 @@
+//go:build !no_protobuf
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func init() {
+	registerCodec("protobuf", newProtobufCodec)
+}
+
+// protobufCodec decodes protobuf messages of a type described by a
+// descriptor set, so publishers' .proto files need no code generation in
+// the bridge. Fields are named as in the .proto; fields without presence
+// are always present (with their zero value), enums decode to their value
+// names and google.protobuf.Timestamp to an RFC 3339 string.
+type protobufCodec struct {
+	message protoreflect.MessageDescriptor
+}
+
+func newProtobufCodec(cc CodecConfig) (Codec, error) {
+	if cc.DescriptorSet == "" || cc.Message == "" {
+		return nil, errors.New("protobuf codec requires descriptor_set and message")
+	}
+	data, err := os.ReadFile(cc.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read descriptor set: %w", err)
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %w", cc.DescriptorSet, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s (built with --include_imports?): %w", cc.DescriptorSet, err)
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(cc.Message))
+	if err != nil {
+		return nil, fmt.Errorf("message %s not found in %s", cc.Message, cc.DescriptorSet)
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message type", cc.Message)
+	}
+	return &protobufCodec{message: message}, nil
+}
+
+func (c *protobufCodec) Name() string { return "protobuf" }
+
+func (c *protobufCodec) Decode(topic string, payload []byte) (map[string]interface{}, error) {
+	msg := dynamicpb.NewMessage(c.message)
+	if err := proto.Unmarshal(payload, msg); err != nil {
+		return nil, fmt.Errorf("protobuf: %w", err)
+	}
+	return protoFields(msg), nil
+}
+
+// protoFields converts a message to record fields
+func protoFields(m protoreflect.Message) map[string]interface{} {
+	fields := make(map[string]interface{})
+	descs := m.Descriptor().Fields()
+	for i := 0; i < descs.Len(); i++ {
+		fd := descs.Get(i)
+		if fd.HasPresence() && !m.Has(fd) {
+			continue
+		}
+		v := m.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			values := make([]interface{}, list.Len())
+			for j := range values {
+				values[j] = protoValue(fd, list.Get(j))
+			}
+			fields[string(fd.Name())] = values
+		case fd.IsMap():
+			entries := make(map[string]interface{})
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				entries[k.String()] = protoValue(fd.MapValue(), v)
+				return true
+			})
+			fields[string(fd.Name())] = entries
+		default:
+			fields[string(fd.Name())] = protoValue(fd, v)
+		}
+	}
+	return fields
+}
+
+// protoValue converts a singular value; numbers become float64 like JSON
+// numbers
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return float64(v.Enum())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return float64(v.Int())
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return float64(v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := v.Message()
+		if msg.Descriptor().FullName() == "google.protobuf.Timestamp" {
+			fields := msg.Descriptor().Fields()
+			seconds := msg.Get(fields.ByName("seconds")).Int()
+			nanos := msg.Get(fields.ByName("nanos")).Int()
+			return time.Unix(seconds, nanos).UTC().Format(time.RFC3339Nano)
+		}
+		return protoFields(msg)
+	}
+	return nil
+}
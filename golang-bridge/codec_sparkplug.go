@@ -0,0 +1,249 @@
+//go:build !no_sparkplug
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	registerCodec("sparkplug", func(CodecConfig) (Codec, error) {
+		return &sparkplugCodec{aliases: make(map[string]map[uint64]string)}, nil
+	})
+}
+
+// sparkplugCodec decodes Sparkplug B payloads on
+// spBv1.0/<group_id>/<message_type>/<edge_node_id>[/<device_id>] into one
+// record per message: every metric by name, plus the payload timestamp,
+// seq and the topic's identifiers. Metric aliases, which are unique per
+// edge node and its devices, are resolved with the names of the node's
+// latest NBIRTH and DBIRTHs; datasets and templates are skipped.
+type sparkplugCodec struct {
+	mu      sync.Mutex
+	aliases map[string]map[uint64]string // group/edge node → alias → name
+}
+
+func (c *sparkplugCodec) Name() string { return "sparkplug" }
+
+// Sparkplug B metric data types (sparkplug_b.proto)
+const (
+	spInt8     = 1
+	spInt16    = 2
+	spInt32    = 3
+	spInt64    = 4
+	spDateTime = 13
+)
+
+// sparkplugMetric is one metric of a payload
+type sparkplugMetric struct {
+	name     string
+	alias    uint64
+	hasAlias bool
+	datatype uint64
+	value    interface{}
+	hasValue bool
+}
+
+func (c *sparkplugCodec) Decode(topic string, payload []byte) (map[string]interface{}, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != "spBv1.0" {
+		return nil, fmt.Errorf("sparkplug: %s is not a spBv1.0/<group>/<type>/<node>[/<device>] topic", topic)
+	}
+	messageType := levels[2]
+	switch messageType {
+	case "NBIRTH", "NDATA", "NDEATH", "DBIRTH", "DDATA", "DDEATH":
+	default:
+		return nil, fmt.Errorf("sparkplug: %s messages carry no metrics", messageType)
+	}
+	fields := map[string]interface{}{
+		"group_id":     levels[1],
+		"message_type": messageType,
+		"edge_node_id": levels[3],
+	}
+	if len(levels) == 5 {
+		fields["device_id"] = levels[4]
+	}
+
+	var metrics []sparkplugMetric
+	for b := payload; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+			}
+			fields["timestamp"] = time.UnixMilli(int64(v)).UTC().Format(time.RFC3339Nano)
+			b = b[n:]
+		case num == 2 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return nil, fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+			}
+			metric, err := parseSparkplugMetric(v)
+			if err != nil {
+				return nil, err
+			}
+			metrics = append(metrics, metric)
+			b = b[n:]
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return nil, fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+			}
+			fields["seq"] = float64(v)
+			b = b[n:]
+		default:
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, fmt.Errorf("sparkplug: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+
+	node := levels[1] + "/" + levels[3]
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if messageType == "NBIRTH" || (messageType == "DBIRTH" && c.aliases[node] == nil) {
+		c.aliases[node] = make(map[uint64]string)
+	}
+	if messageType == "NBIRTH" || messageType == "DBIRTH" {
+		for _, m := range metrics {
+			if m.hasAlias && m.name != "" {
+				c.aliases[node][m.alias] = m.name
+			}
+		}
+	}
+	for _, m := range metrics {
+		if !m.hasValue {
+			continue
+		}
+		name := m.name
+		if name == "" {
+			name = c.aliases[node][m.alias]
+		}
+		if name == "" {
+			name = fmt.Sprintf("alias_%d", m.alias)
+		}
+		fields[name] = m.value
+	}
+	return fields, nil
+}
+
+// parseSparkplugMetric decodes a Metric message
+func parseSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+	var isNull bool
+	var raw uint64
+	var valueField protowire.Number
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			m.name = string(v)
+			b = b[n:]
+		case num == 15 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			m.value, m.hasValue, valueField = string(v), true, num
+			b = b[n:]
+		case num == 16 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			m.value, m.hasValue, valueField = base64.StdEncoding.EncodeToString(v), true, num
+			b = b[n:]
+		case num == 12 && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			m.value, m.hasValue, valueField = float64(math.Float32frombits(v)), true, num
+			b = b[n:]
+		case num == 13 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			m.value, m.hasValue, valueField = math.Float64frombits(v), true, num
+			b = b[n:]
+		case typ == protowire.VarintType && (num == 2 || num == 4 || num == 7 || num == 10 || num == 11 || num == 14):
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+			switch num {
+			case 2:
+				m.alias, m.hasAlias = v, true
+			case 4:
+				m.datatype = v
+			case 7:
+				isNull = v != 0
+			case 14:
+				m.value, m.hasValue, valueField = v != 0, true, num
+			default:
+				raw, m.hasValue, valueField = v, true, num
+			}
+		default:
+			// Timestamps, metadata, properties, datasets and templates
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return m, fmt.Errorf("sparkplug: metric: %w", protowire.ParseError(n))
+			}
+			b = b[n:]
+		}
+	}
+	if m.name == "" && !m.hasAlias {
+		return m, errors.New("sparkplug: metric without name or alias")
+	}
+	switch {
+	case isNull:
+		m.value, m.hasValue = nil, true
+	case valueField == 10:
+		switch m.datatype {
+		case spInt8:
+			m.value = float64(int8(raw))
+		case spInt16:
+			m.value = float64(int16(raw))
+		case spInt32:
+			m.value = float64(int32(raw))
+		default:
+			m.value = float64(uint32(raw))
+		}
+	case valueField == 11:
+		switch m.datatype {
+		case spInt64:
+			m.value = float64(int64(raw))
+		case spDateTime:
+			m.value = time.UnixMilli(int64(raw)).UTC().Format(time.RFC3339Nano)
+		default:
+			m.value = float64(raw)
+		}
+	}
+	return m, nil
+}
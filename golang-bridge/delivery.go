@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Delivery modes of a sink:
+//   - at_most_once: records are written once; a failed write is dropped and
+//     counted (the default, and the bridge's original behaviour)
+//   - at_least_once: records are appended to a write-ahead log before the
+//     sink sees them, failed writes are retried at the next flushes, and
+//     the log is replayed after a crash, so records may be written twice
+//   - effectively_once: at_least_once plus a dedup key per record (a hash
+//     of dedup_key fields, or of topic and payload): records whose key was
+//     seen within dedup_window are skipped, including MQTT redeliveries and
+//     records replayed after they reached the sink, and Elasticsearch uses
+//     the key as document _id so a duplicate overwrites instead of adding
+//
+// The log is checkpointed once the sink holds the records in it, i.e. after
+// a successful flush, and for parquet and jsonl sinks when the file holding
+// the records is closed: the dedup keys of the records in the sink are saved
+// and the log keeps only the failed writes waiting for a retry, so a replay
+// never writes a record the sink already holds.
+const (
+	deliveryAtMostOnce      = "at_most_once"
+	deliveryAtLeastOnce     = "at_least_once"
+	deliveryEffectivelyOnce = "effectively_once"
+)
+
+// deliveryTopic carries the periodic per-sink delivery counters
+const deliveryTopic = "status/bridge/delivery"
+
+// maxDeliveryAttempts bounds how many flushes a failed write is retried for
+// before the record is dropped
+const maxDeliveryAttempts = 3
+
+// errBatched marks a Write error about a batch the sink buffers rather than
+// the record written: the record is queued and the sink retries or counts
+// the batch itself
+var errBatched = errors.New("queued batch")
+
+// DeliveryStats are the cumulative delivery counters of one sink
+type DeliveryStats struct {
+	Pipeline string `json:"pipeline"`
+	Sink     int    `json:"sink"` // index in the pipeline's sinks
+	Type     string `json:"type"`
+	Delivery string `json:"delivery"`
+	Written  int64  `json:"written"`
+	// Dropped counts records lost by a failed write
+	Dropped int64 `json:"dropped"`
+	// Retrying is the number of failed writes waiting for the next flush
+	Retrying int `json:"retrying"`
+	// Replayed counts records written again from the log after a restart;
+	// with at_least_once they are Duplicated too, since the sink may
+	// already hold them
+	Replayed     int64 `json:"replayed"`
+	Duplicated   int64 `json:"duplicated"`
+	Deduplicated int64 `json:"deduplicated"`
+}
+
+// DeliveryReport is published on status/bridge/delivery
+type DeliveryReport struct {
+	Sinks []DeliveryStats `json:"sinks"`
+	Time  string          `json:"timestamp"`
+}
+
+// walEntry is one record in a sink's write-ahead log
+type walEntry struct {
+	Topic    string                 `json:"topic"`
+	Payload  []byte                 `json:"payload"`
+	Received time.Time              `json:"received"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+	Key      string                 `json:"key,omitempty"`
+}
+
+// failedWrite is a record waiting to be written again
+type failedWrite struct {
+	rec      *Record
+	attempts int
+}
+
+// deliverySink applies a sink's delivery mode and counts what happens to
+// its records; every pipeline sink is wrapped in one
+type deliverySink struct {
+	Sink
+	mu        sync.Mutex
+	dedupKeys []string
+	walPath   string
+	wal       *os.File // nil with at_most_once
+	walCount  int      // records appended since the last checkpoint
+	dedup     *dedupWindow
+	retry     []failedWrite
+	stats     DeliveryStats
+	logged    DeliveryStats
+}
+
+func newDeliverySink(pc PipelineConfig, index int, sc SinkConfig, sink Sink, config *Config) (Sink, error) {
+	sc.normalize(pc, config)
+	if sc.Delivery == "" {
+		sc.Delivery = deliveryAtMostOnce
+	}
+	switch sc.Delivery {
+	case deliveryAtMostOnce, deliveryAtLeastOnce, deliveryEffectivelyOnce:
+	default:
+		return nil, fmt.Errorf("unknown delivery %q", sc.Delivery)
+	}
+	s := &deliverySink{
+		Sink:      sink,
+		dedupKeys: sc.DedupKey,
+		stats:     DeliveryStats{Pipeline: pc.Name, Sink: index, Type: sc.Type, Delivery: sc.Delivery},
+	}
+	if sc.Delivery != deliveryEffectivelyOnce && (len(sc.DedupKey) > 0 || sc.DedupWindow != 0) {
+		return nil, fmt.Errorf("dedup_key and dedup_window require delivery: %s", deliveryEffectivelyOnce)
+	}
+	if sc.Delivery == deliveryAtMostOnce {
+		return s, nil
+	}
+	if sc.PartitionBy != "" {
+		return nil, fmt.Errorf("delivery %s is not supported with partition_by", sc.Delivery)
+	}
+
+	dir := sc.WALDir
+	if dir == "" {
+		dir = filepath.Join(sc.OutputDir, ".wal")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+	s.walPath = filepath.Join(dir, fmt.Sprintf("%s-%d-%s.wal", pc.Name, index, sc.Type))
+	if sc.Delivery == deliveryEffectivelyOnce {
+		if sc.DedupWindow < 0 {
+			return nil, fmt.Errorf("dedup_window must not be negative")
+		}
+		if sc.DedupWindow == 0 {
+			sc.DedupWindow = 100000
+		}
+		s.dedup = newDedupWindow(sc.DedupWindow)
+		if err := s.dedup.load(s.walPath + ".keys"); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %w", err)
+	}
+	s.wal = f
+	return s, nil
+}
+
+// replay writes the records left in the log by a previous run to the sink;
+// they stay in the log until the next checkpoint
+func (s *deliverySink) replay() error {
+	f, err := os.Open(s.walPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open wal: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e walEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// The tail of a log cut short by a crash
+			log.Printf("[WARN] Skipping unreadable entry in %s: %v", s.walPath, err)
+			continue
+		}
+		s.walCount++
+		if s.dedup != nil && !s.dedup.add(e.Key) {
+			s.stats.Deduplicated++
+			continue
+		}
+		rec := &Record{Topic: e.Topic, Payload: e.Payload, Received: e.Received, Fields: e.Fields, Key: e.Key}
+		s.stats.Replayed++
+		if s.dedup == nil {
+			s.stats.Duplicated++
+		}
+		s.writeLocked(rec, 0)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read wal: %w", err)
+	}
+	if s.stats.Replayed > 0 {
+		log.Printf("[%s] Replayed %d record(s) from %s into the %s sink", s.stats.Pipeline, s.stats.Replayed, s.walPath, s.stats.Type)
+	}
+	return nil
+}
+
+func (s *deliverySink) Write(rec *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		err := s.Sink.Write(rec)
+		switch {
+		case err == nil || errors.Is(err, errBatched):
+			s.stats.Written++
+		default:
+			s.stats.Dropped++
+		}
+		return err
+	}
+
+	if s.dedup != nil {
+		key := s.dedupKey(rec)
+		if !s.dedup.add(key) {
+			s.stats.Deduplicated++
+			return nil
+		}
+		// The record is shared with the pipeline's other sinks
+		keyed := *rec
+		keyed.Key = key
+		rec = &keyed
+	}
+	line, err := walLine(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(line); err != nil {
+		log.Printf("[ERROR] [%s] Failed to append to %s, record is not durable: %v", s.stats.Pipeline, s.walPath, err)
+	} else {
+		s.walCount++
+	}
+	return s.writeLocked(rec, 0)
+}
+
+// writeLocked writes a record to the sink and keeps it for retry when the
+// write fails; the caller must hold s.mu
+func (s *deliverySink) writeLocked(rec *Record, attempts int) error {
+	err := s.Sink.Write(rec)
+	if err == nil || errors.Is(err, errBatched) {
+		s.stats.Written++
+		return err
+	}
+	if attempts+1 >= maxDeliveryAttempts {
+		s.stats.Dropped++
+		return fmt.Errorf("dropped after %d attempts: %w", attempts+1, err)
+	}
+	s.retry = append(s.retry, failedWrite{rec: rec, attempts: attempts + 1})
+	return fmt.Errorf("%w (retried at the next flush)", err)
+}
+
+// Flush retries the failed writes, flushes the sink and checkpoints the log
+// once the sink holds every record in it
+func (s *deliverySink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wal == nil {
+		return s.Sink.Flush()
+	}
+
+	failed := s.retry
+	s.retry = nil
+	for _, w := range failed {
+		if err := s.writeLocked(w.rec, w.attempts); err != nil && !errors.Is(err, errBatched) {
+			log.Printf("[ERROR] [%s] Retrying %s sink: %v", s.stats.Pipeline, s.Sink.Name(), err)
+		}
+	}
+	before := openFileOf(s.Sink)
+	err := s.Sink.Flush()
+	if syncErr := s.wal.Sync(); syncErr != nil {
+		log.Printf("[ERROR] [%s] Failed to sync %s: %v", s.stats.Pipeline, s.walPath, syncErr)
+	}
+	if err != nil {
+		return err
+	}
+	// Records in a file that is still open are lost if the bridge crashes
+	// before it is closed; a closed file commits them even while other
+	// writes are failing
+	if after := openFileOf(s.Sink); after != "" && after == before {
+		return nil
+	}
+	s.checkpointLocked()
+	return nil
+}
+
+// checkpointLocked saves the dedup keys of the records the sink holds and
+// rewrites the log with the failed writes waiting for a retry; the caller
+// must hold s.mu
+func (s *deliverySink) checkpointLocked() {
+	if s.walCount == 0 {
+		return
+	}
+	if s.dedup != nil {
+		retrying := make(map[string]bool, len(s.retry))
+		for _, w := range s.retry {
+			retrying[w.rec.Key] = true
+		}
+		if err := s.dedup.save(s.walPath+".keys", retrying); err != nil {
+			log.Printf("[ERROR] [%s] Failed to save dedup keys, keeping %s: %v", s.stats.Pipeline, s.walPath, err)
+			return
+		}
+	}
+	if len(s.retry) == 0 {
+		if err := s.wal.Truncate(0); err != nil {
+			log.Printf("[ERROR] [%s] Failed to checkpoint %s: %v", s.stats.Pipeline, s.walPath, err)
+			return
+		}
+	} else if err := s.rewriteLocked(); err != nil {
+		log.Printf("[ERROR] [%s] Failed to checkpoint %s: %v", s.stats.Pipeline, s.walPath, err)
+		return
+	}
+	s.walCount = len(s.retry)
+}
+
+// rewriteLocked replaces the log with the records waiting for a retry; the
+// caller must hold s.mu
+func (s *deliverySink) rewriteLocked() error {
+	var data []byte
+	for _, w := range s.retry {
+		line, err := walLine(w.rec)
+		if err != nil {
+			return err
+		}
+		data = append(data, line...)
+	}
+	tmp := s.walPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.walPath); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen wal: %w", err)
+	}
+	s.wal.Close()
+	s.wal = f
+	return nil
+}
+
+// walLine encodes a record as a log line
+func walLine(rec *Record) ([]byte, error) {
+	line, err := json.Marshal(walEntry{Topic: rec.Topic, Payload: rec.Payload, Received: rec.Received, Fields: rec.Fields, Key: rec.Key})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal wal entry: %w", err)
+	}
+	return append(line, '\n'), nil
+}
+
+// Close closes the sink, which writes out its open file, and checkpoints
+// the log
+func (s *deliverySink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.Sink.Close()
+	if s.wal == nil {
+		return err
+	}
+	if err == nil {
+		s.checkpointLocked()
+	}
+	if len(s.retry) > 0 {
+		log.Printf("[WARN] [%s] %d failed record(s) of the %s sink stay in %s for the next start", s.stats.Pipeline, len(s.retry), s.Sink.Name(), s.walPath)
+	}
+	s.wal.Close()
+	return err
+}
+
+// dedupKey hashes the topic and the dedup_key fields of a record, or its
+// topic and payload when it has none of them
+func (s *deliverySink) dedupKey(rec *Record) string {
+	h := sha256.New()
+	h.Write([]byte(rec.Topic))
+	found := false
+	for _, name := range s.dedupKeys {
+		if v, ok := rec.Fields[name]; ok {
+			fmt.Fprintf(h, "\x00%s=%v", name, v)
+			found = true
+		}
+	}
+	if !found {
+		h.Write([]byte{0})
+		h.Write(rec.Payload)
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// report returns the counters and whether they changed in a way worth
+// logging since the last report
+func (s *deliverySink) report() (DeliveryStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Retrying = len(s.retry)
+	stats := s.stats
+	changed := stats.Dropped != s.logged.Dropped || stats.Duplicated != s.logged.Duplicated ||
+		stats.Deduplicated != s.logged.Deduplicated || stats.Retrying != s.logged.Retrying
+	s.logged = stats
+	return stats, changed
+}
+
+// fileSink is implemented by sinks writing rotating files
+type fileSink interface {
+	// openFile returns the file being written, "" when none is open
+	openFile() string
+}
+
+// openFileOf returns the open file of a file sink, looking through sinks
+// that wrap it
+func openFileOf(sink Sink) string {
+	for {
+		switch s := sink.(type) {
+		case fileSink:
+			return s.openFile()
+		case *unitsSink:
+			sink = s.Sink
+		default:
+			return ""
+		}
+	}
+}
+
+// dedupWindow remembers the most recent dedup keys
+type dedupWindow struct {
+	keys map[string]bool
+	ring []string
+	next int
+}
+
+func newDedupWindow(size int) *dedupWindow {
+	return &dedupWindow{keys: make(map[string]bool, size), ring: make([]string, size)}
+}
+
+// add records a key and reports whether it is new
+func (w *dedupWindow) add(key string) bool {
+	if key == "" {
+		return true
+	}
+	if w.keys[key] {
+		return false
+	}
+	if old := w.ring[w.next]; old != "" {
+		delete(w.keys, old)
+	}
+	w.ring[w.next] = key
+	w.keys[key] = true
+	w.next = (w.next + 1) % len(w.ring)
+	return true
+}
+
+// load reads the keys saved at the last checkpoint
+func (w *dedupWindow) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dedup keys: %w", err)
+	}
+	var keys []string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		log.Printf("[WARN] Ignoring unreadable dedup keys in %s: %v", path, err)
+		return nil
+	}
+	for _, key := range keys {
+		w.add(key)
+	}
+	return nil
+}
+
+// save writes the keys oldest first, except those of records the sink does
+// not hold yet, replacing the file atomically
+func (w *dedupWindow) save(path string, skip map[string]bool) error {
+	keys := make([]string, 0, len(w.keys))
+	for i := range w.ring {
+		if key := w.ring[(w.next+i)%len(w.ring)]; key != "" && !skip[key] {
+			keys = append(keys, key)
+		}
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// publishDeliveryReport logs the sinks whose drop, duplicate or retry
+// counters changed and publishes the counters of every sink
+func (h *MQTTHandler) publishDeliveryReport() {
+	r := DeliveryReport{Time: time.Now().UTC().Format(time.RFC3339)}
+	for _, p := range h.pipelines {
+		for _, sink := range p.sinks {
+			d, ok := sink.(*deliverySink)
+			if !ok {
+				continue
+			}
+			stats, changed := d.report()
+			if changed {
+				log.Printf("[STATS] [%s] %s sink %d (%s): written %d, dropped %d, retrying %d, replayed %d, duplicated %d, deduplicated %d",
+					stats.Pipeline, stats.Type, stats.Sink, stats.Delivery, stats.Written, stats.Dropped,
+					stats.Retrying, stats.Replayed, stats.Duplicated, stats.Deduplicated)
+			}
+			r.Sinks = append(r.Sinks, stats)
+		}
+	}
+	if len(r.Sinks) == 0 || h.client == nil || !h.client.IsConnected() {
+		return
+	}
+	h.publishStatus(deliveryTopic, 0, r)
+}
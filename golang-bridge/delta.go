@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// deltaDecoder rebuilds full telemetry rows from the gateway's delta
+// publishing mode. Snapshots replace a room's state; deltas are applied on
+// top of it, with null removing a field. Deltas for rooms without a snapshot
+// yet are dropped.
+type deltaDecoder struct {
+	mu    sync.Mutex
+	key   string
+	state map[string]map[string]interface{}
+	seq   map[string]float64
+}
+
+func newDeltaDecoder(key string) *deltaDecoder {
+	return &deltaDecoder{
+		key:   key,
+		state: make(map[string]map[string]interface{}),
+		seq:   make(map[string]float64),
+	}
+}
+
+func (d *deltaDecoder) apply(rec *Record) bool {
+	msgType, _ := rec.Fields["msg_type"].(string)
+	if msgType == "" {
+		// Not delta-encoded, pass through unchanged
+		return true
+	}
+	key := fmt.Sprint(rec.Fields[d.key])
+	seq, _ := rec.Fields["seq"].(float64)
+	delete(rec.Fields, "msg_type")
+	delete(rec.Fields, "seq")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	state, ok := d.state[key]
+	switch msgType {
+	case "snapshot":
+		state = make(map[string]interface{}, len(rec.Fields))
+		d.state[key] = state
+	case "delta":
+		if !ok {
+			log.Printf("[DEBUG] Delta for %s before its first snapshot, dropped", key)
+			return false
+		}
+		if last := d.seq[key]; seq != last+1 {
+			log.Printf("[WARN] Delta gap for %s (seq %v after %v), fields may be stale until the next snapshot", key, seq, last)
+		}
+	default:
+		log.Printf("[WARN] Unknown msg_type %q for %s, dropped", msgType, key)
+		return false
+	}
+	d.seq[key] = seq
+
+	for k, v := range rec.Fields {
+		if v == nil {
+			delete(state, k)
+		} else {
+			state[k] = v
+		}
+	}
+	rec.Fields = make(map[string]interface{}, len(state))
+	for k, v := range state {
+		rec.Fields[k] = v
+	}
+	return true
+}
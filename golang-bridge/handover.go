@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Returning from the gateway's fallback broker to the central broker. The
+// gateway spools what it could not publish centrally and replays it once
+// reconnected; those messages already reached the bridge through the
+// fallback broker, so the bridge stays there until the gateway's retained
+// spool state on fallbackSpoolTopic reports nothing pending. It then
+// subscribes on the central broker with a second connection before leaving
+// the fallback broker, so nothing published during the switch is missed,
+// and drops the copies received on both connections.
+
+// fallbackSpoolTopic carries the gateway's retained spool state on its
+// embedded broker
+const fallbackSpoolTopic = "fallback/spool"
+
+// handoverTimeout bounds the wait for the resubscription on the central
+// broker; handoverGrace lets messages in flight on the overlap connection
+// arrive before it is closed
+const (
+	handoverTimeout = 30 * time.Second
+	handoverGrace   = time.Second
+)
+
+// handover is the state of a return to the central broker
+type handover struct {
+	// spoolPending is set while the gateway replays its spool
+	spoolPending atomic.Bool
+	active       atomic.Bool
+	mu           sync.Mutex
+	seen         map[uint64]struct{}
+	resubscribed chan struct{}
+}
+
+// begin starts dropping messages received twice
+func (ho *handover) begin() {
+	ho.mu.Lock()
+	ho.seen = make(map[uint64]struct{})
+	ho.resubscribed = make(chan struct{})
+	ho.mu.Unlock()
+	ho.active.Store(true)
+}
+
+func (ho *handover) end() {
+	ho.active.Store(false)
+	ho.mu.Lock()
+	ho.seen, ho.resubscribed = nil, nil
+	ho.mu.Unlock()
+}
+
+// subscribed signals that the main connection has resubscribed
+func (ho *handover) subscribed() {
+	ho.mu.Lock()
+	defer ho.mu.Unlock()
+	if ho.resubscribed != nil {
+		close(ho.resubscribed)
+		ho.resubscribed = nil
+	}
+}
+
+// waitSubscribed waits for the main connection's resubscription
+func (ho *handover) waitSubscribed(timeout time.Duration) bool {
+	ho.mu.Lock()
+	ch := ho.resubscribed
+	ho.mu.Unlock()
+	if ch == nil {
+		return true
+	}
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// duplicate reports whether a message was already received during a
+// handover; payloads carry timestamps, so equal topic and payload is the
+// same message
+func (ho *handover) duplicate(msg mqtt.Message) bool {
+	if !ho.active.Load() {
+		return false
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(msg.Topic()))
+	hash.Write([]byte{0})
+	hash.Write(msg.Payload())
+	key := hash.Sum64()
+	ho.mu.Lock()
+	defer ho.mu.Unlock()
+	if ho.seen == nil {
+		return false
+	}
+	if _, ok := ho.seen[key]; ok {
+		return true
+	}
+	ho.seen[key] = struct{}{}
+	return false
+}
+
+// fallbackBrokerURL returns the fallback broker's URL with its credentials
+func (c *Config) fallbackBrokerURL() string {
+	u := &url.URL{Scheme: "tcp", Host: c.MQTTFallbackBroker}
+	if c.MQTTFallbackUser != "" {
+		u.User = url.UserPassword(c.MQTTFallbackUser, c.MQTTFallbackPass)
+	}
+	return u.String()
+}
+
+// subscribeSpoolState follows the gateway's spool state; it is only
+// published on the fallback broker
+func (h *MQTTHandler) subscribeSpoolState() error {
+	if h.config.MQTTFallbackBroker == "" {
+		return nil
+	}
+	token := h.client.Subscribe(fallbackSpoolTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		var state struct {
+			Pending bool `json:"pending"`
+		}
+		if err := json.Unmarshal(msg.Payload(), &state); err != nil {
+			log.Printf("[WARN] Invalid spool state on %s: %v", msg.Topic(), err)
+			return
+		}
+		h.handover.spoolPending.Store(state.Pending)
+	})
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", fallbackSpoolTopic, token.Error())
+	}
+	return nil
+}
+
+// returnToPrimary reconnects to the central broker once it is reachable
+// again and the gateway has replayed its spool, while the bridge is running
+// on the gateway's fallback broker
+func (h *MQTTHandler) returnToPrimary() {
+	primary := net.JoinHostPort(h.config.MQTTBroker, h.config.MQTTPort)
+	if !h.onFallback() || !h.client.IsConnected() {
+		return
+	}
+	if h.handover.spoolPending.Load() {
+		log.Printf("[DEBUG] Waiting for the gateway to replay its spool before leaving the fallback broker")
+		return
+	}
+	conn, err := net.DialTimeout("tcp", primary, 2*time.Second)
+	if err != nil {
+		return
+	}
+	conn.Close()
+
+	log.Printf("Central broker %s is reachable again, leaving the fallback broker", primary)
+	h.handover.begin()
+	defer h.handover.end()
+	overlap, err := h.connectOverlap(primary)
+	if err != nil {
+		log.Printf("[ERROR] Failed to subscribe on the central broker, staying on the fallback broker: %v", err)
+		return
+	}
+	defer overlap.Disconnect(250)
+
+	h.client.Disconnect(250)
+	// The connect handler restores the subscriptions
+	if token := h.client.Connect(); token.Wait() && token.Error() != nil {
+		log.Printf("[ERROR] Failed to reconnect: %v", token.Error())
+		return
+	}
+	if !h.handover.waitSubscribed(handoverTimeout) {
+		log.Printf("[WARN] Resubscription on the central broker took longer than %v", handoverTimeout)
+	}
+	time.Sleep(handoverGrace)
+}
+
+// connectOverlap subscribes the pipelines on the central broker with a
+// second connection, which receives their messages while the main one
+// switches over
+func (h *MQTTHandler) connectOverlap(primary string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + primary)
+	opts.SetClientID(h.session.config.clientID(h.config) + "-handover")
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	for _, p := range h.pipelines {
+		topic := h.config.SubscriptionTopic(p.config.Topic)
+		if token := client.Subscribe(topic, 1, h.messageHandler(p)); token.Wait() && token.Error() != nil {
+			client.Disconnect(250)
+			return nil, fmt.Errorf("pipeline %s: %w", p.config.Name, token.Error())
+		}
+	}
+	return client, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The healthcheck subcommand exercises the bridge's dependencies and exits
+// 0 when all are healthy, 1 otherwise (2 for usage errors), for Docker
+// HEALTHCHECK and Kubernetes probes. It shares its output format and exit
+// codes with the gateway's healthcheck: one "ok|fail|skip <check>: <detail>"
+// line per check, or a JSON report with -json.
+
+// healthCheckResult is the outcome of one check
+type healthCheckResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"` // ok, fail or skip
+	Detail    string `json:"detail"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// healthReport is the -json output
+type healthReport struct {
+	Healthy bool                `json:"healthy"`
+	Checks  []healthCheckResult `json:"checks"`
+}
+
+func runHealthcheck(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", 5*time.Second, "timeout of each check")
+	asJSON := flags.Bool("json", false, "print a JSON report")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: golang-bridge healthcheck [-timeout 5s] [-json]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+	// Config loading logs progress; the report is the only output
+	log.SetOutput(io.Discard)
+
+	config := loadConfig()
+	var report healthReport
+	run := func(name string, check func() (string, error)) {
+		start := time.Now()
+		detail, err := check()
+		result := healthCheckResult{Name: name, Status: "ok", Detail: detail, ElapsedMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Status, result.Detail = "fail", err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	run("config", func() (string, error) {
+		rooms, err := loadRoomMetadata(config.RoomsPath)
+		if err != nil {
+			return "", err
+		}
+		config.Rooms = rooms
+		file, err := loadBridgeFile(config.PipelinesPath, config)
+		if err != nil {
+			return "", err
+		}
+		if _, err := newCodecTable(file.Codecs); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d pipelines, %d rooms", len(file.Pipelines), len(rooms)), nil
+	})
+	run("mqtt", func() (string, error) {
+		return checkBrokerConnect(config, *timeout)
+	})
+	run("output_dir", func() (string, error) {
+		return checkWritableDir(config.OutputDir)
+	})
+
+	report.Healthy = true
+	for _, c := range report.Checks {
+		if c.Status == "fail" {
+			report.Healthy = false
+		}
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, c := range report.Checks {
+			fmt.Printf("%-4s %s: %s (%dms)\n", c.Status, c.Name, c.Detail, c.ElapsedMs)
+		}
+	}
+	if !report.Healthy {
+		return 1
+	}
+	return 0
+}
+
+// checkBrokerConnect connects to the broker, or the fallback broker like the
+// bridge itself, with a client ID of its own so the check never takes over
+// the bridge's session
+func checkBrokerConnect(config *Config, timeout time.Duration) (string, error) {
+	broker := fmt.Sprintf("tcp://%s:%s", config.MQTTBroker, config.MQTTPort)
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	if config.MQTTFallbackBroker != "" {
+		opts.AddBroker(config.fallbackBrokerURL())
+	}
+	connected := broker
+	opts.SetConnectionAttemptHandler(func(u *url.URL, cfg *tls.Config) *tls.Config {
+		connected = u.Redacted()
+		return cfg
+	})
+	opts.SetClientID(fmt.Sprintf("golang-bridge-healthcheck-%d", os.Getpid()))
+	opts.SetConnectTimeout(timeout)
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return "", fmt.Errorf("no CONNACK from %s within %s", broker, timeout)
+	}
+	if err := token.Error(); err != nil {
+		return "", fmt.Errorf("%s: %w", broker, err)
+	}
+	client.Disconnect(250)
+	return "connected to " + connected, nil
+}
+
+// checkWritableDir creates and removes a file in dir
+func checkWritableDir(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return "", fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	return dir + " is writable", nil
+}
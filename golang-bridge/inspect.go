@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+// inspectBatch is the number of rows read at a time when scanning a file
+const inspectBatch = 1024
+
+// parquetColumn is a top-level column of an archived file
+type parquetColumn struct {
+	name      string
+	element   *parquet.SchemaElement
+	timestamp bool
+}
+
+func (c *parquetColumn) typeString() string {
+	e := c.element
+	if e.GetNumChildren() > 0 {
+		return "group"
+	}
+	t := e.GetType().String()
+	if e.ConvertedType != nil {
+		t += " " + e.GetConvertedType().String()
+	}
+	return t
+}
+
+// archivedFile is an open archived Parquet file read without a row struct,
+// so it works for every pipeline schema
+type archivedFile struct {
+	path    string
+	file    interface{ Close() error }
+	reader  *reader.ParquetReader
+	columns []parquetColumn
+	// schema and version come from the footer metadata of registry schemas
+	schema, version string
+}
+
+func openArchivedFile(path string) (*archivedFile, error) {
+	if strings.HasSuffix(path, sealedExt) {
+		return nil, fmt.Errorf("%s is encrypted; decrypt it first with age -d -i <identity>", path)
+	}
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		fr.Close()
+		return nil, fmt.Errorf("failed to read %s (still being written?): %w", path, err)
+	}
+
+	f := &archivedFile{path: path, file: fr, reader: pr}
+	for _, kv := range pr.Footer.KeyValueMetadata {
+		if kv.Value == nil {
+			continue
+		}
+		switch kv.Key {
+		case "schema":
+			f.schema = *kv.Value
+		case "schema_version":
+			f.version = *kv.Value
+		}
+	}
+
+	// Top-level columns follow the root element; nested groups are skipped
+	// over by their number of children
+	elements := pr.Footer.Schema
+	for i := 1; i < len(elements); {
+		e := elements[i]
+		name := pr.SchemaHandler.Infos[i].ExName
+		f.columns = append(f.columns, parquetColumn{
+			name:      name,
+			element:   e,
+			timestamp: isTimestampColumn(name, e),
+		})
+		i = skipSchemaElement(elements, i)
+	}
+	return f, nil
+}
+
+// skipSchemaElement returns the index of the element following i and all
+// of its descendants
+func skipSchemaElement(elements []*parquet.SchemaElement, i int) int {
+	children := int(elements[i].GetNumChildren())
+	i++
+	for ; children > 0; children-- {
+		i = skipSchemaElement(elements, i)
+	}
+	return i
+}
+
+// isTimestampColumn reports whether a column holds timestamps in any of the
+// bridge's encodings; a plain INT64 column named timestamp is the nanos mode
+func isTimestampColumn(name string, e *parquet.SchemaElement) bool {
+	if e.GetNumChildren() > 0 || e.Type == nil {
+		return false
+	}
+	switch {
+	case e.GetType() == parquet.Type_INT96:
+		return true
+	case e.LogicalType != nil && e.LogicalType.GetTIMESTAMP() != nil:
+		return true
+	case e.ConvertedType != nil:
+		ct := e.GetConvertedType()
+		return ct == parquet.ConvertedType_TIMESTAMP_MILLIS || ct == parquet.ConvertedType_TIMESTAMP_MICROS
+	}
+	return name == "timestamp" && e.GetType() == parquet.Type_INT64
+}
+
+// columnTime decodes a timestamp column value
+func columnTime(e *parquet.SchemaElement, v interface{}) (time.Time, bool) {
+	switch x := v.(type) {
+	case string:
+		if e.GetType() == parquet.Type_INT96 {
+			return types.INT96ToTime(x).UTC(), true
+		}
+	case int64:
+		if e.LogicalType != nil && e.LogicalType.GetTIMESTAMP() != nil {
+			switch unit := e.LogicalType.GetTIMESTAMP().GetUnit(); {
+			case unit != nil && unit.IsSetMILLIS():
+				return time.UnixMilli(x).UTC(), true
+			case unit != nil && unit.IsSetMICROS():
+				return time.UnixMicro(x).UTC(), true
+			}
+			return time.Unix(0, x).UTC(), true
+		}
+		switch e.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return time.UnixMilli(x).UTC(), true
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return time.UnixMicro(x).UTC(), true
+		}
+		return time.Unix(0, x).UTC(), true
+	}
+	return time.Time{}, false
+}
+
+func (f *archivedFile) close() {
+	f.reader.ReadStop()
+	f.file.Close()
+}
+
+func (f *archivedFile) numRows() int64 {
+	return f.reader.GetNumRows()
+}
+
+// readRows reads up to n rows as records keyed by column name, in column
+// order, with timestamps decoded
+func (f *archivedFile) readRows(n int) ([]orderedRow, error) {
+	rows, err := f.reader.ReadByNumber(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rows of %s: %w", f.path, err)
+	}
+	records := make([]orderedRow, 0, len(rows))
+	for _, row := range rows {
+		v := reflect.Indirect(reflect.ValueOf(row))
+		record := make(orderedRow, 0, len(f.columns))
+		for i := range f.columns {
+			if i >= v.NumField() {
+				break
+			}
+			col := &f.columns[i]
+			value := columnValue(v.Field(i))
+			if col.timestamp && value != nil {
+				if t, ok := columnTime(col.element, value); ok {
+					value = t.Format(time.RFC3339Nano)
+				}
+			}
+			record = append(record, rowField{name: col.name, value: value})
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// timeRange scans the first timestamp column of the whole file
+func (f *archivedFile) timeRange() (first, last time.Time, err error) {
+	col := -1
+	for i := range f.columns {
+		if f.columns[i].timestamp {
+			col = i
+			break
+		}
+	}
+	if col < 0 {
+		return first, last, nil
+	}
+	for remaining := f.numRows(); remaining > 0; remaining -= inspectBatch {
+		batch := inspectBatch
+		if remaining < int64(batch) {
+			batch = int(remaining)
+		}
+		rows, err := f.reader.ReadByNumber(batch)
+		if err != nil {
+			return first, last, fmt.Errorf("failed to read rows of %s: %w", f.path, err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			value := columnValue(reflect.Indirect(reflect.ValueOf(row)).Field(col))
+			t, ok := columnTime(f.columns[col].element, value)
+			if !ok {
+				continue
+			}
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+	}
+	return first, last, nil
+}
+
+// columnValue dereferences optional values; nil stays nil
+func columnValue(v reflect.Value) interface{} {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	return v.Interface()
+}
+
+type rowField struct {
+	name  string
+	value interface{}
+}
+
+// orderedRow marshals to a JSON object keeping the column order
+type orderedRow []rowField
+
+func (r orderedRow) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range r {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal column %s: %w", field.name, err)
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// archivedFiles expands a file or partition directory to its Parquet files
+// (encrypted ones included), ordered by name and so by rotation time
+func archivedFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && (strings.HasSuffix(p, ".parquet") || strings.HasSuffix(p, ".parquet"+sealedExt)) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", path, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func formatRange(first, last time.Time) string {
+	if first.IsZero() {
+		return "-"
+	}
+	return first.Format(time.RFC3339) + " .. " + last.Format(time.RFC3339)
+}
+
+func printSchema(f *archivedFile) {
+	if f.schema != "" {
+		fmt.Printf("schema: %s v%s\n", f.schema, f.version)
+	}
+	if createdBy := f.reader.Footer.GetCreatedBy(); createdBy != "" {
+		fmt.Printf("created by: %s\n", createdBy)
+	}
+	fmt.Println("columns:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for i := range f.columns {
+		col := &f.columns[i]
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", col.name, col.typeString(), strings.ToLower(col.element.GetRepetitionType().String()))
+	}
+	tw.Flush()
+}
+
+// runInspect prints the schema, row count and time range of archived files
+// or partition directories (OUTPUT_DIR by default)
+func runInspect(args []string) int {
+	flags := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: golang-bridge inspect [FILE|DIR]...")
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{getEnv("OUTPUT_DIR", "/data/parquet")}
+	}
+
+	status := 0
+	for _, path := range paths {
+		files, err := archivedFiles(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+			continue
+		}
+		if len(files) == 0 {
+			fmt.Printf("%s: no parquet files\n", path)
+			continue
+		}
+		if err := inspectFiles(path, files); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// inspectFiles prints one file in detail, or a partition as the schema of
+// its newest file followed by a line per file and the totals
+func inspectFiles(path string, files []string) error {
+	var (
+		total       int64
+		first, last time.Time
+		schemaShown bool
+		failed      int
+	)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if len(files) > 1 {
+		fmt.Fprintln(tw, "FILE\tROWS\tTIME RANGE")
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		name := files[i]
+		if rel, err := filepath.Rel(path, name); err == nil && rel != "." {
+			name = rel
+		}
+		f, err := openArchivedFile(files[i])
+		if err != nil {
+			if len(files) == 1 {
+				return err
+			}
+			fmt.Fprintf(tw, "%s\t-\t%v\n", name, err)
+			failed++
+			continue
+		}
+		from, to, err := f.timeRange()
+		rows := f.numRows()
+		if !schemaShown {
+			fmt.Printf("%s\n", path)
+			printSchema(f)
+			schemaShown = true
+		}
+		f.close()
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 1 {
+			fmt.Printf("rows: %d\ntime range: %s\n", rows, formatRange(from, to))
+			return nil
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", name, rows, formatRange(from, to))
+		total += rows
+		if !from.IsZero() && (first.IsZero() || from.Before(first)) {
+			first = from
+		}
+		if to.After(last) {
+			last = to
+		}
+	}
+	tw.Flush()
+	fmt.Printf("total: %d files, %d rows, %s\n", len(files)-failed, total, formatRange(first, last))
+	if failed > 0 {
+		fmt.Printf("unreadable: %d files\n", failed)
+	}
+	return nil
+}
+
+// runTail prints the last records of a file or partition directory
+// (OUTPUT_DIR by default) as JSON lines
+func runTail(args []string) int {
+	flags := flag.NewFlagSet("tail", flag.ContinueOnError)
+	n := flags.Int("n", 10, "number of records")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: golang-bridge tail [-n N] [FILE|DIR]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	path := getEnv("OUTPUT_DIR", "/data/parquet")
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	if *n <= 0 {
+		return 0
+	}
+
+	files, err := archivedFiles(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	// Newest files first until enough records are collected; unreadable
+	// files (encrypted or still being written) are skipped in partitions
+	var chunks [][]orderedRow
+	needed := *n
+	for i := len(files) - 1; i >= 0 && needed > 0; i-- {
+		f, err := openArchivedFile(files[i])
+		if err != nil {
+			if len(files) == 1 {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+			fmt.Fprintf(os.Stderr, "skipping %v\n", err)
+			continue
+		}
+		rows, err := tailFile(f, needed)
+		f.close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		chunks = append(chunks, rows)
+		needed -= len(rows)
+	}
+
+	out := json.NewEncoder(os.Stdout)
+	for i := len(chunks) - 1; i >= 0; i-- {
+		for _, row := range chunks[i] {
+			if err := out.Encode(row); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// tailFile reads the last n rows of a file
+func tailFile(f *archivedFile, n int) ([]orderedRow, error) {
+	total := f.numRows()
+	if skip := total - int64(n); skip > 0 {
+		if err := f.reader.SkipRows(skip); err != nil {
+			return nil, fmt.Errorf("failed to skip rows of %s: %w", f.path, err)
+		}
+	} else {
+		n = int(total)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return f.readRows(n)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ingestLagTopic carries the periodic per-room ingest lag report
+const ingestLagTopic = "status/bridge/ingest_lag"
+
+// LagConfig tracks the ingest lag of every room: the time between a
+// record's event time (its timestamp field) and the bridge's arrival time.
+// The p50/p95/p99 and extremes of each flush interval are logged and
+// published to status/bridge/ingest_lag. A room whose p95 exceeds
+// threshold_sec, or whose timestamps run more than threshold_sec ahead of
+// the bridge's clock, raises an ingest_lag event on status/bridge/
+// data_quality, and a recovery event once it is back under the threshold.
+// Retained messages and records without a timestamp are not counted.
+type LagConfig struct {
+	Enabled      bool    `yaml:"enabled"`
+	ThresholdSec float64 `yaml:"threshold_sec,omitempty"` // default 30
+	// MaxSamples bounds the samples kept per room and interval; the most
+	// recent are kept
+	MaxSamples int `yaml:"max_samples,omitempty"` // default 1000
+}
+
+func (c *LagConfig) normalize() error {
+	if c.ThresholdSec < 0 {
+		return fmt.Errorf("lag: threshold_sec must not be negative")
+	}
+	if c.ThresholdSec == 0 {
+		c.ThresholdSec = 30
+	}
+	if c.MaxSamples <= 0 {
+		c.MaxSamples = 1000
+	}
+	return nil
+}
+
+// RoomLag is the ingest lag of one room over a report interval, in seconds;
+// negative values are event times ahead of the bridge's clock
+type RoomLag struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_sec"`
+	P95     float64 `json:"p95_sec"`
+	P99     float64 `json:"p99_sec"`
+	Min     float64 `json:"min_sec"`
+	Max     float64 `json:"max_sec"`
+}
+
+// LagReport is published on status/bridge/ingest_lag
+type LagReport struct {
+	Rooms map[string]RoomLag `json:"rooms"`
+	Time  string             `json:"timestamp"`
+}
+
+// IngestLagEvent is published on status/bridge/data_quality when a room's
+// lag crosses the threshold
+type IngestLagEvent struct {
+	Event        string  `json:"event"`
+	RoomID       string  `json:"room_id"`
+	State        string  `json:"state"` // lagging, clock_ahead or recovered
+	P95Sec       float64 `json:"p95_sec"`
+	MinSec       float64 `json:"min_sec"`
+	ThresholdSec float64 `json:"threshold_sec"`
+	Time         string  `json:"timestamp"`
+}
+
+// lagTracker collects lag samples per room between reports
+type lagTracker struct {
+	config  LagConfig
+	mu      sync.Mutex
+	samples map[string][]float64
+	// alerting holds the rooms with an open ingest_lag event
+	alerting map[string]string
+}
+
+func newLagTracker(config LagConfig) *lagTracker {
+	return &lagTracker{
+		config:   config,
+		samples:  make(map[string][]float64),
+		alerting: make(map[string]string),
+	}
+}
+
+// observe records the lag of a record that arrived at arrived. Nil trackers
+// (lag tracking disabled) ignore records.
+func (t *lagTracker) observe(rec *Record, arrived time.Time) {
+	if t == nil {
+		return
+	}
+	str, ok := rec.Fields["timestamp"].(string)
+	if !ok {
+		return
+	}
+	eventTime, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return
+	}
+	room := recordRoomID(rec)
+	lag := arrived.Sub(eventTime).Seconds()
+	t.mu.Lock()
+	samples := append(t.samples[room], lag)
+	if len(samples) > t.config.MaxSamples {
+		samples = samples[len(samples)-t.config.MaxSamples:]
+	}
+	t.samples[room] = samples
+	t.mu.Unlock()
+}
+
+// report returns the lag of every room since the previous report and the
+// events of rooms that crossed the threshold
+func (t *lagTracker) report(now time.Time) (LagReport, []IngestLagEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := LagReport{Rooms: make(map[string]RoomLag, len(t.samples)), Time: now.Format(time.RFC3339)}
+	var events []IngestLagEvent
+	for room, samples := range t.samples {
+		sort.Float64s(samples)
+		lag := RoomLag{
+			Samples: len(samples),
+			P50:     lagPercentile(samples, 0.50),
+			P95:     lagPercentile(samples, 0.95),
+			P99:     lagPercentile(samples, 0.99),
+			Min:     samples[0],
+			Max:     samples[len(samples)-1],
+		}
+		r.Rooms[room] = lag
+
+		state := ""
+		switch {
+		case lag.P95 > t.config.ThresholdSec:
+			state = "lagging"
+		case lag.Min < -t.config.ThresholdSec:
+			state = "clock_ahead"
+		}
+		previous := t.alerting[room]
+		if state == previous {
+			continue
+		}
+		if state == "" {
+			delete(t.alerting, room)
+			state = "recovered"
+		} else {
+			t.alerting[room] = state
+		}
+		events = append(events, IngestLagEvent{
+			Event:        "ingest_lag",
+			RoomID:       room,
+			State:        state,
+			P95Sec:       lag.P95,
+			MinSec:       lag.Min,
+			ThresholdSec: t.config.ThresholdSec,
+			Time:         r.Time,
+		})
+	}
+	t.samples = make(map[string][]float64)
+	return r, events
+}
+
+// lagPercentile returns the nearest-rank percentile of sorted samples
+func lagPercentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// publishLagReport logs and publishes the ingest lag since the last flush
+// interval and the events of rooms that crossed the threshold
+func (h *MQTTHandler) publishLagReport() {
+	if h.lag == nil {
+		return
+	}
+	r, events := h.lag.report(time.Now())
+	for _, e := range events {
+		if e.State == "recovered" {
+			log.Printf("[EVENT] Ingest lag of room %s recovered (p95 %.1fs)", e.RoomID, e.P95Sec)
+		} else {
+			log.Printf("[WARN] Ingest lag of room %s: %s (p95 %.1fs, min %.1fs, threshold %.0fs)", e.RoomID, e.State, e.P95Sec, e.MinSec, e.ThresholdSec)
+		}
+	}
+	if len(r.Rooms) == 0 {
+		return
+	}
+	worst, worstP95 := "", math.Inf(-1)
+	for room, lag := range r.Rooms {
+		if lag.P95 > worstP95 {
+			worst, worstP95 = room, lag.P95
+		}
+	}
+	log.Printf("[STATS] Ingest lag of %d room(s), worst p95 %.1fs (%s)", len(r.Rooms), worstP95, worst)
+
+	if h.client == nil || !h.client.IsConnected() {
+		return
+	}
+	for _, e := range events {
+		h.publishStatus(dataQualityTopic, 1, e)
+	}
+	h.publishStatus(ingestLagTopic, 0, r)
+}
+
+// publishStatus publishes a JSON status message
+func (h *MQTTHandler) publishStatus(topic string, qos byte, v interface{}) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s message: %v", topic, err)
+		return
+	}
+	token := h.client.Publish(topic, qos, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// lifecycleTopics carry the gateway's retained decommissioning tombstones
+var lifecycleTopics = []string{"status/sensor/+", "status/room/+"}
+
+// LifecycleConfig records the gateway's tombstones for removed sensors and
+// rooms as end-of-life markers, one JSON line each in File, so historical
+// queries know when coverage ended. Tombstones are retained and redelivered
+// on every connect; each is recorded once.
+type LifecycleConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file,omitempty"` // default <OUTPUT_DIR>/lifecycle/end_of_life.jsonl
+}
+
+func (c *LifecycleConfig) normalize(config *Config) {
+	if c.File == "" {
+		c.File = filepath.Join(config.OutputDir, "lifecycle", "end_of_life.jsonl")
+	}
+}
+
+// EndOfLife is one line of the lifecycle ledger
+type EndOfLife struct {
+	Kind             string `json:"kind"`
+	ID               string `json:"id"`
+	GatewayID        string `json:"gateway_id"`
+	Status           string `json:"status"`
+	DecommissionedAt string `json:"decommissioned_at"`
+	RoomID           string `json:"room_id,omitempty"`
+	LastSeen         string `json:"last_seen,omitempty"`
+	RecordedAt       string `json:"recorded_at"`
+}
+
+func (e EndOfLife) key() string {
+	return fmt.Sprintf("%s/%s@%s", e.Kind, e.ID, e.DecommissionedAt)
+}
+
+// lifecycleLedger appends end-of-life markers not recorded before
+type lifecycleLedger struct {
+	path string
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+// openLifecycleLedger loads the markers already in the ledger
+func openLifecycleLedger(path string) (*lifecycleLedger, error) {
+	l := &lifecycleLedger{path: path, seen: make(map[string]bool)}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lifecycle ledger: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e EndOfLife
+		if json.Unmarshal(scanner.Bytes(), &e) == nil {
+			l.seen[e.key()] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read lifecycle ledger: %w", err)
+	}
+	log.Printf("Loaded %d end-of-life markers from %s", len(l.seen), path)
+	return l, nil
+}
+
+// record appends a tombstone payload; empty payloads (cleared tombstones of
+// re-added IDs) and markers already in the ledger are ignored
+func (l *lifecycleLedger) record(topic string, payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	var e EndOfLife
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return fmt.Errorf("invalid tombstone on %s: %w", topic, err)
+	}
+	if e.Kind == "" || e.ID == "" {
+		return fmt.Errorf("invalid tombstone on %s: kind and id are required", topic)
+	}
+	e.RecordedAt = time.Now().UTC().Format(time.RFC3339)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.seen[e.key()] {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to create lifecycle directory: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lifecycle ledger: %w", err)
+	}
+	defer f.Close()
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write lifecycle ledger: %w", err)
+	}
+	l.seen[e.key()] = true
+	log.Printf("[EVENT] Recorded end of life of %s %s (decommissioned %s)", e.Kind, e.ID, e.DecommissionedAt)
+	return nil
+}
+
+// subscribeLifecycle subscribes the ledger to the tombstone topics. They
+// are not shared between replicas: brokers do not deliver retained
+// messages to shared subscriptions, and every replica keeps its own ledger.
+func (h *MQTTHandler) subscribeLifecycle() error {
+	if h.lifecycle == nil {
+		return nil
+	}
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		if err := h.lifecycle.record(msg.Topic(), msg.Payload()); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+	}
+	for _, topic := range lifecycleTopics {
+		if token := h.client.Subscribe(topic, 1, handler); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", topic, token.Error())
+		}
+	}
+	return nil
+}
@@ -1,21 +1,20 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/xitongsys/parquet-go-source/local"
-	"github.com/xitongsys/parquet-go/parquet"
-	"github.com/xitongsys/parquet-go/source"
-	"github.com/xitongsys/parquet-go/writer"
 )
 
 // SensorTelemetry represents the downsampled sensor data structure
@@ -29,51 +28,94 @@ type SensorTelemetry struct {
 	MotionDetected  bool    `json:"motion_detected" parquet:"name=motion_detected, type=BOOLEAN"`
 	EnergyKWH       float64 `json:"energy_kwh" parquet:"name=energy_kwh, type=DOUBLE"`
 	AirQualityIndex float64 `json:"air_quality_index" parquet:"name=air_quality_index, type=DOUBLE"`
-	TimestampStr    string  `json:"timestamp"`                              // RFC3339 string from JSON
-	Timestamp       int64   `json:"-" parquet:"name=timestamp, type=INT64"` // Unix nano for Parquet
+	// Optional IAQ columns, null for rooms without particulate/TVOC sensors
+	PM25 *float64 `json:"pm25_ugm3" parquet:"name=pm25_ugm3, type=DOUBLE, repetitiontype=OPTIONAL"`
+	PM10 *float64 `json:"pm10_ugm3" parquet:"name=pm10_ugm3, type=DOUBLE, repetitiontype=OPTIONAL"`
+	TVOC *float64 `json:"tvoc_ppb" parquet:"name=tvoc_ppb, type=DOUBLE, repetitiontype=OPTIONAL"`
+	// Trace IDs from the gateway: one per message, and reading_traces is a
+	// JSON object mapping each sensor to the trace ID of its reading
+	TraceID       *string `json:"trace_id" parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	ReadingTraces *string `json:"-" parquet:"name=reading_traces, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	// Asset registry IDs from the gateway's id_mapping as JSON objects:
+	// external_ids maps system to the room's ID, sensor_external_ids maps
+	// each sensor to its IDs by system
+	ExternalIDs       *string `json:"-" parquet:"name=external_ids, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	SensorExternalIDs *string `json:"-" parquet:"name=sensor_external_ids, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	TimestampStr      string  `json:"timestamp"`                              // RFC3339 string from JSON
+	Timestamp         int64   `json:"-" parquet:"name=timestamp, type=INT64"` // Unix time for Parquet, see PARQUET_TIMESTAMP
+	// TimestampInt96 holds the timestamp column value in int96 mode
+	TimestampInt96 string `json:"-"`
 }
 
 // Config holds application configuration
 type Config struct {
-	MQTTBroker       string
-	MQTTPort         string
-	MQTTClientID     string
-	MQTTTopicPattern string
-	OutputDir        string
-	OutputFormat     string
-	FlushInterval    time.Duration
-	FileRotation     time.Duration
-}
-
-// ParquetWriter manages writing data to parquet files
-type ParquetWriter struct {
-	mu           sync.Mutex
-	currentFile  string
-	writer       *writer.ParquetWriter
-	fileWriter   source.ParquetFile
-	recordCount  int64
-	lastRotation time.Time
-	config       *Config
+	MQTTBroker string
+	MQTTPort   string
+	// MQTTFallbackBroker is the gateway's embedded broker (host:port), used
+	// while the central broker is down, with its credentials
+	MQTTFallbackBroker string
+	MQTTFallbackUser   string
+	MQTTFallbackPass   string
+	MQTTClientID       string
+	MQTTTopicPattern   string
+	MQTTSharedGroup    string
+	IngestPartitions   int
+	OutputDir          string
+	OutputFormat       string
+	FlushInterval      time.Duration
+	FileRotation       time.Duration
+	TimestampMode      string
+	PipelinesPath      string
+	RoomsPath          string
+	// Rooms is loaded from RoomsPath at startup
+	Rooms map[string]RoomMetadata
 }
 
 func loadConfig() *Config {
 	mqttBroker := getEnv("MQTT_BROKER", "nanomq")
 	mqttPort := getEnv("MQTT_PORT", "1883")
+	mqttFallbackBroker := getEnv("MQTT_FALLBACK_BROKER", "")
+	mqttFallbackUser := getEnv("MQTT_FALLBACK_USERNAME", "")
+	mqttFallbackPass := getEnv("MQTT_FALLBACK_PASSWORD", "")
+	mqttSharedGroup := getEnv("MQTT_SHARED_GROUP", "")
+	ingestPartitions := getEnvAsInt("INGEST_PARTITIONS", 1)
 	outputDir := getEnv("OUTPUT_DIR", "/data/parquet")
 	outputFormat := getEnv("OUTPUT_FORMAT", "parquet")
 	flushIntervalSec := getEnvAsInt("FLUSH_INTERVAL_SEC", 60)
 	fileRotationSec := getEnvAsInt("FILE_ROTATION_SEC", 300)
+	timestampMode := getEnv("PARQUET_TIMESTAMP", TimestampNanos)
+	pipelinesPath := getEnv("BRIDGE_CONFIG", "/app/config/bridge.yaml")
+	roomsPath := getEnv("ROOMS_CONFIG", "/app/config/rooms.yaml")
 
 	return &Config{
-		MQTTBroker:       mqttBroker,
-		MQTTPort:         mqttPort,
-		MQTTClientID:     "golang-bridge-" + fmt.Sprint(time.Now().Unix()),
-		MQTTTopicPattern: "ds_telemetry/#",
-		OutputDir:        outputDir,
-		OutputFormat:     outputFormat,
-		FlushInterval:    time.Duration(flushIntervalSec) * time.Second,
-		FileRotation:     time.Duration(fileRotationSec) * time.Second,
+		MQTTBroker:         mqttBroker,
+		MQTTPort:           mqttPort,
+		MQTTFallbackBroker: mqttFallbackBroker,
+		MQTTFallbackUser:   mqttFallbackUser,
+		MQTTFallbackPass:   mqttFallbackPass,
+		MQTTClientID:       "golang-bridge-" + fmt.Sprint(time.Now().Unix()),
+		MQTTTopicPattern:   "ds_telemetry/#",
+		MQTTSharedGroup:    mqttSharedGroup,
+		IngestPartitions:   ingestPartitions,
+		OutputDir:          outputDir,
+		OutputFormat:       outputFormat,
+		FlushInterval:      time.Duration(flushIntervalSec) * time.Second,
+		FileRotation:       time.Duration(fileRotationSec) * time.Second,
+		TimestampMode:      strings.ToLower(timestampMode),
+		PipelinesPath:      pipelinesPath,
+		RoomsPath:          roomsPath,
+	}
+}
+
+// SubscriptionTopic returns the topic filter to subscribe to for a pattern.
+// When a shared group is configured the filter is wrapped as
+// $share/<group>/<pattern> so the broker load-balances messages across
+// bridge replicas.
+func (c *Config) SubscriptionTopic(pattern string) string {
+	if c.MQTTSharedGroup == "" {
+		return pattern
 	}
+	return fmt.Sprintf("$share/%s/%s", c.MQTTSharedGroup, pattern)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -96,151 +138,96 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return value
 }
 
-// NewParquetWriter creates a new parquet writer
-func NewParquetWriter(config *Config) *ParquetWriter {
-	return &ParquetWriter{
-		config:       config,
-		lastRotation: time.Now(),
-	}
+// MQTTHandler handles MQTT connections and messages
+type MQTTHandler struct {
+	config      *Config
+	client      mqtt.Client
+	pipelines   []*Pipeline
+	throttle    *throttle
+	wg          sync.WaitGroup
+	partitions  []chan pipelineMessage
+	partitionWg sync.WaitGroup
+	done        chan struct{}
+	// uploader ships closed files to object storage, nil when disabled
+	uploader *uploader
+	// lifecycle records decommissioning tombstones, nil when disabled
+	lifecycle *lifecycleLedger
+	session   *sessionTracker
+	// recorder archives raw payloads, nil when disabled
+	recorder *rawRecorder
+	// lag tracks the per-room ingest lag, nil when disabled
+	lag *lagTracker
+	// broker is the URL of the broker of the latest connection attempt
+	broker atomic.Value
+	// handover tracks the return from the fallback broker
+	handover handover
 }
 
-// rotateFile closes the current file and creates a new one
-func (pw *ParquetWriter) rotateFile() error {
-	pw.mu.Lock()
-	defer pw.mu.Unlock()
-
-	log.Println("[DEBUG] rotateFile called")
-
-	// Close existing writer
-	if pw.writer != nil {
-		log.Printf("Closing current parquet file: %s (records: %d)", pw.currentFile, pw.recordCount)
-		if err := pw.writer.WriteStop(); err != nil {
-			log.Printf("[ERROR] WriteStop failed: %v", err)
-		}
-		if err := pw.fileWriter.Close(); err != nil {
-			log.Printf("[ERROR] Close failed: %v", err)
-		}
-		pw.writer = nil
-		pw.fileWriter = nil
-	}
-
-	// Create new file with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	filename := fmt.Sprintf("sensor_telemetry_%s.parquet", timestamp)
-	filepath := filepath.Join(pw.config.OutputDir, filename)
-
-	log.Printf("[DEBUG] Creating new parquet file: %s", filepath)
+// pipelineMessage is a message queued for one pipeline
+type pipelineMessage struct {
+	pipeline *Pipeline
+	msg      mqtt.Message
+	arrived  time.Time
+}
 
-	// Ensure output directory exists
-	if err := os.MkdirAll(pw.config.OutputDir, 0755); err != nil {
-		return fmt.Errorf("failed to create output directory: %w", err)
+func NewMQTTHandler(config *Config, file *BridgeFile) (*MQTTHandler, error) {
+	h := &MQTTHandler{
+		config:   config,
+		throttle: newThrottle(file.Throttle),
+		session:  newSessionTracker(file.Session),
+		done:     make(chan struct{}),
 	}
-
-	// Create new parquet file
-	fw, err := local.NewLocalFileWriter(filepath)
-	if err != nil {
-		return fmt.Errorf("failed to create parquet file: %w", err)
+	if file.Lag.Enabled {
+		h.lag = newLagTracker(file.Lag)
 	}
-	log.Println("[DEBUG] LocalFileWriter created successfully")
-
-	// Create parquet writer with compression
-	pw.fileWriter = fw
-	pw.writer, err = writer.NewParquetWriter(fw, new(SensorTelemetry), 4)
+	codecs, err := newCodecTable(file.Codecs)
 	if err != nil {
-		fw.Close()
-		return fmt.Errorf("failed to create parquet writer: %w", err)
+		return nil, err
 	}
-	log.Println("[DEBUG] ParquetWriter created successfully")
-
-	pw.writer.CompressionType = parquet.CompressionCodec_SNAPPY
-	pw.currentFile = filepath
-	pw.recordCount = 0
-	pw.lastRotation = time.Now()
-
-	log.Printf("Created new parquet file: %s", filepath)
-	return nil
-}
-
-// Write adds a record to the parquet file
-func (pw *ParquetWriter) Write(record *SensorTelemetry) error {
-	pw.mu.Lock()
-	defer pw.mu.Unlock()
-
-	log.Printf("[DEBUG] Write called, writer is nil: %v", pw.writer == nil)
-
-	// Initialize writer if needed
-	if pw.writer == nil {
-		pw.mu.Unlock()
-		log.Println("[DEBUG] Initializing new parquet file...")
-		if err := pw.rotateFile(); err != nil {
-			log.Printf("[ERROR] Failed to rotate file: %v", err)
-			return err
+	for _, pc := range file.Pipelines {
+		p, err := NewPipeline(pc, config)
+		if err != nil {
+			h.closePipelines()
+			return nil, err
 		}
-		pw.mu.Lock()
+		p.lag = h.lag
+		p.codecs = codecs
+		h.pipelines = append(h.pipelines, p)
 	}
-
-	log.Printf("[DEBUG] About to write record to parquet: room=%s", record.RoomID)
-
-	// Write record
-	if err := pw.writer.Write(record); err != nil {
-		return fmt.Errorf("failed to write record: %w", err)
+	if file.Lifecycle.Enabled {
+		ledger, err := openLifecycleLedger(file.Lifecycle.File)
+		if err != nil {
+			h.closePipelines()
+			return nil, err
+		}
+		h.lifecycle = ledger
 	}
-
-	pw.recordCount++
-	log.Printf("[DEBUG] Record written successfully, total records: %d", pw.recordCount)
-	return nil
-}
-
-// Flush flushes the writer buffer
-func (pw *ParquetWriter) Flush() error {
-	pw.mu.Lock()
-	defer pw.mu.Unlock()
-
-	if pw.writer != nil {
-		// Parquet writer doesn't have explicit flush, but WriteStop commits data
-		// We'll just log the current status
-		log.Printf("Current file: %s, Records written: %d", pw.currentFile, pw.recordCount)
+	if file.Recorder.Enabled {
+		recorder, err := newRawRecorder(&file.Recorder)
+		if err != nil {
+			h.closePipelines()
+			return nil, err
+		}
+		h.recorder = recorder
 	}
-	return nil
-}
-
-// CheckRotation checks if file rotation is needed
-func (pw *ParquetWriter) CheckRotation() error {
-	if time.Since(pw.lastRotation) >= pw.config.FileRotation {
-		log.Println("File rotation interval reached, rotating file...")
-		return pw.rotateFile()
+	if file.Upload.Enabled {
+		u, err := newUploader(&file.Upload, config, uploadRoots(file, config))
+		if err != nil {
+			h.closePipelines()
+			return nil, err
+		}
+		h.uploader = u
 	}
-	return nil
-}
-
-// Close closes the parquet writer
-func (pw *ParquetWriter) Close() error {
-	pw.mu.Lock()
-	defer pw.mu.Unlock()
 
-	if pw.writer != nil {
-		log.Printf("Final close: %s (records: %d)", pw.currentFile, pw.recordCount)
-		pw.writer.WriteStop()
-		pw.fileWriter.Close()
+	numPartitions := config.IngestPartitions
+	if numPartitions < 1 {
+		numPartitions = 1
 	}
-	return nil
-}
-
-// MQTTHandler handles MQTT connections and messages
-type MQTTHandler struct {
-	config        *Config
-	client        mqtt.Client
-	parquetWriter *ParquetWriter
-	wg            sync.WaitGroup
-	errorCount    int64
-	successCount  int64
-}
-
-func NewMQTTHandler(config *Config) *MQTTHandler {
-	return &MQTTHandler{
-		config:        config,
-		parquetWriter: NewParquetWriter(config),
+	h.partitions = make([]chan pipelineMessage, numPartitions)
+	for i := range h.partitions {
+		h.partitions[i] = make(chan pipelineMessage, 256)
 	}
+	return h, nil
 }
 
 var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
@@ -255,44 +242,46 @@ var connectLostHandler mqtt.ConnectionLostHandler = func(client mqtt.Client, err
 	log.Printf("Connection lost: %v", err)
 }
 
-func (h *MQTTHandler) messageHandler(client mqtt.Client, msg mqtt.Message) {
-	log.Printf("[DEBUG] Received message on topic: %s, payload length: %d", msg.Topic(), len(msg.Payload()))
-	log.Printf("[DEBUG] Payload: %s", string(msg.Payload()))
-
-	var telemetry SensorTelemetry
-
-	if err := json.Unmarshal(msg.Payload(), &telemetry); err != nil {
-		log.Printf("[ERROR] Failed to unmarshal JSON from %s: %v", msg.Topic(), err)
-		h.errorCount++
-		return
-	}
-
-	// Parse RFC3339 timestamp string to Unix nanoseconds
-	t, err := time.Parse(time.RFC3339, telemetry.TimestampStr)
-	if err != nil {
-		log.Printf("[ERROR] Failed to parse timestamp '%s' from %s: %v", telemetry.TimestampStr, msg.Topic(), err)
-		h.errorCount++
-		return
+// startPartitions launches one worker per ingest partition. Each worker drains
+// its own queue sequentially, so records for a given room are always written in
+// the order they were received.
+func (h *MQTTHandler) startPartitions() {
+	for i, queue := range h.partitions {
+		h.partitionWg.Add(1)
+		go func(id int, queue <-chan pipelineMessage) {
+			defer h.partitionWg.Done()
+			for pm := range queue {
+				pm.pipeline.Process(pm.msg, pm.arrived)
+			}
+			log.Printf("[DEBUG] Ingest partition %d drained", id)
+		}(i, queue)
 	}
-	telemetry.Timestamp = t.UnixNano()
-
-	log.Printf("[DEBUG] Unmarshaled telemetry: room_id=%s, temp=%.2f, timestamp=%d",
-		telemetry.RoomID, telemetry.Temperature, telemetry.Timestamp)
+	log.Printf("Started %d ingest partition(s)", len(h.partitions))
+}
 
-	// Write to parquet
-	if err := h.parquetWriter.Write(&telemetry); err != nil {
-		log.Printf("[ERROR] Failed to write to parquet: %v", err)
-		h.errorCount++
-		return
+// partitionFor maps a topic to a partition index by hashing its room ID (the
+// last topic level), keeping per-room ordering while spreading rooms across
+// workers.
+func (h *MQTTHandler) partitionFor(topic string) int {
+	key := topic
+	if idx := strings.LastIndex(topic, "/"); idx >= 0 && idx < len(topic)-1 {
+		key = topic[idx+1:]
 	}
+	hasher := fnv.New32a()
+	hasher.Write([]byte(key))
+	return int(hasher.Sum32() % uint32(len(h.partitions)))
+}
 
-	h.successCount++
-	if h.successCount%100 == 0 {
-		log.Printf("[STATS] Success: %d, Errors: %d, Success rate: %.2f%%",
-			h.successCount, h.errorCount,
-			float64(h.successCount)*100/float64(h.successCount+h.errorCount))
+// messageHandler returns the subscription callback for a pipeline; it only
+// enqueues so the paho router is never blocked on sink I/O
+func (h *MQTTHandler) messageHandler(p *Pipeline) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if h.handover.duplicate(msg) {
+			return
+		}
+		h.session.delivered()
+		h.enqueue(p, msg)
 	}
-	log.Printf("[SUCCESS] Written record for room %s at %d", telemetry.RoomID, telemetry.Timestamp)
 }
 
 func (h *MQTTHandler) Connect() error {
@@ -300,12 +289,28 @@ func (h *MQTTHandler) Connect() error {
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
-	opts.SetClientID(h.config.MQTTClientID)
+	if h.config.MQTTFallbackBroker != "" {
+		opts.AddBroker(h.config.fallbackBrokerURL())
+	}
+	opts.SetConnectionAttemptHandler(func(u *url.URL, cfg *tls.Config) *tls.Config {
+		h.broker.Store(u.Redacted())
+		return cfg
+	})
+	opts.SetClientID(h.session.config.clientID(h.config))
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		connectHandler(client)
+		h.onConnect(client)
+	})
 	opts.SetDefaultPublishHandler(messagePubHandler)
-	opts.OnConnect = connectHandler
-	opts.OnConnectionLost = connectLostHandler
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		connectLostHandler(client, err)
+		h.session.lost(err)
+	})
+	opts.SetReconnectingHandler(func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		h.session.reconnecting(opts)
+	})
 	opts.SetAutoReconnect(true)
-	opts.SetCleanSession(true)
+	opts.SetCleanSession(!h.session.config.Persistent)
 
 	h.client = mqtt.NewClient(opts)
 
@@ -314,16 +319,50 @@ func (h *MQTTHandler) Connect() error {
 		return fmt.Errorf("failed to connect to MQTT broker: %w", token.Error())
 	}
 
-	log.Printf("Subscribing to topic: %s", h.config.MQTTTopicPattern)
-	if token := h.client.Subscribe(h.config.MQTTTopicPattern, 1, h.messageHandler); token.Wait() && token.Error() != nil {
-		return fmt.Errorf("failed to subscribe to topic: %w", token.Error())
+	h.startPartitions()
+	return h.subscribe()
+}
+
+// subscribe subscribes every pipeline to its topic
+func (h *MQTTHandler) subscribe() error {
+	for _, p := range h.pipelines {
+		topic := p.config.Topic
+		if h.onFallback() {
+			topic = p.config.FallbackTopic
+		}
+		topic = h.config.SubscriptionTopic(topic)
+		log.Printf("Subscribing pipeline %s to topic: %s", p.config.Name, topic)
+		if token := h.client.Subscribe(topic, 1, h.messageHandler(p)); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe pipeline %s to %s: %w", p.config.Name, topic, token.Error())
+		}
+	}
+	if err := h.subscribeLifecycle(); err != nil {
+		return err
+	}
+	if err := h.subscribeRecorder(); err != nil {
+		return err
 	}
+	if err := h.subscribeSpoolState(); err != nil {
+		return err
+	}
+	h.handover.subscribed()
 
-	log.Println("Successfully subscribed to downsampled topics")
+	log.Printf("Successfully subscribed %d pipeline(s) on %v", len(h.pipelines), h.broker.Load())
 	return nil
 }
 
+// onFallback reports whether the latest connection is to the fallback broker
+func (h *MQTTHandler) onFallback() bool {
+	current, _ := h.broker.Load().(string)
+	return h.config.MQTTFallbackBroker != "" && strings.HasSuffix(current, h.config.MQTTFallbackBroker)
+}
+
 func (h *MQTTHandler) StartPeriodicTasks() {
+	if h.uploader != nil {
+		h.wg.Add(1)
+		go h.uploader.run(h.done, &h.wg)
+	}
+
 	// Periodic flush
 	h.wg.Add(1)
 	go func() {
@@ -331,12 +370,23 @@ func (h *MQTTHandler) StartPeriodicTasks() {
 		ticker := time.NewTicker(h.config.FlushInterval)
 		defer ticker.Stop()
 
-		for range ticker.C {
-			if err := h.parquetWriter.Flush(); err != nil {
-				log.Printf("Error flushing writer: %v", err)
-			}
-			if err := h.parquetWriter.CheckRotation(); err != nil {
-				log.Printf("Error checking rotation: %v", err)
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				for _, p := range h.pipelines {
+					p.Flush()
+				}
+				if h.recorder != nil {
+					h.recorder.flush()
+				}
+				h.publishShedReport()
+				h.publishLagReport()
+				h.publishDeliveryReport()
+				if h.config.MQTTFallbackBroker != "" {
+					h.returnToPrimary()
+				}
 			}
 		}
 	}()
@@ -349,22 +399,67 @@ func (h *MQTTHandler) Close() {
 		h.client.Disconnect(250)
 	}
 
-	if h.parquetWriter != nil {
-		h.parquetWriter.Close()
+	// Stop periodic flushes, then drain queued messages before the sinks
+	// are finalized
+	close(h.done)
+	h.wg.Wait()
+	for _, queue := range h.partitions {
+		close(queue)
 	}
+	h.partitionWg.Wait()
 
-	h.wg.Wait()
+	h.closePipelines()
+	if h.recorder != nil {
+		h.recorder.Close()
+	}
+	if h.uploader != nil {
+		h.uploader.finalPass()
+	}
 	log.Println("MQTT handler closed")
 }
 
+func (h *MQTTHandler) closePipelines() {
+	for _, p := range h.pipelines {
+		p.Close()
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "inspect":
+			os.Exit(runInspect(os.Args[2:]))
+		case "tail":
+			os.Exit(runTail(os.Args[2:]))
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "healthcheck":
+			os.Exit(runHealthcheck(os.Args[2:]))
+		}
+	}
+
 	log.Println("Starting Parquet Golang Bridge...")
 
 	config := loadConfig()
-	log.Printf("Configuration: Broker=%s:%s, OutputDir=%s, Format=%s",
-		config.MQTTBroker, config.MQTTPort, config.OutputDir, config.OutputFormat)
+	log.Printf("Configuration: Broker=%s:%s, Pipelines=%s, Partitions=%d, OutputDir=%s, Format=%s, Timestamp=%s",
+		config.MQTTBroker, config.MQTTPort, config.PipelinesPath, config.IngestPartitions,
+		config.OutputDir, config.OutputFormat, config.TimestampMode)
+
+	rooms, err := loadRoomMetadata(config.RoomsPath)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config.Rooms = rooms
 
-	handler := NewMQTTHandler(config)
+	bridgeFile, err := loadBridgeFile(config.PipelinesPath, config)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	handler, err := NewMQTTHandler(config, bridgeFile)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	if err := handler.Connect(); err != nil {
 		log.Fatalf("Failed to connect: %v", err)
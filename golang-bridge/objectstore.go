@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// checksumMetaHeader stores the SHA-256 of the whole file on every object,
+// so an existing object can be compared with a local file without
+// downloading it
+const checksumMetaHeader = "x-amz-meta-sha256"
+
+// errNoSuchUpload is returned when a multipart upload no longer exists
+// (completed, aborted or expired by a lifecycle rule)
+var errNoSuchUpload = errors.New("multipart upload not found")
+
+// objectStore is a minimal S3-compatible client (AWS S3, MinIO, and Google
+// Cloud Storage through its XML API with HMAC keys). Requests are signed
+// with AWS Signature Version 4 including the payload hash, so the store
+// rejects any body that does not match the checksum it was sent with.
+type objectStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	client    *http.Client
+}
+
+func newObjectStore(c *UploadConfig) (*objectStore, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("upload: invalid endpoint %q", c.Endpoint)
+	}
+	return &objectStore{
+		endpoint:  u,
+		bucket:    c.Bucket,
+		region:    c.Region,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		pathStyle: c.PathStyle,
+		client:    &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+// objectURL returns the URL of an object in the bucket
+func (s *objectStore) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	p := "/" + key
+	if s.pathStyle {
+		p = "/" + s.bucket + p
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = p
+	u.RawPath = s3Escape(p, true)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+// do signs and sends one request. body may be nil; payloadHash is the hex
+// SHA-256 of the body.
+func (s *objectStore) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if body == nil {
+		payloadHash = emptyPayloadHash
+	}
+	s.sign(req, payloadHash, time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds the Signature Version 4 headers. Every header already set on
+// the request is signed along with the host.
+func (s *objectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		values[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// headObject returns the size and stored checksum of an object; exists is
+// false when there is no object at key
+func (s *objectStore) headObject(ctx context.Context, key string) (size int64, checksum string, exists bool, err error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return 0, "", false, fmt.Errorf("failed to check object %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", false, fmt.Errorf("failed to check object %s: %s", key, resp.Status)
+	}
+	return resp.ContentLength, resp.Header.Get(checksumMetaHeader), true, nil
+}
+
+// putObject uploads a whole object in one request
+func (s *objectStore) putObject(ctx context.Context, key string, body io.Reader, size int64, checksum string) error {
+	header := http.Header{}
+	header.Set(checksumMetaHeader, checksum)
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, body, size, checksum)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "upload "+key)
+}
+
+// createMultipartUpload starts a multipart upload and returns its ID. The
+// whole-file checksum is stored on the object once the upload completes.
+func (s *objectStore) createMultipartUpload(ctx context.Context, key, checksum string) (string, error) {
+	header := http.Header{}
+	header.Set(checksumMetaHeader, checksum)
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, header, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return "", fmt.Errorf("failed to start multipart upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "start multipart upload of "+key); err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("failed to parse multipart upload of %s: %v", key, err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart uploads one part and returns its ETag
+func (s *objectStore) uploadPart(ctx context.Context, key, uploadID string, number int, body io.Reader, size int64, checksum string) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {uploadID}}
+	resp, err := s.do(ctx, http.MethodPut, key, query, nil, body, size, checksum)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d of %s: %w", number, key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errNoSuchUpload
+	}
+	if err := checkResponse(resp, fmt.Sprintf("upload part %d of %s", number, key)); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+// objectPart is an uploaded part of a multipart upload
+type objectPart struct {
+	Number int    `xml:"PartNumber"`
+	ETag   string `xml:"ETag"`
+	Size   int64  `xml:"Size"`
+}
+
+// listParts returns the parts the store holds for a multipart upload
+func (s *objectStore) listParts(ctx context.Context, key, uploadID string) (map[int]objectPart, error) {
+	parts := make(map[int]objectPart)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		resp, err := s.do(ctx, http.MethodGet, key, query, nil, nil, 0, emptyPayloadHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list parts of %s: %w", key, err)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return nil, errNoSuchUpload
+		}
+		if err := checkResponse(resp, "list parts of "+key); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Parts       []objectPart `xml:"Part"`
+			IsTruncated bool         `xml:"IsTruncated"`
+			NextMarker  string       `xml:"NextPartNumberMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parts of %s: %w", key, err)
+		}
+		for _, part := range result.Parts {
+			parts[part.Number] = part
+		}
+		if !result.IsTruncated || result.NextMarker == "" {
+			return parts, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// completeMultipartUpload assembles the parts into the object. The object
+// only becomes visible once this succeeds.
+func (s *objectStore) completeMultipartUpload(ctx context.Context, key, uploadID string, parts []objectPart) error {
+	type completePart struct {
+		Number int    `xml:"PartNumber"`
+		ETag   string `xml:"ETag"`
+	}
+	request := struct {
+		XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+		Parts   []completePart `xml:"Part"`
+	}{}
+	for _, part := range parts {
+		request.Parts = append(request.Parts, completePart{Number: part.Number, ETag: part.ETag})
+	}
+	body, err := xml.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parts of %s: %w", key, err)
+	}
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, bytes.NewReader(body), int64(len(body)), sha256Hex(body))
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoSuchUpload
+	}
+	if err := checkResponse(resp, "complete upload of "+key); err != nil {
+		return err
+	}
+	// S3 may report a failure in the body of a 200 response
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("failed to complete upload of %s: %w", key, err)
+	}
+	if code := errorCode(data); code != "" {
+		return fmt.Errorf("failed to complete upload of %s: %s", key, code)
+	}
+	return nil
+}
+
+// abortMultipartUpload discards an unfinished upload and its parts
+func (s *objectStore) abortMultipartUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return fmt.Errorf("failed to abort upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return checkResponse(resp, "abort upload of "+key)
+}
+
+// checkResponse turns a non-2xx response into an error carrying the S3
+// error code
+func checkResponse(resp *http.Response, action string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if code := errorCode(data); code != "" {
+		return fmt.Errorf("failed to %s: %s (%s)", action, resp.Status, code)
+	}
+	return fmt.Errorf("failed to %s: %s", action, resp.Status)
+}
+
+// errorCode returns the code of an S3 <Error> document, or "" if data is not
+// one
+func errorCode(data []byte) string {
+	var doc struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &doc) != nil || doc.XMLName.Local != "Error" {
+		return ""
+	}
+	if doc.Message != "" {
+		return doc.Code + ": " + doc.Message
+	}
+	return doc.Code
+}
+
+// s3Escape percent-encodes everything except unreserved characters (and
+// slashes in paths), as Signature Version 4 requires
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', keepSlash && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query parameters sorted by name
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v3"
+)
+
+// BridgeFile is the optional YAML pipeline configuration. Without it the
+// bridge runs a single ds_telemetry → Parquet pipeline configured from the
+// environment.
+type BridgeFile struct {
+	Pipelines []PipelineConfig   `yaml:"pipelines"`
+	Schemas   []SchemaDefinition `yaml:"schemas"`
+	Throttle  ThrottleConfig     `yaml:"throttle"`
+	Upload    UploadConfig       `yaml:"upload"`
+	Lifecycle LifecycleConfig    `yaml:"lifecycle"`
+	Session   SessionConfig      `yaml:"session"`
+	Recorder  RecorderConfig     `yaml:"recorder"`
+	Lag       LagConfig          `yaml:"lag"`
+	Codecs    []CodecConfig      `yaml:"codecs"`
+}
+
+// PipelineConfig routes one topic pattern through transforms into sinks
+type PipelineConfig struct {
+	Name       string            `yaml:"name"`
+	Topic      string            `yaml:"topic"`
+	Schema     string            `yaml:"schema,omitempty"`   // telemetry (default), raw or a registry schema
+	Priority   string            `yaml:"priority,omitempty"` // critical, normal (default) or low
+	Transforms []TransformConfig `yaml:"transforms,omitempty"`
+	Sinks      []SinkConfig      `yaml:"sinks"`
+
+	// FallbackTopic is subscribed instead of Topic while the bridge runs on
+	// the gateway's fallback broker, which only carries what the gateway
+	// publishes; ds_telemetry/... topics default to their telemetry/...
+	// counterpart
+	FallbackTopic string `yaml:"fallback_topic,omitempty"`
+}
+
+// TransformConfig is one record transform:
+//   - rename: fields maps old → new field names
+//   - drop: names lists fields to remove
+//   - set: values adds constant fields (e.g. site or building tags)
+//   - topic_level: copies topic level `level` (0-based) into `field`
+//   - delta: rebuilds full rows from the gateway's delta-published telemetry,
+//     keyed by `field` (default room_id)
+type TransformConfig struct {
+	Type   string                 `yaml:"type"`
+	Fields map[string]string      `yaml:"fields,omitempty"`
+	Names  []string               `yaml:"names,omitempty"`
+	Values map[string]interface{} `yaml:"values,omitempty"`
+	Field  string                 `yaml:"field,omitempty"`
+	Level  int                    `yaml:"level,omitempty"`
+}
+
+// Record is a decoded MQTT message flowing through a pipeline. Fields is
+// nil when the payload is not a JSON object.
+type Record struct {
+	Topic    string
+	Payload  []byte
+	Received time.Time
+	Fields   map[string]interface{}
+	// Key is the dedup key of a record written to an effectively_once sink
+	Key string
+}
+
+// transform modifies a record in place; returning false drops the record
+type transform func(rec *Record) bool
+
+// Pipeline is a running pipeline with its transforms and sinks
+type Pipeline struct {
+	config       PipelineConfig
+	schema       parquetSchema
+	transforms   []transform
+	sinks        []Sink
+	successCount int64
+	errorCount   int64
+	// lag tracks the ingest lag of records, nil when disabled
+	lag *lagTracker
+	// codecs picks the payload codec of each topic
+	codecs *codecTable
+}
+
+// loadBridgeFile reads the pipeline file, falling back to the default
+// ds_telemetry pipeline when it does not exist
+func loadBridgeFile(path string, config *Config) (*BridgeFile, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No pipeline config at %s, using the default Parquet pipeline", path)
+		return &BridgeFile{Pipelines: []PipelineConfig{defaultPipeline(config)}}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline config: %w", err)
+	}
+
+	var file BridgeFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+	if len(file.Pipelines) == 0 {
+		return nil, fmt.Errorf("pipeline config %s defines no pipelines", path)
+	}
+	if err := registerSchemas(file.Schemas); err != nil {
+		return nil, err
+	}
+	if err := file.Throttle.normalize(); err != nil {
+		return nil, err
+	}
+	if err := file.Upload.normalize(config); err != nil {
+		return nil, err
+	}
+	file.Lifecycle.normalize(config)
+	if err := file.Session.normalize(); err != nil {
+		return nil, err
+	}
+	if err := file.Lag.normalize(); err != nil {
+		return nil, err
+	}
+	if file.Recorder.Enabled {
+		if err := file.Recorder.normalize(config); err != nil {
+			return nil, err
+		}
+		// The MQTT client keeps one handler per topic filter
+		for _, topic := range file.Recorder.Topics {
+			for _, pc := range file.Pipelines {
+				if pc.Topic == topic {
+					return nil, fmt.Errorf("recorder: topic %s is also the topic of pipeline %s; use a wider filter such as #", topic, pc.Name)
+				}
+			}
+		}
+	}
+	return &file, nil
+}
+
+// defaultPipeline reproduces the bridge's original behaviour
+func defaultPipeline(config *Config) PipelineConfig {
+	return PipelineConfig{
+		Name:   "ds_telemetry",
+		Topic:  config.MQTTTopicPattern,
+		Schema: SchemaTelemetry,
+		Sinks: []SinkConfig{{
+			Type:        "parquet",
+			OutputDir:   config.OutputDir,
+			FilePrefix:  "sensor_telemetry",
+			RotationSec: int(config.FileRotation / time.Second),
+			Timestamp:   config.TimestampMode,
+		}},
+	}
+}
+
+// NewPipeline validates a pipeline and opens its sinks
+func NewPipeline(pc PipelineConfig, config *Config) (*Pipeline, error) {
+	if pc.Name == "" {
+		return nil, errors.New("pipeline name is required")
+	}
+	if pc.Topic == "" {
+		return nil, fmt.Errorf("pipeline %s: topic is required", pc.Name)
+	}
+	if pc.FallbackTopic == "" {
+		if rest, ok := strings.CutPrefix(pc.Topic, "ds_telemetry/"); ok {
+			pc.FallbackTopic = "telemetry/" + rest
+		} else {
+			pc.FallbackTopic = pc.Topic
+		}
+	}
+	if pc.Schema == "" {
+		pc.Schema = SchemaTelemetry
+	}
+	schema, ok := parquetSchemas[pc.Schema]
+	if !ok {
+		return nil, fmt.Errorf("pipeline %s: unknown schema %q", pc.Name, pc.Schema)
+	}
+	if pc.Priority == "" {
+		pc.Priority = PriorityNormal
+	}
+	if !validPriority(pc.Priority) {
+		return nil, fmt.Errorf("pipeline %s: unknown priority %q", pc.Name, pc.Priority)
+	}
+	if len(pc.Sinks) == 0 {
+		return nil, fmt.Errorf("pipeline %s: at least one sink is required", pc.Name)
+	}
+
+	p := &Pipeline{config: pc, schema: schema}
+	for i, tc := range pc.Transforms {
+		t, err := buildTransform(tc)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: transform %d: %w", pc.Name, i, err)
+		}
+		p.transforms = append(p.transforms, t)
+	}
+	for i, sc := range pc.Sinks {
+		sink, err := newSink(pc, sc, config)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("pipeline %s: sink %d: %w", pc.Name, i, err)
+		}
+		delivery, err := newDeliverySink(pc, i, sc, sink, config)
+		if err != nil {
+			sink.Close()
+			p.Close()
+			return nil, fmt.Errorf("pipeline %s: sink %d: %w", pc.Name, i, err)
+		}
+		sink = delivery
+		p.sinks = append(p.sinks, sink)
+	}
+	log.Printf("Pipeline %s: topic=%s schema=%s priority=%s transforms=%d sinks=%d",
+		pc.Name, pc.Topic, pc.Schema, pc.Priority, len(p.transforms), len(p.sinks))
+	return p, nil
+}
+
+func buildTransform(tc TransformConfig) (transform, error) {
+	switch tc.Type {
+	case "rename":
+		if len(tc.Fields) == 0 {
+			return nil, errors.New("rename requires fields")
+		}
+		return func(rec *Record) bool {
+			for from, to := range tc.Fields {
+				if v, ok := rec.Fields[from]; ok {
+					delete(rec.Fields, from)
+					rec.Fields[to] = v
+				}
+			}
+			return true
+		}, nil
+	case "drop":
+		if len(tc.Names) == 0 {
+			return nil, errors.New("drop requires names")
+		}
+		return func(rec *Record) bool {
+			for _, name := range tc.Names {
+				delete(rec.Fields, name)
+			}
+			return true
+		}, nil
+	case "set":
+		if len(tc.Values) == 0 {
+			return nil, errors.New("set requires values")
+		}
+		return func(rec *Record) bool {
+			for k, v := range tc.Values {
+				rec.Fields[k] = v
+			}
+			return true
+		}, nil
+	case "topic_level":
+		if tc.Field == "" || tc.Level < 0 {
+			return nil, errors.New("topic_level requires field and a non-negative level")
+		}
+		return func(rec *Record) bool {
+			levels := strings.Split(rec.Topic, "/")
+			if tc.Level < len(levels) {
+				rec.Fields[tc.Field] = levels[tc.Level]
+			}
+			return true
+		}, nil
+	case "delta":
+		key := tc.Field
+		if key == "" {
+			key = "room_id"
+		}
+		return newDeltaDecoder(key).apply, nil
+	default:
+		return nil, fmt.Errorf("unknown transform type %q", tc.Type)
+	}
+}
+
+// Process decodes a message, applies the transforms and writes the record to
+// every sink. Gzip payloads are decompressed, then decoded with the topic's
+// codec; JSON constrained-link batches are split into one record per room.
+// arrived is when the bridge received the message.
+func (p *Pipeline) Process(msg mqtt.Message, arrived time.Time) {
+	log.Printf("[DEBUG] [%s] Received message on topic: %s, payload length: %d", p.config.Name, msg.Topic(), len(msg.Payload()))
+	log.Printf("[DEBUG] Payload: %s", string(msg.Payload()))
+
+	payload, err := decodePayload(msg.Payload())
+	if err != nil {
+		log.Printf("[ERROR] [%s] Failed to decompress payload from %s: %v", p.config.Name, msg.Topic(), err)
+		atomic.AddInt64(&p.errorCount, 1)
+		return
+	}
+	codec := p.codecs.forTopic(msg.Topic())
+	if _, isJSON := codec.(jsonCodec); isJSON {
+		if rooms, ok := splitBatch(payload); ok {
+			base := strings.SplitN(msg.Topic(), "/", 2)[0]
+			for _, room := range rooms {
+				p.processRecord(base+"/"+batchRoomID(room), room, codec, arrived, msg.Retained())
+			}
+			return
+		}
+	}
+	p.processRecord(msg.Topic(), payload, codec, arrived, msg.Retained())
+}
+
+func (p *Pipeline) processRecord(topic string, payload []byte, codec Codec, arrived time.Time, retained bool) {
+	rec := &Record{
+		Topic:    topic,
+		Payload:  payload,
+		Received: time.Now(),
+	}
+	fields, err := codec.Decode(topic, payload)
+	if err != nil {
+		if p.config.Schema != SchemaRaw {
+			log.Printf("[ERROR] [%s] Failed to decode %s payload from %s: %v", p.config.Name, codec.Name(), topic, err)
+			atomic.AddInt64(&p.errorCount, 1)
+			return
+		}
+		fields = nil
+	}
+	rec.Fields = fields
+	if rec.Fields != nil && !retained {
+		// A retained message may be arbitrarily old, so it says nothing
+		// about the lag
+		p.lag.observe(rec, arrived)
+	}
+	if rec.Fields != nil {
+		for _, t := range p.transforms {
+			if !t(rec) {
+				log.Printf("[DEBUG] [%s] Record from %s dropped by transform", p.config.Name, topic)
+				return
+			}
+		}
+	}
+	if p.schema.validate != nil {
+		if err := p.schema.validate(rec); err != nil {
+			log.Printf("[ERROR] [%s] Invalid record from %s: %v", p.config.Name, topic, err)
+			atomic.AddInt64(&p.errorCount, 1)
+			return
+		}
+	}
+
+	failed := false
+	for _, sink := range p.sinks {
+		if err := sink.Write(rec); err != nil {
+			log.Printf("[ERROR] [%s] %s sink: %v", p.config.Name, sink.Name(), err)
+			failed = true
+		}
+	}
+	if failed {
+		atomic.AddInt64(&p.errorCount, 1)
+		return
+	}
+
+	successCount := atomic.AddInt64(&p.successCount, 1)
+	if successCount%100 == 0 {
+		errorCount := atomic.LoadInt64(&p.errorCount)
+		log.Printf("[STATS] [%s] Success: %d, Errors: %d, Success rate: %.2f%%",
+			p.config.Name, successCount, errorCount,
+			float64(successCount)*100/float64(successCount+errorCount))
+	}
+	log.Printf("[SUCCESS] [%s] Written record from %s", p.config.Name, topic)
+}
+
+// Flush runs the periodic flush and rotation of every sink
+func (p *Pipeline) Flush() {
+	for _, sink := range p.sinks {
+		if err := sink.Flush(); err != nil {
+			log.Printf("[ERROR] [%s] Error flushing %s sink: %v", p.config.Name, sink.Name(), err)
+		}
+	}
+}
+
+// Close closes every sink
+func (p *Pipeline) Close() {
+	for _, sink := range p.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("[ERROR] [%s] Error closing %s sink: %v", p.config.Name, sink.Name(), err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// fieldConversion converts a telemetry field from the gateway's canonical
+// unit: value*scale + offset
+type fieldConversion struct {
+	unit   string
+	scale  float64
+	offset float64
+}
+
+// sinkProfiles are the output profiles a sink can write in, by telemetry
+// field. They assume the gateway's default canonical units (°C, lx, Pa,
+// m3/h, L/min, m3 and mm/s); "si" writes the fields unchanged.
+var sinkProfiles = map[string]map[string]fieldConversion{
+	"si": {},
+	"imperial": {
+		"temperature":        {unit: "[degF]", scale: 9.0 / 5, offset: 32},
+		"light_lux":          {unit: "[ft_i]-2.[cd_i]", scale: 1 / 10.7639},
+		"static_pressure_pa": {unit: "[in_i'H2O]", scale: 1 / 249.0889},
+		"air_flow":           {unit: "[ft_i]3/min", scale: 1 / 1.699011},
+		"water_flow":         {unit: "[gal_us]/min", scale: 1 / 3.785411784},
+		"water_volume_m3":    {unit: "[gal_us]", scale: 1 / 0.003785411784},
+		"vibration_rms":      {unit: "[in_i]/s", scale: 1 / 25.4},
+		"vibration_peak":     {unit: "[in_i]/s", scale: 1 / 25.4},
+	},
+}
+
+// unitsSink converts the decoded fields of every record to an output
+// profile before handing it to the sink it wraps, so one pipeline can keep
+// the archive in SI while feeding an imperial dashboard index. Converted
+// records carry a "units" object naming the unit of each converted field.
+type unitsSink struct {
+	Sink
+	conversions map[string]fieldConversion
+}
+
+func newUnitsSink(pc PipelineConfig, sc SinkConfig, config *Config) (Sink, error) {
+	conversions, ok := sinkProfiles[sc.Units]
+	if !ok {
+		names := make([]string, 0, len(sinkProfiles))
+		for name := range sinkProfiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown units profile %q (known: %s)", sc.Units, strings.Join(names, ", "))
+	}
+	sc.Units = ""
+	sink, err := newSink(pc, sc, config)
+	if err != nil || len(conversions) == 0 {
+		return sink, err
+	}
+	return &unitsSink{Sink: sink, conversions: conversions}, nil
+}
+
+// Write converts a copy of the record; the record itself is shared with
+// the pipeline's other sinks
+func (s *unitsSink) Write(rec *Record) error {
+	if rec.Fields == nil {
+		return s.Sink.Write(rec)
+	}
+	converted := *rec
+	converted.Fields = make(map[string]interface{}, len(rec.Fields)+1)
+	units := make(map[string]interface{})
+	for name, v := range rec.Fields {
+		if c, ok := s.conversions[name]; ok {
+			if f, ok := v.(float64); ok {
+				v = f*c.scale + c.offset
+				units[name] = c.unit
+			}
+		}
+		converted.Fields[name] = v
+	}
+	if len(units) > 0 {
+		converted.Fields["units"] = units
+	}
+	return s.Sink.Write(&converted)
+}
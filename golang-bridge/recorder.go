@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// rawSegmentMagic starts the uncompressed stream of every raw segment
+var rawSegmentMagic = []byte("SBRAW\x01")
+
+const rawSegmentExt = ".seg.gz"
+
+// RecorderConfig archives every received MQTT payload verbatim, for
+// auditors who require the original telemetry stream. Messages are recorded
+// on arrival, before throttling, decoding or transforms, into gzip segment
+// files <dir>/raw-<start>.seg.gz. Each segment holds the magic "SBRAW\x01"
+// followed by records of
+//
+//	uint64 receive time (Unix ns) | uint8 flags (bit 0 retained, bits 1-2
+//	QoS) | uint16 topic length | topic | uint32 payload length | payload
+//
+// all integers big-endian. Segments are closed after SegmentSec or SegmentMB
+// of payload and removed after RetentionDays, oldest first beyond MaxTotalMB.
+type RecorderConfig struct {
+	Enabled       bool     `yaml:"enabled"`
+	Topics        []string `yaml:"topics,omitempty"` // default ["#"]
+	Dir           string   `yaml:"dir,omitempty"`    // default <OUTPUT_DIR>/raw
+	SegmentSec    int      `yaml:"segment_sec,omitempty"`
+	SegmentMB     int      `yaml:"segment_mb,omitempty"`
+	RetentionDays int      `yaml:"retention_days,omitempty"` // 0 keeps segments forever
+	MaxTotalMB    int      `yaml:"max_total_mb,omitempty"`   // 0 is unlimited
+}
+
+func (c *RecorderConfig) normalize(config *Config) error {
+	if len(c.Topics) == 0 {
+		c.Topics = []string{"#"}
+	}
+	if c.Dir == "" {
+		c.Dir = filepath.Join(config.OutputDir, "raw")
+	}
+	if c.SegmentSec <= 0 {
+		c.SegmentSec = 3600
+	}
+	if c.SegmentMB <= 0 {
+		c.SegmentMB = 64
+	}
+	if c.RetentionDays < 0 || c.MaxTotalMB < 0 {
+		return fmt.Errorf("recorder: retention_days and max_total_mb must not be negative")
+	}
+	return nil
+}
+
+// rawRecorder writes the current segment
+type rawRecorder struct {
+	config *RecorderConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	zw      *gzip.Writer
+	w       *bufio.Writer
+	path    string
+	opened  time.Time
+	written int64
+	records int64
+}
+
+func newRawRecorder(config *RecorderConfig) (*rawRecorder, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recorder directory: %w", err)
+	}
+	r := &rawRecorder{config: config}
+	r.enforceRetention()
+	return r, nil
+}
+
+// record appends one message, rotating the segment when it is due
+func (r *rawRecorder) record(msg mqtt.Message) {
+	now := time.Now()
+	topic, payload := msg.Topic(), msg.Payload()
+	if len(topic) > 0xFFFF {
+		log.Printf("[ERROR] Recorder: topic too long, message not archived")
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file != nil && (now.Sub(r.opened) >= time.Duration(r.config.SegmentSec)*time.Second || r.written >= int64(r.config.SegmentMB)<<20) {
+		r.closeLocked()
+		r.enforceRetention()
+	}
+	if r.file == nil {
+		if err := r.openLocked(now); err != nil {
+			log.Printf("[ERROR] Recorder: %v", err)
+			return
+		}
+	}
+
+	var flags byte
+	if msg.Retained() {
+		flags |= 1
+	}
+	flags |= (msg.Qos() & 0x03) << 1
+	header := make([]byte, 0, 15)
+	header = binary.BigEndian.AppendUint64(header, uint64(now.UnixNano()))
+	header = append(header, flags)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(topic)))
+	r.w.Write(header)
+	r.w.WriteString(topic)
+	r.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(payload))))
+	if _, err := r.w.Write(payload); err != nil {
+		log.Printf("[ERROR] Recorder: failed to write %s: %v", r.path, err)
+		return
+	}
+	r.written += int64(len(header) + len(topic) + 4 + len(payload))
+	r.records++
+}
+
+func (r *rawRecorder) openLocked(now time.Time) error {
+	path := filepath.Join(r.config.Dir, fmt.Sprintf("raw-%s%s", now.UTC().Format("20060102T150405.000Z"), rawSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	r.file, r.path, r.opened = f, path, now
+	r.zw = gzip.NewWriter(f)
+	r.w = bufio.NewWriterSize(r.zw, 64<<10)
+	r.written, r.records = 0, 0
+	r.w.Write(rawSegmentMagic)
+	return nil
+}
+
+func (r *rawRecorder) closeLocked() {
+	if r.file == nil {
+		return
+	}
+	err := r.w.Flush()
+	if zerr := r.zw.Close(); err == nil {
+		err = zerr
+	}
+	if ferr := r.file.Close(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		log.Printf("[ERROR] Recorder: failed to close %s: %v", r.path, err)
+	} else {
+		log.Printf("Recorder: closed %s (%d messages, %d bytes)", r.path, r.records, r.written)
+	}
+	r.file = nil
+}
+
+// flush pushes buffered records to disk so a crash loses little, and closes
+// a segment that is due without new messages
+func (r *rawRecorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return
+	}
+	if time.Since(r.opened) >= time.Duration(r.config.SegmentSec)*time.Second {
+		r.closeLocked()
+		r.enforceRetention()
+		return
+	}
+	err := r.w.Flush()
+	if err == nil {
+		err = r.zw.Flush()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Recorder: failed to flush %s: %v", r.path, err)
+	}
+}
+
+func (r *rawRecorder) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+}
+
+// enforceRetention removes closed segments older than the retention period,
+// then the oldest ones while the total exceeds MaxTotalMB
+func (r *rawRecorder) enforceRetention() {
+	if r.config.RetentionDays == 0 && r.config.MaxTotalMB == 0 {
+		return
+	}
+	type segment struct {
+		path string
+		mod  time.Time
+		size int64
+	}
+	var segments []segment
+	var total int64
+	err := filepath.WalkDir(r.config.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(path, rawSegmentExt) || path == r.path && r.file != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		segments = append(segments, segment{path, info.ModTime(), info.Size()})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Recorder: failed to scan %s: %v", r.config.Dir, err)
+		return
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].path < segments[j].path })
+
+	cutoff := time.Now().AddDate(0, 0, -r.config.RetentionDays)
+	limit := int64(r.config.MaxTotalMB) << 20
+	for _, s := range segments {
+		expired := r.config.RetentionDays > 0 && s.mod.Before(cutoff)
+		over := limit > 0 && total > limit
+		if !expired && !over {
+			break
+		}
+		if err := os.Remove(s.path); err != nil {
+			log.Printf("[ERROR] Recorder: failed to remove %s: %v", s.path, err)
+			continue
+		}
+		total -= s.size
+		log.Printf("Recorder: removed %s (retention)", s.path)
+	}
+}
+
+// subscribeRecorder subscribes the recorder to its topics
+func (h *MQTTHandler) subscribeRecorder() error {
+	if h.recorder == nil {
+		return nil
+	}
+	handler := func(client mqtt.Client, msg mqtt.Message) {
+		h.recorder.record(msg)
+	}
+	for _, pattern := range h.recorder.config.Topics {
+		topic := h.config.SubscriptionTopic(pattern)
+		if token := h.client.Subscribe(topic, 1, handler); token.Wait() && token.Error() != nil {
+			return fmt.Errorf("failed to subscribe recorder to %s: %w", topic, token.Error())
+		}
+	}
+	return nil
+}
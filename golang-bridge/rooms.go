@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RoomMetadata is the subset of config/rooms.yaml the bridge uses to label
+// records
+type RoomMetadata struct {
+	ID    string `yaml:"id"`
+	Name  string `yaml:"name"`
+	Floor int    `yaml:"floor"`
+	Zone  string `yaml:"zone"`
+	// Tenant scopes the room's data in multi-tenant buildings
+	Tenant string `yaml:"tenant"`
+}
+
+// labels returns the room's metadata as metric labels
+func (r RoomMetadata) labels() map[string]string {
+	labels := map[string]string{"room_id": r.ID, "floor": strconv.Itoa(r.Floor)}
+	if r.Name != "" {
+		labels["room_name"] = r.Name
+	}
+	if r.Zone != "" {
+		labels["zone"] = r.Zone
+	}
+	if r.Tenant != "" {
+		labels["tenant"] = r.Tenant
+	}
+	return labels
+}
+
+// recordRoomID returns a record's room_id field, or the last topic level
+func recordRoomID(rec *Record) string {
+	if roomID, _ := rec.Fields["room_id"].(string); roomID != "" {
+		return roomID
+	}
+	return rec.Topic[strings.LastIndex(rec.Topic, "/")+1:]
+}
+
+// loadRoomMetadata reads the rooms file shared with the gateway. A missing
+// file is not an error; records are then labelled with room_id only.
+func loadRoomMetadata(path string) (map[string]RoomMetadata, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Printf("No rooms config at %s, room metadata labels disabled", path)
+		return map[string]RoomMetadata{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rooms config: %w", err)
+	}
+
+	var file struct {
+		Rooms []RoomMetadata `yaml:"rooms"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse rooms config: %w", err)
+	}
+	rooms := make(map[string]RoomMetadata, len(file.Rooms))
+	for _, r := range file.Rooms {
+		rooms[r.ID] = r
+	}
+	log.Printf("Loaded metadata for %d rooms", len(rooms))
+	return rooms, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types of registry schemas
+const (
+	ColumnString    = "string"
+	ColumnDouble    = "double"
+	ColumnInt32     = "int32"
+	ColumnInt64     = "int64"
+	ColumnBoolean   = "boolean"
+	ColumnTimestamp = "timestamp" // RFC3339 string, stored per the sink's timestamp encoding
+)
+
+// SchemaDefinition is a named, versioned record schema declared in
+// bridge.yaml. Pipelines reference it as <name> (highest version) or
+// <name>@<version>.
+type SchemaDefinition struct {
+	Name    string         `yaml:"name"`
+	Version int            `yaml:"version"`
+	Fields  []SchemaColumn `yaml:"fields"`
+}
+
+// SchemaColumn is one field of a registry schema. Required fields must be
+// present in every record; nullable fields may be null or absent and are
+// written as OPTIONAL columns. Absent non-nullable fields get the zero value.
+type SchemaColumn struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Required bool   `yaml:"required,omitempty"`
+	Nullable bool   `yaml:"nullable,omitempty"`
+}
+
+// columnKinds maps column types to their Go kind and parquet tag
+var columnKinds = map[string]struct {
+	goType reflect.Type
+	tag    string
+}{
+	ColumnString:    {reflect.TypeOf(""), "type=BYTE_ARRAY, convertedtype=UTF8"},
+	ColumnDouble:    {reflect.TypeOf(float64(0)), "type=DOUBLE"},
+	ColumnInt32:     {reflect.TypeOf(int32(0)), "type=INT32"},
+	ColumnInt64:     {reflect.TypeOf(int64(0)), "type=INT64"},
+	ColumnBoolean:   {reflect.TypeOf(false), "type=BOOLEAN"},
+	ColumnTimestamp: {reflect.TypeOf(int64(0)), "type=INT64"},
+}
+
+// registerSchemas validates the configured schema definitions and adds them
+// to parquetSchemas under <name>@<version>, with <name> pointing at the
+// highest version
+func registerSchemas(defs []SchemaDefinition) error {
+	latest := make(map[string]int)
+	for _, def := range defs {
+		if def.Name == "" || strings.Contains(def.Name, "@") {
+			return fmt.Errorf("schema registry: invalid schema name %q", def.Name)
+		}
+		if def.Version <= 0 {
+			def.Version = 1
+		}
+		if s, ok := parquetSchemas[def.Name]; ok && s.version == 0 {
+			return fmt.Errorf("schema registry: %s is a built-in schema", def.Name)
+		}
+		key := fmt.Sprintf("%s@%d", def.Name, def.Version)
+		if _, ok := parquetSchemas[key]; ok {
+			return fmt.Errorf("schema registry: duplicate schema %s", key)
+		}
+		schema, err := def.compile()
+		if err != nil {
+			return fmt.Errorf("schema registry: %s: %w", key, err)
+		}
+		parquetSchemas[key] = schema
+		if def.Version > latest[def.Name] {
+			latest[def.Name] = def.Version
+			parquetSchemas[def.Name] = schema
+		}
+	}
+	return nil
+}
+
+// compile builds the row struct type and record conversion for a definition.
+// Row fields are C<i>; timestamp columns get a C<i>Int96 companion field.
+func (def SchemaDefinition) compile() (parquetSchema, error) {
+	if len(def.Fields) == 0 {
+		return parquetSchema{}, fmt.Errorf("no fields defined")
+	}
+	seen := make(map[string]bool)
+	var fields []reflect.StructField
+	for i, col := range def.Fields {
+		kind, ok := columnKinds[col.Type]
+		if !ok {
+			return parquetSchema{}, fmt.Errorf("field %q has unknown type %q", col.Name, col.Type)
+		}
+		if col.Name == "" || strings.ContainsAny(col.Name, ",= \t") {
+			return parquetSchema{}, fmt.Errorf("invalid field name %q", col.Name)
+		}
+		if seen[col.Name] {
+			return parquetSchema{}, fmt.Errorf("duplicate field %q", col.Name)
+		}
+		seen[col.Name] = true
+
+		goType, int96Type := kind.goType, reflect.TypeOf("")
+		tag := fmt.Sprintf(`json:"%s" parquet:"name=%s, %s`, col.Name, col.Name, kind.tag)
+		if col.Nullable {
+			goType, int96Type = reflect.PointerTo(goType), reflect.PointerTo(int96Type)
+			tag += ", repetitiontype=OPTIONAL"
+		}
+		tag += `"`
+		if col.Type == ColumnTimestamp {
+			tag += ` timestamp:"true"`
+		}
+		name := "C" + strconv.Itoa(i)
+		fields = append(fields, reflect.StructField{Name: name, Type: goType, Tag: reflect.StructTag(tag)})
+		if col.Type == ColumnTimestamp {
+			fields = append(fields, reflect.StructField{Name: name + "Int96", Type: int96Type})
+		}
+	}
+
+	rowType := reflect.StructOf(fields)
+	return parquetSchema{
+		name:    def.Name,
+		version: def.Version,
+		row:     reflect.New(rowType).Elem().Interface(),
+		validate: func(rec *Record) error {
+			_, err := def.convert(rec)
+			return err
+		},
+		toRow: func(rec *Record, timestampMode string) (interface{}, error) {
+			values, err := def.convert(rec)
+			if err != nil {
+				return nil, err
+			}
+			row := reflect.New(rowType).Elem()
+			for i, col := range def.Fields {
+				v := values[i]
+				if v == nil {
+					continue
+				}
+				name := "C" + strconv.Itoa(i)
+				var int96 string
+				if col.Type == ColumnTimestamp {
+					v, int96 = encodeTimestamp(v.(time.Time), timestampMode)
+				}
+				setColumn(row.FieldByName(name), v)
+				if col.Type == ColumnTimestamp && timestampMode == TimestampInt96 {
+					setColumn(row.FieldByName(name+"Int96"), int96)
+				}
+			}
+			return row.Addr().Interface(), nil
+		},
+	}, nil
+}
+
+// setColumn stores v in a row field, allocating it for nullable columns
+func setColumn(field reflect.Value, v interface{}) {
+	value := reflect.ValueOf(v)
+	if field.Kind() == reflect.Ptr {
+		ptr := reflect.New(field.Type().Elem())
+		ptr.Elem().Set(value)
+		field.Set(ptr)
+		return
+	}
+	field.Set(value)
+}
+
+// convert checks a record against the definition and returns each column's
+// typed value, nil for null or absent fields
+func (def SchemaDefinition) convert(rec *Record) ([]interface{}, error) {
+	if rec.Fields == nil {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	values := make([]interface{}, len(def.Fields))
+	for i, col := range def.Fields {
+		raw, present := rec.Fields[col.Name]
+		if !present && col.Required {
+			return nil, fmt.Errorf("schema %s@%d: missing required field %q", def.Name, def.Version, col.Name)
+		}
+		if raw == nil {
+			if present && !col.Nullable {
+				return nil, fmt.Errorf("schema %s@%d: field %q is not nullable", def.Name, def.Version, col.Name)
+			}
+			continue
+		}
+		v, err := convertColumn(col.Type, raw)
+		if err != nil {
+			return nil, fmt.Errorf("schema %s@%d: field %q: %w", def.Name, def.Version, col.Name, err)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+func convertColumn(typ string, raw interface{}) (interface{}, error) {
+	switch typ {
+	case ColumnString:
+		if s, ok := raw.(string); ok {
+			return s, nil
+		}
+	case ColumnDouble:
+		if f, ok := raw.(float64); ok {
+			return f, nil
+		}
+	case ColumnInt32, ColumnInt64:
+		f, ok := raw.(float64)
+		if !ok {
+			break
+		}
+		if f != math.Trunc(f) {
+			return nil, fmt.Errorf("expected an integer, got %v", f)
+		}
+		if typ == ColumnInt32 {
+			if f < math.MinInt32 || f > math.MaxInt32 {
+				return nil, fmt.Errorf("%v overflows int32", f)
+			}
+			return int32(f), nil
+		}
+		return int64(f), nil
+	case ColumnBoolean:
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+	case ColumnTimestamp:
+		if s, ok := raw.(string); ok {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %q", s)
+			}
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %T", typ, raw)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// dataQualityTopic carries events about data the bridge probably missed
+const dataQualityTopic = "status/bridge/data_quality"
+
+// SessionConfig controls the MQTT session across connection losses. The
+// bridge resubscribes after every reconnect either way. A persistent session
+// (CleanSession=false under a stable client ID) lets the broker queue QoS 1
+// messages while the bridge is away; after an outage longer than ExpirySec
+// the bridge starts a clean session instead of draining a stale backlog.
+// MQTT 3.1.1 has no session expiry property, so the bridge enforces it.
+type SessionConfig struct {
+	Persistent bool `yaml:"persistent"`
+	// ClientID must be stable and unique per replica (default
+	// golang-bridge-<hostname> for persistent sessions)
+	ClientID  string `yaml:"client_id,omitempty"`
+	ExpirySec int    `yaml:"expiry_sec,omitempty"` // 0 never expires
+}
+
+func (c *SessionConfig) normalize() error {
+	if c.ExpirySec < 0 {
+		return fmt.Errorf("session: expiry_sec must not be negative")
+	}
+	if c.ExpirySec > 0 && !c.Persistent {
+		return fmt.Errorf("session: expiry_sec requires persistent")
+	}
+	return nil
+}
+
+// clientID returns the MQTT client ID: the configured or hostname-based
+// stable ID for persistent sessions, else the per-start default
+func (c *SessionConfig) clientID(config *Config) string {
+	if c.ClientID != "" {
+		return c.ClientID
+	}
+	if c.Persistent {
+		if host, err := os.Hostname(); err == nil {
+			return "golang-bridge-" + host
+		}
+	}
+	return config.MQTTClientID
+}
+
+// DataQualityEvent reports a connection loss and an estimate of the
+// messages missed meanwhile: the message rate of the preceding connection
+// times the downtime. With a kept session QoS 1 messages are redelivered, so
+// the estimate is an upper bound.
+type DataQualityEvent struct {
+	Event                string  `json:"event"`
+	Broker               string  `json:"broker"`
+	Error                string  `json:"error,omitempty"`
+	DisconnectedAt       string  `json:"disconnected_at"`
+	ReconnectedAt        string  `json:"reconnected_at"`
+	DowntimeSec          float64 `json:"downtime_sec"`
+	SessionKept          bool    `json:"session_kept"`
+	EstimatedMissed      int64   `json:"estimated_missed"`
+	EstimatedMissedTotal int64   `json:"estimated_missed_total"`
+}
+
+// sessionTracker follows connects and losses to decide the session type of
+// each reconnect and to estimate missed messages
+type sessionTracker struct {
+	config   SessionConfig
+	received int64 // messages delivered, updated atomically
+
+	mu                sync.Mutex
+	connects          int
+	connectedAt       time.Time
+	receivedAtConnect int64
+	lostAt            time.Time
+	lostErr           error
+	rate              float64 // messages per second before the loss
+	sessionKept       bool
+	missedTotal       int64
+}
+
+func newSessionTracker(config SessionConfig) *sessionTracker {
+	return &sessionTracker{config: config}
+}
+
+func (s *sessionTracker) delivered() {
+	atomic.AddInt64(&s.received, 1)
+}
+
+// lost records a connection loss and the message rate before it
+func (s *sessionTracker) lost(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.lostAt, s.lostErr = now, err
+	s.rate = 0
+	if elapsed := now.Sub(s.connectedAt).Seconds(); elapsed > 0 {
+		s.rate = float64(atomic.LoadInt64(&s.received)-s.receivedAtConnect) / elapsed
+	}
+}
+
+// reconnecting picks the session type of the next connection attempt
+func (s *sessionTracker) reconnecting(opts *mqtt.ClientOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := s.config.ExpirySec > 0 && !s.lostAt.IsZero() && time.Since(s.lostAt) > time.Duration(s.config.ExpirySec)*time.Second
+	s.sessionKept = s.config.Persistent && !expired
+	opts.SetCleanSession(!s.sessionKept)
+	if s.config.Persistent && expired {
+		log.Printf("[WARN] Disconnected for more than %ds, starting a clean MQTT session", s.config.ExpirySec)
+	}
+}
+
+// connected records a connection. It reports whether this is a reconnect,
+// which needs the subscriptions restored, and the data quality event when
+// the connection had been lost.
+func (s *sessionTracker) connected(broker string) (bool, *DataQualityEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.connects++
+	s.connectedAt = now
+	s.receivedAtConnect = atomic.LoadInt64(&s.received)
+	if s.connects == 1 || s.lostAt.IsZero() {
+		s.lostAt = time.Time{}
+		return s.connects > 1, nil
+	}
+
+	downtime := now.Sub(s.lostAt)
+	missed := int64(s.rate*downtime.Seconds() + 0.5)
+	s.missedTotal += missed
+	event := &DataQualityEvent{
+		Event:                "connection_lost",
+		Broker:               broker,
+		DisconnectedAt:       s.lostAt.UTC().Format(time.RFC3339),
+		ReconnectedAt:        now.UTC().Format(time.RFC3339),
+		DowntimeSec:          downtime.Seconds(),
+		SessionKept:          s.sessionKept,
+		EstimatedMissed:      missed,
+		EstimatedMissedTotal: s.missedTotal,
+	}
+	if s.lostErr != nil {
+		event.Error = s.lostErr.Error()
+	}
+	s.lostAt, s.lostErr = time.Time{}, nil
+	return true, event
+}
+
+// onConnect restores the subscriptions after a reconnect and reports the
+// outage
+func (h *MQTTHandler) onConnect(client mqtt.Client) {
+	broker, _ := h.broker.Load().(string)
+	reconnect, event := h.session.connected(broker)
+	if !reconnect {
+		return
+	}
+	go func() {
+		if err := h.subscribe(); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+		if event != nil {
+			h.publishDataQuality(event)
+		}
+	}()
+}
+
+func (h *MQTTHandler) publishDataQuality(event *DataQualityEvent) {
+	log.Printf("[WARN] MQTT connection was down for %.0fs, about %d messages missed (%d in total)",
+		event.DowntimeSec, event.EstimatedMissed, event.EstimatedMissedTotal)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal data quality event: %v", err)
+		return
+	}
+	token := h.client.Publish(dataQualityTopic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish data quality event: %v", token.Error())
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink receives the records of one pipeline
+type Sink interface {
+	Name() string
+	Write(rec *Record) error
+	// Flush is called every FLUSH_INTERVAL_SEC and also handles rotation
+	Flush() error
+	Close() error
+}
+
+// SinkConfig configures one pipeline sink:
+//   - parquet: rotating Parquet files using the pipeline's schema
+//   - jsonl: rotating newline-delimited JSON files
+//   - elasticsearch: bulk indexing into daily Elasticsearch/OpenSearch indices
+//   - victoriametrics: numeric fields imported as samples labelled with room
+//     metadata
+type SinkConfig struct {
+	Type        string `yaml:"type"`
+	OutputDir   string `yaml:"output_dir,omitempty"`
+	FilePrefix  string `yaml:"file_prefix,omitempty"`
+	RotationSec int    `yaml:"rotation_sec,omitempty"`
+	// Timestamp is the parquet timestamp encoding (PARQUET_TIMESTAMP by default)
+	Timestamp string `yaml:"timestamp,omitempty"`
+	// PartitionBy "tenant" writes each tenant's records under
+	// <output_dir>/tenant=<tenant>/ (parquet and jsonl)
+	PartitionBy string `yaml:"partition_by,omitempty"`
+	// Completed parquet and jsonl files are encrypted with age to these
+	// recipients (age1... public keys, or an age recipients file) and the
+	// plaintext removed
+	EncryptRecipients     []string `yaml:"encrypt_recipients,omitempty"`
+	EncryptRecipientsFile string   `yaml:"encrypt_recipients_file,omitempty"`
+	// Units is the output profile the sink writes in (si or imperial); the
+	// default writes the fields in the gateway's canonical units
+	Units string `yaml:"units,omitempty"`
+	// Delivery is at_most_once (default), at_least_once or effectively_once,
+	// see delivery.go. The write-ahead log is kept in wal_dir (default
+	// <output_dir>/.wal); dedup_key names the fields identifying a record
+	// (default: its topic and payload) and dedup_window how many keys are
+	// remembered (default 100000).
+	Delivery    string   `yaml:"delivery,omitempty"`
+	WALDir      string   `yaml:"wal_dir,omitempty"`
+	DedupKey    []string `yaml:"dedup_key,omitempty"`
+	DedupWindow int      `yaml:"dedup_window,omitempty"`
+
+	// Elasticsearch/OpenSearch settings. Index is the index and template name
+	// prefix; credentials may reference environment variables as ${VAR}.
+	URL       string `yaml:"url,omitempty"`
+	Index     string `yaml:"index,omitempty"`
+	Username  string `yaml:"username,omitempty"`
+	Password  string `yaml:"password,omitempty"`
+	APIKey    string `yaml:"api_key,omitempty"`
+	BatchSize int    `yaml:"batch_size,omitempty"`
+	Replicas  int    `yaml:"replicas,omitempty"`
+
+	// VictoriaMetrics naming: metrics are <metric_prefix>_<field> unless
+	// metric_names overrides a field; labels are added to every sample
+	MetricPrefix string            `yaml:"metric_prefix,omitempty"`
+	MetricNames  map[string]string `yaml:"metric_names,omitempty"`
+	Labels       map[string]string `yaml:"labels,omitempty"`
+}
+
+// normalize fills sink defaults from the environment configuration
+func (sc *SinkConfig) normalize(pc PipelineConfig, config *Config) {
+	if sc.OutputDir == "" {
+		sc.OutputDir = config.OutputDir
+	}
+	if sc.FilePrefix == "" {
+		sc.FilePrefix = pc.Name
+	}
+	if sc.RotationSec <= 0 {
+		sc.RotationSec = int(config.FileRotation / time.Second)
+	}
+	if sc.Timestamp == "" {
+		sc.Timestamp = config.TimestampMode
+	}
+	sc.Timestamp = strings.ToLower(sc.Timestamp)
+	if sc.Index == "" {
+		sc.Index = strings.ReplaceAll(strings.ToLower(pc.Name), "_", "-")
+	}
+	if sc.BatchSize <= 0 {
+		sc.BatchSize = 500
+	}
+	if sc.Type == "victoriametrics" && sc.MetricPrefix == "" {
+		sc.MetricPrefix = "building"
+	}
+	sc.Password = os.ExpandEnv(sc.Password)
+	sc.APIKey = os.ExpandEnv(sc.APIKey)
+}
+
+func newSink(pc PipelineConfig, sc SinkConfig, config *Config) (Sink, error) {
+	sc.normalize(pc, config)
+	encrypted := len(sc.EncryptRecipients) > 0 || sc.EncryptRecipientsFile != ""
+	if encrypted && sc.Type != "parquet" && sc.Type != "jsonl" {
+		return nil, fmt.Errorf("encryption is not supported for %s sinks", sc.Type)
+	}
+	if sc.Units != "" {
+		return newUnitsSink(pc, sc, config)
+	}
+	if sc.PartitionBy != "" {
+		return newTenantPartitionedSink(pc, sc, config)
+	}
+	switch sc.Type {
+	case "parquet":
+		return NewParquetWriter(sc, pc.Schema)
+	case "jsonl":
+		return newJSONLSink(sc, pc.Schema)
+	case "elasticsearch", "opensearch":
+		return newElasticsearchSink(sc, pc.Schema)
+	case "victoriametrics":
+		return newVictoriaMetricsSink(sc, config.Rooms)
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", sc.Type)
+	}
+}
+
+// jsonlSink writes one JSON document per line to rotating files
+type jsonlSink struct {
+	mu           sync.Mutex
+	config       SinkConfig
+	schema       string
+	file         *os.File
+	buf          *bufio.Writer
+	currentFile  string
+	lastRotation time.Time
+	// sealer encrypts closed files, nil without encryption
+	sealer *fileSealer
+}
+
+func newJSONLSink(config SinkConfig, schema string) (*jsonlSink, error) {
+	sealer, err := newFileSealer(config)
+	if err != nil {
+		return nil, err
+	}
+	if sealer != nil {
+		sealer.sealLeftovers(config.OutputDir, config.FilePrefix, ".jsonl")
+	} else {
+		checksumLeftovers(config.OutputDir, config.FilePrefix, ".jsonl")
+	}
+	return &jsonlSink{config: config, schema: schema, sealer: sealer}, nil
+}
+
+func (s *jsonlSink) Name() string { return "jsonl" }
+
+func (s *jsonlSink) Write(rec *Record) error {
+	var doc interface{} = rec.Fields
+	if s.schema == SchemaRaw || rec.Fields == nil {
+		doc = map[string]interface{}{
+			"topic":    rec.Topic,
+			"payload":  string(rec.Payload),
+			"received": rec.Received.Format(time.RFC3339Nano),
+		}
+	}
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.buf.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+	return nil
+}
+
+// rotateLocked closes the current file and opens a new one; the caller must
+// hold s.mu
+func (s *jsonlSink) rotateLocked() error {
+	if err := s.closeLocked(); err != nil {
+		log.Printf("[ERROR] Close failed: %v", err)
+	}
+	if err := os.MkdirAll(s.config.OutputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	name := fmt.Sprintf("%s_%s.jsonl", s.config.FilePrefix, time.Now().Format("20060102_150405"))
+	path := filepath.Join(s.config.OutputDir, name)
+	// Tracked before creation so the uploader never sees a partial file; a
+	// file reopened within the same second loses its checksum until it is
+	// finalized again
+	trackOpenFile(path)
+	os.Remove(path + checksumExt)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		releaseOpenFile(path)
+		return fmt.Errorf("failed to create jsonl file: %w", err)
+	}
+	s.file = f
+	s.buf = bufio.NewWriter(f)
+	s.currentFile = path
+	s.lastRotation = time.Now()
+	log.Printf("Created new jsonl file: %s", path)
+	return nil
+}
+
+func (s *jsonlSink) closeLocked() error {
+	if s.file == nil {
+		return nil
+	}
+	flushErr := s.buf.Flush()
+	closeErr := s.file.Close()
+	s.file = nil
+	s.buf = nil
+	defer releaseOpenFile(s.currentFile)
+	if flushErr != nil {
+		return flushErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return finalizeFile(s.currentFile, s.sealer)
+}
+
+func (s *jsonlSink) openFile() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return ""
+	}
+	return s.currentFile
+}
+
+func (s *jsonlSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	if time.Since(s.lastRotation) >= time.Duration(s.config.RotationSec)*time.Second {
+		log.Printf("File rotation interval reached, rotating %s...", s.currentFile)
+		return s.rotateLocked()
+	}
+	return s.buf.Flush()
+}
+
+func (s *jsonlSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeLocked()
+}
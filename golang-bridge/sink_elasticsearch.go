@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPendingBatches bounds how many failed batches are kept for retry
+// before the oldest documents are dropped
+const maxPendingBatches = 10
+
+// elasticsearchSink bulk-indexes records into daily indices
+// (<index>-YYYY.MM.DD). It works with Elasticsearch and OpenSearch, which
+// share the _bulk and _index_template APIs.
+type elasticsearchSink struct {
+	mu      sync.Mutex // guards pending and the counters
+	sending sync.Mutex // serializes bulk requests, held without mu
+	config  SinkConfig
+	schema  string
+	client  *http.Client
+	pending []bulkDoc // documents waiting for the next bulk request
+	indexed int64
+	failed  int64
+}
+
+// bulkDoc is one queued document with its daily index and dedup _id
+type bulkDoc struct {
+	line []byte
+	day  string
+	id   string // "" lets the cluster assign one
+}
+
+func newElasticsearchSink(config SinkConfig, schema string) (*elasticsearchSink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("elasticsearch sink requires url")
+	}
+	s := &elasticsearchSink{
+		config: config,
+		schema: schema,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	// The cluster may still be starting; documents are buffered and the
+	// template only affects indices created afterwards, so this is not fatal
+	if err := s.putIndexTemplate(); err != nil {
+		log.Printf("[WARN] Failed to install index template %s: %v", config.Index, err)
+	}
+	return s, nil
+}
+
+func (s *elasticsearchSink) Name() string { return "elasticsearch" }
+
+// indexTemplate maps @timestamp as a date and string fields as keywords so
+// rooms, topics and alarm types can be filtered and aggregated directly
+func (s *elasticsearchSink) indexTemplate() map[string]interface{} {
+	return map[string]interface{}{
+		"index_patterns": []string{s.config.Index + "-*"},
+		"template": map[string]interface{}{
+			"settings": map[string]interface{}{
+				"number_of_shards":   1,
+				"number_of_replicas": s.config.Replicas,
+			},
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"strings_as_keywords": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping":            map[string]interface{}{"type": "keyword"},
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"@timestamp": map[string]interface{}{"type": "date"},
+					"topic":      map[string]interface{}{"type": "keyword"},
+					"payload":    map[string]interface{}{"type": "text"},
+				},
+			},
+		},
+	}
+}
+
+func (s *elasticsearchSink) putIndexTemplate() error {
+	body, err := json.Marshal(s.indexTemplate())
+	if err != nil {
+		return fmt.Errorf("failed to marshal index template: %w", err)
+	}
+	resp, err := s.do(http.MethodPut, "/_index_template/"+s.config.Index, "application/json", body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	log.Printf("Installed index template %s for %s-*", s.config.Index, s.config.Index)
+	return nil
+}
+
+// document builds the indexed document and the time used for its daily index
+func (s *elasticsearchSink) document(rec *Record) (map[string]interface{}, time.Time) {
+	ts := rec.Received
+	if s.schema == SchemaRaw || rec.Fields == nil {
+		return map[string]interface{}{
+			"@timestamp": ts.UTC().Format(time.RFC3339Nano),
+			"topic":      rec.Topic,
+			"payload":    string(rec.Payload),
+		}, ts
+	}
+	doc := make(map[string]interface{}, len(rec.Fields)+2)
+	for k, v := range rec.Fields {
+		doc[k] = v
+	}
+	// Prefer the event's own timestamp so late records land in the right day
+	if str, ok := rec.Fields["timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, str); err == nil {
+			ts = t
+		}
+	}
+	doc["@timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	doc["topic"] = rec.Topic
+	return doc, ts
+}
+
+func (s *elasticsearchSink) Write(rec *Record) error {
+	doc, ts := s.document(rec)
+	line, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal document: %w", err)
+	}
+
+	s.mu.Lock()
+	// Dedup keys make a redelivered record overwrite its first copy
+	s.pending = append(s.pending, bulkDoc{line: line, day: ts.UTC().Format("2006.01.02"), id: rec.Key})
+	full := len(s.pending) >= s.config.BatchSize
+	s.mu.Unlock()
+	if full {
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("%w: %w", errBatched, err)
+		}
+	}
+	return nil
+}
+
+// flush sends the pending documents in one bulk request. The queue is only
+// locked while the batch is taken and settled, so writers are not blocked
+// behind the HTTP round trip. On failure the documents are queued again in
+// front of anything written meanwhile.
+func (s *elasticsearchSink) flush() error {
+	s.sending.Lock()
+	defer s.sending.Unlock()
+
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	for _, doc := range batch {
+		if doc.id != "" {
+			fmt.Fprintf(&body, `{"index":{"_index":"%s-%s","_id":"%s"}}`+"\n", s.config.Index, doc.day, doc.id)
+		} else {
+			fmt.Fprintf(&body, `{"index":{"_index":"%s-%s"}}`+"\n", s.config.Index, doc.day)
+		}
+		body.Write(doc.line)
+		body.WriteByte('\n')
+	}
+
+	resp, err := s.do(http.MethodPost, "/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		queued := s.requeue(batch)
+		return fmt.Errorf("bulk request failed (%d documents queued): %w", queued, err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		s.requeue(batch)
+		return fmt.Errorf("failed to decode bulk response: %w", err)
+	}
+
+	// Items come back in request order. A 429 means the node's write queue
+	// was full and the document is retried with the next flush; any other
+	// failure is a mapping or validation error that a retry will not fix,
+	// so it is counted and dropped.
+	var retry []bulkDoc
+	rejected := 0
+	if result.Errors {
+		for i, item := range result.Items {
+			for _, r := range item {
+				switch {
+				case r.Status < 300:
+				case r.Status == http.StatusTooManyRequests && i < len(batch):
+					retry = append(retry, batch[i])
+				default:
+					if rejected == 0 {
+						log.Printf("[ERROR] Elasticsearch rejected document: %s: %s", r.Error.Type, r.Error.Reason)
+					}
+					rejected++
+				}
+			}
+		}
+	}
+	indexed := len(batch) - len(retry) - rejected
+	log.Printf("[DEBUG] Bulk indexed %d documents into %s-* (%d rejected, %d retried)", indexed, s.config.Index, rejected, len(retry))
+	s.mu.Lock()
+	s.indexed += int64(indexed)
+	s.failed += int64(rejected)
+	s.mu.Unlock()
+	if len(retry) > 0 {
+		queued := s.requeue(retry)
+		return fmt.Errorf("%d of %d documents throttled (%d documents queued)", len(retry), len(batch), queued)
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d of %d documents rejected", rejected, len(result.Items))
+	}
+	return nil
+}
+
+// requeue puts documents from a failed bulk request back in front of the
+// queue, dropping the oldest once the retry buffer is full, and returns the
+// queue length
+func (s *elasticsearchSink) requeue(docs []bulkDoc) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(docs[:len(docs):len(docs)], s.pending...)
+	limit := s.config.BatchSize * maxPendingBatches
+	if over := len(s.pending) - limit; over > 0 {
+		log.Printf("[WARN] Elasticsearch retry buffer full, dropping %d oldest documents", over)
+		s.pending = append([]bulkDoc(nil), s.pending[over:]...)
+		s.failed += int64(over)
+	}
+	return len(s.pending)
+}
+
+// do sends a request to the cluster and turns non-2xx responses into errors
+func (s *elasticsearchSink) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(s.config.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case s.config.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.config.APIKey)
+	case s.config.Username != "":
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (s *elasticsearchSink) Flush() error {
+	err := s.flush()
+	s.mu.Lock()
+	log.Printf("Elasticsearch %s: indexed %d, failed %d, queued %d", s.config.Index, s.indexed, s.failed, len(s.pending))
+	s.mu.Unlock()
+	return err
+}
+
+func (s *elasticsearchSink) Close() error {
+	return s.flush()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Pipeline schemas
+const (
+	// SchemaTelemetry writes downsampled room telemetry (SensorTelemetry)
+	SchemaTelemetry = "telemetry"
+	// SchemaRaw writes the topic and the unparsed payload of every message
+	SchemaRaw = "raw"
+)
+
+// RawMessage is the parquet row of the raw schema
+type RawMessage struct {
+	Topic          string `parquet:"name=topic, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Payload        string `parquet:"name=payload, type=BYTE_ARRAY"`
+	Timestamp      int64  `parquet:"name=timestamp, type=INT64"` // receive time
+	TimestampInt96 string
+}
+
+// parquetSchema describes how a pipeline schema maps records to parquet rows.
+// Built-in schemas have version 0; registry schemas also validate records
+// before they reach any sink.
+type parquetSchema struct {
+	name     string
+	version  int
+	row      interface{}
+	toRow    func(rec *Record, timestampMode string) (interface{}, error)
+	validate func(rec *Record) error
+}
+
+// parquetSchemas is the schema registry: the built-in schemas plus the
+// definitions registered from bridge.yaml
+var parquetSchemas = map[string]parquetSchema{
+	SchemaTelemetry: {name: SchemaTelemetry, row: SensorTelemetry{}, toRow: telemetryRow},
+	SchemaRaw:       {name: SchemaRaw, row: RawMessage{}, toRow: rawRow},
+}
+
+// telemetryRow decodes a record's fields into SensorTelemetry
+func telemetryRow(rec *Record, timestampMode string) (interface{}, error) {
+	if rec.Fields == nil {
+		return nil, fmt.Errorf("payload is not a JSON object")
+	}
+	data, err := json.Marshal(rec.Fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal record: %w", err)
+	}
+	var telemetry SensorTelemetry
+	if err := json.Unmarshal(data, &telemetry); err != nil {
+		return nil, fmt.Errorf("failed to decode telemetry: %w", err)
+	}
+	for _, column := range []struct {
+		field string
+		dst   **string
+	}{
+		{"reading_traces", &telemetry.ReadingTraces},
+		{"external_ids", &telemetry.ExternalIDs},
+		{"sensor_external_ids", &telemetry.SensorExternalIDs},
+	} {
+		object, ok := rec.Fields[column.field].(map[string]interface{})
+		if !ok || len(object) == 0 {
+			continue
+		}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal %s: %w", column.field, err)
+		}
+		value := string(data)
+		*column.dst = &value
+	}
+
+	// Parse RFC3339 timestamp string into the configured encoding
+	t, err := time.Parse(time.RFC3339, telemetry.TimestampStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp '%s': %w", telemetry.TimestampStr, err)
+	}
+	telemetry.Timestamp, telemetry.TimestampInt96 = encodeTimestamp(t, timestampMode)
+	return &telemetry, nil
+}
+
+func rawRow(rec *Record, timestampMode string) (interface{}, error) {
+	row := &RawMessage{Topic: rec.Topic, Payload: string(rec.Payload)}
+	row.Timestamp, row.TimestampInt96 = encodeTimestamp(rec.Received, timestampMode)
+	return row, nil
+}
+
+// ParquetWriter is the parquet sink; it manages writing rows to rotating
+// parquet files
+type ParquetWriter struct {
+	mu           sync.Mutex
+	currentFile  string
+	writer       *writer.ParquetWriter
+	fileWriter   source.ParquetFile
+	recordCount  int64
+	lastRotation time.Time
+	config       SinkConfig
+	schema       parquetSchema
+	schemaJSON   string
+	// sealer encrypts closed files, nil without encryption
+	sealer *fileSealer
+}
+
+// NewParquetWriter creates a new parquet writer for a pipeline schema
+func NewParquetWriter(config SinkConfig, schemaName string) (*ParquetWriter, error) {
+	schema, ok := parquetSchemas[schemaName]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", schemaName)
+	}
+	schemaJSON, err := parquetSchemaJSON(schema.row, config.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newFileSealer(config)
+	if err != nil {
+		return nil, err
+	}
+	if sealer != nil {
+		sealer.sealLeftovers(config.OutputDir, config.FilePrefix, ".parquet")
+	} else {
+		checksumLeftovers(config.OutputDir, config.FilePrefix, ".parquet")
+	}
+	return &ParquetWriter{
+		config:       config,
+		lastRotation: time.Now(),
+		schema:       schema,
+		schemaJSON:   schemaJSON,
+		sealer:       sealer,
+	}, nil
+}
+
+func (pw *ParquetWriter) Name() string { return "parquet" }
+
+// rotateFile closes the current file and creates a new one
+func (pw *ParquetWriter) rotateFile() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.rotateLocked()
+}
+
+// rotateLocked performs the rotation; the caller must hold pw.mu
+func (pw *ParquetWriter) rotateLocked() error {
+	log.Println("[DEBUG] rotateFile called")
+
+	// Close existing writer
+	if pw.writer != nil {
+		log.Printf("Closing current parquet file: %s (records: %d)", pw.currentFile, pw.recordCount)
+		if err := pw.writer.WriteStop(); err != nil {
+			log.Printf("[ERROR] WriteStop failed: %v", err)
+		}
+		if err := pw.fileWriter.Close(); err != nil {
+			log.Printf("[ERROR] Close failed: %v", err)
+		}
+		pw.writer = nil
+		pw.fileWriter = nil
+		pw.finalizeLocked()
+	}
+
+	// Create new file with timestamp
+	timestamp := time.Now().Format("20060102_150405")
+	filename := fmt.Sprintf("%s_%s.parquet", pw.config.FilePrefix, timestamp)
+	filepath := filepath.Join(pw.config.OutputDir, filename)
+
+	log.Printf("[DEBUG] Creating new parquet file: %s", filepath)
+
+	// Ensure output directory exists
+	if err := os.MkdirAll(pw.config.OutputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	// Create new parquet file, tracked first so the uploader never sees it
+	// before the footer is written
+	trackOpenFile(filepath)
+	fw, err := local.NewLocalFileWriter(filepath)
+	if err != nil {
+		releaseOpenFile(filepath)
+		return fmt.Errorf("failed to create parquet file: %w", err)
+	}
+	log.Println("[DEBUG] LocalFileWriter created successfully")
+
+	// Create parquet writer with compression
+	pw.fileWriter = fw
+	pw.writer, err = writer.NewParquetWriter(fw, pw.schemaJSON, 4)
+	if err != nil {
+		fw.Close()
+		releaseOpenFile(filepath)
+		return fmt.Errorf("failed to create parquet writer: %w", err)
+	}
+	log.Println("[DEBUG] ParquetWriter created successfully")
+
+	pw.writer.CompressionType = parquet.CompressionCodec_SNAPPY
+	if pw.schema.version > 0 {
+		name, version := pw.schema.name, strconv.Itoa(pw.schema.version)
+		pw.writer.Footer.KeyValueMetadata = append(pw.writer.Footer.KeyValueMetadata,
+			&parquet.KeyValue{Key: "schema", Value: &name},
+			&parquet.KeyValue{Key: "schema_version", Value: &version})
+	}
+	pw.currentFile = filepath
+	pw.recordCount = 0
+	pw.lastRotation = time.Now()
+
+	log.Printf("Created new parquet file: %s", filepath)
+	return nil
+}
+
+// Write converts a record to the schema's row and adds it to the parquet file
+func (pw *ParquetWriter) Write(rec *Record) error {
+	row, err := pw.schema.toRow(rec, pw.config.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	log.Printf("[DEBUG] Write called, writer is nil: %v", pw.writer == nil)
+
+	// Initialize writer if needed. The lock is held throughout so concurrent
+	// ingest partitions cannot both open a new file.
+	if pw.writer == nil {
+		log.Println("[DEBUG] Initializing new parquet file...")
+		if err := pw.rotateLocked(); err != nil {
+			log.Printf("[ERROR] Failed to rotate file: %v", err)
+			return err
+		}
+	}
+
+	// Write record
+	if err := pw.writer.Write(row); err != nil {
+		return fmt.Errorf("failed to write record: %w", err)
+	}
+
+	pw.recordCount++
+	log.Printf("[DEBUG] Record written successfully, total records: %d", pw.recordCount)
+	return nil
+}
+
+func (pw *ParquetWriter) openFile() string {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.writer == nil {
+		return ""
+	}
+	return pw.currentFile
+}
+
+// Flush logs the writer status and rotates the file when the rotation
+// interval has passed
+func (pw *ParquetWriter) Flush() error {
+	pw.mu.Lock()
+	if pw.writer != nil {
+		// Parquet writer doesn't have explicit flush, but WriteStop commits data
+		// We'll just log the current status
+		log.Printf("Current file: %s, Records written: %d", pw.currentFile, pw.recordCount)
+	}
+	pw.mu.Unlock()
+	return pw.CheckRotation()
+}
+
+// CheckRotation checks if file rotation is needed
+func (pw *ParquetWriter) CheckRotation() error {
+	if time.Since(pw.lastRotation) >= time.Duration(pw.config.RotationSec)*time.Second {
+		log.Println("File rotation interval reached, rotating file...")
+		return pw.rotateFile()
+	}
+	return nil
+}
+
+// Close closes the parquet writer
+func (pw *ParquetWriter) Close() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	if pw.writer != nil {
+		log.Printf("Final close: %s (records: %d)", pw.currentFile, pw.recordCount)
+		pw.writer.WriteStop()
+		pw.fileWriter.Close()
+		pw.writer = nil
+		pw.finalizeLocked()
+	}
+	return nil
+}
+
+// finalizeLocked encrypts the file just closed when encryption is
+// configured and records its checksum; the file stays tracked as open
+// until then so it is never uploaded in plaintext or without a checksum
+func (pw *ParquetWriter) finalizeLocked() {
+	defer releaseOpenFile(pw.currentFile)
+	if err := finalizeFile(pw.currentFile, pw.sealer); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vmSeries is one line of VictoriaMetrics' JSON line import format
+type vmSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+// victoriaMetricsSink converts every numeric record field into a sample and
+// posts them to /api/v1/import. Labels come from the room metadata in
+// rooms.yaml plus the sink's static labels.
+type victoriaMetricsSink struct {
+	mu       sync.Mutex
+	config   SinkConfig
+	rooms    map[string]RoomMetadata
+	client   *http.Client
+	pending  []vmSeries
+	imported int64
+	failed   int64
+}
+
+func newVictoriaMetricsSink(config SinkConfig, rooms map[string]RoomMetadata) (*victoriaMetricsSink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("victoriametrics sink requires url")
+	}
+	return &victoriaMetricsSink{
+		config: config,
+		rooms:  rooms,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (s *victoriaMetricsSink) Name() string { return "victoriametrics" }
+
+// metricName applies the configured naming: an explicit metric_names entry,
+// otherwise <metric_prefix>_<field>
+func (s *victoriaMetricsSink) metricName(field string) string {
+	if name, ok := s.config.MetricNames[field]; ok {
+		return name
+	}
+	if s.config.MetricPrefix == "" {
+		return field
+	}
+	return s.config.MetricPrefix + "_" + field
+}
+
+// labels builds the label set shared by every sample of a record
+func (s *victoriaMetricsSink) labels(rec *Record) map[string]string {
+	roomID := recordRoomID(rec)
+	labels := map[string]string{"room_id": roomID}
+	if room, ok := s.rooms[roomID]; ok {
+		labels = room.labels()
+	}
+	for k, v := range s.config.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// series converts a record into one series per numeric field. Booleans are
+// exported as 0/1; strings and nested values are skipped.
+func (s *victoriaMetricsSink) series(rec *Record) []vmSeries {
+	ts := rec.Received
+	if str, ok := rec.Fields["timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, str); err == nil {
+			ts = t
+		}
+	}
+	labels := s.labels(rec)
+
+	fields := make([]string, 0, len(rec.Fields))
+	for field := range rec.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var out []vmSeries
+	for _, field := range fields {
+		var value float64
+		switch v := rec.Fields[field].(type) {
+		case float64:
+			value = v
+		case bool:
+			if v {
+				value = 1
+			}
+		default:
+			continue
+		}
+		metric := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			metric[k] = v
+		}
+		metric["__name__"] = s.metricName(field)
+		out = append(out, vmSeries{Metric: metric, Values: []float64{value}, Timestamps: []int64{ts.UnixMilli()}})
+	}
+	return out
+}
+
+func (s *victoriaMetricsSink) Write(rec *Record) error {
+	if rec.Fields == nil {
+		return fmt.Errorf("payload is not a JSON object")
+	}
+	series := s.series(rec)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, series...)
+	if len(s.pending) >= s.config.BatchSize {
+		if err := s.flushLocked(); err != nil {
+			return fmt.Errorf("%w: %w", errBatched, err)
+		}
+	}
+	return nil
+}
+
+// flushLocked imports the pending samples; the caller must hold s.mu. On
+// failure the samples stay queued for the next flush.
+func (s *victoriaMetricsSink) flushLocked() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, series := range s.pending {
+		if err := enc.Encode(series); err != nil {
+			return fmt.Errorf("failed to encode series: %w", err)
+		}
+	}
+
+	if err := s.post(body.Bytes()); err != nil {
+		if over := len(s.pending) - s.config.BatchSize*maxPendingBatches; over > 0 {
+			log.Printf("[WARN] VictoriaMetrics retry buffer full, dropping %d oldest samples", over)
+			s.pending = append([]vmSeries(nil), s.pending[over:]...)
+			s.failed += int64(over)
+		}
+		return fmt.Errorf("import failed (%d samples queued): %w", len(s.pending), err)
+	}
+	log.Printf("[DEBUG] Imported %d samples into VictoriaMetrics", len(s.pending))
+	s.imported += int64(len(s.pending))
+	s.pending = s.pending[:0]
+	return nil
+}
+
+func (s *victoriaMetricsSink) post(body []byte) error {
+	url := strings.TrimRight(s.config.URL, "/") + "/api/v1/import"
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (s *victoriaMetricsSink) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.flushLocked()
+	log.Printf("VictoriaMetrics: imported %d, failed %d, queued %d", s.imported, s.failed, len(s.pending))
+	return err
+}
+
+func (s *victoriaMetricsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushLocked()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// unassignedTenant partitions records of rooms without a tenant
+const unassignedTenant = "unassigned"
+
+// recordTenant returns the tenant of a record: its tenant field when the
+// publisher set one, otherwise the tenant of its room in rooms.yaml
+func recordTenant(rec *Record, rooms map[string]RoomMetadata) string {
+	if tenant, _ := rec.Fields["tenant"].(string); tenant != "" {
+		return tenant
+	}
+	if room, ok := rooms[recordRoomID(rec)]; ok && room.Tenant != "" {
+		return room.Tenant
+	}
+	return unassignedTenant
+}
+
+// tenantPartitionedSink writes each tenant's records through its own file
+// sink under <output_dir>/tenant=<tenant>/, so tenants can be given access
+// to their own prefix of the lake
+type tenantPartitionedSink struct {
+	pipeline PipelineConfig
+	config   SinkConfig
+	bridge   *Config
+	mu       sync.Mutex
+	sinks    map[string]Sink
+}
+
+func newTenantPartitionedSink(pc PipelineConfig, sc SinkConfig, config *Config) (Sink, error) {
+	if sc.PartitionBy != "tenant" {
+		return nil, fmt.Errorf("unsupported partition_by %q", sc.PartitionBy)
+	}
+	if sc.Type != "parquet" && sc.Type != "jsonl" {
+		return nil, fmt.Errorf("partition_by is not supported for %s sinks", sc.Type)
+	}
+	return &tenantPartitionedSink{pipeline: pc, config: sc, bridge: config, sinks: make(map[string]Sink)}, nil
+}
+
+func (s *tenantPartitionedSink) Name() string { return s.config.Type }
+
+func (s *tenantPartitionedSink) Write(rec *Record) error {
+	sink, err := s.sink(recordTenant(rec, s.bridge.Rooms))
+	if err != nil {
+		return err
+	}
+	return sink.Write(rec)
+}
+
+// sink returns the tenant's sink, creating it on first use
+func (s *tenantPartitionedSink) sink(tenant string) (Sink, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sink, ok := s.sinks[tenant]; ok {
+		return sink, nil
+	}
+	sc := s.config
+	sc.PartitionBy = ""
+	sc.OutputDir = filepath.Join(s.config.OutputDir, "tenant="+sanitizePartition(tenant))
+	sink, err := newSink(s.pipeline, sc, s.bridge)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Pipeline %s: %s partition for tenant %s in %s", s.pipeline.Name, sc.Type, tenant, sc.OutputDir)
+	s.sinks[tenant] = sink
+	return sink, nil
+}
+
+func (s *tenantPartitionedSink) each(fn func(Sink) error) error {
+	s.mu.Lock()
+	sinks := make([]Sink, 0, len(s.sinks))
+	for _, sink := range s.sinks {
+		sinks = append(sinks, sink)
+	}
+	s.mu.Unlock()
+	var first error
+	for _, sink := range sinks {
+		if err := fn(sink); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *tenantPartitionedSink) Flush() error {
+	return s.each(Sink.Flush)
+}
+
+func (s *tenantPartitionedSink) Close() error {
+	return s.each(Sink.Close)
+}
+
+// sanitizePartition keeps a partition value to one safe path element
+func sanitizePartition(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '=' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, v)
+	if v == "" || v == "." || v == ".." {
+		return "_"
+	}
+	return v
+}
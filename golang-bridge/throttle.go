@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Record priorities used by the degradation policy
+const (
+	PriorityCritical = "critical" // never sampled or dropped (alarms, occupancy)
+	PriorityNormal   = "normal"
+	PriorityLow      = "low"
+)
+
+// shedTopic carries the periodic load-shedding report
+const shedTopic = "status/bridge/shed"
+
+// ThrottleConfig is the degradation policy applied when the ingest queues
+// back up. While shedding, low and normal priority records are sampled per
+// room (1 in N kept); critical records are always queued, blocking if needed.
+// Non-critical records are dropped outright when their queue is full.
+type ThrottleConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Queue fill fractions that start and stop shedding
+	HighWatermark float64 `yaml:"high_watermark,omitempty"`
+	LowWatermark  float64 `yaml:"low_watermark,omitempty"`
+	// Keep 1 of every N records per room while shedding
+	LowSampleEvery    int `yaml:"low_sample_every,omitempty"`
+	NormalSampleEvery int `yaml:"normal_sample_every,omitempty"`
+	// Rooms maps room ID patterns (path.Match syntax) to a priority; the
+	// first matching pattern in sorted order wins
+	Rooms map[string]string `yaml:"rooms,omitempty"`
+	// ProtectedTopics are topic filters whose records are always critical
+	ProtectedTopics []string `yaml:"protected_topics,omitempty"`
+	// ProtectedFields make a JSON record critical when any of these fields
+	// is set to a non-zero, non-false value (e.g. occupancy_count in room
+	// telemetry)
+	ProtectedFields []string `yaml:"protected_fields,omitempty"`
+}
+
+func (c *ThrottleConfig) normalize() error {
+	if c.HighWatermark <= 0 || c.HighWatermark > 1 {
+		c.HighWatermark = 0.8
+	}
+	if c.LowWatermark <= 0 || c.LowWatermark >= c.HighWatermark {
+		c.LowWatermark = c.HighWatermark / 2
+	}
+	if c.LowSampleEvery <= 0 {
+		c.LowSampleEvery = 10
+	}
+	if c.NormalSampleEvery <= 0 {
+		c.NormalSampleEvery = 2
+	}
+	for pattern, priority := range c.Rooms {
+		if !validPriority(priority) {
+			return fmt.Errorf("throttle: room %s has unknown priority %q", pattern, priority)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("throttle: invalid room pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func validPriority(p string) bool {
+	return p == PriorityCritical || p == PriorityNormal || p == PriorityLow
+}
+
+// ShedReport is published on status/bridge/shed
+type ShedReport struct {
+	Shedding bool             `json:"shedding"`
+	Dropped  map[string]int64 `json:"dropped"` // pipeline/priority → records since last report
+	Total    int64            `json:"total_dropped"`
+	Time     string           `json:"timestamp"`
+}
+
+// throttle tracks shedding state and per-room sampling counters
+type throttle struct {
+	config   ThrottleConfig
+	patterns []string // keys of config.Rooms, sorted
+	shedding atomic.Bool
+	mu       sync.Mutex
+	seen     map[string]int
+	dropped  map[string]int64
+	total    int64
+}
+
+func newThrottle(config ThrottleConfig) *throttle {
+	patterns := make([]string, 0, len(config.Rooms))
+	for pattern := range config.Rooms {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	return &throttle{
+		config:   config,
+		patterns: patterns,
+		seen:     make(map[string]int),
+		dropped:  make(map[string]int64),
+	}
+}
+
+// priorityFor resolves a message's priority: protected topics and fields
+// first, then room overrides, then the pipeline's priority
+func (t *throttle) priorityFor(p *Pipeline, topic string, payload []byte) string {
+	for _, filter := range t.config.ProtectedTopics {
+		if topicMatches(filter, topic) {
+			return PriorityCritical
+		}
+	}
+	if t.protectedPayload(payload) {
+		return PriorityCritical
+	}
+	room := topic[strings.LastIndex(topic, "/")+1:]
+	for _, pattern := range t.patterns {
+		if ok, _ := path.Match(pattern, room); ok {
+			return t.config.Rooms[pattern]
+		}
+	}
+	return p.config.Priority
+}
+
+// protectedPayload reports whether a JSON object payload sets one of the
+// protected fields. Compressed or non-object payloads are not inspected.
+func (t *throttle) protectedPayload(payload []byte) bool {
+	if len(t.config.ProtectedFields) == 0 {
+		return false
+	}
+	var fields map[string]interface{}
+	if json.Unmarshal(payload, &fields) != nil {
+		return false
+	}
+	for _, name := range t.config.ProtectedFields {
+		switch v := fields[name].(type) {
+		case bool:
+			if v {
+				return true
+			}
+		case float64:
+			if v != 0 {
+				return true
+			}
+		case string:
+			if v != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admit decides whether a message is queued. fill is the target queue's
+// fill fraction and full reports whether a send would block.
+func (t *throttle) admit(p *Pipeline, topic string, payload []byte, fill float64, full bool) bool {
+	if !t.config.Enabled {
+		return true
+	}
+	if fill >= t.config.HighWatermark && t.shedding.CompareAndSwap(false, true) {
+		log.Printf("[WARN] Ingest queue at %.0f%%, shedding low-priority records", fill*100)
+	} else if fill <= t.config.LowWatermark && t.shedding.CompareAndSwap(true, false) {
+		log.Printf("Ingest queue at %.0f%%, shedding stopped", fill*100)
+	}
+
+	if !full && !t.shedding.Load() {
+		return true
+	}
+	priority := t.priorityFor(p, topic, payload)
+	if priority == PriorityCritical {
+		return true
+	}
+	if full {
+		t.drop(p, priority)
+		return false
+	}
+
+	every := t.config.NormalSampleEvery
+	if priority == PriorityLow {
+		every = t.config.LowSampleEvery
+	}
+	t.mu.Lock()
+	key := p.config.Name + "|" + topic
+	n := t.seen[key]
+	t.seen[key] = n + 1
+	t.mu.Unlock()
+	if n%every == 0 {
+		return true
+	}
+	t.drop(p, priority)
+	return false
+}
+
+func (t *throttle) drop(p *Pipeline, priority string) {
+	t.mu.Lock()
+	t.dropped[p.config.Name+"/"+priority]++
+	t.total++
+	t.mu.Unlock()
+}
+
+// report returns the shedding counters since the previous report
+func (t *throttle) report() ShedReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := ShedReport{
+		Shedding: t.shedding.Load(),
+		Dropped:  t.dropped,
+		Total:    t.total,
+		Time:     time.Now().Format(time.RFC3339),
+	}
+	t.dropped = make(map[string]int64)
+	if !r.Shedding {
+		t.seen = make(map[string]int)
+	}
+	return r
+}
+
+// publishShedReport logs and publishes how many records were shed since the
+// last flush interval
+func (h *MQTTHandler) publishShedReport() {
+	r := h.throttle.report()
+	if len(r.Dropped) == 0 && !r.Shedding {
+		return
+	}
+	log.Printf("[STATS] Shedding=%v, dropped since last report: %v (total %d)", r.Shedding, r.Dropped, r.Total)
+	payload, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal shed report: %v", err)
+		return
+	}
+	if h.client == nil || !h.client.IsConnected() {
+		return
+	}
+	token := h.client.Publish(shedTopic, 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish shed report: %v", token.Error())
+	}
+}
+
+// topicMatches reports whether an MQTT topic matches a filter with + and #
+// wildcards
+func topicMatches(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		if parts := strings.SplitN(filter, "/", 3); len(parts) == 3 {
+			filter = parts[2]
+		}
+	}
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// enqueue applies the degradation policy and queues the message
+func (h *MQTTHandler) enqueue(p *Pipeline, msg mqtt.Message) {
+	queue := h.partitions[h.partitionFor(msg.Topic())]
+	fill := float64(len(queue)) / float64(cap(queue))
+	if !h.throttle.admit(p, msg.Topic(), msg.Payload(), fill, len(queue) == cap(queue)) {
+		return
+	}
+	queue <- pipelineMessage{pipeline: p, msg: msg, arrived: time.Now()}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/types"
+)
+
+// Timestamp encodings for the parquet timestamp column
+const (
+	// TimestampNanos is the original encoding: plain INT64 Unix nanoseconds
+	// without a logical type
+	TimestampNanos  = "nanos"
+	TimestampMillis = "millis"
+	TimestampMicros = "micros"
+	// TimestampInt96 is the legacy Impala/Hive encoding
+	TimestampInt96 = "int96"
+)
+
+// timestampColumnTags maps each encoding to its parquet tag. The millis and
+// micros encodings set both the logical type and the older converted type so
+// readers that only know one of them still see a timestamp.
+var timestampColumnTags = map[string]string{
+	TimestampNanos: "name=timestamp, type=INT64",
+	TimestampMillis: "name=timestamp, type=INT64, convertedtype=TIMESTAMP_MILLIS, " +
+		"logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MILLIS",
+	TimestampMicros: "name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS, " +
+		"logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=MICROS",
+	TimestampInt96: "name=timestamp, type=INT96",
+}
+
+// schemaField is a node of parquet-go's JSON schema format
+type schemaField struct {
+	Tag    string        `json:"Tag"`
+	Fields []schemaField `json:"Fields,omitempty"`
+}
+
+// parquetSchemaJSON builds the parquet JSON schema from a row struct's tags,
+// replacing timestamp columns with the configured encoding. A timestamp column
+// is the one named timestamp or any field tagged `timestamp:"true"`; its INT96
+// value is read from the companion <Field>Int96 string field.
+func parquetSchemaJSON(row interface{}, mode string) (string, error) {
+	timestampTag, ok := timestampColumnTags[mode]
+	if !ok {
+		return "", fmt.Errorf("unknown timestamp encoding %q (want nanos, millis, micros or int96)", mode)
+	}
+
+	root := schemaField{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	t := reflect.Indirect(reflect.ValueOf(row)).Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("parquet")
+		if tag == "" {
+			continue
+		}
+		inName := field.Name
+		if strings.HasPrefix(tag, "name=timestamp,") || field.Tag.Get("timestamp") == "true" {
+			name, rest, _ := strings.Cut(tag, ",")
+			tag = strings.Replace(timestampTag, "name=timestamp", name, 1)
+			if strings.Contains(rest, "repetitiontype=OPTIONAL") {
+				tag += ", repetitiontype=OPTIONAL"
+			}
+			if mode == TimestampInt96 {
+				inName = field.Name + "Int96"
+			}
+		}
+		root.Fields = append(root.Fields, schemaField{Tag: tag + ", inname=" + inName})
+	}
+
+	schema, err := json.Marshal(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal parquet schema: %w", err)
+	}
+	return string(schema), nil
+}
+
+// encodeTimestamp returns the INT64 and INT96 column values for ts in the
+// configured encoding
+func encodeTimestamp(ts time.Time, mode string) (int64, string) {
+	switch mode {
+	case TimestampMillis:
+		return ts.UnixMilli(), ""
+	case TimestampMicros:
+		return ts.UnixMicro(), ""
+	case TimestampInt96:
+		return ts.UnixNano(), types.TimeToINT96(ts)
+	default:
+		return ts.UnixNano(), ""
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadConfig ships closed Parquet and JSONL files to S3-compatible object
+// storage (AWS S3, MinIO, or GCS through its XML API with HMAC keys). Object
+// keys are deterministic, <prefix><path relative to OUTPUT_DIR>, and every
+// object carries the SHA-256 of its file, so retries and restarts never
+// create duplicates: a file whose object already exists with the same size
+// and checksum is recorded as uploaded without sending it again. Files of at
+// least multipart_threshold_mb are sent as multipart uploads whose progress
+// is kept in the ledger and resumed after a failure or restart; the object
+// only appears once all parts are in. Credentials may reference environment
+// variables as ${VAR}.
+type UploadConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix,omitempty"`
+	Region    string `yaml:"region,omitempty"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// PathStyle addresses the bucket as <endpoint>/<bucket> (MinIO) instead
+	// of <bucket>.<endpoint>
+	PathStyle            bool `yaml:"path_style,omitempty"`
+	IntervalSec          int  `yaml:"interval_sec,omitempty"`
+	PartSizeMB           int  `yaml:"part_size_mb,omitempty"`
+	MultipartThresholdMB int  `yaml:"multipart_threshold_mb,omitempty"`
+	// Ledger is the local upload state file, <OUTPUT_DIR>/.upload_ledger.json
+	// by default
+	Ledger string `yaml:"ledger,omitempty"`
+	// ShutdownTimeoutSec bounds the final upload pass on shutdown
+	ShutdownTimeoutSec int `yaml:"shutdown_timeout_sec,omitempty"`
+}
+
+// minPartSize is the smallest part S3 accepts (except for the last one)
+const minPartSize = 5 << 20
+
+// maxParts is the S3 limit on parts per upload
+const maxParts = 10000
+
+func (c *UploadConfig) normalize(config *Config) error {
+	if !c.Enabled {
+		return nil
+	}
+	c.Endpoint = os.ExpandEnv(c.Endpoint)
+	c.AccessKey = os.ExpandEnv(c.AccessKey)
+	c.SecretKey = os.ExpandEnv(c.SecretKey)
+	if c.Endpoint == "" || c.Bucket == "" {
+		return fmt.Errorf("upload: endpoint and bucket are required")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return fmt.Errorf("upload: access_key and secret_key are required")
+	}
+	c.Prefix = strings.TrimPrefix(c.Prefix, "/")
+	if c.Prefix != "" && !strings.HasSuffix(c.Prefix, "/") {
+		c.Prefix += "/"
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = 60
+	}
+	if c.PartSizeMB <= 0 {
+		c.PartSizeMB = 16
+	}
+	if c.PartSizeMB < minPartSize>>20 {
+		return fmt.Errorf("upload: part_size_mb must be at least %d", minPartSize>>20)
+	}
+	if c.MultipartThresholdMB <= 0 {
+		c.MultipartThresholdMB = 64
+	}
+	if c.Ledger == "" {
+		c.Ledger = filepath.Join(config.OutputDir, ".upload_ledger.json")
+	}
+	if c.ShutdownTimeoutSec <= 0 {
+		c.ShutdownTimeoutSec = 30
+	}
+	return nil
+}
+
+// openFiles holds the files sinks are still writing; they are not uploaded
+// until rotation or shutdown closes them
+var openFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func trackOpenFile(path string) {
+	openFiles.Lock()
+	openFiles.paths[filepath.Clean(path)] = true
+	openFiles.Unlock()
+}
+
+func releaseOpenFile(path string) {
+	openFiles.Lock()
+	delete(openFiles.paths, filepath.Clean(path))
+	openFiles.Unlock()
+}
+
+func isOpenFile(path string) bool {
+	openFiles.Lock()
+	defer openFiles.Unlock()
+	return openFiles.paths[filepath.Clean(path)]
+}
+
+// Ledger states of a file
+const (
+	uploadPending   = "pending"
+	uploadUploading = "uploading"
+	uploadDone      = "uploaded"
+	uploadSkipped   = "skipped"
+	uploadCorrupt   = "corrupt"
+)
+
+// ledgerEntry is the upload state of one local file. Size and ModTime
+// identify the file version the entry describes.
+type ledgerEntry struct {
+	Key        string       `json:"key"`
+	Size       int64        `json:"size"`
+	ModTime    time.Time    `json:"mod_time"`
+	SHA256     string       `json:"sha256,omitempty"`
+	State      string       `json:"state"`
+	UploadID   string       `json:"upload_id,omitempty"`
+	PartSize   int64        `json:"part_size,omitempty"`
+	Parts      []objectPart `json:"parts,omitempty"`
+	UploadedAt *time.Time   `json:"uploaded_at,omitempty"`
+	Attempts   int          `json:"attempts,omitempty"`
+	LastError  string       `json:"last_error,omitempty"`
+}
+
+// uploadLedger is the local record of upload progress, rewritten atomically
+// after every state change
+type uploadLedger struct {
+	path  string
+	Files map[string]*ledgerEntry `json:"files"`
+}
+
+func loadUploadLedger(path string) (*uploadLedger, error) {
+	ledger := &uploadLedger{path: path, Files: make(map[string]*ledgerEntry)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ledger, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, ledger); err != nil {
+		return nil, fmt.Errorf("failed to parse upload ledger %s: %w", path, err)
+	}
+	if ledger.Files == nil {
+		ledger.Files = make(map[string]*ledgerEntry)
+	}
+	return ledger, nil
+}
+
+func (l *uploadLedger) save() error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload ledger: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to create ledger directory: %w", err)
+	}
+	tmp := l.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to write upload ledger: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write upload ledger: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync upload ledger: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write upload ledger: %w", err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("failed to replace upload ledger: %w", err)
+	}
+	return nil
+}
+
+// uploader periodically uploads closed files from the sink output
+// directories
+type uploader struct {
+	config    *UploadConfig
+	store     *objectStore
+	outputDir string
+	roots     []string
+	ledger    *uploadLedger
+	// mu serializes upload passes
+	mu sync.Mutex
+}
+
+func newUploader(config *UploadConfig, bridge *Config, roots []string) (*uploader, error) {
+	store, err := newObjectStore(config)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := loadUploadLedger(config.Ledger)
+	if err != nil {
+		return nil, err
+	}
+	return &uploader{
+		config:    config,
+		store:     store,
+		outputDir: filepath.Clean(bridge.OutputDir),
+		roots:     roots,
+		ledger:    ledger,
+	}, nil
+}
+
+// uploadRoots returns the distinct output directories of the file sinks
+func uploadRoots(file *BridgeFile, config *Config) []string {
+	seen := make(map[string]bool)
+	var roots []string
+	for _, pc := range file.Pipelines {
+		for _, sc := range pc.Sinks {
+			if sc.Type != "parquet" && sc.Type != "jsonl" {
+				continue
+			}
+			sc.normalize(pc, config)
+			dir := filepath.Clean(sc.OutputDir)
+			if !seen[dir] {
+				seen[dir] = true
+				roots = append(roots, dir)
+			}
+		}
+	}
+	return roots
+}
+
+// objectKey maps a local file to its object key: its path relative to
+// OUTPUT_DIR, or its absolute path for sinks writing elsewhere
+func (u *uploader) objectKey(path string) string {
+	rel, err := filepath.Rel(u.outputDir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = strings.TrimPrefix(path, string(filepath.Separator))
+	}
+	return u.config.Prefix + filepath.ToSlash(rel)
+}
+
+// run uploads on every interval until done is closed, starting with a pass
+// that picks up files left over from before a restart
+func (u *uploader) run(done <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	ticker := time.NewTicker(time.Duration(u.config.IntervalSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		u.pass(ctx)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finalPass uploads the files closed at shutdown, bounded by the shutdown
+// timeout; unfinished multipart uploads resume on the next start
+func (u *uploader) finalPass() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(u.config.ShutdownTimeoutSec)*time.Second)
+	defer cancel()
+	u.pass(ctx)
+}
+
+// pass uploads every closed file that is not yet in the object store
+func (u *uploader) pass(ctx context.Context) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	files := u.closedFiles()
+	uploaded, failed := 0, 0
+	for _, path := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		sent, err := u.uploadFile(ctx, path)
+		if err != nil {
+			failed++
+			log.Printf("[ERROR] Upload of %s failed: %v", path, err)
+			continue
+		}
+		if sent {
+			uploaded++
+		}
+	}
+	u.prune(files)
+	if err := u.ledger.save(); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+	if uploaded > 0 || failed > 0 {
+		log.Printf("[STATS] Upload pass: %d uploaded, %d failed", uploaded, failed)
+	}
+}
+
+// closedFiles lists the sink files under the roots that no sink
+// is writing, oldest name first
+func (u *uploader) closedFiles() []string {
+	seen := make(map[string]bool)
+	var files []string
+	for _, root := range u.roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() || seen[path] {
+				return nil
+			}
+			if !uploadable(path) {
+				return nil
+			}
+			seen[path] = true
+			if !isOpenFile(path) {
+				files = append(files, path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed to scan %s for uploads: %v", root, err)
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// uploadable reports whether a path is a sink file: Parquet or JSONL, or
+// either encrypted with age
+func uploadable(path string) bool {
+	ext := filepath.Ext(strings.TrimSuffix(path, sealedExt))
+	return ext == ".parquet" || ext == ".jsonl"
+}
+
+// prune forgets uploaded files that have been removed locally
+func (u *uploader) prune(files []string) {
+	present := make(map[string]bool, len(files))
+	for _, path := range files {
+		present[path] = true
+	}
+	for path, entry := range u.ledger.Files {
+		if present[path] || isOpenFile(path) || entry.State != uploadDone && entry.State != uploadSkipped && entry.State != uploadCorrupt {
+			continue
+		}
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			delete(u.ledger.Files, path)
+		}
+	}
+}
+
+// uploadFile brings one file's object up to date and reports whether it
+// sent data
+func (u *uploader) uploadFile(ctx context.Context, path string) (bool, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	entry := u.ledger.Files[path]
+	if entry != nil && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		if entry.State == uploadDone || entry.State == uploadSkipped || entry.State == uploadCorrupt {
+			return false, nil
+		}
+	} else {
+		if entry != nil && entry.UploadID != "" {
+			// The file changed since the upload started, so its parts are stale
+			if err := u.store.abortMultipartUpload(ctx, entry.Key, entry.UploadID); err != nil {
+				log.Printf("[WARN] %v", err)
+			}
+		}
+		entry = &ledgerEntry{Key: u.objectKey(path), Size: info.Size(), ModTime: info.ModTime(), State: uploadPending}
+		u.ledger.Files[path] = entry
+	}
+
+	sent, err := u.syncEntry(ctx, path, entry)
+	if err != nil {
+		entry.Attempts++
+		entry.LastError = err.Error()
+	}
+	if saveErr := u.ledger.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return sent, err
+}
+
+func (u *uploader) syncEntry(ctx context.Context, path string, entry *ledgerEntry) (bool, error) {
+	if entry.SHA256 == "" {
+		if filepath.Ext(path) == ".parquet" && !parquetComplete(path, entry.Size) {
+			// Left behind by a crash before the footer was written
+			log.Printf("[WARN] Not uploading incomplete Parquet file %s", path)
+			entry.State = uploadSkipped
+			return false, nil
+		}
+		checksum, err := fileSHA256(path)
+		if err != nil {
+			return false, err
+		}
+		recorded, err := readChecksum(path)
+		if err != nil {
+			return false, err
+		}
+		if recorded != "" && recorded != checksum {
+			// Corrupted on local storage since finalization
+			log.Printf("[ERROR] Not uploading %s: checksum %s does not match the recorded %s", path, checksum, recorded)
+			entry.State = uploadCorrupt
+			entry.LastError = "checksum mismatch"
+			return false, nil
+		}
+		entry.SHA256 = checksum
+	}
+
+	size, checksum, exists, err := u.store.headObject(ctx, entry.Key)
+	if err != nil {
+		return false, err
+	}
+	if exists && size == entry.Size && checksum == entry.SHA256 {
+		if entry.UploadID != "" {
+			// Completed before the ledger was updated
+			entry.UploadID, entry.Parts = "", nil
+		}
+		log.Printf("Object %s already holds %s, not uploading again", entry.Key, path)
+		u.markUploaded(entry)
+		return false, nil
+	}
+	if exists && entry.UploadID == "" {
+		log.Printf("[WARN] Object %s differs from %s (size %d, sha256 %q), replacing it", entry.Key, path, size, checksum)
+	}
+
+	if entry.Size < int64(u.config.MultipartThresholdMB)<<20 {
+		err = u.putFile(ctx, path, entry)
+	} else {
+		err = u.multipartFile(ctx, path, entry)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Verify the object before recording it as uploaded
+	size, checksum, exists, err = u.store.headObject(ctx, entry.Key)
+	if err != nil {
+		return true, err
+	}
+	if !exists || size != entry.Size || checksum != entry.SHA256 {
+		return true, fmt.Errorf("object %s does not match after upload (size %d, sha256 %q)", entry.Key, size, checksum)
+	}
+	u.markUploaded(entry)
+	log.Printf("Uploaded %s to %s (%d bytes)", path, entry.Key, entry.Size)
+	return true, nil
+}
+
+func (u *uploader) markUploaded(entry *ledgerEntry) {
+	now := time.Now().UTC()
+	entry.State = uploadDone
+	entry.UploadedAt = &now
+	entry.LastError = ""
+}
+
+// putFile uploads a small file in one request
+func (u *uploader) putFile(ctx context.Context, path string, entry *ledgerEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entry.State = uploadUploading
+	return u.store.putObject(ctx, entry.Key, f, entry.Size, entry.SHA256)
+}
+
+// multipartFile uploads a large file in parts, resuming the upload recorded
+// in the ledger when the store still has it. Parts are only reused when the
+// store holds them with the ETag and size the ledger recorded.
+func (u *uploader) multipartFile(ctx context.Context, path string, entry *ledgerEntry) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	done := make(map[int]objectPart)
+	if entry.UploadID != "" {
+		remote, err := u.store.listParts(ctx, entry.Key, entry.UploadID)
+		switch {
+		case errors.Is(err, errNoSuchUpload):
+			log.Printf("[WARN] Multipart upload of %s no longer exists, starting over", entry.Key)
+			entry.UploadID, entry.Parts = "", nil
+		case err != nil:
+			return err
+		default:
+			for _, part := range entry.Parts {
+				r, ok := remote[part.Number]
+				if ok && strings.Trim(r.ETag, `"`) == strings.Trim(part.ETag, `"`) && r.Size == part.Size {
+					done[part.Number] = part
+				}
+			}
+			log.Printf("Resuming upload of %s with %d part(s) already stored", entry.Key, len(done))
+		}
+	}
+	if entry.UploadID == "" {
+		entry.PartSize = partSize(entry.Size, int64(u.config.PartSizeMB)<<20)
+		uploadID, err := u.store.createMultipartUpload(ctx, entry.Key, entry.SHA256)
+		if err != nil {
+			return err
+		}
+		entry.UploadID = uploadID
+		entry.Parts = nil
+		entry.State = uploadUploading
+		if err := u.ledger.save(); err != nil {
+			return err
+		}
+	}
+
+	count := int((entry.Size + entry.PartSize - 1) / entry.PartSize)
+	parts := make([]objectPart, 0, count)
+	for n := 1; n <= count; n++ {
+		if part, ok := done[n]; ok {
+			parts = append(parts, part)
+			continue
+		}
+		offset := int64(n-1) * entry.PartSize
+		size := entry.PartSize
+		if rest := entry.Size - offset; rest < size {
+			size = rest
+		}
+		section := io.NewSectionReader(f, offset, size)
+		checksum, err := readerSHA256(section)
+		if err != nil {
+			return err
+		}
+		if _, err := section.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		etag, err := u.store.uploadPart(ctx, entry.Key, entry.UploadID, n, section, size, checksum)
+		if err != nil {
+			if errors.Is(err, errNoSuchUpload) {
+				entry.UploadID, entry.Parts = "", nil
+			} else {
+				entry.Parts = parts
+			}
+			return err
+		}
+		parts = append(parts, objectPart{Number: n, ETag: etag, Size: size})
+		entry.Parts = parts
+		if err := u.ledger.save(); err != nil {
+			return err
+		}
+	}
+
+	if err := u.store.completeMultipartUpload(ctx, entry.Key, entry.UploadID, parts); err != nil {
+		if errors.Is(err, errNoSuchUpload) {
+			// Either completed by an earlier attempt whose response was
+			// lost or expired; the next pass checks the object first
+			entry.UploadID, entry.Parts = "", nil
+		}
+		return err
+	}
+	entry.UploadID, entry.Parts = "", nil
+	return nil
+}
+
+// partSize returns the configured part size, raised when needed to stay
+// within the part count limit
+func partSize(fileSize, configured int64) int64 {
+	size := configured
+	for (fileSize+size-1)/size > maxParts {
+		size *= 2
+	}
+	return size
+}
+
+// parquetComplete reports whether a Parquet file ends with the footer magic
+// written when the file is closed
+func parquetComplete(path string, size int64) bool {
+	if size < 8 {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := f.ReadAt(magic, size-4); err != nil {
+		return false
+	}
+	return string(magic) == "PAR1"
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerSHA256(f)
+}
+
+func readerSHA256(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", fmt.Errorf("failed to checksum file: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// maxWindowSamples bounds the per-sensor sample window so sensors that are
+// not assigned to any room cannot grow it without limit
+const maxWindowSamples = 1024
+
+// Aggregation functions applied to the samples of a publish window
+const (
+	aggregateLast   = "last"
+	aggregateMean   = "mean"
+	aggregateMedian = "median"
+	aggregateMin    = "min"
+	aggregateMax    = "max"
+	aggregateSum    = "sum"
+)
+
+// AggregationConfig selects, per sensor type, how the readings collected
+// during a publish window become the telemetry value, e.g. max for CO2
+// alarms and mean for reporting. Types not listed publish the last reading;
+// noise_db (Leq) and vibration (RMS and peak) always use their own.
+type AggregationConfig struct {
+	Functions map[string]string `yaml:"functions"`
+}
+
+func (c *AggregationConfig) normalize() error {
+	for sensorType, fn := range c.Functions {
+		if _, ok := canonicalUnits[sensorType]; !ok {
+			return fmt.Errorf("aggregation for unknown sensor type %s", sensorType)
+		}
+		switch sensorType {
+		case "noise_db", "vibration", "leak", "contact":
+			return fmt.Errorf("aggregation of %s is fixed", sensorType)
+		}
+		switch fn {
+		case aggregateLast, aggregateMean, aggregateMedian, aggregateMin, aggregateMax, aggregateSum:
+		default:
+			return fmt.Errorf("unknown aggregation %q for %s (want last, mean, median, min, max or sum)", fn, sensorType)
+		}
+	}
+	return nil
+}
+
+// aggregate applies the configured function of a sensor type to a window;
+// last is the latest reading, used when the window is empty
+func (c *AggregationConfig) aggregate(sensorType string, samples []float64, last float64) float64 {
+	if len(samples) == 0 {
+		return last
+	}
+	switch c.Functions[sensorType] {
+	case aggregateMean:
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+		return sum / float64(len(samples))
+	case aggregateMedian:
+		sorted := append([]float64(nil), samples...)
+		sort.Float64s(sorted)
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[mid-1] + sorted[mid]) / 2
+		}
+		return sorted[mid]
+	case aggregateMin:
+		min := samples[0]
+		for _, v := range samples[1:] {
+			min = math.Min(min, v)
+		}
+		return min
+	case aggregateMax:
+		max := samples[0]
+		for _, v := range samples[1:] {
+			max = math.Max(max, v)
+		}
+		return max
+	case aggregateSum:
+		var sum float64
+		for _, v := range samples {
+			sum += v
+		}
+		return sum
+	default:
+		return last
+	}
+}
+
+// recordSample appends a successful reading to the sensor's aggregation
+// window. The caller must hold gw.readingsMutex.
+func (gw *Gateway) recordSample(sensorID string, value float64) {
+	samples := append(gw.windowSamples[sensorID], value)
+	if len(samples) > maxWindowSamples {
+		samples = samples[len(samples)-maxWindowSamples:]
+	}
+	gw.windowSamples[sensorID] = samples
+}
+
+// takeSamples returns and clears the samples collected for a sensor since the
+// previous aggregation. The caller must hold gw.readingsMutex.
+func (gw *Gateway) takeSamples(sensorID string) []float64 {
+	samples := gw.windowSamples[sensorID]
+	delete(gw.windowSamples, sensorID)
+	return samples
+}
+
+// equivalentLevel computes the Leq of a set of sound levels in dB, i.e. the
+// energy average 10*log10(mean(10^(L/10))) rather than an arithmetic mean.
+func equivalentLevel(levels []float64) float64 {
+	if len(levels) == 0 {
+		return 0
+	}
+	var energy float64
+	for _, l := range levels {
+		energy += math.Pow(10, l/10)
+	}
+	return 10 * math.Log10(energy/float64(len(levels)))
+}
+
+// rootMeanSquare returns the RMS of the samples
+func rootMeanSquare(samples []float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range samples {
+		sum += v * v
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// peakAbsolute returns the largest absolute sample value
+func peakAbsolute(samples []float64) float64 {
+	var peak float64
+	for _, v := range samples {
+		if a := math.Abs(v); a > peak {
+			peak = a
+		}
+	}
+	return peak
+}
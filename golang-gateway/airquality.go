@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+)
+
+// AirQualityConfig configures the composite indoor air quality index. Each
+// metric is keyed by sensor type and converted to a 0-100 sub-score (higher is
+// better) by linear interpolation between its breakpoints; the index is the
+// weighted mean of the sub-scores available in a room.
+type AirQualityConfig struct {
+	Enabled *bool                       `yaml:"enabled,omitempty"`
+	Metrics map[string]AirQualityMetric `yaml:"metrics,omitempty"`
+}
+
+type AirQualityMetric struct {
+	Weight      float64      `yaml:"weight"`
+	Breakpoints []Breakpoint `yaml:"breakpoints"`
+}
+
+type Breakpoint struct {
+	Value float64 `yaml:"value"`
+	Score float64 `yaml:"score"`
+}
+
+// defaultAirQualityMetrics loosely follow WELL/RESET guidance
+func defaultAirQualityMetrics() map[string]AirQualityMetric {
+	return map[string]AirQualityMetric{
+		"co2": {Weight: 0.3, Breakpoints: []Breakpoint{
+			{400, 100}, {800, 80}, {1000, 60}, {1500, 30}, {2500, 0}}},
+		"pm25": {Weight: 0.2, Breakpoints: []Breakpoint{
+			{0, 100}, {12, 80}, {35, 50}, {55, 25}, {150, 0}}},
+		"pm10": {Weight: 0.1, Breakpoints: []Breakpoint{
+			{0, 100}, {54, 80}, {154, 50}, {254, 25}, {424, 0}}},
+		"tvoc": {Weight: 0.2, Breakpoints: []Breakpoint{
+			{0, 100}, {220, 80}, {660, 50}, {2200, 20}, {5500, 0}}},
+		"humidity": {Weight: 0.1, Breakpoints: []Breakpoint{
+			{0, 0}, {30, 80}, {40, 100}, {60, 100}, {70, 80}, {100, 0}}},
+		"temperature": {Weight: 0.1, Breakpoints: []Breakpoint{
+			{15, 0}, {20, 100}, {25, 100}, {30, 0}}},
+	}
+}
+
+// normalize fills in defaults and sorts breakpoints by value
+func (c *AirQualityConfig) normalize() {
+	if c.Enabled == nil {
+		enabled := true
+		c.Enabled = &enabled
+	}
+	if len(c.Metrics) == 0 {
+		c.Metrics = defaultAirQualityMetrics()
+	}
+	for name, metric := range c.Metrics {
+		sort.Slice(metric.Breakpoints, func(i, j int) bool {
+			return metric.Breakpoints[i].Value < metric.Breakpoints[j].Value
+		})
+		c.Metrics[name] = metric
+	}
+}
+
+// score computes the composite index from the latest value per sensor type.
+// It returns false when disabled or when none of the configured metrics are
+// present, in which case a device-provided index is used as-is.
+func (c *AirQualityConfig) score(values map[string]float64) (float64, bool) {
+	if c.Enabled != nil && !*c.Enabled {
+		return 0, false
+	}
+	var weighted, totalWeight float64
+	for name, metric := range c.Metrics {
+		value, ok := values[name]
+		if !ok || metric.Weight <= 0 || len(metric.Breakpoints) == 0 {
+			continue
+		}
+		weighted += metric.Weight * interpolateScore(metric.Breakpoints, value)
+		totalWeight += metric.Weight
+	}
+	if totalWeight == 0 {
+		return 0, false
+	}
+	return weighted / totalWeight, true
+}
+
+// interpolateScore maps a value onto sorted breakpoints, clamping outside the
+// configured range
+func interpolateScore(points []Breakpoint, value float64) float64 {
+	if value <= points[0].Value {
+		return points[0].Score
+	}
+	for i := 1; i < len(points); i++ {
+		lo, hi := points[i-1], points[i]
+		if value <= hi.Value {
+			if hi.Value == lo.Value {
+				return hi.Score
+			}
+			frac := (value - lo.Value) / (hi.Value - lo.Value)
+			return lo.Score + frac*(hi.Score-lo.Score)
+		}
+	}
+	return points[len(points)-1].Score
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alarmSeverities in escalation order
+var alarmSeverities = []string{"low", "medium", "high", "critical"}
+
+// Alarm states
+const (
+	alarmActive       = "active"
+	alarmAcknowledged = "acknowledged"
+	alarmCleared      = "cleared"
+)
+
+// AlarmsConfig turns leak/contact events and rule events with a severity
+// into alarms that must be acknowledged. An alarm notifies the first
+// contact group of its zone's escalation chain; while it stays
+// unacknowledged, every escalate_after_min it is raised one severity and the
+// next group is notified. Notifications are published on
+// alarms/notify/<group> for the paging/e-mail integration to deliver.
+type AlarmsConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	EscalateAfterMin int  `yaml:"escalate_after_min"`
+	CheckIntervalSec int  `yaml:"check_interval_sec"`
+	// Escalation is the default chain of contact group names
+	Escalation    []string             `yaml:"escalation"`
+	ContactGroups []ContactGroupConfig `yaml:"contact_groups"`
+	Zones         []ZoneAlarmConfig    `yaml:"zones"`
+	// Severities of alarms raised by binary sensors
+	LeakSeverity    string `yaml:"leak_severity"`
+	ContactSeverity string `yaml:"contact_severity"`
+}
+
+// ContactGroupConfig is a set of people notified together; contacts are
+// opaque to the gateway (addresses, numbers or on-call schedule IDs)
+type ContactGroupConfig struct {
+	Name     string   `yaml:"name"`
+	Contacts []string `yaml:"contacts"`
+}
+
+// ZoneAlarmConfig overrides the escalation chain and delay for a zone
+type ZoneAlarmConfig struct {
+	Zone             string   `yaml:"zone"`
+	Escalation       []string `yaml:"escalation"`
+	EscalateAfterMin int      `yaml:"escalate_after_min,omitempty"`
+}
+
+func (c *AlarmsConfig) normalize() error {
+	if c.EscalateAfterMin <= 0 {
+		c.EscalateAfterMin = 15
+	}
+	if c.CheckIntervalSec <= 0 {
+		c.CheckIntervalSec = 30
+	}
+	if c.LeakSeverity == "" {
+		c.LeakSeverity = "high"
+	}
+	if c.ContactSeverity == "" {
+		c.ContactSeverity = "low"
+	}
+	for _, severity := range []string{c.LeakSeverity, c.ContactSeverity} {
+		if severityRank(severity) < 0 {
+			return fmt.Errorf("alarms: unknown severity %q (want %s)", severity, strings.Join(alarmSeverities, ", "))
+		}
+	}
+
+	groups := make(map[string]bool)
+	for _, g := range c.ContactGroups {
+		if g.Name == "" {
+			return fmt.Errorf("alarms: contact group without a name")
+		}
+		if groups[g.Name] {
+			return fmt.Errorf("alarms: duplicate contact group %q", g.Name)
+		}
+		groups[g.Name] = true
+	}
+	checkChain := func(chain []string) error {
+		for _, name := range chain {
+			if !groups[name] {
+				return fmt.Errorf("alarms: unknown contact group %q in escalation", name)
+			}
+		}
+		return nil
+	}
+	if err := checkChain(c.Escalation); err != nil {
+		return err
+	}
+	for i := range c.Zones {
+		zone := &c.Zones[i]
+		if err := checkChain(zone.Escalation); err != nil {
+			return err
+		}
+		if zone.EscalateAfterMin <= 0 {
+			zone.EscalateAfterMin = c.EscalateAfterMin
+		}
+	}
+	return nil
+}
+
+// policy returns the escalation chain and delay for a zone
+func (c *AlarmsConfig) policy(zone string) ([]string, time.Duration) {
+	for _, z := range c.Zones {
+		if z.Zone == zone {
+			return z.Escalation, time.Duration(z.EscalateAfterMin) * time.Minute
+		}
+	}
+	return c.Escalation, time.Duration(c.EscalateAfterMin) * time.Minute
+}
+
+func (c *AlarmsConfig) contacts(group string) []string {
+	for _, g := range c.ContactGroups {
+		if g.Name == group {
+			return g.Contacts
+		}
+	}
+	return nil
+}
+
+func severityRank(severity string) int {
+	for i, s := range alarmSeverities {
+		if s == severity {
+			return i
+		}
+	}
+	return -1
+}
+
+// Alarm is published on alarms/<room_id>/<source> on every state change
+type Alarm struct {
+	ID             string `json:"id"`
+	RoomID         string `json:"room_id"`
+	Zone           string `json:"zone,omitempty"`
+	Source         string `json:"source"`
+	Type           string `json:"type"`
+	Severity       string `json:"severity"`
+	Message        string `json:"message,omitempty"`
+	State          string `json:"state"`
+	Level          int    `json:"escalation_level"`
+	NotifiedGroup  string `json:"notified_group,omitempty"`
+	RaisedAt       string `json:"raised_at"`
+	AcknowledgedAt string `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+	ClearedAt      string `json:"cleared_at,omitempty"`
+
+	escalatedAt time.Time
+	// latching alarms have no clear condition and end when acknowledged
+	latching bool
+}
+
+// AlarmNotification is published on alarms/notify/<group>
+type AlarmNotification struct {
+	Group     string   `json:"group"`
+	Contacts  []string `json:"contacts"`
+	Escalated bool     `json:"escalated"`
+	Alarm     Alarm    `json:"alarm"`
+}
+
+type alarmEngine struct {
+	mu     sync.Mutex
+	config *AlarmsConfig
+	alarms map[string]*Alarm
+}
+
+func newAlarmEngine(config *AlarmsConfig) *alarmEngine {
+	return &alarmEngine{config: config, alarms: make(map[string]*Alarm)}
+}
+
+// raiseAlarm creates an alarm, or updates the message of one already
+// active for the same source
+func (gw *Gateway) raiseAlarm(roomID, source, alarmType, severity, message string, latching bool) {
+	e := gw.alarms
+	now := time.Now()
+	id := roomID + "." + source
+
+	e.mu.Lock()
+	alarm, exists := e.alarms[id]
+	if exists {
+		alarm.Message = message
+		e.mu.Unlock()
+		return
+	}
+	zone := ""
+	if room := gw.rooms[roomID]; room != nil {
+		zone = room.Zone
+	}
+	alarm = &Alarm{
+		ID:          id,
+		RoomID:      roomID,
+		Zone:        zone,
+		Source:      source,
+		Type:        alarmType,
+		Severity:    severity,
+		Message:     message,
+		State:       alarmActive,
+		RaisedAt:    now.Format(time.RFC3339),
+		escalatedAt: now,
+		latching:    latching,
+	}
+	chain, _ := e.config.policy(zone)
+	if len(chain) > 0 {
+		alarm.NotifiedGroup = chain[0]
+	}
+	e.alarms[id] = alarm
+	copied := *alarm
+	e.mu.Unlock()
+
+	log.Printf("[ALARM] %s raised (%s): %s", id, severity, message)
+	gw.events.alarm(eventAlarmRaised, &copied)
+	gw.publishAlarm(&copied)
+	if copied.NotifiedGroup != "" {
+		gw.notifyAlarm(&copied, false)
+	}
+}
+
+// clearAlarm ends a non-latching alarm whose condition returned to normal,
+// acknowledged or not
+func (gw *Gateway) clearAlarm(roomID, source string) {
+	e := gw.alarms
+	id := roomID + "." + source
+
+	e.mu.Lock()
+	alarm, exists := e.alarms[id]
+	if !exists || alarm.latching {
+		e.mu.Unlock()
+		return
+	}
+	delete(e.alarms, id)
+	alarm.State = alarmCleared
+	alarm.ClearedAt = time.Now().Format(time.RFC3339)
+	e.mu.Unlock()
+
+	log.Printf("[ALARM] %s cleared", id)
+	gw.events.alarm(eventAlarmCleared, alarm)
+	gw.publishAlarm(alarm)
+}
+
+// acknowledgeAlarm stops an alarm's escalation; latching alarms end here
+func (gw *Gateway) acknowledgeAlarm(id, by string) (*Alarm, error) {
+	e := gw.alarms
+	e.mu.Lock()
+	alarm, exists := e.alarms[id]
+	if !exists {
+		e.mu.Unlock()
+		return nil, fmt.Errorf("unknown alarm %s", id)
+	}
+	if alarm.State == alarmAcknowledged {
+		e.mu.Unlock()
+		return nil, fmt.Errorf("alarm %s is already acknowledged", id)
+	}
+	alarm.State = alarmAcknowledged
+	alarm.AcknowledgedAt = time.Now().Format(time.RFC3339)
+	alarm.AcknowledgedBy = by
+	ended := alarm.latching
+	if ended {
+		delete(e.alarms, id)
+	}
+	copied := *alarm
+	e.mu.Unlock()
+
+	log.Printf("[ALARM] %s acknowledged by %s", id, by)
+	if ended {
+		gw.events.alarm(eventAlarmCleared, &copied)
+	} else {
+		gw.events.alarm(eventAlarmAcknowledge, &copied)
+	}
+	gw.publishAlarm(&copied)
+	return &copied, nil
+}
+
+// escalateAlarms raises every unacknowledged alarm that has waited its
+// zone's delay to the next severity and contact group. An alarm at the
+// end of its chain and at critical severity is not escalated further.
+func (gw *Gateway) escalateAlarms(now time.Time) {
+	e := gw.alarms
+	var escalated []Alarm
+
+	e.mu.Lock()
+	for _, alarm := range e.alarms {
+		if alarm.State != alarmActive {
+			continue
+		}
+		chain, after := e.config.policy(alarm.Zone)
+		if now.Sub(alarm.escalatedAt) < after {
+			continue
+		}
+		rank := severityRank(alarm.Severity)
+		if alarm.Level+1 >= len(chain) && rank+1 >= len(alarmSeverities) {
+			continue
+		}
+		if rank >= 0 && rank+1 < len(alarmSeverities) {
+			alarm.Severity = alarmSeverities[rank+1]
+		}
+		if alarm.Level+1 < len(chain) {
+			alarm.Level++
+			alarm.NotifiedGroup = chain[alarm.Level]
+		}
+		alarm.escalatedAt = now
+		escalated = append(escalated, *alarm)
+	}
+	e.mu.Unlock()
+
+	for i := range escalated {
+		alarm := &escalated[i]
+		log.Printf("[ALARM] %s unacknowledged, escalated to %s (%s)", alarm.ID, alarm.Severity, alarm.NotifiedGroup)
+		gw.events.alarm(eventAlarmEscalated, alarm)
+		gw.publishAlarm(alarm)
+		if alarm.NotifiedGroup != "" {
+			gw.notifyAlarm(alarm, true)
+		}
+	}
+}
+
+func (e *alarmEngine) get(id string) (*Alarm, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alarm, ok := e.alarms[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *alarm
+	return &copied, true
+}
+
+// list returns the open alarms ordered by raise time
+func (e *alarmEngine) list() []Alarm {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alarms := make([]Alarm, 0, len(e.alarms))
+	for _, alarm := range e.alarms {
+		alarms = append(alarms, *alarm)
+	}
+	sort.Slice(alarms, func(i, j int) bool {
+		if alarms[i].RaisedAt != alarms[j].RaisedAt {
+			return alarms[i].RaisedAt < alarms[j].RaisedAt
+		}
+		return alarms[i].ID < alarms[j].ID
+	})
+	return alarms
+}
+
+func (gw *Gateway) publishAlarm(alarm *Alarm) {
+	payload, err := json.Marshal(alarm)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal alarm %s: %v", alarm.ID, err)
+		return
+	}
+	topic := fmt.Sprintf("alarms/%s/%s", alarm.RoomID, alarm.Source)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
+
+func (gw *Gateway) notifyAlarm(alarm *Alarm, escalated bool) {
+	payload, err := json.Marshal(AlarmNotification{
+		Group:     alarm.NotifiedGroup,
+		Contacts:  gw.settings.Alarms.contacts(alarm.NotifiedGroup),
+		Escalated: escalated,
+		Alarm:     *alarm,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal alarm notification for %s: %v", alarm.ID, err)
+		return
+	}
+	topic := fmt.Sprintf("alarms/notify/%s", alarm.NotifiedGroup)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
+
+// checkAlarmEscalation periodically escalates unacknowledged alarms
+func (gw *Gateway) checkAlarmEscalation() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(gw.settings.Alarms.CheckIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			gw.escalateAlarms(now)
+		}
+	}
+}
+
+// handleAlarms serves GET /alarms, the open alarms of the caller's rooms
+func (gw *Gateway) handleAlarms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if gw.alarms == nil {
+		writeJSONError(w, http.StatusNotFound, "alarms are disabled")
+		return
+	}
+	alarms := make([]Alarm, 0)
+	for _, alarm := range gw.alarms.list() {
+		if gw.roomAllowed(r, alarm.RoomID) {
+			alarms = append(alarms, alarm)
+		}
+	}
+	writeJSON(w, http.StatusOK, alarms)
+}
+
+// handleAlarmAck serves POST /alarms/{id}/ack
+func (gw *Gateway) handleAlarmAck(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/alarms/"), "/"), "/")
+	if len(parts) != 2 || parts[1] != "ack" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if gw.alarms == nil {
+		writeJSONError(w, http.StatusNotFound, "alarms are disabled")
+		return
+	}
+	id := parts[0]
+	alarm, ok := gw.alarms.get(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown alarm "+id)
+		return
+	}
+	if !gw.roomAllowed(r, alarm.RoomID) {
+		writeJSONError(w, http.StatusForbidden, "alarm "+id+" belongs to another tenant")
+		return
+	}
+	alarm, err := gw.acknowledgeAlarm(id, apiClient(r))
+	if err != nil {
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, alarm)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIConfig configures the gateway's HTTP API
+type APIConfig struct {
+	ListenAddr string `yaml:"listen_addr,omitempty"`
+}
+
+func (c *APIConfig) normalize() {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":8080"
+	}
+}
+
+// startAPI starts the HTTP API server in the background
+func (gw *Gateway) startAPI() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sensors/", gw.requireRole(roleOperator, gw.rateLimited(gw.handleSensors)))
+	mux.HandleFunc("/debug/capture", gw.requireRole(roleAdmin, gw.rateLimited(gw.handleCapture)))
+	mux.HandleFunc("/metrics", gw.requireRole(roleViewer, gw.rateLimited(gw.handleMetrics)))
+	mux.HandleFunc("/export", gw.requireRole(roleViewer, gw.rateLimited(gw.handleExport)))
+	mux.HandleFunc("/history", gw.requireRole(roleViewer, gw.rateLimited(gw.handleHistory)))
+	mux.HandleFunc("/api/v1/query", gw.requireRole(roleViewer, gw.rateLimited(gw.handlePromQuery)))
+	mux.HandleFunc("/api/v1/query_range", gw.requireRole(roleViewer, gw.rateLimited(gw.handlePromQueryRange)))
+	mux.HandleFunc("/stream", gw.requireRole(roleViewer, gw.rateLimited(gw.handleStream)))
+	mux.HandleFunc("/completeness", gw.requireRole(roleViewer, gw.rateLimited(gw.handleCompleteness)))
+	mux.HandleFunc("/commissioning/", gw.requireRole(roleOperator, gw.rateLimited(gw.handleCommissioning)))
+	mux.HandleFunc("/parameters/", gw.requireRole(roleAdmin, gw.rateLimited(gw.handleParameters)))
+	mux.HandleFunc("/ventilation", gw.requireRole(roleViewer, gw.rateLimited(gw.handleVentilation)))
+	mux.HandleFunc("/alarms", gw.requireRole(roleViewer, gw.rateLimited(gw.handleAlarms)))
+	mux.HandleFunc("/alarms/", gw.requireRole(roleOperator, gw.rateLimited(gw.handleAlarmAck)))
+	mux.HandleFunc("/bacnet/objects", gw.requireRole(roleOperator, gw.rateLimited(gw.handleBACnetObjects)))
+
+	gw.apiServer = &http.Server{
+		Addr:              gw.settings.API.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	// Long-lived event streams must end before Shutdown can complete
+	gw.apiServer.RegisterOnShutdown(gw.live.close)
+
+	go func() {
+		log.Printf("HTTP API listening on %s", gw.settings.API.ListenAddr)
+		if !gw.settings.Auth.Enabled {
+			log.Printf("[WARN] HTTP API authentication is disabled")
+		}
+		if err := gw.apiServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("[ERROR] HTTP API stopped: %v", err)
+		}
+	}()
+}
+
+// stopAPI gracefully shuts down the HTTP API server
+func (gw *Gateway) stopAPI() {
+	if gw.apiServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gw.apiServer.Shutdown(ctx); err != nil {
+		log.Printf("[ERROR] HTTP API shutdown: %v", err)
+	}
+}
+
+// handleSensors routes /sensors/{id}/... requests
+func (gw *Gateway) handleSensors(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sensors/"), "/"), "/")
+	if len(parts) == 2 && parts[1] == "read" {
+		gw.handleSensorRead(w, r, parts[0])
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "not found")
+}
+
+// handleSensorRead serves POST /sensors/{id}/read: it polls the sensor
+// immediately, bypassing its schedule, and returns the fresh reading so
+// commissioning technicians can verify wiring changes interactively; units
+// selects an output profile
+func (gw *Gateway) handleSensorRead(w http.ResponseWriter, r *http.Request, sensorID string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	config, ok := gw.sensors[sensorID]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown sensor "+sensorID)
+		return
+	}
+	if !gw.roomAllowed(r, gw.sensorToRoom[sensorID]) {
+		writeJSONError(w, http.StatusForbidden, "sensor "+sensorID+" belongs to another tenant")
+		return
+	}
+
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	reading, err := gw.readSensor(sensorID, config)
+	reading = profile.convertReading(reading)
+	if errors.Is(err, errUnknownProtocol) {
+		writeJSONError(w, http.StatusUnprocessableEntity, "unknown protocol "+config.Protocol)
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+			"error":   err.Error(),
+			"reading": reading,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, reading)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[ERROR] Failed to write API response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"gopkg.in/yaml.v3"
+)
+
+var configBucket = []byte("config")
+
+// AuditConfig configures the configuration audit trail. Every config load is
+// compared with the previously loaded configuration (kept in the state store)
+// and the differences are appended to File and published on
+// audit/gateway/<gateway_id>/config.
+type AuditConfig struct {
+	File string `yaml:"file,omitempty"`
+}
+
+func (c *AuditConfig) normalize() {
+	if c.File == "" {
+		c.File = "/app/data/config_audit.log"
+	}
+}
+
+// ConfigDiff lists the IDs added and removed, and the changed fields of each
+// modified entry
+type ConfigDiff struct {
+	Added    []string            `json:"added,omitempty"`
+	Removed  []string            `json:"removed,omitempty"`
+	Modified map[string][]string `json:"modified,omitempty"`
+}
+
+func (d ConfigDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// ConfigAuditEntry is one line of the audit log
+type ConfigAuditEntry struct {
+	Timestamp string `json:"timestamp"`
+	GatewayID string `json:"gateway_id"`
+	// Trigger is what caused the load (e.g. "startup"); Actor is who made
+	// the change, taken from CONFIG_CHANGED_BY when the deployment sets it
+	Trigger string `json:"trigger"`
+	Actor   string `json:"actor"`
+	// Initial is set when there was no previous configuration to compare to
+	Initial         bool              `json:"initial,omitempty"`
+	Files           map[string]string `json:"files"` // path → sha256
+	Sensors         ConfigDiff        `json:"sensors"`
+	Rooms           ConfigDiff        `json:"rooms"`
+	SettingsChanged []string          `json:"settings_changed,omitempty"`
+}
+
+// configAudit holds entries and tombstones not yet published over MQTT
+type configAudit struct {
+	mu       sync.Mutex
+	hashes   map[string]string
+	pending  []ConfigAuditEntry
+	retained []retainedMessage
+}
+
+func (a *configAudit) recordFile(path string, data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.hashes == nil {
+		a.hashes = make(map[string]string)
+	}
+	sum := sha256.Sum256(data)
+	a.hashes[path] = hex.EncodeToString(sum[:])
+}
+
+// auditConfig diffs the loaded configuration against the last audited one,
+// appends the entry to the audit log and queues it for publishing
+func (gw *Gateway) auditConfig(trigger string) error {
+	current := gw.configSnapshot()
+	previous := make(map[string]map[string]interface{})
+	err := gw.store.load(configBucket, func(key string, data []byte) error {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to decode %s: %w", key, err)
+		}
+		previous[key] = doc
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load previous config: %w", err)
+	}
+
+	gw.audit.mu.Lock()
+	files := gw.audit.hashes
+	gw.audit.mu.Unlock()
+	entry := ConfigAuditEntry{
+		Timestamp: time.Now().Format(time.RFC3339),
+		GatewayID: gw.settings.GatewayID,
+		Trigger:   trigger,
+		Actor:     getEnv("CONFIG_CHANGED_BY", "unknown"),
+		Initial:   len(previous) == 0,
+		Files:     files,
+		Sensors:   diffConfig(previous, current, "sensor/"),
+		Rooms:     diffConfig(previous, current, "room/"),
+	}
+	if prev, ok := previous["settings"]; ok {
+		entry.SettingsChanged = changedFields(prev, current["settings"])
+	}
+
+	if !entry.Initial && entry.Sensors.empty() && entry.Rooms.empty() && len(entry.SettingsChanged) == 0 {
+		log.Printf("Configuration unchanged since the last load")
+	} else {
+		log.Printf("[EVENT] Configuration changed (%s by %s): sensors +%d -%d ~%d, rooms +%d -%d ~%d, settings %v",
+			trigger, entry.Actor,
+			len(entry.Sensors.Added), len(entry.Sensors.Removed), len(entry.Sensors.Modified),
+			len(entry.Rooms.Added), len(entry.Rooms.Removed), len(entry.Rooms.Modified), entry.SettingsChanged)
+	}
+
+	gw.events.configLoaded(entry, current)
+
+	if err := appendAuditLog(gw.settings.Audit.File, entry); err != nil {
+		return err
+	}
+	docs := make(map[string]interface{}, len(current))
+	for key, doc := range current {
+		docs[key] = doc
+	}
+	if err := gw.store.save(configBucket, docs); err != nil {
+		return fmt.Errorf("failed to save config snapshot: %w", err)
+	}
+
+	gw.audit.mu.Lock()
+	gw.audit.pending = append(gw.audit.pending, entry)
+	gw.audit.mu.Unlock()
+	gw.queueTombstones(entry, previous)
+	return nil
+}
+
+// configSnapshot returns the loaded sensors, rooms and settings as generic
+// documents keyed sensor/<id>, room/<id> and settings, using YAML field names
+func (gw *Gateway) configSnapshot() map[string]map[string]interface{} {
+	snapshot := make(map[string]map[string]interface{})
+	for id, sensor := range gw.sensors {
+		snapshot["sensor/"+id] = yamlDocument(sensor)
+	}
+	for id, room := range gw.rooms {
+		snapshot["room/"+id] = yamlDocument(room)
+	}
+	snapshot["settings"] = yamlDocument(&gw.settings)
+	return snapshot
+}
+
+// yamlDocument converts a config struct to a map normalized through JSON so
+// it compares equal to a snapshot read back from the store
+func yamlDocument(v interface{}) map[string]interface{} {
+	data, _ := yaml.Marshal(v)
+	var doc map[string]interface{}
+	yaml.Unmarshal(data, &doc)
+	encoded, _ := json.Marshal(doc)
+	doc = nil
+	json.Unmarshal(encoded, &doc)
+	return doc
+}
+
+func diffConfig(previous, current map[string]map[string]interface{}, prefix string) ConfigDiff {
+	var diff ConfigDiff
+	for key, doc := range current {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		id := strings.TrimPrefix(key, prefix)
+		prev, ok := previous[key]
+		if !ok {
+			diff.Added = append(diff.Added, id)
+			continue
+		}
+		if fields := changedFields(prev, doc); len(fields) > 0 {
+			if diff.Modified == nil {
+				diff.Modified = make(map[string][]string)
+			}
+			diff.Modified[id] = fields
+		}
+	}
+	for key := range previous {
+		if _, ok := current[key]; !ok && strings.HasPrefix(key, prefix) {
+			diff.Removed = append(diff.Removed, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
+
+// changedFields returns the top-level keys whose values differ
+func changedFields(prev, cur map[string]interface{}) []string {
+	var fields []string
+	for k, v := range cur {
+		if !reflect.DeepEqual(prev[k], v) {
+			fields = append(fields, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func appendAuditLog(path string, entry ConfigAuditEntry) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer f.Close()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// publishConfigAudit publishes queued audit entries; entries that fail stay
+// queued for the next connect
+func (gw *Gateway) publishConfigAudit(client mqtt.Client) {
+	gw.audit.mu.Lock()
+	pending := gw.audit.pending
+	gw.audit.pending = nil
+	gw.audit.mu.Unlock()
+
+	topic := fmt.Sprintf("audit/gateway/%s/config", gw.settings.GatewayID)
+	for i, entry := range pending {
+		payload, _ := json.Marshal(entry)
+		token := client.Publish(topic, 1, false, payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("[ERROR] Failed to publish config audit: %v", token.Error())
+			gw.audit.mu.Lock()
+			gw.audit.pending = append(pending[i:], gw.audit.pending...)
+			gw.audit.mu.Unlock()
+			return
+		}
+		log.Printf("[MQTT] Published config audit to %s", topic)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// API roles, in increasing order of privilege
+const (
+	roleViewer   = "viewer"   // read-only: metrics, status and queries
+	roleOperator = "operator" // viewer plus commands and forced polls
+	roleAdmin    = "admin"    // operator plus configuration and debugging
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// AuthConfig enables API authentication. Callers authenticate with an API
+// key (X-API-Key header or "Authorization: ApiKey <key>") or an OIDC bearer
+// token, and each endpoint requires a minimum role.
+type AuthConfig struct {
+	Enabled bool           `yaml:"enabled"`
+	APIKeys []APIKeyConfig `yaml:"api_keys,omitempty"`
+	OIDC    OIDCConfig     `yaml:"oidc,omitempty"`
+}
+
+// APIKeyConfig is one API key; Key may reference an environment variable as
+// ${VAR} so secrets stay out of the config file
+type APIKeyConfig struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
+	Role string `yaml:"role"`
+	// Tenant limits the key to the rooms of one tenant
+	Tenant string `yaml:"tenant,omitempty"`
+	// secret is Key with environment references expanded; it is kept out of
+	// the YAML form so config audits never record it
+	secret string
+}
+
+func (c *AuthConfig) normalize() error {
+	for i := range c.APIKeys {
+		k := &c.APIKeys[i]
+		k.secret = os.ExpandEnv(k.Key)
+		if _, ok := roleRank[k.Role]; !ok {
+			return fmt.Errorf("api key %s has unknown role %q", k.Name, k.Role)
+		}
+		if c.Enabled && k.secret == "" {
+			return fmt.Errorf("api key %s is empty", k.Name)
+		}
+	}
+	return c.OIDC.normalize()
+}
+
+// principal is an authenticated API caller
+type principal struct {
+	name string
+	role string
+	// tenant scopes the caller to one tenant's rooms; empty means all rooms
+	tenant string
+}
+
+// authenticate identifies the caller of a request
+func (gw *Gateway) authenticate(r *http.Request) (*principal, error) {
+	key := r.Header.Get("X-API-Key")
+	authz := r.Header.Get("Authorization")
+	if strings.HasPrefix(authz, "ApiKey ") {
+		key = strings.TrimPrefix(authz, "ApiKey ")
+	}
+	if key != "" {
+		for _, k := range gw.settings.Auth.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(k.secret), []byte(key)) == 1 {
+				return &principal{name: "key:" + k.Name, role: k.Role, tenant: k.Tenant}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if strings.HasPrefix(authz, "Bearer ") {
+		if gw.oidc == nil {
+			return nil, fmt.Errorf("bearer tokens are not accepted")
+		}
+		return gw.oidc.verify(strings.TrimPrefix(authz, "Bearer "))
+	}
+	return nil, fmt.Errorf("missing credentials")
+}
+
+// requireRole wraps a handler so only callers with at least role may use it
+func (gw *Gateway) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !gw.settings.Auth.Enabled {
+			next(w, r)
+			return
+		}
+		p, err := gw.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		// Building-wide administration is not available to tenant-scoped callers
+		if roleRank[p.role] < roleRank[role] || (role == roleAdmin && p.tenant != "") {
+			log.Printf("[WARN] API: %s (%s) denied %s %s, requires %s", p.name, p.role, r.Method, r.URL.Path, role)
+			writeJSONError(w, http.StatusForbidden, fmt.Sprintf("role %s required", role))
+			return
+		}
+		next(w, withPrincipal(r, p))
+	}
+}
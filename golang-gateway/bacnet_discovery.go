@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexbeltran/gobacnet"
+	"github.com/alexbeltran/gobacnet/types"
+)
+
+// bacnetMaxInstance is the largest valid device instance (4194303 is the
+// wildcard)
+const bacnetMaxInstance = 4194302
+
+// BACnetDiscoveryConfig controls the Who-Is broadcasts that map device
+// instances to addresses. Discovery runs on startup and every IntervalSec
+// when a sensor references a device_instance; I-Am announcements from
+// restarted controllers update the map in between.
+type BACnetDiscoveryConfig struct {
+	IntervalSec int `yaml:"interval_sec"`
+	// TimeoutSec is how long each Who-Is collects I-Am replies
+	TimeoutSec int `yaml:"timeout_sec"`
+}
+
+func (c *BACnetDiscoveryConfig) normalize() {
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = 300
+	}
+	if c.TimeoutSec <= 0 {
+		c.TimeoutSec = 3
+	}
+}
+
+// bacnetDirectory caches discovered devices by instance number
+type bacnetDirectory struct {
+	mu      sync.RWMutex
+	devices map[uint32]discoveredDevice
+}
+
+func newBACnetDirectory() *bacnetDirectory {
+	return &bacnetDirectory{devices: make(map[uint32]discoveredDevice)}
+}
+
+// update stores a device, logging new devices and address changes
+func (d *bacnetDirectory) update(device discoveredDevice) {
+	d.mu.Lock()
+	old, known := d.devices[device.Instance]
+	d.devices[device.Instance] = device
+	d.mu.Unlock()
+	switch {
+	case !known:
+		log.Printf("BACnet device %d discovered at %s", device.Instance, device.Address)
+	case old.Address != device.Address:
+		log.Printf("[WARN] BACnet device %d moved from %s to %s", device.Instance, old.Address, device.Address)
+	}
+}
+
+func (d *bacnetDirectory) lookup(instance uint32) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	device, ok := d.devices[instance]
+	return device.Address, ok
+}
+
+// validateBACnetSensors checks device_instance references and object types
+func (gw *Gateway) validateBACnetSensors() error {
+	for id, sensor := range gw.sensors {
+		if err := validateBACnetObject(id, sensor); err != nil {
+			return err
+		}
+		if sensor.DeviceInstance == nil {
+			continue
+		}
+		if sensor.Protocol != "bacnet" {
+			return fmt.Errorf("sensor %s: device_instance is only valid for protocol bacnet", id)
+		}
+		if *sensor.DeviceInstance < 0 || *sensor.DeviceInstance > bacnetMaxInstance {
+			return fmt.Errorf("sensor %s: device_instance %d out of range 0-%d", id, *sensor.DeviceInstance, bacnetMaxInstance)
+		}
+	}
+	return nil
+}
+
+// usesBACnetDiscovery reports whether any sensor is addressed by device
+// instance
+func (gw *Gateway) usesBACnetDiscovery() bool {
+	for _, sensor := range gw.sensors {
+		if sensor.DeviceInstance != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// bacnetAddress resolves a sensor's device address: the discovered address
+// of its device_instance, falling back to address until the device has
+// answered
+func (gw *Gateway) bacnetAddress(sensor *SensorConfig) (string, error) {
+	if sensor.DeviceInstance == nil {
+		return sensor.Address, nil
+	}
+	if address, ok := gw.bacnetDevices.lookup(uint32(*sensor.DeviceInstance)); ok {
+		return address, nil
+	}
+	if sensor.Address != "" {
+		return sensor.Address, nil
+	}
+	return "", fmt.Errorf("BACnet device %d not discovered yet", *sensor.DeviceInstance)
+}
+
+// discoverBACnet broadcasts one Who-Is and caches the replies
+func (gw *Gateway) discoverBACnet(timeout time.Duration) ([]discoveredDevice, error) {
+	devices, err := gw.bacnet.whoIs(timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		gw.bacnetDevices.update(device)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Instance < devices[j].Instance })
+	return devices, nil
+}
+
+// runBACnetDiscovery repeats discovery every interval and reports device
+// instances referenced by sensors that have not answered
+func (gw *Gateway) runBACnetDiscovery() {
+	defer gw.wg.Done()
+
+	cfg := &gw.settings.BACnetDiscovery
+	ticker := time.NewTicker(time.Duration(cfg.IntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			if _, err := gw.discoverBACnet(time.Duration(cfg.TimeoutSec) * time.Second); err != nil {
+				log.Printf("[WARN] BACnet discovery failed: %v", err)
+				continue
+			}
+			gw.logMissingBACnetDevices()
+		}
+	}
+}
+
+func (gw *Gateway) logMissingBACnetDevices() {
+	missing := make(map[int]bool)
+	for _, sensor := range gw.sensors {
+		if sensor.DeviceInstance == nil {
+			continue
+		}
+		if _, ok := gw.bacnetDevices.lookup(uint32(*sensor.DeviceInstance)); !ok {
+			missing[*sensor.DeviceInstance] = true
+		}
+	}
+	for instance := range missing {
+		log.Printf("[WARN] BACnet device %d has not answered Who-Is", instance)
+	}
+}
+
+// bacnetPropertyObjectList is the object-list property of the device object
+const bacnetPropertyObjectList = 76
+
+// bacnetObjectRef is an entry of a device's object list
+type bacnetObjectRef struct {
+	Type     string `json:"type"`
+	Instance uint32 `json:"instance"`
+}
+
+// readObjectList reads the object list of a device. Large controllers return
+// it segmented, or element by element when they cannot segment.
+func (gw *Gateway) readObjectList(instance uint32, address string) ([]bacnetObjectRef, error) {
+	resp, err := gw.bacnet.readProperty(context.Background(), address, types.ReadPropertyData{
+		Object: types.Object{
+			ID: types.ObjectID{Type: types.DeviceType, Instance: types.ObjectInstance(instance)},
+			Properties: []types.Property{{
+				Type:       bacnetPropertyObjectList,
+				ArrayIndex: gobacnet.ArrayAll,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Object.Properties) == 0 {
+		return nil, fmt.Errorf("BACnet response contained no properties")
+	}
+	names := make(map[types.ObjectType]string, len(bacnetObjectTypes))
+	for name, t := range bacnetObjectTypes {
+		names[t] = name
+	}
+	values, ok := resp.Object.Properties[0].Data.([]interface{})
+	if !ok {
+		values = []interface{}{resp.Object.Properties[0].Data}
+	}
+	objects := make([]bacnetObjectRef, 0, len(values))
+	for _, v := range values {
+		id, ok := v.(types.ObjectID)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object-list entry %T", v)
+		}
+		name, ok := names[id.Type]
+		if !ok {
+			name = strconv.Itoa(int(id.Type))
+		}
+		objects = append(objects, bacnetObjectRef{Type: name, Instance: uint32(id.Instance)})
+	}
+	return objects, nil
+}
+
+// handleBACnetObjects serves GET /bacnet/objects?device=<instance>, the
+// object list of a discovered device, for commissioning sensors
+func (gw *Gateway) handleBACnetObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if gw.bacnet == nil {
+		writeJSONError(w, http.StatusServiceUnavailable, "BACnet client not initialized")
+		return
+	}
+	instance, err := strconv.ParseUint(r.URL.Query().Get("device"), 10, 32)
+	if err != nil || instance > bacnetMaxInstance {
+		writeJSONError(w, http.StatusBadRequest, "device must be a BACnet device instance")
+		return
+	}
+	address, ok := gw.bacnetDevices.lookup(uint32(instance))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, fmt.Sprintf("BACnet device %d not discovered", instance))
+		return
+	}
+	objects, err := gw.readObjectList(uint32(instance), address)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, fmt.Sprintf("BACnet read error: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"device": instance, "address": address, "objects": objects})
+}
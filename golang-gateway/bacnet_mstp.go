@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// BACnetMSTPConfig runs the gateway as a master node on an MS/TP (RS-485)
+// trunk, so its stations can be addressed as mstp:<mac> without a router.
+// The gateway takes part in token passing; a request waits for the token,
+// which on a busy trunk can take a few hundred milliseconds.
+type BACnetMSTPConfig struct {
+	Port     string `yaml:"port,omitempty"`      // e.g. /dev/ttyUSB0; empty disables MS/TP
+	BaudRate int    `yaml:"baud_rate,omitempty"` // default 38400
+	// MAC is the gateway's station address (0-127), unique on the trunk
+	MAC           *int `yaml:"mac,omitempty"`
+	MaxMaster     int  `yaml:"max_master,omitempty"`      // highest master address polled, default 127
+	MaxInfoFrames int  `yaml:"max_info_frames,omitempty"` // frames sent per token, default 1
+}
+
+func (c *BACnetMSTPConfig) normalize() error {
+	if c.Port == "" {
+		return nil
+	}
+	if c.BaudRate == 0 {
+		c.BaudRate = 38400
+	}
+	switch c.BaudRate {
+	case 9600, 19200, 38400, 57600, 115200:
+	default:
+		return fmt.Errorf("bacnet_mstp: unsupported baud_rate %d (9600, 19200, 38400, 57600 or 115200)", c.BaudRate)
+	}
+	if c.MaxMaster == 0 {
+		c.MaxMaster = mstpMaxMaster
+	}
+	if c.MaxMaster < 0 || c.MaxMaster > mstpMaxMaster {
+		return fmt.Errorf("bacnet_mstp: max_master must be 0-%d", mstpMaxMaster)
+	}
+	if c.MAC == nil || *c.MAC < 0 || *c.MAC > c.MaxMaster {
+		return fmt.Errorf("bacnet_mstp: mac is required and must be 0-%d", c.MaxMaster)
+	}
+	if c.MaxInfoFrames <= 0 {
+		c.MaxInfoFrames = 1
+	}
+	return nil
+}
+
+// MS/TP frame types and timing (ANSI/ASHRAE 135 clause 9). The usage and
+// reply timeouts are at the upper end of the allowed range to tolerate USB
+// serial adapters.
+const (
+	mstpToken                 = 0
+	mstpPollForMaster         = 1
+	mstpReplyToPollForMaster  = 2
+	mstpTestRequest           = 3
+	mstpTestResponse          = 4
+	mstpDataExpectingReply    = 5
+	mstpDataNotExpectingReply = 6
+	mstpReplyPostponed        = 7
+
+	mstpBroadcast  = 255
+	mstpMaxMaster  = 127
+	mstpMaxData    = 501
+	mstpPollTokens = 50 // tokens passed between polls for new masters
+
+	mstpNoToken      = 500 * time.Millisecond
+	mstpSlot         = 10 * time.Millisecond
+	mstpUsageTimeout = 35 * time.Millisecond
+	mstpReplyTimeout = 300 * time.Millisecond
+	mstpSolePoll     = 100 * time.Millisecond
+)
+
+type mstpFrame struct {
+	typ, dst, src byte
+	data          []byte
+}
+
+type mstpOutgoing struct {
+	dst            byte
+	npdu           []byte
+	expectingReply bool
+}
+
+// mstpLink is a master node state machine. One goroutine reads frames from
+// the port; another owns the bus, answering polls, passing the token and
+// sending queued NPDUs while it holds the token.
+type mstpLink struct {
+	port    io.ReadWriteCloser
+	config  *BACnetMSTPConfig
+	station byte
+	deliver func(source string, npdu []byte)
+	capture *frameCapture
+	frames  chan mstpFrame
+	queue   chan mstpOutgoing
+	closed  chan struct{}
+	held    *mstpFrame // frame received while waiting, handled next
+	next    byte       // next station to pass the token to; station while unknown
+	poll    byte       // next address polled for a new master
+	tokens  int
+	sole    bool
+}
+
+// openMSTPLink opens the serial port and joins the trunk. Received NPDUs are
+// passed to deliver with their source as mstp:<mac>.
+func openMSTPLink(config *BACnetMSTPConfig, deliver func(string, []byte), capture *frameCapture) (*mstpLink, error) {
+	port, err := serial.Open(&serial.Config{
+		Address:  config.Port,
+		BaudRate: config.BaudRate,
+		DataBits: 8,
+		StopBits: 1,
+		Parity:   "N",
+		Timeout:  mstpNoToken,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open MS/TP port %s: %w", config.Port, err)
+	}
+	l := &mstpLink{
+		port:    port,
+		config:  config,
+		station: byte(*config.MAC),
+		deliver: deliver,
+		capture: capture,
+		frames:  make(chan mstpFrame, 16),
+		queue:   make(chan mstpOutgoing, 64),
+		closed:  make(chan struct{}),
+	}
+	l.next = l.station
+	l.poll = l.successor(l.station)
+	go l.read()
+	go l.run()
+	log.Printf("BACnet MS/TP master %d on %s at %d baud", l.station, config.Port, config.BaudRate)
+	return l, nil
+}
+
+func (l *mstpLink) Close() {
+	close(l.closed)
+	l.port.Close()
+}
+
+// send queues an NPDU for the next token
+func (l *mstpLink) send(dst byte, npdu []byte, expectingReply bool) error {
+	if len(npdu) > mstpMaxData {
+		return fmt.Errorf("MS/TP frame of %d bytes exceeds %d", len(npdu), mstpMaxData)
+	}
+	select {
+	case l.queue <- mstpOutgoing{dst: dst, npdu: npdu, expectingReply: expectingReply}:
+		return nil
+	default:
+		return errors.New("MS/TP send queue full")
+	}
+}
+
+// read parses frames from the port; frames with bad CRCs are dropped
+func (l *mstpLink) read() {
+	r := bufio.NewReader(l.port)
+	for {
+		frame, err := readMSTPFrame(r)
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+		if err != nil {
+			if !errors.Is(err, serial.ErrTimeout) && !errors.Is(err, errMSTPFrame) {
+				log.Printf("[ERROR] MS/TP receive error: %v", err)
+				time.Sleep(mstpNoToken)
+			}
+			continue
+		}
+		if frame.typ >= mstpDataExpectingReply && (frame.dst == l.station || frame.dst == mstpBroadcast) {
+			l.capture.record(fmt.Sprintf("mstp:%d", frame.src), "rx", encodeMSTPFrame(frame.typ, frame.dst, frame.src, frame.data))
+		}
+		select {
+		case l.frames <- frame:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+// receive returns the next frame, or false when none arrives in time
+func (l *mstpLink) receive(timeout time.Duration) (mstpFrame, bool) {
+	if l.held != nil {
+		frame := *l.held
+		l.held = nil
+		return frame, true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case frame := <-l.frames:
+		return frame, true
+	case <-timer.C:
+	case <-l.closed:
+	}
+	return mstpFrame{}, false
+}
+
+func (l *mstpLink) write(typ, dst byte, data []byte) {
+	frame := encodeMSTPFrame(typ, dst, l.station, data)
+	if typ >= mstpDataExpectingReply {
+		l.capture.record(fmt.Sprintf("mstp:%d", dst), "tx", frame)
+	}
+	if _, err := l.port.Write(frame); err != nil {
+		log.Printf("[ERROR] MS/TP send error: %v", err)
+	}
+}
+
+// run is the master node loop. Without traffic for the no-token time the
+// token is considered lost and the gateway polls for a successor; alone on
+// the trunk it keeps the token and polls one address at a time.
+func (l *mstpLink) run() {
+	noToken := mstpNoToken + time.Duration(l.station)*mstpSlot
+	for {
+		select {
+		case <-l.closed:
+			return
+		default:
+		}
+		if l.sole {
+			l.runSoleMaster()
+			continue
+		}
+		frame, ok := l.receive(noToken)
+		if !ok {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			log.Printf("[WARN] MS/TP token lost, polling for a successor")
+			l.findSuccessor(l.successor(l.station))
+			l.useToken()
+			continue
+		}
+		l.handle(frame)
+	}
+}
+
+// runSoleMaster sends queued frames directly and polls for other masters
+func (l *mstpLink) runSoleMaster() {
+	if l.held != nil {
+		frame, _ := l.receive(0)
+		l.handle(frame)
+		return
+	}
+	select {
+	case frame := <-l.frames:
+		l.handle(frame)
+	case out := <-l.queue:
+		l.transmit(out)
+	case <-time.After(mstpSolePoll):
+		if l.poll == l.station {
+			l.poll = l.successor(l.poll)
+		}
+		if l.pollForMaster(l.poll) {
+			l.next, l.sole = l.poll, false
+			log.Printf("MS/TP passing the token to master %d", l.next)
+			l.poll = l.successor(l.station)
+			l.passToken()
+			return
+		}
+		l.poll = l.successor(l.poll)
+	case <-l.closed:
+	}
+}
+
+// handle answers frames addressed to the gateway and delivers data
+func (l *mstpLink) handle(frame mstpFrame) {
+	if frame.dst != l.station && frame.dst != mstpBroadcast {
+		return
+	}
+	switch frame.typ {
+	case mstpToken:
+		l.useToken()
+	case mstpPollForMaster:
+		l.write(mstpReplyToPollForMaster, frame.src, nil)
+	case mstpTestRequest:
+		l.write(mstpTestResponse, frame.src, frame.data)
+	case mstpDataExpectingReply, mstpDataNotExpectingReply:
+		// Requests to the gateway are not served, so the sender times out
+		l.deliver(fmt.Sprintf("mstp:%d", frame.src), frame.data)
+	}
+}
+
+// useToken sends up to MaxInfoFrames queued NPDUs, then passes the token
+func (l *mstpLink) useToken() {
+send:
+	for i := 0; i < l.config.MaxInfoFrames; i++ {
+		select {
+		case out := <-l.queue:
+			l.transmit(out)
+		default:
+			break send
+		}
+	}
+	l.passToken()
+}
+
+// transmit sends one NPDU and, for a confirmed request, waits for the reply
+// or a Reply Postponed (the answer then follows when the device holds the
+// token)
+func (l *mstpLink) transmit(out mstpOutgoing) {
+	if !out.expectingReply || out.dst == mstpBroadcast {
+		l.write(mstpDataNotExpectingReply, out.dst, out.npdu)
+		return
+	}
+	l.write(mstpDataExpectingReply, out.dst, out.npdu)
+	deadline := time.Now().Add(mstpReplyTimeout)
+	for {
+		frame, ok := l.receive(time.Until(deadline))
+		if !ok {
+			return
+		}
+		if frame.src == out.dst && frame.dst == l.station {
+			if frame.typ == mstpDataNotExpectingReply {
+				l.deliver(fmt.Sprintf("mstp:%d", frame.src), frame.data)
+			}
+			return
+		}
+	}
+}
+
+// passToken hands the token to the next station. Every mstpPollTokens
+// tokens one address between the gateway and the next station is polled for
+// a new master. A successor that does not use the token is retried once,
+// then replaced by polling.
+func (l *mstpLink) passToken() {
+	if l.next == l.station && !l.sole {
+		l.findSuccessor(l.successor(l.station))
+	}
+	if l.sole {
+		return
+	}
+	l.tokens++
+	if l.tokens >= mstpPollTokens {
+		l.tokens = 0
+		if l.poll == l.next || l.poll == l.station {
+			l.poll = l.successor(l.station)
+		}
+		if l.poll != l.next {
+			if l.pollForMaster(l.poll) {
+				log.Printf("MS/TP passing the token to master %d", l.poll)
+				l.next = l.poll
+				l.poll = l.successor(l.station)
+			} else {
+				l.poll = l.successor(l.poll)
+			}
+		}
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		l.write(mstpToken, l.next, nil)
+		if frame, ok := l.receive(mstpUsageTimeout); ok {
+			l.held = &frame
+			return
+		}
+	}
+	log.Printf("[WARN] MS/TP station %d did not take the token", l.next)
+	if l.findSuccessor(l.successor(l.next)) {
+		l.write(mstpToken, l.next, nil)
+	}
+}
+
+// findSuccessor polls addresses from start up to the gateway's own for a
+// master and makes the first to answer the next station. Without an answer
+// the gateway becomes sole master.
+func (l *mstpLink) findSuccessor(start byte) bool {
+	for address := start; address != l.station; address = l.successor(address) {
+		if l.pollForMaster(address) {
+			if address != l.next {
+				log.Printf("MS/TP passing the token to master %d", address)
+			}
+			l.next, l.sole = address, false
+			return true
+		}
+	}
+	if !l.sole {
+		log.Printf("[WARN] MS/TP master %d found no other masters", l.station)
+	}
+	l.next, l.sole = l.station, true
+	return false
+}
+
+func (l *mstpLink) pollForMaster(address byte) bool {
+	l.write(mstpPollForMaster, address, nil)
+	deadline := time.Now().Add(mstpUsageTimeout)
+	for {
+		frame, ok := l.receive(time.Until(deadline))
+		if !ok {
+			return false
+		}
+		if frame.typ == mstpReplyToPollForMaster && frame.src == address && frame.dst == l.station {
+			return true
+		}
+	}
+}
+
+// successor is the next master address after address, wrapping at max_master
+func (l *mstpLink) successor(address byte) byte {
+	if int(address) >= l.config.MaxMaster {
+		return 0
+	}
+	return address + 1
+}
+
+var errMSTPFrame = errors.New("invalid MS/TP frame")
+
+// readMSTPFrame reads one frame: preamble 55 FF, frame type, destination,
+// source, length (big-endian), header CRC, then data and data CRC (low byte
+// first) when the length is not zero
+func readMSTPFrame(r *bufio.Reader) (mstpFrame, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return mstpFrame{}, err
+		}
+		if b != 0x55 {
+			continue
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return mstpFrame{}, err
+		}
+		if b == 0xFF {
+			break
+		}
+		r.UnreadByte()
+	}
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return mstpFrame{}, err
+	}
+	crc := byte(0xFF)
+	for _, b := range header {
+		crc = mstpHeaderCRC(b, crc)
+	}
+	if crc != 0x55 {
+		return mstpFrame{}, errMSTPFrame
+	}
+	frame := mstpFrame{typ: header[0], dst: header[1], src: header[2]}
+	length := int(header[3])<<8 | int(header[4])
+	if length == 0 {
+		return frame, nil
+	}
+	if length > mstpMaxData {
+		return mstpFrame{}, errMSTPFrame
+	}
+	data := make([]byte, length+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return mstpFrame{}, err
+	}
+	dataCRC := uint16(0xFFFF)
+	for _, b := range data {
+		dataCRC = mstpDataCRC(b, dataCRC)
+	}
+	if dataCRC != 0xF0B8 {
+		return mstpFrame{}, errMSTPFrame
+	}
+	frame.data = data[:length]
+	return frame, nil
+}
+
+func encodeMSTPFrame(typ, dst, src byte, data []byte) []byte {
+	frame := []byte{0x55, 0xFF, typ, dst, src, byte(len(data) >> 8), byte(len(data))}
+	crc := byte(0xFF)
+	for _, b := range frame[2:] {
+		crc = mstpHeaderCRC(b, crc)
+	}
+	frame = append(frame, ^crc)
+	if len(data) == 0 {
+		return frame
+	}
+	dataCRC := uint16(0xFFFF)
+	for _, b := range data {
+		dataCRC = mstpDataCRC(b, dataCRC)
+	}
+	dataCRC = ^dataCRC
+	frame = append(frame, data...)
+	return append(frame, byte(dataCRC), byte(dataCRC>>8))
+}
+
+// mstpHeaderCRC is the CRC-8 (x^8 + x^7 + 1) of clause G.1
+func mstpHeaderCRC(value, crc byte) byte {
+	c := uint16(crc ^ value)
+	c = c ^ c<<1 ^ c<<2 ^ c<<3 ^ c<<4 ^ c<<5 ^ c<<6 ^ c<<7
+	return byte(c&0xFE) ^ byte(c>>8&1)
+}
+
+// mstpDataCRC is the CRC-16 (x^16 + x^12 + x^5 + 1) of clause G.2
+func mstpDataCRC(value byte, crc uint16) uint16 {
+	low := crc&0xFF ^ uint16(value)
+	return crc>>8 ^ low<<8 ^ low<<3 ^ low<<12 ^ low>>4 ^ low&0x0F ^ (low&0x0F)<<7
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alexbeltran/gobacnet/property"
+	"github.com/alexbeltran/gobacnet/types"
+)
+
+// BACnet object types and properties by their configuration names, shared by
+// sensors and device parameters
+var bacnetObjectTypes = map[string]types.ObjectType{
+	"analog-input":       types.AnalogInput,
+	"analog-output":      types.AnalogOutput,
+	"analog-value":       types.AnalogValue,
+	"binary-input":       types.BinaryInput,
+	"binary-output":      types.BinaryOutput,
+	"binary-value":       types.BinaryValue,
+	"multi-state-input":  types.MultiStateInput,
+	"multi-state-output": 14,
+	"multi-state-value":  types.MultiStateValue,
+	"device":             types.DeviceType,
+}
+
+var bacnetProperties = map[string]uint32{
+	"present-value":      property.PresentValue,
+	"object-name":        property.ObjectName,
+	"description":        property.Description,
+	"units":              property.Units,
+	"cov-increment":      22,
+	"event-state":        36,
+	"high-limit":         45,
+	"low-limit":          59,
+	"out-of-service":     81,
+	"reliability":        103,
+	"relinquish-default": 104,
+	"status-flags":       111,
+}
+
+const (
+	bacnetPropertyOutOfService      = 81
+	bacnetPropertyRelinquishDefault = 104
+)
+
+// Default object type and property of BACnet sensors
+const (
+	defaultBACnetObjectType = "analog-value"
+	defaultBACnetProperty   = "present-value"
+)
+
+// bacnetObject returns the object type and property a sensor reads
+func bacnetObject(sensor *SensorConfig) (types.ObjectType, uint32) {
+	objectType, prop := sensor.ObjectType, sensor.Property
+	if objectType == "" {
+		objectType = defaultBACnetObjectType
+	}
+	if prop == "" {
+		prop = defaultBACnetProperty
+	}
+	return bacnetObjectTypes[objectType], bacnetProperties[prop]
+}
+
+// validateBACnetObject checks a sensor's object_type, property and
+// write_priority
+func validateBACnetObject(id string, sensor *SensorConfig) error {
+	if sensor.WritePriority != 0 {
+		if sensor.Protocol != "bacnet" {
+			return fmt.Errorf("sensor %s: write_priority is only valid for protocol bacnet", id)
+		}
+		if err := validateWritePriority(sensor.WritePriority); err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+	}
+	if sensor.ObjectType == "" && sensor.Property == "" {
+		return nil
+	}
+	if sensor.Protocol != "bacnet" {
+		return fmt.Errorf("sensor %s: object_type and property are only valid for protocol bacnet", id)
+	}
+	if _, ok := bacnetObjectTypes[sensor.ObjectType]; sensor.ObjectType != "" && !ok {
+		return fmt.Errorf("sensor %s: unsupported object_type %q", id, sensor.ObjectType)
+	}
+	if _, ok := bacnetProperties[sensor.Property]; sensor.Property != "" && !ok {
+		return fmt.Errorf("sensor %s: unsupported property %q", id, sensor.Property)
+	}
+	if sensor.Writable && sensor.Property != "" && sensor.Property != defaultBACnetProperty {
+		return fmt.Errorf("sensor %s: writable sensors must read present-value", id)
+	}
+	return nil
+}
+
+// bacnetBitString is a decoded BACnet BIT STRING, bit 0 first
+type bacnetBitString []bool
+
+// value packs the bits into a number, bit 0 as the least significant bit;
+// for status-flags in-alarm is 1, fault 2, overridden 4 and out-of-service 8
+func (b bacnetBitString) value() float64 {
+	var v uint64
+	for i, set := range b {
+		if set && i < 64 {
+			v |= 1 << uint(i)
+		}
+	}
+	return float64(v)
+}
+
+var statusFlagNames = []string{"in-alarm", "fault", "overridden", "out-of-service"}
+
+// text lists the set status flags, or the set bit numbers of other bit
+// strings
+func (b bacnetBitString) text() string {
+	var set []string
+	for i, bit := range b {
+		if !bit {
+			continue
+		}
+		if len(b) == len(statusFlagNames) {
+			set = append(set, statusFlagNames[i])
+		} else {
+			set = append(set, fmt.Sprint(i))
+		}
+	}
+	return strings.Join(set, ",")
+}
+
+// decodeBitStringAck extracts a BIT STRING property value from a
+// ReadProperty ComplexAck, which gobacnet cannot decode. It reports false
+// when the value is not a bit string.
+func decodeBitStringAck(apdu []byte) (bacnetBitString, bool) {
+	if len(apdu) < 3 || apdu[0]&0x08 != 0 {
+		return nil, false // segmented
+	}
+	i := 3
+	for i < len(apdu) {
+		tag := apdu[i]
+		i++
+		if tag == 0x3E { // opening tag [3], the property value
+			break
+		}
+		if tag&0x08 == 0 {
+			return nil, false
+		}
+		i += int(tag & 0x07)
+	}
+	if i >= len(apdu) || apdu[i]>>4 != 8 || apdu[i]&0x08 != 0 { // application tag 8, BIT STRING
+		return nil, false
+	}
+	length := int(apdu[i] & 0x07)
+	i++
+	if length == 5 {
+		if i >= len(apdu) {
+			return nil, false
+		}
+		length = int(apdu[i])
+		i++
+	}
+	if length < 1 || i+length > len(apdu) {
+		return nil, false
+	}
+	unused := int(apdu[i] & 0x07)
+	data := apdu[i+1 : i+length]
+	bits := make(bacnetBitString, 0, 8*len(data))
+	for _, octet := range data {
+		for bit := 7; bit >= 0; bit-- {
+			bits = append(bits, octet&(1<<uint(bit)) != 0)
+		}
+	}
+	if unused > len(bits) {
+		return nil, false
+	}
+	return bits[:len(bits)-unused], true
+}
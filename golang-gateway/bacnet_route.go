@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// bacnetRoute is a parsed BACnet device address:
+//
+//	host[:port]                B/IP device on the local network
+//	mstp:<mac>                 station on the gateway's MS/TP trunk
+//	<either>/<network>/<mac>   device on a remote network, reached through
+//	                           the BACnet router at the first address
+//
+// Remote MACs are decimal for one-byte MS/TP addresses, or hex with a 0x
+// prefix (e.g. 0xc0a80a14bac0 for a B/IP device).
+type bacnetRoute struct {
+	host    string // normalized B/IP address of the device or router
+	mstp    bool
+	station byte   // MS/TP MAC of the device or router
+	network uint16 // remote network number, 0 for a local device
+	mac     []byte // MAC address on the remote network
+}
+
+func parseBACnetRoute(address string) (bacnetRoute, error) {
+	var route bacnetRoute
+	parts := strings.Split(strings.TrimSpace(address), "/")
+	if len(parts) != 1 && len(parts) != 3 {
+		return route, fmt.Errorf("invalid BACnet address %q: expected host[:port] or mstp:<mac>, optionally followed by /<network>/<mac>", address)
+	}
+	if station, ok := strings.CutPrefix(parts[0], "mstp:"); ok {
+		mac, err := strconv.ParseUint(station, 10, 8)
+		if err != nil || mac >= mstpBroadcast {
+			return route, fmt.Errorf("invalid BACnet address %q: MS/TP MAC must be 0-254", address)
+		}
+		route.mstp, route.station = true, byte(mac)
+	} else {
+		route.host = normalizeBACnetAddress(parts[0])
+	}
+	if len(parts) == 1 {
+		return route, nil
+	}
+
+	network, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil || network == 0 || network == npduGlobalNetwork {
+		return route, fmt.Errorf("invalid BACnet address %q: network number must be 1-65534", address)
+	}
+	route.network = uint16(network)
+	if hexMAC, ok := strings.CutPrefix(parts[2], "0x"); ok {
+		route.mac, err = hex.DecodeString(hexMAC)
+	} else {
+		var mac uint64
+		mac, err = strconv.ParseUint(parts[2], 10, 8)
+		route.mac = []byte{byte(mac)}
+	}
+	if err != nil || len(route.mac) == 0 || len(route.mac) > 7 {
+		return route, fmt.Errorf("invalid BACnet address %q: MAC must be 0-255 or 0x followed by up to 7 hex bytes", address)
+	}
+	return route, nil
+}
+
+// npdu builds the network layer header of a message to the route
+func (r bacnetRoute) npdu(expectingReply bool) []byte {
+	var control byte
+	if expectingReply {
+		control |= npduExpectingReply
+	}
+	if r.network == 0 {
+		return []byte{npduVersion, control}
+	}
+	npdu := []byte{npduVersion, control | npduDestination, byte(r.network >> 8), byte(r.network), byte(len(r.mac))}
+	npdu = append(npdu, r.mac...)
+	return append(npdu, npduMaxHops)
+}
+
+func (r bacnetRoute) String() string {
+	address := r.host
+	if r.mstp {
+		address = fmt.Sprintf("mstp:%d", r.station)
+	}
+	if r.network != 0 {
+		address += fmt.Sprintf("/%d/%s", r.network, formatBACnetMAC(r.mac))
+	}
+	return address
+}
+
+// formatBACnetMAC formats a remote MAC as parseBACnetRoute accepts it
+func formatBACnetMAC(mac []byte) string {
+	if len(mac) == 1 {
+		return strconv.Itoa(int(mac[0]))
+	}
+	return "0x" + hex.EncodeToString(mac)
+}
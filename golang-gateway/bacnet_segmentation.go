@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexbeltran/gobacnet"
+	"github.com/alexbeltran/gobacnet/types"
+)
+
+// BACnetAPDUConfig sets the APDU size and segmentation the gateway accepts
+// in replies. Large replies (object lists, long priority arrays) arrive as
+// a segmented ComplexACK, which is reassembled before decoding; MaxSegments
+// 1 disables segmented replies. Devices that cannot segment an array reply
+// are read element by element instead.
+type BACnetAPDUConfig struct {
+	// MaxAPDU is the largest APDU accepted: 50, 128, 206, 480, 1024 or
+	// 1476 (default); MS/TP stations are limited to 480
+	MaxAPDU int `yaml:"max_apdu,omitempty"`
+	// MaxSegments is the number of segments accepted per reply: 1, 2, 4,
+	// 8, 16, 32 or 64 (default), or 0 for more than 64
+	MaxSegments *int `yaml:"max_segments,omitempty"`
+	// WindowSize is the number of segments acknowledged at once, 1-127,
+	// default 16; a device may propose fewer
+	WindowSize int `yaml:"window_size,omitempty"`
+	// SegmentTimeoutMs is how long to wait for the next segment, default
+	// 2000
+	SegmentTimeoutMs int `yaml:"segment_timeout_ms,omitempty"`
+	// TimeoutMs bounds a confirmed request including all its segments,
+	// default 3000; a sensor's timeout_ms overrides it for its reads
+	TimeoutMs int `yaml:"timeout_ms,omitempty"`
+}
+
+// Encodings of the max-APDU and max-segments fields of confirmed requests
+var (
+	bacnetMaxAPDUCodes     = map[int]byte{50: 0, 128: 1, 206: 2, 480: 3, 1024: 4, 1476: 5}
+	bacnetMaxSegmentsCodes = map[int]byte{0: 7, 1: 0, 2: 1, 4: 2, 8: 3, 16: 4, 32: 5, 64: 6}
+)
+
+const (
+	apduSegmentAck               = 0x40
+	apduFlagSegmented            = 0x08
+	apduFlagMoreFollows          = 0x04
+	apduFlagSegAccepted          = 0x02
+	segmentAckNegative           = 0x02
+	mstpMaxAPDU                  = 480
+	bacnetUnlimitedSegs          = 256
+	abortBufferOverflow          = 1
+	abortSegmentationUnsupported = 4
+	abortWindowSize              = 7
+	abortTSMTimeout              = 10
+	abortAPDUTooLong             = 11
+	bacnetMaxArrayElements       = 16384
+)
+
+func (c *BACnetAPDUConfig) normalize() error {
+	if c.MaxAPDU == 0 {
+		c.MaxAPDU = 1476
+	}
+	if _, ok := bacnetMaxAPDUCodes[c.MaxAPDU]; !ok {
+		return fmt.Errorf("bacnet_apdu: max_apdu %d must be 50, 128, 206, 480, 1024 or 1476", c.MaxAPDU)
+	}
+	if c.MaxSegments == nil {
+		c.MaxSegments = intPtr(64)
+	}
+	if _, ok := bacnetMaxSegmentsCodes[*c.MaxSegments]; !ok {
+		return fmt.Errorf("bacnet_apdu: max_segments %d must be 1, 2, 4, 8, 16, 32, 64 or 0 (unlimited)", *c.MaxSegments)
+	}
+	if c.WindowSize == 0 {
+		c.WindowSize = 16
+	}
+	if c.WindowSize < 1 || c.WindowSize > 127 {
+		return fmt.Errorf("bacnet_apdu: window_size %d out of range 1-127", c.WindowSize)
+	}
+	if c.SegmentTimeoutMs <= 0 {
+		c.SegmentTimeoutMs = 2000
+	}
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 3000
+	}
+	return nil
+}
+
+func intPtr(v int) *int { return &v }
+
+// segmented reports whether segmented replies are accepted
+func (c *BACnetAPDUConfig) segmented() bool {
+	return *c.MaxSegments != 1
+}
+
+// maxSegments is the segment limit of a reply
+func (c *BACnetAPDUConfig) maxSegments() int {
+	if *c.MaxSegments == 0 {
+		return bacnetUnlimitedSegs
+	}
+	return *c.MaxSegments
+}
+
+// maxAPDU is the largest APDU a route can carry
+func (c *BACnetAPDUConfig) maxAPDU(route bacnetRoute) int {
+	if route.mstp && c.MaxAPDU > mstpMaxAPDU {
+		return mstpMaxAPDU
+	}
+	return c.MaxAPDU
+}
+
+// setRequestLimits rewrites the segmentation flag and the max-segments and
+// max-APDU fields of an encoded confirmed request for route
+func (c *BACnetAPDUConfig) setRequestLimits(apdu []byte, route bacnetRoute) {
+	if len(apdu) < 2 || apdu[0]&0xF0 != apduConfirmedRequest {
+		return
+	}
+	apdu[0] &^= apduFlagSegAccepted
+	if c.segmented() {
+		apdu[0] |= apduFlagSegAccepted
+	}
+	apdu[1] = bacnetMaxSegmentsCodes[*c.MaxSegments]<<4 | bacnetMaxAPDUCodes[c.maxAPDU(route)]
+}
+
+// bacnetAbortError is an Abort PDU received from a device
+type bacnetAbortError struct {
+	reason byte
+}
+
+func (e *bacnetAbortError) Error() string {
+	switch e.reason {
+	case abortBufferOverflow:
+		return "BACnet device aborted the request: buffer overflow"
+	case abortSegmentationUnsupported:
+		return "BACnet device aborted the request: segmentation not supported"
+	case abortAPDUTooLong:
+		return "BACnet device aborted the request: reply too long"
+	}
+	return fmt.Sprintf("BACnet device aborted the request (reason %d)", e.reason)
+}
+
+// replyTooLarge reports whether a device aborted because its reply did not
+// fit the APDU size or segmentation accepted
+func replyTooLarge(err error) bool {
+	var abort *bacnetAbortError
+	if !errors.As(err, &abort) {
+		return false
+	}
+	switch abort.reason {
+	case abortBufferOverflow, abortSegmentationUnsupported, abortAPDUTooLong:
+		return true
+	}
+	return false
+}
+
+// reassemble collects the segments of a segmented ComplexACK whose first
+// segment is first and returns it as one unsegmented ComplexACK. Segments
+// are acknowledged per window; a gap is answered with a negative ack so the
+// device resends from the last segment received in order.
+func (t *bacnetTransport) reassemble(ctx context.Context, route bacnetRoute, invokeID uint8, first []byte, replies chan []byte) ([]byte, error) {
+	if len(first) < 5 || first[2] != 0 {
+		t.abort(route, invokeID, abortBufferOverflow)
+		return nil, errors.New("invalid first segment of BACnet reply")
+	}
+	window := int(first[3])
+	if window < 1 || window > 127 {
+		t.abort(route, invokeID, abortWindowSize)
+		return nil, fmt.Errorf("BACnet device proposed window size %d", window)
+	}
+	window = min(window, t.apdu.WindowSize)
+	service := first[4]
+	reply := append([]byte{apduComplexAck, invokeID, service}, first[5:]...)
+	limit := t.apdu.maxSegments() * t.apdu.maxAPDU(route)
+	segments := 1
+	last := uint8(0)
+	// The first segment is acknowledged at once, settling the window size
+	if err := t.segmentAck(route, invokeID, last, window, false); err != nil {
+		return nil, err
+	}
+	more := first[0]&apduFlagMoreFollows != 0
+	inWindow := 0
+	timeout := time.Duration(t.apdu.SegmentTimeoutMs) * time.Millisecond
+	for more {
+		var segment []byte
+		select {
+		case segment = <-replies:
+		case <-time.After(timeout):
+			t.abort(route, invokeID, abortTSMTimeout)
+			return nil, fmt.Errorf("BACnet reply from %s timed out after %d segments", route, segments)
+		case <-ctx.Done():
+			t.abort(route, invokeID, abortTSMTimeout)
+			return nil, fmt.Errorf("BACnet reply from %s timed out after %d segments: %w", route, segments, ctx.Err())
+		}
+		switch segment[0] & 0xF0 {
+		case apduComplexAck:
+		case apduAbort:
+			return nil, abortError(segment)
+		default:
+			return nil, fmt.Errorf("unexpected BACnet reply type 0x%02x during segmented reply", segment[0])
+		}
+		if segment[0]&apduFlagSegmented == 0 || len(segment) < 5 {
+			t.abort(route, invokeID, abortBufferOverflow)
+			return nil, errors.New("invalid segment of BACnet reply")
+		}
+		if segment[2] != last+1 {
+			// Duplicate or out of order: ask for the segments after last
+			inWindow = 0
+			if err := t.segmentAck(route, invokeID, last, window, true); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		last = segment[2]
+		segments++
+		reply = append(reply, segment[5:]...)
+		if segments > t.apdu.maxSegments() || len(reply) > limit {
+			t.abort(route, invokeID, abortBufferOverflow)
+			return nil, fmt.Errorf("BACnet reply from %s exceeds %d segments of %d bytes", route, t.apdu.maxSegments(), t.apdu.maxAPDU(route))
+		}
+		more = segment[0]&apduFlagMoreFollows != 0
+		inWindow++
+		if inWindow == window || !more {
+			inWindow = 0
+			if err := t.segmentAck(route, invokeID, last, window, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if segments > 1 {
+		log.Printf("[DEBUG] BACnet reply from %s reassembled from %d segments (%d bytes)", route, segments, len(reply))
+	}
+	return reply, nil
+}
+
+// segmentAck acknowledges the segments up to sequence
+func (t *bacnetTransport) segmentAck(route bacnetRoute, invokeID, sequence uint8, window int, negative bool) error {
+	pdu := byte(apduSegmentAck)
+	if negative {
+		pdu |= segmentAckNegative
+	}
+	return t.send(route, route.npdu(false), []byte{pdu, invokeID, sequence, byte(window)})
+}
+
+// abort ends a segmented reply the gateway will not complete
+func (t *bacnetTransport) abort(route bacnetRoute, invokeID, reason uint8) {
+	if err := t.send(route, route.npdu(false), []byte{apduAbort, invokeID, reason}); err != nil {
+		log.Printf("[DEBUG] BACnet abort to %s failed: %v", route, err)
+	}
+}
+
+func abortError(apdu []byte) error {
+	if len(apdu) < 3 {
+		return &bacnetAbortError{}
+	}
+	return &bacnetAbortError{reason: apdu[2]}
+}
+
+// readArrayElements reads an array property one element at a time, for
+// devices that cannot return the whole array in one (segmented) reply:
+// index 0 holds the array length
+func (t *bacnetTransport) readArrayElements(ctx context.Context, address string, rp types.ReadPropertyData) (types.ReadPropertyData, error) {
+	element := func(index uint32) (interface{}, error) {
+		req := rp
+		req.Object.Properties = []types.Property{{Type: rp.Object.Properties[0].Type, ArrayIndex: index}}
+		resp, err := t.readPropertyOnce(ctx, address, req)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Object.Properties) == 0 {
+			return nil, fmt.Errorf("BACnet response contained no properties")
+		}
+		return resp.Object.Properties[0].Data, nil
+	}
+	lengthData, err := element(0)
+	if err != nil {
+		return types.ReadPropertyData{}, fmt.Errorf("failed to read array length: %w", err)
+	}
+	length, err := parseBACnetNumeric(lengthData)
+	if err != nil || length < 0 || length > bacnetMaxArrayElements {
+		return types.ReadPropertyData{}, fmt.Errorf("invalid BACnet array length %v", lengthData)
+	}
+	values := make([]interface{}, 0, int(length))
+	for i := uint32(1); i <= uint32(length); i++ {
+		v, err := element(i)
+		if err != nil {
+			return types.ReadPropertyData{}, fmt.Errorf("failed to read array element %d: %w", i, err)
+		}
+		values = append(values, v)
+	}
+	out := rp
+	out.Object.Properties = []types.Property{{Type: rp.Object.Properties[0].Type, ArrayIndex: gobacnet.ArrayAll, Data: values}}
+	if len(values) == 1 {
+		out.Object.Properties[0].Data = values[0]
+	}
+	return out, nil
+}
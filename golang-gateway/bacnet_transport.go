@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/alexbeltran/gobacnet"
+	"github.com/alexbeltran/gobacnet/encoding"
+	"github.com/alexbeltran/gobacnet/types"
+)
+
+// bacnetTransport sends confirmed BACnet/IP requests from its own UDP socket
+// and matches replies by invoke ID. gobacnet's encoder and decoder are used
+// for the service payloads, but owning the socket lets the gateway see raw
+// frames (for capture) and receive SimpleACKs, which gobacnet drops. Devices
+// behind BACnet routers are reached through the router's address, and an
+// optional MS/TP link serves stations on the gateway's own RS-485 trunk.
+type bacnetTransport struct {
+	conn *net.UDPConn
+	// listener receives broadcasts to the BACnet/IP port, where devices
+	// send I-Am; nil when the port could not be bound
+	listener  *net.UDPConn
+	broadcast net.IP
+	mstp      *mstpLink
+	apdu      *BACnetAPDUConfig
+	mu        sync.Mutex
+	pending   map[uint8]*pendingRequest
+	nextID    uint8
+	capture   *frameCapture
+	closed    chan struct{}
+	// iAm receives I-Am replies while a Who-Is is in progress
+	iAm chan discoveredDevice
+	// announced, when set, is called with every I-Am received
+	announced func(discoveredDevice)
+}
+
+// pendingRequest is a confirmed request awaiting its reply; source is the
+// address replies must come from, as dispatch formats it
+type pendingRequest struct {
+	source  string
+	replies chan []byte
+}
+
+const (
+	bvlcTypeBIP          = 0x81
+	bvlcOriginalUnicast  = 0x0A
+	npduVersion          = 0x01
+	npduExpectingReply   = 0x04
+	npduDestination      = 0x20
+	npduSource           = 0x08
+	npduGlobalNetwork    = 0xFFFF
+	npduMaxHops          = 0xFF
+	apduConfirmedRequest = 0x00
+	apduUnconfirmed      = 0x10
+	apduSimpleAck        = 0x20
+	apduComplexAck       = 0x30
+	apduError            = 0x50
+	apduReject           = 0x60
+	apduAbort            = 0x70
+	// max segments 0 (unspecified), max APDU 1476 bytes; request rewrites
+	// both from bacnet_apdu
+	apduMaxSegsMaxAPDU     = 0x05
+	serviceWriteProperty   = 15
+	serviceIAm             = 0
+	serviceWhoIs           = 8
+	bvlcOriginalBroadcast  = 0x0B
+	bacnetMaxResponseBytes = 2048
+	bacnetPort             = 47808
+)
+
+// newBACnetTransport binds an ephemeral UDP port on the IPv4 address of the
+// named interface for requests, plus a shared listener on the BACnet/IP port
+// for broadcast I-Am announcements
+func newBACnetTransport(interfaceName string, apdu *BACnetAPDUConfig, capture *frameCapture) (*bacnetTransport, error) {
+	local, err := interfaceIPv4(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BACnet socket: %w", err)
+	}
+	t := &bacnetTransport{
+		conn:      conn,
+		broadcast: directedBroadcast(local),
+		apdu:      apdu,
+		pending:   make(map[uint8]*pendingRequest),
+		capture:   capture,
+		closed:    make(chan struct{}),
+	}
+	// Broadcasts only reach sockets bound to the wildcard address; other
+	// BACnet software on the host may share the port
+	listener, err := listenReusable(fmt.Sprintf(":%d", bacnetPort))
+	if err != nil {
+		log.Printf("[WARN] Failed to listen on BACnet port %d, broadcast I-Am announcements are not received: %v", bacnetPort, err)
+	} else {
+		t.listener = listener
+		go t.receive(listener)
+	}
+	go t.receive(conn)
+	return t, nil
+}
+
+// listenReusable binds a UDP socket with SO_REUSEADDR, so broadcasts are
+// delivered to every socket sharing the port
+func listenReusable(address string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// interfaceIPv4 returns the IPv4 address and netmask of the named interface
+func interfaceIPv4(name string) (*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s: %w", name, err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+			return &net.IPNet{IP: ipNet.IP.To4(), Mask: ipNet.Mask[len(ipNet.Mask)-net.IPv4len:]}, nil
+		}
+	}
+	return nil, fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
+// directedBroadcast returns the broadcast address of a subnet, which
+// reaches its devices through the interface regardless of the routing table
+// (unlike 255.255.255.255)
+func directedBroadcast(subnet *net.IPNet) net.IP {
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range broadcast {
+		broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+	return broadcast
+}
+
+func (t *bacnetTransport) Close() {
+	close(t.closed)
+	t.conn.Close()
+	if t.listener != nil {
+		t.listener.Close()
+	}
+	if t.mstp != nil {
+		t.mstp.Close()
+	}
+}
+
+// receive reads BACnet/IP frames from a socket
+func (t *bacnetTransport) receive(conn *net.UDPConn) {
+	buf := make([]byte, bacnetMaxResponseBytes)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-t.closed:
+				return
+			default:
+			}
+			log.Printf("[ERROR] BACnet receive error: %v", err)
+			continue
+		}
+		frame := append([]byte(nil), buf[:n]...)
+		t.capture.record(src.String(), "rx", frame)
+
+		if npdu, origin, ok := extractNPDU(frame); ok {
+			if origin == nil {
+				origin = src
+			}
+			t.dispatch(origin.String(), npdu)
+		}
+	}
+}
+
+// dispatch hands an NPDU received from source (a B/IP address or MS/TP
+// station) to the waiting request or, for I-Am, to discovery
+func (t *bacnetTransport) dispatch(source string, npdu []byte) {
+	apdu, network, mac, ok := parseNPDU(npdu)
+	if !ok || len(apdu) < 2 {
+		return
+	}
+	if network != 0 {
+		source = fmt.Sprintf("%s/%d/%s", source, network, formatBACnetMAC(mac))
+	}
+	if apdu[0] == apduUnconfirmed && apdu[1] == serviceIAm {
+		t.handleIAm(apdu, source)
+		return
+	}
+	if apdu[0]&0xF0 == apduUnconfirmed {
+		// Other unconfirmed services, including our own Who-Is broadcast
+		return
+	}
+	invokeID := apdu[1]
+
+	t.mu.Lock()
+	req, ok := t.pending[invokeID]
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+	// Invoke IDs are only unique per peer, so a reply from another device
+	// must not complete the request
+	if req.source != source {
+		log.Printf("[DEBUG] BACnet reply with invoke ID %d from %s, expected from %s, ignored", invokeID, source, req.source)
+		return
+	}
+	select {
+	case req.replies <- apdu:
+	default:
+	}
+}
+
+// allocateID reserves a free invoke ID for a request to source
+func (t *bacnetTransport) allocateID(source string) (uint8, chan []byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < 256; i++ {
+		id := t.nextID
+		t.nextID++
+		if _, busy := t.pending[id]; !busy {
+			// Room for a window of segments of a segmented reply
+			ch := make(chan []byte, t.apdu.WindowSize+1)
+			t.pending[id] = &pendingRequest{source: source, replies: ch}
+			return id, ch, nil
+		}
+	}
+	return 0, nil, errors.New("no free BACnet invoke IDs")
+}
+
+func (t *bacnetTransport) releaseID(id uint8) {
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+}
+
+// request sends a confirmed request whose APDU is built by encode and returns
+// the reply APDU, reassembled when the device segments it. Error, Reject and
+// Abort replies are returned as errors.
+func (t *bacnetTransport) request(ctx context.Context, address string, encode func(invokeID uint8) ([]byte, error)) ([]byte, error) {
+	route, err := parseBACnetRoute(address)
+	if err != nil {
+		return nil, err
+	}
+
+	source, err := t.replySource(route)
+	if err != nil {
+		return nil, err
+	}
+	invokeID, replies, err := t.allocateID(source)
+	if err != nil {
+		return nil, err
+	}
+	defer t.releaseID(invokeID)
+	// Without a deadline of its own a request gets the APDU timeout
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(t.apdu.TimeoutMs)*time.Millisecond)
+		defer cancel()
+	}
+
+	apdu, err := encode(invokeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode BACnet request: %w", err)
+	}
+	t.apdu.setRequestLimits(apdu, route)
+	if err := t.send(route, route.npdu(true), apdu); err != nil {
+		return nil, err
+	}
+
+	select {
+	case reply := <-replies:
+		switch reply[0] & 0xF0 {
+		case apduError:
+			return nil, fmt.Errorf("BACnet device returned an error")
+		case apduReject:
+			return nil, fmt.Errorf("BACnet device rejected the request")
+		case apduAbort:
+			return nil, abortError(reply)
+		}
+		if reply[0]&0xF0 == apduComplexAck && reply[0]&apduFlagSegmented != 0 {
+			return t.reassemble(ctx, route, invokeID, reply, replies)
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("BACnet request to %s timed out: %w", route, ctx.Err())
+	}
+}
+
+// readProperty performs a ReadProperty request. A whole array the device
+// cannot fit in its reply is read element by element.
+func (t *bacnetTransport) readProperty(ctx context.Context, address string, rp types.ReadPropertyData) (types.ReadPropertyData, error) {
+	out, err := t.readPropertyOnce(ctx, address, rp)
+	if err != nil && replyTooLarge(err) && rp.Object.Properties[0].ArrayIndex == gobacnet.ArrayAll {
+		log.Printf("[DEBUG] BACnet reply from %s too large (%v), reading array elements", address, err)
+		return t.readArrayElements(ctx, address, rp)
+	}
+	return out, err
+}
+
+// readPropertyOnce performs a single ReadProperty request
+func (t *bacnetTransport) readPropertyOnce(ctx context.Context, address string, rp types.ReadPropertyData) (types.ReadPropertyData, error) {
+	reply, err := t.request(ctx, address, func(invokeID uint8) ([]byte, error) {
+		enc := encoding.NewEncoder()
+		err := enc.ReadProperty(invokeID, rp)
+		return enc.Bytes(), err
+	})
+	if err != nil {
+		return types.ReadPropertyData{}, err
+	}
+	if reply[0]&0xF0 != apduComplexAck {
+		return types.ReadPropertyData{}, fmt.Errorf("unexpected BACnet reply type 0x%02x", reply[0])
+	}
+
+	if bits, ok := decodeBitStringAck(reply); ok {
+		out := rp
+		out.Object.Properties = []types.Property{{Type: rp.Object.Properties[0].Type, Data: bits}}
+		return out, nil
+	}
+
+	var out types.ReadPropertyData
+	var apdu types.APDU
+	dec := encoding.NewDecoder(reply)
+	if err := dec.APDU(&apdu); err != nil {
+		return types.ReadPropertyData{}, fmt.Errorf("failed to decode BACnet reply: %w", err)
+	}
+	if err := dec.ReadProperty(&out); err != nil {
+		return types.ReadPropertyData{}, fmt.Errorf("failed to decode BACnet reply: %w", err)
+	}
+	return out, nil
+}
+
+// replySource returns the source dispatch reports for replies from route:
+// the resolved B/IP address or the MS/TP station, followed by the remote
+// network and MAC for routed devices
+func (t *bacnetTransport) replySource(route bacnetRoute) (string, error) {
+	if route.mstp {
+		return route.String(), nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", route.host)
+	if err != nil {
+		return "", fmt.Errorf("invalid BACnet address %s: %w", route.host, err)
+	}
+	source := udpAddr.String()
+	if route.network != 0 {
+		source += fmt.Sprintf("/%d/%s", route.network, formatBACnetMAC(route.mac))
+	}
+	return source, nil
+}
+
+// send transmits an APDU to route, over B/IP or the MS/TP link
+func (t *bacnetTransport) send(route bacnetRoute, npdu, apdu []byte) error {
+	if route.mstp {
+		if t.mstp == nil {
+			return fmt.Errorf("BACnet address %s needs an MS/TP port (bacnet_mstp.port)", route)
+		}
+		expectingReply := npdu[1]&npduExpectingReply != 0
+		if err := t.mstp.send(route.station, append(npdu, apdu...), expectingReply); err != nil {
+			return fmt.Errorf("BACnet send error: %w", err)
+		}
+		return nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", route.host)
+	if err != nil {
+		return fmt.Errorf("invalid BACnet address %s: %w", route.host, err)
+	}
+	frame := frameBIP(bvlcOriginalUnicast, npdu, apdu)
+	t.capture.record(route.host, "tx", frame)
+	if _, err := t.conn.WriteToUDP(frame, udpAddr); err != nil {
+		return fmt.Errorf("BACnet send error: %w", err)
+	}
+	return nil
+}
+
+// frameBIP wraps an NPDU and APDU in a BVLC header
+func frameBIP(function byte, npdu, apdu []byte) []byte {
+	length := 4 + len(npdu) + len(apdu)
+	frame := []byte{bvlcTypeBIP, function, byte(length >> 8), byte(length)}
+	frame = append(frame, npdu...)
+	return append(frame, apdu...)
+}
+
+// extractNPDU strips the BVLC header from a BACnet/IP frame and, for a
+// Forwarded-NPDU, returns the original source B/IP address
+func extractNPDU(frame []byte) ([]byte, *net.UDPAddr, bool) {
+	if len(frame) < 6 || frame[0] != bvlcTypeBIP {
+		return nil, nil, false
+	}
+	if frame[1] == 0x04 {
+		if len(frame) < 12 {
+			return nil, nil, false
+		}
+		origin := &net.UDPAddr{IP: net.IP(append([]byte(nil), frame[4:8]...)), Port: int(binary.BigEndian.Uint16(frame[8:10]))}
+		return frame[10:], origin, true
+	}
+	return frame[4:], nil, true
+}
+
+// parseNPDU returns the APDU of an NPDU and, for messages from a remote
+// network, the source network number and MAC address
+func parseNPDU(npdu []byte) (apdu []byte, network uint16, mac []byte, ok bool) {
+	if len(npdu) < 2 || npdu[0] != npduVersion {
+		return nil, 0, nil, false
+	}
+	control := npdu[1]
+	offset := 2
+	if control&0x80 != 0 { // network layer message, no APDU
+		return nil, 0, nil, false
+	}
+	if control&npduDestination != 0 {
+		if len(npdu) < offset+3 {
+			return nil, 0, nil, false
+		}
+		offset += 3 + int(npdu[offset+2])
+	}
+	if control&npduSource != 0 {
+		if len(npdu) < offset+3 || len(npdu) < offset+3+int(npdu[offset+2]) {
+			return nil, 0, nil, false
+		}
+		network = binary.BigEndian.Uint16(npdu[offset:])
+		mac = npdu[offset+3 : offset+3+int(npdu[offset+2])]
+		offset += 3 + len(mac)
+	}
+	if control&npduDestination != 0 {
+		offset++ // hop count
+	}
+	if len(npdu) <= offset {
+		return nil, 0, nil, false
+	}
+	return npdu[offset:], network, mac, true
+}
+
+// appendContextUnsigned encodes an unsigned integer with a context tag
+func appendContextUnsigned(b []byte, tag uint8, value uint32) []byte {
+	var encoded []byte
+	switch {
+	case value < 1<<8:
+		encoded = []byte{byte(value)}
+	case value < 1<<16:
+		encoded = binary.BigEndian.AppendUint16(nil, uint16(value))
+	case value < 1<<24:
+		encoded = []byte{byte(value >> 16), byte(value >> 8), byte(value)}
+	default:
+		encoded = binary.BigEndian.AppendUint32(nil, value)
+	}
+	b = append(b, tag<<4|0x08|byte(len(encoded)))
+	return append(b, encoded...)
+}
+
+// discoveredDevice is a BACnet device that answered Who-Is
+type discoveredDevice struct {
+	Instance uint32 `json:"instance"`
+	Address  string `json:"address"`
+	VendorID uint32 `json:"vendor_id"`
+}
+
+// whoIs broadcasts a global Who-Is and collects I-Am replies until timeout
+func (t *bacnetTransport) whoIs(timeout time.Duration) ([]discoveredDevice, error) {
+	found := make(chan discoveredDevice, 64)
+	t.mu.Lock()
+	if t.iAm != nil {
+		t.mu.Unlock()
+		return nil, errors.New("discovery already in progress")
+	}
+	t.iAm = found
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.iAm = nil
+		t.mu.Unlock()
+	}()
+
+	// A global broadcast, which routers forward to the networks behind them,
+	// sent to the subnet's directed broadcast address
+	apdu := []byte{apduUnconfirmed, serviceWhoIs}
+	npdu := []byte{npduVersion, npduDestination, npduGlobalNetwork >> 8, npduGlobalNetwork & 0xFF, 0, npduMaxHops}
+	frame := frameBIP(bvlcOriginalBroadcast, npdu, apdu)
+	broadcast := &net.UDPAddr{IP: t.broadcast, Port: bacnetPort}
+	t.capture.record(broadcast.String(), "tx", frame)
+	if _, err := t.conn.WriteToUDP(frame, broadcast); err != nil {
+		return nil, fmt.Errorf("BACnet Who-Is send error: %w", err)
+	}
+	if t.mstp != nil {
+		if err := t.mstp.send(mstpBroadcast, append(npdu, apdu...), false); err != nil {
+			return nil, fmt.Errorf("BACnet Who-Is send error: %w", err)
+		}
+	}
+
+	devices := make(map[uint32]discoveredDevice)
+	deadline := time.After(timeout)
+	for {
+		select {
+		case d := <-found:
+			devices[d.Instance] = d
+		case <-deadline:
+			result := make([]discoveredDevice, 0, len(devices))
+			for _, d := range devices {
+				result = append(result, d)
+			}
+			return result, nil
+		}
+	}
+}
+
+// handleIAm decodes an I-Am (device object identifier, max APDU,
+// segmentation, vendor ID) and hands it to a running Who-Is and the
+// announced callback
+func (t *bacnetTransport) handleIAm(apdu []byte, source string) {
+	rest := apdu[2:]
+	var values []uint32
+	for len(rest) > 0 && len(values) < 4 {
+		length := int(rest[0] & 0x07)
+		if len(rest) < 1+length || length > 4 {
+			return
+		}
+		var v uint32
+		for _, b := range rest[1 : 1+length] {
+			v = v<<8 | uint32(b)
+		}
+		values = append(values, v)
+		rest = rest[1+length:]
+	}
+	if len(values) < 4 || values[0]>>22 != uint32(types.DeviceType) {
+		return
+	}
+	device := discoveredDevice{Instance: values[0] & 0x3FFFFF, Address: source, VendorID: values[3]}
+	if t.announced != nil {
+		t.announced(device)
+	}
+
+	t.mu.Lock()
+	found := t.iAm
+	t.mu.Unlock()
+	if found == nil {
+		return
+	}
+	select {
+	case found <- device:
+	default:
+	}
+}
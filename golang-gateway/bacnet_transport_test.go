@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestDispatchMatchesSource(t *testing.T) {
+	tr := &bacnetTransport{
+		apdu:    &BACnetAPDUConfig{WindowSize: 1},
+		pending: make(map[uint8]*pendingRequest),
+	}
+	route, err := parseBACnetRoute("10.0.0.20/5/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := tr.replySource(route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, replies, err := tr.allocateID(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	simpleAck := []byte{apduSimpleAck, id, serviceWriteProperty}
+	// NPDU with source network 5, MAC 7
+	routed := append([]byte{npduVersion, npduSource, 0, 5, 1, 7}, simpleAck...)
+	local := append([]byte{npduVersion, 0}, simpleAck...)
+
+	for _, tc := range []struct {
+		source string
+		npdu   []byte
+	}{
+		{"10.0.0.21:47808", routed},
+		{"10.0.0.20:47808", local},
+		{"10.0.0.20:47809", routed},
+	} {
+		tr.dispatch(tc.source, tc.npdu)
+		select {
+		case <-replies:
+			t.Fatalf("reply from %s accepted for a request to %s", tc.source, source)
+		default:
+		}
+	}
+
+	tr.dispatch("10.0.0.20:47808", routed)
+	select {
+	case reply := <-replies:
+		if reply[1] != id {
+			t.Fatalf("reply invoke ID %d, want %d", reply[1], id)
+		}
+	default:
+		t.Fatal("reply from the device was not delivered")
+	}
+}
+
+func TestExtractNPDUForwarded(t *testing.T) {
+	npdu := []byte{npduVersion, 0, apduSimpleAck, 1, serviceWriteProperty}
+	frame := append([]byte{bvlcTypeBIP, 0x04, 0, byte(10 + len(npdu)), 10, 0, 0, 20, 0xBA, 0xC0}, npdu...)
+	got, origin, ok := extractNPDU(frame)
+	if !ok || origin == nil || origin.String() != "10.0.0.20:47808" || len(got) != len(npdu) {
+		t.Fatalf("extractNPDU = %v, %v, %v", got, origin, ok)
+	}
+	if _, _, ok := extractNPDU([]byte{bvlcTypeBIP, 0x04, 0, 8, 10, 0, 0, 20}); ok {
+		t.Fatal("truncated Forwarded-NPDU accepted")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/alexbeltran/gobacnet/encoding"
+	"github.com/alexbeltran/gobacnet/property"
+	"github.com/alexbeltran/gobacnet/types"
+)
+
+// gobacnet has no WriteProperty service, so writes are encoded here and sent
+// through the gateway's BACnet transport, which also receives the SimpleACK.
+
+// defaultWritePriority is the lowest BACnet command priority
+const defaultWritePriority = 16
+
+// bacnetWriteRequest describes a WriteProperty request. Text writes a
+// CharacterString (object names, descriptions); otherwise a nil Value writes
+// NULL, relinquishing the given priority slot.
+type bacnetWriteRequest struct {
+	ObjectType types.ObjectType
+	Instance   types.ObjectInstance
+	Property   uint32
+	Value      *float32
+	Text       *string
+	Priority   uint8
+}
+
+// encodeWriteProperty builds the APDU for a WriteProperty confirmed request
+func encodeWriteProperty(invokeID uint8, req bacnetWriteRequest) []byte {
+	apdu := []byte{apduConfirmedRequest, apduMaxSegsMaxAPDU, invokeID, serviceWriteProperty}
+
+	// [0] object identifier
+	objectID := uint32(req.ObjectType)<<22 | uint32(req.Instance)&0x3FFFFF
+	apdu = append(apdu, 0x0C)
+	apdu = binary.BigEndian.AppendUint32(apdu, objectID)
+
+	// [1] property identifier
+	apdu = appendContextUnsigned(apdu, 1, req.Property)
+
+	// [3] property value
+	apdu = append(apdu, 0x3E)
+	if req.Text != nil {
+		enc := encoding.NewEncoder()
+		enc.AppData(*req.Text)
+		apdu = append(apdu, enc.Bytes()...)
+	} else if req.Value == nil {
+		apdu = append(apdu, 0x00) // application NULL
+	} else {
+		apdu = appendWriteValue(apdu, req)
+	}
+	apdu = append(apdu, 0x3F)
+
+	// [4] priority
+	if req.Priority > 0 {
+		apdu = appendContextUnsigned(apdu, 4, uint32(req.Priority))
+	}
+	return apdu
+}
+
+// appendWriteValue encodes a numeric value in the property's datatype:
+// BOOLEAN for out-of-service, ENUMERATED for the present value of binary
+// objects, Unsigned for multi-state objects and REAL otherwise
+func appendWriteValue(apdu []byte, req bacnetWriteRequest) []byte {
+	v := *req.Value
+	if req.Property == bacnetPropertyOutOfService {
+		if v != 0 {
+			return append(apdu, 0x11)
+		}
+		return append(apdu, 0x10)
+	}
+	if req.Property == property.PresentValue || req.Property == bacnetPropertyRelinquishDefault {
+		switch req.ObjectType {
+		case types.BinaryInput, types.BinaryOutput, types.BinaryValue:
+			return appendApplicationUnsigned(apdu, 9, uint32(math.Round(float64(v)))) // ENUMERATED
+		case types.MultiStateInput, bacnetObjectTypes["multi-state-output"], types.MultiStateValue:
+			return appendApplicationUnsigned(apdu, 2, uint32(math.Round(float64(v)))) // Unsigned
+		}
+	}
+	apdu = append(apdu, 0x44) // application REAL
+	return binary.BigEndian.AppendUint32(apdu, math.Float32bits(v))
+}
+
+// appendApplicationUnsigned appends an application tagged unsigned integer
+// or enumeration
+func appendApplicationUnsigned(b []byte, tag uint8, value uint32) []byte {
+	n := len(b)
+	b = appendContextUnsigned(b, tag, value)
+	b[n] &^= 0x08 // application class
+	return b
+}
+
+// writeProperty sends a WriteProperty request and waits for the SimpleACK
+func (t *bacnetTransport) writeProperty(address string, req bacnetWriteRequest) error {
+	reply, err := t.request(context.Background(), address, func(invokeID uint8) ([]byte, error) {
+		return encodeWriteProperty(invokeID, req), nil
+	})
+	if err != nil {
+		return err
+	}
+	if reply[0]&0xF0 != apduSimpleAck {
+		return fmt.Errorf("unexpected BACnet reply type 0x%02x to WriteProperty", reply[0])
+	}
+	return nil
+}
+
+// validateWritePriority checks a BACnet command priority; 6 is reserved for
+// minimum on/off times
+func validateWritePriority(priority int) error {
+	if priority < 1 || priority > 16 || priority == 6 {
+		return fmt.Errorf("BACnet write priority must be 1-16 except 6, got %d", priority)
+	}
+	return nil
+}
+
+// writePriority is the priority of a command: its own, else the sensor's
+// write_priority, else the lowest
+func (s *SensorConfig) writePriority(priority int) int {
+	switch {
+	case priority != 0:
+		return priority
+	case s.WritePriority != 0:
+		return s.WritePriority
+	}
+	return defaultWritePriority
+}
+
+// writeBACnet writes a command to the sensor's present value at the
+// command's priority: the value, or NULL to relinquish the slot. Commands
+// for the relinquish default write that property instead.
+func (gw *Gateway) writeBACnet(sensor *SensorConfig, cmd CommandRequest, value float64) error {
+	if gw.bacnet == nil {
+		return fmt.Errorf("BACnet client not initialized")
+	}
+	address, err := gw.bacnetAddress(sensor)
+	if err != nil {
+		return err
+	}
+	objectType, prop := bacnetObject(sensor)
+	req := bacnetWriteRequest{
+		ObjectType: objectType,
+		Instance:   types.ObjectInstance(sensor.ObjectID),
+		Property:   prop,
+		Priority:   uint8(sensor.writePriority(cmd.Priority)),
+	}
+	v := float32(value)
+	switch {
+	case cmd.Relinquish:
+	case cmd.RelinquishDefault:
+		req.Property, req.Priority, req.Value = bacnetPropertyRelinquishDefault, 0, &v
+	default:
+		req.Value = &v
+	}
+	start := time.Now()
+	err = gw.bacnet.writeProperty(address, req)
+	gw.latency.observe("bacnet", normalizeBACnetAddress(address), time.Since(start), err)
+	if err != nil {
+		return fmt.Errorf("BACnet write error: %w", err)
+	}
+	return nil
+}
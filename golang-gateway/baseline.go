@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	baselineBucket = []byte("baseline")
+	// meterBucket holds the energy meter readings of the hour in progress
+	meterBucket = []byte("meters")
+)
+
+// BaselineConfig configures the per-zone energy baseline. Hourly zone
+// consumption (from the energy meters of the zone's rooms) is learned per
+// weekday, hour and outdoor temperature bucket; each completed hour is
+// compared with its baseline and published on energy/<zone>/baseline, with
+// alerts on alerts/energy/<zone>.
+type BaselineConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// OutdoorSensor is the sensor ID of the outdoor air temperature; without
+	// it every hour falls in one temperature bucket
+	OutdoorSensor string  `yaml:"outdoor_sensor,omitempty"`
+	TempBucketC   float64 `yaml:"temp_bucket_c"`
+	// MinSamples is how many hours a baseline cell needs before it is used
+	MinSamples   int     `yaml:"min_samples"`
+	DeviationPct float64 `yaml:"deviation_pct"`
+	// Occupied hours are [OccupiedStartHour, OccupiedEndHour) local time on
+	// OccupiedDays (mon..sun)
+	OccupiedDays      []string `yaml:"occupied_days"`
+	OccupiedStartHour int      `yaml:"occupied_start_hour"`
+	OccupiedEndHour   int      `yaml:"occupied_end_hour"`
+	// SetbackRatio flags a failed setback when an unoccupied hour uses at
+	// least this fraction of the zone's typical occupied hour
+	SetbackRatio float64 `yaml:"setback_ratio"`
+
+	occupiedDays map[time.Weekday]bool
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (c *BaselineConfig) normalize() error {
+	if c.TempBucketC <= 0 {
+		c.TempBucketC = 5
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = 3
+	}
+	if c.DeviationPct <= 0 {
+		c.DeviationPct = 25
+	}
+	if len(c.OccupiedDays) == 0 {
+		c.OccupiedDays = []string{"mon", "tue", "wed", "thu", "fri"}
+	}
+	if c.OccupiedStartHour == 0 && c.OccupiedEndHour == 0 {
+		c.OccupiedStartHour, c.OccupiedEndHour = 7, 19
+	}
+	if c.SetbackRatio <= 0 {
+		c.SetbackRatio = 0.7
+	}
+	if c.OccupiedStartHour < 0 || c.OccupiedEndHour > 24 || c.OccupiedStartHour >= c.OccupiedEndHour {
+		return fmt.Errorf("baseline occupied hours %d-%d are invalid", c.OccupiedStartHour, c.OccupiedEndHour)
+	}
+	c.occupiedDays = make(map[time.Weekday]bool)
+	for _, day := range c.OccupiedDays {
+		wd, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("baseline occupied day %q is invalid", day)
+		}
+		c.occupiedDays[wd] = true
+	}
+	return nil
+}
+
+func (c *BaselineConfig) occupied(t time.Time) bool {
+	return c.occupiedDays[t.Weekday()] && t.Hour() >= c.OccupiedStartHour && t.Hour() < c.OccupiedEndHour
+}
+
+// baselineCell is the learned consumption of one weekday/hour/temperature
+// bucket. The mean adapts like an exponential average once Count reaches
+// baselineMaxWeight, so seasonal drift is followed.
+type baselineCell struct {
+	Count int     `json:"count"`
+	Mean  float64 `json:"mean_kwh"`
+}
+
+const baselineMaxWeight = 8
+
+func (c *baselineCell) update(kwh float64) {
+	if c.Count < baselineMaxWeight {
+		c.Count++
+	}
+	c.Mean += (kwh - c.Mean) / float64(c.Count)
+}
+
+// zoneBaseline is the persisted model of one zone
+type zoneBaseline struct {
+	Cells map[string]*baselineCell `json:"cells"`
+}
+
+// EnergyBaselineReport is published on energy/<zone>/baseline for every
+// completed hour
+type EnergyBaselineReport struct {
+	Zone           string   `json:"zone"`
+	HourStart      string   `json:"hour_start"`
+	ConsumptionKWH float64  `json:"consumption_kwh"`
+	ExpectedKWH    *float64 `json:"expected_kwh,omitempty"`
+	DeviationKWH   *float64 `json:"deviation_kwh,omitempty"`
+	DeviationPct   *float64 `json:"deviation_pct,omitempty"`
+	OutdoorTemp    *float64 `json:"outdoor_temp,omitempty"`
+	Occupied       bool     `json:"occupied"`
+	// Alerts lists above_baseline, after_hours_load and failed_setback
+	Alerts    []string `json:"alerts,omitempty"`
+	Timestamp string   `json:"timestamp"`
+}
+
+// baselineTracker accumulates the current hour and holds the zone models
+type baselineTracker struct {
+	config *BaselineConfig
+	mu     sync.Mutex
+	zones  map[string]*zoneBaseline
+	// hour is the start of the hour being accumulated; start and last hold
+	// the meter readings at its start and latest sample
+	hour       time.Time
+	start      map[string]float64
+	last       map[string]float64
+	outdoorSum float64
+	outdoorN   int
+}
+
+func newBaselineTracker(config *BaselineConfig) *baselineTracker {
+	return &baselineTracker{
+		config: config,
+		zones:  make(map[string]*zoneBaseline),
+		start:  make(map[string]float64),
+		last:   make(map[string]float64),
+	}
+}
+
+func baselineCellKey(hour time.Time, outdoor *float64, bucketC float64) string {
+	bucket := "na"
+	if outdoor != nil {
+		bucket = fmt.Sprintf("%d", int(math.Floor(*outdoor/bucketC)))
+	}
+	return fmt.Sprintf("%d-%02d-%s", hour.Weekday(), hour.Hour(), bucket)
+}
+
+// zoneMeters returns the energy meters of each zone; rooms without a zone
+// are their own zone
+func (gw *Gateway) zoneMeters() map[string][]string {
+	meters := make(map[string][]string)
+	for roomID, room := range gw.rooms {
+		zone := room.Zone
+		if zone == "" {
+			zone = roomID
+		}
+		for _, sensorID := range room.Sensors {
+			if sensor, ok := gw.sensors[sensorID]; ok && sensor.Type == "energy" {
+				meters[zone] = append(meters[zone], sensorID)
+			}
+		}
+	}
+	return meters
+}
+
+// meterHour is the persisted state of the hour being accumulated, so a
+// restart within the hour still measures consumption from its start
+type meterHour struct {
+	Hour       time.Time          `json:"hour"`
+	Start      map[string]float64 `json:"start"`
+	Last       map[string]float64 `json:"last"`
+	OutdoorSum float64            `json:"outdoor_sum"`
+	OutdoorN   int                `json:"outdoor_n"`
+}
+
+// loadBaselines restores the learned zone models and the meter readings of
+// the hour in progress from the state store
+func (gw *Gateway) loadBaselines() error {
+	t := gw.baseline
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := gw.store.load(baselineBucket, func(zone string, data []byte) error {
+		var model zoneBaseline
+		if err := json.Unmarshal(data, &model); err != nil {
+			return fmt.Errorf("failed to parse baseline of zone %s: %w", zone, err)
+		}
+		t.zones[zone] = &model
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore energy baselines: %w", err)
+	}
+	err = gw.store.load(meterBucket, func(_ string, data []byte) error {
+		var state meterHour
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse energy meter readings: %w", err)
+		}
+		// An hour that ended while the gateway was down is not evaluated,
+		// as with hours it slept through
+		if state.Start == nil || state.Last == nil || !state.Hour.Equal(time.Now().Truncate(time.Hour)) {
+			return nil
+		}
+		t.hour, t.start, t.last = state.Hour, state.Start, state.Last
+		t.outdoorSum, t.outdoorN = state.OutdoorSum, state.OutdoorN
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore energy meter readings: %w", err)
+	}
+	return nil
+}
+
+// saveMeterHour persists the meter readings of the hour in progress
+func (gw *Gateway) saveMeterHour() error {
+	t := gw.baseline
+	t.mu.Lock()
+	if t.hour.IsZero() {
+		t.mu.Unlock()
+		return nil
+	}
+	state := &meterHour{
+		Hour:       t.hour,
+		Start:      make(map[string]float64, len(t.start)),
+		Last:       make(map[string]float64, len(t.last)),
+		OutdoorSum: t.outdoorSum,
+		OutdoorN:   t.outdoorN,
+	}
+	for id, v := range t.start {
+		state.Start[id] = v
+	}
+	for id, v := range t.last {
+		state.Last[id] = v
+	}
+	t.mu.Unlock()
+	return gw.store.save(meterBucket, map[string]interface{}{"hour": state})
+}
+
+// trackBaselines samples the zone meters every minute and evaluates each
+// completed hour
+func (gw *Gateway) trackBaselines() {
+	defer gw.wg.Done()
+
+	meters := gw.zoneMeters()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	gw.sampleBaselines(meters, time.Now())
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			gw.sampleBaselines(meters, now)
+		}
+	}
+}
+
+func (gw *Gateway) sampleBaselines(meters map[string][]string, now time.Time) {
+	t := gw.baseline
+	hour := now.Truncate(time.Hour)
+
+	values := make(map[string]float64)
+	var outdoor *float64
+	gw.readingsMutex.RLock()
+	for _, ids := range meters {
+		for _, id := range ids {
+			if reading, ok := gw.lastReadings[id]; ok && reading.Status == "ok" {
+				values[id] = reading.Value
+			}
+		}
+	}
+	if reading, ok := gw.lastReadings[t.config.OutdoorSensor]; ok && reading.Status == "ok" {
+		outdoor = floatPtr(reading.Value)
+	}
+	gw.readingsMutex.RUnlock()
+
+	t.mu.Lock()
+	var reports []*EnergyBaselineReport
+	if !t.hour.IsZero() && hour.After(t.hour) {
+		// The meter readings at the rollover close the finished hour and
+		// open the next
+		for id, v := range values {
+			t.last[id] = v
+		}
+		// Hours the gateway slept through are not evaluated
+		if hour.Sub(t.hour) == time.Hour {
+			reports = t.closeHourLocked(meters, now)
+		}
+		t.hour = time.Time{}
+	}
+	if t.hour.IsZero() {
+		t.hour = hour
+		t.start = make(map[string]float64, len(values))
+		t.last = make(map[string]float64, len(values))
+		t.outdoorSum, t.outdoorN = 0, 0
+	}
+	for id, v := range values {
+		if _, ok := t.start[id]; !ok {
+			t.start[id] = v
+		}
+		t.last[id] = v
+	}
+	if outdoor != nil {
+		t.outdoorSum += *outdoor
+		t.outdoorN++
+	}
+	models := make(map[string]interface{}, len(t.zones))
+	for zone, model := range t.zones {
+		models[zone] = model
+	}
+	t.mu.Unlock()
+
+	if len(reports) == 0 {
+		return
+	}
+	if err := gw.store.save(baselineBucket, models); err != nil {
+		log.Printf("[ERROR] Failed to persist energy baselines: %v", err)
+	}
+	for _, report := range reports {
+		gw.publishBaselineReport(report)
+	}
+}
+
+// closeHourLocked compares the finished hour of every zone with its baseline
+// and then learns from it
+func (t *baselineTracker) closeHourLocked(meters map[string][]string, now time.Time) []*EnergyBaselineReport {
+	var outdoor *float64
+	if t.outdoorN > 0 {
+		outdoor = floatPtr(t.outdoorSum / float64(t.outdoorN))
+	}
+	key := baselineCellKey(t.hour, outdoor, t.config.TempBucketC)
+	occupied := t.config.occupied(t.hour)
+
+	zones := make([]string, 0, len(meters))
+	for zone := range meters {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+
+	var reports []*EnergyBaselineReport
+	for _, zone := range zones {
+		consumption, metered := 0.0, false
+		for _, id := range meters[zone] {
+			start, ok1 := t.start[id]
+			last, ok2 := t.last[id]
+			// Negative deltas are meter resets or replacements
+			if ok1 && ok2 && last >= start {
+				consumption += last - start
+				metered = true
+			}
+		}
+		if !metered {
+			continue
+		}
+
+		model, ok := t.zones[zone]
+		if !ok {
+			model = &zoneBaseline{Cells: make(map[string]*baselineCell)}
+			t.zones[zone] = model
+		}
+		report := &EnergyBaselineReport{
+			Zone:           zone,
+			HourStart:      t.hour.Format(time.RFC3339),
+			ConsumptionKWH: consumption,
+			OutdoorTemp:    outdoor,
+			Occupied:       occupied,
+			Timestamp:      now.Format(time.RFC3339),
+		}
+		cell := model.Cells[key]
+		if cell != nil && cell.Count >= t.config.MinSamples {
+			expected := cell.Mean
+			report.ExpectedKWH = floatPtr(expected)
+			report.DeviationKWH = floatPtr(consumption - expected)
+			if expected > 0 {
+				pct := (consumption - expected) / expected * 100
+				report.DeviationPct = floatPtr(pct)
+				if pct > t.config.DeviationPct {
+					if occupied {
+						report.Alerts = append(report.Alerts, "above_baseline")
+					} else {
+						report.Alerts = append(report.Alerts, "after_hours_load")
+					}
+				}
+			}
+		}
+		// A setback that never worked is learned as normal, so unoccupied
+		// hours are also checked against the typical occupied hour
+		if !occupied {
+			if typical, ok := model.occupiedMean(t.config); ok && typical > 0 && consumption >= t.config.SetbackRatio*typical {
+				report.Alerts = append(report.Alerts, "failed_setback")
+			}
+		}
+		reports = append(reports, report)
+
+		if cell == nil {
+			cell = &baselineCell{}
+			model.Cells[key] = cell
+		}
+		cell.update(consumption)
+	}
+	return reports
+}
+
+// occupiedMean is the average learned consumption of the zone's occupied
+// hours
+func (m *zoneBaseline) occupiedMean(config *BaselineConfig) (float64, bool) {
+	sum, n := 0.0, 0
+	for key, cell := range m.Cells {
+		var weekday, hour int
+		if _, err := fmt.Sscanf(key, "%d-%d-", &weekday, &hour); err != nil || cell.Count < config.MinSamples {
+			continue
+		}
+		if config.occupiedDays[time.Weekday(weekday)] && hour >= config.OccupiedStartHour && hour < config.OccupiedEndHour {
+			sum += cell.Mean
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / float64(n), true
+}
+
+func (gw *Gateway) publishBaselineReport(report *EnergyBaselineReport) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal energy baseline for zone %s: %v", report.Zone, err)
+		return
+	}
+
+	topics := []string{fmt.Sprintf("energy/%s/baseline", report.Zone)}
+	if len(report.Alerts) > 0 {
+		topics = append(topics, fmt.Sprintf("alerts/energy/%s", report.Zone))
+		log.Printf("[EVENT] Energy alert for zone %s: %s (%.2f kWh)", report.Zone, strings.Join(report.Alerts, ", "), report.ConsumptionKWH)
+	}
+	for _, topic := range topics {
+		token := gw.mqttClient.Publish(topic, 1, false, payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		} else {
+			log.Printf("[MQTT] Published to %s", topic)
+		}
+	}
+}
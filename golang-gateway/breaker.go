@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ReadRetryConfig backs off polled sensors whose reads fail. After the n-th
+// consecutive failure a sensor is polled again only after 2^(n-1) poll
+// intervals (at most max_backoff_sec). After failure_threshold consecutive
+// failures its circuit opens: the sensor is left out of polling for
+// open_sec, then a single half-open probe read decides whether the circuit
+// closes or stays open for another open_sec. Successful pushed or on-demand
+// reads close the circuit too. Circuit changes are published on
+// events/<room_id>/<sensor_id>/circuit.
+type ReadRetryConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	MaxBackoffSec    int  `yaml:"max_backoff_sec"`
+	FailureThreshold int  `yaml:"failure_threshold"`
+	OpenSec          int  `yaml:"open_sec"`
+}
+
+func (c *ReadRetryConfig) normalize() {
+	if c.MaxBackoffSec <= 0 {
+		c.MaxBackoffSec = 300
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = 5
+	}
+	if c.OpenSec <= 0 {
+		c.OpenSec = 300
+	}
+}
+
+// Circuit states of a sensor
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// SensorCircuitEvent is published when a sensor's circuit opens, is probed
+// or closes
+type SensorCircuitEvent struct {
+	SensorID string `json:"sensor_id"`
+	RoomID   string `json:"room_id"`
+	State    string `json:"state"` // open, half_open or closed
+	Failures int    `json:"consecutive_failures"`
+	// LastError is the error of the read that opened the circuit
+	LastError string `json:"last_error,omitempty"`
+	// RetryAt is when an open circuit is probed
+	RetryAt   string `json:"retry_at,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// sensorCircuit is the retry state of one polled sensor
+type sensorCircuit struct {
+	state    string
+	failures int
+	lastErr  string
+	// retryAt is when the sensor is polled again after a failure
+	retryAt time.Time
+}
+
+// sensorBreakers holds the retry state of polled sensors
+type sensorBreakers struct {
+	config    *ReadRetryConfig
+	intervals map[string]time.Duration
+	mu        sync.Mutex
+	circuits  map[string]*sensorCircuit
+}
+
+func newSensorBreakers(config *ReadRetryConfig, intervals map[string]time.Duration) *sensorBreakers {
+	return &sensorBreakers{config: config, intervals: intervals, circuits: make(map[string]*sensorCircuit)}
+}
+
+// allow reports whether a sensor is polled now, and returns the half-open
+// event when the poll probes an open circuit
+func (b *sensorBreakers) allow(sensorID string, now time.Time) (bool, *SensorCircuitEvent) {
+	if b == nil {
+		return true, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[sensorID]
+	if !ok || c.failures == 0 {
+		return true, nil
+	}
+	// Polls fall on ticks, so a retry is due on the tick nearest retryAt
+	if now.Before(c.retryAt.Add(-b.intervals[sensorID] / 2)) {
+		return false, nil
+	}
+	if c.state == circuitOpen {
+		c.state = circuitHalfOpen
+		return true, b.event(sensorID, c, now)
+	}
+	return true, nil
+}
+
+// observe records the outcome of a read and returns the event of a circuit
+// change
+func (b *sensorBreakers) observe(sensorID string, err error, now time.Time) *SensorCircuitEvent {
+	if b == nil {
+		return nil
+	}
+	interval, polled := b.intervals[sensorID]
+	if !polled {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.circuits[sensorID]
+	if !ok {
+		if err == nil {
+			return nil
+		}
+		c = &sensorCircuit{state: circuitClosed}
+		b.circuits[sensorID] = c
+	}
+
+	if err == nil {
+		wasOpen := c.state != circuitClosed
+		c.state, c.failures, c.lastErr = circuitClosed, 0, ""
+		if wasOpen {
+			return b.event(sensorID, c, now)
+		}
+		return nil
+	}
+
+	c.failures++
+	c.lastErr = err.Error()
+	switch {
+	case c.state == circuitOpen:
+		// An on-demand read of a sensor left out of polling
+		return nil
+	case c.state == circuitHalfOpen || c.failures >= b.config.FailureThreshold:
+		c.state = circuitOpen
+		c.retryAt = now.Add(time.Duration(b.config.OpenSec) * time.Second)
+		return b.event(sensorID, c, now)
+	}
+	backoff := interval << (c.failures - 1)
+	if limit := time.Duration(b.config.MaxBackoffSec) * time.Second; backoff > limit || backoff <= 0 {
+		backoff = limit
+	}
+	c.retryAt = now.Add(backoff)
+	return nil
+}
+
+func (b *sensorBreakers) event(sensorID string, c *sensorCircuit, now time.Time) *SensorCircuitEvent {
+	event := &SensorCircuitEvent{
+		SensorID:  sensorID,
+		State:     c.state,
+		Failures:  c.failures,
+		Timestamp: now.Format(time.RFC3339),
+	}
+	if c.state == circuitOpen {
+		event.LastError = c.lastErr
+		event.RetryAt = c.retryAt.Format(time.RFC3339)
+	}
+	return event
+}
+
+// allowPoll reports whether a sensor is polled now, publishing the event
+// of a half-open probe
+func (gw *Gateway) allowPoll(sensorID string, now time.Time) bool {
+	allowed, event := gw.breakers.allow(sensorID, now)
+	if event != nil {
+		gw.publishCircuitEvent(event)
+	}
+	return allowed
+}
+
+// publishCircuitEvent publishes a sensor's circuit change
+func (gw *Gateway) publishCircuitEvent(event *SensorCircuitEvent) {
+	event.RoomID = gw.sensorToRoom[event.SensorID]
+	switch event.State {
+	case circuitOpen:
+		log.Printf("[WARN] Sensor %s failed %d consecutive reads, leaving it out of polling until %s: %s", event.SensorID, event.Failures, event.RetryAt, event.LastError)
+	case circuitHalfOpen:
+		log.Printf("[EVENT] Probing sensor %s", event.SensorID)
+	default:
+		log.Printf("[EVENT] Sensor %s reads again, resuming polling", event.SensorID)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal circuit event for %s: %v", event.SensorID, err)
+		return
+	}
+	topic := fmt.Sprintf("events/%s/%s/circuit", event.RoomID, event.SensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
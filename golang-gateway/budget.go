@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ResourceBudgetConfig lets a gateway that shares an edge box with other
+// workloads degrade gracefully. Every CheckIntervalSec the process CPU
+// (percent of one core), memory obtained from the OS and outgoing MQTT
+// payload bandwidth are compared with their budgets (0 is unlimited). While
+// any is exceeded the poll intervals of sensors with poll_priority low are
+// doubled, up to MaxFactor; once every usage is below RecoverPercent of its
+// budget they are halved again. Sensors in poll groups are not throttled.
+// The throttling state is published retained on
+// status/gateway/<gateway_id>/throttle whenever it changes.
+type ResourceBudgetConfig struct {
+	Enabled          bool    `yaml:"enabled"`
+	CPUPercent       float64 `yaml:"cpu_percent,omitempty"`
+	MemoryMB         int     `yaml:"memory_mb,omitempty"`
+	BandwidthKBps    float64 `yaml:"bandwidth_kbps,omitempty"`
+	CheckIntervalSec int     `yaml:"check_interval_sec,omitempty"` // default 10
+	MaxFactor        int     `yaml:"max_factor,omitempty"`         // default 8
+	RecoverPercent   int     `yaml:"recover_percent,omitempty"`    // default 80
+}
+
+func (c *ResourceBudgetConfig) normalize() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.CPUPercent < 0 || c.MemoryMB < 0 || c.BandwidthKBps < 0 {
+		return fmt.Errorf("resource_budget: budgets must not be negative")
+	}
+	if c.CPUPercent == 0 && c.MemoryMB == 0 && c.BandwidthKBps == 0 {
+		return fmt.Errorf("resource_budget: enabled without a cpu_percent, memory_mb or bandwidth_kbps budget")
+	}
+	if c.CheckIntervalSec <= 0 {
+		c.CheckIntervalSec = 10
+	}
+	if c.MaxFactor <= 0 {
+		c.MaxFactor = 8
+	}
+	if c.RecoverPercent <= 0 || c.RecoverPercent > 100 {
+		c.RecoverPercent = 80
+	}
+	return nil
+}
+
+// Poll priorities of sensors
+const (
+	pollPriorityNormal = "normal"
+	pollPriorityLow    = "low"
+)
+
+// validatePollPriorities checks the sensors' poll_priority
+func (gw *Gateway) validatePollPriorities() error {
+	for id, sensor := range gw.sensors {
+		switch sensor.PollPriority {
+		case "", pollPriorityNormal, pollPriorityLow:
+		default:
+			return fmt.Errorf("sensor %s: unknown poll_priority %q (normal or low)", id, sensor.PollPriority)
+		}
+	}
+	return nil
+}
+
+// ResourceUsage is the usage measured over one check interval
+type ResourceUsage struct {
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryMB      float64 `json:"memory_mb"`
+	BandwidthKBps float64 `json:"bandwidth_kbps"`
+}
+
+// ThrottleState is published on status/gateway/<gateway_id>/throttle
+type ThrottleState struct {
+	GatewayID string `json:"gateway_id"`
+	Throttled bool   `json:"throttled"`
+	// Factor multiplies the poll interval of low priority sensors
+	Factor           int           `json:"factor"`
+	Exceeded         []string      `json:"exceeded,omitempty"` // cpu, memory, bandwidth
+	Usage            ResourceUsage `json:"usage"`
+	ThrottledSensors int           `json:"throttled_sensors"`
+	Timestamp        string        `json:"timestamp"`
+}
+
+// resourceBudget measures usage and holds the current throttle factor
+type resourceBudget struct {
+	config *ResourceBudgetConfig
+	sent   *atomic.Uint64 // outgoing MQTT payload bytes
+	scale  atomic.Int64
+
+	mu       sync.Mutex
+	usage    ResourceUsage
+	exceeded []string
+	lastCPU  time.Duration
+	lastSent uint64
+	lastAt   time.Time
+}
+
+func newResourceBudget(config *ResourceBudgetConfig, sent *atomic.Uint64) *resourceBudget {
+	b := &resourceBudget{config: config, sent: sent}
+	b.scale.Store(1)
+	b.lastCPU, b.lastSent, b.lastAt = processCPUTime(), sent.Load(), time.Now()
+	return b
+}
+
+// factor is the current poll interval multiplier of low priority sensors,
+// 1 when no budget is configured
+func (b *resourceBudget) factor() int {
+	if b == nil {
+		return 1
+	}
+	return int(b.scale.Load())
+}
+
+// skipPoll reports whether the tick-th tick of a sensor's poller is skipped
+func (b *resourceBudget) skipPoll(sensor *SensorConfig, tick int) bool {
+	if sensor.PollPriority != pollPriorityLow {
+		return false
+	}
+	return tick%b.factor() != 0
+}
+
+// processCPUTime is the user and system CPU time used by the process
+func processCPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// measure updates the usage since the previous check
+func (b *resourceBudget) measure(now time.Time) ResourceUsage {
+	cpu, sent := processCPUTime(), b.sent.Load()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elapsed := now.Sub(b.lastAt)
+	if elapsed > 0 {
+		b.usage = ResourceUsage{
+			CPUPercent:    100 * float64(cpu-b.lastCPU) / float64(elapsed),
+			MemoryMB:      float64(mem.Sys-mem.HeapReleased) / (1 << 20),
+			BandwidthKBps: float64(sent-b.lastSent) / 1024 / elapsed.Seconds(),
+		}
+	}
+	b.lastCPU, b.lastSent, b.lastAt = cpu, sent, now
+	return b.usage
+}
+
+// adjust doubles the factor while a budget is exceeded and halves it once
+// usage is back below the recovery threshold; it reports a change
+func (b *resourceBudget) adjust(usage ResourceUsage) bool {
+	c := b.config
+	recoverAt := float64(c.RecoverPercent) / 100
+	var exceeded []string
+	below := true
+	for _, r := range []struct {
+		name          string
+		used, allowed float64
+	}{
+		{"cpu", usage.CPUPercent, c.CPUPercent},
+		{"memory", usage.MemoryMB, float64(c.MemoryMB)},
+		{"bandwidth", usage.BandwidthKBps, c.BandwidthKBps},
+	} {
+		if r.allowed == 0 {
+			continue
+		}
+		if r.used > r.allowed {
+			exceeded = append(exceeded, r.name)
+		}
+		if r.used >= r.allowed*recoverAt {
+			below = false
+		}
+	}
+
+	b.mu.Lock()
+	b.exceeded = exceeded
+	b.mu.Unlock()
+
+	factor := b.factor()
+	switch {
+	case len(exceeded) > 0 && factor < c.MaxFactor:
+		factor *= 2
+		if factor > c.MaxFactor {
+			factor = c.MaxFactor
+		}
+	case below && factor > 1:
+		factor /= 2
+	default:
+		return false
+	}
+	b.scale.Store(int64(factor))
+	return true
+}
+
+func (b *resourceBudget) state(gatewayID string, throttledSensors int) ThrottleState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	factor := b.factor()
+	if factor == 1 {
+		throttledSensors = 0
+	}
+	return ThrottleState{
+		GatewayID:        gatewayID,
+		Throttled:        factor > 1,
+		Factor:           factor,
+		Exceeded:         b.exceeded,
+		Usage:            b.usage,
+		ThrottledSensors: throttledSensors,
+		Timestamp:        time.Now().Format(time.RFC3339),
+	}
+}
+
+func (b *resourceBudget) writePrometheus(sb *strings.Builder) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	usage := b.usage
+	b.mu.Unlock()
+	sb.WriteString("# HELP gateway_resource_usage Resource usage over the latest budget check.\n")
+	sb.WriteString("# TYPE gateway_resource_usage gauge\n")
+	fmt.Fprintf(sb, "gateway_resource_usage{resource=\"cpu_percent\"} %g\n", usage.CPUPercent)
+	fmt.Fprintf(sb, "gateway_resource_usage{resource=\"memory_mb\"} %g\n", usage.MemoryMB)
+	fmt.Fprintf(sb, "gateway_resource_usage{resource=\"bandwidth_kbps\"} %g\n", usage.BandwidthKBps)
+	sb.WriteString("# HELP gateway_poll_throttle_factor Poll interval multiplier of low priority sensors.\n")
+	sb.WriteString("# TYPE gateway_poll_throttle_factor gauge\n")
+	fmt.Fprintf(sb, "gateway_poll_throttle_factor %d\n", b.factor())
+}
+
+// lowPrioritySensors counts the individually polled low priority sensors
+func (gw *Gateway) lowPrioritySensors() int {
+	grouped := make(map[string]bool)
+	for _, group := range gw.settings.PollGroups {
+		for _, sensorID := range group.Sensors {
+			grouped[sensorID] = true
+		}
+	}
+	n := 0
+	for id, sensor := range gw.sensors {
+		if sensor.PollPriority == pollPriorityLow && !grouped[id] {
+			n++
+		}
+	}
+	return n
+}
+
+// enforceBudget checks resource usage every interval and publishes the
+// throttling state when it changes
+func (gw *Gateway) enforceBudget() {
+	defer gw.wg.Done()
+
+	cfg := &gw.settings.ResourceBudget
+	ticker := time.NewTicker(time.Duration(cfg.CheckIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	sensors := gw.lowPrioritySensors()
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			usage := gw.budget.measure(now)
+			if !gw.budget.adjust(usage) {
+				continue
+			}
+			state := gw.budget.state(gw.settings.GatewayID, sensors)
+			switch {
+			case len(state.Exceeded) > 0:
+				log.Printf("[WARN] Resource budget exceeded (%s): polling %d low priority sensor(s) %dx slower", strings.Join(state.Exceeded, ", "), sensors, state.Factor)
+			case state.Throttled:
+				log.Printf("Resource usage recovering: polling low priority sensors %dx slower", state.Factor)
+			default:
+				log.Printf("Resource usage back within budget, low priority sensors polled normally")
+			}
+			gw.publishThrottleState(state)
+		}
+	}
+}
+
+func (gw *Gateway) publishThrottleState(state ThrottleState) {
+	payload, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal throttle state: %v", err)
+		return
+	}
+	topic := gw.statusTopic() + "/throttle"
+	token := gw.mqttClient.Publish(topic, 1, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Every numeric reading is corrected from the protocol's raw value with
+// the sensor's scale and offset (raw*scale + offset) and then, if set, the
+// polynomial calibration c0 + c1*x + c2*x^2 + ... with x the scaled value,
+// e.g. the fit of a two- or three-point calibration against a reference
+// instrument. The correction is applied before any decoder and before the
+// conversion to the canonical unit. Readings of sensors with an enum_map
+// and text readings that are not numbers (state names) are left as read.
+// Commands to writable sensors are converted back to the raw value, so
+// these must not have a calibration polynomial.
+
+// validateCalibration checks the scale, offset and calibration of sensors
+func (gw *Gateway) validateCalibration() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Scale == 0 {
+			sensor.Scale = 1
+		}
+		for i, c := range sensor.Calibration {
+			if math.IsNaN(c) || math.IsInf(c, 0) {
+				return fmt.Errorf("sensor %s: calibration coefficient %d is not a number", id, i)
+			}
+		}
+		if len(sensor.Calibration) == 1 {
+			return fmt.Errorf("sensor %s: calibration needs at least two coefficients (c0, c1), use offset for a constant correction", id)
+		}
+		if sensor.Writable && len(sensor.Calibration) > 0 {
+			return fmt.Errorf("sensor %s: writable sensors cannot have a calibration polynomial, use scale and offset", id)
+		}
+	}
+	return nil
+}
+
+// calibrated reports whether a sensor's readings are corrected at all
+func (s *SensorConfig) calibrated() bool {
+	return (s.Scale != 1 || s.Offset != 0 || len(s.Calibration) > 0) && len(s.EnumMap) == 0
+}
+
+// calibrate corrects a raw reading; text readings that are not numbers are
+// returned unchanged
+func (s *SensorConfig) calibrate(value float64, text string) float64 {
+	if !s.calibrated() {
+		return value
+	}
+	if text != "" {
+		if _, err := strconv.ParseFloat(text, 64); err != nil {
+			return value
+		}
+	}
+	x := value*s.Scale + s.Offset
+	if len(s.Calibration) == 0 {
+		return x
+	}
+	// Horner's method
+	y := 0.0
+	for i := len(s.Calibration) - 1; i >= 0; i-- {
+		y = y*x + s.Calibration[i]
+	}
+	return y
+}
+
+// uncalibrate converts a commanded value back to the raw value written to
+// the device
+func (s *SensorConfig) uncalibrate(value float64) (float64, error) {
+	if !s.calibrated() {
+		return value, nil
+	}
+	if len(s.Calibration) > 0 {
+		return 0, errors.New("sensors with a calibration polynomial cannot be written")
+	}
+	return (value - s.Offset) / s.Scale, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// captureAllDevices enables capture for every device
+const captureAllDevices = "*"
+
+// FrameCaptureConfig configures raw protocol frame capture for
+// troubleshooting. Devices lists the device keys to capture from startup:
+// BACnet addresses as host:port and the Modbus address, or "*" for all.
+// Capture can also be toggled at runtime through /debug/capture.
+type FrameCaptureConfig struct {
+	File      string   `yaml:"file,omitempty"`
+	MaxSizeMB int      `yaml:"max_size_mb,omitempty"`
+	MaxFiles  int      `yaml:"max_files,omitempty"`
+	Devices   []string `yaml:"devices,omitempty"`
+}
+
+func (c *FrameCaptureConfig) normalize() {
+	if c.File == "" {
+		c.File = "/app/data/frames.log"
+	}
+	if c.MaxSizeMB <= 0 {
+		c.MaxSizeMB = 10
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = 3
+	}
+	for i, device := range c.Devices {
+		c.Devices[i] = captureDeviceKey(device)
+	}
+}
+
+// frameCapture writes hex dumps of protocol frames for enabled devices to a
+// size-rotated debug file (file, file.1 ... file.N)
+type frameCapture struct {
+	mu      sync.Mutex
+	config  *FrameCaptureConfig
+	enabled map[string]bool
+	file    *os.File
+	size    int64
+}
+
+func newFrameCapture(config *FrameCaptureConfig) *frameCapture {
+	c := &frameCapture{config: config, enabled: make(map[string]bool)}
+	for _, device := range config.Devices {
+		c.enabled[device] = true
+	}
+	if len(c.enabled) > 0 {
+		log.Printf("Frame capture enabled for %s", strings.Join(config.Devices, ", "))
+	}
+	return c
+}
+
+// captureDeviceKey normalizes a device key so BACnet addresses given without
+// a port match the addresses frames are recorded under
+func captureDeviceKey(device string) string {
+	device = strings.TrimSpace(device)
+	if device == captureAllDevices {
+		return device
+	}
+	return normalizeBACnetAddress(device)
+}
+
+// setEnabled turns capture on or off for a device
+func (c *frameCapture) setEnabled(device string, enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enabled {
+		c.enabled[device] = true
+	} else {
+		delete(c.enabled, device)
+	}
+	if len(c.enabled) == 0 && c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	log.Printf("Frame capture for %s set to %v", device, enabled)
+}
+
+// devices returns the devices capture is enabled for
+func (c *frameCapture) devices() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	devices := make([]string, 0, len(c.enabled))
+	for device := range c.enabled {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// record writes a frame sent to ("tx") or received from ("rx") a device
+func (c *frameCapture) record(device, direction string, frame []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.enabled[device] && !c.enabled[captureAllDevices] {
+		return
+	}
+
+	entry := fmt.Sprintf("%s %s %s %d bytes\n%s",
+		time.Now().Format(time.RFC3339Nano), device, direction, len(frame), hex.Dump(frame))
+	if err := c.writeLocked([]byte(entry)); err != nil {
+		log.Printf("[ERROR] Failed to write frame capture: %v", err)
+	}
+}
+
+// writeLocked appends to the capture file, rotating it first when the entry
+// would exceed the size limit; the caller holds mu
+func (c *frameCapture) writeLocked(entry []byte) error {
+	maxSize := int64(c.config.MaxSizeMB) * 1024 * 1024
+	if c.file != nil && c.size+int64(len(entry)) > maxSize {
+		c.file.Close()
+		c.file = nil
+		c.rotateLocked()
+	}
+	if c.file == nil {
+		f, err := os.OpenFile(c.config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", c.config.File, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to stat %s: %w", c.config.File, err)
+		}
+		c.file = f
+		c.size = info.Size()
+	}
+	n, err := c.file.Write(entry)
+	c.size += int64(n)
+	return err
+}
+
+// rotateLocked shifts file.N-1 -> file.N ... file -> file.1, dropping the oldest
+func (c *frameCapture) rotateLocked() {
+	base := c.config.File
+	os.Remove(fmt.Sprintf("%s.%d", base, c.config.MaxFiles))
+	for i := c.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+	if err := os.Rename(base, base+".1"); err != nil && !os.IsNotExist(err) {
+		log.Printf("[ERROR] Failed to rotate frame capture file: %v", err)
+	}
+}
+
+func (c *frameCapture) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+}
+
+// writer returns an io.Writer for the goburrow Modbus logger, which prints
+// every ADU as "modbus: sending/received <hex>"; those lines are recorded
+// as frames of device
+func (c *frameCapture) writer(device string) *captureLogWriter {
+	return &captureLogWriter{capture: c, device: device}
+}
+
+type captureLogWriter struct {
+	capture *frameCapture
+	device  string
+}
+
+func (w *captureLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	var direction, dump string
+	switch {
+	case strings.HasPrefix(line, "modbus: sending "):
+		direction, dump = "tx", strings.TrimPrefix(line, "modbus: sending ")
+	case strings.HasPrefix(line, "modbus: received "):
+		direction, dump = "rx", strings.TrimPrefix(line, "modbus: received ")
+	default:
+		return len(p), nil
+	}
+	frame, err := hex.DecodeString(strings.ReplaceAll(dump, " ", ""))
+	if err != nil {
+		return len(p), nil
+	}
+	w.capture.record(w.device, direction, frame)
+	return len(p), nil
+}
+
+// captureToggle is the body accepted by POST /debug/capture
+type captureToggle struct {
+	Device  string `json:"device"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleCapture serves /debug/capture: GET lists the devices being captured
+// and POST enables or disables capture for one device
+func (gw *Gateway) handleCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var toggle captureToggle
+		if err := json.NewDecoder(r.Body).Decode(&toggle); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if strings.TrimSpace(toggle.Device) == "" {
+			writeJSONError(w, http.StatusBadRequest, "device is required")
+			return
+		}
+		gw.capture.setEnabled(captureDeviceKey(toggle.Device), toggle.Enabled)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file":    gw.settings.FrameCapture.File,
+		"devices": gw.capture.devices(),
+	})
+}
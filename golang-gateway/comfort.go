@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ComfortConfig tracks thermal comfort compliance in the spirit of ASHRAE
+// 55: every minute each room's temperature (and humidity, when the band
+// limits it) is checked against the comfort band of the season while the
+// room is occupied. At the end of each local day the share of occupied
+// hours spent in the band is published per room on comfort/<room_id>/daily
+// as evidence for lease SLAs and WELL certification. Rooms with occupancy
+// or motion sensors are occupied when someone is detected; other rooms
+// follow the occupied schedule, as do all rooms under privacy mode.
+type ComfortConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Heating and Cooling are the bands of the two seasons; CoolingMonths
+	// (1-12) select the cooling season
+	Heating       ComfortBand `yaml:"heating"`
+	Cooling       ComfortBand `yaml:"cooling"`
+	CoolingMonths []int       `yaml:"cooling_months"`
+	// Rooms overrides the band of individual rooms all year round
+	Rooms map[string]ComfortBand `yaml:"rooms,omitempty"`
+	// TargetPct is the contractual compliance; reports flag days below it
+	TargetPct        float64 `yaml:"target_pct"`
+	OccupiedSchedule `yaml:",inline"`
+
+	coolingMonths map[time.Month]bool
+}
+
+// OccupiedSchedule gives the occupied hours of rooms without occupancy
+// sensing: [OccupiedStartHour, OccupiedEndHour) local time on OccupiedDays
+type OccupiedSchedule struct {
+	OccupiedDays      []string `yaml:"occupied_days"`
+	OccupiedStartHour int      `yaml:"occupied_start_hour"`
+	OccupiedEndHour   int      `yaml:"occupied_end_hour"`
+
+	occupiedDays map[time.Weekday]bool
+}
+
+func (c *OccupiedSchedule) normalize(section string) error {
+	if len(c.OccupiedDays) == 0 {
+		c.OccupiedDays = []string{"mon", "tue", "wed", "thu", "fri"}
+	}
+	if c.OccupiedStartHour == 0 && c.OccupiedEndHour == 0 {
+		c.OccupiedStartHour, c.OccupiedEndHour = 7, 19
+	}
+	if c.OccupiedStartHour < 0 || c.OccupiedEndHour > 24 || c.OccupiedStartHour >= c.OccupiedEndHour {
+		return fmt.Errorf("%s occupied hours %d-%d are invalid", section, c.OccupiedStartHour, c.OccupiedEndHour)
+	}
+	c.occupiedDays = make(map[time.Weekday]bool)
+	for _, day := range c.OccupiedDays {
+		wd, ok := weekdayNames[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("%s occupied day %q is invalid", section, day)
+		}
+		c.occupiedDays[wd] = true
+	}
+	return nil
+}
+
+func (c *OccupiedSchedule) scheduled(t time.Time) bool {
+	return c.occupiedDays[t.Weekday()] && t.Hour() >= c.OccupiedStartHour && t.Hour() < c.OccupiedEndHour
+}
+
+// ComfortBand is an operative temperature range in °C with optional
+// relative humidity limits
+type ComfortBand struct {
+	TempMinC       float64 `yaml:"temp_min_c" json:"temp_min_c"`
+	TempMaxC       float64 `yaml:"temp_max_c" json:"temp_max_c"`
+	HumidityMinPct float64 `yaml:"humidity_min_pct,omitempty" json:"humidity_min_pct,omitempty"`
+	HumidityMaxPct float64 `yaml:"humidity_max_pct,omitempty" json:"humidity_max_pct,omitempty"`
+}
+
+func (b ComfortBand) validate(name string) error {
+	if b.TempMinC >= b.TempMaxC {
+		return fmt.Errorf("comfort band %s: temp_min_c %.1f must be below temp_max_c %.1f", name, b.TempMinC, b.TempMaxC)
+	}
+	if b.HumidityMaxPct > 0 && b.HumidityMinPct >= b.HumidityMaxPct {
+		return fmt.Errorf("comfort band %s: humidity_min_pct must be below humidity_max_pct", name)
+	}
+	return nil
+}
+
+func (c *ComfortConfig) normalize() error {
+	if c.Heating == (ComfortBand{}) {
+		c.Heating = ComfortBand{TempMinC: 20, TempMaxC: 24, HumidityMaxPct: 65}
+	}
+	if c.Cooling == (ComfortBand{}) {
+		c.Cooling = ComfortBand{TempMinC: 23, TempMaxC: 26, HumidityMaxPct: 65}
+	}
+	if len(c.CoolingMonths) == 0 {
+		c.CoolingMonths = []int{5, 6, 7, 8, 9}
+	}
+	if c.TargetPct <= 0 {
+		c.TargetPct = 90
+	}
+	if err := c.OccupiedSchedule.normalize("comfort"); err != nil {
+		return err
+	}
+
+	if err := c.Heating.validate("heating"); err != nil {
+		return err
+	}
+	if err := c.Cooling.validate("cooling"); err != nil {
+		return err
+	}
+	for roomID, band := range c.Rooms {
+		if err := band.validate(roomID); err != nil {
+			return err
+		}
+	}
+	c.coolingMonths = make(map[time.Month]bool)
+	for _, m := range c.CoolingMonths {
+		if m < 1 || m > 12 {
+			return fmt.Errorf("comfort cooling month %d is invalid", m)
+		}
+		c.coolingMonths[time.Month(m)] = true
+	}
+	return nil
+}
+
+// band returns the comfort band of a room at t
+func (c *ComfortConfig) band(roomID string, t time.Time) ComfortBand {
+	if band, ok := c.Rooms[roomID]; ok {
+		return band
+	}
+	if c.coolingMonths[t.Month()] {
+		return c.Cooling
+	}
+	return c.Heating
+}
+
+// ComfortComplianceReport is published on comfort/<room_id>/daily. Hours
+// are occupied hours; those without a temperature reading count as
+// NoDataHours and are left out of CompliancePct.
+type ComfortComplianceReport struct {
+	RoomID         string  `json:"room_id"`
+	Date           string  `json:"date"`
+	OccupiedHours  float64 `json:"occupied_hours"`
+	CompliantHours float64 `json:"compliant_hours"`
+	TooColdHours   float64 `json:"too_cold_hours"`
+	TooWarmHours   float64 `json:"too_warm_hours"`
+	HumidityHours  float64 `json:"humidity_out_of_band_hours"`
+	NoDataHours    float64 `json:"no_data_hours"`
+	// CompliancePct is nil when the room was never occupied with data
+	CompliancePct *float64 `json:"compliance_pct,omitempty"`
+	TargetPct     float64  `json:"target_pct"`
+	TargetMet     bool     `json:"target_met"`
+	// Occupancy is "sensor" or "schedule"
+	Occupancy string `json:"occupancy"`
+	Timestamp string `json:"timestamp"`
+}
+
+// comfortDay accumulates one room's occupied seconds for the current day
+type comfortDay struct {
+	occupied, compliant, cold, warm, humidity, noData float64
+}
+
+type comfortTracker struct {
+	mu     sync.Mutex
+	config *ComfortConfig
+	day    time.Time
+	last   time.Time
+	rooms  map[string]*comfortDay
+}
+
+func newComfortTracker(config *ComfortConfig) *comfortTracker {
+	return &comfortTracker{config: config, rooms: make(map[string]*comfortDay)}
+}
+
+// occupancySampleInterval is how often rooms are checked for comfort and
+// ventilation compliance; a sample never
+// stands for more than twice this, so gaps while the gateway was down are
+// not counted
+const occupancySampleInterval = time.Minute
+
+// trackComfort samples every room each minute and publishes the daily
+// reports when the local date changes
+func (gw *Gateway) trackComfort() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(occupancySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			gw.sampleComfort(now)
+		}
+	}
+}
+
+// roomConditions is what comfort sampling reads of a room
+type roomConditions struct {
+	temp, humidity, co2          float64
+	hasTemp, hasHumidity, hasCO2 bool
+	occupied, sensed             bool
+}
+
+func (gw *Gateway) roomConditions(room *RoomConfig) roomConditions {
+	var rc roomConditions
+	for _, sensorID := range room.Sensors {
+		reading, ok := gw.lastReadings[sensorID]
+		if !ok || reading.Status != "ok" || reading.Maintenance {
+			continue
+		}
+		switch reading.Type {
+		case "temperature":
+			rc.temp, rc.hasTemp = celsius(reading.Value, reading.Unit), true
+		case "humidity":
+			rc.humidity, rc.hasHumidity = reading.Value, true
+		case "co2":
+			rc.co2, rc.hasCO2 = reading.Value, true
+		case "occupancy":
+			rc.sensed = true
+			rc.occupied = rc.occupied || reading.Value >= 1
+		case "motion":
+			rc.sensed = true
+			rc.occupied = rc.occupied || reading.Value >= 0.5
+		}
+	}
+	return rc
+}
+
+// allRoomConditions reads the conditions of every room. Occupancy sensing
+// is ignored under privacy mode so per-room presence never shows up in
+// compliance reports.
+func (gw *Gateway) allRoomConditions() map[string]roomConditions {
+	gw.readingsMutex.RLock()
+	defer gw.readingsMutex.RUnlock()
+	conditions := make(map[string]roomConditions, len(gw.rooms))
+	for roomID, room := range gw.rooms {
+		rc := gw.roomConditions(room)
+		if gw.settings.Privacy.Enabled {
+			rc.occupied, rc.sensed = false, false
+		}
+		conditions[roomID] = rc
+	}
+	return conditions
+}
+
+// celsius converts a temperature in a registered unit to °C
+func celsius(value float64, unit string) float64 {
+	def, ok := unitRegistry[unit]
+	if !ok {
+		if code, alias := unitAliases[strings.ToLower(unit)]; alias {
+			def, ok = unitRegistry[code]
+		}
+	}
+	if !ok || def.dimension != "temperature" {
+		return value
+	}
+	return value*def.scale + def.offset
+}
+
+func (gw *Gateway) sampleComfort(now time.Time) {
+	t := gw.comfort
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	conditions := gw.allRoomConditions()
+
+	t.mu.Lock()
+	var reports []*ComfortComplianceReport
+	if !t.day.IsZero() && day.After(t.day) {
+		reports = t.closeDayLocked(conditions, now)
+	}
+	if t.day.IsZero() || day.After(t.day) {
+		t.day = day
+		t.rooms = make(map[string]*comfortDay)
+	}
+	elapsed := now.Sub(t.last).Seconds()
+	if t.last.IsZero() || elapsed > 2*occupancySampleInterval.Seconds() {
+		elapsed = occupancySampleInterval.Seconds()
+	}
+	t.last = now
+	for roomID, rc := range conditions {
+		occupied := rc.occupied
+		if !rc.sensed {
+			occupied = t.config.scheduled(now)
+		}
+		if !occupied {
+			continue
+		}
+		acc := t.rooms[roomID]
+		if acc == nil {
+			acc = &comfortDay{}
+			t.rooms[roomID] = acc
+		}
+		acc.occupied += elapsed
+		if !rc.hasTemp {
+			acc.noData += elapsed
+			continue
+		}
+		band := t.config.band(roomID, now)
+		compliant := true
+		if rc.temp < band.TempMinC {
+			acc.cold += elapsed
+			compliant = false
+		} else if rc.temp > band.TempMaxC {
+			acc.warm += elapsed
+			compliant = false
+		}
+		if rc.hasHumidity && ((band.HumidityMaxPct > 0 && rc.humidity > band.HumidityMaxPct) || rc.humidity < band.HumidityMinPct) {
+			acc.humidity += elapsed
+			compliant = false
+		}
+		if compliant {
+			acc.compliant += elapsed
+		}
+	}
+	t.mu.Unlock()
+
+	for _, report := range reports {
+		gw.publishComfortReport(report)
+	}
+}
+
+// closeDayLocked builds the reports of the finished day for every room
+func (t *comfortTracker) closeDayLocked(conditions map[string]roomConditions, now time.Time) []*ComfortComplianceReport {
+	reports := make([]*ComfortComplianceReport, 0, len(conditions))
+	for roomID, rc := range conditions {
+		acc := t.rooms[roomID]
+		if acc == nil {
+			acc = &comfortDay{}
+		}
+		hours := func(sec float64) float64 {
+			return math.Round(sec/3600*100) / 100
+		}
+		report := &ComfortComplianceReport{
+			RoomID:         roomID,
+			Date:           t.day.Format("2006-01-02"),
+			OccupiedHours:  hours(acc.occupied),
+			CompliantHours: hours(acc.compliant),
+			TooColdHours:   hours(acc.cold),
+			TooWarmHours:   hours(acc.warm),
+			HumidityHours:  hours(acc.humidity),
+			NoDataHours:    hours(acc.noData),
+			TargetPct:      t.config.TargetPct,
+			TargetMet:      true,
+			Occupancy:      "schedule",
+			Timestamp:      now.Format(time.RFC3339),
+		}
+		if rc.sensed {
+			report.Occupancy = "sensor"
+		}
+		if measured := acc.occupied - acc.noData; measured > 0 {
+			pct := math.Round(acc.compliant/measured*1000) / 10
+			report.CompliancePct = &pct
+			report.TargetMet = pct >= t.config.TargetPct
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+func (gw *Gateway) publishComfortReport(report *ComfortComplianceReport) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal comfort report for room %s: %v", report.RoomID, err)
+		return
+	}
+	topic := fmt.Sprintf("comfort/%s/daily", report.RoomID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	if !report.TargetMet {
+		log.Printf("[EVENT] Room %s was in its comfort band for only %.1f%% of occupied hours on %s (target %.0f%%)", report.RoomID, *report.CompliancePct, report.Date, report.TargetPct)
+	}
+	log.Printf("[MQTT] Published to %s", topic)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CommandQueueConfig limits how fast writes are sent to a single device so a
+// burst of scene or demand-response commands cannot overwhelm slow
+// controllers. Devices overrides the defaults per device key: the BACnet
+// address (or bacnet:<device instance>), the Modbus endpoint (<host:port> or
+// <host:port>#<unit id>), grpc:<target> or dali:A<short address>.
+type CommandQueueConfig struct {
+	MaxInFlight int                          `yaml:"max_in_flight,omitempty"`
+	SpacingMs   int                          `yaml:"spacing_ms,omitempty"`
+	QueueSize   int                          `yaml:"queue_size,omitempty"`
+	Devices     map[string]DeviceQueueLimits `yaml:"devices,omitempty"`
+}
+
+type DeviceQueueLimits struct {
+	MaxInFlight int `yaml:"max_in_flight,omitempty"`
+	SpacingMs   int `yaml:"spacing_ms,omitempty"`
+}
+
+func (c *CommandQueueConfig) normalize() {
+	if c.MaxInFlight <= 0 {
+		c.MaxInFlight = 1
+	}
+	if c.SpacingMs < 0 {
+		c.SpacingMs = 0
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 64
+	}
+}
+
+// limitsFor returns the effective limits for a device
+func (c *CommandQueueConfig) limitsFor(device string) DeviceQueueLimits {
+	limits := DeviceQueueLimits{MaxInFlight: c.MaxInFlight, SpacingMs: c.SpacingMs}
+	if override, ok := c.Devices[device]; ok {
+		if override.MaxInFlight > 0 {
+			limits.MaxInFlight = override.MaxInFlight
+		}
+		if override.SpacingMs > 0 {
+			limits.SpacingMs = override.SpacingMs
+		}
+	}
+	return limits
+}
+
+// commandJob is a queued write; run performs it and reports the outcome
+type commandJob struct {
+	run func()
+}
+
+// deviceQueue serializes writes to one device with at most maxInFlight
+// concurrent writes and at least spacing between consecutive starts
+type deviceQueue struct {
+	jobs     chan commandJob
+	spacing  time.Duration
+	mu       sync.Mutex
+	nextSlot time.Time
+}
+
+type commandQueues struct {
+	mu       sync.Mutex
+	config   *CommandQueueConfig
+	queues   map[string]*deviceQueue
+	shutdown <-chan struct{}
+}
+
+func newCommandQueues(config *CommandQueueConfig, shutdown <-chan struct{}) *commandQueues {
+	return &commandQueues{
+		config:   config,
+		queues:   make(map[string]*deviceQueue),
+		shutdown: shutdown,
+	}
+}
+
+// submit enqueues a job for a device without blocking; it fails when the
+// device's queue is full
+func (cq *commandQueues) submit(device string, job commandJob) error {
+	q := cq.queueFor(device)
+	select {
+	case q.jobs <- job:
+		return nil
+	default:
+		return fmt.Errorf("command queue for device %s is full", device)
+	}
+}
+
+// queueFor returns the device's queue, starting its workers on first use
+func (cq *commandQueues) queueFor(device string) *deviceQueue {
+	cq.mu.Lock()
+	defer cq.mu.Unlock()
+	if q, ok := cq.queues[device]; ok {
+		return q
+	}
+
+	limits := cq.config.limitsFor(device)
+	q := &deviceQueue{
+		jobs:    make(chan commandJob, cq.config.QueueSize),
+		spacing: time.Duration(limits.SpacingMs) * time.Millisecond,
+	}
+	for i := 0; i < limits.MaxInFlight; i++ {
+		go q.work(cq.shutdown)
+	}
+	cq.queues[device] = q
+	log.Printf("Started command queue for device %s (max in-flight %d, spacing %v)", device, limits.MaxInFlight, q.spacing)
+	return q
+}
+
+func (q *deviceQueue) work(shutdown <-chan struct{}) {
+	for {
+		select {
+		case <-shutdown:
+			return
+		case job := <-q.jobs:
+			if wait := q.reserveSlot(); wait > 0 {
+				select {
+				case <-shutdown:
+					return
+				case <-time.After(wait):
+				}
+			}
+			job.run()
+		}
+	}
+}
+
+// reserveSlot claims the next start time for this device and returns how
+// long the caller must wait for it
+func (q *deviceQueue) reserveSlot() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	start := q.nextSlot
+	if start.Before(now) {
+		start = now
+	}
+	q.nextSlot = start.Add(q.spacing)
+	return start.Sub(now)
+}
+
+// commandDeviceKey identifies the physical device a sensor's writes go to
+func (gw *Gateway) commandDeviceKey(sensor *SensorConfig) string {
+	switch sensor.Protocol {
+	case "bacnet":
+		if sensor.DeviceInstance != nil {
+			return fmt.Sprintf("bacnet:%d", *sensor.DeviceInstance)
+		}
+		return normalizeBACnetAddress(sensor.Address)
+	case "modbus":
+		_, key := gw.modbus.endpoint(sensor.Address, sensor.UnitID)
+		return key
+	case "grpc":
+		return "grpc:" + sensor.Target
+	case "dali":
+		return fmt.Sprintf("dali:A%d", sensor.daliAddress)
+	default:
+		return sensor.Protocol + ":" + sensor.Address
+	}
+}
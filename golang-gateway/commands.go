@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// commandTopicFilter matches commands/<room_id>/<sensor_id>
+const commandTopicFilter = "commands/+/+"
+
+// CommandRequest is the payload accepted on commands/<room_id>/<sensor_id>.
+// For BACnet points Priority (1-16, default the sensor's write_priority)
+// selects the slot of the priority array written; Relinquish writes NULL to
+// that slot so the next lower priority or the Relinquish_Default takes
+// effect, and RelinquishDefault writes Value to Relinquish_Default instead
+// of the present value.
+type CommandRequest struct {
+	Value             float64 `json:"value"`
+	Priority          int     `json:"priority,omitempty"`
+	Relinquish        bool    `json:"relinquish,omitempty"`
+	RelinquishDefault bool    `json:"relinquish_default,omitempty"`
+	// ClientID optionally names the sender; rate limits apply per target
+	// point, not per ClientID
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// CommandResult is published on commands/<room_id>/<sensor_id>/result
+type CommandResult struct {
+	SensorID string  `json:"sensor_id"`
+	Value    float64 `json:"value"`
+	OK       bool    `json:"ok"`
+	Error    string  `json:"error,omitempty"`
+	// Priority is the BACnet priority written; after a relinquish
+	// EffectiveValue is the present value read back
+	Priority       int      `json:"priority,omitempty"`
+	Relinquished   bool     `json:"relinquished,omitempty"`
+	EffectiveValue *float64 `json:"effective_value,omitempty"`
+	// RetryAfterSec is set when the command was rejected by the rate limit
+	RetryAfterSec int    `json:"retry_after_sec,omitempty"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// rateLimitError rejects a command whose sender exceeded its rate limit
+type rateLimitError struct {
+	client string
+	wait   time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for %s, retry in %v", e.client, e.wait.Round(time.Millisecond))
+}
+
+// SetpointDriftEvent is published on events/<room_id>/<sensor_id>/drift when
+// the read-back value of a written point no longer matches what was commanded
+type SetpointDriftEvent struct {
+	SensorID  string  `json:"sensor_id"`
+	RoomID    string  `json:"room_id"`
+	Commanded float64 `json:"commanded"`
+	Actual    float64 `json:"actual"`
+	Drifted   bool    `json:"drifted"`
+	Timestamp string  `json:"timestamp"`
+}
+
+// commandedValue is the last value the gateway successfully wrote to a point
+type commandedValue struct {
+	value     float64
+	writtenAt time.Time
+	drifted   bool
+}
+
+type setpointTracker struct {
+	mu        sync.Mutex
+	commanded map[string]*commandedValue
+}
+
+func newSetpointTracker() *setpointTracker {
+	return &setpointTracker{commanded: make(map[string]*commandedValue)}
+}
+
+func (t *setpointTracker) record(sensorID string, value float64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.commanded[sensorID] = &commandedValue{value: value, writtenAt: now}
+}
+
+// forget stops drift checks of a relinquished point
+func (t *setpointTracker) forget(sensorID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.commanded, sensorID)
+}
+
+// check compares a read-back value against the commanded value and reports a
+// drift transition (into or out of mismatch). Reads within the grace period
+// after a write are ignored so slow controllers can apply the new value.
+func (t *setpointTracker) check(sensorID string, actual, tolerance float64, grace time.Duration, now time.Time) (commanded float64, drifted, changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.commanded[sensorID]
+	if !ok || now.Sub(c.writtenAt) < grace {
+		return 0, false, false
+	}
+	drifted = math.Abs(actual-c.value) > tolerance
+	changed = drifted != c.drifted
+	c.drifted = drifted
+	return c.value, drifted, changed
+}
+
+func (gw *Gateway) hasWritablePoints() bool {
+	for _, sensor := range gw.sensors {
+		if sensor.Writable {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribeCommands subscribes to the command topics. It is called from the
+// MQTT OnConnect handler so the subscription is restored after reconnects.
+func (gw *Gateway) subscribeCommands(client mqtt.Client) {
+	token := client.Subscribe(commandTopicFilter, 1, gw.handleCommand)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to subscribe to %s: %v", commandTopicFilter, token.Error())
+		return
+	}
+	log.Printf("Subscribed to command topic %s", commandTopicFilter)
+}
+
+// handleCommand runs on the paho router goroutine, so results are published
+// asynchronously rather than waiting on a publish token here
+func (gw *Gateway) handleCommand(client mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 3 {
+		return
+	}
+	roomID, sensorID := parts[1], parts[2]
+
+	var req CommandRequest
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		go gw.publishCommandResult(roomID, sensorID, req, CommandResult{}, fmt.Errorf("invalid command payload: %w", err))
+		return
+	}
+
+	point := roomID + "/" + sensorID
+	if ok, wait := gw.limits.commands.allow(point, time.Now()); !ok {
+		go gw.publishCommandResult(roomID, sensorID, req, CommandResult{}, &rateLimitError{client: point, wait: wait})
+		return
+	}
+
+	if err := gw.queueCommand(roomID, sensorID, req); err != nil {
+		go gw.publishCommandResult(roomID, sensorID, req, CommandResult{}, err)
+	}
+}
+
+// queueCommand validates a write to a writable point and queues it on the
+// device's command queue; the result is published once the write completes
+func (gw *Gateway) queueCommand(roomID, sensorID string, req CommandRequest) error {
+	sensor, ok := gw.sensors[sensorID]
+	if !ok {
+		return fmt.Errorf("unknown sensor %s", sensorID)
+	}
+	if !sensor.Writable {
+		return fmt.Errorf("sensor %s is not writable", sensorID)
+	}
+	if gw.sensorToRoom[sensorID] != roomID {
+		return fmt.Errorf("sensor %s does not belong to room %s", sensorID, roomID)
+	}
+	if sensor.Protocol != "bacnet" && (req.Priority != 0 || req.Relinquish || req.RelinquishDefault) {
+		return fmt.Errorf("priority and relinquish are only supported for BACnet points")
+	}
+	if req.Priority != 0 {
+		if err := validateWritePriority(req.Priority); err != nil {
+			return err
+		}
+	}
+	if req.Relinquish && req.RelinquishDefault {
+		return fmt.Errorf("relinquish and relinquish_default are exclusive")
+	}
+
+	return gw.commandQueues.submit(gw.commandDeviceKey(sensor), commandJob{
+		run: func() {
+			var result CommandResult
+			if sensor.Protocol == "bacnet" && !req.RelinquishDefault {
+				result.Priority = sensor.writePriority(req.Priority)
+			}
+			err := gw.writePoint(sensor, req)
+			switch {
+			case err != nil:
+			case req.Relinquish:
+				gw.setpoints.forget(sensorID)
+				result.Relinquished = true
+				ctx, cancel := gw.readContext(sensor)
+				value, text, readErr := gw.readBACnet(ctx, sensor)
+				cancel()
+				if readErr == nil {
+					value = sensor.calibrate(value, text)
+					if sensor.units != nil {
+						value = sensor.units.toCanonical(value)
+					}
+					result.EffectiveValue = &value
+				}
+				log.Printf("[COMMAND] Relinquished priority %d of %s", result.Priority, sensorID)
+			case req.RelinquishDefault:
+				log.Printf("[COMMAND] Wrote %.2f to the relinquish default of %s", req.Value, sensorID)
+			default:
+				gw.setpoints.record(sensorID, req.Value, time.Now())
+				log.Printf("[COMMAND] Wrote %.2f to %s", req.Value, sensorID)
+			}
+			gw.publishCommandResult(roomID, sensorID, req, result, err)
+		},
+	})
+}
+
+// writePoint writes a command to a point using the sensor's protocol
+func (gw *Gateway) writePoint(sensor *SensorConfig, req CommandRequest) error {
+	// Commands are given in the canonical unit of the point and written as
+	// the raw value
+	value := req.Value
+	if sensor.units != nil {
+		value = sensor.units.fromCanonical(value)
+	}
+	value, err := sensor.uncalibrate(value)
+	if err != nil {
+		return err
+	}
+	switch sensor.Protocol {
+	case "bacnet":
+		return gw.writeBACnet(sensor, req, value)
+	case "modbus":
+		return gw.writeModbus(sensor, value)
+	case "grpc":
+		return gw.drivers.write(sensor, value)
+	case "dali":
+		return gw.dali.write(sensor, value)
+	default:
+		return fmt.Errorf("writes not supported for protocol %s", sensor.Protocol)
+	}
+}
+
+// writeModbus writes holding registers with the same encoding as reads, or
+// a coil (any non-zero value switches it on)
+func (gw *Gateway) writeModbus(sensor *SensorConfig, value float64) error {
+	client, endpoint := gw.modbus.client(sensor.Address, sensor.UnitID)
+	var err error
+	start := time.Now()
+	if sensor.RegisterType == registerCoil {
+		var state uint16
+		if value != 0 {
+			state = 0xFF00
+		}
+		_, err = client.WriteSingleCoil(uint16(sensor.Register), state)
+	} else {
+		data, encodeErr := encodeModbusValue(sensor, value)
+		if encodeErr != nil {
+			return encodeErr
+		}
+		if len(data) == 2 {
+			_, err = client.WriteSingleRegister(uint16(sensor.Register), binary.BigEndian.Uint16(data))
+		} else {
+			_, err = client.WriteMultipleRegisters(uint16(sensor.Register), uint16(len(data)/2), data)
+		}
+	}
+	gw.latency.observe("modbus", endpoint, time.Since(start), err)
+	if err != nil {
+		return fmt.Errorf("Modbus write error: %w", err)
+	}
+	return nil
+}
+
+func (gw *Gateway) publishCommandResult(roomID, sensorID string, req CommandRequest, result CommandResult, cmdErr error) {
+	result.SensorID = sensorID
+	result.Value = req.Value
+	result.OK = cmdErr == nil
+	result.Timestamp = time.Now().Format(time.RFC3339)
+	if cmdErr != nil {
+		result.Error = cmdErr.Error()
+		var limited *rateLimitError
+		if errors.As(cmdErr, &limited) {
+			result.RetryAfterSec = int(math.Ceil(limited.wait.Seconds()))
+		} else {
+			log.Printf("[ERROR] Command for %s failed: %v", sensorID, cmdErr)
+		}
+	}
+	eventType := eventCommandExecuted
+	if cmdErr != nil {
+		eventType = eventCommandFailed
+	}
+	gw.events.append(GatewayEvent{Type: eventType, SensorID: sensorID, RoomID: roomID, Command: &result})
+
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal command result for %s: %v", sensorID, err)
+		return
+	}
+	topic := fmt.Sprintf("commands/%s/%s/result", roomID, sensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
+
+// checkSetpointDrift compares a polled value of a written point with the
+// commanded value and publishes an event when a local controller or manual
+// override has changed it (and again once it is back in line)
+func (gw *Gateway) checkSetpointDrift(sensorID, roomID string, config *SensorConfig, actual float64, now time.Time) {
+	tolerance := config.DriftTolerance
+	if tolerance <= 0 {
+		tolerance = 0.01
+	}
+	grace := 2 * time.Duration(config.PollIntervalMs) * time.Millisecond
+	commanded, drifted, changed := gw.setpoints.check(sensorID, actual, tolerance, grace, now)
+	if !changed {
+		return
+	}
+
+	event := SetpointDriftEvent{
+		SensorID:  sensorID,
+		RoomID:    roomID,
+		Commanded: commanded,
+		Actual:    actual,
+		Drifted:   drifted,
+		Timestamp: now.Format(time.RFC3339),
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal drift event for %s: %v", sensorID, err)
+		return
+	}
+	topic := fmt.Sprintf("events/%s/%s/drift", roomID, sensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[EVENT] Setpoint %s drifted=%v (commanded %.2f, actual %.2f)", sensorID, drifted, commanded, actual)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommissioningConfig configures the sensor commissioning checklist run by
+// POST /commissioning/run. Each sensor is read, its value checked against
+// plausibility limits (by sensor ID, else by type, in canonical units) and
+// optionally against a reference measurement taken on site. Reports are
+// written to ReportDir as JSON and HTML and signed with HMAC-SHA256 using
+// SigningKey (${VAR} expanded).
+type CommissioningConfig struct {
+	ReportDir  string                       `yaml:"report_dir,omitempty"`
+	SigningKey string                       `yaml:"signing_key,omitempty"`
+	Limits     map[string]PlausibilityLimit `yaml:"limits,omitempty"`
+}
+
+// PlausibilityLimit is an inclusive range of plausible values
+type PlausibilityLimit struct {
+	Min *float64 `yaml:"min,omitempty" json:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty" json:"max,omitempty"`
+}
+
+// defaultPlausibilityLimits apply to sensor types without configured limits
+var defaultPlausibilityLimits = map[string]PlausibilityLimit{
+	"temperature":    {Min: floatPtr(-10), Max: floatPtr(50)},
+	"humidity":       {Min: floatPtr(0), Max: floatPtr(100)},
+	"co2":            {Min: floatPtr(300), Max: floatPtr(5000)},
+	"light":          {Min: floatPtr(0), Max: floatPtr(100000)},
+	"energy":         {Min: floatPtr(0)},
+	"pm25":           {Min: floatPtr(0), Max: floatPtr(1000)},
+	"pm10":           {Min: floatPtr(0), Max: floatPtr(1000)},
+	"noise_db":       {Min: floatPtr(20), Max: floatPtr(130)},
+	"power":          {Min: floatPtr(0)},
+	"water_volume":   {Min: floatPtr(0)},
+	"ups_load":       {Min: floatPtr(0), Max: floatPtr(150)},
+	"dimmer_level":   {Min: floatPtr(0), Max: floatPtr(100)},
+	"blind_position": {Min: floatPtr(0), Max: floatPtr(100)},
+	"battery":        {Min: floatPtr(0), Max: floatPtr(100)},
+}
+
+// contains reports whether a value lies within the limits
+func (l PlausibilityLimit) contains(v float64) bool {
+	return (l.Min == nil || v >= *l.Min) && (l.Max == nil || v <= *l.Max)
+}
+
+// plausibilityLimits returns the limits of a sensor, by sensor ID, else by
+// type, else the type's defaults
+func (gw *Gateway) plausibilityLimits(sensorID string, config *SensorConfig) (PlausibilityLimit, bool) {
+	limits, ok := gw.settings.Commissioning.Limits[sensorID]
+	if !ok {
+		limits, ok = gw.settings.Commissioning.Limits[config.Type]
+	}
+	if !ok {
+		limits, ok = defaultPlausibilityLimits[config.Type]
+	}
+	return limits, ok
+}
+
+func (c *CommissioningConfig) normalize() {
+	if c.ReportDir == "" {
+		c.ReportDir = "/app/data/commissioning"
+	}
+}
+
+// ReferenceMeasurement is a value read on site with a calibrated instrument
+type ReferenceMeasurement struct {
+	Value     float64 `json:"value"`
+	Tolerance float64 `json:"tolerance"`
+}
+
+// CommissioningItem is the checklist result of one sensor
+type CommissioningItem struct {
+	SensorID  string             `json:"sensor_id"`
+	RoomID    string             `json:"room_id,omitempty"`
+	Type      string             `json:"type"`
+	Protocol  string             `json:"protocol"`
+	Address   string             `json:"address,omitempty"`
+	Status    string             `json:"status"` // "pass", "fail" or "skipped"
+	Responded bool               `json:"responded"`
+	Value     *float64           `json:"value,omitempty"`
+	Unit      string             `json:"unit,omitempty"`
+	LatencyMs float64            `json:"latency_ms"`
+	Limits    *PlausibilityLimit `json:"limits,omitempty"`
+	Plausible *bool              `json:"plausible,omitempty"`
+	// Reference and ReferenceOK are set when a reference was supplied
+	Reference   *ReferenceMeasurement `json:"reference,omitempty"`
+	ReferenceOK *bool                 `json:"reference_ok,omitempty"`
+	Notes       []string              `json:"notes,omitempty"`
+}
+
+// CommissioningReport is the signed result of a commissioning run
+type CommissioningReport struct {
+	ID          string              `json:"id"`
+	GatewayID   string              `json:"gateway_id"`
+	Technician  string              `json:"technician,omitempty"`
+	GeneratedAt string              `json:"generated_at"`
+	Passed      int                 `json:"passed"`
+	Failed      int                 `json:"failed"`
+	Skipped     int                 `json:"skipped"`
+	Items       []CommissioningItem `json:"items"`
+	// Signature is the hex HMAC-SHA256 of the report marshalled without it
+	Signature string `json:"signature,omitempty"`
+}
+
+// sign computes the report signature
+func (r *CommissioningReport) sign(key string) (string, error) {
+	unsigned := *r
+	unsigned.Signature = ""
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkSensor runs the checklist for one sensor
+func (gw *Gateway) checkSensor(sensorID string, reference *ReferenceMeasurement) CommissioningItem {
+	config := gw.sensors[sensorID]
+	item := CommissioningItem{
+		SensorID:  sensorID,
+		RoomID:    gw.sensorToRoom[sensorID],
+		Type:      config.Type,
+		Protocol:  config.Protocol,
+		Address:   config.Address,
+		Reference: reference,
+	}
+	if item.RoomID == "" {
+		item.Notes = append(item.Notes, "sensor is not assigned to a room")
+	}
+	if gw.control.isPaused(sensorID) {
+		item.Status = "skipped"
+		item.Notes = append(item.Notes, "sensor is paused")
+		return item
+	}
+
+	start := time.Now()
+	reading, err := gw.readSensor(sensorID, config)
+	item.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	if errors.Is(err, errUnknownProtocol) {
+		item.Status = "skipped"
+		item.Notes = append(item.Notes, "unknown protocol "+config.Protocol)
+		return item
+	}
+	if err != nil {
+		item.Status = "fail"
+		item.Notes = append(item.Notes, "no response: "+err.Error())
+		return item
+	}
+	item.Responded = true
+	item.Value = floatPtr(reading.Value)
+	item.Unit = reading.Unit
+	item.Status = "pass"
+	if reading.Status != "ok" {
+		item.Status = "fail"
+		item.Notes = append(item.Notes, "reading status "+reading.Status)
+	}
+
+	if limits, ok := gw.plausibilityLimits(sensorID, config); ok {
+		item.Limits = &limits
+		plausible := limits.contains(reading.Value)
+		item.Plausible = &plausible
+		if !plausible {
+			item.Status = "fail"
+			item.Notes = append(item.Notes, fmt.Sprintf("value %g %s outside plausibility limits", reading.Value, reading.Unit))
+		}
+	}
+
+	if reference != nil {
+		matches := math.Abs(reading.Value-reference.Value) <= reference.Tolerance
+		item.ReferenceOK = &matches
+		if !matches {
+			item.Status = "fail"
+			item.Notes = append(item.Notes, fmt.Sprintf("value %g differs from reference %g by more than %g", reading.Value, reference.Value, reference.Tolerance))
+		}
+	}
+	return item
+}
+
+// handleCommissioning routes /commissioning/run, /commissioning/verify and
+// /commissioning/reports/<file>
+func (gw *Gateway) handleCommissioning(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/commissioning/"), "/")
+	switch {
+	case path == "run" && r.Method == http.MethodPost:
+		gw.handleCommissioningRun(w, r)
+	case path == "verify" && r.Method == http.MethodPost:
+		gw.handleCommissioningVerify(w, r)
+	case strings.HasPrefix(path, "reports/") && r.Method == http.MethodGet:
+		name := strings.TrimPrefix(path, "reports/")
+		if name == "" || name != filepath.Base(name) || !strings.HasPrefix(name, "commissioning-") {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(gw.settings.Commissioning.ReportDir, name))
+	case path == "run" || path == "verify":
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleCommissioningRun serves POST /commissioning/run with an optional
+// body {"sensors": [...], "technician": "...", "references": {"<sensor_id>":
+// {"value": v, "tolerance": t}}}; without sensors every sensor is checked
+func (gw *Gateway) handleCommissioningRun(w http.ResponseWriter, r *http.Request) {
+	key := os.ExpandEnv(gw.settings.Commissioning.SigningKey)
+	if key == "" {
+		writeJSONError(w, http.StatusConflict, "commissioning.signing_key is not configured")
+		return
+	}
+	var body struct {
+		Sensors    []string                        `json:"sensors"`
+		Technician string                          `json:"technician"`
+		References map[string]ReferenceMeasurement `json:"references"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+	}
+	sensors := body.Sensors
+	if len(sensors) == 0 {
+		for id := range gw.sensors {
+			if gw.roomAllowed(r, gw.sensorToRoom[id]) {
+				sensors = append(sensors, id)
+			}
+		}
+	}
+	sort.Strings(sensors)
+	for _, id := range sensors {
+		if _, ok := gw.sensors[id]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "unknown sensor "+id)
+			return
+		}
+		if !gw.roomAllowed(r, gw.sensorToRoom[id]) {
+			writeJSONError(w, http.StatusForbidden, "sensor "+id+" belongs to another tenant")
+			return
+		}
+	}
+	for id := range body.References {
+		if _, ok := gw.sensors[id]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "reference for unknown sensor "+id)
+			return
+		}
+	}
+
+	now := time.Now()
+	report := &CommissioningReport{
+		ID:          "commissioning-" + now.UTC().Format("20060102T150405Z"),
+		GatewayID:   gw.settings.GatewayID,
+		Technician:  body.Technician,
+		GeneratedAt: now.Format(time.RFC3339),
+	}
+	if report.Technician == "" {
+		report.Technician = apiClient(r)
+	}
+	for _, id := range sensors {
+		var reference *ReferenceMeasurement
+		if ref, ok := body.References[id]; ok {
+			reference = &ref
+		}
+		item := gw.checkSensor(id, reference)
+		switch item.Status {
+		case "pass":
+			report.Passed++
+		case "fail":
+			report.Failed++
+		default:
+			report.Skipped++
+		}
+		report.Items = append(report.Items, item)
+	}
+	signature, err := report.sign(key)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to sign report: "+err.Error())
+		return
+	}
+	report.Signature = signature
+
+	if err := gw.writeCommissioningReport(report); err != nil {
+		log.Printf("[ERROR] %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("[EVENT] Commissioning report %s: %d passed, %d failed, %d skipped", report.ID, report.Passed, report.Failed, report.Skipped)
+	writeJSON(w, http.StatusOK, report)
+}
+
+// handleCommissioningVerify serves POST /commissioning/verify, checking the
+// signature of a report JSON
+func (gw *Gateway) handleCommissioningVerify(w http.ResponseWriter, r *http.Request) {
+	var report CommissioningReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid report: "+err.Error())
+		return
+	}
+	key := os.ExpandEnv(gw.settings.Commissioning.SigningKey)
+	if key == "" {
+		writeJSONError(w, http.StatusConflict, "commissioning.signing_key is not configured")
+		return
+	}
+	expected, err := report.sign(key)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid report: "+err.Error())
+		return
+	}
+	valid := hmac.Equal([]byte(expected), []byte(report.Signature))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": report.ID, "valid": valid})
+}
+
+// writeCommissioningReport stores the report as <id>.json and <id>.html
+func (gw *Gateway) writeCommissioningReport(report *CommissioningReport) error {
+	dir := gw.settings.Commissioning.ReportDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create commissioning report directory: %w", err)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal commissioning report: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, report.ID+".json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write commissioning report: %w", err)
+	}
+	var page bytes.Buffer
+	if err := commissioningTemplate.Execute(&page, report); err != nil {
+		return fmt.Errorf("failed to render commissioning report: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, report.ID+".html"), page.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write commissioning report: %w", err)
+	}
+	return nil
+}
+
+var commissioningTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"deref": func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return fmt.Sprintf("%g", *f)
+	},
+}).Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.ID}}</title>
+<style>
+body{font-family:sans-serif;margin:2em}table{border-collapse:collapse}
+td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}
+.pass{background:#e6f4ea}.fail{background:#fce8e6}.skipped{background:#f1f3f4}
+</style></head><body>
+<h1>Commissioning report {{.ID}}</h1>
+<p>Gateway {{.GatewayID}}, {{.GeneratedAt}}{{if .Technician}}, by {{.Technician}}{{end}}</p>
+<p>{{.Passed}} passed, {{.Failed}} failed, {{.Skipped}} skipped</p>
+<table><tr><th>Sensor</th><th>Room</th><th>Type</th><th>Protocol</th><th>Address</th><th>Status</th><th>Value</th><th>Limits</th><th>Reference</th><th>Latency (ms)</th><th>Notes</th></tr>
+{{range .Items}}<tr class="{{.Status}}"><td>{{.SensorID}}</td><td>{{.RoomID}}</td><td>{{.Type}}</td><td>{{.Protocol}}</td><td>{{.Address}}</td><td>{{.Status}}</td><td>{{deref .Value}} {{.Unit}}</td><td>{{with .Limits}}{{deref .Min}} to {{deref .Max}}{{end}}</td><td>{{with .Reference}}{{.Value}} ± {{.Tolerance}}{{end}}</td><td>{{printf "%.1f" .LatencyMs}}</td><td>{{range .Notes}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>
+<p>Signature (HMAC-SHA256): <code>{{.Signature}}</code></p>
+</body></html>
+`))
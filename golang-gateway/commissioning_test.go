@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testCommissioningReport() *CommissioningReport {
+	value := 21.5
+	plausible := true
+	return &CommissioningReport{
+		ID:          "commissioning-20240301T120000Z",
+		GatewayID:   "gw-1",
+		Technician:  "tech",
+		GeneratedAt: "2024-03-01T12:00:00Z",
+		Passed:      1,
+		Items: []CommissioningItem{{
+			SensorID:  "t-101",
+			RoomID:    "101",
+			Type:      "temperature",
+			Protocol:  "modbus",
+			Status:    "pass",
+			Responded: true,
+			Value:     &value,
+			Unit:      "celsius",
+			LatencyMs: 12.5,
+			Limits:    &PlausibilityLimit{Min: floatPtr(-10), Max: floatPtr(50)},
+			Plausible: &plausible,
+		}},
+	}
+}
+
+func TestCommissioningReportSign(t *testing.T) {
+	report := testCommissioningReport()
+	signature, err := report.sign("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signature) != 64 {
+		t.Fatalf("signature %q is not a hex SHA-256 HMAC", signature)
+	}
+
+	// The signature field itself is not signed
+	report.Signature = signature
+	if again, _ := report.sign("key"); again != signature {
+		t.Fatal("signature depends on the signature field")
+	}
+	if other, _ := report.sign("other"); other == signature {
+		t.Fatal("signature does not depend on the key")
+	}
+	report.Items[0].Status = "fail"
+	if tampered, _ := report.sign("key"); tampered == signature {
+		t.Fatal("signature does not cover the items")
+	}
+}
+
+func TestCommissioningVerify(t *testing.T) {
+	t.Setenv("COMMISSIONING_TEST_KEY", "s3cret")
+	report := testCommissioningReport()
+	signature, err := report.sign("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report.Signature = signature
+	// Reports are verified as stored on disk
+	signed, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(signed), `"passed": 1`, `"passed": 2`, 1)
+	unsigned := strings.Replace(string(signed), signature, "", 1)
+
+	tests := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+		valid  bool
+	}{
+		{"valid", "s3cret", string(signed), http.StatusOK, true},
+		{"env key", "${COMMISSIONING_TEST_KEY}", string(signed), http.StatusOK, true},
+		{"wrong key", "other", string(signed), http.StatusOK, false},
+		{"tampered", "s3cret", tampered, http.StatusOK, false},
+		{"unsigned", "s3cret", unsigned, http.StatusOK, false},
+		{"no key", "", string(signed), http.StatusConflict, false},
+		{"unset env key", "${COMMISSIONING_UNSET_KEY}", string(signed), http.StatusConflict, false},
+		{"invalid json", "s3cret", "{", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := &Gateway{}
+			gw.settings.Commissioning.SigningKey = tt.key
+			w := httptest.NewRecorder()
+			gw.handleCommissioningVerify(w, httptest.NewRequest(http.MethodPost, "/commissioning/verify", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var result struct {
+				ID    string `json:"id"`
+				Valid bool   `json:"valid"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != tt.valid || result.ID != report.ID {
+				t.Fatalf("got %+v, want valid=%v", result, tt.valid)
+			}
+		})
+	}
+}
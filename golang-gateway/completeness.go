@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CompletenessConfig configures data-completeness tracking. Successful
+// samples are counted per sensor and hour against the number expected from
+// the sensor's poll interval; a gap is a stretch without a successful sample
+// longer than GapFactor poll intervals. A report per local day is published
+// on status/gateway/<id>/completeness after midnight, and the current day is
+// served by GET /completeness. Sensors in maintenance when a report is built
+// are marked and left out of its overall completeness.
+type CompletenessConfig struct {
+	Enabled   bool    `yaml:"enabled"`
+	GapFactor float64 `yaml:"gap_factor"`
+}
+
+func (c *CompletenessConfig) normalize() {
+	if c.GapFactor <= 1 {
+		c.GapFactor = 3
+	}
+}
+
+// DataGap is a period without successful samples
+type DataGap struct {
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	DurationSec float64 `json:"duration_sec"`
+}
+
+// SensorCompleteness is the completeness of one sensor over a day
+type SensorCompleteness struct {
+	SensorID        string     `json:"sensor_id"`
+	Expected        int        `json:"expected"`
+	Received        int        `json:"received"`
+	CompletenessPct float64    `json:"completeness_pct"`
+	HourlyPct       []*float64 `json:"hourly_pct"`
+	Gaps            []DataGap  `json:"gaps"`
+	Maintenance     bool       `json:"maintenance,omitempty"`
+}
+
+// CompletenessReport covers one local day, or the part of it the gateway
+// was running
+type CompletenessReport struct {
+	GatewayID       string               `json:"gateway_id"`
+	Date            string               `json:"date"`
+	From            string               `json:"from"`
+	To              string               `json:"to"`
+	CompletenessPct float64              `json:"completeness_pct"`
+	Sensors         []SensorCompleteness `json:"sensors"`
+}
+
+type sensorSamples struct {
+	interval time.Duration
+	hours    [24]int
+	lastOK   time.Time
+	gaps     []DataGap
+}
+
+// completenessTracker counts samples of the current day
+type completenessTracker struct {
+	config  *CompletenessConfig
+	mu      sync.Mutex
+	day     time.Time // local midnight
+	from    time.Time // start of tracking within the day
+	sensors map[string]*sensorSamples
+	// finished holds reports of closed days until they are published
+	finished  []*CompletenessReport
+	gatewayID string
+	// inMaintenance excludes sensors under planned work from the totals
+	inMaintenance func(sensorID string) bool
+}
+
+func newCompletenessTracker(config *CompletenessConfig, gatewayID string, intervals map[string]time.Duration, now time.Time) *completenessTracker {
+	t := &completenessTracker{config: config, gatewayID: gatewayID, sensors: make(map[string]*sensorSamples, len(intervals))}
+	for id, interval := range intervals {
+		t.sensors[id] = &sensorSamples{interval: interval}
+	}
+	t.resetLocked(now)
+	return t
+}
+
+func localMidnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func (t *completenessTracker) resetLocked(now time.Time) {
+	t.day = localMidnight(now)
+	t.from = now
+	for _, s := range t.sensors {
+		s.hours = [24]int{}
+		s.gaps = nil
+		// Gaps are measured from the start of tracking
+		s.lastOK = now
+	}
+}
+
+// observe counts a successful sample
+func (t *completenessTracker) observe(sensorID string, at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.sensors[sensorID]
+	if !ok || at.Before(t.day) {
+		return
+	}
+	if !at.Before(t.day.AddDate(0, 0, 1)) {
+		t.closeDayLocked(at)
+	}
+	s.hours[at.Hour()]++
+	t.closeGapLocked(s, at)
+	s.lastOK = at
+}
+
+// closeGapLocked records a gap ending at end if it is long enough
+func (t *completenessTracker) closeGapLocked(s *sensorSamples, end time.Time) {
+	gap := end.Sub(s.lastOK)
+	if gap > time.Duration(t.config.GapFactor*float64(s.interval)) {
+		s.gaps = append(s.gaps, DataGap{
+			Start:       s.lastOK.Format(time.RFC3339),
+			End:         end.Format(time.RFC3339),
+			DurationSec: gap.Seconds(),
+		})
+	}
+}
+
+// report builds the report of the tracked day up to now
+func (t *completenessTracker) report(now time.Time) *CompletenessReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reportLocked(now)
+}
+
+func (t *completenessTracker) reportLocked(to time.Time) *CompletenessReport {
+	report := &CompletenessReport{
+		GatewayID: t.gatewayID,
+		Date:      t.day.Format("2006-01-02"),
+		From:      t.from.Format(time.RFC3339),
+		To:        to.Format(time.RFC3339),
+		Sensors:   make([]SensorCompleteness, 0, len(t.sensors)),
+	}
+	ids := make([]string, 0, len(t.sensors))
+	for id := range t.sensors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	totalExpected, totalReceived := 0, 0
+	for _, id := range ids {
+		s := t.sensors[id]
+		sc := SensorCompleteness{SensorID: id, HourlyPct: make([]*float64, 24), Gaps: append([]DataGap{}, s.gaps...)}
+		for h := 0; h < 24; h++ {
+			// Expected samples cover the tracked part of the hour
+			start := t.day.Add(time.Duration(h) * time.Hour)
+			end := start.Add(time.Hour)
+			if start.Before(t.from) {
+				start = t.from
+			}
+			if end.After(to) {
+				end = to
+			}
+			if !end.After(start) {
+				continue
+			}
+			expected := int(end.Sub(start) / s.interval)
+			received := s.hours[h]
+			if received > expected {
+				received = expected
+			}
+			sc.Expected += expected
+			sc.Received += received
+			if expected > 0 {
+				sc.HourlyPct[h] = floatPtr(float64(received) / float64(expected) * 100)
+			}
+		}
+		// A gap still open at the end of the period
+		if gap := to.Sub(s.lastOK); gap > time.Duration(t.config.GapFactor*float64(s.interval)) {
+			sc.Gaps = append(sc.Gaps, DataGap{Start: s.lastOK.Format(time.RFC3339), End: to.Format(time.RFC3339), DurationSec: gap.Seconds()})
+		}
+		if sc.Expected > 0 {
+			sc.CompletenessPct = float64(sc.Received) / float64(sc.Expected) * 100
+		}
+		if t.inMaintenance != nil && t.inMaintenance(id) {
+			sc.Maintenance = true
+		} else {
+			totalExpected += sc.Expected
+			totalReceived += sc.Received
+		}
+		report.Sensors = append(report.Sensors, sc)
+	}
+	if totalExpected > 0 {
+		report.CompletenessPct = float64(totalReceived) / float64(totalExpected) * 100
+	}
+	return report
+}
+
+// closeDayLocked finishes the tracked day and starts the day of now
+func (t *completenessTracker) closeDayLocked(now time.Time) {
+	end := t.day.AddDate(0, 0, 1)
+	t.finished = append(t.finished, t.reportLocked(end))
+	t.resetLocked(now)
+	// The next day is tracked from midnight unless whole days were missed
+	if t.day.Equal(end) {
+		t.from = end
+		for _, s := range t.sensors {
+			s.lastOK = end
+		}
+	}
+}
+
+// rollover closes the tracked day when now is past it and returns the
+// reports of finished days
+func (t *completenessTracker) rollover(now time.Time) []*CompletenessReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !now.Before(t.day.AddDate(0, 0, 1)) {
+		t.closeDayLocked(now)
+	}
+	reports := t.finished
+	t.finished = nil
+	return reports
+}
+
+// sensorIntervals returns the effective poll interval of every sensor
+func (gw *Gateway) sensorIntervals() map[string]time.Duration {
+	intervals := make(map[string]time.Duration, len(gw.sensors))
+	for id, sensor := range gw.sensors {
+		if sensor.PollIntervalMs > 0 {
+			intervals[id] = time.Duration(sensor.PollIntervalMs) * time.Millisecond
+		}
+	}
+	for _, group := range gw.settings.PollGroups {
+		for _, id := range group.Sensors {
+			if group.cron != nil {
+				// Scheduled reads have no fixed interval
+				delete(intervals, id)
+				continue
+			}
+			intervals[id] = time.Duration(group.IntervalMs) * time.Millisecond
+		}
+	}
+	return intervals
+}
+
+// publishCompleteness publishes the report of each finished day
+func (gw *Gateway) publishCompleteness() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	topic := gw.statusTopic() + "/completeness"
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			for _, report := range gw.completeness.rollover(now) {
+				gw.publishCompletenessReport(topic, report)
+			}
+		}
+	}
+}
+
+func (gw *Gateway) publishCompletenessReport(topic string, report *CompletenessReport) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal completeness report: %v", err)
+		return
+	}
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[STATS] Data completeness for %s: %.2f%%", report.Date, report.CompletenessPct)
+}
+
+// handleCompleteness serves GET /completeness, the report of the current day
+// so far
+func (gw *Gateway) handleCompleteness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if gw.completeness == nil {
+		writeJSONError(w, http.StatusNotFound, "completeness tracking is disabled")
+		return
+	}
+	report := gw.completeness.report(time.Now())
+	sensors := report.Sensors[:0]
+	for _, sc := range report.Sensors {
+		if gw.roomAllowed(r, gw.sensorToRoom[sc.SensorID]) {
+			sensors = append(sensors, sc)
+		}
+	}
+	report.Sensors = sensors
+	writeJSON(w, http.StatusOK, report)
+}
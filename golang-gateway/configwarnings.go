@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConfigWarningsConfig checks readings against the plausibility limits of
+// their sensor (see CommissioningConfig) to catch mapping mistakes. After
+// min_samples consecutive implausible readings the gateway infers what is
+// wrong and publishes a configuration-warning event on
+// events/<room_id>/<sensor_id>/config_warning with the first issue that
+// applies:
+//
+//	wrong_unit     the value fits in another unit of the same quantity,
+//	               e.g. a temperature of 72 Cel is 72 °F
+//	missing_scale  the value fits after scaling by a power of ten, e.g. a
+//	               temperature of 2150 is a raw register in 0.01 °C
+//	wrong_type     the value fits the limits of other sensor types
+//	out_of_range   none of the above
+//
+// The other sensor types whose limits fit the value are inferred for every
+// warning. A sensor is warned about once until it reads plausibly again.
+type ConfigWarningsConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	MinSamples int  `yaml:"min_samples"`
+}
+
+func (c *ConfigWarningsConfig) normalize() {
+	if c.MinSamples <= 0 {
+		c.MinSamples = 3
+	}
+}
+
+// Issues of a configuration warning
+const (
+	configIssueMissingScale = "missing_scale"
+	configIssueWrongUnit    = "wrong_unit"
+	configIssueWrongType    = "wrong_type"
+	configIssueOutOfRange   = "out_of_range"
+)
+
+// ConfigWarningEvent is published when a sensor's readings do not fit its
+// configured type and unit
+type ConfigWarningEvent struct {
+	SensorID string            `json:"sensor_id"`
+	RoomID   string            `json:"room_id"`
+	Issue    string            `json:"issue"`
+	Type     string            `json:"type"`
+	Unit     string            `json:"unit,omitempty"` // the configured unit
+	Value    float64           `json:"value"`          // in the type's canonical unit
+	Limits   PlausibilityLimit `json:"limits"`
+	// SuggestedScale is the sensor scale that makes the value plausible
+	SuggestedScale *float64 `json:"suggested_scale,omitempty"`
+	// SuggestedUnit is a unit in which the value is plausible
+	SuggestedUnit string `json:"suggested_unit,omitempty"`
+	// InferredTypes are the sensor types whose limits fit the value,
+	// narrowest first
+	InferredTypes []string `json:"inferred_types,omitempty"`
+	Message       string   `json:"message"`
+	Timestamp     string   `json:"timestamp"`
+}
+
+// configWarnings tracks the implausible readings of each sensor
+type configWarnings struct {
+	minSamples  int
+	mu          sync.Mutex
+	implausible map[string]int // sensor → consecutive implausible readings
+	warned      map[string]bool
+}
+
+func newConfigWarnings(config *ConfigWarningsConfig) *configWarnings {
+	return &configWarnings{minSamples: config.MinSamples, implausible: make(map[string]int), warned: make(map[string]bool)}
+}
+
+// observe counts a reading and reports whether the sensor is due a warning
+func (w *configWarnings) observe(sensorID string, plausible bool) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if plausible {
+		delete(w.implausible, sensorID)
+		delete(w.warned, sensorID)
+		return false
+	}
+	w.implausible[sensorID]++
+	if w.warned[sensorID] || w.implausible[sensorID] < w.minSamples {
+		return false
+	}
+	w.warned[sensorID] = true
+	return true
+}
+
+// checkReading checks an ok numeric reading against its sensor's limits and
+// publishes a configuration warning when it is due
+func (gw *Gateway) checkReading(sensorID string, config *SensorConfig, reading *SensorReading) {
+	if gw.configWarnings == nil || reading.Status != "ok" || reading.StringValue != "" || len(config.EnumMap) > 0 {
+		return
+	}
+	limits, ok := gw.plausibilityLimits(sensorID, config)
+	if !ok || !gw.configWarnings.observe(sensorID, limits.contains(reading.Value)) {
+		return
+	}
+	event := inferMisconfiguration(config, reading.Value, limits)
+	event.SensorID = sensorID
+	event.RoomID = reading.RoomID
+	event.Timestamp = reading.Timestamp.Format(time.RFC3339)
+	gw.publishConfigWarning(event)
+}
+
+// inferMisconfiguration explains an implausible value of a sensor
+func inferMisconfiguration(config *SensorConfig, value float64, limits PlausibilityLimit) *ConfigWarningEvent {
+	event := &ConfigWarningEvent{Type: config.Type, Unit: config.Unit, Value: value, Limits: limits}
+	// The value in the configured unit, which scaling and unit mistakes are
+	// made in
+	raw, units := value, config.units
+	if units != nil {
+		raw = units.fromCanonical(value)
+	}
+	toCanonical := func(v float64) float64 {
+		if units == nil {
+			return v
+		}
+		return units.toCanonical(v)
+	}
+
+	if units != nil {
+		codes := make([]string, 0, len(unitRegistry))
+		for code, unit := range unitRegistry {
+			if unit.dimension == units.to.dimension && code != units.from.code {
+				codes = append(codes, code)
+			}
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			conversion := unitConversion{from: unitRegistry[code], to: units.to}
+			if v := conversion.toCanonical(raw); limits.contains(v) {
+				event.SuggestedUnit = code
+				event.Issue = configIssueWrongUnit
+				event.Message = fmt.Sprintf("%s value %g %s is implausible but plausible in %s", config.Type, raw, units.from.code, code)
+				break
+			}
+		}
+	}
+
+	// Registers missing their scaling are off by powers of ten, most often
+	// too large
+	for _, exp := range []int{-1, -2, -3, -4, 1, 2, 3, 4} {
+		factor := math.Pow10(exp)
+		if v := toCanonical(raw * factor); limits.contains(v) {
+			scale := config.Scale * factor
+			event.SuggestedScale = &scale
+			if event.Issue == "" {
+				event.Issue = configIssueMissingScale
+				event.Message = fmt.Sprintf("%s value %s is implausible; scale %g would give %s", config.Type, withUnit(value, units), scale, withUnit(v, units))
+			}
+			break
+		}
+	}
+
+	event.InferredTypes = inferSensorTypes(config, value)
+	if event.Issue == "" {
+		if len(event.InferredTypes) > 0 {
+			event.Issue = configIssueWrongType
+			event.Message = fmt.Sprintf("%s value %s is implausible but would fit a %s sensor", config.Type, withUnit(value, units), event.InferredTypes[0])
+		} else {
+			event.Issue = configIssueOutOfRange
+			event.Message = fmt.Sprintf("%s value %s is outside plausibility limits", config.Type, withUnit(value, units))
+		}
+	}
+	return event
+}
+
+// inferSensorTypes returns the other sensor types measuring the same
+// quantity whose bounded default limits contain a value, narrowest first
+func inferSensorTypes(config *SensorConfig, value float64) []string {
+	var dimension string
+	if config.Unit != "" && config.units != nil {
+		dimension = config.units.to.dimension
+	}
+	var types []string
+	for sensorType, limits := range defaultPlausibilityLimits {
+		if sensorType == config.Type || limits.Min == nil || limits.Max == nil || !limits.contains(value) {
+			continue
+		}
+		if dimension != "" {
+			if unit, ok := lookupUnit(canonicalUnits[sensorType]); !ok || unit.dimension != dimension {
+				continue
+			}
+		}
+		types = append(types, sensorType)
+	}
+	width := func(t string) float64 {
+		l := defaultPlausibilityLimits[t]
+		return *l.Max - *l.Min
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if wi, wj := width(types[i]), width(types[j]); wi != wj {
+			return wi < wj
+		}
+		return types[i] < types[j]
+	})
+	if len(types) > 3 {
+		types = types[:3]
+	}
+	return types
+}
+
+// withUnit formats a canonical value with its unit
+func withUnit(v float64, units *unitConversion) string {
+	if units == nil {
+		return fmt.Sprintf("%g", v)
+	}
+	return fmt.Sprintf("%g %s", v, units.to.code)
+}
+
+// publishConfigWarning publishes a configuration-warning event
+func (gw *Gateway) publishConfigWarning(event *ConfigWarningEvent) {
+	log.Printf("[WARN] Sensor %s may be misconfigured (%s): %s", event.SensorID, event.Issue, event.Message)
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal config warning for %s: %v", event.SensorID, err)
+		return
+	}
+	topic := fmt.Sprintf("events/%s/%s/config_warning", event.RoomID, event.SensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConstrainedLinkConfig is the operating profile for remote buildings on
+// LTE-M or other metered backhaul. All rooms are sent in one batch message per
+// publish interval, optionally gzip-compressed, and publishing slows down while
+// the modem reports poor signal. Batches can also be sent as MQTT-SN through
+// a UDP gateway instead of the MQTT connection.
+type ConstrainedLinkConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BatchTopic receives the batches. The MQTT 3.1.1 client cannot set the
+	// MQTT 5 content-encoding property, so gzip batches go to BatchTopic/gz.
+	BatchTopic string `yaml:"batch_topic"`
+	Compress   bool   `yaml:"compress"`
+	// SignalFile holds the modem's signal strength in dBm (RSRP or RSSI),
+	// written by the modem manager; readings at or below PoorSignalDBm
+	// stretch the publish interval by PoorSignalFactor
+	SignalFile       string       `yaml:"signal_file"`
+	PoorSignalDBm    float64      `yaml:"poor_signal_dbm"`
+	PoorSignalFactor int          `yaml:"poor_signal_factor"`
+	MQTTSN           MQTTSNConfig `yaml:"mqttsn"`
+}
+
+// MQTTSNConfig sends batches as QoS -1 MQTT-SN publishes, which need no
+// connection setup, using a topic ID predefined on the MQTT-SN gateway
+type MQTTSNConfig struct {
+	Address string `yaml:"address"` // host:port of the MQTT-SN gateway; empty disables
+	TopicID uint16 `yaml:"topic_id"`
+	// GzipTopicID is used for compressed batches (default TopicID+1)
+	GzipTopicID uint16 `yaml:"gzip_topic_id"`
+}
+
+func (c *ConstrainedLinkConfig) normalize() {
+	if c.BatchTopic == "" {
+		c.BatchTopic = "telemetry/batch"
+	}
+	if c.PoorSignalDBm == 0 {
+		c.PoorSignalDBm = -110
+	}
+	if c.PoorSignalFactor <= 0 {
+		c.PoorSignalFactor = 4
+	}
+	if c.MQTTSN.TopicID == 0 {
+		c.MQTTSN.TopicID = 1
+	}
+	if c.MQTTSN.GzipTopicID == 0 {
+		c.MQTTSN.GzipTopicID = c.MQTTSN.TopicID + 1
+	}
+}
+
+// TelemetryBatch is the payload of a constrained-link batch. Rooms holds each
+// room's regular telemetry/<room> payload (full or delta).
+type TelemetryBatch struct {
+	GatewayID string            `json:"gateway_id"`
+	Timestamp string            `json:"timestamp"`
+	Rooms     []json.RawMessage `json:"rooms"`
+}
+
+// constrainedLink tracks signal-based publish skipping and the optional
+// MQTT-SN socket
+type constrainedLink struct {
+	config    *ConstrainedLinkConfig
+	mu        sync.Mutex
+	ticks     int
+	poor      bool
+	signalErr bool
+	snConn    net.Conn
+}
+
+func newConstrainedLink(config *ConstrainedLinkConfig) (*constrainedLink, error) {
+	l := &constrainedLink{config: config}
+	if config.Enabled && config.MQTTSN.Address != "" {
+		conn, err := net.Dial("udp", config.MQTTSN.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open MQTT-SN socket: %w", err)
+		}
+		l.snConn = conn
+		log.Printf("Constrained link: batches via MQTT-SN gateway %s (topic ID %d)", config.MQTTSN.Address, config.MQTTSN.TopicID)
+	}
+	return l, nil
+}
+
+// skip reports whether this publish tick should be skipped because the
+// signal is poor; while poor only every PoorSignalFactor-th tick publishes
+func (l *constrainedLink) skip() bool {
+	if l.config.SignalFile == "" {
+		return false
+	}
+	dbm, err := readSignal(l.config.SignalFile)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err != nil {
+		if !l.signalErr {
+			log.Printf("[WARN] Cannot read signal strength, assuming good signal: %v", err)
+			l.signalErr = true
+		}
+		return false
+	}
+	l.signalErr = false
+
+	poor := dbm <= l.config.PoorSignalDBm
+	if poor != l.poor {
+		l.poor = poor
+		l.ticks = 0
+		if poor {
+			log.Printf("[WARN] Poor signal (%.0f dBm), publishing every %d intervals", dbm, l.config.PoorSignalFactor)
+		} else {
+			log.Printf("Signal recovered (%.0f dBm), publishing every interval", dbm)
+		}
+	}
+	if !poor {
+		return false
+	}
+	l.ticks++
+	return l.ticks%l.config.PoorSignalFactor != 1
+}
+
+// readSignal parses the first number in the signal file
+func readSignal(path string) (float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("signal file %s is empty", path)
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+func (l *constrainedLink) Close() {
+	if l.snConn != nil {
+		l.snConn.Close()
+	}
+}
+
+// publishBatch sends all rooms' telemetry as one message
+func (gw *Gateway) publishBatch(telemetries []*RoomTelemetry) {
+	cfg := &gw.settings.ConstrainedLink
+	batch := TelemetryBatch{
+		GatewayID: gw.settings.GatewayID,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	for _, telemetry := range telemetries {
+		payload, err := gw.encodeTelemetry(telemetry)
+		if err != nil {
+			log.Printf("[ERROR] Failed to marshal telemetry for room %s: %v", telemetry.RoomID, err)
+			continue
+		}
+		batch.Rooms = append(batch.Rooms, payload)
+	}
+	if len(batch.Rooms) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal telemetry batch: %v", err)
+		return
+	}
+	plainSize := len(payload)
+	topic, topicID := cfg.BatchTopic, cfg.MQTTSN.TopicID
+	if cfg.Compress {
+		if payload, err = gzipBytes(payload); err != nil {
+			log.Printf("[ERROR] Failed to compress telemetry batch: %v", err)
+			return
+		}
+		topic, topicID = topic+"/gz", cfg.MQTTSN.GzipTopicID
+	}
+
+	if gw.link.snConn != nil {
+		if err := gw.link.publishMQTTSN(topicID, payload); err != nil {
+			log.Printf("[ERROR] Failed to publish MQTT-SN batch: %v", err)
+			return
+		}
+		log.Printf("[MQTT] Published %d rooms via MQTT-SN topic %d (%d bytes, %d uncompressed)", len(batch.Rooms), topicID, len(payload), plainSize)
+		return
+	}
+
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[MQTT] Published %d rooms to %s (%d bytes, %d uncompressed)", len(batch.Rooms), topic, len(payload), plainSize)
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MQTT-SN PUBLISH with QoS -1 and a predefined topic ID
+const (
+	mqttsnPublish         = 0x0C
+	mqttsnFlagQoSMinusOne = 0x60
+	mqttsnTopicPredefined = 0x01
+)
+
+// publishMQTTSN sends one QoS -1 PUBLISH datagram. Packets over 255 bytes
+// use the three-byte length form.
+func (l *constrainedLink) publishMQTTSN(topicID uint16, payload []byte) error {
+	body := make([]byte, 0, 6+len(payload))
+	body = append(body, mqttsnPublish, mqttsnFlagQoSMinusOne|mqttsnTopicPredefined)
+	body = binary.BigEndian.AppendUint16(body, topicID)
+	body = binary.BigEndian.AppendUint16(body, 0) // message ID, unused at QoS -1
+	body = append(body, payload...)
+
+	var packet []byte
+	if len(body)+1 <= 0xFF {
+		packet = append([]byte{byte(len(body) + 1)}, body...)
+	} else if len(body)+3 <= 0xFFFF {
+		packet = append([]byte{0x01, 0, 0}, body...)
+		binary.BigEndian.PutUint16(packet[1:3], uint16(len(packet)))
+	} else {
+		return fmt.Errorf("batch of %d bytes exceeds the MQTT-SN packet limit", len(payload))
+	}
+	_, err := l.snConn.Write(packet)
+	return err
+}
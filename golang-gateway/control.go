@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ControlConfig configures the fleet control topic control/gateway/<id>.
+// Requests are signed with HMAC-SHA256 using Secret (${VAR} expanded) over
+//
+//	gateway_id + "\n" + id + "\n" + command + "\n" + timestamp + "\n" + args
+//
+// where gateway_id is the target gateway, so a request cannot be replayed to
+// another gateway sharing the secret, and args is the raw JSON of the args
+// field (empty if absent). Requests are rejected when their timestamp is
+// more than MaxSkewSec away or earlier than the gateway's start (the used
+// ids are only remembered in memory), or their id was already used. Results
+// are published on control/gateway/<id>/result.
+type ControlConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	Secret     string `yaml:"secret,omitempty"`
+	MaxSkewSec int    `yaml:"max_skew_sec"`
+}
+
+func (c *ControlConfig) normalize() error {
+	if c.MaxSkewSec <= 0 {
+		c.MaxSkewSec = 300
+	}
+	if c.Enabled && os.ExpandEnv(c.Secret) == "" {
+		return errors.New("control.secret is required when the control topic is enabled")
+	}
+	return nil
+}
+
+// ControlRequest is a signed fleet command
+type ControlRequest struct {
+	ID        string          `json:"id"`
+	Command   string          `json:"command"`
+	Args      json.RawMessage `json:"args,omitempty"`
+	Timestamp string          `json:"timestamp"`
+	Signature string          `json:"signature"`
+}
+
+// ControlResult answers a control request
+type ControlResult struct {
+	ID        string      `json:"id"`
+	GatewayID string      `json:"gateway_id"`
+	Command   string      `json:"command"`
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Result    interface{} `json:"result,omitempty"`
+	Timestamp string      `json:"timestamp"`
+}
+
+// controlState tracks used request IDs, paused sensors and sensors put in
+// maintenance
+type controlState struct {
+	mu          sync.Mutex
+	seen        map[string]time.Time
+	paused      map[string]bool
+	maintenance map[string]sensorMaintenance
+	started     time.Time
+}
+
+func newControlState() *controlState {
+	return &controlState{
+		seen:        make(map[string]time.Time),
+		paused:      make(map[string]bool),
+		maintenance: make(map[string]sensorMaintenance),
+		started:     time.Now(),
+	}
+}
+
+func (s *controlState) isPaused(sensorID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused[sensorID]
+}
+
+func (gw *Gateway) controlTopic() string {
+	return fmt.Sprintf("control/gateway/%s", gw.settings.GatewayID)
+}
+
+// subscribeControl subscribes to the control topic from the OnConnect
+// handler
+func (gw *Gateway) subscribeControl(client mqtt.Client) {
+	topic := gw.controlTopic()
+	token := client.Subscribe(topic, 1, gw.handleControl)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to subscribe to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("Subscribed to control topic %s", topic)
+}
+
+// handleControl runs on the paho router goroutine; commands run separately
+// since discovery and reloads take seconds
+func (gw *Gateway) handleControl(client mqtt.Client, msg mqtt.Message) {
+	var req ControlRequest
+	if err := json.Unmarshal(msg.Payload(), &req); err != nil {
+		log.Printf("[WARN] Ignoring malformed control request: %v", err)
+		return
+	}
+	go func() {
+		result, err := gw.runControl(&req)
+		gw.publishControlResult(client, &req, result, err)
+		if err == nil && req.Command == "reload_config" {
+			// Pollers, queues and clients are built from the configuration
+			// at startup, so the new files are applied by a clean restart
+			select {
+			case gw.restart <- offlineReasonConfigReload:
+				log.Printf("Restarting to apply the configuration reloaded by control request %s", req.ID)
+			default:
+			}
+		}
+	}()
+}
+
+// verifyControl checks the signature, timestamp and replay of a request
+func (gw *Gateway) verifyControl(req *ControlRequest, now time.Time) error {
+	config := &gw.settings.Control
+	signature, err := hex.DecodeString(req.Signature)
+	if err != nil || !hmac.Equal(signature, controlMAC(os.ExpandEnv(config.Secret), gw.settings.GatewayID, req)) {
+		return errors.New("invalid signature")
+	}
+	ts, err := time.Parse(time.RFC3339, req.Timestamp)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	skew := time.Duration(config.MaxSkewSec) * time.Second
+	if ts.Before(now.Add(-skew)) || ts.After(now.Add(skew)) {
+		return errors.New("request timestamp outside the allowed skew")
+	}
+	if req.ID == "" {
+		return errors.New("missing request id")
+	}
+
+	state := gw.control
+	// A request seen before a restart would pass the in-memory replay check
+	if ts.Before(state.started.Truncate(time.Second)) {
+		return errors.New("request predates the gateway start")
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	for id, at := range state.seen {
+		if now.Sub(at) > 2*skew {
+			delete(state.seen, id)
+		}
+	}
+	if _, ok := state.seen[req.ID]; ok {
+		return errors.New("request id already used")
+	}
+	state.seen[req.ID] = now
+	return nil
+}
+
+// controlMAC is the HMAC-SHA256 of a request addressed to a gateway
+func controlMAC(secret, gatewayID string, req *ControlRequest) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(gatewayID + "\n" + req.ID + "\n" + req.Command + "\n" + req.Timestamp + "\n" + string(req.Args)))
+	return mac.Sum(nil)
+}
+
+func (gw *Gateway) runControl(req *ControlRequest) (interface{}, error) {
+	if err := gw.verifyControl(req, time.Now()); err != nil {
+		log.Printf("[WARN] Rejected control request %s (%s): %v", req.ID, req.Command, err)
+		return nil, err
+	}
+	log.Printf("[EVENT] Control request %s: %s %s", req.ID, req.Command, req.Args)
+
+	var args struct {
+		Level      string `json:"level"`
+		SensorID   string `json:"sensor_id"`
+		TimeoutSec int    `json:"timeout_sec"`
+		// Address, DurationMin and Reason scope and describe maintenance
+		Address     string `json:"address"`
+		DurationMin int    `json:"duration_min"`
+		Reason      string `json:"reason"`
+		// Protocol and Target select a driver sidecar for discover
+		Protocol string `json:"protocol"`
+		Target   string `json:"target"`
+	}
+	if len(req.Args) > 0 {
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid args: %w", err)
+		}
+	}
+
+	switch req.Command {
+	case "status":
+		return gw.controlStatus(), nil
+	case "set_log_level":
+		if err := setLogLevel(args.Level); err != nil {
+			return nil, err
+		}
+		return map[string]string{"level": args.Level}, nil
+	case "pause_sensor", "resume_sensor":
+		if _, ok := gw.sensors[args.SensorID]; !ok {
+			return nil, fmt.Errorf("unknown sensor %s", args.SensorID)
+		}
+		gw.control.mu.Lock()
+		if req.Command == "pause_sensor" {
+			gw.control.paused[args.SensorID] = true
+		} else {
+			delete(gw.control.paused, args.SensorID)
+		}
+		gw.control.mu.Unlock()
+		return map[string]interface{}{"sensor_id": args.SensorID, "paused": req.Command == "pause_sensor"}, nil
+	case "start_maintenance", "end_maintenance":
+		return gw.setMaintenance(req.Command == "start_maintenance", args.SensorID, args.Address, args.DurationMin, args.Reason)
+	case "discover":
+		if args.Protocol == "grpc" {
+			if args.Target == "" {
+				return nil, errors.New("discover with protocol grpc requires a target")
+			}
+			timeout := 3 * time.Second
+			if args.TimeoutSec > 0 {
+				timeout = time.Duration(args.TimeoutSec) * time.Second
+			}
+			points, err := gw.drivers.discover(args.Target, timeout)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"target": args.Target, "points": points}, nil
+		}
+		if gw.bacnet == nil {
+			return nil, errors.New("BACnet client not initialized")
+		}
+		timeout := 3 * time.Second
+		if args.TimeoutSec > 0 {
+			timeout = time.Duration(args.TimeoutSec) * time.Second
+		}
+		devices, err := gw.discoverBACnet(timeout)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"devices": devices}, nil
+	case "reload_config":
+		if err := validateConfigFiles(gw.configPaths); err != nil {
+			return nil, err
+		}
+		return map[string]string{"action": "restarting"}, nil
+	default:
+		return nil, fmt.Errorf("unknown command %q", req.Command)
+	}
+}
+
+// validateConfigFiles loads the config files into a scratch gateway
+func validateConfigFiles(paths [3]string) error {
+	scratch := &Gateway{
+		sensors:      make(map[string]*SensorConfig),
+		rooms:        make(map[string]*RoomConfig),
+		sensorToRoom: make(map[string]string),
+	}
+	if err := scratch.loadConfig(paths[0], paths[1], paths[2]); err != nil {
+		return fmt.Errorf("new configuration rejected: %w", err)
+	}
+	return nil
+}
+
+// ControlStatus is the result of the status command
+type ControlStatus struct {
+	GatewayID     string   `json:"gateway_id"`
+	UptimeSec     int64    `json:"uptime_sec"`
+	LogLevel      string   `json:"log_level"`
+	Sensors       int      `json:"sensors"`
+	SensorsOK     int      `json:"sensors_ok"`
+	PausedSensors []string `json:"paused_sensors"`
+	// MaintenanceSensors are in maintenance by config or control command
+	MaintenanceSensors []string `json:"maintenance_sensors"`
+	Rooms              int      `json:"rooms"`
+	MQTTConnected      bool     `json:"mqtt_connected"`
+}
+
+func (gw *Gateway) controlStatus() ControlStatus {
+	status := ControlStatus{
+		GatewayID:     gw.settings.GatewayID,
+		UptimeSec:     int64(time.Since(gw.control.started).Seconds()),
+		LogLevel:      logLevelName(),
+		Sensors:       len(gw.sensors),
+		Rooms:         len(gw.rooms),
+		MQTTConnected: gw.mqttClient != nil && gw.mqttClient.IsConnectionOpen(),
+		PausedSensors: []string{},
+	}
+	status.MaintenanceSensors = gw.maintenanceSensors()
+	gw.readingsMutex.RLock()
+	for _, reading := range gw.lastReadings {
+		if reading.Status == "ok" {
+			status.SensorsOK++
+		}
+	}
+	gw.readingsMutex.RUnlock()
+	gw.control.mu.Lock()
+	for id := range gw.control.paused {
+		status.PausedSensors = append(status.PausedSensors, id)
+	}
+	gw.control.mu.Unlock()
+	sort.Strings(status.PausedSensors)
+	return status
+}
+
+func (gw *Gateway) publishControlResult(client mqtt.Client, req *ControlRequest, result interface{}, err error) {
+	res := ControlResult{
+		ID:        req.ID,
+		GatewayID: gw.settings.GatewayID,
+		Command:   req.Command,
+		OK:        err == nil,
+		Result:    result,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	payload, _ := json.Marshal(res)
+	topic := gw.controlTopic() + "/result"
+	token := client.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedControlRequest(secret, gatewayID, id string, ts time.Time) *ControlRequest {
+	req := &ControlRequest{ID: id, Command: "status", Args: []byte(`{"level":"info"}`), Timestamp: ts.UTC().Format(time.RFC3339)}
+	req.Signature = hex.EncodeToString(controlMAC(secret, gatewayID, req))
+	return req
+}
+
+func TestVerifyControl(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	newGateway := func() *Gateway {
+		gw := &Gateway{control: newControlState()}
+		gw.control.started = start
+		gw.settings.GatewayID = "gw-1"
+		gw.settings.Control = ControlConfig{Enabled: true, Secret: "s3cret", MaxSkewSec: 300}
+		return gw
+	}
+	now := start.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		req  *ControlRequest
+		err  string
+	}{
+		{"valid", signedControlRequest("s3cret", "gw-1", "c-1", now), ""},
+		{"other gateway", signedControlRequest("s3cret", "gw-2", "c-1", now), "invalid signature"},
+		{"wrong secret", signedControlRequest("other", "gw-1", "c-1", now), "invalid signature"},
+		{"too old", signedControlRequest("s3cret", "gw-1", "c-1", now.Add(-10*time.Minute)), "skew"},
+		{"too new", signedControlRequest("s3cret", "gw-1", "c-1", now.Add(10*time.Minute)), "skew"},
+		{"before start", signedControlRequest("s3cret", "gw-1", "c-1", start.Add(-time.Second)), "predates"},
+		{"missing id", signedControlRequest("s3cret", "gw-1", "", now), "missing request id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newGateway().verifyControl(tt.req, now)
+			if tt.err == "" && err != nil {
+				t.Fatalf("verifyControl() = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("verifyControl() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+
+	t.Run("tampered args", func(t *testing.T) {
+		req := signedControlRequest("s3cret", "gw-1", "c-1", now)
+		req.Args = []byte(`{"level":"debug"}`)
+		if err := newGateway().verifyControl(req, now); err == nil {
+			t.Fatal("tampered request accepted")
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		gw := newGateway()
+		req := signedControlRequest("s3cret", "gw-1", "c-1", now)
+		if err := gw.verifyControl(req, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.verifyControl(req, now.Add(time.Second)); err == nil || !strings.Contains(err.Error(), "already used") {
+			t.Fatalf("replayed request: %v", err)
+		}
+	})
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DALIConfig is the DALI-2 IP gateway the gateway drives the lighting bus
+// through. Sensors with protocol dali address one control gear by its short
+// address (0-63, or A0-A63) and read the dali_point selected for it: the
+// dim level, the lamp and gear status bits, or the state and test results
+// of emergency lighting (IEC 62386-202). Writable level sensors set the
+// light level with commands on commands/<room_id>/<sensor_id>.
+//
+// The IP gateway is used in its raw frame mode over TCP: each request is
+// three bytes (kind, address byte, opcode), kind 1 sending a forward frame
+// and kind 2 a query that waits for the backward frame; each reply is two
+// bytes (status, data), status 0 for no answer, 1 for a backward frame in
+// data, 2 for a collision or corrupt backward frame and 3 for a bus power
+// failure.
+type DALIConfig struct {
+	Gateway   string `yaml:"gateway,omitempty"`    // host:port of the DALI-2 IP gateway
+	TimeoutMs int    `yaml:"timeout_ms,omitempty"` // reply timeout, default 1000
+	Retries   int    `yaml:"retries,omitempty"`    // default 2
+	// DimmingCurve is how the control gear maps arc power levels to light
+	// output: logarithmic (the DALI default) or linear
+	DimmingCurve string `yaml:"dimming_curve,omitempty"`
+}
+
+func (c *DALIConfig) normalize() error {
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 1000
+	}
+	if c.Retries <= 0 {
+		c.Retries = 2
+	}
+	switch c.DimmingCurve {
+	case "":
+		c.DimmingCurve = "logarithmic"
+	case "logarithmic", "linear":
+	default:
+		return fmt.Errorf("dali: unknown dimming_curve %q (logarithmic or linear)", c.DimmingCurve)
+	}
+	return nil
+}
+
+// DALI raw frame mode codes and IEC 62386 commands
+const (
+	daliSend         = 0x01
+	daliQuery        = 0x02
+	daliNoAnswer     = 0x00
+	daliAnswer       = 0x01
+	daliBusError     = 0x02
+	daliPowerFailure = 0x03
+
+	daliQueryStatus         = 0x90
+	daliQueryActualLevel    = 0xA0
+	daliEnableDeviceType    = 0xC1 // special command, the device type is the data byte
+	daliEmergencyDeviceType = 0x01
+	daliQueryBatteryCharge  = 0xF0
+	daliQueryDurationResult = 0xF2
+	daliQueryEmergencyMode  = 0xF9
+	daliQueryFailureStatus  = 0xFB
+	daliQueryEmergencyState = 0xFC
+	daliMask                = 0xFF
+	daliMaxShortAddress     = 63
+)
+
+// daliPoint is a value a sensor reads from its control gear: the reply to
+// a query, decoded
+type daliPoint struct {
+	opcode    byte
+	emergency bool // the query is an emergency lighting (device type 1) command
+	decode    func(d *daliDriver, answer byte) (float64, error)
+}
+
+func daliBit(bit uint) func(*daliDriver, byte) (float64, error) {
+	return func(_ *daliDriver, answer byte) (float64, error) {
+		return float64(answer >> bit & 1), nil
+	}
+}
+
+func daliByte(_ *daliDriver, answer byte) (float64, error) {
+	return float64(answer), nil
+}
+
+// daliPoints are the values dali_point may name
+var daliPoints = map[string]daliPoint{
+	"level": {opcode: daliQueryActualLevel, decode: func(d *daliDriver, answer byte) (float64, error) {
+		if answer == daliMask {
+			return 0, errors.New("level unknown (lamp failure or fading)")
+		}
+		return d.levelPercent(answer), nil
+	}},
+	"status":       {opcode: daliQueryStatus, decode: daliByte},
+	"gear_failure": {opcode: daliQueryStatus, decode: daliBit(0)},
+	"lamp_failure": {opcode: daliQueryStatus, decode: daliBit(1)},
+	"lamp_on":      {opcode: daliQueryStatus, decode: daliBit(2)},
+
+	"emergency_mode":       {opcode: daliQueryEmergencyMode, emergency: true, decode: daliByte},
+	"emergency_status":     {opcode: daliQueryEmergencyState, emergency: true, decode: daliByte},
+	"emergency_failure":    {opcode: daliQueryFailureStatus, emergency: true, decode: daliByte},
+	"battery_failure":      {opcode: daliQueryFailureStatus, emergency: true, decode: daliBit(2)},
+	"emergency_lamp_fault": {opcode: daliQueryFailureStatus, emergency: true, decode: daliBit(3)},
+	"function_test_failed": {opcode: daliQueryFailureStatus, emergency: true, decode: daliBit(6)},
+	"duration_test_failed": {opcode: daliQueryFailureStatus, emergency: true, decode: daliBit(7)},
+	"battery_charge": {opcode: daliQueryBatteryCharge, emergency: true, decode: func(_ *daliDriver, answer byte) (float64, error) {
+		if answer == daliMask {
+			return 0, errors.New("battery charge unknown")
+		}
+		return float64(answer) / 254 * 100, nil
+	}},
+	// duration_test_result is the battery duration reached in the last
+	// duration test, in minutes
+	"duration_test_result": {opcode: daliQueryDurationResult, emergency: true, decode: func(_ *daliDriver, answer byte) (float64, error) {
+		return float64(answer) * 2, nil
+	}},
+}
+
+// validateDALISensors checks the DALI settings of sensors
+func (gw *Gateway) validateDALISensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "dali" {
+			if sensor.DALIPoint != "" {
+				return fmt.Errorf("sensor %s: dali_point is only valid for protocol dali", id)
+			}
+			continue
+		}
+		if gw.settings.DALI.Gateway == "" {
+			return fmt.Errorf("sensor %s: protocol dali requires dali.gateway in the gateway config", id)
+		}
+		address, err := parseDALIAddress(sensor.Address)
+		if err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		sensor.daliAddress = address
+		if sensor.DALIPoint == "" && sensor.Type == "dimmer_level" {
+			sensor.DALIPoint = "level"
+		}
+		if _, ok := daliPoints[sensor.DALIPoint]; !ok {
+			return fmt.Errorf("sensor %s: invalid dali_point %q, expected one of %s", id, sensor.DALIPoint, daliPointNames())
+		}
+		if sensor.Writable && sensor.DALIPoint != "level" {
+			return fmt.Errorf("sensor %s: only dali_point level is writable", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+func daliPointNames() string {
+	names := make([]string, 0, len(daliPoints))
+	for name := range daliPoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseDALIAddress returns the short address of a control gear
+func parseDALIAddress(address string) (byte, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.ToUpper(address), "A"))
+	if err != nil || n < 0 || n > daliMaxShortAddress {
+		return 0, fmt.Errorf("invalid DALI address %q, expected a short address 0-%d", address, daliMaxShortAddress)
+	}
+	return byte(n), nil
+}
+
+// daliDriver owns the connection to the IP gateway; frames are sent
+// strictly one at a time, as the bus carries one at a time
+type daliDriver struct {
+	config  *DALIConfig
+	latency *latencyRecorder
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newDALIDriver(config *DALIConfig, latency *latencyRecorder) *daliDriver {
+	return &daliDriver{config: config, latency: latency}
+}
+
+// read queries a sensor's point from its control gear
+func (d *daliDriver) read(sensor *SensorConfig) (float64, string, error) {
+	point := daliPoints[sensor.DALIPoint]
+	answer, err := d.query(sensor.daliAddress, point)
+	if err != nil {
+		return 0, "", fmt.Errorf("DALI read error: A%d %s: %w", sensor.daliAddress, sensor.DALIPoint, err)
+	}
+	value, err := point.decode(d, answer)
+	if err != nil {
+		return 0, "", fmt.Errorf("DALI read error: A%d: %w", sensor.daliAddress, err)
+	}
+	return value, sensor.enumText[value], nil
+}
+
+// write sets the light level of a sensor's control gear in percent with a
+// direct arc power command; 0 switches the lamp off
+func (d *daliDriver) write(sensor *SensorConfig, percent float64) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("DALI level %.2f out of range 0-100", percent)
+	}
+	level := d.arcLevel(percent)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var err error
+	for attempt := 0; attempt <= d.config.Retries; attempt++ {
+		start := time.Now()
+		_, _, err = d.exchange(daliSend, sensor.daliAddress<<1, level)
+		d.latency.observe("dali", fmt.Sprintf("A%d", sensor.daliAddress), time.Since(start), err)
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("DALI write error: A%d: %w", sensor.daliAddress, err)
+}
+
+// query sends a query to a control gear, enabling the emergency lighting
+// device type first for its commands, and returns the answer; a missing
+// answer means the gear is absent or does not support the query
+func (d *daliDriver) query(address byte, point daliPoint) (byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device := fmt.Sprintf("A%d", address)
+	var err error
+	for attempt := 0; attempt <= d.config.Retries; attempt++ {
+		start := time.Now()
+		var answer byte
+		answer, err = d.queryOnce(address<<1|1, point)
+		d.latency.observe("dali", device, time.Since(start), err)
+		if err == nil {
+			return answer, nil
+		}
+	}
+	return 0, err
+}
+
+func (d *daliDriver) queryOnce(addressByte byte, point daliPoint) (byte, error) {
+	if point.emergency {
+		if _, _, err := d.exchange(daliSend, daliEnableDeviceType, daliEmergencyDeviceType); err != nil {
+			return 0, err
+		}
+	}
+	answered, answer, err := d.exchange(daliQuery, addressByte, point.opcode)
+	if err != nil {
+		return 0, err
+	}
+	if !answered {
+		return 0, errors.New("no answer")
+	}
+	return answer, nil
+}
+
+// exchange sends one frame to the IP gateway and reads its reply
+func (d *daliDriver) exchange(kind, addressByte, opcode byte) (answered bool, answer byte, err error) {
+	if err := d.open(); err != nil {
+		return false, 0, err
+	}
+	deadline := time.Now().Add(time.Duration(d.config.TimeoutMs) * time.Millisecond)
+	d.conn.SetDeadline(deadline)
+	if _, err := d.conn.Write([]byte{kind, addressByte, opcode}); err != nil {
+		d.closeConn()
+		return false, 0, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(d.conn, reply); err != nil {
+		// A late reply would be taken for the next request's
+		d.closeConn()
+		return false, 0, err
+	}
+	switch reply[0] {
+	case daliNoAnswer:
+		return false, 0, nil
+	case daliAnswer:
+		return true, reply[1], nil
+	case daliBusError:
+		return false, 0, errors.New("collision or corrupt backward frame")
+	case daliPowerFailure:
+		return false, 0, errors.New("DALI bus power failure")
+	}
+	d.closeConn()
+	return false, 0, fmt.Errorf("unexpected reply status 0x%02X", reply[0])
+}
+
+// open connects to the IP gateway if needed
+func (d *daliDriver) open() error {
+	if d.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", d.config.Gateway, time.Duration(d.config.TimeoutMs)*time.Millisecond)
+	if err != nil {
+		return fmt.Errorf("failed to connect to DALI gateway %s: %w", d.config.Gateway, err)
+	}
+	d.conn = conn
+	log.Printf("DALI gateway %s connected", d.config.Gateway)
+	return nil
+}
+
+func (d *daliDriver) closeConn() {
+	if d.conn != nil {
+		d.conn.Close()
+		d.conn = nil
+	}
+}
+
+func (d *daliDriver) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closeConn()
+}
+
+// levelPercent converts an arc power level (1-254, 0 off) to light output
+// in percent on the gear's dimming curve; the logarithmic curve spans 0.1%
+// to 100%
+func (d *daliDriver) levelPercent(level byte) float64 {
+	if level == 0 {
+		return 0
+	}
+	if d.config.DimmingCurve == "linear" {
+		return float64(level) / 254 * 100
+	}
+	return math.Pow(10, (float64(level)-1)/(253.0/3)-1)
+}
+
+// arcLevel converts light output in percent to the nearest arc power level;
+// outputs below the curve's minimum switch the lamp off
+func (d *daliDriver) arcLevel(percent float64) byte {
+	var level float64
+	if d.config.DimmingCurve == "linear" {
+		level = percent / 100 * 254
+	} else if percent >= 0.1 {
+		level = 1 + (253.0/3)*(math.Log10(percent)+1)
+	}
+	return byte(math.Max(0, math.Min(254, math.Round(level))))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Report by exception: a sensor with a deadband reports a reading only when
+// its value moved more than Deadband (in the reading's unit) or
+// DeadbandPercent of the last reported value, its status or state text
+// changed, or MaxSilenceSec passed since its last report. Rooms whose
+// sensors all have a deadband are published (and recorded in the history
+// and live stream) only when one of their sensors reported since the
+// room's last publish, so stable rooms stop repeating unchanged telemetry
+// while max_silence_sec still proves they are alive. Rooms with any sensor
+// without a deadband are published on every tick as before.
+
+// defaultMaxSilence applies to sensors with a deadband but no
+// max_silence_sec
+const defaultMaxSilence = 15 * time.Minute
+
+// reportedValue is the last reading of a sensor that passed its deadband
+type reportedValue struct {
+	value  float64
+	text   string
+	status string
+	at     time.Time
+}
+
+// deadbandFilter tracks the reported values of sensors with a deadband and
+// the rooms with changes not yet published
+type deadbandFilter struct {
+	mu       sync.Mutex
+	reported map[string]reportedValue
+	// rooms holds the rooms filtered by exception, with whether a sensor
+	// reported since their last publish
+	rooms map[string]bool
+}
+
+func newDeadbandFilter(sensors map[string]*SensorConfig, rooms map[string]*RoomConfig) *deadbandFilter {
+	f := &deadbandFilter{
+		reported: make(map[string]reportedValue),
+		rooms:    make(map[string]bool),
+	}
+	for roomID, room := range rooms {
+		filtered := len(room.Sensors) > 0
+		for _, sensorID := range room.Sensors {
+			if sensor, ok := sensors[sensorID]; !ok || !sensor.hasDeadband() {
+				filtered = false
+				break
+			}
+		}
+		if filtered {
+			// Published once at startup, then by exception
+			f.rooms[roomID] = true
+		}
+	}
+	return f
+}
+
+// validateDeadbands checks the deadband settings of sensors
+func (gw *Gateway) validateDeadbands() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Deadband < 0 || sensor.DeadbandPercent < 0 || sensor.MaxSilenceSec < 0 {
+			return fmt.Errorf("sensor %s: deadband, deadband_percent and max_silence_sec must not be negative", id)
+		}
+		if sensor.MaxSilenceSec > 0 && !sensor.hasDeadband() {
+			return fmt.Errorf("sensor %s: max_silence_sec requires deadband or deadband_percent", id)
+		}
+	}
+	return nil
+}
+
+func (s *SensorConfig) hasDeadband() bool {
+	return s.Deadband > 0 || s.DeadbandPercent > 0
+}
+
+func (s *SensorConfig) maxSilence() time.Duration {
+	if s.MaxSilenceSec > 0 {
+		return time.Duration(s.MaxSilenceSec) * time.Second
+	}
+	return defaultMaxSilence
+}
+
+// exceedsDeadband reports whether value moved out of the deadband around
+// the last reported value
+func (s *SensorConfig) exceedsDeadband(last, value float64) bool {
+	change := math.Abs(value - last)
+	if s.Deadband > 0 && change > s.Deadband {
+		return true
+	}
+	return s.DeadbandPercent > 0 && change > math.Abs(last)*s.DeadbandPercent/100
+}
+
+// observe records a reading and reports whether it passed the sensor's
+// deadband; readings of sensors without a deadband always pass
+func (f *deadbandFilter) observe(roomID string, config *SensorConfig, reading *SensorReading) bool {
+	if f == nil || !config.hasDeadband() {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	last, ok := f.reported[reading.SensorID]
+	if ok && reading.Status == last.status && reading.StringValue == last.text &&
+		!config.exceedsDeadband(last.value, reading.Value) &&
+		reading.Timestamp.Sub(last.at) < config.maxSilence() {
+		return false
+	}
+	f.reported[reading.SensorID] = reportedValue{
+		value:  reading.Value,
+		text:   reading.StringValue,
+		status: reading.Status,
+		at:     reading.Timestamp,
+	}
+	if _, filtered := f.rooms[roomID]; filtered {
+		f.rooms[roomID] = true
+	}
+	return true
+}
+
+// changed returns the due rooms to publish: rooms filtered by exception
+// only when a sensor reported since their last publish
+func (f *deadbandFilter) changed(due []string) []string {
+	if f == nil || len(f.rooms) == 0 {
+		return due
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rooms := due[:0:0]
+	for _, roomID := range due {
+		changed, filtered := f.rooms[roomID]
+		if filtered && !changed {
+			continue
+		}
+		if filtered {
+			f.rooms[roomID] = false
+		}
+		rooms = append(rooms, roomID)
+	}
+	return rooms
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// DeltaConfig enables delta publishing of room telemetry for metered
+// backhaul links: each message carries only the fields that changed since
+// the room's previous publish, with a full snapshot every
+// snapshot_interval_sec. Consumers rebuild full rows from the last snapshot
+// (the bridge's delta transform does this).
+type DeltaConfig struct {
+	Enabled             bool `yaml:"enabled"`
+	SnapshotIntervalSec int  `yaml:"snapshot_interval_sec"`
+}
+
+func (c *DeltaConfig) normalize() {
+	if c.SnapshotIntervalSec <= 0 {
+		c.SnapshotIntervalSec = 300
+	}
+}
+
+// Delta message types, carried in the msg_type field
+const (
+	msgTypeSnapshot = "snapshot"
+	msgTypeDelta    = "delta"
+)
+
+// deltaEncoder remembers the last published fields of every room
+type deltaEncoder struct {
+	mu           sync.Mutex
+	config       *DeltaConfig
+	last         map[string]map[string]interface{}
+	lastSnapshot map[string]time.Time
+	seq          map[string]uint64
+}
+
+func newDeltaEncoder(config *DeltaConfig) *deltaEncoder {
+	return &deltaEncoder{
+		config:       config,
+		last:         make(map[string]map[string]interface{}),
+		lastSnapshot: make(map[string]time.Time),
+		seq:          make(map[string]uint64),
+	}
+}
+
+// encode returns the payload for a room's telemetry: a snapshot when one is
+// due, otherwise the changed fields. Fields that disappeared (e.g. a sensor
+// went offline) are sent as null. Every message carries room_id, timestamp,
+// msg_type and a per-room seq so consumers can detect gaps.
+func (d *deltaEncoder) encode(telemetry *RoomTelemetry) ([]byte, error) {
+	data, err := json.Marshal(telemetry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal telemetry: %w", err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to decode telemetry: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	roomID := telemetry.RoomID
+	prev, ok := d.last[roomID]
+	d.last[roomID] = fields
+	d.seq[roomID]++
+
+	out := map[string]interface{}{
+		"room_id": roomID,
+		"seq":     d.seq[roomID],
+	}
+	interval := time.Duration(d.config.SnapshotIntervalSec) * time.Second
+	if !ok || time.Since(d.lastSnapshot[roomID]) >= interval {
+		d.lastSnapshot[roomID] = time.Now()
+		for k, v := range fields {
+			out[k] = v
+		}
+		out["msg_type"] = msgTypeSnapshot
+	} else {
+		for k, v := range fields {
+			if old, exists := prev[k]; !exists || !reflect.DeepEqual(old, v) {
+				out[k] = v
+			}
+		}
+		for k := range prev {
+			if _, exists := fields[k]; !exists {
+				out[k] = nil
+			}
+		}
+		out["msg_type"] = msgTypeDelta
+	}
+	out["timestamp"] = telemetry.Timestamp
+
+	payload, err := json.Marshal(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal delta: %w", err)
+	}
+	return payload, nil
+}
+
+// forceSnapshot makes the next publish for every room a full snapshot, e.g.
+// after a reconnect when consumers may have missed deltas
+func (d *deltaEncoder) forceSnapshot() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastSnapshot = make(map[string]time.Time)
+}
@@ -0,0 +1,261 @@
+// Driver sidecar protocol. External processes implement the Driver service
+// to bring proprietary or licensed field protocols into the gateway without
+// linking them into it: sensors with `protocol: grpc` name the sidecar's
+// address in `target`, and the gateway calls the sidecar for reads, writes,
+// discovery and pushed updates.
+//
+// Regenerate the Go code with protoc-gen-go and protoc-gen-go-grpc:
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//          --go-grpc_out=. --go-grpc_opt=paths=source_relative driver.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: driver.proto
+
+package driverpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Driver_ReadPoint_FullMethodName  = "/smartbuilding.driver.v1.Driver/ReadPoint"
+	Driver_WritePoint_FullMethodName = "/smartbuilding.driver.v1.Driver/WritePoint"
+	Driver_Discover_FullMethodName   = "/smartbuilding.driver.v1.Driver/Discover"
+	Driver_Subscribe_FullMethodName  = "/smartbuilding.driver.v1.Driver/Subscribe"
+)
+
+// DriverClient is the client API for Driver service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DriverClient interface {
+	// ReadPoint reads the current value of one point
+	ReadPoint(ctx context.Context, in *ReadPointRequest, opts ...grpc.CallOption) (*PointValue, error)
+	// WritePoint writes a value to one point and returns the value read back
+	// when the driver can read it
+	WritePoint(ctx context.Context, in *WritePointRequest, opts ...grpc.CallOption) (*WritePointResponse, error)
+	// Discover lists the points the driver can reach
+	Discover(ctx context.Context, in *DiscoverRequest, opts ...grpc.CallOption) (*DiscoverResponse, error)
+	// Subscribe streams values of the points as the driver receives them,
+	// for protocols that push changes instead of being polled
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PointValue], error)
+}
+
+type driverClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDriverClient(cc grpc.ClientConnInterface) DriverClient {
+	return &driverClient{cc}
+}
+
+func (c *driverClient) ReadPoint(ctx context.Context, in *ReadPointRequest, opts ...grpc.CallOption) (*PointValue, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PointValue)
+	err := c.cc.Invoke(ctx, Driver_ReadPoint_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *driverClient) WritePoint(ctx context.Context, in *WritePointRequest, opts ...grpc.CallOption) (*WritePointResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(WritePointResponse)
+	err := c.cc.Invoke(ctx, Driver_WritePoint_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *driverClient) Discover(ctx context.Context, in *DiscoverRequest, opts ...grpc.CallOption) (*DiscoverResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DiscoverResponse)
+	err := c.cc.Invoke(ctx, Driver_Discover_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *driverClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PointValue], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Driver_ServiceDesc.Streams[0], Driver_Subscribe_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[SubscribeRequest, PointValue]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Driver_SubscribeClient = grpc.ServerStreamingClient[PointValue]
+
+// DriverServer is the server API for Driver service.
+// All implementations must embed UnimplementedDriverServer
+// for forward compatibility.
+type DriverServer interface {
+	// ReadPoint reads the current value of one point
+	ReadPoint(context.Context, *ReadPointRequest) (*PointValue, error)
+	// WritePoint writes a value to one point and returns the value read back
+	// when the driver can read it
+	WritePoint(context.Context, *WritePointRequest) (*WritePointResponse, error)
+	// Discover lists the points the driver can reach
+	Discover(context.Context, *DiscoverRequest) (*DiscoverResponse, error)
+	// Subscribe streams values of the points as the driver receives them,
+	// for protocols that push changes instead of being polled
+	Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[PointValue]) error
+	mustEmbedUnimplementedDriverServer()
+}
+
+// UnimplementedDriverServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDriverServer struct{}
+
+func (UnimplementedDriverServer) ReadPoint(context.Context, *ReadPointRequest) (*PointValue, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReadPoint not implemented")
+}
+func (UnimplementedDriverServer) WritePoint(context.Context, *WritePointRequest) (*WritePointResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method WritePoint not implemented")
+}
+func (UnimplementedDriverServer) Discover(context.Context, *DiscoverRequest) (*DiscoverResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Discover not implemented")
+}
+func (UnimplementedDriverServer) Subscribe(*SubscribeRequest, grpc.ServerStreamingServer[PointValue]) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedDriverServer) mustEmbedUnimplementedDriverServer() {}
+func (UnimplementedDriverServer) testEmbeddedByValue()                {}
+
+// UnsafeDriverServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DriverServer will
+// result in compilation errors.
+type UnsafeDriverServer interface {
+	mustEmbedUnimplementedDriverServer()
+}
+
+func RegisterDriverServer(s grpc.ServiceRegistrar, srv DriverServer) {
+	// If the following call pancis, it indicates UnimplementedDriverServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Driver_ServiceDesc, srv)
+}
+
+func _Driver_ReadPoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadPointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DriverServer).ReadPoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Driver_ReadPoint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DriverServer).ReadPoint(ctx, req.(*ReadPointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Driver_WritePoint_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WritePointRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DriverServer).WritePoint(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Driver_WritePoint_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DriverServer).WritePoint(ctx, req.(*WritePointRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Driver_Discover_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiscoverRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DriverServer).Discover(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Driver_Discover_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DriverServer).Discover(ctx, req.(*DiscoverRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Driver_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DriverServer).Subscribe(m, &grpc.GenericServerStream[SubscribeRequest, PointValue]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Driver_SubscribeServer = grpc.ServerStreamingServer[PointValue]
+
+// Driver_ServiceDesc is the grpc.ServiceDesc for Driver service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Driver_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "smartbuilding.driver.v1.Driver",
+	HandlerType: (*DriverServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ReadPoint",
+			Handler:    _Driver_ReadPoint_Handler,
+		},
+		{
+			MethodName: "WritePoint",
+			Handler:    _Driver_WritePoint_Handler,
+		},
+		{
+			MethodName: "Discover",
+			Handler:    _Driver_Discover_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Driver_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "driver.proto",
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types used by the embedded broker
+const (
+	pktConnect     = 1
+	pktConnack     = 2
+	pktPublish     = 3
+	pktPuback      = 4
+	pktPubrec      = 5
+	pktPubrel      = 6
+	pktPubcomp     = 7
+	pktSubscribe   = 8
+	pktSuback      = 9
+	pktUnsubscribe = 10
+	pktUnsuback    = 11
+	pktPingreq     = 12
+	pktPingresp    = 13
+	pktDisconnect  = 14
+)
+
+// embeddedBroker is a minimal MQTT 3.1.1 broker used as a local fallback
+// while the central broker is down. It accepts any client, supports QoS 0/1
+// publishes (QoS 2 is acknowledged but delivered as QoS 0), retained messages
+// and wills, and delivers everything to subscribers at QoS 0. Shared
+// subscriptions are treated as plain ones. When a username is set, clients
+// must connect with it and the password; there is no persistence or ACL, so
+// it is meant for co-located consumers only.
+type embeddedBroker struct {
+	listener net.Listener
+	username string
+	password string
+	mu       sync.RWMutex
+	sessions map[*brokerSession]struct{}
+	retained map[string][]byte
+	wg       sync.WaitGroup
+}
+
+type brokerSession struct {
+	conn     net.Conn
+	writeMu  sync.Mutex
+	clientID string
+	subs     map[string]struct{}
+	will     *brokerMessage
+}
+
+type brokerMessage struct {
+	topic   string
+	payload []byte
+	retain  bool
+}
+
+// errNotAuthorized rejects a CONNECT with wrong or missing credentials
+var errNotAuthorized = errors.New("bad username or password")
+
+func startEmbeddedBroker(addr, username, password string) (*embeddedBroker, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start embedded broker: %w", err)
+	}
+	b := &embeddedBroker{
+		listener: listener,
+		username: username,
+		password: password,
+		sessions: make(map[*brokerSession]struct{}),
+		retained: make(map[string][]byte),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	log.Printf("Embedded MQTT broker listening on %s", listener.Addr())
+	return b, nil
+}
+
+func (b *embeddedBroker) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("[ERROR] Embedded broker accept: %v", err)
+			}
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.serve(conn)
+		}()
+	}
+}
+
+// serve handles one client connection until it disconnects
+func (b *embeddedBroker) serve(conn net.Conn) {
+	s := &brokerSession{conn: conn, subs: make(map[string]struct{})}
+	r := bufio.NewReader(conn)
+	clean := false
+	defer func() {
+		b.mu.Lock()
+		delete(b.sessions, s)
+		b.mu.Unlock()
+		conn.Close()
+		if !clean && s.will != nil {
+			b.publish(s.will.topic, s.will.payload, s.will.retain)
+		}
+		if s.clientID != "" {
+			log.Printf("[MQTT] Embedded broker: client %s disconnected", s.clientID)
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, body, err := readMQTTPacket(r)
+	if err != nil || header>>4 != pktConnect {
+		return
+	}
+	keepAlive, err := b.handleConnect(s, body)
+	if err != nil {
+		if errors.Is(err, errNotAuthorized) {
+			s.write(pktConnack<<4, []byte{0, 4})
+		}
+		log.Printf("[WARN] Embedded broker: rejected connect from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	b.mu.Lock()
+	b.sessions[s] = struct{}{}
+	b.mu.Unlock()
+	s.write(pktConnack<<4, []byte{0, 0})
+	log.Printf("[MQTT] Embedded broker: client %s connected from %s", s.clientID, conn.RemoteAddr())
+
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case pktPublish:
+			if err := b.handlePublish(s, header, body); err != nil {
+				return
+			}
+		case pktPubrel:
+			s.write(pktPubcomp<<4, body)
+		case pktSubscribe:
+			if err := b.handleSubscribe(s, body); err != nil {
+				return
+			}
+		case pktUnsubscribe:
+			if len(body) < 2 {
+				return
+			}
+			for rest := body[2:]; len(rest) > 0; {
+				var filter string
+				if filter, rest, err = readMQTTString(rest); err != nil {
+					return
+				}
+				b.mu.Lock()
+				delete(s.subs, unshareFilter(filter))
+				b.mu.Unlock()
+			}
+			s.write(pktUnsuback<<4, body[:2])
+		case pktPingreq:
+			s.write(pktPingresp<<4, nil)
+		case pktDisconnect:
+			clean = true
+			return
+		default:
+			return
+		}
+	}
+}
+
+// handleConnect parses CONNECT, checks the credentials and returns the
+// keep-alive interval
+func (b *embeddedBroker) handleConnect(s *brokerSession, body []byte) (time.Duration, error) {
+	_, rest, err := readMQTTString(body)
+	if err != nil || len(rest) < 4 {
+		return 0, errors.New("malformed CONNECT")
+	}
+	flags := rest[1]
+	keepAlive := time.Duration(binary.BigEndian.Uint16(rest[2:4])) * time.Second
+	rest = rest[4:]
+	if s.clientID, rest, err = readMQTTString(rest); err != nil {
+		return 0, err
+	}
+	if flags&0x04 != 0 {
+		will := &brokerMessage{retain: flags&0x20 != 0}
+		if will.topic, rest, err = readMQTTString(rest); err != nil {
+			return 0, err
+		}
+		var payload string
+		if payload, rest, err = readMQTTString(rest); err != nil {
+			return 0, err
+		}
+		will.payload = []byte(payload)
+		s.will = will
+	}
+	var username, password string
+	if flags&0x80 != 0 {
+		if username, rest, err = readMQTTString(rest); err != nil {
+			return 0, err
+		}
+	}
+	if flags&0x40 != 0 {
+		if password, _, err = readMQTTString(rest); err != nil {
+			return 0, err
+		}
+	}
+	if b.username != "" && (subtle.ConstantTimeCompare([]byte(username), []byte(b.username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(b.password)) != 1) {
+		return 0, errNotAuthorized
+	}
+	if s.clientID == "" {
+		s.clientID = s.conn.RemoteAddr().String()
+	}
+	return keepAlive, nil
+}
+
+func (b *embeddedBroker) handlePublish(s *brokerSession, header byte, body []byte) error {
+	topic, rest, err := readMQTTString(body)
+	if err != nil {
+		return err
+	}
+	qos := (header >> 1) & 0x03
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("malformed PUBLISH")
+		}
+		id := rest[:2]
+		rest = rest[2:]
+		if qos == 1 {
+			s.write(pktPuback<<4, id)
+		} else {
+			s.write(pktPubrec<<4, id)
+		}
+	}
+	b.publish(topic, rest, header&0x01 != 0)
+	return nil
+}
+
+func (b *embeddedBroker) handleSubscribe(s *brokerSession, body []byte) error {
+	if len(body) < 2 {
+		return errors.New("malformed SUBSCRIBE")
+	}
+	ack := append([]byte{}, body[:2]...)
+	var filters []string
+	for rest := body[2:]; len(rest) > 0; {
+		filter, next, err := readMQTTString(rest)
+		if err != nil || len(next) < 1 {
+			return errors.New("malformed SUBSCRIBE")
+		}
+		rest = next[1:]
+		filters = append(filters, unshareFilter(filter))
+		ack = append(ack, 0) // granted QoS 0
+	}
+
+	b.mu.Lock()
+	for _, f := range filters {
+		s.subs[f] = struct{}{}
+	}
+	var retained []brokerMessage
+	for topic, payload := range b.retained {
+		for _, f := range filters {
+			if mqttTopicMatches(f, topic) {
+				retained = append(retained, brokerMessage{topic: topic, payload: payload, retain: true})
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	s.write(pktSuback<<4, ack)
+	for _, m := range retained {
+		s.send(m)
+	}
+	return nil
+}
+
+// publish stores retained messages and delivers to matching subscribers
+func (b *embeddedBroker) publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = append([]byte(nil), payload...)
+		}
+	}
+	var targets []*brokerSession
+	for s := range b.sessions {
+		for f := range s.subs {
+			if mqttTopicMatches(f, topic) {
+				targets = append(targets, s)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+
+	for _, s := range targets {
+		s.send(brokerMessage{topic: topic, payload: payload})
+	}
+}
+
+// send writes a QoS 0 PUBLISH to the session
+func (s *brokerSession) send(m brokerMessage) {
+	header := byte(pktPublish << 4)
+	if m.retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, m.topic)
+	body = append(body, m.payload...)
+	s.write(header, body)
+}
+
+func (s *brokerSession) write(header byte, body []byte) {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(packet); err != nil {
+		s.conn.Close()
+	}
+}
+
+// Close stops the listener and disconnects every client
+func (b *embeddedBroker) Close() {
+	b.listener.Close()
+	b.mu.Lock()
+	for s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// unshareFilter strips the $share/<group>/ prefix of a shared subscription
+// (as used by bridges with MQTT_SHARED_GROUP); the embedded broker delivers
+// to every subscriber instead of load-balancing within the group
+func unshareFilter(filter string) string {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		if group, pattern, ok := strings.Cut(rest, "/"); ok && group != "" && pattern != "" {
+			return pattern
+		}
+	}
+	return filter
+}
+
+// mqttTopicMatches reports whether a topic matches a filter with + and #
+// wildcards
+func mqttTopicMatches(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func startTestBroker(t *testing.T, username, password string) *embeddedBroker {
+	t.Helper()
+	b, err := startEmbeddedBroker("127.0.0.1:0", username, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+func connectTestClient(b *embeddedBroker, clientID, username, password string) (mqtt.Client, error) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker("tcp://" + b.listener.Addr().String())
+	opts.SetClientID(clientID)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(false)
+	opts.SetConnectRetry(false)
+	opts.SetConnectTimeout(2 * time.Second)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(3 * time.Second) {
+		return nil, mqtt.ErrNotConnected
+	}
+	return client, token.Error()
+}
+
+func receive(t *testing.T, ch <-chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestEmbeddedBrokerPublishSubscribe(t *testing.T) {
+	b := startTestBroker(t, "", "")
+	b.publish("fallback/spool", []byte(`{"pending":true}`), true)
+
+	sub, err := connectTestClient(b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+	messages := make(chan mqtt.Message, 10)
+	handler := func(_ mqtt.Client, msg mqtt.Message) { messages <- msg }
+	for _, filter := range []string{"$share/bridges/telemetry/#", "fallback/spool"} {
+		if token := sub.Subscribe(filter, 1, handler); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+	}
+	if msg := receive(t, messages); msg.Topic() != "fallback/spool" || !msg.Retained() {
+		t.Fatalf("retained message: got %s (retained %v)", msg.Topic(), msg.Retained())
+	}
+
+	pub, err := connectTestClient(b, "pub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Disconnect(0)
+	if token := pub.Publish("telemetry/01", 1, false, `{"room_id":"01"}`); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	msg := receive(t, messages)
+	if msg.Topic() != "telemetry/01" || string(msg.Payload()) != `{"room_id":"01"}` {
+		t.Fatalf("got %s %s", msg.Topic(), msg.Payload())
+	}
+
+	// Not subscribed
+	pub.Publish("events/01", 0, false, "x").Wait()
+	b.publish("telemetry/02", []byte("y"), false)
+	if msg := receive(t, messages); msg.Topic() != "telemetry/02" {
+		t.Fatalf("unexpected message on %s", msg.Topic())
+	}
+}
+
+func TestEmbeddedBrokerAuth(t *testing.T) {
+	b := startTestBroker(t, "bridge", "secret")
+	for _, tc := range []struct {
+		username, password string
+		ok                 bool
+	}{
+		{"bridge", "secret", true},
+		{"bridge", "wrong", false},
+		{"other", "secret", false},
+		{"", "", false},
+	} {
+		client, err := connectTestClient(b, "c-"+tc.username+"-"+tc.password, tc.username, tc.password)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q/%q: connect error %v, want ok=%v", tc.username, tc.password, err, tc.ok)
+		}
+		if err == nil {
+			client.Disconnect(0)
+		}
+	}
+}
+
+func TestEmbeddedBrokerWill(t *testing.T) {
+	b := startTestBroker(t, "", "")
+	sub, err := connectTestClient(b, "sub", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Disconnect(0)
+	messages := make(chan mqtt.Message, 1)
+	if token := sub.Subscribe("status/#", 0, func(_ mqtt.Client, msg mqtt.Message) { messages <- msg }); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	// Closing the connection without DISCONNECT publishes the will
+	var connect bytes.Buffer
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, 0x04|0x02, 0, 0)
+	body = appendMQTTString(body, "dying")
+	body = appendMQTTString(body, "status/dying")
+	body = appendMQTTString(body, "offline")
+	connect.WriteByte(pktConnect << 4)
+	connect.WriteByte(byte(len(body)))
+	connect.Write(body)
+	conn, err := net.Dial("tcp", b.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write(connect.Bytes())
+	header, _, err := readMQTTPacket(bufio.NewReader(conn))
+	if err != nil || header>>4 != pktConnack {
+		t.Fatalf("CONNACK: header %x, %v", header, err)
+	}
+	conn.Close()
+	if msg := receive(t, messages); msg.Topic() != "status/dying" || string(msg.Payload()) != "offline" {
+		t.Fatalf("will: got %s %s", msg.Topic(), msg.Payload())
+	}
+}
+
+func TestReadMQTTPacket(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		body []byte
+		ok   bool
+	}{
+		{"empty body", []byte{pktPingreq << 4, 0}, []byte{}, true},
+		{"two-byte length", append([]byte{pktPublish << 4, 0x80, 0x01}, make([]byte, 128)...), make([]byte, 128), true},
+		{"length too long", []byte{pktPublish << 4, 0xff, 0xff, 0xff, 0xff, 0x01}, nil, false},
+		{"truncated body", []byte{pktPublish << 4, 5, 1, 2}, nil, false},
+		{"missing length", []byte{pktPublish << 4}, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, body, err := readMQTTPacket(bufio.NewReader(bytes.NewReader(tc.data)))
+			if (err == nil) != tc.ok {
+				t.Fatalf("error %v, want ok=%v", err, tc.ok)
+			}
+			if tc.ok && !bytes.Equal(body, tc.body) {
+				t.Fatalf("body %v, want %v", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestMQTTTopicMatches(t *testing.T) {
+	for _, tc := range []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"telemetry/#", "telemetry/01", true},
+		{"telemetry/#", "telemetry/building/a/snapshot", true},
+		{"telemetry/+", "telemetry/01", true},
+		{"telemetry/+", "telemetry/01/x", false},
+		{"telemetry/01", "telemetry/01", true},
+		{"telemetry/01", "telemetry/02", false},
+		{"+/01", "events/01", true},
+		{"telemetry/+/snapshot", "telemetry/a/snapshot", true},
+		{"telemetry/+/snapshot", "telemetry/a", false},
+		{"#", "anything/at/all", true},
+	} {
+		if got := mqttTopicMatches(tc.filter, tc.topic); got != tc.want {
+			t.Errorf("mqttTopicMatches(%q, %q) = %v, want %v", tc.filter, tc.topic, got, tc.want)
+		}
+	}
+}
+
+func TestUnshareFilter(t *testing.T) {
+	for filter, want := range map[string]string{
+		"$share/bridges/ds_telemetry/#": "ds_telemetry/#",
+		"ds_telemetry/#":                "ds_telemetry/#",
+		"$share//telemetry/#":           "$share//telemetry/#",
+		"$share/bridges":                "$share/bridges",
+	} {
+		if got := unshareFilter(filter); got != want {
+			t.Errorf("unshareFilter(%q) = %q, want %q", filter, got, want)
+		}
+	}
+}
+
+func TestFallbackOpenListener(t *testing.T) {
+	for _, tc := range []struct {
+		config FallbackBrokerConfig
+		want   bool
+	}{
+		{FallbackBrokerConfig{ListenAddr: ":1884"}, true},
+		{FallbackBrokerConfig{ListenAddr: "0.0.0.0:1884"}, true},
+		{FallbackBrokerConfig{ListenAddr: "gateway:1884"}, true},
+		{FallbackBrokerConfig{ListenAddr: "127.0.0.1:1884"}, false},
+		{FallbackBrokerConfig{ListenAddr: "[::1]:1884"}, false},
+		{FallbackBrokerConfig{ListenAddr: "localhost:1884"}, false},
+		{FallbackBrokerConfig{ListenAddr: ":1884", Username: "bridge"}, false},
+	} {
+		if got := tc.config.openListener(); got != tc.want {
+			t.Errorf("openListener(%+v) = %v, want %v", tc.config, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// EmptyRoomsConfig suppresses the telemetry of rooms without data instead
+// of publishing all-zero telemetry for them. A room is empty when none of
+// its sensors has an ok reading younger than StaleFactor poll intervals
+// (MaxAgeSec for sensors without one, e.g. pushed values). When a room
+// becomes empty a retained "no_data" status is published on
+// status/room/<room_id>/data and its telemetry stops, including from the
+// history and rollups; the status is cleared when data returns. Rooms
+// waiting for their first readings after startup are not published either,
+// but only reported empty once their sensors would have gone stale.
+type EmptyRoomsConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	StaleFactor float64 `yaml:"stale_factor"`
+	MaxAgeSec   int     `yaml:"max_age_sec"`
+}
+
+func (c *EmptyRoomsConfig) normalize() {
+	if c.StaleFactor <= 1 {
+		c.StaleFactor = 3
+	}
+	if c.MaxAgeSec <= 0 {
+		c.MaxAgeSec = 900
+	}
+}
+
+// RoomDataStatus is published retained on status/room/<room_id>/data while
+// a room has no data
+type RoomDataStatus struct {
+	RoomID    string `json:"room_id"`
+	GatewayID string `json:"gateway_id"`
+	Status    string `json:"status"`
+	Since     string `json:"since"`
+	// LastReading is the time of the room's most recent reading, if any
+	LastReading string `json:"last_reading,omitempty"`
+}
+
+// emptyRooms tracks the rooms whose telemetry is suppressed
+type emptyRooms struct {
+	config    *EmptyRoomsConfig
+	intervals map[string]time.Duration
+	started   time.Time
+	mu        sync.Mutex
+	since     map[string]time.Time
+	// checked holds the rooms judged since startup; a status retained
+	// before a restart is cleared the first time the room has data
+	checked map[string]bool
+}
+
+func newEmptyRooms(config *EmptyRoomsConfig, intervals map[string]time.Duration, now time.Time) *emptyRooms {
+	return &emptyRooms{
+		config:    config,
+		intervals: intervals,
+		started:   now,
+		since:     make(map[string]time.Time),
+		checked:   make(map[string]bool),
+	}
+}
+
+func roomDataTopic(roomID string) string {
+	return fmt.Sprintf("status/room/%s/data", roomID)
+}
+
+// roomFreshness reports whether any sensor of a room has a fresh ok
+// reading, whether one may still deliver its first reading, and the time of
+// the room's latest reading
+func (gw *Gateway) roomFreshness(room *RoomConfig, now time.Time) (fresh, pending bool, last time.Time) {
+	e := gw.emptyRooms
+	gw.readingsMutex.RLock()
+	defer gw.readingsMutex.RUnlock()
+	for _, sensorID := range room.Sensors {
+		maxAge := time.Duration(e.config.MaxAgeSec) * time.Second
+		if interval := e.intervals[sensorID]; interval > 0 {
+			maxAge = time.Duration(e.config.StaleFactor * float64(interval))
+		}
+		reading, ok := gw.lastReadings[sensorID]
+		if !ok {
+			pending = pending || now.Sub(e.started) <= maxAge
+			continue
+		}
+		if reading.Timestamp.After(last) {
+			last = reading.Timestamp
+		}
+		if reading.Status == "ok" && now.Sub(reading.Timestamp) <= maxAge {
+			fresh = true
+		}
+	}
+	return fresh, pending, last
+}
+
+// withData returns the due rooms that have data, publishing the retained
+// status of rooms that became empty or recovered
+func (gw *Gateway) withData(due []string, now time.Time) []string {
+	e := gw.emptyRooms
+	if e == nil {
+		return due
+	}
+	rooms := make([]string, 0, len(due))
+	for _, roomID := range due {
+		fresh, pending, last := gw.roomFreshness(gw.rooms[roomID], now)
+		if !fresh && pending {
+			continue
+		}
+		e.mu.Lock()
+		since, empty := e.since[roomID]
+		first := !e.checked[roomID]
+		e.checked[roomID] = true
+		switch {
+		case fresh && empty:
+			delete(e.since, roomID)
+		case !fresh && !empty:
+			e.since[roomID] = now
+		}
+		e.mu.Unlock()
+
+		if fresh {
+			rooms = append(rooms, roomID)
+			if empty {
+				log.Printf("[EVENT] Room %s has data again after %s, resuming telemetry", roomID, now.Sub(since).Round(time.Second))
+			}
+			if empty || first {
+				gw.publishRoomDataStatus(roomID, nil)
+			}
+			continue
+		}
+		if !empty {
+			log.Printf("[EVENT] Room %s has no fresh readings, suppressing its telemetry", roomID)
+			gw.schedule.forget(roomID)
+			status := RoomDataStatus{
+				RoomID:    roomID,
+				GatewayID: gw.settings.GatewayID,
+				Status:    "no_data",
+				Since:     now.Format(time.RFC3339),
+			}
+			if !last.IsZero() {
+				status.LastReading = last.Format(time.RFC3339)
+			}
+			payload, _ := json.Marshal(status)
+			gw.publishRoomDataStatus(roomID, payload)
+		}
+	}
+	return rooms
+}
+
+// publishRoomDataStatus publishes a room's retained data status; an empty
+// payload clears it
+func (gw *Gateway) publishRoomDataStatus(roomID string, payload []byte) {
+	topic := roomDataTopic(roomID)
+	token := gw.mqttClient.Publish(topic, 1, true, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
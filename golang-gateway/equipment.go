@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// EquipmentConfig describes a piece of HVAC plant (AHU, chiller, boiler, ...)
+// and the zones or floors it serves. Points maps a role such as supply_temp,
+// return_temp or status to the sensor that provides it.
+type EquipmentConfig struct {
+	ID           string            `yaml:"id"`
+	Name         string            `yaml:"name"`
+	Type         string            `yaml:"type"`
+	ServesZones  []string          `yaml:"serves_zones,omitempty"`
+	ServesFloors []int             `yaml:"serves_floors,omitempty"`
+	Points       map[string]string `yaml:"points"`
+
+	// Medium ("air" or "water") selects the thermal load calculation; it
+	// defaults to water for hydronic plant types and air otherwise
+	Medium      string  `yaml:"medium,omitempty"`
+	PressureKPa float64 `yaml:"pressure_kpa,omitempty"`
+}
+
+// EquipmentTelemetry is published on equipment/<equipment_id>
+type EquipmentTelemetry struct {
+	EquipmentID  string             `json:"equipment_id"`
+	Type         string             `json:"type"`
+	ServesZones  []string           `json:"serves_zones,omitempty"`
+	ServesFloors []int              `json:"serves_floors,omitempty"`
+	SupplyTemp   *float64           `json:"supply_temp,omitempty"`
+	ReturnTemp   *float64           `json:"return_temp,omitempty"`
+	Running      *bool              `json:"running,omitempty"`
+	RuntimeHours float64            `json:"runtime_hours"`
+	CycleCount   int64              `json:"cycle_count"`
+	Points       map[string]float64 `json:"points,omitempty"`
+	Timestamp    string             `json:"timestamp"`
+
+	// Plant metrics computed from the supply/return points, see
+	// computePlantMetrics
+	DeltaT         *float64 `json:"delta_t,omitempty"`
+	SupplyEnthalpy *float64 `json:"supply_enthalpy_kj_kg,omitempty"`
+	ReturnEnthalpy *float64 `json:"return_enthalpy_kj_kg,omitempty"`
+	ThermalLoadKW  *float64 `json:"thermal_load_kw,omitempty"`
+}
+
+// Well-known equipment point roles; any other role is reported under Points
+const (
+	pointSupplyTemp = "supply_temp"
+	pointReturnTemp = "return_temp"
+	pointStatus     = "status"
+)
+
+// validateEquipment checks that every equipment point references a known sensor
+func (gw *Gateway) validateEquipment() error {
+	for _, eq := range gw.settings.Equipment {
+		if eq.ID == "" {
+			return fmt.Errorf("equipment entry without id")
+		}
+		if eq.Medium != "" && eq.Medium != "air" && eq.Medium != "water" {
+			return fmt.Errorf("equipment %s has unknown medium %q", eq.ID, eq.Medium)
+		}
+		for role, sensorID := range eq.Points {
+			if _, ok := gw.sensors[sensorID]; !ok {
+				return fmt.Errorf("equipment %s point %s references unknown sensor %s", eq.ID, role, sensorID)
+			}
+		}
+	}
+	return nil
+}
+
+func (gw *Gateway) publishEquipmentData() {
+	defer gw.wg.Done()
+
+	interval := gw.telemetryInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			telemetries := make([]*EquipmentTelemetry, 0, len(gw.settings.Equipment))
+			for i := range gw.settings.Equipment {
+				eq := &gw.settings.Equipment[i]
+				telemetry := gw.aggregateEquipmentData(eq)
+				gw.publishEquipmentTelemetry(eq, telemetry)
+				telemetries = append(telemetries, telemetry)
+			}
+			for _, rollup := range plantRollups(telemetries, time.Now()) {
+				gw.publishPlantRollup(rollup)
+			}
+		}
+	}
+}
+
+func (gw *Gateway) aggregateEquipmentData(eq *EquipmentConfig) *EquipmentTelemetry {
+	now := time.Now()
+	telemetry := &EquipmentTelemetry{
+		EquipmentID:  eq.ID,
+		Type:         eq.Type,
+		ServesZones:  eq.ServesZones,
+		ServesFloors: eq.ServesFloors,
+		Timestamp:    now.Format(time.RFC3339),
+	}
+
+	roles := make([]string, 0, len(eq.Points))
+	for role := range eq.Points {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+
+	gw.readingsMutex.RLock()
+	for _, role := range roles {
+		reading, ok := gw.lastReadings[eq.Points[role]]
+		if !ok || reading.Status != "ok" {
+			continue
+		}
+		switch role {
+		case pointSupplyTemp:
+			telemetry.SupplyTemp = floatPtr(reading.Value)
+		case pointReturnTemp:
+			telemetry.ReturnTemp = floatPtr(reading.Value)
+		case pointStatus:
+			running := reading.Value >= 0.5
+			telemetry.Running = &running
+		default:
+			if telemetry.Points == nil {
+				telemetry.Points = make(map[string]float64)
+			}
+			telemetry.Points[role] = reading.Value
+		}
+	}
+	gw.readingsMutex.RUnlock()
+
+	if counter, ok := gw.runtime.counter(eq.Points[pointStatus]); ok {
+		telemetry.RuntimeHours = counter.RuntimeHours
+		telemetry.CycleCount = counter.Cycles
+	}
+	computePlantMetrics(eq, telemetry)
+	return telemetry
+}
+
+func (gw *Gateway) publishEquipmentTelemetry(eq *EquipmentConfig, telemetry *EquipmentTelemetry) {
+	topic := fmt.Sprintf("equipment/%s", eq.ID)
+
+	payload, err := json.Marshal(telemetry)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal telemetry for equipment %s: %v", eq.ID, err)
+		return
+	}
+
+	token := gw.mqttClient.Publish(topic, 0, false, payload)
+	token.Wait()
+
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	} else {
+		log.Printf("[MQTT] Published to %s", topic)
+	}
+}
+
+// PlantRollup sums the equipment serving a zone or floor and is published
+// on plant/<zone|floor>/<id>. Temperatures are averaged over the units
+// reporting them; the thermal load is summed over those that compute one.
+type PlantRollup struct {
+	Group         string   `json:"group"`
+	ID            string   `json:"id"`
+	Equipment     []string `json:"equipment"`
+	Running       int      `json:"running"`
+	RuntimeHours  float64  `json:"runtime_hours"`
+	SupplyTemp    *float64 `json:"supply_temp,omitempty"`
+	ReturnTemp    *float64 `json:"return_temp,omitempty"`
+	ThermalLoadKW *float64 `json:"thermal_load_kw,omitempty"`
+	Timestamp     string   `json:"timestamp"`
+
+	supplySum, returnSum float64
+	supplyN, returnN     int
+}
+
+// plantRollups groups equipment telemetry by the zones and floors served,
+// sorted by group and ID
+func plantRollups(telemetries []*EquipmentTelemetry, now time.Time) []*PlantRollup {
+	rollups := make(map[string]*PlantRollup)
+	add := func(group, id string, t *EquipmentTelemetry) {
+		key := group + "/" + id
+		r, ok := rollups[key]
+		if !ok {
+			r = &PlantRollup{Group: group, ID: id, Timestamp: now.Format(time.RFC3339)}
+			rollups[key] = r
+		}
+		r.Equipment = append(r.Equipment, t.EquipmentID)
+		if t.Running != nil && *t.Running {
+			r.Running++
+		}
+		r.RuntimeHours += t.RuntimeHours
+		if t.SupplyTemp != nil {
+			r.supplySum += *t.SupplyTemp
+			r.supplyN++
+		}
+		if t.ReturnTemp != nil {
+			r.returnSum += *t.ReturnTemp
+			r.returnN++
+		}
+		if t.ThermalLoadKW != nil {
+			if r.ThermalLoadKW == nil {
+				r.ThermalLoadKW = floatPtr(0)
+			}
+			*r.ThermalLoadKW += *t.ThermalLoadKW
+		}
+	}
+	for _, t := range telemetries {
+		for _, zone := range t.ServesZones {
+			add("zone", zone, t)
+		}
+		for _, floor := range t.ServesFloors {
+			add("floor", strconv.Itoa(floor), t)
+		}
+	}
+
+	keys := make([]string, 0, len(rollups))
+	for key := range rollups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*PlantRollup, 0, len(keys))
+	for _, key := range keys {
+		r := rollups[key]
+		if r.supplyN > 0 {
+			r.SupplyTemp = floatPtr(r.supplySum / float64(r.supplyN))
+		}
+		if r.returnN > 0 {
+			r.ReturnTemp = floatPtr(r.returnSum / float64(r.returnN))
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+func (gw *Gateway) publishPlantRollup(rollup *PlantRollup) {
+	topic := fmt.Sprintf("plant/%s/%s", rollup.Group, rollup.ID)
+	payload, err := json.Marshal(rollup)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal plant rollup for %s %s: %v", rollup.Group, rollup.ID, err)
+		return
+	}
+	token := gw.mqttClient.Publish(topic, 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
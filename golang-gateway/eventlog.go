@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types of the gateway event log
+const (
+	eventCheckpoint       = "checkpoint"
+	eventConfigLoaded     = "config_loaded"
+	eventSensorAdded      = "sensor_added"
+	eventSensorModified   = "sensor_modified"
+	eventSensorRemoved    = "sensor_removed"
+	eventRoomAdded        = "room_added"
+	eventRoomModified     = "room_modified"
+	eventRoomRemoved      = "room_removed"
+	eventReadingAccepted  = "reading_accepted"
+	eventAlarmRaised      = "alarm_raised"
+	eventAlarmEscalated   = "alarm_escalated"
+	eventAlarmCleared     = "alarm_cleared"
+	eventAlarmAcknowledge = "alarm_acknowledged"
+	eventCommandExecuted  = "command_executed"
+	eventCommandFailed    = "command_failed"
+	eventGatewayStopped   = "gateway_stopped"
+)
+
+// EventLogConfig configures event sourcing: every state change of the
+// gateway (configuration loaded and sensors or rooms added, changed or
+// removed, readings accepted, alarms raised, escalated, acknowledged and
+// cleared, commands executed, shutdown) is appended as a JSON line with a
+// sequence number to File and, with Publish, to eventlog/gateway/<id>.
+// `golang-gateway rebuild-state` folds the log back into the gateway state
+// at any point in time. The log rotates at MaxSizeMB, keeping MaxFiles
+// old files; every file starts with a checkpoint of the full state, so the
+// retained files alone rebuild it.
+type EventLogConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	File      string `yaml:"file,omitempty"`
+	MaxSizeMB int    `yaml:"max_size_mb,omitempty"`
+	MaxFiles  int    `yaml:"max_files,omitempty"`
+	// Readings selects the readings logged: changes (default, a reading
+	// whose value or text differs from the last one logged), all or none
+	Readings string `yaml:"readings,omitempty"`
+	Publish  bool   `yaml:"publish"`
+}
+
+func (c *EventLogConfig) normalize() error {
+	if c.File == "" {
+		c.File = "/app/data/events.log"
+	}
+	if c.MaxSizeMB <= 0 {
+		c.MaxSizeMB = 100
+	}
+	if c.MaxFiles <= 0 {
+		c.MaxFiles = 10
+	}
+	switch c.Readings {
+	case "":
+		c.Readings = "changes"
+	case "changes", "all", "none":
+	default:
+		return fmt.Errorf("event_log: unknown readings mode %q (changes, all or none)", c.Readings)
+	}
+	return nil
+}
+
+// GatewayEvent is one entry of the event log. Config carries the full
+// document of an added or modified sensor or room (YAML field names), so
+// the configuration can be rebuilt without the config files of the time.
+type GatewayEvent struct {
+	Seq       uint64 `json:"seq"`
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"`
+	GatewayID string `json:"gateway_id"`
+	SensorID  string `json:"sensor_id,omitempty"`
+	RoomID    string `json:"room_id,omitempty"`
+
+	Config  map[string]interface{} `json:"config,omitempty"`
+	Changed []string               `json:"changed,omitempty"`
+	// Trigger, Actor and Files describe a config load (see ConfigAuditEntry)
+	Trigger string            `json:"trigger,omitempty"`
+	Actor   string            `json:"actor,omitempty"`
+	Files   map[string]string `json:"files,omitempty"`
+
+	Reading *SensorReading `json:"reading,omitempty"`
+	Alarm   *Alarm         `json:"alarm,omitempty"`
+	Command *CommandResult `json:"command,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+
+	State *EventState `json:"state,omitempty"` // checkpoint
+}
+
+// EventState is the gateway state carried by checkpoints and rebuilt from
+// the event log
+type EventState struct {
+	Seq       uint64                            `json:"seq"`
+	Timestamp string                            `json:"timestamp,omitempty"`
+	Sensors   map[string]map[string]interface{} `json:"sensors"`
+	Rooms     map[string]map[string]interface{} `json:"rooms"`
+	Readings  map[string]*SensorReading         `json:"readings"`
+	Alarms    map[string]*Alarm                 `json:"alarms"`
+	// Commands holds the last command result of each point
+	Commands map[string]*CommandResult `json:"commands"`
+	// LastConfigLoad and StoppedReason describe the last config load and,
+	// when the gateway has shut down since, the shutdown
+	LastConfigLoad string `json:"last_config_load,omitempty"`
+	StoppedReason  string `json:"stopped_reason,omitempty"`
+}
+
+func newEventState() *EventState {
+	return &EventState{
+		Sensors:  make(map[string]map[string]interface{}),
+		Rooms:    make(map[string]map[string]interface{}),
+		Readings: make(map[string]*SensorReading),
+		Alarms:   make(map[string]*Alarm),
+		Commands: make(map[string]*CommandResult),
+	}
+}
+
+// apply folds one event into the state
+func (s *EventState) apply(event *GatewayEvent) {
+	s.Seq, s.Timestamp = event.Seq, event.Timestamp
+	switch event.Type {
+	case eventCheckpoint:
+		if event.State != nil {
+			*s = *event.State
+			s.Seq, s.Timestamp = event.Seq, event.Timestamp
+		}
+	case eventConfigLoaded:
+		s.LastConfigLoad = event.Timestamp
+		s.StoppedReason = ""
+	case eventSensorAdded, eventSensorModified:
+		s.Sensors[event.SensorID] = event.Config
+	case eventSensorRemoved:
+		delete(s.Sensors, event.SensorID)
+		delete(s.Readings, event.SensorID)
+	case eventRoomAdded, eventRoomModified:
+		s.Rooms[event.RoomID] = event.Config
+	case eventRoomRemoved:
+		delete(s.Rooms, event.RoomID)
+	case eventReadingAccepted:
+		if event.Reading != nil {
+			s.Readings[event.SensorID] = event.Reading
+		}
+	case eventAlarmRaised, eventAlarmEscalated, eventAlarmAcknowledge:
+		if event.Alarm != nil {
+			s.Alarms[event.Alarm.ID] = event.Alarm
+		}
+	case eventAlarmCleared:
+		if event.Alarm != nil {
+			delete(s.Alarms, event.Alarm.ID)
+		}
+	case eventCommandExecuted, eventCommandFailed:
+		if event.Command != nil {
+			s.Commands[event.SensorID] = event.Command
+		}
+	case eventGatewayStopped:
+		s.StoppedReason = event.Reason
+	}
+}
+
+// eventLog appends events to a size-rotated file (file, file.1 ... file.N)
+// and queues them for publishing. A nil log records nothing.
+type eventLog struct {
+	mu         sync.Mutex
+	config     *EventLogConfig
+	gatewayID  string
+	checkpoint func() *EventState
+	file       *os.File
+	size       int64
+	seq        uint64
+	logged     map[string]*SensorReading // last reading logged per sensor
+	publish    chan []byte
+	dropped    int
+}
+
+// openEventLog opens the log, continuing the sequence of the events
+// already in it; checkpoint returns the current gateway state, written at
+// the start of an empty log and of every rotated file
+func openEventLog(config *EventLogConfig, gatewayID string, checkpoint func() *EventState) (*eventLog, error) {
+	if err := os.MkdirAll(filepath.Dir(config.File), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create event log directory: %w", err)
+	}
+	l := &eventLog{
+		config:     config,
+		gatewayID:  gatewayID,
+		checkpoint: checkpoint,
+		logged:     make(map[string]*SensorReading),
+	}
+	if config.Publish {
+		l.publish = make(chan []byte, 1024)
+	}
+	seq, err := lastEventSeq(config.File)
+	if err != nil {
+		return nil, err
+	}
+	l.seq = seq
+	if err := l.openLocked(); err != nil {
+		return nil, err
+	}
+	if seq == 0 {
+		l.writeCheckpointLocked()
+	}
+	log.Printf("Event log %s opened at sequence %d", config.File, l.seq)
+	return l, nil
+}
+
+// lastEventSeq returns the sequence number of the last event in the log or,
+// when the current file is empty after a rotation, in the newest old file
+func lastEventSeq(path string) (uint64, error) {
+	for _, name := range []string{path, path + ".1"} {
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to open event log: %w", err)
+		}
+		var seq uint64
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var event struct {
+				Seq uint64 `json:"seq"`
+			}
+			// A line torn by a crash is skipped
+			if json.Unmarshal(scanner.Bytes(), &event) == nil && event.Seq > seq {
+				seq = event.Seq
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to read event log %s: %w", name, err)
+		}
+		if seq > 0 {
+			return seq, nil
+		}
+	}
+	return 0, nil
+}
+
+func (l *eventLog) openLocked() error {
+	f, err := os.OpenFile(l.config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat event log: %w", err)
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// append numbers and writes an event
+func (l *eventLog) append(event GatewayEvent) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked(&event)
+}
+
+func (l *eventLog) appendLocked(event *GatewayEvent) {
+	if l.file == nil {
+		return
+	}
+	l.seq++
+	event.Seq = l.seq
+	event.GatewayID = l.gatewayID
+	if event.Timestamp == "" {
+		event.Timestamp = time.Now().Format(time.RFC3339Nano)
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal %s event: %v", event.Type, err)
+		return
+	}
+
+	if l.size+int64(len(line))+1 > int64(l.config.MaxSizeMB)*1024*1024 && event.Type != eventCheckpoint {
+		if err := l.rotateLocked(); err != nil {
+			log.Printf("[ERROR] Failed to rotate event log: %v", err)
+			return
+		}
+		// The new file starts with a checkpoint; the event follows it
+		l.writeCheckpointLocked()
+		l.seq++
+		event.Seq = l.seq
+		line, _ = json.Marshal(event)
+	}
+
+	n, err := l.file.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("[ERROR] Failed to write event log: %v", err)
+		return
+	}
+	if l.publish != nil {
+		select {
+		case l.publish <- line:
+		default:
+			l.dropped++
+			if l.dropped == 1 || l.dropped%1000 == 0 {
+				log.Printf("[WARN] Event log publish queue full, %d events not published", l.dropped)
+			}
+		}
+	}
+}
+
+func (l *eventLog) writeCheckpointLocked() {
+	l.appendLocked(&GatewayEvent{Type: eventCheckpoint, State: l.checkpoint()})
+}
+
+// rotateLocked shifts file.N-1 -> file.N ... file -> file.1, dropping the
+// oldest, and opens a new file
+func (l *eventLog) rotateLocked() error {
+	l.file.Close()
+	l.file = nil
+	base := l.config.File
+	os.Remove(fmt.Sprintf("%s.%d", base, l.config.MaxFiles))
+	for i := l.config.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+	if err := os.Rename(base, base+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return l.openLocked()
+}
+
+// reading logs an accepted reading according to the readings mode
+func (l *eventLog) reading(reading *SensorReading) {
+	if l == nil || l.config.Readings == "none" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	last := l.logged[reading.SensorID]
+	if l.config.Readings == "changes" && last != nil && last.Value == reading.Value && last.StringValue == reading.StringValue {
+		return
+	}
+	copied := *reading
+	l.logged[reading.SensorID] = &copied
+	l.appendLocked(&GatewayEvent{
+		Type:     eventReadingAccepted,
+		SensorID: reading.SensorID,
+		RoomID:   reading.RoomID,
+		Reading:  &copied,
+	})
+}
+
+// alarm logs an alarm state change
+func (l *eventLog) alarm(eventType string, alarm *Alarm) {
+	if l == nil {
+		return
+	}
+	copied := *alarm
+	l.append(GatewayEvent{Type: eventType, RoomID: alarm.RoomID, Alarm: &copied})
+}
+
+// configLoaded logs a config load and the sensors and rooms it added,
+// changed or removed
+func (l *eventLog) configLoaded(entry ConfigAuditEntry, current map[string]map[string]interface{}) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked(&GatewayEvent{
+		Type:    eventConfigLoaded,
+		Trigger: entry.Trigger,
+		Actor:   entry.Actor,
+		Files:   entry.Files,
+		Changed: entry.SettingsChanged,
+	})
+	for _, change := range []struct {
+		prefix                   string
+		diff                     ConfigDiff
+		added, modified, removed string
+	}{
+		{"sensor/", entry.Sensors, eventSensorAdded, eventSensorModified, eventSensorRemoved},
+		{"room/", entry.Rooms, eventRoomAdded, eventRoomModified, eventRoomRemoved},
+	} {
+		event := func(eventType, id string) *GatewayEvent {
+			if change.prefix == "sensor/" {
+				return &GatewayEvent{Type: eventType, SensorID: id}
+			}
+			return &GatewayEvent{Type: eventType, RoomID: id}
+		}
+		for _, id := range change.diff.Added {
+			e := event(change.added, id)
+			e.Config = current[change.prefix+id]
+			l.appendLocked(e)
+		}
+		modified := make([]string, 0, len(change.diff.Modified))
+		for id := range change.diff.Modified {
+			modified = append(modified, id)
+		}
+		sort.Strings(modified)
+		for _, id := range modified {
+			e := event(change.modified, id)
+			e.Config = current[change.prefix+id]
+			e.Changed = change.diff.Modified[id]
+			l.appendLocked(e)
+		}
+		for _, id := range change.diff.Removed {
+			l.appendLocked(event(change.removed, id))
+		}
+	}
+}
+
+func (l *eventLog) close(reason string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.appendLocked(&GatewayEvent{Type: eventGatewayStopped, Reason: reason})
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// eventCheckpoint captures the configuration, last readings and active
+// alarms for a checkpoint event
+func (gw *Gateway) eventCheckpoint() *EventState {
+	state := newEventState()
+	for key, doc := range gw.configSnapshot() {
+		switch {
+		case strings.HasPrefix(key, "sensor/"):
+			state.Sensors[strings.TrimPrefix(key, "sensor/")] = doc
+		case strings.HasPrefix(key, "room/"):
+			state.Rooms[strings.TrimPrefix(key, "room/")] = doc
+		}
+	}
+	gw.readingsMutex.RLock()
+	for id, reading := range gw.lastReadings {
+		if reading.Status == "ok" {
+			copied := *reading
+			state.Readings[id] = &copied
+		}
+	}
+	gw.readingsMutex.RUnlock()
+	if gw.alarms != nil {
+		for _, alarm := range gw.alarms.list() {
+			copied := alarm
+			state.Alarms[alarm.ID] = &copied
+		}
+	}
+	return state
+}
+
+// publishEventLog publishes logged events on eventlog/gateway/<gateway_id>
+func (gw *Gateway) publishEventLog() {
+	defer gw.wg.Done()
+
+	topic := fmt.Sprintf("eventlog/gateway/%s", gw.settings.GatewayID)
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case payload := <-gw.events.publish:
+			token := gw.mqttClient.Publish(topic, 1, false, payload)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+			}
+		}
+	}
+}
+
+// runRebuildState implements `golang-gateway rebuild-state`: it replays the
+// event log, oldest rotated file first, and prints the gateway state as of
+// -until or -seq (default the end of the log) as JSON. It returns the
+// process exit code.
+func runRebuildState(args []string) int {
+	fs := flag.NewFlagSet("rebuild-state", flag.ContinueOnError)
+	path := fs.String("file", getEnv("EVENT_LOG", "/app/data/events.log"), "event log to replay")
+	until := fs.String("until", "", "stop after the last event at or before this RFC 3339 time")
+	untilSeq := fs.Uint64("seq", 0, "stop after the event with this sequence number")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var limit time.Time
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -until: %v\n", err)
+			return 2
+		}
+		limit = t
+	}
+
+	files, _ := filepath.Glob(*path + ".*")
+	rotated := make(map[int]string)
+	for _, name := range files {
+		var n int
+		if _, err := fmt.Sscanf(name[len(*path):], ".%d", &n); err == nil && fmt.Sprintf("%s.%d", *path, n) == name {
+			rotated[n] = name
+		}
+	}
+	order := make([]int, 0, len(rotated))
+	for n := range rotated {
+		order = append(order, n)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(order)))
+	names := make([]string, 0, len(order)+1)
+	for _, n := range order {
+		names = append(names, rotated[n])
+	}
+	names = append(names, *path)
+
+	state := newEventState()
+	var replayed int
+	for _, name := range names {
+		done, n, err := replayEventFile(name, state, limit, *untilSeq)
+		replayed += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		if done {
+			break
+		}
+	}
+	if replayed == 0 {
+		fmt.Fprintf(os.Stderr, "no events in %s\n", *path)
+		return 1
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(state); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// replayEventFile applies the events of one file; done reports that the
+// limit was reached
+func replayEventFile(name string, state *EventState, until time.Time, untilSeq uint64) (done bool, replayed int, err error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event GatewayEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("[WARN] %s:%d: skipping unreadable event: %v", name, line, err)
+			continue
+		}
+		if event.Seq <= state.Seq {
+			continue // already applied from an older file
+		}
+		if !until.IsZero() {
+			if at, err := time.Parse(time.RFC3339Nano, event.Timestamp); err == nil && at.After(until) {
+				return true, replayed, nil
+			}
+		}
+		if untilSeq > 0 && event.Seq > untilSeq {
+			return true, replayed, nil
+		}
+		state.apply(&event)
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return false, replayed, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return false, replayed, nil
+}
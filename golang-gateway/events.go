@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// binaryEventTypes are sensor types whose state changes are published as
+// events immediately instead of waiting for the next aggregation tick
+var binaryEventTypes = map[string]bool{
+	"leak":    true,
+	"contact": true,
+}
+
+// binaryState tracks the debounced/latched state of a binary sensor
+type binaryState struct {
+	active     bool
+	lastActive time.Time
+}
+
+// SensorEvent is published on events/<room_id>/<sensor_id> when a binary
+// sensor changes state
+type SensorEvent struct {
+	SensorID  string `json:"sensor_id"`
+	RoomID    string `json:"room_id"`
+	Type      string `json:"type"`
+	Active    bool   `json:"active"`
+	Raw       bool   `json:"raw"`
+	Latched   bool   `json:"latched"`
+	Timestamp string `json:"timestamp"`
+	// Maintenance marks events of a sensor under planned work
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+type binaryStateTracker struct {
+	mu     sync.Mutex
+	states map[string]*binaryState
+}
+
+func newBinaryStateTracker() *binaryStateTracker {
+	return &binaryStateTracker{states: make(map[string]*binaryState)}
+}
+
+// update applies a raw reading and returns the resulting (possibly latched)
+// state and whether it changed. An active state is held for LatchMs after the
+// raw input clears.
+func (t *binaryStateTracker) update(sensorID string, config *SensorConfig, raw bool, now time.Time) (active, changed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Sensors start out inactive, so the first reading only raises an event
+	// if it is already active
+	state, exists := t.states[sensorID]
+	if !exists {
+		state = &binaryState{}
+		t.states[sensorID] = state
+	}
+	if raw {
+		state.lastActive = now
+	}
+	active = raw
+	if !raw && config.LatchMs > 0 && !state.lastActive.IsZero() {
+		active = now.Sub(state.lastActive) < time.Duration(config.LatchMs)*time.Millisecond
+	}
+	changed = active != state.active
+	state.active = active
+	return active, changed
+}
+
+// active returns the current state of a binary sensor
+func (t *binaryStateTracker) active(sensorID string) (bool, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.states[sensorID]
+	if !ok {
+		return false, false
+	}
+	return state.active, true
+}
+
+// handleBinaryReading updates the state of a leak/contact sensor and publishes
+// an event on every edge
+func (gw *Gateway) handleBinaryReading(sensorID, roomID string, config *SensorConfig, value float64) {
+	raw := value >= 0.5
+	now := time.Now()
+	active, changed := gw.binaryStates.update(sensorID, config, raw, now)
+	if !changed {
+		return
+	}
+
+	event := SensorEvent{
+		SensorID:    sensorID,
+		RoomID:      roomID,
+		Type:        config.Type,
+		Active:      active,
+		Raw:         raw,
+		Latched:     active && !raw,
+		Timestamp:   now.Format(time.RFC3339),
+		Maintenance: gw.inMaintenance(sensorID),
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal event for sensor %s: %v", sensorID, err)
+		return
+	}
+
+	topic := fmt.Sprintf("events/%s/%s", roomID, sensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish event to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[EVENT] %s %s active=%v", config.Type, sensorID, active)
+
+	if gw.alarms == nil {
+		return
+	}
+	if !active {
+		gw.clearAlarm(roomID, sensorID)
+		return
+	}
+	if gw.inMaintenance(sensorID) {
+		log.Printf("[EVENT] %s %s active during maintenance, no alarm raised", config.Type, sensorID)
+		return
+	}
+	severity := gw.settings.Alarms.ContactSeverity
+	if config.Type == "leak" {
+		severity = gw.settings.Alarms.LeakSeverity
+	}
+	gw.raiseAlarm(roomID, sensorID, config.Type, severity, fmt.Sprintf("%s %s active", config.Type, sensorID), false)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleExport serves GET /export?rooms=&metrics=&from=&to=&format= as a
+// CSV (default) or XLSX download of the in-memory telemetry history, one row
+// per room and bucket. rooms and metrics are comma-separated and default to
+// all rooms the caller's tenant may see; from and to are RFC 3339 and default
+// to the last 24 hours. units selects an output profile; converted columns
+// name their unit in the header, e.g. "temperature [degF]".
+func (gw *Gateway) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeJSONError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	rooms := splitList(q.Get("rooms"))
+	if len(rooms) == 0 {
+		for id := range gw.rooms {
+			if gw.roomAllowed(r, id) {
+				rooms = append(rooms, id)
+			}
+		}
+		sort.Strings(rooms)
+	}
+	for _, id := range rooms {
+		if _, ok := gw.rooms[id]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "unknown room "+id)
+			return
+		}
+		if !gw.roomAllowed(r, id) {
+			writeJSONError(w, http.StatusForbidden, "room "+id+" belongs to another tenant")
+			return
+		}
+	}
+	metrics := splitList(q.Get("metrics"))
+	if len(metrics) == 0 {
+		metrics = gw.history.metrics()
+	}
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var out rowWriter
+	name := fmt.Sprintf("export_%s_%s", from.UTC().Format("20060102T150405Z"), to.UTC().Format("20060102T150405Z"))
+	switch format := q.Get("format"); format {
+	case "", "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, name))
+		out = &csvRowWriter{w: csv.NewWriter(w)}
+	case "xlsx":
+		w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.xlsx"`, name))
+		out = newXLSXRowWriter(w)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "unsupported format "+format)
+		return
+	}
+
+	header := []string{"timestamp", "room_id"}
+	for _, m := range metrics {
+		if unit := profile.unit(m); unit != "" {
+			m += " [" + unit + "]"
+		}
+		header = append(header, m)
+	}
+	rows := 0
+	err = out.header(header)
+	for _, roomID := range rooms {
+		for _, p := range gw.history.query(roomID, from, to) {
+			if err != nil {
+				break
+			}
+			values := make([]interface{}, 0, len(header))
+			values = append(values, p.at.UTC().Format(time.RFC3339), roomID)
+			for _, m := range metrics {
+				if v, ok := p.metrics[m]; ok {
+					values = append(values, profile.convert(m, v))
+				} else {
+					values = append(values, nil)
+				}
+			}
+			err = out.row(values)
+			rows++
+		}
+	}
+	if err == nil {
+		err = out.close()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Export failed after %d rows: %v", rows, err)
+		return
+	}
+	log.Printf("Exported %d rows for %d rooms (%s to %s)", rows, len(rooms), from.Format(time.RFC3339), to.Format(time.RFC3339))
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// rowWriter streams the export in one format; values are strings, float64s
+// or nil for empty cells
+type rowWriter interface {
+	header(names []string) error
+	row(values []interface{}) error
+	close() error
+}
+
+type csvRowWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvRowWriter) header(names []string) error {
+	return c.w.Write(names)
+}
+
+func (c *csvRowWriter) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case float64:
+			record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvRowWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// xlsxRowWriter streams a single-sheet workbook with inline strings, so rows
+// are written as they are produced without a shared string table
+type xlsxRowWriter struct {
+	zip   *zip.Writer
+	sheet io.Writer
+	rows  int
+	err   error
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRootRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Telemetry" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+)
+
+func newXLSXRowWriter(w io.Writer) *xlsxRowWriter {
+	x := &xlsxRowWriter{zip: zip.NewWriter(w)}
+	for _, part := range []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	} {
+		x.writePart(part.name, part.body)
+	}
+	if x.err == nil {
+		x.sheet, x.err = x.zip.Create("xl/worksheets/sheet1.xml")
+	}
+	x.write(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return x
+}
+
+func (x *xlsxRowWriter) writePart(name, body string) {
+	if x.err != nil {
+		return
+	}
+	var f io.Writer
+	if f, x.err = x.zip.Create(name); x.err == nil {
+		_, x.err = io.WriteString(f, body)
+	}
+}
+
+func (x *xlsxRowWriter) write(s string) {
+	if x.err == nil {
+		_, x.err = io.WriteString(x.sheet, s)
+	}
+}
+
+func (x *xlsxRowWriter) header(names []string) error {
+	values := make([]interface{}, len(names))
+	for i, n := range names {
+		values[i] = n
+	}
+	return x.row(values)
+}
+
+func (x *xlsxRowWriter) row(values []interface{}) error {
+	x.rows++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%d">`, x.rows)
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			b.WriteString(`<c t="inlineStr"><is><t>`)
+			xmlEscape(&b, v)
+			b.WriteString(`</t></is></c>`)
+		case float64:
+			fmt.Fprintf(&b, `<c><v>%s</v></c>`, strconv.FormatFloat(v, 'f', -1, 64))
+		default:
+			b.WriteString(`<c/>`)
+		}
+	}
+	b.WriteString(`</row>`)
+	x.write(b.String())
+	return x.err
+}
+
+func (x *xlsxRowWriter) close() error {
+	x.write(`</sheetData></worksheet>`)
+	if x.err != nil {
+		return x.err
+	}
+	return x.zip.Close()
+}
+
+func xmlEscape(b *strings.Builder, s string) {
+	for _, r := range s {
+		switch r {
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			b.WriteString("&amp;")
+		case '"':
+			b.WriteString("&quot;")
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
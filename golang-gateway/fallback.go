@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// FallbackBrokerConfig runs an embedded MQTT broker next to the gateway so a
+// co-located bridge keeps archiving while the central broker is down. Every
+// gateway publish is mirrored to the embedded broker; publishes made while
+// the central broker is unreachable are spooled and replayed to it, in order,
+// once the connection returns. While the spool holds messages a retained
+// SpoolState is published on fallbackSpoolTopic of the embedded broker, so
+// the bridge stays on it until the replay is done instead of receiving the
+// replayed messages a second time from the central broker.
+type FallbackBrokerConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	ListenAddr string `yaml:"listen_addr"`
+	// Username and Password are required from clients when Username is set
+	// (${VAR} expanded)
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// SpoolSize caps the messages kept for replay; the oldest are dropped
+	SpoolSize int `yaml:"spool_size"`
+}
+
+func (c *FallbackBrokerConfig) normalize() {
+	if c.ListenAddr == "" {
+		c.ListenAddr = ":1884"
+	}
+	if c.SpoolSize <= 0 {
+		c.SpoolSize = 10000
+	}
+}
+
+// openListener reports whether the embedded broker accepts clients without
+// credentials on a non-loopback address
+func (c *FallbackBrokerConfig) openListener() bool {
+	if c.Username != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil || host == "localhost" {
+		return err != nil
+	}
+	ip := net.ParseIP(host)
+	return ip == nil || !ip.IsLoopback()
+}
+
+// fallbackSpoolTopic carries the retained spool state on the embedded broker
+const fallbackSpoolTopic = "fallback/spool"
+
+// SpoolState tells the bridge whether the gateway still has messages to
+// replay to the central broker
+type SpoolState struct {
+	GatewayID string `json:"gateway_id"`
+	Pending   bool   `json:"pending"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Replay retries of a failed publish while the connection stays up
+const (
+	spoolRetryMin = time.Second
+	spoolRetryMax = 30 * time.Second
+)
+
+type spooledMessage struct {
+	topic    string
+	qos      byte
+	retained bool
+	payload  []byte
+}
+
+// fallbackClient wraps the central broker client. Publishes always reach the
+// embedded broker; they go to the central broker when it is connected and
+// are spooled otherwise.
+type fallbackClient struct {
+	mqtt.Client
+	broker    *embeddedBroker
+	config    *FallbackBrokerConfig
+	gatewayID string
+	mu        sync.Mutex
+	spool     []spooledMessage
+	dropped   int
+	// syncing is set while sync replays the spool; spool[0] is then the
+	// message in flight
+	syncing bool
+}
+
+func newFallbackClient(client mqtt.Client, broker *embeddedBroker, config *FallbackBrokerConfig, gatewayID string) *fallbackClient {
+	return &fallbackClient{Client: client, broker: broker, config: config, gatewayID: gatewayID}
+}
+
+func (c *fallbackClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	c.broker.publish(topic, data, retained)
+
+	c.mu.Lock()
+	// Keep spooling until the backlog is replayed so ordering is preserved
+	if c.Client.IsConnectionOpen() && !c.syncing && len(c.spool) == 0 {
+		c.mu.Unlock()
+		return c.Client.Publish(topic, qos, retained, payload)
+	}
+	if len(c.spool) >= c.config.SpoolSize {
+		c.dropped++
+		// The oldest message not in flight makes room
+		oldest := 0
+		if c.syncing {
+			oldest = 1
+		}
+		if oldest >= len(c.spool) {
+			c.mu.Unlock()
+			return completedToken{}
+		}
+		c.spool = append(c.spool[:oldest], c.spool[oldest+1:]...)
+	}
+	c.spool = append(c.spool, spooledMessage{topic: topic, qos: qos, retained: retained, payload: data})
+	if len(c.spool) == 1 && !c.syncing {
+		c.publishState(true)
+	}
+	// A message spooled while the connect handler's replay was finishing
+	// is replayed right away
+	resume := !c.syncing && c.Client.IsConnectionOpen()
+	c.mu.Unlock()
+	if resume {
+		go c.sync(c.Client)
+	}
+	return completedToken{}
+}
+
+// publishState publishes the retained spool state on the embedded broker;
+// it is called with mu held so states are published in order
+func (c *fallbackClient) publishState(pending bool) {
+	payload, _ := json.Marshal(SpoolState{GatewayID: c.gatewayID, Pending: pending, Timestamp: time.Now().Format(time.RFC3339)})
+	c.broker.publish(fallbackSpoolTopic, payload, true)
+}
+
+// sync replays the spool to the central broker; it runs from the connect
+// handler. A failed publish is retried with backoff while the connection
+// stays up; when it drops, the next connect resumes the replay.
+func (c *fallbackClient) sync(client mqtt.Client) {
+	c.mu.Lock()
+	if c.syncing || len(c.spool) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.syncing = true
+	if c.dropped > 0 {
+		log.Printf("[WARN] Fallback spool overflowed, %d oldest messages were not kept", c.dropped)
+		c.dropped = 0
+	}
+	c.mu.Unlock()
+
+	replayed := 0
+	start := time.Now()
+	retry := spoolRetryMin
+	for {
+		c.mu.Lock()
+		if len(c.spool) == 0 {
+			c.syncing = false
+			c.publishState(false)
+			c.mu.Unlock()
+			break
+		}
+		m := c.spool[0]
+		c.mu.Unlock()
+
+		token := client.Publish(m.topic, m.qos, m.retained, m.payload)
+		token.Wait()
+		if token.Error() != nil {
+			if !client.IsConnectionOpen() {
+				log.Printf("[ERROR] Spool replay stopped after %d messages: %v", replayed, token.Error())
+				c.mu.Lock()
+				c.syncing = false
+				c.mu.Unlock()
+				return
+			}
+			log.Printf("[ERROR] Spool replay failed after %d messages, retrying in %v: %v", replayed, retry, token.Error())
+			time.Sleep(retry)
+			retry = min(retry*2, spoolRetryMax)
+			continue
+		}
+		retry = spoolRetryMin
+		c.mu.Lock()
+		c.spool = c.spool[1:]
+		c.mu.Unlock()
+		replayed++
+	}
+	log.Printf("[MQTT] Replayed %d spooled messages to the central broker in %v", replayed, time.Since(start).Round(time.Millisecond))
+}
+
+// completedToken is returned for spooled publishes
+type completedToken struct{}
+
+func (completedToken) Wait() bool                     { return true }
+func (completedToken) WaitTimeout(time.Duration) bool { return true }
+func (completedToken) Done() <-chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+func (completedToken) Error() error { return nil }
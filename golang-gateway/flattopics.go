@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// FlatTopicsConfig additionally publishes every telemetry field on its own
+// topic, telemetry/<room_id>/<metric>, with the bare value as payload (a
+// number, or true/false), for consumers that cannot parse JSON such as
+// Node-RED flows and PLC bridges. Metric names are the JSON field names
+// (co2_ppm, temperature, ...); rule plugin KPIs are published on
+// telemetry/<room_id>/kpis/<name>.
+type FlatTopicsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Retain keeps the last value on the broker for new subscribers
+	Retain bool `yaml:"retain"`
+	// Metrics limits the published metrics; all when empty
+	Metrics []string `yaml:"metrics,omitempty"`
+}
+
+// flatTopicSkipped are telemetry fields that are metadata rather than
+// metrics
+var flatTopicSkipped = map[string]bool{
+	"room_id":              true,
+	"tenant":               true,
+	"timestamp":            true,
+	"occupancy_suppressed": true,
+	"kpis":                 true,
+	"trace_id":             true,
+	"reading_traces":       true,
+}
+
+// flatMetrics returns a room's metrics by name with their payloads.
+// Occupancy and motion withheld by privacy mode are left out rather than
+// published as zero.
+func flatMetrics(telemetry *RoomTelemetry) (map[string]string, error) {
+	data, err := json.Marshal(telemetry)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	metrics := make(map[string]string, len(fields)+len(telemetry.KPIs))
+	for name, value := range fields {
+		if flatTopicSkipped[name] {
+			continue
+		}
+		if telemetry.OccupancySuppressed && (name == "occupancy_count" || name == "motion_detected") {
+			continue
+		}
+		switch v := value.(type) {
+		case float64:
+			metrics[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			metrics[name] = strconv.FormatBool(v)
+		}
+	}
+	for name, value := range telemetry.KPIs {
+		metrics["kpis/"+name] = strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return metrics, nil
+}
+
+// publishFlatTelemetry publishes a room's metrics on per-metric topics,
+// also under the tenant prefix when tenant topics are enabled
+func (gw *Gateway) publishFlatTelemetry(telemetry *RoomTelemetry) {
+	config := &gw.settings.FlatTopics
+	metrics, err := flatMetrics(telemetry)
+	if err != nil {
+		log.Printf("[ERROR] Failed to flatten telemetry for room %s: %v", telemetry.RoomID, err)
+		return
+	}
+
+	prefixes := []string{"telemetry/" + telemetry.RoomID}
+	if room := gw.rooms[telemetry.RoomID]; gw.settings.Tenancy.TenantTopics && room != nil && room.Tenant != "" {
+		prefixes = append(prefixes, fmt.Sprintf("tenants/%s/telemetry/%s", room.Tenant, telemetry.RoomID))
+	}
+
+	names := config.Metrics
+	if len(names) == 0 {
+		names = make([]string, 0, len(metrics))
+		for name := range metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	published := 0
+	for _, name := range names {
+		payload, ok := metrics[name]
+		if !ok {
+			continue
+		}
+		for _, prefix := range prefixes {
+			topic := prefix + "/" + name
+			token := gw.mqttClient.Publish(topic, 0, config.Retain, payload)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+				continue
+			}
+			published++
+		}
+	}
+	log.Printf("[DEBUG] Published %d flat topics for room %s", published, telemetry.RoomID)
+}
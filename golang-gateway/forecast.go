@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ForecastConfig publishes short-horizon forecasts of room conditions next
+// to the actual values, so rules can pre-condition a room before it drifts
+// out of band. Every IntervalSec the room history (see HistoryConfig) of
+// each metric is resampled to IntervalSec steps and the value HorizonMin
+// ahead is predicted by the model:
+//
+//   - holt-winters: additive Holt-Winters with a daily season, computed in
+//     the gateway; until two seasons of history exist it falls back to
+//     Holt's linear trend
+//   - http: the series is posted to Endpoint, which answers {"forecast": v}
+//
+// Forecasts are published on forecast/<room_id>.
+type ForecastConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Metrics are telemetry fields, default temperature and co2_ppm
+	Metrics      []string `yaml:"metrics"`
+	HorizonMin   int      `yaml:"horizon_min"`
+	IntervalSec  int      `yaml:"interval_sec"`
+	HistoryHours int      `yaml:"history_hours"` // series length, default 3 seasons
+	Model        string   `yaml:"model"`         // holt-winters (default) or http
+	// Holt-Winters smoothing factors for level, trend and season, and the
+	// season length
+	Alpha       float64 `yaml:"alpha,omitempty"`
+	Beta        float64 `yaml:"beta,omitempty"`
+	Gamma       float64 `yaml:"gamma,omitempty"`
+	SeasonHours int     `yaml:"season_hours,omitempty"`
+	// Endpoint and TimeoutSec configure the http model
+	Endpoint   string `yaml:"endpoint,omitempty"`
+	TimeoutSec int    `yaml:"timeout_sec,omitempty"`
+}
+
+func (c *ForecastConfig) normalize(history *HistoryConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if len(c.Metrics) == 0 {
+		c.Metrics = []string{"temperature", "co2_ppm"}
+	}
+	if c.HorizonMin <= 0 {
+		c.HorizonMin = 60
+	}
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = 300
+	}
+	if c.IntervalSec < history.ResolutionSec {
+		return fmt.Errorf("forecast: interval_sec %d is shorter than the history resolution_sec %d", c.IntervalSec, history.ResolutionSec)
+	}
+	if c.SeasonHours <= 0 {
+		c.SeasonHours = 24
+	}
+	if c.HistoryHours <= 0 {
+		c.HistoryHours = 3 * c.SeasonHours
+	}
+	if c.HistoryHours > history.RetentionHours {
+		c.HistoryHours = history.RetentionHours
+	}
+	if c.Alpha == 0 {
+		c.Alpha = 0.5
+	}
+	if c.Beta == 0 {
+		c.Beta = 0.05
+	}
+	if c.Gamma == 0 {
+		c.Gamma = 0.3
+	}
+	for _, factor := range []float64{c.Alpha, c.Beta, c.Gamma} {
+		if factor < 0 || factor > 1 {
+			return fmt.Errorf("forecast: alpha, beta and gamma must be between 0 and 1")
+		}
+	}
+	switch c.Model {
+	case "":
+		c.Model = "holt-winters"
+	case "holt-winters":
+	case "http":
+		if c.Endpoint == "" {
+			return fmt.Errorf("forecast: the http model needs an endpoint")
+		}
+		if c.TimeoutSec <= 0 {
+			c.TimeoutSec = 10
+		}
+	default:
+		return fmt.Errorf("forecast: unknown model %q (holt-winters or http)", c.Model)
+	}
+	return nil
+}
+
+// forecastSample is one step of a resampled series
+type forecastSample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+// forecastModel predicts a metric steps intervals after the last sample of
+// series, which is evenly spaced and oldest first
+type forecastModel interface {
+	predict(roomID, metric string, series []forecastSample, steps int) (float64, error)
+}
+
+// holtWinters is the built-in additive Holt-Winters model
+type holtWinters struct {
+	alpha, beta, gamma float64
+	season             int // steps per season
+}
+
+func (m *holtWinters) predict(roomID, metric string, series []forecastSample, steps int) (float64, error) {
+	n := len(series)
+	if n < 2 {
+		return 0, fmt.Errorf("not enough history")
+	}
+	x := func(i int) float64 { return series[i].Value }
+
+	if m.season < 2 || n < 2*m.season {
+		// Holt's linear trend
+		level, trend := x(0), x(1)-x(0)
+		for t := 1; t < n; t++ {
+			previous := level
+			level = m.alpha*x(t) + (1-m.alpha)*(level+trend)
+			trend = m.beta*(level-previous) + (1-m.beta)*trend
+		}
+		return level + float64(steps)*trend, nil
+	}
+
+	s := m.season
+	var first, second float64
+	for i := 0; i < s; i++ {
+		first += x(i)
+		second += x(s + i)
+	}
+	first, second = first/float64(s), second/float64(s)
+	level, trend := first, (second-first)/float64(s)
+	seasonal := make([]float64, s)
+	for i := 0; i < s; i++ {
+		seasonal[i] = x(i) - first
+	}
+	for t := s; t < n; t++ {
+		previous := level
+		level = m.alpha*(x(t)-seasonal[t%s]) + (1-m.alpha)*(level+trend)
+		trend = m.beta*(level-previous) + (1-m.beta)*trend
+		seasonal[t%s] = m.gamma*(x(t)-level) + (1-m.gamma)*seasonal[t%s]
+	}
+	return level + float64(steps)*trend + seasonal[(n-1+steps)%s], nil
+}
+
+// httpForecaster delegates to an external model endpoint
+type httpForecaster struct {
+	config *ForecastConfig
+	client *http.Client
+}
+
+// forecastRequest is posted to the http model's endpoint
+type forecastRequest struct {
+	RoomID      string           `json:"room_id"`
+	Metric      string           `json:"metric"`
+	IntervalSec int              `json:"interval_sec"`
+	HorizonMin  int              `json:"horizon_min"`
+	Series      []forecastSample `json:"series"`
+}
+
+func (m *httpForecaster) predict(roomID, metric string, series []forecastSample, steps int) (float64, error) {
+	body, err := json.Marshal(forecastRequest{
+		RoomID:      roomID,
+		Metric:      metric,
+		IntervalSec: m.config.IntervalSec,
+		HorizonMin:  m.config.HorizonMin,
+		Series:      series,
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp, err := m.client.Post(m.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("POST %s: %s", m.config.Endpoint, resp.Status)
+	}
+	var result struct {
+		Forecast *float64 `json:"forecast"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("invalid forecast response: %w", err)
+	}
+	if result.Forecast == nil {
+		return 0, fmt.Errorf("forecast response has no forecast")
+	}
+	return *result.Forecast, nil
+}
+
+func newForecastModel(config *ForecastConfig) forecastModel {
+	if config.Model == "http" {
+		return &httpForecaster{config: config, client: &http.Client{Timeout: time.Duration(config.TimeoutSec) * time.Second}}
+	}
+	return &holtWinters{
+		alpha:  config.Alpha,
+		beta:   config.Beta,
+		gamma:  config.Gamma,
+		season: config.SeasonHours * 3600 / config.IntervalSec,
+	}
+}
+
+// MetricForecast pairs the latest actual value with its forecast
+type MetricForecast struct {
+	Actual   float64 `json:"actual"`
+	Forecast float64 `json:"forecast"`
+}
+
+// RoomForecast is published on forecast/<room_id>
+type RoomForecast struct {
+	RoomID     string                    `json:"room_id"`
+	Model      string                    `json:"model"`
+	HorizonMin int                       `json:"horizon_min"`
+	TargetTime string                    `json:"target_time"`
+	Metrics    map[string]MetricForecast `json:"metrics"`
+	Timestamp  string                    `json:"timestamp"`
+}
+
+// resampleHistory averages history points into interval steps ending at
+// now, carrying the previous value over steps without data
+func resampleHistory(points []historyPoint, metric string, from time.Time, interval time.Duration, steps int) []forecastSample {
+	sums := make([]float64, steps)
+	counts := make([]int, steps)
+	for _, p := range points {
+		v, ok := p.metrics[metric]
+		if !ok {
+			continue
+		}
+		i := int(p.at.Sub(from) / interval)
+		if i < 0 || i >= steps {
+			continue
+		}
+		sums[i] += v
+		counts[i]++
+	}
+	var series []forecastSample
+	for i := 0; i < steps; i++ {
+		at := from.Add(time.Duration(i) * interval)
+		switch {
+		case counts[i] > 0:
+			series = append(series, forecastSample{Timestamp: at, Value: sums[i] / float64(counts[i])})
+		case len(series) > 0:
+			series = append(series, forecastSample{Timestamp: at, Value: series[len(series)-1].Value})
+		}
+	}
+	return series
+}
+
+// runForecasts forecasts every room each interval
+func (gw *Gateway) runForecasts() {
+	defer gw.wg.Done()
+
+	cfg := &gw.settings.Forecast
+	model := newForecastModel(cfg)
+	ticker := time.NewTicker(time.Duration(cfg.IntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			for roomID := range gw.rooms {
+				if forecast := gw.forecastRoom(model, roomID, now); forecast != nil {
+					gw.publishForecast(forecast)
+				}
+			}
+		}
+	}
+}
+
+func (gw *Gateway) forecastRoom(model forecastModel, roomID string, now time.Time) *RoomForecast {
+	cfg := &gw.settings.Forecast
+	interval := time.Duration(cfg.IntervalSec) * time.Second
+	horizon := time.Duration(cfg.HorizonMin) * time.Minute
+	steps := int(time.Duration(cfg.HistoryHours) * time.Hour / interval)
+	from := now.Truncate(interval).Add(-time.Duration(steps-1) * interval)
+	points := gw.history.query(roomID, from, now)
+
+	forecast := &RoomForecast{
+		RoomID:     roomID,
+		Model:      cfg.Model,
+		HorizonMin: cfg.HorizonMin,
+		TargetTime: now.Add(horizon).Format(time.RFC3339),
+		Metrics:    make(map[string]MetricForecast),
+		Timestamp:  now.Format(time.RFC3339),
+	}
+	ahead := int((horizon + interval - 1) / interval)
+	for _, metric := range cfg.Metrics {
+		series := resampleHistory(points, metric, from, interval, steps)
+		if len(series) < 2 {
+			continue
+		}
+		value, err := model.predict(roomID, metric, series, ahead)
+		if err != nil {
+			log.Printf("[WARN] Forecast of %s in room %s failed: %v", metric, roomID, err)
+			continue
+		}
+		forecast.Metrics[metric] = MetricForecast{Actual: series[len(series)-1].Value, Forecast: value}
+	}
+	if len(forecast.Metrics) == 0 {
+		return nil
+	}
+	return forecast
+}
+
+func (gw *Gateway) publishForecast(forecast *RoomForecast) {
+	payload, err := json.Marshal(forecast)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal forecast for room %s: %v", forecast.RoomID, err)
+		return
+	}
+	topic := fmt.Sprintf("forecast/%s", forecast.RoomID)
+	token := gw.mqttClient.Publish(topic, 0, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[MQTT] Published to %s", topic)
+}
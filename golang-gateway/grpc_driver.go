@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang-gateway/driverpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// driverCallTimeout bounds unary calls to driver sidecars
+const driverCallTimeout = 5 * time.Second
+
+// grpcDrivers is the client side of the driver sidecar protocol
+// (driverpb/driver.proto). Sensors with protocol grpc are read from and
+// written to through the sidecar at their target; with subscribe set they
+// are not polled and receive the values the sidecar pushes instead.
+// Sidecars run next to the gateway, so connections are not encrypted.
+type grpcDrivers struct {
+	mu      sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	latency *latencyRecorder
+}
+
+func newGRPCDrivers(latency *latencyRecorder) *grpcDrivers {
+	return &grpcDrivers{conns: make(map[string]*grpc.ClientConn), latency: latency}
+}
+
+// validateGRPCSensors checks the sidecar settings of sensors
+func (gw *Gateway) validateGRPCSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "grpc" {
+			if sensor.Target != "" {
+				return fmt.Errorf("sensor %s: target is only valid for protocol grpc", id)
+			}
+			if sensor.Protocol == "knx" {
+				if !sensor.Subscribe && !sensor.polled() {
+					return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required unless subscribe is set", id)
+				}
+			} else if sensor.Subscribe {
+				return fmt.Errorf("sensor %s: subscribe is only valid for protocols grpc and knx", id)
+			}
+			continue
+		}
+		if sensor.Target == "" {
+			return fmt.Errorf("sensor %s: protocol grpc requires a target", id)
+		}
+		if !sensor.Subscribe && !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required unless subscribe is set", id)
+		}
+	}
+	return nil
+}
+
+// client returns a client for a sidecar, connecting lazily on first use
+func (d *grpcDrivers) client(target string) (driverpb.DriverClient, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	conn, ok := d.conns[target]
+	if !ok {
+		var err error
+		conn, err = grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create driver client for %s: %w", target, err)
+		}
+		d.conns[target] = conn
+	}
+	return driverpb.NewDriverClient(conn), nil
+}
+
+func pointRef(sensor *SensorConfig) *driverpb.PointRef {
+	return &driverpb.PointRef{SensorId: sensor.ID, Address: sensor.Address, Params: sensor.Params}
+}
+
+// pointValueError turns a bad-quality value into a read error
+func pointValueError(v *driverpb.PointValue) error {
+	if v.GetQuality() != driverpb.Quality_QUALITY_BAD {
+		return nil
+	}
+	if v.GetError() != "" {
+		return fmt.Errorf("driver reported bad quality: %s", v.GetError())
+	}
+	return errors.New("driver reported bad quality")
+}
+
+// read polls one point through its sidecar
+func (d *grpcDrivers) read(sensor *SensorConfig) (float64, string, error) {
+	client, err := d.client(sensor.Target)
+	if err != nil {
+		return 0, "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), driverCallTimeout)
+	defer cancel()
+	start := time.Now()
+	v, err := client.ReadPoint(ctx, &driverpb.ReadPointRequest{Point: pointRef(sensor)})
+	d.latency.observe("grpc", sensor.Target, time.Since(start), err)
+	if err != nil {
+		return 0, "", fmt.Errorf("driver read error: %w", err)
+	}
+	return v.GetValue(), v.GetStringValue(), pointValueError(v)
+}
+
+// write commands one point through its sidecar
+func (d *grpcDrivers) write(sensor *SensorConfig, value float64) error {
+	client, err := d.client(sensor.Target)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), driverCallTimeout)
+	defer cancel()
+	start := time.Now()
+	_, err = client.WritePoint(ctx, &driverpb.WritePointRequest{Point: pointRef(sensor), Value: value})
+	d.latency.observe("grpc", sensor.Target, time.Since(start), err)
+	if err != nil {
+		return fmt.Errorf("driver write error: %w", err)
+	}
+	return nil
+}
+
+// discover asks a sidecar for the points it can reach
+func (d *grpcDrivers) discover(target string, timeout time.Duration) ([]*driverpb.DiscoveredPoint, error) {
+	client, err := d.client(target)
+	if err != nil {
+		return nil, err
+	}
+	// The sidecar gets the timeout for its own discovery plus time to reply
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+driverCallTimeout)
+	defer cancel()
+	resp, err := client.Discover(ctx, &driverpb.DiscoverRequest{TimeoutMs: int32(timeout / time.Millisecond)})
+	if err != nil {
+		return nil, fmt.Errorf("driver discovery error: %w", err)
+	}
+	return resp.GetPoints(), nil
+}
+
+func (d *grpcDrivers) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for target, conn := range d.conns {
+		if err := conn.Close(); err != nil {
+			log.Printf("[WARN] Failed to close driver connection to %s: %v", target, err)
+		}
+	}
+	d.conns = make(map[string]*grpc.ClientConn)
+}
+
+// subscribedSensors groups the sensors with subscribe set by sidecar target
+func (gw *Gateway) subscribedSensors() map[string][]*SensorConfig {
+	targets := make(map[string][]*SensorConfig)
+	for _, sensor := range gw.sensors {
+		if sensor.Protocol == "grpc" && sensor.Subscribe {
+			targets[sensor.Target] = append(targets[sensor.Target], sensor)
+		}
+	}
+	return targets
+}
+
+// subscribeDriver keeps a Subscribe stream open to one sidecar and records
+// every pushed value, reconnecting with backoff until shutdown
+func (gw *Gateway) subscribeDriver(target string, sensors []*SensorConfig) {
+	defer gw.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-gw.shutdown
+		cancel()
+	}()
+
+	byID := make(map[string]*SensorConfig, len(sensors))
+	req := &driverpb.SubscribeRequest{}
+	for _, sensor := range sensors {
+		byID[sensor.ID] = sensor
+		req.Points = append(req.Points, pointRef(sensor))
+	}
+
+	backoff := time.Second
+	for {
+		err := gw.receiveDriverValues(ctx, target, req, byID, func() { backoff = time.Second })
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("[WARN] Driver subscription to %s ended: %v; retrying in %v", target, err, backoff)
+		select {
+		case <-gw.shutdown:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// receiveDriverValues runs one Subscribe stream until it fails
+func (gw *Gateway) receiveDriverValues(ctx context.Context, target string, req *driverpb.SubscribeRequest, sensors map[string]*SensorConfig, connected func()) error {
+	client, err := gw.drivers.client(target)
+	if err != nil {
+		return err
+	}
+	stream, err := client.Subscribe(ctx, req)
+	if err != nil {
+		return err
+	}
+	log.Printf("Subscribed to %d point(s) on driver %s", len(req.Points), target)
+	for {
+		v, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		connected()
+		sensor, ok := sensors[v.GetSensorId()]
+		if !ok {
+			log.Printf("[WARN] Driver %s pushed a value for unknown sensor %s", target, v.GetSensorId())
+			continue
+		}
+		if gw.control.isPaused(sensor.ID) {
+			continue
+		}
+		var sampledAt time.Time
+		if ns := v.GetTimestampUnixNano(); ns > 0 {
+			sampledAt = time.Unix(0, ns)
+		}
+		gw.recordReading(sensor.ID, sensor, v.GetValue(), v.GetStringValue(), pointValueError(v), sampledAt, newTraceID())
+	}
+}
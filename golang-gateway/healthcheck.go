@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// The healthcheck subcommand exercises the gateway's dependencies and exits
+// 0 when all are healthy, 1 otherwise (2 for usage errors), for Docker
+// HEALTHCHECK and Kubernetes probes. It shares its output format and exit
+// codes with the bridge's healthcheck: one "ok|fail|skip <check>: <detail>"
+// line per check, or a JSON report with -json.
+
+// healthCheckResult is the outcome of one check
+type healthCheckResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"` // ok, fail or skip
+	Detail    string `json:"detail"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+// healthReport is the -json output
+type healthReport struct {
+	Healthy bool                `json:"healthy"`
+	Checks  []healthCheckResult `json:"checks"`
+}
+
+// errHealthSkipped marks a check that does not apply to the configuration
+type errHealthSkipped string
+
+func (e errHealthSkipped) Error() string { return string(e) }
+
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of each check")
+	sensorID := fs.String("sensor", "", "sensor to read through the API (default: the first configured sensor)")
+	apiKey := fs.String("api-key", os.Getenv("HEALTHCHECK_API_KEY"), "operator API key when API authentication is enabled")
+	asJSON := fs.Bool("json", false, "print a JSON report")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: golang-gateway healthcheck [-timeout 5s] [-sensor ID] [-api-key KEY] [-json]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	// Config loading logs progress; the report is the only output
+	log.SetOutput(io.Discard)
+
+	gw := &Gateway{
+		sensors:      make(map[string]*SensorConfig),
+		rooms:        make(map[string]*RoomConfig),
+		sensorToRoom: make(map[string]string),
+	}
+	var report healthReport
+	run := func(name string, check func() (string, error)) {
+		start := time.Now()
+		detail, err := check()
+		result := healthCheckResult{Name: name, Status: "ok", Detail: detail, ElapsedMs: time.Since(start).Milliseconds()}
+		var skipped errHealthSkipped
+		switch {
+		case err == nil:
+		case errors.As(err, &skipped):
+			result.Status, result.Detail = "skip", err.Error()
+		default:
+			result.Status, result.Detail = "fail", err.Error()
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	configLoaded := false
+	run("config", func() (string, error) {
+		err := gw.loadConfig(
+			getEnv("SENSORS_CONFIG", "/app/config/sensors.yaml"),
+			getEnv("ROOMS_CONFIG", "/app/config/rooms.yaml"),
+			getEnv("GATEWAY_CONFIG", "/app/config/gateway.yaml"))
+		if err != nil {
+			return "", err
+		}
+		configLoaded = true
+		return fmt.Sprintf("%d sensors in %d rooms", len(gw.sensors), len(gw.rooms)), nil
+	})
+	run("mqtt", func() (string, error) {
+		detail, err := checkBrokerConnect(getEnv("MQTT_BROKER", "tcp://nanomq:1883"), gw.settings.GatewayID, *timeout)
+		if err != nil && gw.settings.FallbackBroker.Enabled {
+			// Publishes are spooled to the embedded broker meanwhile
+			return fmt.Sprintf("%v; using the fallback broker", err), nil
+		}
+		return detail, err
+	})
+	run("sensor_read", func() (string, error) {
+		if !configLoaded {
+			return "", errHealthSkipped("config did not load")
+		}
+		return gw.checkSensorRead(*sensorID, *apiKey, *timeout)
+	})
+	run("data_dir", func() (string, error) {
+		if !configLoaded {
+			return "", errHealthSkipped("config did not load")
+		}
+		return checkWritableDir(filepath.Dir(gw.settings.Store.Path))
+	})
+
+	report.Healthy = true
+	for _, c := range report.Checks {
+		if c.Status == "fail" {
+			report.Healthy = false
+		}
+	}
+	if *asJSON {
+		data, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		for _, c := range report.Checks {
+			fmt.Printf("%-4s %s: %s (%dms)\n", c.Status, c.Name, c.Detail, c.ElapsedMs)
+		}
+	}
+	if !report.Healthy {
+		return 1
+	}
+	return 0
+}
+
+// checkBrokerConnect connects to the broker with a client ID of its own, so
+// the check never takes over the gateway's session
+func checkBrokerConnect(broker, gatewayID string, timeout time.Duration) (string, error) {
+	if gatewayID == "" {
+		gatewayID = "golang-gateway"
+	}
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID(fmt.Sprintf("%s-healthcheck-%d", gatewayID, os.Getpid()))
+	opts.SetConnectTimeout(timeout)
+	opts.SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(timeout) {
+		return "", fmt.Errorf("no CONNACK from %s within %s", broker, timeout)
+	}
+	if err := token.Error(); err != nil {
+		return "", fmt.Errorf("%s: %w", broker, err)
+	}
+	client.Disconnect(250)
+	return "connected to " + broker, nil
+}
+
+// checkSensorRead reads a sensor through the running gateway's API, which
+// exercises both the API and the sensor's protocol driver without opening
+// a second BACnet or Modbus client next to the gateway's
+func (gw *Gateway) checkSensorRead(sensorID, apiKey string, timeout time.Duration) (string, error) {
+	if sensorID == "" {
+		if len(gw.sensors) == 0 {
+			return "", errHealthSkipped("no sensors configured")
+		}
+		ids := make([]string, 0, len(gw.sensors))
+		for id := range gw.sensors {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		sensorID = ids[0]
+	}
+	sensor, ok := gw.sensors[sensorID]
+	if !ok {
+		return "", fmt.Errorf("unknown sensor %s", sensorID)
+	}
+
+	host, port, err := net.SplitHostPort(gw.settings.API.ListenAddr)
+	if err != nil {
+		return "", fmt.Errorf("invalid api listen_addr: %w", err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	url := fmt.Sprintf("http://%s/sensors/%s/read", net.JoinHostPort(host, port), sensorID)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", err
+	}
+	if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("API unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var reading SensorReading
+		if err := json.Unmarshal(body, &reading); err != nil {
+			return "", fmt.Errorf("invalid reading from API: %w", err)
+		}
+		value := fmt.Sprint(reading.Value)
+		if reading.StringValue != "" {
+			value = reading.StringValue
+		}
+		return fmt.Sprintf("%s (%s) read %s %s", sensorID, sensor.Protocol, value, reading.Unit), nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "", fmt.Errorf("API refused the read (%s); set HEALTHCHECK_API_KEY to an operator key", resp.Status)
+	}
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Error != "" {
+		return "", fmt.Errorf("%s (%s): %s", sensorID, sensor.Protocol, apiErr.Error)
+	}
+	return "", fmt.Errorf("%s (%s): API returned %s", sensorID, sensor.Protocol, strings.TrimSpace(resp.Status))
+}
+
+// checkWritableDir creates and removes a file in dir
+func checkWritableDir(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	name := f.Name()
+	f.Close()
+	if err := os.Remove(name); err != nil {
+		return "", fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	return dir + " is writable", nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Driver names in heartbeats: the field bus protocols and mqtt-out, the
+// gateway's publishes to the broker
+const driverMQTTOut = "mqtt-out"
+
+// DriverStatus is the health of one driver. Status is idle without requests
+// in the last interval, down when they all failed (or the broker connection
+// is down for mqtt-out), degraded when some failed and ok otherwise.
+// Requests and Errors count since startup.
+type DriverStatus struct {
+	Driver           string `json:"driver"`
+	Status           string `json:"status"`
+	Requests         uint64 `json:"requests"`
+	Errors           uint64 `json:"errors"`
+	IntervalRequests uint64 `json:"interval_requests"`
+	IntervalErrors   uint64 `json:"interval_errors"`
+	LastSuccess      string `json:"last_success,omitempty"`
+	LastError        string `json:"last_error,omitempty"`
+	LastErrorMessage string `json:"last_error_message,omitempty"`
+	Connected        *bool  `json:"connected,omitempty"`
+}
+
+// DriverHeartbeat is published on status/gateway/<gateway_id>/drivers
+type DriverHeartbeat struct {
+	GatewayID   string         `json:"gateway_id"`
+	IntervalSec int            `json:"interval_sec"`
+	Drivers     []DriverStatus `json:"drivers"`
+	Timestamp   string         `json:"timestamp"`
+}
+
+type driverCounters struct {
+	requests, errors             uint64
+	windowRequests, windowErrors uint64
+	lastSuccess, lastError       time.Time
+	lastErrorMessage             string
+}
+
+// driverHealth counts request outcomes per driver
+type driverHealth struct {
+	mu      sync.Mutex
+	drivers map[string]*driverCounters
+}
+
+func newDriverHealth() *driverHealth {
+	return &driverHealth{drivers: make(map[string]*driverCounters)}
+}
+
+func (h *driverHealth) observe(driver string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.drivers[driver]
+	if !ok {
+		c = &driverCounters{}
+		h.drivers[driver] = c
+	}
+	c.requests++
+	c.windowRequests++
+	if err != nil {
+		c.errors++
+		c.windowErrors++
+		c.lastError = time.Now()
+		c.lastErrorMessage = err.Error()
+		return
+	}
+	c.lastSuccess = time.Now()
+}
+
+// take returns the status of the given drivers (plus any others seen) and
+// starts a new interval
+func (h *driverHealth) take(drivers []string) []DriverStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make(map[string]bool, len(drivers)+len(h.drivers))
+	for _, driver := range drivers {
+		names[driver] = true
+	}
+	for driver := range h.drivers {
+		names[driver] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for driver := range names {
+		sorted = append(sorted, driver)
+	}
+	sort.Strings(sorted)
+
+	statuses := make([]DriverStatus, 0, len(sorted))
+	for _, driver := range sorted {
+		c, ok := h.drivers[driver]
+		if !ok {
+			c = &driverCounters{}
+		}
+		s := DriverStatus{
+			Driver:           driver,
+			Requests:         c.requests,
+			Errors:           c.errors,
+			IntervalRequests: c.windowRequests,
+			IntervalErrors:   c.windowErrors,
+			LastErrorMessage: c.lastErrorMessage,
+		}
+		if !c.lastSuccess.IsZero() {
+			s.LastSuccess = c.lastSuccess.Format(time.RFC3339)
+		}
+		if !c.lastError.IsZero() {
+			s.LastError = c.lastError.Format(time.RFC3339)
+		}
+		switch {
+		case c.windowRequests == 0:
+			s.Status = "idle"
+		case c.windowErrors == c.windowRequests:
+			s.Status = "down"
+		case c.windowErrors > 0:
+			s.Status = "degraded"
+		default:
+			s.Status = "ok"
+		}
+		c.windowRequests, c.windowErrors = 0, 0
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// observedClient counts the outcome of every waited-for publish as the
+// mqtt-out driver, and the payload bytes published for the resource budget
+type observedClient struct {
+	mqtt.Client
+	health *driverHealth
+	sent   *atomic.Uint64
+}
+
+func (c *observedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	switch p := payload.(type) {
+	case []byte:
+		c.sent.Add(uint64(len(p)))
+	case string:
+		c.sent.Add(uint64(len(p)))
+	}
+	return &observedToken{Token: c.Client.Publish(topic, qos, retained, payload), health: c.health}
+}
+
+type observedToken struct {
+	mqtt.Token
+	health *driverHealth
+	once   sync.Once
+}
+
+func (t *observedToken) Wait() bool {
+	done := t.Token.Wait()
+	t.record()
+	return done
+}
+
+func (t *observedToken) WaitTimeout(d time.Duration) bool {
+	done := t.Token.WaitTimeout(d)
+	if done {
+		t.record()
+	}
+	return done
+}
+
+func (t *observedToken) record() {
+	t.once.Do(func() { t.health.observe(driverMQTTOut, t.Token.Error()) })
+}
+
+// configuredDrivers lists the drivers in use, reported even when idle
+func (gw *Gateway) configuredDrivers() []string {
+	drivers := []string{driverMQTTOut}
+	protocols := make(map[string]bool)
+	for _, sensor := range gw.sensors {
+		protocols[sensor.Protocol] = true
+	}
+	for _, protocol := range []string{"bacnet", "modbus", "opcua", "snmp", "knx", "mbus", "http", "zigbee", "dali", "grpc", "model"} {
+		if protocols[protocol] {
+			drivers = append(drivers, protocol)
+		}
+	}
+	return drivers
+}
+
+// publishDriverHeartbeats periodically publishes per-driver health for
+// dashboards that need more than the gateway's online status
+func (gw *Gateway) publishDriverHeartbeats() {
+	defer gw.wg.Done()
+
+	interval := gw.settings.Metrics.HeartbeatIntervalSec
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	topic := gw.statusTopic() + "/drivers"
+	drivers := gw.configuredDrivers()
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			statuses := gw.latency.health.take(drivers)
+			for i := range statuses {
+				if statuses[i].Driver != driverMQTTOut {
+					continue
+				}
+				connected := gw.mqttClient.IsConnectionOpen()
+				statuses[i].Connected = &connected
+				if !connected {
+					statuses[i].Status = "down"
+				}
+			}
+			payload, err := json.Marshal(DriverHeartbeat{
+				GatewayID:   gw.settings.GatewayID,
+				IntervalSec: interval,
+				Drivers:     statuses,
+				Timestamp:   time.Now().Format(time.RFC3339),
+			})
+			if err != nil {
+				log.Printf("[ERROR] Failed to marshal driver heartbeat: %v", err)
+				continue
+			}
+			token := gw.mqttClient.Publish(topic, 0, false, payload)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+			}
+		}
+	}
+}
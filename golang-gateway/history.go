@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HistoryConfig sizes the in-memory history of room telemetry served by
+// GET /export, GET /history (see historyapi.go) and the query API (see promql.go). Telemetry is averaged into buckets of ResolutionSec and kept
+// for RetentionHours; the history starts empty after a restart.
+// MaxPageRows caps the rows of one GET /history page.
+type HistoryConfig struct {
+	ResolutionSec  int `yaml:"resolution_sec"`
+	RetentionHours int `yaml:"retention_hours"`
+	MaxPageRows    int `yaml:"max_page_rows"`
+}
+
+func (c *HistoryConfig) normalize() {
+	if c.ResolutionSec <= 0 {
+		c.ResolutionSec = 60
+	}
+	if c.RetentionHours <= 0 {
+		c.RetentionHours = 168
+	}
+	if c.MaxPageRows <= 0 {
+		c.MaxPageRows = 10000
+	}
+}
+
+// historyPoint is the averaged telemetry of one room over one bucket
+type historyPoint struct {
+	at      time.Time
+	metrics map[string]float64
+}
+
+// historyBucket accumulates the samples of the current bucket
+type historyBucket struct {
+	at     time.Time
+	sums   map[string]float64
+	counts map[string]int
+}
+
+type roomHistory struct {
+	mu      sync.RWMutex
+	config  *HistoryConfig
+	points  map[string][]historyPoint
+	current map[string]*historyBucket
+}
+
+func newRoomHistory(config *HistoryConfig) *roomHistory {
+	return &roomHistory{
+		config:  config,
+		points:  make(map[string][]historyPoint),
+		current: make(map[string]*historyBucket),
+	}
+}
+
+// telemetryMetrics flattens telemetry to its numeric fields; booleans are
+// 1/0 and absent optional fields are left out
+func telemetryMetrics(telemetry *RoomTelemetry) map[string]float64 {
+	data, _ := json.Marshal(telemetry)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	metrics := make(map[string]float64, len(fields))
+	for name, v := range fields {
+		switch v := v.(type) {
+		case float64:
+			metrics[name] = v
+		case bool:
+			if v {
+				metrics[name] = 1
+			} else {
+				metrics[name] = 0
+			}
+		}
+	}
+	return metrics
+}
+
+// record adds a room's telemetry to its current bucket
+func (h *roomHistory) record(roomID string, telemetry *RoomTelemetry, now time.Time) {
+	resolution := time.Duration(h.config.ResolutionSec) * time.Second
+	at := now.Truncate(resolution)
+	metrics := telemetryMetrics(telemetry)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.current[roomID]
+	if b != nil && !b.at.Equal(at) {
+		h.closeBucketLocked(roomID, b, now)
+		b = nil
+	}
+	if b == nil {
+		b = &historyBucket{at: at, sums: make(map[string]float64), counts: make(map[string]int)}
+		h.current[roomID] = b
+	}
+	for name, v := range metrics {
+		b.sums[name] += v
+		b.counts[name]++
+	}
+}
+
+func (h *roomHistory) closeBucketLocked(roomID string, b *historyBucket, now time.Time) {
+	point := historyPoint{at: b.at, metrics: make(map[string]float64, len(b.sums))}
+	for name, sum := range b.sums {
+		point.metrics[name] = sum / float64(b.counts[name])
+	}
+	points := append(h.points[roomID], point)
+	cutoff := now.Add(-time.Duration(h.config.RetentionHours) * time.Hour)
+	drop := 0
+	for drop < len(points) && points[drop].at.Before(cutoff) {
+		drop++
+	}
+	h.points[roomID] = points[drop:]
+}
+
+// query returns a room's points within [from, to), including the bucket in
+// progress
+func (h *roomHistory) query(roomID string, from, to time.Time) []historyPoint {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	points := h.points[roomID]
+	start := sort.Search(len(points), func(i int) bool { return !points[i].at.Before(from) })
+	var result []historyPoint
+	for _, p := range points[start:] {
+		if !p.at.Before(to) {
+			return result
+		}
+		result = append(result, p)
+	}
+	if b := h.current[roomID]; b != nil && !b.at.Before(from) && b.at.Before(to) {
+		p := historyPoint{at: b.at, metrics: make(map[string]float64, len(b.sums))}
+		for name, sum := range b.sums {
+			p.metrics[name] = sum / float64(b.counts[name])
+		}
+		result = append(result, p)
+	}
+	return result
+}
+
+// metrics lists every metric name seen in the history
+func (h *roomHistory) metrics() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	seen := make(map[string]bool)
+	for _, b := range h.current {
+		for name := range b.sums {
+			seen[name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleHistory serves GET /history, the paginated JSON form of the
+// telemetry history for historians and query services. Downsampling runs
+// in the gateway: rows are one room over one step (default resolution_sec)
+// with each metric reduced by agg (avg, min, max, sum, count, first, last)
+// over the history buckets in the step. rooms, floor and zone select the
+// rooms (default: all the caller's tenant may see), metrics the fields;
+// from/to are RFC 3339 and default to the last 24 hours. Rows are ordered
+// by room and time, at most limit (max_page_rows) per page; next_cursor is
+// passed as cursor with the same parameters to fetch the next page. The
+// response is gzip-compressed for clients that accept it.
+func (gw *Gateway) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	config := &gw.settings.History
+
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+	var err error
+	if s := q.Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+	}
+	if !from.Before(to) {
+		writeJSONError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	resolution := time.Duration(config.ResolutionSec) * time.Second
+	step := resolution
+	if s := q.Get("step"); s != "" {
+		if step, err = parsePromDuration(s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid step: "+err.Error())
+			return
+		}
+		if step < resolution || step%resolution != 0 {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("step must be a multiple of the history resolution (%s)", resolution))
+			return
+		}
+	}
+	agg := q.Get("agg")
+	if agg == "" {
+		agg = "avg"
+	}
+	reduce, ok := historyAggregations[agg]
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "unsupported agg "+agg)
+		return
+	}
+	limit := config.MaxPageRows
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	rooms, status, err := gw.historyRooms(r)
+	if err != nil {
+		writeJSONError(w, status, err.Error())
+		return
+	}
+	start, resume := 0, from
+	if s := q.Get("cursor"); s != "" {
+		roomID, at, err := decodeHistoryCursor(s)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		start = sort.SearchStrings(rooms, roomID)
+		if start == len(rooms) || rooms[start] != roomID {
+			writeJSONError(w, http.StatusBadRequest, "cursor does not match the query")
+			return
+		}
+		// The page continues with the room's next step
+		if next := at.Add(step); next.After(from) {
+			resume = next
+		}
+	}
+	metrics := splitList(q.Get("metrics"))
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page := HistoryPage{
+		From: from.UTC().Format(time.RFC3339),
+		To:   to.UTC().Format(time.RFC3339),
+		Step: step.String(),
+		Agg:  agg,
+		Rows: []HistoryRow{},
+	}
+	for i := start; i < len(rooms) && page.NextCursor == ""; i++ {
+		roomFrom := from
+		if i == start {
+			roomFrom = resume
+		}
+		points := gw.history.query(rooms[i], roomFrom, to)
+		for _, row := range downsampleHistory(rooms[i], points, step, metrics, reduce) {
+			if len(page.Rows) == limit {
+				last := page.Rows[len(page.Rows)-1]
+				lastAt, _ := time.Parse(time.RFC3339, last.Timestamp)
+				page.NextCursor = encodeHistoryCursor(last.RoomID, lastAt)
+				break
+			}
+			for m, v := range row.Metrics {
+				row.Metrics[m] = profile.convert(m, v)
+				if unit := profile.unit(m); unit != "" {
+					if page.Units == nil {
+						page.Units = make(map[string]string)
+					}
+					page.Units[m] = unit
+				}
+			}
+			page.Rows = append(page.Rows, row)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Vary", "Accept-Encoding")
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(out).Encode(page)
+}
+
+// HistoryPage is one page of GET /history
+type HistoryPage struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Step string `json:"step"`
+	Agg  string `json:"agg"`
+	// Units names the unit of metrics converted by an output profile
+	Units      map[string]string `json:"units,omitempty"`
+	Rows       []HistoryRow      `json:"rows"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// HistoryRow is the downsampled telemetry of one room over one step
+type HistoryRow struct {
+	Timestamp string             `json:"timestamp"`
+	RoomID    string             `json:"room_id"`
+	Metrics   map[string]float64 `json:"metrics"`
+}
+
+// historyAggregations reduce the bucket values of a metric within a step
+var historyAggregations = map[string]func([]float64) float64{
+	"avg": func(v []float64) float64 { return promSum(v) / float64(len(v)) },
+	"min": func(v []float64) float64 {
+		m := v[0]
+		for _, x := range v[1:] {
+			m = math.Min(m, x)
+		}
+		return m
+	},
+	"max": func(v []float64) float64 {
+		m := v[0]
+		for _, x := range v[1:] {
+			m = math.Max(m, x)
+		}
+		return m
+	},
+	"sum":   promSum,
+	"count": func(v []float64) float64 { return float64(len(v)) },
+	"first": func(v []float64) float64 { return v[0] },
+	"last":  func(v []float64) float64 { return v[len(v)-1] },
+}
+
+// downsampleHistory groups a room's points into steps and reduces each
+// metric; points are in time order, so are the rows
+func downsampleHistory(roomID string, points []historyPoint, step time.Duration, metrics []string, reduce func([]float64) float64) []HistoryRow {
+	var rows []HistoryRow
+	for i := 0; i < len(points); {
+		at := points[i].at.Truncate(step)
+		values := make(map[string][]float64)
+		for ; i < len(points) && points[i].at.Truncate(step).Equal(at); i++ {
+			for name, v := range points[i].metrics {
+				values[name] = append(values[name], v)
+			}
+		}
+		row := HistoryRow{Timestamp: at.UTC().Format(time.RFC3339), RoomID: roomID, Metrics: make(map[string]float64)}
+		if len(metrics) == 0 {
+			for name, v := range values {
+				row.Metrics[name] = reduce(v)
+			}
+		}
+		for _, name := range metrics {
+			if v := values[name]; len(v) > 0 {
+				row.Metrics[name] = reduce(v)
+			}
+		}
+		if len(row.Metrics) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// historyRooms returns the sorted rooms selected by the rooms, floor and
+// zone parameters among those the caller may see, with the status of an
+// invalid selection
+func (gw *Gateway) historyRooms(r *http.Request) ([]string, int, error) {
+	q := r.URL.Query()
+	rooms := splitList(q.Get("rooms"))
+	for _, id := range rooms {
+		if _, ok := gw.rooms[id]; !ok {
+			return nil, http.StatusBadRequest, fmt.Errorf("unknown room %s", id)
+		}
+		if !gw.roomAllowed(r, id) {
+			return nil, http.StatusForbidden, fmt.Errorf("room %s belongs to another tenant", id)
+		}
+	}
+	if len(rooms) == 0 {
+		for id := range gw.rooms {
+			if gw.roomAllowed(r, id) {
+				rooms = append(rooms, id)
+			}
+		}
+	}
+	floor := -1
+	if s := q.Get("floor"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid floor %q", s)
+		}
+		floor = n
+	}
+	zone := q.Get("zone")
+	selected := rooms[:0]
+	for _, id := range rooms {
+		room := gw.rooms[id]
+		if (floor >= 0 && room.Floor != floor) || (zone != "" && room.Zone != zone) {
+			continue
+		}
+		selected = append(selected, id)
+	}
+	sort.Strings(selected)
+	return selected, 0, nil
+}
+
+// A cursor is the room and step of the last row of a page
+func encodeHistoryCursor(roomID string, at time.Time) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(roomID + "\n" + strconv.FormatInt(at.Unix(), 10)))
+}
+
+func decodeHistoryCursor(s string) (string, time.Time, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	roomID, sec, ok := strings.Cut(string(data), "\n")
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("malformed cursor")
+	}
+	n, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return roomID, time.Unix(n, 0), nil
+}
+
+// acceptsGzip reports whether the client accepts a gzip-encoded response
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
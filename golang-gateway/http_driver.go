@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPConfig holds the gateway-wide settings of the http driver. Sensors
+// with protocol http GET the URL in address on their poll interval and
+// extract the value with json_path; sensors polling the same URL with the
+// same credentials within cache_ms share one request, so a cloud API
+// returning many points is called once per poll.
+type HTTPConfig struct {
+	TimeoutMs int `yaml:"timeout_ms,omitempty"`  // per request, default 5000
+	CacheMs   int `yaml:"cache_ms,omitempty"`    // default 1000
+	MaxBodyKB int `yaml:"max_body_kb,omitempty"` // default 1024
+	// InsecureSkipVerify accepts self-signed certificates of local devices
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
+}
+
+func (c *HTTPConfig) normalize() {
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 5000
+	}
+	if c.CacheMs <= 0 {
+		c.CacheMs = 1000
+	}
+	if c.MaxBodyKB <= 0 {
+		c.MaxBodyKB = 1024
+	}
+}
+
+// validateHTTPSensors checks the http settings of sensors and parses their
+// JSON paths
+func (gw *Gateway) validateHTTPSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "http" {
+			if sensor.JSONPath != "" || len(sensor.Headers) > 0 || sensor.BearerToken != "" {
+				return fmt.Errorf("sensor %s: json_path, headers and bearer_token are only valid for protocol http", id)
+			}
+			continue
+		}
+		u, err := url.Parse(sensor.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("sensor %s: address must be an http:// or https:// URL", id)
+		}
+		path, err := parseJSONPath(sensor.JSONPath)
+		if err != nil {
+			return fmt.Errorf("sensor %s: invalid json_path %q: %w", id, sensor.JSONPath, err)
+		}
+		sensor.jsonPath = path
+		if (sensor.Username == "") != (sensor.Password == "") {
+			return fmt.Errorf("sensor %s: username and password must be set together", id)
+		}
+		if sensor.Username != "" && sensor.BearerToken != "" {
+			return fmt.Errorf("sensor %s: username/password and bearer_token are exclusive", id)
+		}
+		for name := range sensor.Headers {
+			if strings.EqualFold(name, "Authorization") && (sensor.Username != "" || sensor.BearerToken != "") {
+				return fmt.Errorf("sensor %s: an Authorization header conflicts with username/password or bearer_token", id)
+			}
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol http", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+// jsonPathStep is one step of a JSON path: an object key, an array index,
+// the length of an array (#) or the first array element whose field
+// equals a value (#(field==value))
+type jsonPathStep struct {
+	key   string
+	index int // -1 when key is used
+	count bool
+	query *jsonPathQuery
+}
+
+type jsonPathQuery struct {
+	field []jsonPathStep
+	op    string // == or !=
+	value interface{}
+}
+
+// parseJSONPath parses gjson style paths (sensors.0.value, data.#,
+// points.#(name=="supply_temp").value, with \. escaping a dot in a key)
+// and JSONPath (starting with $: $.sensors[0].value, $['a b'],
+// $.points[?(@.name=='supply_temp')].value)
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("json_path is required")
+	}
+	if strings.HasPrefix(path, "$") {
+		return parseBracketPath(path[1:])
+	}
+	return parseDotPath(path)
+}
+
+func parseDotPath(path string) ([]jsonPathStep, error) {
+	var steps []jsonPathStep
+	for _, part := range splitJSONPath(path) {
+		switch {
+		case part == "":
+			return nil, errors.New("empty path element")
+		case part == "#":
+			steps = append(steps, jsonPathStep{count: true, index: -1})
+		case strings.HasPrefix(part, "#(") && strings.HasSuffix(part, ")"):
+			query, err := parseJSONPathQuery(part[2:len(part)-1], parseDotPath)
+			if err != nil {
+				return nil, err
+			}
+			steps = append(steps, jsonPathStep{query: query, index: -1})
+		default:
+			steps = append(steps, keyOrIndexStep(part))
+		}
+	}
+	return steps, nil
+}
+
+// splitJSONPath splits a gjson path on dots outside queries, unescaping \.
+func splitJSONPath(path string) []string {
+	var parts []string
+	var current strings.Builder
+	depth := 0
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '\\' && i+1 < len(path):
+			i++
+			current.WriteByte(path[i])
+		case c == '(':
+			depth++
+			current.WriteByte(c)
+		case c == ')':
+			depth--
+			current.WriteByte(c)
+		case c == '.' && depth == 0:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	return append(parts, current.String())
+}
+
+func parseBracketPath(path string) ([]jsonPathStep, error) {
+	var steps []jsonPathStep
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			end := strings.IndexAny(path[1:], ".[")
+			if end < 0 {
+				end = len(path) - 1
+			}
+			key := path[1 : end+1]
+			if key == "" {
+				return nil, errors.New("empty path element")
+			}
+			steps = append(steps, jsonPathStep{key: key, index: -1})
+			path = path[end+1:]
+		case '[':
+			end := matchingBracket(path)
+			if end < 0 {
+				return nil, errors.New("unterminated [")
+			}
+			inner := strings.TrimSpace(path[1:end])
+			path = path[end+1:]
+			switch {
+			case strings.HasPrefix(inner, "?(") && strings.HasSuffix(inner, ")"):
+				query, err := parseJSONPathQuery(strings.TrimPrefix(inner[2:len(inner)-1], "@"), func(field string) ([]jsonPathStep, error) {
+					return parseBracketPath(field)
+				})
+				if err != nil {
+					return nil, err
+				}
+				steps = append(steps, jsonPathStep{query: query, index: -1})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, jsonPathStep{key: inner[1 : len(inner)-1], index: -1})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid index [%s]", inner)
+				}
+				steps = append(steps, jsonPathStep{index: index})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q", path)
+		}
+	}
+	if len(steps) == 0 {
+		return nil, errors.New("path selects the whole document")
+	}
+	return steps, nil
+}
+
+// matchingBracket returns the index of the ] closing the [ at path[0],
+// skipping quoted strings
+func matchingBracket(path string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// parseJSONPathQuery parses field==value or field!=value; value is a
+// quoted string, a number, true, false or null
+func parseJSONPathQuery(query string, parseField func(string) ([]jsonPathStep, error)) (*jsonPathQuery, error) {
+	op := "=="
+	at := strings.Index(query, "==")
+	if ne := strings.Index(query, "!="); ne >= 0 && (at < 0 || ne < at) {
+		op, at = "!=", ne
+	}
+	if at < 0 {
+		return nil, fmt.Errorf("query %q needs == or !=", query)
+	}
+	field, err := parseField(strings.TrimSpace(query[:at]))
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %w", query, err)
+	}
+	literal := strings.TrimSpace(query[at+2:])
+	var value interface{}
+	switch {
+	case len(literal) >= 2 && (literal[0] == '\'' || literal[0] == '"') && literal[len(literal)-1] == literal[0]:
+		value = literal[1 : len(literal)-1]
+	case literal == "true", literal == "false":
+		value = literal == "true"
+	case literal == "null":
+		value = nil
+	default:
+		f, err := strconv.ParseFloat(literal, 64)
+		if err != nil {
+			return nil, fmt.Errorf("query %q: invalid value %s", query, literal)
+		}
+		value = f
+	}
+	return &jsonPathQuery{field: field, op: op, value: value}, nil
+}
+
+func keyOrIndexStep(part string) jsonPathStep {
+	if index, err := strconv.Atoi(part); err == nil && index >= 0 {
+		// Digits address an array element, or the key of that name in an
+		// object
+		return jsonPathStep{key: part, index: index}
+	}
+	return jsonPathStep{key: part, index: -1}
+}
+
+// evalJSONPath walks a document decoded with UseNumber
+func evalJSONPath(doc interface{}, steps []jsonPathStep) (interface{}, bool) {
+	current := doc
+	for _, step := range steps {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if step.count || step.query != nil || step.key == "" && step.index >= 0 {
+				return nil, false
+			}
+			value, ok := node[step.key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			switch {
+			case step.count:
+				current = json.Number(strconv.Itoa(len(node)))
+			case step.query != nil:
+				found := false
+				for _, element := range node {
+					if step.query.matches(element) {
+						current, found = element, true
+						break
+					}
+				}
+				if !found {
+					return nil, false
+				}
+			case step.index >= 0 && step.index < len(node):
+				current = node[step.index]
+			default:
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (q *jsonPathQuery) matches(element interface{}) bool {
+	value, ok := evalJSONPath(element, q.field)
+	if !ok {
+		return false
+	}
+	var equal bool
+	switch want := q.value.(type) {
+	case string:
+		got, isString := value.(string)
+		equal = isString && got == want
+	case float64:
+		got, isNumber := value.(json.Number)
+		f, err := got.Float64()
+		equal = isNumber && err == nil && f == want
+	default:
+		equal = value == want
+	}
+	return equal == (q.op == "==")
+}
+
+// httpDriver polls REST endpoints, sharing recent responses between the
+// sensors of a URL
+type httpDriver struct {
+	config  *HTTPConfig
+	latency *latencyRecorder
+	client  *http.Client
+
+	mu        sync.Mutex
+	responses map[string]*httpResponse
+}
+
+// httpResponse is a decoded response body; done is closed once the request
+// finished, so concurrent readers of a URL wait for one request
+type httpResponse struct {
+	done    chan struct{}
+	doc     interface{}
+	err     error
+	fetched time.Time
+}
+
+func newHTTPDriver(config *HTTPConfig, latency *latencyRecorder) *httpDriver {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &httpDriver{
+		config:    config,
+		latency:   latency,
+		client:    &http.Client{Timeout: time.Duration(config.TimeoutMs) * time.Millisecond, Transport: transport},
+		responses: make(map[string]*httpResponse),
+	}
+}
+
+// requestKey identifies requests that return the same document
+func httpRequestKey(sensor *SensorConfig) string {
+	names := make([]string, 0, len(sensor.Headers))
+	for name := range sensor.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	key := []string{sensor.Address, sensor.Username, sensor.BearerToken}
+	for _, name := range names {
+		key = append(key, name+"="+sensor.Headers[name])
+	}
+	return strings.Join(key, "|")
+}
+
+// read GETs a sensor's URL (or uses a response fetched within cache_ms)
+// and extracts the value at its JSON path
+func (d *httpDriver) read(sensor *SensorConfig) (float64, string, error) {
+	key := httpRequestKey(sensor)
+	d.mu.Lock()
+	response, ok := d.responses[key]
+	if ok {
+		select {
+		case <-response.done:
+			if response.err != nil || time.Since(response.fetched) > time.Duration(d.config.CacheMs)*time.Millisecond {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		response = &httpResponse{done: make(chan struct{})}
+		d.responses[key] = response
+		go d.fetch(sensor, response)
+	}
+	d.mu.Unlock()
+
+	<-response.done
+	if response.err != nil {
+		return 0, "", response.err
+	}
+	value, found := evalJSONPath(response.doc, sensor.jsonPath)
+	if !found {
+		return 0, "", fmt.Errorf("HTTP read error: %s not found in the response of %s", sensor.JSONPath, sensor.Address)
+	}
+	return httpValue(sensor, value)
+}
+
+func (d *httpDriver) fetch(sensor *SensorConfig, response *httpResponse) {
+	defer close(response.done)
+	start := time.Now()
+	response.doc, response.err = d.get(sensor)
+	response.fetched = time.Now()
+	u, _ := url.Parse(sensor.Address)
+	d.latency.observe("http", u.Host, time.Since(start), response.err)
+}
+
+func (d *httpDriver) get(sensor *SensorConfig) (interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, sensor.Address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP read error: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	for name, value := range sensor.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	switch {
+	case sensor.Username != "":
+		req.SetBasicAuth(sensor.Username, os.ExpandEnv(sensor.Password))
+	case sensor.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(sensor.BearerToken))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP read error: %w", err)
+	}
+	defer resp.Body.Close()
+	limit := int64(d.config.MaxBodyKB) * 1024
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP read error: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP read error: %s returned %s", sensor.Address, resp.Status)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("HTTP read error: response of %s exceeds max_body_kb %d", sensor.Address, d.config.MaxBodyKB)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("HTTP read error: invalid JSON from %s: %w", sensor.Address, err)
+	}
+	return doc, nil
+}
+
+// httpValue converts the selected JSON value: strings are mapped through enum_map or parsed as numbers, booleans read 1 or 0
+func httpValue(sensor *SensorConfig, value interface{}) (float64, string, error) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, "", fmt.Errorf("HTTP read error: %s: %w", sensor.JSONPath, err)
+		}
+		return f, sensor.enumText[f], nil
+	case string:
+		text := strings.TrimSpace(v)
+		if code, ok := lookupEnumCode(sensor.EnumMap, text); ok {
+			return code, text, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, text, nil
+		}
+		if len(sensor.EnumMap) > 0 {
+			return 0, text, fmt.Errorf("HTTP state %q not found in enum_map", text)
+		}
+		return 0, text, nil
+	case bool:
+		if v {
+			return 1, sensor.enumText[1], nil
+		}
+		return 0, sensor.enumText[0], nil
+	case nil:
+		return 0, "", fmt.Errorf("HTTP read error: %s is null", sensor.JSONPath)
+	default:
+		return 0, "", fmt.Errorf("HTTP read error: %s selects an object or array, not a value", sensor.JSONPath)
+	}
+}
+
+func (d *httpDriver) close() {
+	d.client.CloseIdleConnections()
+}
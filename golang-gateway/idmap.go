@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// IDMappingConfig declares the external systems (e.g. cmms, ifc, erp) whose
+// identifiers are attached to rooms and sensors. IDs are set inline with
+// external_ids in rooms.yaml and sensors.yaml, or loaded from registry
+// exports; inline IDs win. Mapped IDs are published in room telemetry under
+// external_ids (the room's) and sensor_external_ids (per sensor).
+type IDMappingConfig struct {
+	Systems    []string           `yaml:"systems"`
+	Registries []IDRegistryConfig `yaml:"registries"`
+}
+
+// IDRegistryConfig is an export of an external asset registry. A csv file
+// has rows of kind (room or sensor), internal ID and external ID, with an
+// optional header row; a json file is {"rooms": {id: ext}, "sensors": {...}}.
+type IDRegistryConfig struct {
+	System string `yaml:"system"`
+	Format string `yaml:"format,omitempty"` // csv (default) or json
+	Path   string `yaml:"path"`
+}
+
+func (c *IDMappingConfig) normalize() error {
+	declared := make(map[string]bool)
+	for _, system := range c.Systems {
+		if system == "" || declared[system] {
+			return fmt.Errorf("id_mapping: empty or duplicate system %q", system)
+		}
+		declared[system] = true
+	}
+	for i := range c.Registries {
+		r := &c.Registries[i]
+		if !declared[r.System] {
+			return fmt.Errorf("id_mapping: registry %s has undeclared system %q", r.Path, r.System)
+		}
+		if r.Format == "" {
+			r.Format = "csv"
+		}
+		if _, ok := idRegistryFormats[r.Format]; !ok {
+			return fmt.Errorf("id_mapping: registry %s has unknown format %q (csv or json)", r.Path, r.Format)
+		}
+		if r.Path == "" {
+			return fmt.Errorf("id_mapping: registry of system %s without path", r.System)
+		}
+	}
+	return nil
+}
+
+// idRegistryEntries maps kind ("room" or "sensor") to internal and external
+// IDs
+type idRegistryEntries map[string]map[string]string
+
+// idRegistryFormats are the registry export readers by format; further
+// registries plug in here
+var idRegistryFormats = map[string]func(io.Reader) (idRegistryEntries, error){
+	"csv":  readCSVRegistry,
+	"json": readJSONRegistry,
+}
+
+func readCSVRegistry(r io.Reader) (idRegistryEntries, error) {
+	rows := csv.NewReader(r)
+	rows.FieldsPerRecord = 3
+	rows.TrimLeadingSpace = true
+	rows.Comment = '#'
+	entries := idRegistryEntries{"room": {}, "sensor": {}}
+	for line := 1; ; line++ {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		kind := strings.ToLower(row[0])
+		if line == 1 && kind == "kind" {
+			continue
+		}
+		ids, ok := entries[kind]
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown kind %q (room or sensor)", line, row[0])
+		}
+		ids[row[1]] = row[2]
+	}
+}
+
+func readJSONRegistry(r io.Reader) (idRegistryEntries, error) {
+	var file struct {
+		Rooms   map[string]string `json:"rooms"`
+		Sensors map[string]string `json:"sensors"`
+	}
+	if err := json.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+	return idRegistryEntries{"room": file.Rooms, "sensor": file.Sensors}, nil
+}
+
+// resolveExternalIDs validates inline external IDs and merges in the
+// registries, so every room and sensor carries its complete mapping
+func (gw *Gateway) resolveExternalIDs() error {
+	config := &gw.settings.IDMapping
+	declared := make(map[string]bool)
+	for _, system := range config.Systems {
+		declared[system] = true
+	}
+	for id, room := range gw.rooms {
+		for system := range room.ExternalIDs {
+			if !declared[system] {
+				return fmt.Errorf("room %s: external_ids system %q is not declared in id_mapping", id, system)
+			}
+		}
+	}
+	for id, sensor := range gw.sensors {
+		for system := range sensor.ExternalIDs {
+			if !declared[system] {
+				return fmt.Errorf("sensor %s: external_ids system %q is not declared in id_mapping", id, system)
+			}
+		}
+	}
+
+	for _, registry := range config.Registries {
+		f, err := os.Open(registry.Path)
+		if err != nil {
+			return fmt.Errorf("id_mapping: %w", err)
+		}
+		entries, err := idRegistryFormats[registry.Format](f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("id_mapping: failed to read %s: %w", registry.Path, err)
+		}
+		var unknown []string
+		for roomID, externalID := range entries["room"] {
+			room, ok := gw.rooms[roomID]
+			if !ok {
+				unknown = append(unknown, roomID)
+				continue
+			}
+			room.ExternalIDs = withExternalID(room.ExternalIDs, registry.System, externalID)
+		}
+		for sensorID, externalID := range entries["sensor"] {
+			sensor, ok := gw.sensors[sensorID]
+			if !ok {
+				unknown = append(unknown, sensorID)
+				continue
+			}
+			sensor.ExternalIDs = withExternalID(sensor.ExternalIDs, registry.System, externalID)
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			log.Printf("[WARN] id_mapping: %s maps %d unknown rooms or sensors: %s", registry.Path, len(unknown), strings.Join(unknown, ", "))
+		}
+	}
+	return nil
+}
+
+// withExternalID adds an ID unless the system is already mapped inline
+func withExternalID(ids map[string]string, system, externalID string) map[string]string {
+	if _, ok := ids[system]; ok || externalID == "" {
+		return ids
+	}
+	if ids == nil {
+		ids = make(map[string]string)
+	}
+	ids[system] = externalID
+	return ids
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KNXConfig holds the KNXnet/IP interface the gateway tunnels through.
+// Sensors with protocol knx name a group address in address (3-level
+// 1/2/3, 2-level 1/234 or a plain number) and its datapoint type in dpt.
+// Polled sensors send a GroupValueRead; with subscribe set a sensor is not
+// polled and records every value written to its group address instead.
+type KNXConfig struct {
+	Gateway      string `yaml:"gateway,omitempty"`       // host[:port], default port 3671
+	TimeoutMs    int    `yaml:"timeout_ms,omitempty"`    // connect and read response timeout, default 2000
+	HeartbeatSec int    `yaml:"heartbeat_sec,omitempty"` // connection state interval, default 60
+}
+
+func (c *KNXConfig) normalize() {
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 2000
+	}
+	if c.HeartbeatSec <= 0 {
+		c.HeartbeatSec = 60
+	}
+}
+
+// knxDatapointSizes are the supported datapoint main types and their value
+// size in bytes
+var knxDatapointSizes = map[int]int{
+	1:  1, // boolean (switch, status)
+	5:  1, // 8-bit unsigned (5.001 percent, 5.003 angle)
+	6:  1, // 8-bit signed
+	7:  2, // 16-bit unsigned
+	8:  2, // 16-bit signed
+	9:  2, // 16-bit float (9.001 temperature, 9.004 lux)
+	12: 4, // 32-bit unsigned
+	13: 4, // 32-bit signed
+	14: 4, // 32-bit IEEE float
+}
+
+// validateKNXSensors checks the group addresses and datapoint types of
+// sensors
+func (gw *Gateway) validateKNXSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "knx" {
+			if sensor.DPT != "" {
+				return fmt.Errorf("sensor %s: dpt is only valid for protocol knx", id)
+			}
+			continue
+		}
+		if gw.settings.KNX.Gateway == "" {
+			return fmt.Errorf("sensor %s: protocol knx requires knx.gateway in the gateway config", id)
+		}
+		group, err := parseKNXGroupAddress(sensor.Address)
+		if err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		sensor.knxGroup = group
+		if _, _, err := parseKNXDatapoint(sensor.DPT); err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol knx", id)
+		}
+	}
+	return nil
+}
+
+// parseKNXGroupAddress parses a 3-level (main/middle/sub), 2-level
+// (main/sub) or plain group address
+func parseKNXGroupAddress(address string) (uint16, error) {
+	parts := strings.Split(address, "/")
+	limits := map[int][]uint64{1: {65535}, 2: {31, 2047}, 3: {31, 7, 255}}[len(parts)]
+	if limits == nil {
+		return 0, fmt.Errorf("invalid KNX group address %q, expected main/middle/sub such as 1/2/3", address)
+	}
+	shifts := map[int][]uint{1: {0}, 2: {11, 0}, 3: {11, 8, 0}}[len(parts)]
+	var group uint64
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 16)
+		if err != nil || n > limits[i] {
+			return 0, fmt.Errorf("invalid KNX group address %q, expected main/middle/sub such as 1/2/3", address)
+		}
+		group |= n << shifts[i]
+	}
+	if group == 0 {
+		return 0, fmt.Errorf("KNX group address 0/0/0 is the broadcast address")
+	}
+	return uint16(group), nil
+}
+
+// formatKNXGroupAddress writes a group address in 3-level form
+func formatKNXGroupAddress(group uint16) string {
+	return fmt.Sprintf("%d/%d/%d", group>>11, (group>>8)&0x07, group&0xFF)
+}
+
+// parseKNXDatapoint splits a datapoint type such as 9.001 into main and
+// sub number; the sub number is optional
+func parseKNXDatapoint(dpt string) (int, int, error) {
+	mainPart, subPart, hasSub := strings.Cut(strings.TrimPrefix(strings.ToUpper(dpt), "DPT"), ".")
+	mainType, err := strconv.Atoi(mainPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid KNX dpt %q, expected a datapoint type such as 9.001", dpt)
+	}
+	if _, ok := knxDatapointSizes[mainType]; !ok {
+		return 0, 0, fmt.Errorf("unsupported KNX dpt %q (main types 1, 5, 6, 7, 8, 9, 12, 13 and 14)", dpt)
+	}
+	subType := 0
+	if hasSub {
+		if subType, err = strconv.Atoi(subPart); err != nil {
+			return 0, 0, fmt.Errorf("invalid KNX dpt %q, expected a datapoint type such as 9.001", dpt)
+		}
+	}
+	return mainType, subType, nil
+}
+
+// decodeKNXDatapoint decodes the value bytes of a group telegram
+func decodeKNXDatapoint(dpt string, data []byte) (float64, error) {
+	mainType, subType, err := parseKNXDatapoint(dpt)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != knxDatapointSizes[mainType] {
+		return 0, fmt.Errorf("KNX dpt %s expects %d data byte(s), got %d", dpt, knxDatapointSizes[mainType], len(data))
+	}
+	switch mainType {
+	case 1:
+		return float64(data[0] & 0x01), nil
+	case 5:
+		switch subType {
+		case 1:
+			return float64(data[0]) * 100 / 255, nil
+		case 3:
+			return float64(data[0]) * 360 / 255, nil
+		}
+		return float64(data[0]), nil
+	case 6:
+		return float64(int8(data[0])), nil
+	case 7:
+		return float64(binary.BigEndian.Uint16(data)), nil
+	case 8:
+		return float64(int16(binary.BigEndian.Uint16(data))), nil
+	case 9:
+		raw := binary.BigEndian.Uint16(data)
+		if raw == 0x7FFF {
+			return 0, errors.New("KNX device reported an invalid value")
+		}
+		mantissa := int(raw & 0x07FF)
+		if raw&0x8000 != 0 {
+			mantissa -= 2048
+		}
+		exponent := int(raw>>11) & 0x0F
+		return 0.01 * float64(mantissa) * math.Pow(2, float64(exponent)), nil
+	case 12:
+		return float64(binary.BigEndian.Uint32(data)), nil
+	case 13:
+		return float64(int32(binary.BigEndian.Uint32(data))), nil
+	default:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
+	}
+}
+
+// knxDriver shares one tunnel to the KNXnet/IP interface between polled
+// and subscribed sensors. The tunnel is opened on first use and reopened
+// after it fails; group telegrams are handed to waiting reads and to the
+// subscription handler.
+type knxDriver struct {
+	config  *KNXConfig
+	latency *latencyRecorder
+
+	mu      sync.Mutex
+	tunnel  *knxTunnel
+	waiters map[uint16][]chan []byte
+	handler func(knxTelegram)
+}
+
+func newKNXDriver(config *KNXConfig, latency *latencyRecorder) *knxDriver {
+	return &knxDriver{config: config, latency: latency, waiters: make(map[uint16][]chan []byte)}
+}
+
+// connect returns the open tunnel, dialing the interface if needed
+func (d *knxDriver) connect() (*knxTunnel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tunnel != nil && !d.tunnel.closed() {
+		return d.tunnel, nil
+	}
+	timeout := time.Duration(d.config.TimeoutMs) * time.Millisecond
+	tunnel, err := dialKNXTunnel(d.config.Gateway, timeout, d.dispatch)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("KNX tunnel to %s open on channel %d", d.config.Gateway, tunnel.channel)
+	d.tunnel = tunnel
+	go d.keepAlive(tunnel)
+	return tunnel, nil
+}
+
+// keepAlive sends connection state requests until the tunnel closes
+func (d *knxDriver) keepAlive(tunnel *knxTunnel) {
+	ticker := time.NewTicker(time.Duration(d.config.HeartbeatSec) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tunnel.done:
+			return
+		case <-ticker.C:
+			if err := tunnel.heartbeat(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dispatch passes a group telegram to the reads waiting for its group
+// address and to the subscription handler
+func (d *knxDriver) dispatch(telegram knxTelegram) {
+	d.mu.Lock()
+	for _, ch := range d.waiters[telegram.group] {
+		select {
+		case ch <- telegram.data:
+		default:
+		}
+	}
+	handler := d.handler
+	d.mu.Unlock()
+	if handler != nil {
+		handler(telegram)
+	}
+}
+
+// read sends a GroupValueRead for a sensor's group address and decodes the
+// response
+func (d *knxDriver) read(sensor *SensorConfig) (float64, string, error) {
+	start := time.Now()
+	data, err := d.groupRead(sensor.knxGroup)
+	d.latency.observe("knx", d.config.Gateway, time.Since(start), err)
+	if err != nil {
+		return 0, "", fmt.Errorf("KNX read error: %s: %w", sensor.Address, err)
+	}
+	value, err := decodeKNXDatapoint(sensor.DPT, data)
+	if err != nil {
+		return 0, "", fmt.Errorf("KNX read error: %s: %w", sensor.Address, err)
+	}
+	return value, sensor.enumText[value], nil
+}
+
+func (d *knxDriver) groupRead(group uint16) ([]byte, error) {
+	tunnel, err := d.connect()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan []byte, 1)
+	d.mu.Lock()
+	d.waiters[group] = append(d.waiters[group], ch)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		waiters := d.waiters[group]
+		for i, w := range waiters {
+			if w == ch {
+				d.waiters[group] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(d.waiters[group]) == 0 {
+			delete(d.waiters, group)
+		}
+	}()
+
+	if err := tunnel.groupRead(group); err != nil {
+		return nil, err
+	}
+	select {
+	case data := <-ch:
+		return data, nil
+	case <-tunnel.done:
+		return nil, errors.New("KNX tunnel closed")
+	case <-time.After(time.Duration(d.config.TimeoutMs) * time.Millisecond):
+		return nil, errors.New("no response from the bus")
+	}
+}
+
+func (d *knxDriver) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.tunnel != nil {
+		d.tunnel.close(nil)
+		d.tunnel = nil
+	}
+}
+
+// knxSubscribedSensors groups the knx sensors with subscribe set by group
+// address
+func (gw *Gateway) knxSubscribedSensors() map[uint16][]*SensorConfig {
+	groups := make(map[uint16][]*SensorConfig)
+	for _, sensor := range gw.sensors {
+		if sensor.Protocol == "knx" && sensor.Subscribe {
+			groups[sensor.knxGroup] = append(groups[sensor.knxGroup], sensor)
+		}
+	}
+	return groups
+}
+
+// subscribeKNX keeps the tunnel open for subscribed sensors and records the
+// values written to their group addresses, reopening it with backoff until
+// shutdown. After each connect the current values are requested once.
+func (gw *Gateway) subscribeKNX(groups map[uint16][]*SensorConfig) {
+	defer gw.wg.Done()
+
+	gw.knx.mu.Lock()
+	gw.knx.handler = func(telegram knxTelegram) {
+		for _, sensor := range groups[telegram.group] {
+			if gw.control.isPaused(sensor.ID) {
+				continue
+			}
+			value, err := decodeKNXDatapoint(sensor.DPT, telegram.data)
+			if err != nil {
+				err = fmt.Errorf("KNX value error: %s: %w", sensor.Address, err)
+			}
+			gw.recordReading(sensor.ID, sensor, value, sensor.enumText[value], err, time.Time{}, newTraceID())
+		}
+	}
+	gw.knx.mu.Unlock()
+
+	backoff := time.Second
+	for {
+		tunnel, err := gw.knx.connect()
+		if err == nil {
+			backoff = time.Second
+			log.Printf("Subscribed to %d KNX group address(es)", len(groups))
+			for group := range groups {
+				if err := tunnel.groupRead(group); err != nil {
+					log.Printf("[WARN] KNX read of %s failed: %v", formatKNXGroupAddress(group), err)
+					break
+				}
+			}
+			select {
+			case <-gw.shutdown:
+				return
+			case <-tunnel.done:
+			}
+			err = errors.New("tunnel closed")
+		}
+		log.Printf("[WARN] KNX subscription to %s ended: %v; retrying in %v", gw.settings.KNX.Gateway, err, backoff)
+		select {
+		case <-gw.shutdown:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
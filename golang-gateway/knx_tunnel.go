@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// KNXnet/IP services (ISO 22510 / KNX Standard 3.8) used by the tunnel
+const (
+	knxHeaderSize             = 0x06
+	knxProtocolVersion        = 0x10
+	knxConnectRequest         = 0x0205
+	knxConnectResponse        = 0x0206
+	knxConnectionStateRequest = 0x0207
+	knxConnectionStateResp    = 0x0208
+	knxDisconnectRequest      = 0x0209
+	knxDisconnectResponse     = 0x020A
+	knxTunnellingRequest      = 0x0420
+	knxTunnellingAck          = 0x0421
+	knxDefaultPort            = "3671"
+	knxMaxFrame               = 512
+)
+
+// cEMI message codes and APCI values of group communication
+const (
+	cemiLDataReq     = 0x11
+	cemiLDataCon     = 0x2E
+	cemiLDataInd     = 0x29
+	apciGroupRead    = 0x000
+	apciGroupResp    = 0x040
+	apciGroupWrite   = 0x080
+	apciMask         = 0x3C0
+	knxCtrl1Standard = 0xBC // standard frame, no repeat, low priority
+	knxCtrl2Group    = 0xE0 // group destination, hop count 6
+)
+
+// knxHPAINAT is a host protocol address of 0.0.0.0:0, asking the interface
+// to answer to the address the request came from so the tunnel works
+// through NAT and container networks
+var knxHPAINAT = []byte{0x08, 0x01, 0, 0, 0, 0, 0, 0}
+
+// knxTelegram is a group telegram received on the bus: the group address
+// and the value bytes (for values of 6 bits or less, one byte holding them)
+type knxTelegram struct {
+	group uint16
+	data  []byte
+}
+
+// knxTunnel is one tunnelling connection to a KNXnet/IP interface. Tunnel
+// requests are sent one at a time and acknowledged; telegrams on the bus
+// are passed to the handler.
+type knxTunnel struct {
+	conn    *net.UDPConn
+	timeout time.Duration
+	handler func(knxTelegram)
+
+	channel byte
+	address uint16 // individual address assigned by the interface
+
+	sendMu  sync.Mutex
+	sendSeq byte
+	acks    chan byte
+	states  chan byte
+
+	recvSeq  byte
+	received bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// dialKNXTunnel connects to an interface (host[:port]) and opens a
+// tunnelling connection on the link layer
+func dialKNXTunnel(gateway string, timeout time.Duration, handler func(knxTelegram)) (*knxTunnel, error) {
+	if _, _, err := net.SplitHostPort(gateway); err != nil {
+		gateway = net.JoinHostPort(gateway, knxDefaultPort)
+	}
+	addr, err := net.ResolveUDPAddr("udp4", gateway)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KNX gateway %s: %w", gateway, err)
+	}
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	t := &knxTunnel{
+		conn:    conn,
+		timeout: timeout,
+		handler: handler,
+		acks:    make(chan byte, 4),
+		states:  make(chan byte, 1),
+		done:    make(chan struct{}),
+	}
+
+	body := append(append(append([]byte(nil), knxHPAINAT...), knxHPAINAT...), 0x04, 0x04, 0x02, 0x00)
+	if err := t.send(knxConnectRequest, body); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, knxMaxFrame)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("no KNX connect response: %w", err)
+		}
+		service, body, ok := parseKNXFrame(buf[:n])
+		if !ok || service != knxConnectResponse {
+			continue
+		}
+		if len(body) < 2 {
+			conn.Close()
+			return nil, errors.New("truncated KNX connect response")
+		}
+		if body[1] != 0 {
+			conn.Close()
+			return nil, fmt.Errorf("KNX interface refused the connection: %s", knxStatusText(body[1]))
+		}
+		t.channel = body[0]
+		if len(body) >= 14 {
+			t.address = binary.BigEndian.Uint16(body[12:14])
+		}
+		break
+	}
+	conn.SetReadDeadline(time.Time{})
+	go t.receive()
+	return t, nil
+}
+
+// knxStatusText names the common connect and connection state errors
+func knxStatusText(status byte) string {
+	switch status {
+	case 0x21:
+		return "connection ID invalid"
+	case 0x22:
+		return "connection type not supported"
+	case 0x23:
+		return "connection option not supported"
+	case 0x24:
+		return "no more connections"
+	case 0x26:
+		return "data connection error"
+	case 0x27:
+		return "KNX connection error"
+	case 0x29:
+		return "tunnelling layer not supported"
+	}
+	return fmt.Sprintf("status 0x%02X", status)
+}
+
+// parseKNXFrame checks a KNXnet/IP header and returns the service and body
+func parseKNXFrame(frame []byte) (uint16, []byte, bool) {
+	if len(frame) < knxHeaderSize || frame[0] != knxHeaderSize || frame[1] != knxProtocolVersion {
+		return 0, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(frame[4:6]))
+	if length < knxHeaderSize || length > len(frame) {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint16(frame[2:4]), frame[knxHeaderSize:length], true
+}
+
+// send writes one KNXnet/IP frame
+func (t *knxTunnel) send(service uint16, body []byte) error {
+	frame := []byte{knxHeaderSize, knxProtocolVersion, byte(service >> 8), byte(service), 0, 0}
+	binary.BigEndian.PutUint16(frame[4:], uint16(knxHeaderSize+len(body)))
+	_, err := t.conn.Write(append(frame, body...))
+	return err
+}
+
+// receive handles frames from the interface until the tunnel closes
+func (t *knxTunnel) receive() {
+	buf := make([]byte, knxMaxFrame)
+	for {
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			t.close(fmt.Errorf("receive error: %w", err))
+			return
+		}
+		service, body, ok := parseKNXFrame(buf[:n])
+		if !ok || len(body) < 2 {
+			continue
+		}
+		switch service {
+		case knxTunnellingRequest:
+			t.handleTunnelling(body)
+		case knxTunnellingAck:
+			if len(body) >= 4 && body[1] == t.channel {
+				if body[3] != 0 {
+					log.Printf("[WARN] KNX interface rejected tunnelling request %d: %s", body[2], knxStatusText(body[3]))
+					continue
+				}
+				select {
+				case t.acks <- body[2]:
+				default:
+				}
+			}
+		case knxConnectionStateResp:
+			if body[0] == t.channel {
+				select {
+				case t.states <- body[1]:
+				default:
+				}
+			}
+		case knxDisconnectRequest:
+			if body[0] == t.channel {
+				t.send(knxDisconnectResponse, []byte{t.channel, 0})
+				t.close(errors.New("interface closed the connection"))
+				return
+			}
+		}
+	}
+}
+
+// handleTunnelling acknowledges a tunnelling request and passes group
+// telegrams to the handler; repeats of the last request are only
+// acknowledged again
+func (t *knxTunnel) handleTunnelling(body []byte) {
+	if len(body) < 4 || body[0] != 0x04 || body[1] != t.channel {
+		return
+	}
+	seq := body[2]
+	if t.received && seq == t.recvSeq {
+		t.send(knxTunnellingAck, []byte{0x04, t.channel, seq, 0})
+		return
+	}
+	if t.received && seq != t.recvSeq+1 {
+		return // out of sequence, the interface repeats it
+	}
+	t.send(knxTunnellingAck, []byte{0x04, t.channel, seq, 0})
+	t.recvSeq, t.received = seq, true
+
+	if telegram, ok := parseGroupTelegram(body[4:]); ok && t.handler != nil {
+		t.handler(telegram)
+	}
+}
+
+// parseGroupTelegram extracts a GroupValueWrite or GroupValueResponse from
+// an L_Data.ind cEMI frame
+func parseGroupTelegram(cemi []byte) (knxTelegram, bool) {
+	if len(cemi) < 2 || cemi[0] != cemiLDataInd {
+		return knxTelegram{}, false
+	}
+	frame := cemi[2+int(cemi[1]):] // skip additional info
+	if len(frame) < 9 || frame[1]&0x80 == 0 {
+		return knxTelegram{}, false
+	}
+	length := int(frame[6])
+	apdu := frame[7:]
+	if len(apdu) < 2 || len(apdu) < length+1 {
+		return knxTelegram{}, false
+	}
+	apci := (uint16(apdu[0])<<8 | uint16(apdu[1])) & apciMask
+	if apci != apciGroupWrite && apci != apciGroupResp {
+		return knxTelegram{}, false
+	}
+	telegram := knxTelegram{group: binary.BigEndian.Uint16(frame[4:6])}
+	if length == 1 {
+		telegram.data = []byte{apdu[1] & 0x3F}
+	} else {
+		telegram.data = append([]byte(nil), apdu[2:length+1]...)
+	}
+	return telegram, true
+}
+
+// groupRead sends a GroupValueRead for a group address; the answer arrives
+// as a telegram
+func (t *knxTunnel) groupRead(group uint16) error {
+	cemi := []byte{cemiLDataReq, 0x00, knxCtrl1Standard, knxCtrl2Group, 0, 0, byte(group >> 8), byte(group), 0x01, 0x00, apciGroupRead}
+	return t.tunnel(cemi)
+}
+
+// tunnel sends a cEMI frame and waits for its acknowledgement, repeating
+// it once; a request acknowledged by neither attempt closes the tunnel
+func (t *knxTunnel) tunnel(cemi []byte) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+	seq := t.sendSeq
+	body := append([]byte{0x04, t.channel, seq, 0}, cemi...)
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := t.send(knxTunnellingRequest, body); err != nil {
+			t.close(err)
+			return err
+		}
+		deadline := time.After(time.Second)
+	wait:
+		for {
+			select {
+			case ack := <-t.acks:
+				if ack == seq {
+					t.sendSeq++
+					return nil
+				}
+			case <-deadline:
+				break wait
+			case <-t.done:
+				return errors.New("KNX tunnel closed")
+			}
+		}
+	}
+	err := errors.New("KNX interface did not acknowledge the tunnelling request")
+	t.close(err)
+	return err
+}
+
+// heartbeat checks the connection state, closing the tunnel when the
+// interface does not answer three requests
+func (t *knxTunnel) heartbeat() error {
+	body := append([]byte{t.channel, 0}, knxHPAINAT...)
+	for attempt := 0; attempt < 3; attempt++ {
+		if err := t.send(knxConnectionStateRequest, body); err != nil {
+			break
+		}
+		select {
+		case status := <-t.states:
+			if status == 0 {
+				return nil
+			}
+			err := fmt.Errorf("KNX connection state: %s", knxStatusText(status))
+			t.close(err)
+			return err
+		case <-time.After(10 * time.Second):
+		case <-t.done:
+			return errors.New("KNX tunnel closed")
+		}
+	}
+	err := errors.New("KNX interface did not answer connection state requests")
+	t.close(err)
+	return err
+}
+
+// close ends the tunnel; the first reason is logged
+func (t *knxTunnel) close(reason error) {
+	t.closeOnce.Do(func() {
+		if reason != nil {
+			log.Printf("[WARN] KNX tunnel closed: %v", reason)
+		}
+		t.send(knxDisconnectRequest, append([]byte{t.channel, 0}, knxHPAINAT...))
+		close(t.done)
+		t.conn.Close()
+	})
+}
+
+func (t *knxTunnel) closed() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LiveConfig pushes room telemetry to live dashboards as it is published.
+// GET /stream serves it as server-sent events (one "telemetry" event per
+// room publish, optionally filtered with ?rooms=); when GrafanaURL is set the
+// same telemetry is pushed to Grafana Live as line protocol on
+// stream/<stream_id>/room, so panels update without polling the lake.
+type LiveConfig struct {
+	GrafanaURL string `yaml:"grafana_url,omitempty"`
+	// Token is a Grafana service account token; ${VAR} references are expanded
+	Token    string `yaml:"token,omitempty"`
+	StreamID string `yaml:"stream_id,omitempty"`
+}
+
+func (c *LiveConfig) normalize() {
+	if c.StreamID == "" {
+		c.StreamID = "smart_building"
+	}
+}
+
+// liveClientBuffer is how many events a slow SSE client may fall behind
+// before events to it are dropped
+const liveClientBuffer = 64
+
+type liveEvent struct {
+	roomID  string
+	payload []byte
+}
+
+// liveHub fans telemetry out to SSE clients and the Grafana pusher
+type liveHub struct {
+	config  *LiveConfig
+	token   string
+	mu      sync.Mutex
+	clients map[chan liveEvent]struct{}
+	closed  chan struct{}
+	grafana chan *RoomTelemetry
+	client  *http.Client
+}
+
+func newLiveHub(config *LiveConfig) *liveHub {
+	h := &liveHub{
+		config:  config,
+		token:   os.ExpandEnv(config.Token),
+		clients: make(map[chan liveEvent]struct{}),
+		closed:  make(chan struct{}),
+	}
+	if config.GrafanaURL != "" {
+		h.grafana = make(chan *RoomTelemetry, 256)
+		h.client = &http.Client{Timeout: 5 * time.Second}
+		go h.pushGrafana()
+	}
+	return h
+}
+
+// publish hands telemetry to every subscriber without blocking
+func (h *liveHub) publish(roomID string, telemetry *RoomTelemetry) {
+	h.mu.Lock()
+	subscribers := len(h.clients)
+	h.mu.Unlock()
+	if subscribers > 0 {
+		payload, err := json.Marshal(telemetry)
+		if err == nil {
+			event := liveEvent{roomID: roomID, payload: payload}
+			h.mu.Lock()
+			for ch := range h.clients {
+				select {
+				case ch <- event:
+				default:
+				}
+			}
+			h.mu.Unlock()
+		}
+	}
+	if h.grafana != nil {
+		select {
+		case h.grafana <- telemetry:
+		default:
+		}
+	}
+}
+
+func (h *liveHub) subscribe() chan liveEvent {
+	ch := make(chan liveEvent, liveClientBuffer)
+	h.mu.Lock()
+	h.clients[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *liveHub) unsubscribe(ch chan liveEvent) {
+	h.mu.Lock()
+	delete(h.clients, ch)
+	h.mu.Unlock()
+}
+
+// close ends every SSE stream and the Grafana pusher
+func (h *liveHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.closed:
+	default:
+		close(h.closed)
+	}
+}
+
+// handleStream serves GET /stream as server-sent events; with ?units= the
+// telemetry is converted to an output profile
+func (gw *Gateway) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSONError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	rooms := make(map[string]bool)
+	for _, id := range splitList(r.URL.Query().Get("rooms")) {
+		rooms[id] = true
+	}
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ch := gw.live.subscribe()
+	defer gw.live.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 2000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-gw.live.closed:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-ch:
+			if (len(rooms) > 0 && !rooms[event.roomID]) || !gw.roomAllowed(r, event.roomID) {
+				continue
+			}
+			fmt.Fprintf(w, "event: telemetry\nid: %s\ndata: %s\n\n", event.roomID, profile.convertTelemetry(event.payload))
+		}
+		flusher.Flush()
+	}
+}
+
+// pushGrafana batches queued telemetry into Grafana Live push requests
+func (h *liveHub) pushGrafana() {
+	url := fmt.Sprintf("%s/api/live/push/%s", strings.TrimRight(h.config.GrafanaURL, "/"), h.config.StreamID)
+	failing := false
+	for {
+		var batch []*RoomTelemetry
+		select {
+		case <-h.closed:
+			return
+		case t := <-h.grafana:
+			batch = append(batch, t)
+		}
+	drain:
+		for len(batch) < 256 {
+			select {
+			case t := <-h.grafana:
+				batch = append(batch, t)
+			default:
+				break drain
+			}
+		}
+
+		var body bytes.Buffer
+		now := time.Now()
+		for _, t := range batch {
+			writeLineProtocol(&body, t, now)
+		}
+		err := h.post(url, &body)
+		if err != nil && !failing {
+			log.Printf("[ERROR] Grafana Live push failed: %v", err)
+		} else if err == nil && failing {
+			log.Printf("Grafana Live push recovered")
+		}
+		failing = err != nil
+	}
+}
+
+func (h *liveHub) post(url string, body *bytes.Buffer) error {
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// writeLineProtocol writes one room measurement tagged with its room and
+// tenant
+func writeLineProtocol(b *bytes.Buffer, t *RoomTelemetry, now time.Time) {
+	metrics := telemetryMetrics(t)
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	escape := strings.NewReplacer(" ", `\ `, ",", `\,`, "=", `\=`)
+	fmt.Fprintf(b, "room,room_id=%s", escape.Replace(t.RoomID))
+	if t.Tenant != "" {
+		fmt.Fprintf(b, ",tenant=%s", escape.Replace(t.Tenant))
+	}
+	b.WriteByte(' ')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strconv.FormatFloat(metrics[name], 'f', -1, 64))
+	}
+	fmt.Fprintf(b, " %d\n", now.UnixNano())
+}
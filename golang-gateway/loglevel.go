@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// Log levels, derived from the [DEBUG]/[WARN]/[ERROR] tags of log lines;
+// untagged lines are info
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]int32{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+
+// levelWriter drops log lines below the current level
+type levelWriter struct {
+	out   io.Writer
+	level atomic.Int32
+}
+
+var logFilter = &levelWriter{out: os.Stderr}
+
+func init() {
+	log.SetOutput(logFilter)
+	if err := setLogLevel(getEnv("LOG_LEVEL", "debug")); err != nil {
+		log.Printf("[WARN] %v; logging everything", err)
+	}
+}
+
+func setLogLevel(name string) error {
+	level, ok := logLevelNames[name]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", name)
+	}
+	logFilter.level.Store(level)
+	return nil
+}
+
+func logLevelName() string {
+	level := logFilter.level.Load()
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return ""
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	level := levelInfo
+	switch {
+	case bytes.Contains(p, []byte("[DEBUG]")):
+		level = levelDebug
+	case bytes.Contains(p, []byte("[WARN]")):
+		level = levelWarn
+	case bytes.Contains(p, []byte("[ERROR]")):
+		level = levelError
+	}
+	if level < w.level.Load() {
+		return len(p), nil
+	}
+	return w.out.Write(p)
+}
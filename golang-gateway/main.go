@@ -1,22 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
-	"net"
+	"math"
+	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/alexbeltran/gobacnet"
-	"github.com/alexbeltran/gobacnet/property"
 	"github.com/alexbeltran/gobacnet/types"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
-	"github.com/goburrow/modbus"
 	"gopkg.in/yaml.v3"
 )
 
@@ -30,38 +37,269 @@ type SensorConfig struct {
 	Register       int    `yaml:"register,omitempty"`
 	Unit           string `yaml:"unit"`
 	PollIntervalMs int    `yaml:"poll_interval_ms"`
+	// Schedule is a cron expression polling the sensor at clock times
+	// instead of every poll_interval_ms (see schedule.go)
+	Schedule string `yaml:"schedule,omitempty"`
+	cron     *cronSchedule
+	// MaxAgeSec marks the reading stale when no successful read arrives
+	// for this long (see stale.go)
+	MaxAgeSec int `yaml:"max_age_sec,omitempty"`
+	// TimeoutMs bounds each read, overriding the protocol's timeout (see
+	// timeouts.go)
+	TimeoutMs int `yaml:"timeout_ms,omitempty"`
+	// EnumMap maps state text (e.g. "off", "on", "auto") to numeric codes for
+	// character-string and enumerated present values; codes must be unique
+	EnumMap map[string]float64 `yaml:"enum_map,omitempty"`
+	// enumText is the reverse of EnumMap, built at load
+	enumText map[float64]string
+	// LatchMs holds an active leak/contact state for this long after the input
+	// clears, so short pulses are not missed between aggregation ticks
+	LatchMs int `yaml:"latch_ms,omitempty"`
+	// TrackRuntime accumulates runtime hours and start cycles for a binary
+	// status point; equipment status points are tracked automatically
+	TrackRuntime bool `yaml:"track_runtime,omitempty"`
+	// Writable allows commands on commands/<room_id>/<sensor_id>; the polled
+	// value is compared against the last commanded value within DriftTolerance
+	Writable       bool    `yaml:"writable,omitempty"`
+	DriftTolerance float64 `yaml:"drift_tolerance,omitempty"`
+	// WritePriority is the BACnet priority array slot commands write
+	// (1-16 except 6, default 16)
+	WritePriority int `yaml:"write_priority,omitempty"`
+
+	// Target is the driver sidecar (host:port) of protocol grpc sensors and
+	// Params are passed to it with every call; Subscribe takes the values
+	// the sidecar pushes (or, for protocol knx, the values written to the
+	// group address) instead of polling
+	Target    string            `yaml:"target,omitempty"`
+	Params    map[string]string `yaml:"params,omitempty"`
+	Subscribe bool              `yaml:"subscribe,omitempty"`
+
+	// UnitID is the Modbus slave ID at Address (MODBUS_ADDRESS when empty).
+	// RegisterType is the Modbus table of Register: holding (default),
+	// input, coil or discrete. DataType, ByteOrder and WordSwap decode
+	// registers starting at Register; a uint16 without DataType is scaled
+	// by 0.01 unless Scale is set (see modbus.go for the defaults)
+	UnitID       int    `yaml:"unit_id,omitempty"`
+	RegisterType string `yaml:"register_type,omitempty"`
+	DataType     string `yaml:"data_type,omitempty"`
+	ByteOrder    string `yaml:"byte_order,omitempty"`
+	WordSwap     bool   `yaml:"word_swap,omitempty"`
+
+	// Scale and Offset correct the raw value of any protocol (raw*Scale +
+	// Offset) and Calibration holds the coefficients c0, c1, c2... of a
+	// calibration polynomial applied after them (see calibration.go)
+	Scale       float64   `yaml:"scale,omitempty"`
+	Offset      float64   `yaml:"offset,omitempty"`
+	Calibration []float64 `yaml:"calibration,omitempty"`
+
+	// Deadband and DeadbandPercent filter unchanged readings by exception,
+	// with a report at least every MaxSilenceSec (see deadband.go)
+	Deadband        float64 `yaml:"deadband,omitempty"`
+	DeadbandPercent float64 `yaml:"deadband_percent,omitempty"`
+	MaxSilenceSec   int     `yaml:"max_silence_sec,omitempty"`
+
+	// Decoder names a WebAssembly decoder plugin applied to every reading
+	Decoder string `yaml:"decoder,omitempty"`
+
+	// DeviceInstance addresses a BACnet sensor by device instance, resolved
+	// by Who-Is discovery; Address is only used until the device answers
+	DeviceInstance *int `yaml:"device_instance,omitempty"`
+
+	// ObjectType and Property select the BACnet object type of ObjectID and
+	// the property read: analog-value and present-value by default, or e.g.
+	// binary-input, multi-state-value, status-flags or reliability (see
+	// bacnet_objects.go)
+	ObjectType string `yaml:"object_type,omitempty"`
+	Property   string `yaml:"property,omitempty"`
+
+	// Model names the external model of protocol model sensors and Output
+	// the score read, by default the sensor type (see models.go)
+	Model  string `yaml:"model,omitempty"`
+	Output string `yaml:"output,omitempty"`
+
+	// PollPriority low lets the resource budget lengthen the poll interval
+	// (see budget.go); default normal
+	PollPriority string `yaml:"poll_priority,omitempty"`
+
+	// Maintenance marks a sensor under planned work: its readings are still
+	// collected but flagged, and kept out of alarms and compliance
+	// statistics (see maintenance.go)
+	Maintenance bool `yaml:"maintenance,omitempty"`
+
+	// NodeID is the OPC UA node read by protocol opcua sensors at the
+	// opc.tcp:// endpoint in Address, e.g. ns=2;s=AHU1.SupplyTemp.
+	// SecurityPolicy is None (default) or Basic256Sha256 and SecurityMode
+	// defaults to SignAndEncrypt for secure policies; Username and Password
+	// log in instead of anonymously (see opcua.go)
+	NodeID         string `yaml:"node_id,omitempty"`
+	SecurityPolicy string `yaml:"security_policy,omitempty"`
+	SecurityMode   string `yaml:"security_mode,omitempty"`
+	Username       string `yaml:"username,omitempty"`
+	Password       string `yaml:"password,omitempty"`
+	opcuaNode      uaNodeID
+
+	// OID is read by protocol snmp sensors from the agent in Address, with
+	// SNMPVersion v2c (default, Community default public) or v3 with the
+	// user-based security in SNMPv3 (see snmp.go)
+	OID         string        `yaml:"oid,omitempty"`
+	SNMPVersion string        `yaml:"snmp_version,omitempty"`
+	Community   string        `yaml:"community,omitempty"`
+	SNMPv3      *SNMPv3Config `yaml:"snmp_v3,omitempty"`
+
+	// DPT is the KNX datapoint type of protocol knx sensors, whose Address
+	// is a group address such as 1/2/3 (see knx.go)
+	DPT      string `yaml:"dpt,omitempty"`
+	knxGroup uint16
+
+	// MBusRecord selects the data record protocol mbus sensors read from
+	// the meter at Address: a record index, or a quantity such as energy
+	// or volume for its current value (see mbus.go)
+	MBusRecord string `yaml:"mbus_record,omitempty"`
+
+	// JSONPath selects the value protocol http sensors extract from the
+	// JSON returned by a GET of the URL in Address, sent with Headers and
+	// basic auth (Username, Password) or BearerToken (see http_driver.go)
+	JSONPath    string            `yaml:"json_path,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	BearerToken string            `yaml:"bearer_token,omitempty"`
+	jsonPath    []jsonPathStep
+
+	// Attribute is the JSON attribute protocol zigbee sensors read from the
+	// state zigbee2mqtt publishes for the device named in Address, by
+	// default the usual attribute of the sensor type (see zigbee.go)
+	Attribute string `yaml:"attribute,omitempty"`
+
+	// DALIPoint selects what protocol dali sensors read from the control
+	// gear at the short address in Address: level (the default for
+	// dimmer_level sensors), status bits or emergency test results
+	// (see dali.go)
+	DALIPoint   string `yaml:"dali_point,omitempty"`
+	daliAddress byte
+
+	// ExternalIDs maps id_mapping systems (CMMS, IFC, ERP) to the sensor's
+	// external ID (see idmap.go)
+	ExternalIDs map[string]string `yaml:"external_ids,omitempty"`
+
+	// units converts readings to the canonical unit of Type; unitInvalid
+	// flags a unit that is incompatible with Type
+	units       *unitConversion
+	unitInvalid bool
 }
 
 type RoomConfig struct {
-	ID      string   `yaml:"id"`
-	Name    string   `yaml:"name"`
-	Floor   int      `yaml:"floor"`
-	Zone    string   `yaml:"zone"`
-	Sensors []string `yaml:"sensors"`
+	ID    string `yaml:"id"`
+	Name  string `yaml:"name"`
+	Floor int    `yaml:"floor"`
+	Zone  string `yaml:"zone"`
+	// Tenant scopes the room's data for multi-tenant buildings
+	Tenant string `yaml:"tenant,omitempty"`
+	// PublishIntervalMs overrides the telemetry publish interval
+	PublishIntervalMs int      `yaml:"publish_interval_ms,omitempty"`
+	Sensors           []string `yaml:"sensors"`
+	// ExternalIDs maps id_mapping systems to the room's external ID
+	ExternalIDs map[string]string `yaml:"external_ids,omitempty"`
+	// AreaM2 and VolumeM3 weight the room in zone and building rollups
+	AreaM2   float64 `yaml:"area_m2,omitempty"`
+	VolumeM3 float64 `yaml:"volume_m3,omitempty"`
 }
 
 type SensorsFile struct {
-	Sensors []SensorConfig `yaml:"sensors"`
+	SchemaVersion int            `yaml:"schema_version,omitempty"`
+	Sensors       []SensorConfig `yaml:"sensors"`
 }
 
 type RoomsFile struct {
-	Rooms []RoomConfig `yaml:"rooms"`
+	SchemaVersion int          `yaml:"schema_version,omitempty"`
+	Rooms         []RoomConfig `yaml:"rooms"`
+}
+
+// GatewayFile holds optional gateway-wide settings; every section has defaults
+// so the file may be absent
+type GatewayFile struct {
+	AirQuality   AirQualityConfig   `yaml:"air_quality"`
+	Equipment    []EquipmentConfig  `yaml:"equipment"`
+	Runtime      RuntimeConfig      `yaml:"runtime"`
+	Commands     CommandQueueConfig `yaml:"commands"`
+	API          APIConfig          `yaml:"api"`
+	FrameCapture FrameCaptureConfig `yaml:"frame_capture"`
+	Metrics      MetricsConfig      `yaml:"metrics"`
+	Store        StoreConfig        `yaml:"store"`
+	Delta        DeltaConfig        `yaml:"delta"`
+	// ConstrainedLink batches and compresses telemetry for metered backhaul
+	ConstrainedLink ConstrainedLinkConfig `yaml:"constrained_link"`
+	FallbackBroker  FallbackBrokerConfig  `yaml:"fallback_broker"`
+	Audit           AuditConfig           `yaml:"audit"`
+	Auth            AuthConfig            `yaml:"auth"`
+	RateLimit       RateLimitConfig       `yaml:"rate_limit"`
+	Units           UnitsConfig           `yaml:"units"`
+	OutputProfiles  OutputProfilesConfig  `yaml:"output_profiles"`
+	Replay          ReplayConfig          `yaml:"replay"`
+	History         HistoryConfig         `yaml:"history"`
+	Query           QueryConfig           `yaml:"query"`
+	Live            LiveConfig            `yaml:"live"`
+	Tenancy         TenancyConfig         `yaml:"tenancy"`
+	Control         ControlConfig         `yaml:"control"`
+	Parameters      ParametersConfig      `yaml:"parameters"`
+	PollGroups      []PollGroupConfig     `yaml:"poll_groups"`
+	Baseline        BaselineConfig        `yaml:"baseline"`
+	Commissioning   CommissioningConfig   `yaml:"commissioning"`
+	Completeness    CompletenessConfig    `yaml:"completeness"`
+	Privacy         PrivacyConfig         `yaml:"privacy"`
+	Rollups         RollupConfig          `yaml:"rollups"`
+	EmptyRooms      EmptyRoomsConfig      `yaml:"empty_rooms"`
+	StaleReadings   StaleReadingsConfig   `yaml:"stale_readings"`
+	ReadRetry       ReadRetryConfig       `yaml:"read_retry"`
+	ConfigWarnings  ConfigWarningsConfig  `yaml:"config_warnings"`
+	EventLog        EventLogConfig        `yaml:"event_log"`
+	Plugins         PluginsConfig         `yaml:"plugins"`
+	WarmStart       WarmStartConfig       `yaml:"warm_start"`
+	Alarms          AlarmsConfig          `yaml:"alarms"`
+	Comfort         ComfortConfig         `yaml:"comfort"`
+	Ventilation     VentilationConfig     `yaml:"ventilation"`
+	Publish         PublishConfig         `yaml:"publish"`
+	Aggregation     AggregationConfig     `yaml:"aggregation"`
+	FlatTopics      FlatTopicsConfig      `yaml:"flat_topics"`
+	Snapshot        SnapshotConfig        `yaml:"snapshot"`
+	Modbus          ModbusConfig          `yaml:"modbus"`
+	BACnetDiscovery BACnetDiscoveryConfig `yaml:"bacnet_discovery"`
+	BACnetMSTP      BACnetMSTPConfig      `yaml:"bacnet_mstp"`
+	BACnetAPDU      BACnetAPDUConfig      `yaml:"bacnet_apdu"`
+	Forecast        ForecastConfig        `yaml:"forecast"`
+	Models          []ModelConfig         `yaml:"models"`
+	Mirrors         []MirrorRule          `yaml:"mirrors"`
+	ResourceBudget  ResourceBudgetConfig  `yaml:"resource_budget"`
+	OPCUA           OPCUAConfig           `yaml:"opcua"`
+	IDMapping       IDMappingConfig       `yaml:"id_mapping"`
+	SNMP            SNMPConfig            `yaml:"snmp"`
+	KNX             KNXConfig             `yaml:"knx"`
+	MBus            MBusConfig            `yaml:"mbus"`
+	HTTP            HTTPConfig            `yaml:"http"`
+	Zigbee2MQTT     Zigbee2MQTTConfig     `yaml:"zigbee2mqtt"`
+	DALI            DALIConfig            `yaml:"dali"`
+	// GatewayID names this gateway in status topics and the MQTT client ID
+	PollSchedule PollScheduleConfig `yaml:"poll_schedule"`
+	GatewayID    string             `yaml:"gateway_id"`
 }
 
 // Sensor reading with metadata
 type SensorReading struct {
-	SensorID  string    `json:"sensor_id"`
-	RoomID    string    `json:"room_id"`
-	Type      string    `json:"type"`
-	Value     float64   `json:"value"`
-	Unit      string    `json:"unit"`
-	Timestamp time.Time `json:"timestamp"`
-	Status    string    `json:"status"` // "ok", "error", "stale"
+	SensorID    string    `json:"sensor_id"`
+	RoomID      string    `json:"room_id"`
+	Type        string    `json:"type"`
+	Value       float64   `json:"value"`
+	StringValue string    `json:"string_value,omitempty"` // state text for string/enum points
+	Unit        string    `json:"unit"`
+	Timestamp   time.Time `json:"timestamp"`
+	Status      string    `json:"status"` // "ok", "error", "offline", "stale"
+	TraceID     string    `json:"trace_id,omitempty"`
+	// Maintenance flags readings of a sensor under planned work
+	Maintenance bool `json:"maintenance,omitempty"`
 }
 
 // Room telemetry aggregated from all sensors
 type RoomTelemetry struct {
 	RoomID          string  `json:"room_id"`
+	Tenant          string  `json:"tenant,omitempty"`
 	Temperature     float64 `json:"temperature"`
 	Humidity        float64 `json:"humidity"`
 	CO2PPM          float64 `json:"co2_ppm"`
@@ -70,43 +308,242 @@ type RoomTelemetry struct {
 	MotionDetected  bool    `json:"motion_detected"`
 	EnergyKWH       float64 `json:"energy_kwh"`
 	AirQualityIndex float64 `json:"air_quality_index"`
-	Timestamp       string  `json:"timestamp"`
+	// Mechanical-plant points are pointers so that rooms without them omit
+	// the field rather than reporting a misleading zero (e.g. a closed valve)
+	StaticPressurePa *float64 `json:"static_pressure_pa,omitempty"`
+	AirFlow          *float64 `json:"air_flow,omitempty"`
+	WaterFlow        *float64 `json:"water_flow,omitempty"`
+	WaterVolumeM3    *float64 `json:"water_volume_m3,omitempty"`
+	ValvePosition    *float64 `json:"valve_position_pct,omitempty"`
+	DamperPosition   *float64 `json:"damper_position_pct,omitempty"`
+	// Particulate matter and volatile organics, needed for WELL/RESET reporting
+	PM25 *float64 `json:"pm25_ugm3,omitempty"`
+	PM10 *float64 `json:"pm10_ugm3,omitempty"`
+	TVOC *float64 `json:"tvoc_ppb,omitempty"`
+	// Binary safety points, reported with their latched state
+	LeakDetected *bool `json:"leak_detected,omitempty"`
+	ContactOpen  *bool `json:"contact_open,omitempty"`
+	// IT and facility equipment points, typically read over SNMP
+	PowerW     *float64 `json:"power_w,omitempty"`
+	UPSLoadPct *float64 `json:"ups_load_pct,omitempty"`
+	// Lighting and shading status, typically read over KNX
+	DimmerLevelPct   *float64 `json:"dimmer_level_pct,omitempty"`
+	BlindPositionPct *float64 `json:"blind_position_pct,omitempty"`
+	// Acoustic and vibration points, aggregated over the publish window
+	NoiseDB       *float64 `json:"noise_db,omitempty"`
+	VibrationRMS  *float64 `json:"vibration_rms,omitempty"`
+	VibrationPeak *float64 `json:"vibration_peak,omitempty"`
+	Timestamp     string   `json:"timestamp"`
+
+	// OccupancySuppressed marks occupancy and motion withheld by privacy mode
+	OccupancySuppressed bool `json:"occupancy_suppressed,omitempty"`
+	// KPIs are computed by rule plugins
+	KPIs map[string]float64 `json:"kpis,omitempty"`
+	// Scores are the readings of model sensors by sensor type
+	Scores map[string]float64 `json:"scores,omitempty"`
+	// TraceID identifies this message; ReadingTraces maps each sensor to
+	// the trace ID of the reading aggregated into it
+	TraceID       string            `json:"trace_id,omitempty"`
+	ReadingTraces map[string]string `json:"reading_traces,omitempty"`
+	// ExternalIDs are the room's asset registry IDs by system;
+	// SensorExternalIDs those of each aggregated sensor
+	ExternalIDs       map[string]string            `json:"external_ids,omitempty"`
+	SensorExternalIDs map[string]map[string]string `json:"sensor_external_ids,omitempty"`
+	// MaintenanceSensors lists the aggregated sensors under planned work
+	MaintenanceSensors []string `json:"maintenance_sensors,omitempty"`
 }
 
 // Gateway manages sensor polling and MQTT publishing
 type Gateway struct {
 	sensors           map[string]*SensorConfig
 	rooms             map[string]*RoomConfig
+	settings          GatewayFile
 	sensorToRoom      map[string]string
 	lastReadings      map[string]*SensorReading
+	stateSent         map[string]time.Time // reading timestamps published for warm start
+	windowSamples     map[string][]float64
+	binaryStates      *binaryStateTracker
+	runtime           *runtimeTracker
+	setpoints         *setpointTracker
+	commandQueues     *commandQueues
+	apiServer         *http.Server
 	readingsMutex     sync.RWMutex
 	mqttClient        mqtt.Client
-	bacnetClient      *gobacnet.Client
-	bacnetDevices     map[string]types.Device
-	bacnetDeviceMu    sync.RWMutex
-	bacnetMu          sync.Mutex
+	bacnet            *bacnetTransport
+	bacnetDevices     *bacnetDirectory
+	capture           *frameCapture
+	latency           *latencyRecorder
+	store             *stateStore
+	delta             *deltaEncoder
+	link              *constrainedLink
+	fallback          *fallbackClient
+	oidc              *oidcVerifier
+	limits            *rateLimits
+	replay            *replayDriver
+	history           *roomHistory
+	live              *liveHub
+	control           *controlState
+	maintenance       *maintenanceMode
+	pollGroups        *pollGroupStats
+	baseline          *baselineTracker
+	completeness      *completenessTracker
+	drivers           *grpcDrivers
+	models            *modelScorer
+	opcua             *opcuaDriver
+	snmp              *snmpDriver
+	knx               *knxDriver
+	mbus              *mbusDriver
+	http              *httpDriver
+	zigbee            *zigbeeDriver
+	dali              *daliDriver
+	mirrors           *mirrors
+	deadbands         *deadbandFilter
+	staleReadings     *staleReadings
+	breakers          *sensorBreakers
+	configWarnings    *configWarnings
+	budget            *resourceBudget
+	mqttSent          atomic.Uint64
+	plugins           *pluginHost
+	alarms            *alarmEngine
+	comfort           *comfortTracker
+	ventilation       *ventilationTracker
+	pollGate          sync.RWMutex
+	configPaths       [3]string
+	restart           chan string
+	audit             configAudit
+	events            *eventLog
+	profiles          map[string]*outputProfile
 	telemetryInterval time.Duration
-	modbusHandler     *modbus.TCPClientHandler
+	schedule          *publishSchedule
+	emptyRooms        *emptyRooms
+	modbus            *modbusPool
 	wg                sync.WaitGroup
 	shutdown          chan struct{}
 }
 
-func NewGateway(sensorsConfigPath, roomsConfigPath, mqttBroker, bacnetInterface, modbusAddr string) (*Gateway, error) {
+func NewGateway(sensorsConfigPath, roomsConfigPath, gatewayConfigPath, mqttBroker, bacnetInterface, modbusAddr string) (*Gateway, error) {
 	gw := &Gateway{
 		sensors:       make(map[string]*SensorConfig),
 		rooms:         make(map[string]*RoomConfig),
 		sensorToRoom:  make(map[string]string),
 		lastReadings:  make(map[string]*SensorReading),
-		bacnetDevices: make(map[string]types.Device),
+		stateSent:     make(map[string]time.Time),
+		windowSamples: make(map[string][]float64),
+		binaryStates:  newBinaryStateTracker(),
+		setpoints:     newSetpointTracker(),
+		latency:       newLatencyRecorder(),
+		control:       newControlState(),
+		maintenance:   &maintenanceMode{},
+		pollGroups:    newPollGroupStats(),
+		bacnetDevices: newBACnetDirectory(),
+		configPaths:   [3]string{sensorsConfigPath, roomsConfigPath, gatewayConfigPath},
+		restart:       make(chan string, 1),
 		shutdown:      make(chan struct{}),
 	}
 
 	// Load configuration
-	if err := gw.loadConfig(sensorsConfigPath, roomsConfigPath); err != nil {
+	if err := gw.loadConfig(sensorsConfigPath, roomsConfigPath, gatewayConfigPath); err != nil {
 		return nil, err
 	}
 
 	gw.configureTelemetryInterval()
+	gw.configurePublishSchedule()
+	gw.commandQueues = newCommandQueues(&gw.settings.Commands, gw.shutdown)
+	gw.capture = newFrameCapture(&gw.settings.FrameCapture)
+	gw.delta = newDeltaEncoder(&gw.settings.Delta)
+	gw.limits = newRateLimits(&gw.settings.RateLimit)
+	gw.history = newRoomHistory(&gw.settings.History)
+	gw.live = newLiveHub(&gw.settings.Live)
+	gw.drivers = newGRPCDrivers(gw.latency)
+	gw.models = newModelScorer(gw.settings.Models, gw.history, gw.latency)
+	opcua, err := newOPCUADriver(&gw.settings.OPCUA, gw.latency)
+	if err != nil {
+		return nil, err
+	}
+	gw.opcua = opcua
+	gw.snmp = newSNMPDriver(&gw.settings.SNMP, gw.latency)
+	gw.knx = newKNXDriver(&gw.settings.KNX, gw.latency)
+	gw.mbus = newMBusDriver(&gw.settings.MBus, gw.latency)
+	gw.http = newHTTPDriver(&gw.settings.HTTP, gw.latency)
+	gw.zigbee = newZigbeeDriver(&gw.settings.Zigbee2MQTT, gw.sensors, gw.latency)
+	gw.dali = newDALIDriver(&gw.settings.DALI, gw.latency)
+	gw.mirrors = newMirrors(gw.settings.Mirrors)
+	gw.deadbands = newDeadbandFilter(gw.sensors, gw.rooms)
+	gw.staleReadings = gw.newStaleReadings(time.Now())
+	if gw.settings.ReadRetry.Enabled {
+		gw.breakers = newSensorBreakers(&gw.settings.ReadRetry, gw.sensorIntervals())
+	}
+	if gw.settings.ConfigWarnings.Enabled {
+		gw.configWarnings = newConfigWarnings(&gw.settings.ConfigWarnings)
+	}
+	if gw.settings.ResourceBudget.Enabled {
+		gw.budget = newResourceBudget(&gw.settings.ResourceBudget, &gw.mqttSent)
+	}
+	if gw.settings.EmptyRooms.Enabled {
+		gw.emptyRooms = newEmptyRooms(&gw.settings.EmptyRooms, gw.sensorIntervals(), time.Now())
+	}
+	if gw.settings.Completeness.Enabled {
+		gw.completeness = newCompletenessTracker(&gw.settings.Completeness, gw.settings.GatewayID, gw.sensorIntervals(), time.Now())
+		gw.completeness.inMaintenance = gw.inMaintenance
+	}
+	plugins, err := newPluginHost(&gw.settings.Plugins)
+	if err != nil {
+		return nil, err
+	}
+	gw.plugins = plugins
+	if gw.settings.Alarms.Enabled {
+		gw.alarms = newAlarmEngine(&gw.settings.Alarms)
+	}
+	if gw.settings.Comfort.Enabled {
+		gw.comfort = newComfortTracker(&gw.settings.Comfort)
+	}
+	link, err := newConstrainedLink(&gw.settings.ConstrainedLink)
+	if err != nil {
+		return nil, err
+	}
+	gw.link = link
+	if gw.settings.Auth.OIDC.Issuer != "" {
+		gw.oidc = newOIDCVerifier(&gw.settings.Auth.OIDC)
+	}
+
+	// Restore last-known readings and runtime counters
+	store, err := openStateStore(gw.settings.Store.Path)
+	if err != nil {
+		return nil, err
+	}
+	gw.store = store
+	if err := gw.restoreReadings(); err != nil {
+		log.Printf("[WARN] %v; readings start empty", err)
+	}
+	if gw.settings.EventLog.Enabled {
+		events, err := openEventLog(&gw.settings.EventLog, gw.settings.GatewayID, gw.eventCheckpoint)
+		if err != nil {
+			return nil, err
+		}
+		gw.events = events
+	}
+	if err := gw.auditConfig("startup"); err != nil {
+		log.Printf("[ERROR] Config audit failed: %v", err)
+	}
+	gw.runtime = newRuntimeTracker(store, gw.settings.Runtime.StateFile)
+	if err := gw.runtime.load(); err != nil {
+		log.Printf("[WARN] %v; runtime counters start from zero", err)
+	}
+	gw.baseline = newBaselineTracker(&gw.settings.Baseline)
+	if err := gw.loadBaselines(); err != nil {
+		log.Printf("[WARN] %v; baselines are learned from scratch", err)
+	}
+	if gw.settings.Ventilation.Enabled {
+		gw.ventilation = newVentilationTracker(&gw.settings.Ventilation)
+		if err := gw.loadVentilationReports(); err != nil {
+			log.Printf("[WARN] %v", err)
+		}
+	}
+
+	// Setup the replay driver when sensors use recorded traces
+	if err := gw.setupReplay(); err != nil {
+		return nil, err
+	}
 
 	// Setup BACnet client
 	if err := gw.setupBACnet(bacnetInterface); err != nil {
@@ -122,11 +559,14 @@ func NewGateway(sensorsConfigPath, roomsConfigPath, mqttBroker, bacnetInterface,
 	if err := gw.connectMQTT(mqttBroker); err != nil {
 		return nil, err
 	}
+	if gw.settings.WarmStart.Enabled {
+		gw.warmStart()
+	}
 
 	return gw, nil
 }
 
-func (gw *Gateway) loadConfig(sensorsPath, roomsPath string) error {
+func (gw *Gateway) loadConfig(sensorsPath, roomsPath, gatewayPath string) error {
 	log.Println("Loading configuration...")
 
 	// Load rooms
@@ -134,14 +574,21 @@ func (gw *Gateway) loadConfig(sensorsPath, roomsPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to read rooms config: %w", err)
 	}
+	gw.audit.recordFile(roomsPath, roomsData)
 
 	var roomsFile RoomsFile
 	if err := yaml.Unmarshal(roomsData, &roomsFile); err != nil {
 		return fmt.Errorf("failed to parse rooms config: %w", err)
 	}
+	if err := checkSchemaVersion(roomsPath, roomsFile.SchemaVersion); err != nil {
+		return err
+	}
 
 	for i := range roomsFile.Rooms {
 		room := &roomsFile.Rooms[i]
+		if room.PublishIntervalMs < 0 {
+			return fmt.Errorf("invalid rooms config: room %s has a negative publish_interval_ms", room.ID)
+		}
 		gw.rooms[room.ID] = room
 		for _, sensorID := range room.Sensors {
 			gw.sensorToRoom[sensorID] = room.ID
@@ -153,18 +600,225 @@ func (gw *Gateway) loadConfig(sensorsPath, roomsPath string) error {
 	if err != nil {
 		return fmt.Errorf("failed to read sensors config: %w", err)
 	}
+	gw.audit.recordFile(sensorsPath, sensorsData)
 
 	var sensorsFile SensorsFile
 	if err := yaml.Unmarshal(sensorsData, &sensorsFile); err != nil {
 		return fmt.Errorf("failed to parse sensors config: %w", err)
 	}
+	if err := checkSchemaVersion(sensorsPath, sensorsFile.SchemaVersion); err != nil {
+		return err
+	}
 
 	for i := range sensorsFile.Sensors {
 		sensor := &sensorsFile.Sensors[i]
 		gw.sensors[sensor.ID] = sensor
 	}
 
-	log.Printf("Loaded %d sensors for %d rooms", len(gw.sensors), len(gw.rooms))
+	// Load gateway settings (optional)
+	gatewayData, err := os.ReadFile(gatewayPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read gateway config: %w", err)
+	}
+	if err == nil {
+		gw.audit.recordFile(gatewayPath, gatewayData)
+		if err := yaml.Unmarshal(gatewayData, &gw.settings); err != nil {
+			return fmt.Errorf("failed to parse gateway config: %w", err)
+		}
+	} else {
+		log.Printf("No gateway config at %s, using defaults", gatewayPath)
+	}
+	gw.settings.AirQuality.normalize()
+	gw.settings.Runtime.normalize()
+	gw.settings.Commands.normalize()
+	gw.settings.API.normalize()
+	gw.settings.FrameCapture.normalize()
+	gw.settings.Metrics.normalize()
+	gw.settings.Store.normalize()
+	gw.settings.Delta.normalize()
+	gw.settings.ConstrainedLink.normalize()
+	gw.settings.FallbackBroker.normalize()
+	gw.settings.Audit.normalize()
+	gw.settings.RateLimit.normalize()
+	if err := gw.settings.Replay.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.History.normalize()
+	gw.settings.Query.normalize()
+	gw.settings.Live.normalize()
+	gw.settings.Parameters.normalize()
+	gw.settings.Commissioning.normalize()
+	gw.settings.Completeness.normalize()
+	if err := gw.settings.Auth.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Control.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Baseline.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Privacy.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.WarmStart.normalize()
+	if err := gw.settings.Alarms.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Comfort.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Ventilation.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Forecast.normalize(&gw.settings.History); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := normalizeModels(gw.settings.Models, &gw.settings.History); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.ResourceBudget.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Plugins.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Publish.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Aggregation.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Modbus.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.BACnetDiscovery.normalize()
+	if err := gw.settings.BACnetMSTP.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.BACnetAPDU.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.OPCUA.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.SNMP.normalize()
+	gw.settings.KNX.normalize()
+	if err := gw.settings.MBus.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.HTTP.normalize()
+	if err := gw.settings.Zigbee2MQTT.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.DALI.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.Rollups.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	gw.settings.EmptyRooms.normalize()
+	gw.settings.StaleReadings.normalize()
+	gw.settings.ReadRetry.normalize()
+	gw.settings.ConfigWarnings.normalize()
+	if err := gw.settings.EventLog.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.OutputProfiles.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.settings.IDMapping.normalize(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if sensorID := gw.settings.Baseline.OutdoorSensor; sensorID != "" {
+		if _, ok := gw.sensors[sensorID]; !ok {
+			return fmt.Errorf("invalid gateway config: baseline outdoor_sensor %s is not a known sensor", sensorID)
+		}
+	}
+	if gw.settings.GatewayID == "" {
+		gw.settings.GatewayID = "golang-gateway"
+	}
+	gw.settings.Snapshot.normalize(gw.settings.GatewayID)
+	if err := gw.validateEquipment(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.validateRollups(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.validateSchedules(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.validatePollGroups(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.validateGRPCSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateModelSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateMirrors(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.validatePollPriorities(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateModbusSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateBACnetSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateOPCUASensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateSNMPSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateKNXSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateMBusSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateHTTPSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateZigbeeSensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateDALISensors(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateEnumMaps(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateCalibration(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateDeadbands(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateMaxAges(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateReadTimeouts(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.validateDecoders(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.resolveUnits(); err != nil {
+		return fmt.Errorf("invalid sensor config: %w", err)
+	}
+	if err := gw.resolveOutputProfiles(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+	if err := gw.resolveExternalIDs(); err != nil {
+		return fmt.Errorf("invalid gateway config: %w", err)
+	}
+
+	log.Printf("Loaded %d sensors for %d rooms and %d equipment", len(gw.sensors), len(gw.rooms), len(gw.settings.Equipment))
 	return nil
 }
 
@@ -190,41 +844,87 @@ func (gw *Gateway) configureTelemetryInterval() {
 func (gw *Gateway) setupBACnet(interfaceName string) error {
 	log.Printf("Setting up BACnet client on interface %s", interfaceName)
 
-	client, err := gobacnet.NewClient(interfaceName, 0)
+	transport, err := newBACnetTransport(interfaceName, &gw.settings.BACnetAPDU, gw.capture)
 	if err != nil {
 		return fmt.Errorf("failed to create BACnet client: %w", err)
 	}
 
-	gw.bacnetClient = client
+	// Controllers announce themselves with I-Am after a restart, often on a
+	// new DHCP lease
+	transport.announced = gw.bacnetDevices.update
+	if cfg := &gw.settings.BACnetMSTP; cfg.Port != "" {
+		link, err := openMSTPLink(cfg, transport.dispatch, gw.capture)
+		if err != nil {
+			transport.Close()
+			return err
+		}
+		transport.mstp = link
+	}
+	gw.bacnet = transport
 	log.Println("BACnet client ready")
 	return nil
 }
 
+// setupModbus creates the Modbus connection pool (address is the default
+// endpoint) and connects to the endpoints of the Modbus sensors. An
+// unreachable device does not stop the gateway; its connection is retried
+// with every read.
 func (gw *Gateway) setupModbus(address string) error {
 	log.Printf("Setting up Modbus client to %s", address)
 
-	// Create Modbus TCP handler with connection pooling
-	handler := modbus.NewTCPClientHandler(address)
-	handler.Timeout = 2 * time.Second
-	handler.IdleTimeout = 60 * time.Second
-
-	if err := handler.Connect(); err != nil {
-		return fmt.Errorf("failed to connect Modbus: %w", err)
+	gw.modbus = newModbusPool(address, gw.capture)
+	for _, sensor := range gw.sensors {
+		if sensor.Protocol == "modbus" {
+			gw.modbus.raiseTimeout(sensor.Address, sensor.UnitID, gw.readTimeout(sensor))
+		}
+	}
+	connected := make(map[string]bool)
+	for _, sensor := range gw.sensors {
+		if sensor.Protocol != "modbus" {
+			continue
+		}
+		handler, endpoint := gw.modbus.handler(sensor.Address, sensor.UnitID)
+		if connected[endpoint] {
+			continue
+		}
+		connected[endpoint] = true
+		if err := handler.Connect(); err != nil {
+			log.Printf("[WARN] Modbus endpoint %s not reachable yet: %v", endpoint, err)
+		}
 	}
 
-	gw.modbusHandler = handler
-	log.Println("Modbus client ready")
+	log.Printf("Modbus client ready (%d endpoints)", len(connected))
 	return nil
 }
 
 func (gw *Gateway) connectMQTT(broker string) error {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(broker)
-	opts.SetClientID("golang-gateway")
+	opts.SetClientID(gw.settings.GatewayID)
 	opts.SetAutoReconnect(true)
 	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(gw.onMQTTConnect)
+	gw.configureStatusWill(opts)
 
 	gw.mqttClient = mqtt.NewClient(opts)
+	if gw.settings.FallbackBroker.Enabled {
+		local, err := startEmbeddedBroker(gw.settings.FallbackBroker.ListenAddr, gw.settings.FallbackBroker.Username, os.ExpandEnv(gw.settings.FallbackBroker.Password))
+		if err != nil {
+			return err
+		}
+		if gw.settings.FallbackBroker.openListener() {
+			log.Printf("[WARN] Fallback broker on %s has no username, any client that can reach it may publish and subscribe", gw.settings.FallbackBroker.ListenAddr)
+		}
+		gw.fallback = newFallbackClient(gw.mqttClient, local, &gw.settings.FallbackBroker, gw.settings.GatewayID)
+		gw.mqttClient = gw.fallback
+		// Don't block startup on the central broker; publishes are spooled
+		// until it connects
+		gw.mqttClient = &observedClient{Client: gw.mqttClient, health: gw.latency.health, sent: &gw.mqttSent}
+		gw.mqttClient.Connect()
+		log.Printf("Connecting to MQTT broker %s in the background (fallback broker on %s)", broker, gw.settings.FallbackBroker.ListenAddr)
+		return nil
+	}
+	gw.mqttClient = &observedClient{Client: gw.mqttClient, health: gw.latency.health, sent: &gw.mqttSent}
 	if token := gw.mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		return fmt.Errorf("failed to connect to MQTT: %w", token.Error())
 	}
@@ -233,19 +933,184 @@ func (gw *Gateway) connectMQTT(broker string) error {
 	return nil
 }
 
+// onMQTTConnect runs on every (re)connect to restore the online status and
+// subscriptions
+func (gw *Gateway) onMQTTConnect(client mqtt.Client) {
+	// Consumers may have missed deltas while the link was down
+	gw.delta.forceSnapshot()
+	go func() {
+		gw.publishStatus(client, "online", "")
+		gw.publishConfigAudit(client)
+		gw.publishTombstones(client)
+		if gw.fallback != nil {
+			// Replay retries must not hold up the subscriptions
+			go gw.fallback.sync(client)
+		}
+		if gw.hasWritablePoints() {
+			gw.subscribeCommands(client)
+		}
+		if gw.settings.Control.Enabled {
+			gw.subscribeControl(client)
+		}
+		if len(gw.zigbee.devices) > 0 {
+			gw.subscribeZigbee(client)
+		}
+	}()
+}
+
 func (gw *Gateway) Start() {
 	log.Println("Starting gateway...")
 
-	// Start sensor pollers
+	// Start sensor pollers; grouped sensors and Modbus block members are read
+	// by their group
+	grouped := make(map[string]bool)
+	for i := range gw.settings.PollGroups {
+		group := &gw.settings.PollGroups[i]
+		for _, sensorID := range group.Sensors {
+			grouped[sensorID] = true
+		}
+		gw.wg.Add(1)
+		go gw.pollGroup(group)
+	}
+	if gw.settings.Modbus.BlockReads {
+		for _, group := range gw.planModbusBlocks(grouped) {
+			gw.wg.Add(1)
+			go gw.pollModbusBlocks(group)
+		}
+	}
 	for sensorID, sensorConfig := range gw.sensors {
+		if grouped[sensorID] || sensorConfig.Subscribe || sensorConfig.Protocol == "zigbee" {
+			continue
+		}
 		gw.wg.Add(1)
+		if sensorConfig.cron != nil {
+			go gw.pollScheduled(sensorID, sensorConfig)
+			continue
+		}
 		go gw.pollSensor(sensorID, sensorConfig)
 	}
+	if len(gw.zigbee.devices) > 0 {
+		gw.wg.Add(1)
+		go gw.recordZigbee()
+	}
+
+	// Map BACnet device instances to addresses before the first polls
+	if gw.bacnet != nil && gw.usesBACnetDiscovery() {
+		if _, err := gw.discoverBACnet(time.Duration(gw.settings.BACnetDiscovery.TimeoutSec) * time.Second); err != nil {
+			log.Printf("[WARN] BACnet discovery failed: %v", err)
+		}
+		gw.logMissingBACnetDevices()
+		gw.wg.Add(1)
+		go gw.runBACnetDiscovery()
+	}
+
+	// Start driver sidecar subscriptions
+	for target, sensors := range gw.subscribedSensors() {
+		gw.wg.Add(1)
+		go gw.subscribeDriver(target, sensors)
+	}
+	if groups := gw.knxSubscribedSensors(); len(groups) > 0 {
+		gw.wg.Add(1)
+		go gw.subscribeKNX(groups)
+	}
 
 	// Start room aggregator and publisher
 	gw.wg.Add(1)
 	go gw.publishRoomData()
 
+	// Start stale reading detection
+	if gw.staleReadings != nil {
+		gw.wg.Add(1)
+		go gw.checkStaleReadings()
+	}
+
+	// Start runtime counter persistence and publishing
+	if gw.hasRuntimeTracking() {
+		gw.wg.Add(1)
+		go gw.publishRuntimeCounters()
+	}
+
+	// Start equipment rollups
+	if len(gw.settings.Equipment) > 0 {
+		gw.wg.Add(1)
+		go gw.publishEquipmentData()
+	}
+
+	// Start event log publishing
+	if gw.events != nil && gw.settings.EventLog.Publish {
+		gw.wg.Add(1)
+		go gw.publishEventLog()
+	}
+
+	// Start zone and building rollups
+	if gw.settings.Rollups.Enabled {
+		gw.wg.Add(1)
+		go gw.publishRollups()
+	}
+
+	// Start data-completeness tracking
+	if gw.completeness != nil {
+		gw.wg.Add(1)
+		go gw.publishCompleteness()
+	}
+
+	// Start zone energy baselines
+	if gw.settings.Baseline.Enabled {
+		gw.wg.Add(1)
+		go gw.trackBaselines()
+	}
+
+	// Start comfort compliance tracking
+	if gw.comfort != nil {
+		gw.wg.Add(1)
+		go gw.trackComfort()
+	}
+
+	// Start CO2 ventilation reporting
+	if gw.ventilation != nil {
+		gw.wg.Add(1)
+		go gw.trackVentilation()
+	}
+
+	// Start alarm escalation
+	if gw.alarms != nil {
+		gw.wg.Add(1)
+		go gw.checkAlarmEscalation()
+	}
+
+	// Start room condition forecasts
+	if gw.settings.Forecast.Enabled {
+		gw.wg.Add(1)
+		go gw.runForecasts()
+	}
+
+	// Start plugin hot reloading
+	if len(gw.plugins.plugins()) > 0 {
+		gw.wg.Add(1)
+		go gw.watchPlugins()
+	}
+
+	// Start state persistence
+	gw.wg.Add(1)
+	go gw.flushState()
+
+	// Start field bus latency summaries
+	gw.wg.Add(1)
+	go gw.publishLatencySummaries()
+
+	// Start driver heartbeats
+	gw.wg.Add(1)
+	go gw.publishDriverHeartbeats()
+
+	// Start resource budget enforcement
+	if gw.budget != nil {
+		gw.wg.Add(1)
+		go gw.enforceBudget()
+	}
+
+	// Start HTTP API
+	gw.startAPI()
+
 	log.Println("Gateway started successfully")
 }
 
@@ -255,117 +1120,228 @@ func (gw *Gateway) pollSensor(sensorID string, config *SensorConfig) {
 	ticker := time.NewTicker(time.Duration(config.PollIntervalMs) * time.Millisecond)
 	defer ticker.Stop()
 
-	roomID := gw.sensorToRoom[sensorID]
-
+	tick := 0
 	for {
 		select {
 		case <-gw.shutdown:
 			return
-		case <-ticker.C:
-			var value float64
-			var err error
-
-			// Read from protocol
-			if config.Protocol == "bacnet" {
-				value, err = gw.readBACnet(config)
-			} else if config.Protocol == "modbus" {
-				value, err = gw.readModbus(config.Register)
-			} else {
-				log.Printf("[WARN] Unknown protocol for sensor %s: %s", sensorID, config.Protocol)
+		case now := <-ticker.C:
+			tick++
+			if gw.control.isPaused(sensorID) || gw.budget.skipPoll(config, tick) || !gw.allowPoll(sensorID, now) {
 				continue
 			}
-
-			// Create reading
-			reading := &SensorReading{
-				SensorID:  sensorID,
-				RoomID:    roomID,
-				Type:      config.Type,
-				Value:     value,
-				Unit:      config.Unit,
-				Timestamp: time.Now(),
-				Status:    "ok",
+			// Poll groups take the gate exclusively so their reads are not
+			// queued behind individual polls
+			gw.pollGate.RLock()
+			_, err := gw.readSensor(sensorID, config)
+			gw.pollGate.RUnlock()
+			if err != nil && errors.Is(err, errUnknownProtocol) {
+				log.Printf("[WARN] Unknown protocol for sensor %s: %s", sensorID, config.Protocol)
 			}
+		}
+	}
+}
 
-			if err != nil {
-				reading.Status = "error"
-				log.Printf("[ERROR] Failed to read sensor %s: %v", sensorID, err)
-			}
+var errUnknownProtocol = errors.New("unknown protocol")
 
-			// Store reading
-			gw.readingsMutex.Lock()
-			gw.lastReadings[sensorID] = reading
-			gw.readingsMutex.Unlock()
+// readSensor performs one read of a sensor, stores the reading and runs the
+// per-reading hooks (runtime, drift, events). It is used by the pollers and
+// by on-demand reads from the API.
+func (gw *Gateway) readSensor(sensorID string, config *SensorConfig) (*SensorReading, error) {
+	return gw.readSensorAt(sensorID, config, time.Time{})
+}
 
-			if err == nil {
-				log.Printf("[DEBUG] %s: %.2f %s", sensorID, value, config.Unit)
-			}
+// readSensorAt is readSensor with the reading stamped at sampledAt instead
+// of the time the read completed, when sampledAt is set
+func (gw *Gateway) readSensorAt(sensorID string, config *SensorConfig, sampledAt time.Time) (*SensorReading, error) {
+	var value float64
+	var text string
+	var err error
+	traceID := newTraceID()
+
+	ctx, cancel := gw.readContext(config)
+	defer cancel()
+
+	// Read from protocol
+	var read func() (float64, string, error)
+	if config.Protocol == "bacnet" {
+		// Cancelled by the transport itself at the deadline
+		value, text, err = gw.readBACnet(ctx, config)
+	} else if config.Protocol == "modbus" {
+		read = func() (float64, string, error) {
+			value, err := gw.readModbus(config)
+			return value, "", err
 		}
+	} else if config.Protocol == "replay" && gw.replay != nil {
+		value, text, err = gw.replay.read(config, time.Now())
+	} else if config.Protocol == "grpc" {
+		read = func() (float64, string, error) { return gw.drivers.read(config) }
+	} else if config.Protocol == "model" {
+		value, err = gw.models.read(config, gw.sensorToRoom[sensorID])
+	} else if config.Protocol == "opcua" {
+		read = func() (float64, string, error) { return gw.opcua.read(config) }
+	} else if config.Protocol == "snmp" {
+		read = func() (float64, string, error) { return gw.snmp.read(config) }
+	} else if config.Protocol == "knx" {
+		read = func() (float64, string, error) { return gw.knx.read(config) }
+	} else if config.Protocol == "mbus" {
+		read = func() (float64, string, error) { return gw.mbus.read(config) }
+	} else if config.Protocol == "http" {
+		read = func() (float64, string, error) { return gw.http.read(config) }
+	} else if config.Protocol == "zigbee" {
+		value, text, err = gw.zigbee.read(config)
+	} else if config.Protocol == "dali" {
+		read = func() (float64, string, error) { return gw.dali.read(config) }
+	} else {
+		return nil, errUnknownProtocol
+	}
+	if read != nil {
+		value, text, err = readWithContext(ctx, read)
 	}
+	return gw.recordReading(sensorID, config, value, text, err, sampledAt, traceID)
 }
 
-func (gw *Gateway) readBACnet(sensor *SensorConfig) (float64, error) {
-	if gw.bacnetClient == nil {
-		return 0, fmt.Errorf("BACnet client not initialized")
+// recordReading stores a polled or pushed value (or read error) and runs
+// the per-reading processing. traceID identifies the reading in logs and
+// downstream storage.
+func (gw *Gateway) recordReading(sensorID string, config *SensorConfig, value float64, text string, err error, sampledAt time.Time, traceID string) (*SensorReading, error) {
+	roomID := gw.sensorToRoom[sensorID]
+
+	if err == nil {
+		value = config.calibrate(value, text)
+	}
+	if config.Decoder != "" && err == nil {
+		value, text, err = gw.plugins.decode(config, value, text)
+	}
+
+	unit := config.Unit
+	if config.units != nil {
+		value = config.units.toCanonical(value)
+		unit = config.units.to.code
+	}
+
+	// Create reading
+	reading := &SensorReading{
+		SensorID:    sensorID,
+		RoomID:      roomID,
+		Type:        config.Type,
+		Value:       value,
+		StringValue: text,
+		Unit:        unit,
+		Timestamp:   time.Now(),
+		Status:      "ok",
+		TraceID:     traceID,
+		Maintenance: gw.inMaintenance(sensorID),
+	}
+	if !sampledAt.IsZero() {
+		reading.Timestamp = sampledAt
+	}
+
+	if errors.Is(err, errDeviceOffline) {
+		reading.Status = "offline"
+	} else if err != nil {
+		reading.Status = "error"
+		log.Printf("[ERROR] Failed to read sensor %s (trace %s): %v", sensorID, traceID, err)
+	} else if config.unitInvalid {
+		reading.Status = "invalid_unit"
+	}
+
+	// Store reading
+	gw.readingsMutex.Lock()
+	gw.lastReadings[sensorID] = reading
+	if err == nil {
+		gw.recordSample(sensorID, value)
+	}
+	gw.readingsMutex.Unlock()
+
+	reported := gw.deadbands.observe(roomID, config, reading)
+	if event := gw.breakers.observe(sensorID, err, time.Now()); event != nil {
+		gw.publishCircuitEvent(event)
 	}
 
-	device, err := gw.getBACnetDevice(sensor.Address)
 	if err != nil {
-		return 0, err
+		return reading, err
+	}
+
+	if reported && !gw.privateReading(reading) {
+		gw.events.reading(reading)
+	}
+
+	if gw.completeness != nil {
+		gw.completeness.observe(sensorID, reading.Timestamp)
+	}
+
+	gw.checkReading(sensorID, config, reading)
+
+	if gw.tracksRuntime(sensorID, config) {
+		gw.runtime.observe(sensorID, value >= 0.5, reading.Timestamp)
+	}
+
+	if config.Writable {
+		gw.checkSetpointDrift(sensorID, roomID, config, value, reading.Timestamp)
+	}
+
+	if binaryEventTypes[config.Type] {
+		gw.handleBinaryReading(sensorID, roomID, config, value)
+	}
+
+	gw.mirrorReading(sensorID, value, time.Now())
+
+	if text != "" {
+		log.Printf("[DEBUG] %s: %s (%.0f) trace=%s", sensorID, text, value, traceID)
+	} else {
+		log.Printf("[DEBUG] %s: %.2f %s trace=%s", sensorID, value, unit, traceID)
+	}
+	return reading, nil
+}
+
+func (gw *Gateway) readBACnet(ctx context.Context, sensor *SensorConfig) (float64, string, error) {
+	if gw.bacnet == nil {
+		return 0, "", fmt.Errorf("BACnet client not initialized")
 	}
 
+	objectType, prop := bacnetObject(sensor)
 	rp := types.ReadPropertyData{
 		Object: types.Object{
 			ID: types.ObjectID{
-				Type:     types.AnalogValue,
+				Type:     objectType,
 				Instance: types.ObjectInstance(sensor.ObjectID),
 			},
 			Properties: []types.Property{
 				{
-					Type:       property.PresentValue,
+					Type:       prop,
 					ArrayIndex: gobacnet.ArrayAll,
 				},
 			},
 		},
 	}
 
-	gw.bacnetMu.Lock()
-	resp, err := gw.bacnetClient.ReadProperty(device, rp)
-	gw.bacnetMu.Unlock()
+	address, err := gw.bacnetAddress(sensor)
 	if err != nil {
-		return 0, fmt.Errorf("BACnet read error: %w", err)
+		return 0, "", err
 	}
-
-	if len(resp.Object.Properties) == 0 {
-		return 0, fmt.Errorf("BACnet response contained no properties")
+	start := time.Now()
+	resp, err := gw.bacnet.readProperty(ctx, address, rp)
+	gw.latency.observe("bacnet", normalizeBACnetAddress(address), time.Since(start), err)
+	if err != nil {
+		return 0, "", fmt.Errorf("BACnet read error: %w", err)
 	}
 
-	return parseBACnetNumeric(resp.Object.Properties[0].Data)
-}
-
-func (gw *Gateway) getBACnetDevice(address string) (types.Device, error) {
-	normalized := normalizeBACnetAddress(address)
-	gw.bacnetDeviceMu.RLock()
-	dev, found := gw.bacnetDevices[normalized]
-	gw.bacnetDeviceMu.RUnlock()
-	if found {
-		return dev, nil
+	if len(resp.Object.Properties) == 0 {
+		return 0, "", fmt.Errorf("BACnet response contained no properties")
 	}
 
-	udpAddr, err := net.ResolveUDPAddr("udp", normalized)
-	if err != nil {
-		return types.Device{}, fmt.Errorf("invalid BACnet address %s: %w", normalized, err)
-	}
-	dev = types.Device{
-		Addr: types.UDPToAddress(udpAddr),
-	}
-	gw.bacnetDeviceMu.Lock()
-	gw.bacnetDevices[normalized] = dev
-	gw.bacnetDeviceMu.Unlock()
-	return dev, nil
+	return parseBACnetValue(resp.Object.Properties[0].Data, sensor.EnumMap, sensor.enumText)
 }
 
+// normalizeBACnetAddress adds the default port to a B/IP address, keeping the
+// remote network suffix of routed addresses (mstp: addresses contain a colon
+// and pass unchanged)
 func normalizeBACnetAddress(address string) string {
 	addr := strings.TrimSpace(address)
+	if local, remote, routed := strings.Cut(addr, "/"); routed {
+		return normalizeBACnetAddress(local) + "/" + remote
+	}
 	if addr == "" {
 		return fmt.Sprintf("127.0.0.1:%d", gobacnet.DefaultPort)
 	}
@@ -375,6 +1351,76 @@ func normalizeBACnetAddress(address string) string {
 	return addr
 }
 
+// parseBACnetValue converts a decoded PresentValue into a numeric value plus
+// optional state text. Character strings are mapped to numeric codes through
+// enumMap (or parsed as numbers); enumerated values, which gobacnet decodes as
+// uint32, get their state text from enumText, the reverse of enumMap.
+func parseBACnetValue(value interface{}, enumMap map[string]float64, enumText map[float64]string) (float64, string, error) {
+	switch v := value.(type) {
+	case string:
+		text := strings.TrimSpace(v)
+		if code, ok := lookupEnumCode(enumMap, text); ok {
+			return code, text, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, text, nil
+		}
+		if len(enumMap) > 0 {
+			return 0, text, fmt.Errorf("BACnet state %q not found in enum_map", text)
+		}
+		return 0, text, nil
+	case bool:
+		if v {
+			return 1, "true", nil
+		}
+		return 0, "false", nil
+	case uint32:
+		return float64(v), enumText[float64(v)], nil
+	case bacnetBitString:
+		return v.value(), v.text(), nil
+	}
+
+	numeric, err := parseBACnetNumeric(value)
+	return numeric, "", err
+}
+
+func lookupEnumCode(enumMap map[string]float64, text string) (float64, bool) {
+	if code, ok := enumMap[text]; ok {
+		return code, true
+	}
+	for state, code := range enumMap {
+		if strings.EqualFold(state, text) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// validateEnumMaps builds each sensor's code-to-state reverse map; two
+// states with the same code would make the state text ambiguous
+func (gw *Gateway) validateEnumMaps() error {
+	for id, sensor := range gw.sensors {
+		sensor.enumText = nil
+		if len(sensor.EnumMap) == 0 {
+			continue
+		}
+		states := make([]string, 0, len(sensor.EnumMap))
+		for state := range sensor.EnumMap {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		sensor.enumText = make(map[float64]string, len(states))
+		for _, state := range states {
+			code := sensor.EnumMap[state]
+			if other, ok := sensor.enumText[code]; ok {
+				return fmt.Errorf("sensor %s: enum_map states %q and %q share code %v", id, other, state, code)
+			}
+			sensor.enumText[code] = state
+		}
+	}
+	return nil
+}
+
 func parseBACnetNumeric(value interface{}) (float64, error) {
 	switch v := value.(type) {
 	case float64:
@@ -396,139 +1442,344 @@ func parseBACnetNumeric(value interface{}) (float64, error) {
 	}
 }
 
-func (gw *Gateway) readModbus(register int) (float64, error) {
-	// Create Modbus client
-	client := modbus.NewClient(gw.modbusHandler)
+func (gw *Gateway) readModbus(config *SensorConfig) (float64, error) {
+	// Client of the sensor's endpoint
+	client, endpoint := gw.modbus.client(config.Address, config.UnitID)
 
-	// Read holding register
-	results, err := client.ReadHoldingRegisters(uint16(register), 1)
+	// Read the value's registers, or one bit of a coil or discrete input
+	start := time.Now()
+	results, err := readModbusRegisters(client, config.RegisterType, uint16(config.Register), uint16(modbusRegisterCount(config)))
+	gw.latency.observe("modbus", endpoint, time.Since(start), err)
 	if err != nil {
 		return 0, fmt.Errorf("Modbus read error: %w", err)
 	}
 
-	if len(results) < 2 {
-		return 0, fmt.Errorf("insufficient data returned")
+	if config.RegisterType == registerCoil || config.RegisterType == registerDiscrete {
+		if len(results) < 1 {
+			return 0, fmt.Errorf("insufficient data returned")
+		}
+		return float64(results[0] & 1), nil
 	}
-
-	// Convert bytes to uint16, then to float (scaled by 100)
-	rawValue := uint16(results[0])<<8 | uint16(results[1])
-	floatValue := float64(rawValue) / 100.0
-
-	return floatValue, nil
+	return decodeModbusValue(config, results)
 }
 
 func (gw *Gateway) publishRoomData() {
 	defer gw.wg.Done()
 
-	interval := gw.telemetryInterval
+	interval := gw.schedule.tick
 	if interval <= 0 {
 		interval = time.Second
 	}
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
-	for {
+	for tick := 0; ; tick++ {
 		select {
 		case <-gw.shutdown:
 			return
 		case <-ticker.C:
-			// Aggregate and publish for each room
-			for roomID := range gw.rooms {
-				telemetry := gw.aggregateRoomData(roomID)
-				if telemetry != nil {
-					gw.publishTelemetry(roomID, telemetry)
-				}
+			if gw.settings.ConstrainedLink.Enabled && gw.link.skip() {
+				continue
+			}
+			if due := gw.schedule.due(tick); len(due) > 0 {
+				gw.publishRooms(due)
 			}
 		}
 	}
 }
 
 func (gw *Gateway) aggregateRoomData(roomID string) *RoomTelemetry {
-	gw.readingsMutex.RLock()
-	defer gw.readingsMutex.RUnlock()
+	gw.readingsMutex.Lock()
+	defer gw.readingsMutex.Unlock()
 
 	room := gw.rooms[roomID]
 	telemetry := &RoomTelemetry{
-		RoomID:    roomID,
-		Timestamp: time.Now().Format(time.RFC3339),
+		RoomID:      roomID,
+		Tenant:      room.Tenant,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		TraceID:     newTraceID(),
+		ExternalIDs: room.ExternalIDs,
 	}
 
+	// Latest value per sensor type, used for derived indices
+	values := make(map[string]float64)
+
 	// Aggregate sensor readings for this room
 	for _, sensorID := range room.Sensors {
+		samples := gw.takeSamples(sensorID)
 		reading, exists := gw.lastReadings[sensorID]
 		if !exists || reading.Status != "ok" {
 			continue
 		}
+		if len(samples) == 0 {
+			samples = []float64{reading.Value}
+		}
+		value := gw.settings.Aggregation.aggregate(reading.Type, samples, reading.Value)
+		values[reading.Type] = value
+		if reading.TraceID != "" {
+			if telemetry.ReadingTraces == nil {
+				telemetry.ReadingTraces = make(map[string]string)
+			}
+			telemetry.ReadingTraces[sensorID] = reading.TraceID
+		}
+		if reading.Maintenance {
+			telemetry.MaintenanceSensors = append(telemetry.MaintenanceSensors, sensorID)
+		}
+		if ids := gw.sensors[sensorID].ExternalIDs; len(ids) > 0 {
+			if telemetry.SensorExternalIDs == nil {
+				telemetry.SensorExternalIDs = make(map[string]map[string]string)
+			}
+			telemetry.SensorExternalIDs[sensorID] = ids
+		}
+
+		if gw.sensors[sensorID].Protocol == "model" {
+			if telemetry.Scores == nil {
+				telemetry.Scores = make(map[string]float64)
+			}
+			telemetry.Scores[reading.Type] = value
+			continue
+		}
 
 		// Map sensor types to telemetry fields
 		switch reading.Type {
 		case "temperature":
-			telemetry.Temperature = reading.Value
+			telemetry.Temperature = value
 		case "humidity":
-			telemetry.Humidity = reading.Value
+			telemetry.Humidity = value
 		case "co2":
-			telemetry.CO2PPM = reading.Value
+			telemetry.CO2PPM = value
 		case "air_quality":
-			telemetry.AirQualityIndex = reading.Value
+			telemetry.AirQualityIndex = value
 		case "light":
-			telemetry.LightLux = reading.Value
+			telemetry.LightLux = value
 		case "energy":
-			telemetry.EnergyKWH = reading.Value
+			telemetry.EnergyKWH = value
 		case "motion":
-			telemetry.MotionDetected = reading.Value >= 0.5
+			telemetry.MotionDetected = value >= 0.5
 		case "occupancy":
-			telemetry.OccupancyCount = int32(reading.Value)
+			telemetry.OccupancyCount = int32(math.Round(value))
+		case "pressure":
+			telemetry.StaticPressurePa = floatPtr(value)
+		case "air_flow":
+			telemetry.AirFlow = floatPtr(value)
+		case "water_flow":
+			telemetry.WaterFlow = floatPtr(value)
+		case "water_volume":
+			telemetry.WaterVolumeM3 = floatPtr(value)
+		case "valve_position":
+			telemetry.ValvePosition = floatPtr(value)
+		case "damper_position":
+			telemetry.DamperPosition = floatPtr(value)
+		case "pm25":
+			telemetry.PM25 = floatPtr(value)
+		case "pm10":
+			telemetry.PM10 = floatPtr(value)
+		case "tvoc":
+			telemetry.TVOC = floatPtr(value)
+		case "leak":
+			if active, ok := gw.binaryStates.active(sensorID); ok {
+				telemetry.LeakDetected = &active
+			}
+		case "contact":
+			if active, ok := gw.binaryStates.active(sensorID); ok {
+				telemetry.ContactOpen = &active
+			}
+		case "noise_db":
+			telemetry.NoiseDB = floatPtr(equivalentLevel(samples))
+		case "vibration":
+			telemetry.VibrationRMS = floatPtr(rootMeanSquare(samples))
+			telemetry.VibrationPeak = floatPtr(peakAbsolute(samples))
+		case "power":
+			telemetry.PowerW = floatPtr(value)
+		case "ups_load":
+			telemetry.UPSLoadPct = floatPtr(value)
+		case "dimmer_level":
+			telemetry.DimmerLevelPct = floatPtr(value)
+		case "blind_position":
+			telemetry.BlindPositionPct = floatPtr(value)
 		}
 	}
 
+	if score, ok := gw.settings.AirQuality.score(values); ok {
+		telemetry.AirQualityIndex = score
+	}
+
 	return telemetry
 }
 
-func (gw *Gateway) publishTelemetry(roomID string, telemetry *RoomTelemetry) {
-	topic := fmt.Sprintf("telemetry/%s", roomID)
+// publishRooms aggregates and publishes the given rooms (every room when
+// nil), as one batch in constrained-link mode or one snapshot in snapshot
+// mode
+func (gw *Gateway) publishRooms(due []string) {
+	now := time.Now()
+	if due == nil {
+		due = make([]string, 0, len(gw.rooms))
+		for roomID := range gw.rooms {
+			due = append(due, roomID)
+		}
+	}
+	due = gw.deadbands.changed(gw.withData(due, now))
+	telemetries := make([]*RoomTelemetry, 0, len(due))
+	for _, roomID := range due {
+		if telemetry := gw.aggregateRoomData(roomID); telemetry != nil {
+			telemetries = append(telemetries, telemetry)
+		}
+	}
+	// The latest telemetry of every room also feeds the rollups
+	all := gw.schedule.withLatest(telemetries)
+	var aggregates []*OccupancyAggregate
+	if gw.settings.Privacy.Enabled {
+		aggregates = gw.applyPrivacy(all, now)
+	}
+	gw.applyRules(telemetries, now)
+
+	var snapshot []json.RawMessage
+	for _, telemetry := range telemetries {
+		gw.history.record(telemetry.RoomID, telemetry, now)
+		gw.live.publish(telemetry.RoomID, telemetry)
+		switch {
+		case gw.settings.ConstrainedLink.Enabled:
+		case gw.settings.Snapshot.Enabled:
+			if payload := gw.snapshotRoom(telemetry); payload != nil {
+				snapshot = append(snapshot, payload)
+			}
+		default:
+			gw.publishTelemetry(telemetry.RoomID, telemetry)
+		}
+	}
+	if gw.settings.ConstrainedLink.Enabled {
+		gw.publishBatch(telemetries)
+	} else if gw.settings.Snapshot.Enabled {
+		gw.publishSnapshot(snapshot)
+	}
+	gw.publishOccupancyAggregates(aggregates)
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// newTraceID returns a random 128-bit ID in W3C trace-context format, used
+// to follow a reading from the poll through MQTT into the bridge output
+func newTraceID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
 
-	payload, err := json.Marshal(telemetry)
+func (gw *Gateway) publishTelemetry(roomID string, telemetry *RoomTelemetry) {
+	payload, err := gw.encodeTelemetry(telemetry)
 	if err != nil {
 		log.Printf("[ERROR] Failed to marshal telemetry for room %s: %v", roomID, err)
 		return
 	}
+	gw.publishRoomPayload(telemetry, payload)
+}
 
-	token := gw.mqttClient.Publish(topic, 0, false, payload)
+// publishRoomPayload publishes an encoded room telemetry on its room topic,
+// tenant topic and flat topics
+func (gw *Gateway) publishRoomPayload(telemetry *RoomTelemetry, payload []byte) {
+	topic := fmt.Sprintf("telemetry/%s", telemetry.RoomID)
+	qos := gw.telemetryQoS()
+	token := gw.mqttClient.Publish(topic, qos, false, payload)
 	token.Wait()
 
 	if token.Error() != nil {
 		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
 	} else {
-		log.Printf("[MQTT] Published to %s", topic)
+		log.Printf("[MQTT] Published to %s (trace %s)", topic, telemetry.TraceID)
+	}
+	gw.publishTenantTelemetry(telemetry.RoomID, payload, qos)
+	if gw.settings.FlatTopics.Enabled {
+		gw.publishFlatTelemetry(telemetry)
+	}
+}
+
+// telemetryQoS is the QoS of room telemetry: a lost delta leaves consumers
+// stale until the next snapshot
+func (gw *Gateway) telemetryQoS() byte {
+	if gw.settings.Delta.Enabled {
+		return 1
+	}
+	return 0
+}
+
+// encodeTelemetry returns a room's telemetry payload, delta-encoded when
+// delta publishing is enabled
+func (gw *Gateway) encodeTelemetry(telemetry *RoomTelemetry) ([]byte, error) {
+	if gw.settings.Delta.Enabled {
+		return gw.delta.encode(telemetry)
 	}
+	return json.Marshal(telemetry)
 }
 
-func (gw *Gateway) Stop() {
-	log.Println("Shutting down gateway...")
+// Stop shuts the gateway down, publishing a final aggregation and a retained
+// offline status carrying reason (one of the offlineReason constants)
+func (gw *Gateway) Stop(reason string) {
+	log.Printf("Shutting down gateway (%s)...", reason)
+	gw.stopAPI()
 	close(gw.shutdown)
 	gw.wg.Wait()
 
+	if err := gw.persistState(); err != nil {
+		log.Printf("[ERROR] %v", err)
+	}
+
 	if gw.mqttClient != nil && gw.mqttClient.IsConnected() {
+		gw.flushTelemetry()
+		gw.publishStatus(gw.mqttClient, "offline", reason)
 		gw.mqttClient.Disconnect(250)
 	}
 
-	if gw.bacnetClient != nil {
-		gw.bacnetClient.Close()
+	if gw.bacnet != nil {
+		gw.bacnet.Close()
+	}
+
+	if gw.modbus != nil {
+		gw.modbus.close()
+	}
+	gw.drivers.close()
+	gw.models.close()
+	gw.opcua.close()
+	gw.snmp.close()
+	gw.knx.close()
+	gw.mbus.close()
+	gw.http.close()
+	gw.dali.close()
+
+	gw.capture.Close()
+	gw.link.Close()
+	if gw.fallback != nil {
+		gw.fallback.broker.Close()
 	}
 
-	if gw.modbusHandler != nil {
-		gw.modbusHandler.Close()
+	gw.events.close(reason)
+	if err := gw.store.Close(); err != nil {
+		log.Printf("[ERROR] Failed to close state store: %v", err)
 	}
 
 	log.Println("Gateway stopped")
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate-config" {
+		os.Exit(runMigrateConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-state" {
+		os.Exit(runRebuildState(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
 	log.Println("Starting Golang Gateway with Real BACnet/Modbus")
 
 	// Configuration
 	sensorsConfig := getEnv("SENSORS_CONFIG", "/app/config/sensors.yaml")
 	roomsConfig := getEnv("ROOMS_CONFIG", "/app/config/rooms.yaml")
+	gatewayConfig := getEnv("GATEWAY_CONFIG", "/app/config/gateway.yaml")
 	mqttBroker := getEnv("MQTT_BROKER", "tcp://nanomq:1883")
 	bacnetInterface := getEnv("BACNET_INTERFACE", "")
 	if bacnetInterface == "" {
@@ -537,7 +1788,7 @@ func main() {
 	modbusAddr := getEnv("MODBUS_ADDRESS", "sensor-simulator:5020")
 
 	// Create gateway
-	gateway, err := NewGateway(sensorsConfig, roomsConfig, mqttBroker, bacnetInterface, modbusAddr)
+	gateway, err := NewGateway(sensorsConfig, roomsConfig, gatewayConfig, mqttBroker, bacnetInterface, modbusAddr)
 	if err != nil {
 		log.Fatalf("Failed to create gateway: %v", err)
 	}
@@ -545,13 +1796,20 @@ func main() {
 	// Start gateway
 	gateway.Start()
 
-	// Wait for interrupt
+	// Wait for interrupt or a restart requested over the control topic
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	<-sigChan
+	var reason string
+	select {
+	case sig := <-sigChan:
+		log.Printf("Received %v", sig)
+		reason = offlineReasonSignal
+	case reason = <-gateway.restart:
+	}
 
-	// Graceful shutdown
-	gateway.Stop()
+	// Graceful shutdown; the container restart policy brings the gateway
+	// back with the reloaded configuration
+	gateway.Stop(reason)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Sensors under planned work are put in maintenance with maintenance: true
+// in sensors.yaml, or at runtime with the start_maintenance and
+// end_maintenance control commands for one sensor (sensor_id) or every
+// sensor of a device (address), optionally for duration_min minutes. Their
+// readings are still collected and published, flagged "maintenance" (and
+// listed in the room's maintenance_sensors), but they raise no leak,
+// contact or rule alarms and are left out of comfort, ventilation and
+// completeness statistics.
+
+// sensorMaintenance is a maintenance window entered over the control topic
+type sensorMaintenance struct {
+	since  time.Time
+	until  time.Time // zero until end_maintenance
+	reason string
+}
+
+// inMaintenance reports whether a sensor is in maintenance, ending control
+// windows that have expired
+func (gw *Gateway) inMaintenance(sensorID string) bool {
+	if config, ok := gw.sensors[sensorID]; ok && config.Maintenance {
+		return true
+	}
+	if gw.control == nil {
+		return false
+	}
+	gw.control.mu.Lock()
+	defer gw.control.mu.Unlock()
+	window, ok := gw.control.maintenance[sensorID]
+	if !ok {
+		return false
+	}
+	if !window.until.IsZero() && time.Now().After(window.until) {
+		delete(gw.control.maintenance, sensorID)
+		log.Printf("[EVENT] Sensor %s maintenance window ended (since %s, %s)", sensorID, window.since.Format(time.RFC3339), window.reason)
+		return false
+	}
+	return true
+}
+
+// maintenanceSensors lists the sensors in maintenance
+func (gw *Gateway) maintenanceSensors() []string {
+	ids := []string{}
+	for id := range gw.sensors {
+		if gw.inMaintenance(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// setMaintenance runs the start_maintenance and end_maintenance control
+// commands
+func (gw *Gateway) setMaintenance(start bool, sensorID, address string, durationMin int, reason string) (interface{}, error) {
+	var ids []string
+	switch {
+	case sensorID != "":
+		if _, ok := gw.sensors[sensorID]; !ok {
+			return nil, fmt.Errorf("unknown sensor %s", sensorID)
+		}
+		ids = []string{sensorID}
+	case address != "":
+		for id, config := range gw.sensors {
+			if config.Address == address {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no sensor has address %s", address)
+		}
+		sort.Strings(ids)
+	default:
+		return nil, errors.New("maintenance requires a sensor_id or an address")
+	}
+	if durationMin < 0 {
+		return nil, errors.New("duration_min must not be negative")
+	}
+
+	now := time.Now()
+	window := sensorMaintenance{since: now, reason: reason}
+	if durationMin > 0 {
+		window.until = now.Add(time.Duration(durationMin) * time.Minute)
+	}
+	var configured []string
+	gw.control.mu.Lock()
+	for _, id := range ids {
+		if start {
+			gw.control.maintenance[id] = window
+		} else {
+			delete(gw.control.maintenance, id)
+		}
+		if gw.sensors[id].Maintenance {
+			configured = append(configured, id)
+		}
+	}
+	gw.control.mu.Unlock()
+
+	if start {
+		log.Printf("[EVENT] Sensors %v in maintenance (%s)", ids, reason)
+	} else {
+		log.Printf("[EVENT] Sensors %v out of maintenance", ids)
+	}
+	result := map[string]interface{}{"sensors": ids, "maintenance": start}
+	if start && !window.until.IsZero() {
+		result["until"] = window.until.Format(time.RFC3339)
+	}
+	if !start && len(configured) > 0 {
+		// sensors.yaml keeps these in maintenance until it is changed
+		result["configured"] = configured
+	}
+	return result, nil
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// MBusConfig is the wired M-Bus (EN 13757-2) master of the gateway. Sensors
+// with protocol mbus read one data record of a meter at a primary address
+// (1-250) or an 8-digit secondary address (the meter's identification
+// number); mbus_record selects the record by index or by quantity.
+type MBusConfig struct {
+	// Port is the serial device of the M-Bus level converter (e.g.
+	// /dev/ttyUSB1) or tcp://host:port of a transparent M-Bus gateway
+	Port      string `yaml:"port,omitempty"`
+	BaudRate  int    `yaml:"baud_rate,omitempty"`  // default 2400
+	TimeoutMs int    `yaml:"timeout_ms,omitempty"` // reply timeout, default 1000
+	Retries   int    `yaml:"retries,omitempty"`    // default 2
+}
+
+func (c *MBusConfig) normalize() error {
+	if c.BaudRate == 0 {
+		c.BaudRate = 2400
+	}
+	switch c.BaudRate {
+	case 300, 600, 1200, 2400, 4800, 9600, 19200, 38400:
+	default:
+		return fmt.Errorf("mbus: unsupported baud_rate %d (300 to 38400)", c.BaudRate)
+	}
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 1000
+	}
+	if c.Retries <= 0 {
+		c.Retries = 2
+	}
+	return nil
+}
+
+// M-Bus link layer (EN 13757-2) and application layer (EN 13757-3) codes
+const (
+	mbusAck          = 0xE5
+	mbusShortStart   = 0x10
+	mbusLongStart    = 0x68
+	mbusStop         = 0x16
+	mbusSndNke       = 0x40
+	mbusSndUd        = 0x53
+	mbusReqUd2       = 0x7B // FCB and FCV set, the first request after SND_NKE
+	mbusSelectAddr   = 0xFD
+	mbusCISelect     = 0x52
+	mbusCILongHeader = 0x72
+	mbusCINoHeader   = 0x78
+	mbusCIShortHdr   = 0x7A
+	mbusMaxPrimary   = 250
+	mbusReadoutCache = time.Second
+)
+
+// mbusQuantities are the quantities mbus_record may name, with the unit the
+// value is returned in
+var mbusQuantities = map[string]string{
+	"energy":                 "kW.h",
+	"volume":                 "m3",
+	"mass":                   "kg",
+	"power":                  "W",
+	"volume_flow":            "m3/h",
+	"flow_temperature":       "Cel",
+	"return_temperature":     "Cel",
+	"temperature_difference": "K",
+	"external_temperature":   "Cel",
+	"pressure":               "bar",
+}
+
+// mbusRecord is one data record of a meter readout
+type mbusRecord struct {
+	quantity string // "" for records of other quantities
+	function byte   // 0 instantaneous, 1 maximum, 2 minimum, 3 error state
+	storage  int
+	tariff   int
+	value    float64
+	numeric  bool
+}
+
+// validateMBusSensors checks the M-Bus settings of sensors
+func (gw *Gateway) validateMBusSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "mbus" {
+			if sensor.MBusRecord != "" {
+				return fmt.Errorf("sensor %s: mbus_record is only valid for protocol mbus", id)
+			}
+			continue
+		}
+		if gw.settings.MBus.Port == "" {
+			return fmt.Errorf("sensor %s: protocol mbus requires mbus.port in the gateway config", id)
+		}
+		if _, _, err := parseMBusAddress(sensor.Address); err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		if sensor.MBusRecord == "" {
+			return fmt.Errorf("sensor %s: mbus_record is required (a record index or a quantity such as energy)", id)
+		}
+		if _, ok := mbusQuantities[sensor.MBusRecord]; !ok {
+			if n, err := strconv.Atoi(sensor.MBusRecord); err != nil || n < 0 {
+				return fmt.Errorf("sensor %s: invalid mbus_record %q, expected a record index or one of %s", id, sensor.MBusRecord, mbusQuantityNames())
+			}
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol mbus", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+func mbusQuantityNames() string {
+	names := make([]string, 0, len(mbusQuantities))
+	for name := range mbusQuantities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseMBusAddress returns a primary address, or the BCD-encoded
+// identification number of a secondary address
+func parseMBusAddress(address string) (byte, []byte, error) {
+	if len(address) == 8 {
+		id, err := strconv.ParseUint(address, 10, 32)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid M-Bus secondary address %q, expected 8 digits", address)
+		}
+		bcd := make([]byte, 4)
+		for i := range bcd {
+			bcd[i] = byte(id%10) | byte(id/10%10)<<4
+			id /= 100
+		}
+		return mbusSelectAddr, bcd, nil
+	}
+	n, err := strconv.Atoi(address)
+	if err != nil || n < 1 || n > mbusMaxPrimary {
+		return 0, nil, fmt.Errorf("invalid M-Bus address %q, expected a primary address 1-%d or an 8-digit secondary address", address, mbusMaxPrimary)
+	}
+	return byte(n), nil, nil
+}
+
+// mbusDriver owns the bus; requests are strictly one at a time. A readout
+// carries every record of a meter, so sensors of the same meter polled
+// within mbusReadoutCache share it.
+type mbusDriver struct {
+	config  *MBusConfig
+	latency *latencyRecorder
+
+	mu       sync.Mutex
+	port     io.ReadWriteCloser
+	readouts map[string]mbusReadout
+}
+
+type mbusReadout struct {
+	at      time.Time
+	records []mbusRecord
+}
+
+func newMBusDriver(config *MBusConfig, latency *latencyRecorder) *mbusDriver {
+	return &mbusDriver{config: config, latency: latency, readouts: make(map[string]mbusReadout)}
+}
+
+// read returns the selected record of a sensor's meter
+func (d *mbusDriver) read(sensor *SensorConfig) (float64, string, error) {
+	records, err := d.readout(sensor.Address)
+	if err != nil {
+		return 0, "", fmt.Errorf("M-Bus read error: %s: %w", sensor.Address, err)
+	}
+	record, err := selectMBusRecord(records, sensor.MBusRecord)
+	if err != nil {
+		return 0, "", fmt.Errorf("M-Bus read error: %s: %w", sensor.Address, err)
+	}
+	return record.value, sensor.enumText[record.value], nil
+}
+
+// selectMBusRecord picks a record by index, or the first instantaneous
+// record of a quantity in storage 0 and tariff 0 (the current value)
+func selectMBusRecord(records []mbusRecord, selector string) (mbusRecord, error) {
+	if n, err := strconv.Atoi(selector); err == nil {
+		if n >= len(records) {
+			return mbusRecord{}, fmt.Errorf("record %d not found, the meter returned %d records", n, len(records))
+		}
+		if !records[n].numeric {
+			return mbusRecord{}, fmt.Errorf("record %d is not numeric", n)
+		}
+		return records[n], nil
+	}
+	for _, r := range records {
+		if r.quantity == selector && r.numeric && r.function == 0 && r.storage == 0 && r.tariff == 0 {
+			return r, nil
+		}
+	}
+	return mbusRecord{}, fmt.Errorf("no current %s record in the meter's readout", selector)
+}
+
+// readout requests the data records of a meter, retrying on timeouts and
+// checksum errors
+func (d *mbusDriver) readout(address string) ([]mbusRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r, ok := d.readouts[address]; ok && time.Since(r.at) < mbusReadoutCache {
+		return r.records, nil
+	}
+	primary, secondary, _ := parseMBusAddress(address)
+	var records []mbusRecord
+	var err error
+	for attempt := 0; attempt <= d.config.Retries; attempt++ {
+		start := time.Now()
+		records, err = d.request(primary, secondary)
+		d.latency.observe("mbus", address, time.Since(start), err)
+		if err == nil {
+			d.readouts[address] = mbusReadout{at: time.Now(), records: records}
+			return records, nil
+		}
+	}
+	return nil, err
+}
+
+// request runs one SND_NKE (or secondary selection) and REQ_UD2 exchange
+func (d *mbusDriver) request(primary byte, secondary []byte) ([]mbusRecord, error) {
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	if secondary != nil {
+		data := append(append([]byte(nil), secondary...), 0xFF, 0xFF, 0xFF, 0xFF)
+		if err := d.send(mbusLongFrame(mbusSndUd, mbusSelectAddr, mbusCISelect, data)); err != nil {
+			return nil, err
+		}
+	} else if err := d.send([]byte{mbusShortStart, mbusSndNke, primary, mbusSndNke + primary, mbusStop}); err != nil {
+		return nil, err
+	}
+	if frame, err := d.receive(); err != nil {
+		return nil, fmt.Errorf("no acknowledgement: %w", err)
+	} else if len(frame) != 1 {
+		return nil, errors.New("unexpected reply to link reset")
+	}
+
+	if err := d.send([]byte{mbusShortStart, mbusReqUd2, primary, mbusReqUd2 + primary, mbusStop}); err != nil {
+		return nil, err
+	}
+	frame, err := d.receive()
+	if err != nil {
+		return nil, fmt.Errorf("no reply: %w", err)
+	}
+	if len(frame) < 9 || frame[0] != mbusLongStart {
+		return nil, errors.New("unexpected reply to data request")
+	}
+	return parseMBusRecords(frame[6], frame[7:len(frame)-2])
+}
+
+// open connects to the serial port or TCP gateway if needed
+func (d *mbusDriver) open() error {
+	if d.port != nil {
+		return nil
+	}
+	timeout := time.Duration(d.config.TimeoutMs) * time.Millisecond
+	var err error
+	if host, ok := strings.CutPrefix(d.config.Port, "tcp://"); ok {
+		d.port, err = net.DialTimeout("tcp", host, timeout)
+	} else {
+		d.port, err = serial.Open(&serial.Config{
+			Address:  d.config.Port,
+			BaudRate: d.config.BaudRate,
+			DataBits: 8,
+			StopBits: 1,
+			Parity:   "E",
+			Timeout:  timeout,
+		})
+	}
+	if err != nil {
+		d.port = nil
+		return fmt.Errorf("failed to open M-Bus port %s: %w", d.config.Port, err)
+	}
+	log.Printf("M-Bus master on %s", d.config.Port)
+	return nil
+}
+
+func (d *mbusDriver) send(frame []byte) error {
+	if conn, ok := d.port.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(d.config.TimeoutMs) * time.Millisecond))
+	}
+	if _, err := d.port.Write(frame); err != nil {
+		d.closePort()
+		return err
+	}
+	return nil
+}
+
+// receive reads one frame: a single-character ack, a short frame or a long
+// frame with a valid checksum
+func (d *mbusDriver) receive() ([]byte, error) {
+	if conn, ok := d.port.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(d.config.TimeoutMs) * time.Millisecond))
+	}
+	read := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(d.port, buf); err != nil {
+			var netErr net.Error
+			if !errors.Is(err, serial.ErrTimeout) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				d.closePort()
+			}
+			return nil, err
+		}
+		return buf, nil
+	}
+	start, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	var frame []byte
+	switch start[0] {
+	case mbusAck:
+		return start, nil
+	case mbusShortStart:
+		rest, err := read(4)
+		if err != nil {
+			return nil, err
+		}
+		frame = append(start, rest...)
+		if frame[1]+frame[2] != frame[3] || frame[4] != mbusStop {
+			return nil, errors.New("invalid short frame")
+		}
+		return frame, nil
+	case mbusLongStart:
+		header, err := read(3)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] != header[1] || header[2] != mbusLongStart || header[0] < 3 {
+			return nil, errors.New("invalid long frame header")
+		}
+		rest, err := read(int(header[0]) + 2)
+		if err != nil {
+			return nil, err
+		}
+		frame = append(append(start, header...), rest...)
+		var sum byte
+		for _, b := range frame[4 : len(frame)-2] {
+			sum += b
+		}
+		if sum != frame[len(frame)-2] || frame[len(frame)-1] != mbusStop {
+			return nil, errors.New("long frame checksum error")
+		}
+		return frame, nil
+	}
+	return nil, fmt.Errorf("unexpected start byte 0x%02X", start[0])
+}
+
+func (d *mbusDriver) closePort() {
+	if d.port != nil {
+		d.port.Close()
+		d.port = nil
+	}
+}
+
+func (d *mbusDriver) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closePort()
+}
+
+// mbusLongFrame encodes a long frame
+func mbusLongFrame(control, address, ci byte, data []byte) []byte {
+	body := append([]byte{control, address, ci}, data...)
+	var sum byte
+	for _, b := range body {
+		sum += b
+	}
+	frame := []byte{mbusLongStart, byte(len(body)), byte(len(body)), mbusLongStart}
+	return append(append(frame, body...), sum, mbusStop)
+}
+
+// parseMBusRecords decodes the variable data records of a RSP_UD
+// application layer with the given control information field
+func parseMBusRecords(ci byte, data []byte) ([]mbusRecord, error) {
+	switch ci {
+	case mbusCILongHeader:
+		if len(data) < 12 {
+			return nil, errors.New("truncated data header")
+		}
+		data = data[12:]
+	case mbusCIShortHdr:
+		if len(data) < 4 {
+			return nil, errors.New("truncated data header")
+		}
+		data = data[4:]
+	case mbusCINoHeader:
+	default:
+		return nil, fmt.Errorf("unsupported CI field 0x%02X", ci)
+	}
+
+	var records []mbusRecord
+	for i := 0; i < len(data); {
+		dif := data[i]
+		i++
+		switch dif {
+		case 0x2F: // idle filler
+			continue
+		case 0x0F, 0x1F: // manufacturer specific data follows
+			return records, nil
+		}
+		r := mbusRecord{function: (dif >> 4) & 0x03, storage: int(dif>>6) & 0x01}
+		for n, ext := 0, dif&0x80 != 0; ext; n++ {
+			if i >= len(data) || n >= 10 {
+				return nil, errors.New("truncated data record")
+			}
+			dife := data[i]
+			i++
+			r.storage |= int(dife&0x0F) << (1 + 4*n)
+			r.tariff |= int(dife>>4&0x03) << (2 * n)
+			ext = dife&0x80 != 0
+		}
+		if i >= len(data) {
+			return nil, errors.New("truncated data record")
+		}
+		vifs := []byte{data[i]}
+		i++
+		for vifs[len(vifs)-1]&0x80 != 0 {
+			if i >= len(data) || len(vifs) > 11 {
+				return nil, errors.New("truncated data record")
+			}
+			vifs = append(vifs, data[i])
+			i++
+		}
+		if vifs[0]&0x7F == 0x7C { // plain text unit
+			if i >= len(data) || i+1+int(data[i]) > len(data) {
+				return nil, errors.New("truncated plain text unit")
+			}
+			i += 1 + int(data[i])
+		}
+		value, size, numeric, err := decodeMBusValue(dif&0x0F, data[i:])
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", len(records), err)
+		}
+		i += size
+		quantity, scale := mbusQuantity(vifs)
+		r.quantity = quantity
+		r.value = value * scale
+		r.numeric = numeric
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// decodeMBusValue decodes a data field by its coding, returning the value,
+// the field size and whether it is numeric
+func decodeMBusValue(coding byte, data []byte) (float64, int, bool, error) {
+	sizes := map[byte]int{0x0: 0, 0x1: 1, 0x2: 2, 0x3: 3, 0x4: 4, 0x5: 4, 0x6: 6, 0x7: 8, 0x8: 0, 0x9: 1, 0xA: 2, 0xB: 3, 0xC: 4, 0xE: 6}
+	if coding == 0xD { // variable length
+		if len(data) < 1 {
+			return 0, 0, false, errors.New("truncated variable length data")
+		}
+		lvar := int(data[0])
+		size := lvar
+		switch {
+		case lvar >= 0xC0 && lvar <= 0xDF:
+			size = (lvar & 0x0F) // BCD bytes
+		case lvar >= 0xE0 && lvar <= 0xEF:
+			size = lvar - 0xE0
+		case lvar >= 0xF0 && lvar <= 0xFA:
+			size = 4 * (lvar - 0xEC)
+		case lvar > 0xFA:
+			return 0, 0, false, fmt.Errorf("reserved LVAR 0x%02X", lvar)
+		}
+		if 1+size > len(data) {
+			return 0, 0, false, errors.New("truncated variable length data")
+		}
+		return 0, 1 + size, false, nil
+	}
+	size := sizes[coding]
+	if size > len(data) {
+		return 0, 0, false, errors.New("truncated data field")
+	}
+	field := data[:size]
+	switch coding {
+	case 0x0, 0x8:
+		return 0, 0, false, nil
+	case 0x5:
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(field))), size, true, nil
+	case 0x9, 0xA, 0xB, 0xC, 0xE:
+		v, ok := decodeMBusBCD(field)
+		return v, size, ok, nil
+	}
+	var u uint64
+	for i := size - 1; i >= 0; i-- {
+		u = u<<8 | uint64(field[i])
+	}
+	shift := 64 - 8*uint(size)
+	return float64(int64(u<<shift) >> shift), size, true, nil
+}
+
+// decodeMBusBCD decodes little-endian BCD; a high nibble of F in the most
+// significant byte marks a negative value
+func decodeMBusBCD(field []byte) (float64, bool) {
+	v, negative := 0.0, false
+	for i := len(field) - 1; i >= 0; i-- {
+		hi, lo := field[i]>>4, field[i]&0x0F
+		if i == len(field)-1 && hi == 0x0F {
+			negative, hi = true, 0
+		}
+		if hi > 9 || lo > 9 {
+			return 0, false
+		}
+		v = v*100 + float64(hi)*10 + float64(lo)
+	}
+	if negative {
+		v = -v
+	}
+	return v, true
+}
+
+// mbusQuantity maps a VIF (and its extensions) to a quantity and the scale
+// converting the raw value to the unit in mbusQuantities
+func mbusQuantity(vifs []byte) (string, float64) {
+	pow := func(n int) float64 { return math.Pow10(n) }
+	vif := vifs[0] & 0x7F
+	n := int(vif & 0x07)
+	var quantity string
+	var scale float64
+	switch {
+	case vifs[0] == 0xFB && len(vifs) > 1: // first extension table
+		ext := vifs[1] & 0x7F
+		m := int(ext & 0x01)
+		switch {
+		case ext <= 0x01:
+			quantity, scale = "energy", pow(m-1)*1000 // MWh
+		case ext >= 0x08 && ext <= 0x09:
+			quantity, scale = "energy", pow(m-1)*1e6/3.6 // GJ
+		case ext >= 0x10 && ext <= 0x11:
+			quantity, scale = "volume", pow(m+2)
+		case ext >= 0x28 && ext <= 0x29:
+			quantity, scale = "power", pow(m-1)*1e6 // MW
+		default:
+			return "", 1
+		}
+		vifs = vifs[2:]
+	case vifs[0] == 0xFD || vif == 0x7C || vif == 0x7F:
+		return "", 1
+	default:
+		switch {
+		case vif <= 0x07:
+			quantity, scale = "energy", pow(n-3)/1000
+		case vif <= 0x0F:
+			quantity, scale = "energy", pow(n)/3.6e6
+		case vif <= 0x17:
+			quantity, scale = "volume", pow(n-6)
+		case vif <= 0x1F:
+			quantity, scale = "mass", pow(n-3)
+		case vif >= 0x28 && vif <= 0x2F:
+			quantity, scale = "power", pow(n-3)
+		case vif >= 0x30 && vif <= 0x37:
+			quantity, scale = "power", pow(n)/3600
+		case vif >= 0x38 && vif <= 0x3F:
+			quantity, scale = "volume_flow", pow(n-6)
+		case vif >= 0x40 && vif <= 0x47:
+			quantity, scale = "volume_flow", pow(n-7)*60
+		case vif >= 0x48 && vif <= 0x4F:
+			quantity, scale = "volume_flow", pow(n-9)*3600
+		case vif >= 0x58 && vif <= 0x5B:
+			quantity, scale = "flow_temperature", pow(n&0x03-3)
+		case vif >= 0x5C && vif <= 0x5F:
+			quantity, scale = "return_temperature", pow(n&0x03-3)
+		case vif >= 0x60 && vif <= 0x63:
+			quantity, scale = "temperature_difference", pow(n&0x03-3)
+		case vif >= 0x64 && vif <= 0x67:
+			quantity, scale = "external_temperature", pow(n&0x03-3)
+		case vif >= 0x68 && vif <= 0x6B:
+			quantity, scale = "pressure", pow(n&0x03-3)
+		default:
+			return "", 1
+		}
+		vifs = vifs[1:]
+	}
+	// Combinable extensions: only the multiplicative correction factor
+	// changes the value
+	for _, vife := range vifs {
+		if e := vife & 0x7F; e >= 0x70 && e <= 0x77 {
+			scale *= pow(int(e&0x07) - 6)
+		}
+	}
+	return quantity, scale
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBucketsMs are the upper bounds of the request latency histogram
+var latencyBucketsMs = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// MetricsConfig configures the periodic latency summary published on
+// status/gateway/<gateway_id>/latency and the driver heartbeat on
+// status/gateway/<gateway_id>/drivers
+type MetricsConfig struct {
+	SummaryIntervalSec   int `yaml:"summary_interval_sec,omitempty"`
+	HeartbeatIntervalSec int `yaml:"heartbeat_interval_sec,omitempty"`
+}
+
+func (c *MetricsConfig) normalize() {
+	if c.SummaryIntervalSec <= 0 {
+		c.SummaryIntervalSec = 60
+	}
+	if c.HeartbeatIntervalSec <= 0 {
+		c.HeartbeatIntervalSec = 30
+	}
+}
+
+// latencyHistogram counts request latencies into latencyBucketsMs; the last
+// count is the +Inf bucket
+type latencyHistogram struct {
+	counts []uint64
+	count  uint64
+	errors uint64
+	sumMs  float64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]uint64, len(latencyBucketsMs)+1)}
+}
+
+func (h *latencyHistogram) observe(ms float64, failed bool) {
+	i := sort.SearchFloat64s(latencyBucketsMs, ms)
+	h.counts[i]++
+	h.count++
+	h.sumMs += ms
+	if failed {
+		h.errors++
+	}
+}
+
+// percentile estimates the q-quantile (0..1) by linear interpolation within
+// the bucket that contains it. Values in the +Inf bucket report the largest
+// finite bound.
+func (h *latencyHistogram) percentile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if float64(cumulative+c) >= rank {
+			if i == len(latencyBucketsMs) {
+				return latencyBucketsMs[i-1]
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBucketsMs[i-1]
+			}
+			upper := latencyBucketsMs[i]
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(c)
+		}
+		cumulative += c
+	}
+	return latencyBucketsMs[len(latencyBucketsMs)-1]
+}
+
+// deviceLatency keeps a cumulative histogram for /metrics and a window
+// histogram that is reset after each published summary
+type deviceLatency struct {
+	protocol string
+	device   string
+	total    *latencyHistogram
+	window   *latencyHistogram
+}
+
+// LatencySummary reports request latency percentiles for one device over
+// the last summary interval
+type LatencySummary struct {
+	Protocol string  `json:"protocol"`
+	Device   string  `json:"device"`
+	Requests uint64  `json:"requests"`
+	Errors   uint64  `json:"errors"`
+	P50Ms    float64 `json:"p50_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+	P99Ms    float64 `json:"p99_ms"`
+}
+
+// LatencyReport is published on status/gateway/<gateway_id>/latency
+type LatencyReport struct {
+	GatewayID   string           `json:"gateway_id"`
+	IntervalSec int              `json:"interval_sec"`
+	Devices     []LatencySummary `json:"devices"`
+	Timestamp   string           `json:"timestamp"`
+}
+
+// latencyRecorder keeps the latency histograms; every request also counts
+// towards the health of its protocol driver
+type latencyRecorder struct {
+	mu      sync.Mutex
+	devices map[string]*deviceLatency
+	health  *driverHealth
+}
+
+func newLatencyRecorder() *latencyRecorder {
+	return &latencyRecorder{devices: make(map[string]*deviceLatency), health: newDriverHealth()}
+}
+
+// observe records one field bus request to a device
+func (r *latencyRecorder) observe(protocol, device string, elapsed time.Duration, err error) {
+	r.health.observe(protocol, err)
+	ms := float64(elapsed) / float64(time.Millisecond)
+	key := protocol + "|" + device
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[key]
+	if !ok {
+		d = &deviceLatency{
+			protocol: protocol,
+			device:   device,
+			total:    newLatencyHistogram(),
+			window:   newLatencyHistogram(),
+		}
+		r.devices[key] = d
+	}
+	d.total.observe(ms, err != nil)
+	d.window.observe(ms, err != nil)
+}
+
+// sortedLocked returns the devices ordered by protocol and address; the
+// caller holds mu
+func (r *latencyRecorder) sortedLocked() []*deviceLatency {
+	devices := make([]*deviceLatency, 0, len(r.devices))
+	for _, d := range r.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		if devices[i].protocol != devices[j].protocol {
+			return devices[i].protocol < devices[j].protocol
+		}
+		return devices[i].device < devices[j].device
+	})
+	return devices
+}
+
+// takeSummaries returns per-device percentiles for the current window and
+// starts a new one
+func (r *latencyRecorder) takeSummaries() []LatencySummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	summaries := make([]LatencySummary, 0, len(r.devices))
+	for _, d := range r.sortedLocked() {
+		w := d.window
+		if w.count == 0 {
+			continue
+		}
+		summaries = append(summaries, LatencySummary{
+			Protocol: d.protocol,
+			Device:   d.device,
+			Requests: w.count,
+			Errors:   w.errors,
+			P50Ms:    w.percentile(0.50),
+			P95Ms:    w.percentile(0.95),
+			P99Ms:    w.percentile(0.99),
+		})
+		d.window = newLatencyHistogram()
+	}
+	return summaries
+}
+
+// writePrometheus writes the cumulative histograms and percentiles in the
+// Prometheus text exposition format
+func (r *latencyRecorder) writePrometheus(b *strings.Builder) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	devices := r.sortedLocked()
+
+	b.WriteString("# HELP gateway_request_duration_ms Field bus request latency in milliseconds.\n")
+	b.WriteString("# TYPE gateway_request_duration_ms histogram\n")
+	for _, d := range devices {
+		labels := fmt.Sprintf(`protocol=%q,device=%q`, d.protocol, d.device)
+		var cumulative uint64
+		for i, bound := range latencyBucketsMs {
+			cumulative += d.total.counts[i]
+			fmt.Fprintf(b, "gateway_request_duration_ms_bucket{%s,le=\"%g\"} %d\n", labels, bound, cumulative)
+		}
+		fmt.Fprintf(b, "gateway_request_duration_ms_bucket{%s,le=\"+Inf\"} %d\n", labels, d.total.count)
+		fmt.Fprintf(b, "gateway_request_duration_ms_sum{%s} %g\n", labels, d.total.sumMs)
+		fmt.Fprintf(b, "gateway_request_duration_ms_count{%s} %d\n", labels, d.total.count)
+	}
+
+	b.WriteString("# HELP gateway_request_duration_quantile_ms Estimated field bus request latency percentiles since startup.\n")
+	b.WriteString("# TYPE gateway_request_duration_quantile_ms gauge\n")
+	for _, d := range devices {
+		for _, q := range []float64{0.5, 0.95, 0.99} {
+			fmt.Fprintf(b, "gateway_request_duration_quantile_ms{protocol=%q,device=%q,quantile=\"%g\"} %g\n",
+				d.protocol, d.device, q, d.total.percentile(q))
+		}
+	}
+
+	b.WriteString("# HELP gateway_request_errors_total Failed field bus requests.\n")
+	b.WriteString("# TYPE gateway_request_errors_total counter\n")
+	for _, d := range devices {
+		fmt.Fprintf(b, "gateway_request_errors_total{protocol=%q,device=%q} %d\n", d.protocol, d.device, d.total.errors)
+	}
+}
+
+// handleMetrics serves GET /metrics in the Prometheus text format
+func (gw *Gateway) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var b strings.Builder
+	gw.latency.writePrometheus(&b)
+	gw.limits.writePrometheus(&b)
+	gw.pollGroups.writePrometheus(&b)
+	gw.budget.writePrometheus(&b)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
+
+// publishLatencySummaries periodically publishes per-device latency
+// percentiles so slow or overloaded field buses show up before data goes stale
+func (gw *Gateway) publishLatencySummaries() {
+	defer gw.wg.Done()
+
+	interval := gw.settings.Metrics.SummaryIntervalSec
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	topic := gw.statusTopic() + "/latency"
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			summaries := gw.latency.takeSummaries()
+			if len(summaries) == 0 {
+				continue
+			}
+			payload, err := json.Marshal(LatencyReport{
+				GatewayID:   gw.settings.GatewayID,
+				IntervalSec: interval,
+				Devices:     summaries,
+				Timestamp:   time.Now().Format(time.RFC3339),
+			})
+			if err != nil {
+				log.Printf("[ERROR] Failed to marshal latency summary: %v", err)
+				continue
+			}
+			token := gw.mqttClient.Publish(topic, 0, false, payload)
+			token.Wait()
+			if token.Error() != nil {
+				log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/alexbeltran/gobacnet"
+	"gopkg.in/yaml.v3"
+)
+
+// configSchemaVersion is the layout of sensors.yaml and rooms.yaml this
+// gateway writes; files without schema_version are version 1
+const configSchemaVersion = 2
+
+// configMigration upgrades one file kind from version-1 to version. It
+// returns in-place edits of scalar values so comments and formatting
+// survive.
+type configMigration struct {
+	version     int
+	file        string // "sensors" or "rooms"
+	description string
+	apply       func(root *yaml.Node) []scalarEdit
+}
+
+var configMigrations = []configMigration{
+	{
+		version:     2,
+		file:        "sensors",
+		description: "units are written as UCUM codes",
+		apply:       migrateUnitCodes,
+	},
+	{
+		version:     2,
+		file:        "sensors",
+		description: "BACnet addresses carry the port explicitly",
+		apply:       migrateBACnetPorts,
+	},
+}
+
+// scalarEdit replaces the value of a scalar node
+type scalarEdit struct {
+	node  *yaml.Node
+	value string
+	note  string
+}
+
+// sensorNodes returns the mapping nodes of sensors[] in a sensors file
+func sensorNodes(root *yaml.Node) []*yaml.Node {
+	list := mappingValue(documentMapping(root), "sensors")
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return nil
+	}
+	var sensors []*yaml.Node
+	for _, item := range list.Content {
+		if item.Kind == yaml.MappingNode {
+			sensors = append(sensors, item)
+		}
+	}
+	return sensors
+}
+
+func documentMapping(root *yaml.Node) *yaml.Node {
+	if root.Kind == yaml.DocumentNode && len(root.Content) == 1 {
+		root = root.Content[0]
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	return root
+}
+
+func mappingValue(m *yaml.Node, key string) *yaml.Node {
+	if m == nil {
+		return nil
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == key {
+			return m.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func scalarValue(m *yaml.Node, key string) string {
+	if v := mappingValue(m, key); v != nil && v.Kind == yaml.ScalarNode {
+		return v.Value
+	}
+	return ""
+}
+
+func migrateUnitCodes(root *yaml.Node) []scalarEdit {
+	var edits []scalarEdit
+	for _, sensor := range sensorNodes(root) {
+		node := mappingValue(sensor, "unit")
+		if node == nil || node.Kind != yaml.ScalarNode {
+			continue
+		}
+		if unit, ok := lookupUnit(node.Value); ok && unit.code != node.Value {
+			edits = append(edits, scalarEdit{node: node, value: unit.code, note: scalarValue(sensor, "id")})
+		}
+	}
+	return edits
+}
+
+func migrateBACnetPorts(root *yaml.Node) []scalarEdit {
+	var edits []scalarEdit
+	for _, sensor := range sensorNodes(root) {
+		node := mappingValue(sensor, "address")
+		if scalarValue(sensor, "protocol") != "bacnet" || node == nil || node.Kind != yaml.ScalarNode {
+			continue
+		}
+		if addr := strings.TrimSpace(node.Value); addr != "" && !strings.Contains(addr, ":") {
+			edits = append(edits, scalarEdit{node: node, value: fmt.Sprintf("%s:%d", addr, gobacnet.DefaultPort), note: scalarValue(sensor, "id")})
+		}
+	}
+	return edits
+}
+
+// fileSchemaVersion reads schema_version from a parsed config file
+func fileSchemaVersion(root *yaml.Node) (int, error) {
+	v := mappingValue(documentMapping(root), "schema_version")
+	if v == nil {
+		return 1, nil
+	}
+	var version int
+	if err := v.Decode(&version); err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid schema_version %q", v.Value)
+	}
+	return version, nil
+}
+
+// checkSchemaVersion rejects config files written for a newer gateway and
+// warns about older layouts; version 0 means unversioned
+func checkSchemaVersion(path string, version int) error {
+	if version == 0 {
+		version = 1
+	}
+	if version > configSchemaVersion {
+		return fmt.Errorf("%s has schema_version %d, this gateway supports up to %d", path, version, configSchemaVersion)
+	}
+	if version < configSchemaVersion {
+		log.Printf("[WARN] %s uses config schema version %d (current %d); run `golang-gateway migrate-config` to upgrade it", path, version, configSchemaVersion)
+	}
+	return nil
+}
+
+// migrateConfigFile upgrades one file and returns the new contents and a
+// description of every change; unchanged files return nil
+func migrateConfigFile(kind string, data []byte) ([]byte, []string, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	if documentMapping(&root) == nil {
+		return nil, nil, fmt.Errorf("not a YAML mapping")
+	}
+	version, err := fileSchemaVersion(&root)
+	if err != nil {
+		return nil, nil, err
+	}
+	if version > configSchemaVersion {
+		return nil, nil, fmt.Errorf("schema_version %d is newer than this gateway (%d)", version, configSchemaVersion)
+	}
+	if version == configSchemaVersion {
+		return nil, nil, nil
+	}
+
+	lines := strings.Split(string(data), "\n")
+	var changes []string
+	for _, m := range configMigrations {
+		if m.file != kind || m.version <= version {
+			continue
+		}
+		edits := m.apply(&root)
+		for _, e := range edits {
+			if err := replaceScalar(lines, e.node, e.value); err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, fmt.Sprintf("v%d: %s (%s: %q -> %q)", m.version, m.description, e.note, e.node.Value, e.value))
+		}
+	}
+
+	// Stamp the version, replacing an existing schema_version
+	stamp := fmt.Sprintf("schema_version: %d", configSchemaVersion)
+	if v := mappingValue(documentMapping(&root), "schema_version"); v != nil {
+		if err := replaceScalar(lines, v, fmt.Sprint(configSchemaVersion)); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		at := 0
+		for at < len(lines) && (strings.HasPrefix(lines[at], "#") || strings.HasPrefix(lines[at], "---")) {
+			at++
+		}
+		lines = append(lines[:at], append([]string{stamp}, lines[at:]...)...)
+	}
+	changes = append(changes, fmt.Sprintf("v%d: %s", configSchemaVersion, stamp))
+	return []byte(strings.Join(lines, "\n")), changes, nil
+}
+
+// replaceScalar rewrites a scalar's value on its source line, keeping the
+// quoting style; plain values are quoted when YAML requires it (e.g. "%")
+func replaceScalar(lines []string, node *yaml.Node, value string) error {
+	if node.Style == 0 {
+		out, err := yaml.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("failed to encode %q: %w", value, err)
+		}
+		value = strings.TrimSpace(string(out))
+	}
+	i, col := node.Line-1, node.Column-1
+	if i < 0 || i >= len(lines) || col < 0 || col > len(lines[i]) {
+		return fmt.Errorf("value %q at line %d is out of range", node.Value, node.Line)
+	}
+	line := lines[i]
+	at := strings.Index(line[col:], node.Value)
+	if at < 0 {
+		return fmt.Errorf("cannot rewrite multi-line or escaped value at line %d", node.Line)
+	}
+	at += col
+	lines[i] = line[:at] + value + line[at+len(node.Value):]
+	return nil
+}
+
+// runMigrateConfig implements `golang-gateway migrate-config`: it upgrades
+// sensors.yaml and rooms.yaml to the current schema, prints a unified diff
+// and writes the files (keeping the originals as .bak) unless -dry-run is
+// given. It returns the process exit code.
+func runMigrateConfig(args []string) int {
+	fs := flag.NewFlagSet("migrate-config", flag.ContinueOnError)
+	sensorsPath := fs.String("sensors", getEnv("SENSORS_CONFIG", "/app/config/sensors.yaml"), "sensors config to upgrade")
+	roomsPath := fs.String("rooms", getEnv("ROOMS_CONFIG", "/app/config/rooms.yaml"), "rooms config to upgrade")
+	dryRun := fs.Bool("dry-run", false, "print the diff without writing")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	status := 0
+	for _, f := range []struct{ kind, path string }{{"sensors", *sensorsPath}, {"rooms", *roomsPath}} {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", f.path, err)
+			status = 1
+			continue
+		}
+		upgraded, changes, err := migrateConfigFile(f.kind, data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", f.path, err)
+			status = 1
+			continue
+		}
+		if upgraded == nil {
+			fmt.Printf("%s is up to date (schema version %d)\n", f.path, configSchemaVersion)
+			continue
+		}
+		for _, change := range changes {
+			fmt.Printf("# %s\n", change)
+		}
+		fmt.Print(unifiedDiff(f.path, string(data), string(upgraded)))
+		if *dryRun {
+			continue
+		}
+		if err := writeMigratedConfig(f.path, data, upgraded); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			status = 1
+			continue
+		}
+		fmt.Printf("Upgraded %s (original saved as %s.bak)\n", f.path, f.path)
+	}
+	return status
+}
+
+func writeMigratedConfig(path string, original, upgraded []byte) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if err := os.WriteFile(path+".bak", original, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".migrate-*")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(upgraded); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	return nil
+}
+
+// unifiedDiff returns a unified diff of two texts with three lines of
+// context
+func unifiedDiff(name, a, b string) string {
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+	// Longest common subsequence table, from the end
+	lcs := make([][]int32, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type op struct {
+		kind byte // ' ', '-' or '+'
+		text string
+		i, j int
+	}
+	var ops []op
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ops = append(ops, op{' ', x[i], i, j})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, op{'-', x[i], i, j})
+			i++
+		default:
+			ops = append(ops, op{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	const context = 3
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s\n+++ %s (migrated)\n", name, name)
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are within 2*context lines
+		end := start
+		for k := start; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*context {
+				break
+			}
+		}
+		from := start - context
+		if from < 0 {
+			from = 0
+		}
+		to := end + context
+		if to > len(ops) {
+			to = len(ops)
+		}
+		var oldLines, newLines int
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				oldLines++
+			}
+			if o.kind != '-' {
+				newLines++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", ops[from].i+1, oldLines, ops[from].j+1, newLines)
+		for _, o := range ops[from:to] {
+			fmt.Fprintf(&out, "%c%s\n", o.kind, o.text)
+		}
+		start = to
+	}
+	return out.String()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+// MirrorRule copies the readings of one sensor to a writable point, usually
+// on another protocol (e.g. outdoor temperature from a Modbus weather
+// station to a BACnet AV read by legacy controllers). Values are copied in
+// the canonical unit of the source and converted to the target's unit by the
+// write. A reading is written when it differs from the last written value by
+// more than Deadband, at most once per MinIntervalSec; with RefreshSec the
+// value is rewritten that often even when unchanged, for controllers that
+// fall back to a local value without updates.
+type MirrorRule struct {
+	Source         string  `yaml:"source"` // sensor ID read
+	Target         string  `yaml:"target"` // writable sensor ID written
+	Deadband       float64 `yaml:"deadband,omitempty"`
+	MinIntervalSec int     `yaml:"min_interval_sec,omitempty"`
+	RefreshSec     int     `yaml:"refresh_sec,omitempty"`
+}
+
+// validateMirrors checks the mirror rules against the sensors
+func (gw *Gateway) validateMirrors() error {
+	targets := make(map[string]bool, len(gw.settings.Mirrors))
+	for _, rule := range gw.settings.Mirrors {
+		if _, ok := gw.sensors[rule.Source]; !ok {
+			return fmt.Errorf("mirror %s -> %s: unknown source sensor", rule.Source, rule.Target)
+		}
+		target, ok := gw.sensors[rule.Target]
+		if !ok {
+			return fmt.Errorf("mirror %s -> %s: unknown target sensor", rule.Source, rule.Target)
+		}
+		if !target.Writable {
+			return fmt.Errorf("mirror %s -> %s: target is not writable", rule.Source, rule.Target)
+		}
+		if rule.Source == rule.Target {
+			return fmt.Errorf("mirror %s: source and target are the same sensor", rule.Source)
+		}
+		if targets[rule.Target] {
+			return fmt.Errorf("mirror %s -> %s: target is written by another mirror", rule.Source, rule.Target)
+		}
+		targets[rule.Target] = true
+		if rule.Deadband < 0 || rule.MinIntervalSec < 0 || rule.RefreshSec < 0 {
+			return fmt.Errorf("mirror %s -> %s: deadband, min_interval_sec and refresh_sec must not be negative", rule.Source, rule.Target)
+		}
+	}
+	return nil
+}
+
+// mirrorState tracks the writes of one rule
+type mirrorState struct {
+	rule    *MirrorRule
+	written bool
+	value   float64
+	at      time.Time
+	pending bool // a write is queued or running
+}
+
+// mirrors dispatches source readings to their rules
+type mirrors struct {
+	mu       sync.Mutex
+	bySource map[string][]*mirrorState
+}
+
+func newMirrors(rules []MirrorRule) *mirrors {
+	m := &mirrors{bySource: make(map[string][]*mirrorState)}
+	for i := range rules {
+		rule := &rules[i]
+		m.bySource[rule.Source] = append(m.bySource[rule.Source], &mirrorState{rule: rule})
+	}
+	return m
+}
+
+// due reports whether a reading must be written, and marks the write
+// pending
+func (s *mirrorState) due(value float64, now time.Time) bool {
+	if s.pending {
+		return false
+	}
+	if s.written {
+		since := now.Sub(s.at)
+		if since < time.Duration(s.rule.MinIntervalSec)*time.Second {
+			return false
+		}
+		changed := math.Abs(value-s.value) > s.rule.Deadband
+		refresh := s.rule.RefreshSec > 0 && since >= time.Duration(s.rule.RefreshSec)*time.Second
+		if !changed && !refresh {
+			return false
+		}
+	}
+	s.pending = true
+	return true
+}
+
+// mirrorReading writes a source reading to the targets of its rules through
+// the targets' command queues
+func (gw *Gateway) mirrorReading(sensorID string, value float64, now time.Time) {
+	gw.mirrors.mu.Lock()
+	defer gw.mirrors.mu.Unlock()
+	for _, state := range gw.mirrors.bySource[sensorID] {
+		if !state.due(value, now) {
+			continue
+		}
+		state := state
+		target := gw.sensors[state.rule.Target]
+		err := gw.commandQueues.submit(gw.commandDeviceKey(target), commandJob{
+			run: func() {
+				err := gw.writePoint(target, CommandRequest{Value: value})
+				gw.mirrors.mu.Lock()
+				defer gw.mirrors.mu.Unlock()
+				state.pending = false
+				if err != nil {
+					log.Printf("[ERROR] Failed to mirror %s to %s: %v", sensorID, target.ID, err)
+					return
+				}
+				state.written, state.value, state.at = true, value, time.Now()
+				gw.setpoints.record(target.ID, value, state.at)
+				log.Printf("[COMMAND] Mirrored %.2f from %s to %s", value, sensorID, target.ID)
+			},
+		})
+		if err != nil {
+			state.pending = false
+			log.Printf("[ERROR] Failed to mirror %s to %s: %v", sensorID, target.ID, err)
+		}
+	}
+}
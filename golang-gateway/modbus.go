@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// modbusDefaultPort is used for sensor addresses without a port
+const modbusDefaultPort = "502"
+
+// modbusPool holds one TCP connection per Modbus endpoint (address and unit
+// ID). Sensors without an address use the default endpoint, MODBUS_ADDRESS.
+type modbusPool struct {
+	mu          sync.Mutex
+	defaultAddr string
+	capture     *frameCapture
+	handlers    map[string]*modbus.TCPClientHandler
+	// timeouts holds the response timeout of each endpoint
+	timeouts map[string]time.Duration
+}
+
+func newModbusPool(defaultAddr string, capture *frameCapture) *modbusPool {
+	return &modbusPool{
+		defaultAddr: defaultAddr,
+		capture:     capture,
+		handlers:    make(map[string]*modbus.TCPClientHandler),
+		timeouts:    make(map[string]time.Duration),
+	}
+}
+
+// endpoint resolves an address (host or host:port, default when empty) to
+// host:port and, with the unit ID, to the pool key
+func (p *modbusPool) endpoint(address string, unitID int) (hostPort, key string) {
+	hostPort = address
+	if hostPort == "" {
+		hostPort = p.defaultAddr
+	} else if _, _, err := net.SplitHostPort(hostPort); err != nil {
+		hostPort = net.JoinHostPort(hostPort, modbusDefaultPort)
+	}
+	if unitID == 0 {
+		return hostPort, hostPort
+	}
+	return hostPort, fmt.Sprintf("%s#%d", hostPort, unitID)
+}
+
+// handler returns the connection of an endpoint, created on first use; it
+// connects lazily and reconnects after errors on the next request
+func (p *modbusPool) handler(address string, unitID int) (*modbus.TCPClientHandler, string) {
+	hostPort, key := p.endpoint(address, unitID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	handler, ok := p.handlers[key]
+	if !ok {
+		handler = modbus.NewTCPClientHandler(hostPort)
+		handler.SlaveId = byte(unitID)
+		handler.Timeout = p.timeouts[key]
+		if handler.Timeout <= 0 {
+			handler.Timeout = 2 * time.Second
+		}
+		handler.IdleTimeout = 60 * time.Second
+		handler.Logger = log.New(p.capture.writer(key), "", 0)
+		p.handlers[key] = handler
+		log.Printf("Modbus endpoint %s added", key)
+	}
+	return handler, key
+}
+
+// raiseTimeout makes an endpoint wait at least timeout for responses; it
+// takes effect for connections created afterwards
+func (p *modbusPool) raiseTimeout(address string, unitID int, timeout time.Duration) {
+	_, key := p.endpoint(address, unitID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if timeout > p.timeouts[key] {
+		p.timeouts[key] = timeout
+	}
+}
+
+// client returns a client for an endpoint and the endpoint name used for
+// latency statistics
+func (p *modbusPool) client(address string, unitID int) (modbus.Client, string) {
+	handler, key := p.handler(address, unitID)
+	return modbus.NewClient(handler), key
+}
+
+func (p *modbusPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, handler := range p.handlers {
+		handler.Close()
+	}
+}
+
+// Modbus register types (tables) selectable per sensor with register_type
+const (
+	// registerHolding is read with function code 3 and written with 6
+	registerHolding = "holding"
+	// registerInput is read-only, function code 4
+	registerInput = "input"
+	// registerCoil is a single bit read with function code 1 and written
+	// with 5
+	registerCoil = "coil"
+	// registerDiscrete is a read-only bit, function code 2
+	registerDiscrete = "discrete"
+)
+
+// Modbus data types of register values. Without data_type a sensor uses the
+// original encoding: one uint16 register scaled by 0.01.
+var modbusDataTypes = map[string]int{
+	"uint16":  1,
+	"int16":   1,
+	"uint32":  2,
+	"int32":   2,
+	"float32": 2,
+	"float64": 4,
+}
+
+// validateModbusSensors checks register types and decoding, and that only
+// holding registers and coils are writable
+func (gw *Gateway) validateModbusSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "modbus" {
+			if sensor.RegisterType != "" || sensor.DataType != "" || sensor.ByteOrder != "" || sensor.WordSwap || sensor.UnitID != 0 {
+				return fmt.Errorf("sensor %s: register_type, data_type, byte_order, word_swap and unit_id are only valid for protocol modbus", id)
+			}
+			continue
+		}
+		if sensor.UnitID < 0 || sensor.UnitID > 255 {
+			return fmt.Errorf("sensor %s: unit_id %d out of range 0-255", id, sensor.UnitID)
+		}
+		switch sensor.RegisterType {
+		case "":
+			sensor.RegisterType = registerHolding
+		case registerHolding, registerCoil:
+		case registerInput, registerDiscrete:
+			if sensor.Writable {
+				return fmt.Errorf("sensor %s: %s registers are read-only", id, sensor.RegisterType)
+			}
+		default:
+			return fmt.Errorf("sensor %s: unknown register_type %q (want holding, input, coil or discrete)", id, sensor.RegisterType)
+		}
+
+		bit := sensor.RegisterType == registerCoil || sensor.RegisterType == registerDiscrete
+		if bit && (sensor.DataType != "" || sensor.ByteOrder != "" || sensor.WordSwap || sensor.Scale != 0) {
+			return fmt.Errorf("sensor %s: %s values are single bits without data_type, byte_order, word_swap or scale", id, sensor.RegisterType)
+		}
+		if _, ok := modbusDataTypes[sensor.DataType]; sensor.DataType != "" && !ok {
+			return fmt.Errorf("sensor %s: unknown data_type %q (want int16, uint16, int32, uint32, float32 or float64)", id, sensor.DataType)
+		}
+		switch sensor.ByteOrder {
+		case "", "big", "little":
+		default:
+			return fmt.Errorf("sensor %s: unknown byte_order %q (want big or little)", id, sensor.ByteOrder)
+		}
+		if sensor.Scale == 0 && !bit {
+			sensor.Scale = 1
+			if sensor.DataType == "" {
+				sensor.Scale = 0.01
+			}
+		}
+	}
+	return nil
+}
+
+// modbusRegisterCount is the number of registers (or bits) holding a
+// sensor's value
+func modbusRegisterCount(sensor *SensorConfig) int {
+	if n, ok := modbusDataTypes[sensor.DataType]; ok {
+		return n
+	}
+	return 1
+}
+
+// modbusByteOrder reorders register bytes between the device's layout and
+// big-endian: word_swap reverses the order of the 16-bit registers and
+// little reverses all bytes. Both together give the byte-swapped layout
+// (BADC). The reordering is its own inverse.
+func modbusByteOrder(sensor *SensorConfig, data []byte) []byte {
+	ordered := make([]byte, len(data))
+	copy(ordered, data)
+	if sensor.WordSwap {
+		for i, j := 0, len(ordered)-2; i < j; i, j = i+2, j-2 {
+			ordered[i], ordered[i+1], ordered[j], ordered[j+1] = ordered[j], ordered[j+1], ordered[i], ordered[i+1]
+		}
+	}
+	if sensor.ByteOrder == "little" {
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+	return ordered
+}
+
+// decodeModbusValue decodes the registers read for a sensor; the raw value
+// is scaled with the other calibration (see calibration.go)
+func decodeModbusValue(sensor *SensorConfig, data []byte) (float64, error) {
+	count := modbusRegisterCount(sensor)
+	if len(data) < 2*count {
+		return 0, fmt.Errorf("insufficient data returned")
+	}
+	b := modbusByteOrder(sensor, data[:2*count])
+
+	var value float64
+	switch sensor.DataType {
+	case "int16":
+		value = float64(int16(binary.BigEndian.Uint16(b)))
+	case "uint32":
+		value = float64(binary.BigEndian.Uint32(b))
+	case "int32":
+		value = float64(int32(binary.BigEndian.Uint32(b)))
+	case "float32":
+		value = float64(math.Float32frombits(binary.BigEndian.Uint32(b)))
+	case "float64":
+		value = math.Float64frombits(binary.BigEndian.Uint64(b))
+	default:
+		value = float64(binary.BigEndian.Uint16(b))
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("register value is not a number")
+	}
+	return value, nil
+}
+
+// encodeModbusValue is the inverse of decodeModbusValue for writes
+func encodeModbusValue(sensor *SensorConfig, value float64) ([]byte, error) {
+	inRange := func(min, max float64) error {
+		if math.Round(value) < min || math.Round(value) > max {
+			return fmt.Errorf("raw value %.2f out of range for a %s register", value, sensor.DataType)
+		}
+		return nil
+	}
+
+	b := make([]byte, 2*modbusRegisterCount(sensor))
+	switch sensor.DataType {
+	case "int16":
+		if err := inRange(math.MinInt16, math.MaxInt16); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint16(b, uint16(int16(math.Round(value))))
+	case "uint32":
+		if err := inRange(0, math.MaxUint32); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(b, uint32(math.Round(value)))
+	case "int32":
+		if err := inRange(math.MinInt32, math.MaxInt32); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(b, uint32(int32(math.Round(value))))
+	case "float32":
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(value)))
+	case "float64":
+		binary.BigEndian.PutUint64(b, math.Float64bits(value))
+	default:
+		if math.Round(value) < 0 || math.Round(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("raw value %.2f out of range for a uint16 register", value)
+		}
+		binary.BigEndian.PutUint16(b, uint16(math.Round(value)))
+	}
+	return modbusByteOrder(sensor, b), nil
+}
+
+// readModbusRegisters reads count registers, or count bits for coils and
+// discrete inputs, from the sensor's register table
+func readModbusRegisters(client modbus.Client, registerType string, address, count uint16) ([]byte, error) {
+	switch registerType {
+	case registerInput:
+		return client.ReadInputRegisters(address, count)
+	case registerCoil:
+		return client.ReadCoils(address, count)
+	case registerDiscrete:
+		return client.ReadDiscreteInputs(address, count)
+	default:
+		return client.ReadHoldingRegisters(address, count)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// ModbusConfig tunes Modbus polling. With block reads, sensors on the same
+// endpoint, register table and poll interval are read together: one request
+// per contiguous block of registers (or bits) per poll cycle, fanned out to
+// the individual sensors.
+type ModbusConfig struct {
+	BlockReads bool `yaml:"block_reads"`
+	// MaxGap is how many unused registers or bits a block may read to join
+	// two sensors
+	MaxGap int `yaml:"max_gap"`
+	// MaxRegisters and MaxBits cap a block (protocol limits 125 and 2000)
+	MaxRegisters int `yaml:"max_registers"`
+	MaxBits      int `yaml:"max_bits"`
+	// TimeoutMs is the response timeout of an endpoint, default 2000; an
+	// endpoint waits as long as the longest timeout_ms of its sensors
+	TimeoutMs int `yaml:"timeout_ms"`
+}
+
+func (c *ModbusConfig) normalize() error {
+	if c.MaxGap < 0 {
+		return fmt.Errorf("modbus max_gap must not be negative")
+	}
+	if c.MaxRegisters == 0 {
+		c.MaxRegisters = 125
+	}
+	if c.MaxRegisters < 0 || c.MaxRegisters > 125 {
+		return fmt.Errorf("modbus max_registers must be between 1 and 125")
+	}
+	if c.MaxBits == 0 {
+		c.MaxBits = 2000
+	}
+	if c.MaxBits < 0 || c.MaxBits > 2000 {
+		return fmt.Errorf("modbus max_bits must be between 1 and 2000")
+	}
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 2000
+	}
+	return nil
+}
+
+// modbusBlock is one contiguous read covering several sensors
+type modbusBlock struct {
+	address      string
+	unitID       int
+	registerType string
+	start        int
+	count        int
+	sensors      []string
+}
+
+// modbusBlockGroup holds the blocks polled together on one interval
+type modbusBlockGroup struct {
+	interval    time.Duration
+	lowPriority bool // throttled by the resource budget
+	blocks      []*modbusBlock
+}
+
+// planModbusBlocks groups the polled Modbus sensors not in skip into
+// contiguous blocks. Sensors that end up alone in a block are left to their
+// own poller; the planned sensors are added to skip.
+func (gw *Gateway) planModbusBlocks(skip map[string]bool) []*modbusBlockGroup {
+	cfg := &gw.settings.Modbus
+	type groupKey struct {
+		endpoint     string
+		registerType string
+		intervalMs   int
+		lowPriority  bool
+	}
+	members := make(map[groupKey][]string)
+	for sensorID, sensor := range gw.sensors {
+		if sensor.Protocol != "modbus" || skip[sensorID] || sensor.Subscribe || sensor.Schedule != "" {
+			continue
+		}
+		_, endpoint := gw.modbus.endpoint(sensor.Address, sensor.UnitID)
+		key := groupKey{endpoint, sensor.RegisterType, sensor.PollIntervalMs, sensor.PollPriority == pollPriorityLow}
+		members[key] = append(members[key], sensorID)
+	}
+
+	keys := make([]groupKey, 0, len(members))
+	for key := range members {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		if keys[i].registerType != keys[j].registerType {
+			return keys[i].registerType < keys[j].registerType
+		}
+		if keys[i].intervalMs != keys[j].intervalMs {
+			return keys[i].intervalMs < keys[j].intervalMs
+		}
+		return !keys[i].lowPriority && keys[j].lowPriority
+	})
+
+	var groups []*modbusBlockGroup
+	for _, key := range keys {
+		ids := members[key]
+		sort.Slice(ids, func(i, j int) bool {
+			a, b := gw.sensors[ids[i]], gw.sensors[ids[j]]
+			if a.Register != b.Register {
+				return a.Register < b.Register
+			}
+			return ids[i] < ids[j]
+		})
+		limit := cfg.MaxRegisters
+		if key.registerType == registerCoil || key.registerType == registerDiscrete {
+			limit = cfg.MaxBits
+		}
+
+		var blocks []*modbusBlock
+		var block *modbusBlock
+		for _, sensorID := range ids {
+			sensor := gw.sensors[sensorID]
+			end := sensor.Register + modbusRegisterCount(sensor)
+			if block != nil && sensor.Register-(block.start+block.count) <= cfg.MaxGap {
+				if count := maxInt(end, block.start+block.count) - block.start; count <= limit {
+					block.count = count
+					block.sensors = append(block.sensors, sensorID)
+					continue
+				}
+			}
+			block = &modbusBlock{
+				address:      sensor.Address,
+				unitID:       sensor.UnitID,
+				registerType: key.registerType,
+				start:        sensor.Register,
+				count:        end - sensor.Register,
+				sensors:      []string{sensorID},
+			}
+			blocks = append(blocks, block)
+		}
+
+		group := &modbusBlockGroup{interval: time.Duration(key.intervalMs) * time.Millisecond, lowPriority: key.lowPriority}
+		for _, block := range blocks {
+			if len(block.sensors) < 2 {
+				continue
+			}
+			for _, sensorID := range block.sensors {
+				skip[sensorID] = true
+			}
+			group.blocks = append(group.blocks, block)
+			log.Printf("Modbus block %s %s %d-%d reads %d sensors", key.endpoint, block.registerType, block.start, block.start+block.count-1, len(block.sensors))
+		}
+		if len(group.blocks) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// pollModbusBlocks reads a group's blocks on each tick
+func (gw *Gateway) pollModbusBlocks(group *modbusBlockGroup) {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(group.interval)
+	defer ticker.Stop()
+
+	tick := 0
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			tick++
+			if group.lowPriority && tick%gw.budget.factor() != 0 {
+				continue
+			}
+			gw.pollGate.RLock()
+			for _, block := range group.blocks {
+				// A block is read while any of its sensors is due
+				allowed := false
+				for _, sensorID := range block.sensors {
+					if gw.allowPoll(sensorID, now) {
+						allowed = true
+					}
+				}
+				if allowed {
+					gw.readModbusBlock(block)
+				}
+			}
+			gw.pollGate.RUnlock()
+		}
+	}
+}
+
+// readModbusBlock reads a block and records a reading (or the read error)
+// for each of its sensors that is not paused
+func (gw *Gateway) readModbusBlock(block *modbusBlock) {
+	client, endpoint := gw.modbus.client(block.address, block.unitID)
+	start := time.Now()
+	results, err := readModbusRegisters(client, block.registerType, uint16(block.start), uint16(block.count))
+	gw.latency.observe("modbus", endpoint, time.Since(start), err)
+	if err != nil {
+		err = fmt.Errorf("Modbus read error: %w", err)
+	}
+
+	for _, sensorID := range block.sensors {
+		if gw.control.isPaused(sensorID) {
+			continue
+		}
+		config := gw.sensors[sensorID]
+		var value float64
+		readErr := err
+		if readErr == nil {
+			value, readErr = block.value(config, results)
+		}
+		gw.recordReading(sensorID, config, value, "", readErr, time.Time{}, newTraceID())
+	}
+}
+
+// value extracts a sensor's value from the block's response: a bit of the
+// packed coil or discrete input bytes, or the sensor's registers
+func (b *modbusBlock) value(sensor *SensorConfig, data []byte) (float64, error) {
+	offset := sensor.Register - b.start
+	if b.registerType == registerCoil || b.registerType == registerDiscrete {
+		if offset/8 >= len(data) {
+			return 0, fmt.Errorf("insufficient data returned")
+		}
+		return float64(data[offset/8] >> (offset % 8) & 1), nil
+	}
+	if 2*offset > len(data) {
+		return 0, fmt.Errorf("insufficient data returned")
+	}
+	return decodeModbusValue(sensor, data[2*offset:])
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang-gateway/modelpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ModelConfig is an external ML model that scores recent room telemetry.
+// Sensors with protocol model name it in model and are read by sending the
+// room's feature windows (the room history of each feature, resampled to
+// StepSec over WindowMin) to the model and taking one of the returned
+// scores. The model is trained and deployed outside the gateway:
+//
+//   - http: the request is posted to Endpoint as JSON, which answers
+//     {"scores": {"fault_probability": 0.12, ...}}
+//   - grpc: the Score method of modelpb/model.proto is called at Endpoint
+//     (host:port, unencrypted)
+//
+// Scores of a room are reused for CacheSec, so the sensors of one model
+// and room share a call.
+type ModelConfig struct {
+	Name     string `yaml:"name"`
+	Kind     string `yaml:"kind"` // http (default) or grpc
+	Endpoint string `yaml:"endpoint"`
+	// Features are telemetry fields, default temperature, humidity and
+	// co2_ppm
+	Features    []string `yaml:"features,omitempty"`
+	WindowMin   int      `yaml:"window_min,omitempty"` // default 60
+	StepSec     int      `yaml:"step_sec,omitempty"`   // default the history resolution
+	CacheSec    int      `yaml:"cache_sec,omitempty"`  // default 60
+	TimeoutSec  int      `yaml:"timeout_sec,omitempty"`
+	MinSamples  int      `yaml:"min_samples,omitempty"` // samples needed per feature, default 2
+	windowSteps int
+}
+
+func (c *ModelConfig) normalize(history *HistoryConfig) error {
+	if c.Name == "" {
+		return fmt.Errorf("models: every model needs a name")
+	}
+	switch c.Kind {
+	case "":
+		c.Kind = "http"
+	case "http", "grpc":
+	default:
+		return fmt.Errorf("model %s: unknown kind %q (http or grpc)", c.Name, c.Kind)
+	}
+	if c.Endpoint == "" {
+		return fmt.Errorf("model %s: endpoint is required", c.Name)
+	}
+	if len(c.Features) == 0 {
+		c.Features = []string{"temperature", "humidity", "co2_ppm"}
+	}
+	if c.WindowMin <= 0 {
+		c.WindowMin = 60
+	}
+	if c.StepSec <= 0 {
+		c.StepSec = history.ResolutionSec
+	}
+	if c.StepSec < history.ResolutionSec {
+		return fmt.Errorf("model %s: step_sec %d is shorter than the history resolution_sec %d", c.Name, c.StepSec, history.ResolutionSec)
+	}
+	if c.WindowMin*60 < c.StepSec {
+		return fmt.Errorf("model %s: window_min is shorter than one step", c.Name)
+	}
+	if c.WindowMin > history.RetentionHours*60 {
+		return fmt.Errorf("model %s: window_min exceeds the history retention_hours", c.Name)
+	}
+	if c.CacheSec <= 0 {
+		c.CacheSec = 60
+	}
+	if c.TimeoutSec <= 0 {
+		c.TimeoutSec = 5
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = 2
+	}
+	c.windowSteps = c.WindowMin * 60 / c.StepSec
+	return nil
+}
+
+// normalizeModels normalizes the models and rejects duplicate names
+func normalizeModels(models []ModelConfig, history *HistoryConfig) error {
+	names := make(map[string]bool, len(models))
+	for i := range models {
+		if err := models[i].normalize(history); err != nil {
+			return err
+		}
+		if names[models[i].Name] {
+			return fmt.Errorf("models: duplicate model %s", models[i].Name)
+		}
+		names[models[i].Name] = true
+	}
+	return nil
+}
+
+// validateModelSensors checks the model settings of sensors
+func (gw *Gateway) validateModelSensors() error {
+	models := make(map[string]bool, len(gw.settings.Models))
+	for _, model := range gw.settings.Models {
+		models[model.Name] = true
+	}
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "model" {
+			if sensor.Model != "" || sensor.Output != "" {
+				return fmt.Errorf("sensor %s: model and output are only valid for protocol model", id)
+			}
+			continue
+		}
+		if !models[sensor.Model] {
+			return fmt.Errorf("sensor %s: unknown model %q", id, sensor.Model)
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: model sensors cannot be writable", id)
+		}
+		if _, ok := gw.sensorToRoom[id]; !ok {
+			return fmt.Errorf("sensor %s: model sensors must belong to a room", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+// ScoreRequest is posted to http models; Features maps each feature to its
+// window, oldest first
+type ScoreRequest struct {
+	Model     string               `json:"model"`
+	RoomID    string               `json:"room_id"`
+	Timestamp time.Time            `json:"timestamp"`
+	StepSec   int                  `json:"step_sec"`
+	Features  map[string][]float64 `json:"features"`
+}
+
+// scoreEntry caches the scores of one model and room; mu serializes the
+// calls so concurrent sensor reads share one
+type scoreEntry struct {
+	mu     sync.Mutex
+	at     time.Time
+	scores map[string]float64
+	err    error
+}
+
+// modelScorer reads protocol model sensors
+type modelScorer struct {
+	models  map[string]*ModelConfig
+	history *roomHistory
+	latency *latencyRecorder
+	client  *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*scoreEntry
+	conns   map[string]*grpc.ClientConn
+}
+
+func newModelScorer(models []ModelConfig, history *roomHistory, latency *latencyRecorder) *modelScorer {
+	s := &modelScorer{
+		models:  make(map[string]*ModelConfig, len(models)),
+		history: history,
+		latency: latency,
+		client:  &http.Client{},
+		entries: make(map[string]*scoreEntry),
+		conns:   make(map[string]*grpc.ClientConn),
+	}
+	for i := range models {
+		s.models[models[i].Name] = &models[i]
+	}
+	return s
+}
+
+// read returns the sensor's score for its room; the output name defaults
+// to the sensor type
+func (s *modelScorer) read(sensor *SensorConfig, roomID string) (float64, error) {
+	model, ok := s.models[sensor.Model]
+	if !ok {
+		return 0, fmt.Errorf("unknown model %s", sensor.Model)
+	}
+	scores, err := s.scores(model, roomID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	output := sensor.Output
+	if output == "" {
+		output = sensor.Type
+	}
+	score, ok := scores[output]
+	if !ok {
+		return 0, fmt.Errorf("model %s returned no %s score", model.Name, output)
+	}
+	return score, nil
+}
+
+// scores returns the cached scores of a room, calling the model when they
+// are older than CacheSec. Failures are cached as well, so an unreachable
+// model is not called by every sensor.
+func (s *modelScorer) scores(model *ModelConfig, roomID string, now time.Time) (map[string]float64, error) {
+	key := model.Name + "/" + roomID
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &scoreEntry{}
+		s.entries[key] = entry
+	}
+	s.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if !entry.at.IsZero() && now.Sub(entry.at) < time.Duration(model.CacheSec)*time.Second {
+		return entry.scores, entry.err
+	}
+	entry.scores, entry.err = s.score(model, roomID, now)
+	entry.at = now
+	return entry.scores, entry.err
+}
+
+// features resamples the room history into one window per feature
+func (s *modelScorer) features(model *ModelConfig, roomID string, now time.Time) (map[string][]float64, error) {
+	step := time.Duration(model.StepSec) * time.Second
+	from := now.Truncate(step).Add(-time.Duration(model.windowSteps-1) * step)
+	points := s.history.query(roomID, from, now)
+	features := make(map[string][]float64, len(model.Features))
+	for _, name := range model.Features {
+		series := resampleHistory(points, name, from, step, model.windowSteps)
+		if len(series) < model.MinSamples {
+			return nil, fmt.Errorf("not enough %s history in room %s for model %s", name, roomID, model.Name)
+		}
+		values := make([]float64, len(series))
+		for i, sample := range series {
+			values[i] = sample.Value
+		}
+		features[name] = values
+	}
+	return features, nil
+}
+
+func (s *modelScorer) score(model *ModelConfig, roomID string, now time.Time) (map[string]float64, error) {
+	features, err := s.features(model, roomID, now)
+	if err != nil {
+		return nil, err
+	}
+	req := ScoreRequest{Model: model.Name, RoomID: roomID, Timestamp: now, StepSec: model.StepSec, Features: features}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(model.TimeoutSec)*time.Second)
+	defer cancel()
+	start := time.Now()
+	var scores map[string]float64
+	if model.Kind == "grpc" {
+		scores, err = s.scoreGRPC(ctx, model, req)
+	} else {
+		scores, err = s.scoreHTTP(ctx, model, req)
+	}
+	s.latency.observe("model", model.Endpoint, time.Since(start), err)
+	if err != nil {
+		log.Printf("[WARN] Model %s failed to score room %s: %v", model.Name, roomID, err)
+		return nil, fmt.Errorf("model %s error: %w", model.Name, err)
+	}
+	return scores, nil
+}
+
+func (s *modelScorer) scoreHTTP(ctx context.Context, model *ModelConfig, req ScoreRequest) (map[string]float64, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, model.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", model.Endpoint, resp.Status)
+	}
+	var result struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid score response: %w", err)
+	}
+	return result.Scores, nil
+}
+
+func (s *modelScorer) scoreGRPC(ctx context.Context, model *ModelConfig, req ScoreRequest) (map[string]float64, error) {
+	conn, err := s.conn(model.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	pbReq := &modelpb.ScoreRequest{
+		Model:             req.Model,
+		RoomId:            req.RoomID,
+		TimestampUnixNano: req.Timestamp.UnixNano(),
+		StepSec:           int32(req.StepSec),
+		Features:          make(map[string]*modelpb.FeatureWindow, len(req.Features)),
+	}
+	for name, values := range req.Features {
+		pbReq.Features[name] = &modelpb.FeatureWindow{Values: values}
+	}
+	resp, err := modelpb.NewModelClient(conn).Score(ctx, pbReq)
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetScores(), nil
+}
+
+// conn returns the connection to a model server, connecting lazily on
+// first use
+func (s *modelScorer) conn(target string) (*grpc.ClientConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn, ok := s.conns[target]
+	if !ok {
+		var err error
+		conn, err = grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create model client for %s: %w", target, err)
+		}
+		s.conns[target] = conn
+	}
+	return conn, nil
+}
+
+func (s *modelScorer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for target, conn := range s.conns {
+		if err := conn.Close(); err != nil {
+			log.Printf("[WARN] Failed to close model connection to %s: %v", target, err)
+		}
+	}
+	s.conns = make(map[string]*grpc.ClientConn)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig accepts bearer tokens (JWTs) issued by an OpenID Connect
+// provider. The role comes from RoleClaim (a dotted path such as
+// realm_access.roles for Keycloak), mapped through RoleMap; the highest
+// mapped role wins.
+type OIDCConfig struct {
+	Issuer   string `yaml:"issuer,omitempty"`
+	Audience string `yaml:"audience,omitempty"`
+	// JWKSURL defaults to the jwks_uri of the issuer's discovery document
+	JWKSURL   string            `yaml:"jwks_url,omitempty"`
+	RoleClaim string            `yaml:"role_claim,omitempty"`
+	RoleMap   map[string]string `yaml:"role_map,omitempty"`
+	// TenantClaim names a claim (dotted path) scoping the caller to a tenant
+	TenantClaim string `yaml:"tenant_claim,omitempty"`
+}
+
+func (c *OIDCConfig) normalize() error {
+	if c.Issuer == "" {
+		return nil
+	}
+	if c.RoleClaim == "" {
+		c.RoleClaim = "roles"
+	}
+	for claim, role := range c.RoleMap {
+		if _, ok := roleRank[role]; !ok {
+			return fmt.Errorf("oidc role_map %s has unknown role %q", claim, role)
+		}
+	}
+	return nil
+}
+
+// oidcVerifier validates JWT signatures against the provider's JWKS
+type oidcVerifier struct {
+	config      *OIDCConfig
+	client      *http.Client
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+}
+
+// jwksMinRefresh limits JWKS refetches triggered by unknown key IDs
+const jwksMinRefresh = time.Minute
+
+func newOIDCVerifier(config *OIDCConfig) *oidcVerifier {
+	return &oidcVerifier{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// verify checks a token and returns its principal
+func (v *oidcVerifier) verify(token string) (*principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported token algorithm %s", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, fmt.Errorf("unsupported token algorithm %s", header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("invalid token signature")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	role := v.role(claims)
+	if role == "" {
+		return nil, errors.New("token grants no gateway role")
+	}
+	subject, _ := claims["sub"].(string)
+	p := &principal{name: "oidc:" + subject, role: role}
+	if v.config.TenantClaim != "" {
+		p.tenant, _ = claimValue(claims, v.config.TenantClaim).(string)
+	}
+	return p, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// checkClaims validates issuer, audience and validity period
+func (v *oidcVerifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+		return errors.New("token issuer mismatch")
+	}
+	if v.config.Audience != "" {
+		ok := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			ok = aud == v.config.Audience
+		case []interface{}:
+			for _, a := range aud {
+				if a == v.config.Audience {
+					ok = true
+				}
+			}
+		}
+		if !ok {
+			return errors.New("token audience mismatch")
+		}
+	}
+	now := float64(time.Now().Unix())
+	const leeway = 60
+	if exp, ok := claims["exp"].(float64); !ok || now > exp+leeway {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf-leeway {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// role maps the role claim to the highest gateway role
+func (v *oidcVerifier) role(claims map[string]interface{}) string {
+	var names []string
+	switch c := claimValue(claims, v.config.RoleClaim).(type) {
+	case string:
+		names = []string{c}
+	case []interface{}:
+		for _, n := range c {
+			if s, ok := n.(string); ok {
+				names = append(names, s)
+			}
+		}
+	}
+	best := ""
+	for _, name := range names {
+		role, ok := v.config.RoleMap[name]
+		if !ok {
+			if _, builtin := roleRank[name]; builtin {
+				role = name
+			}
+		}
+		if roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	return best
+}
+
+// claimValue resolves a dotted claim path such as realm_access.roles
+func claimValue(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, part := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[part]
+	}
+	return value
+}
+
+// key returns the verification key for a key ID, refreshing the JWKS when
+// the ID is unknown
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.lastRefresh) < jwksMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	v.lastRefresh = time.Now()
+	keys, err := v.fetchJWKS()
+	if err != nil {
+		log.Printf("[ERROR] Failed to refresh OIDC signing keys: %v", err)
+		return nil, errors.New("signing keys unavailable")
+	}
+	v.keys = keys
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (v *oidcVerifier) fetchJWKS() (map[string]crypto.PublicKey, error) {
+	url := v.config.JWKSURL
+	if url == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimRight(v.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, err
+		}
+		url = discovery.JWKSURI
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(url, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	log.Printf("Loaded %d OIDC signing keys from %s", len(keys), url)
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(url string, out interface{}) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OPCUAConfig holds the gateway-wide OPC UA client settings. Sensors with
+// protocol opcua read the Value attribute of node_id from the endpoint URL
+// in address, e.g. opc.tcp://ahu-3:4840. Sensors with the same endpoint,
+// security and user share one session.
+//
+// Secure policies need the gateway's application instance certificate
+// (CertFile, KeyFile; PEM or DER, RSA), which the server must trust; the
+// application URI is taken from the certificate's URI SAN. Server
+// certificates are accepted when found in TrustedCertsDir, which sensors
+// with a secure policy or a username need: their messages and password are
+// encrypted to the server's key. InsecureAcceptAnyCert accepts any server
+// certificate instead, open to a man in the middle; for lab use only.
+type OPCUAConfig struct {
+	CertFile              string `yaml:"cert_file,omitempty"`
+	KeyFile               string `yaml:"key_file,omitempty"`
+	TrustedCertsDir       string `yaml:"trusted_certs_dir,omitempty"`
+	InsecureAcceptAnyCert bool   `yaml:"insecure_accept_any_cert,omitempty"`
+	TimeoutMs             int    `yaml:"timeout_ms,omitempty"` // per request, default 5000
+}
+
+func (c *OPCUAConfig) normalize() error {
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 5000
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("opcua: cert_file and key_file must be set together")
+	}
+	return nil
+}
+
+// Security policy and mode names accepted in sensor configs
+var (
+	opcuaPolicies = map[string]string{
+		"None":           uaPolicyNone,
+		"Basic256Sha256": uaPolicyBasic256Sha256,
+	}
+	opcuaModes = map[string]uint32{
+		"None":           uaModeNone,
+		"Sign":           uaModeSign,
+		"SignAndEncrypt": uaModeSignAndEncrypt,
+	}
+)
+
+// opcuaSecurity returns a sensor's security policy URI and message security
+// mode; secure policies default to SignAndEncrypt
+func opcuaSecurity(sensor *SensorConfig) (string, uint32) {
+	policy, ok := opcuaPolicies[sensor.SecurityPolicy]
+	if !ok {
+		policy = uaPolicyNone
+	}
+	mode, ok := opcuaModes[sensor.SecurityMode]
+	if !ok {
+		mode = uaModeNone
+		if policy != uaPolicyNone {
+			mode = uaModeSignAndEncrypt
+		}
+	}
+	return policy, mode
+}
+
+// validateOPCUASensors checks the OPC UA settings of sensors and parses
+// their node IDs
+func (gw *Gateway) validateOPCUASensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "opcua" {
+			if sensor.NodeID != "" || sensor.SecurityPolicy != "" || sensor.SecurityMode != "" {
+				return fmt.Errorf("sensor %s: node_id, security_policy and security_mode are only valid for protocol opcua", id)
+			}
+			if sensor.Protocol != "http" && (sensor.Username != "" || sensor.Password != "") {
+				return fmt.Errorf("sensor %s: username and password are only valid for protocols opcua and http", id)
+			}
+			continue
+		}
+		if _, err := uaDialAddress(sensor.Address); err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		node, err := parseUANodeID(sensor.NodeID)
+		if err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		sensor.opcuaNode = node
+		if _, ok := opcuaPolicies[sensor.SecurityPolicy]; sensor.SecurityPolicy != "" && !ok {
+			return fmt.Errorf("sensor %s: unsupported security_policy %q (None or Basic256Sha256)", id, sensor.SecurityPolicy)
+		}
+		if _, ok := opcuaModes[sensor.SecurityMode]; sensor.SecurityMode != "" && !ok {
+			return fmt.Errorf("sensor %s: unknown security_mode %q (None, Sign or SignAndEncrypt)", id, sensor.SecurityMode)
+		}
+		policy, mode := opcuaSecurity(sensor)
+		if (policy == uaPolicyNone) != (mode == uaModeNone) {
+			return fmt.Errorf("sensor %s: security_mode None requires security_policy None and vice versa", id)
+		}
+		if policy != uaPolicyNone && gw.settings.OPCUA.CertFile == "" {
+			return fmt.Errorf("sensor %s: security_policy %s requires opcua cert_file and key_file in the gateway config", id, sensor.SecurityPolicy)
+		}
+		if (sensor.Username == "") != (sensor.Password == "") {
+			return fmt.Errorf("sensor %s: username and password must be set together", id)
+		}
+		if (policy != uaPolicyNone || sensor.Username != "") && gw.settings.OPCUA.TrustedCertsDir == "" && !gw.settings.OPCUA.InsecureAcceptAnyCert {
+			return fmt.Errorf("sensor %s: security_policy and username require opcua trusted_certs_dir in the gateway config to verify the server certificate", id)
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol opcua", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+// opcuaDriver is a minimal OPC UA binary client: it opens a secure channel
+// and session per endpoint and reads node values, reconnecting on the next
+// read after any failure
+type opcuaDriver struct {
+	config  *OPCUAConfig
+	cert    []byte
+	key     *rsa.PrivateKey
+	appURI  string
+	trusted [][]byte
+	latency *latencyRecorder
+
+	mu       sync.Mutex
+	sessions map[string]*uaSession
+}
+
+func newOPCUADriver(config *OPCUAConfig, latency *latencyRecorder) (*opcuaDriver, error) {
+	d := &opcuaDriver{
+		config:   config,
+		appURI:   "urn:smart-building:golang-gateway",
+		latency:  latency,
+		sessions: make(map[string]*uaSession),
+	}
+	if config.CertFile != "" {
+		if err := d.loadCertificate(); err != nil {
+			return nil, err
+		}
+	}
+	if config.TrustedCertsDir != "" {
+		if err := d.loadTrusted(); err != nil {
+			return nil, err
+		}
+	} else if config.InsecureAcceptAnyCert {
+		log.Printf("[WARN] OPC UA insecure_accept_any_cert is set: server certificates are NOT verified, so secure channels and passwords are open to a man in the middle")
+	}
+	return d, nil
+}
+
+// readDER reads a PEM or DER file, returning the first PEM block's bytes
+func readDER(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		return block.Bytes, nil
+	}
+	return data, nil
+}
+
+func (d *opcuaDriver) loadCertificate() error {
+	certDER, err := readDER(d.config.CertFile)
+	if err != nil {
+		return fmt.Errorf("failed to read OPC UA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return fmt.Errorf("failed to parse OPC UA certificate: %w", err)
+	}
+	keyDER, err := readDER(d.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read OPC UA key: %w", err)
+	}
+	var key *rsa.PrivateKey
+	if k, err := x509.ParsePKCS1PrivateKey(keyDER); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(keyDER); err == nil {
+		key, _ = k.(*rsa.PrivateKey)
+	}
+	if key == nil {
+		return fmt.Errorf("failed to parse OPC UA key: expected an RSA key")
+	}
+	d.cert, d.key = certDER, key
+	if len(cert.URIs) > 0 {
+		d.appURI = cert.URIs[0].String()
+	}
+	return nil
+}
+
+func (d *opcuaDriver) loadTrusted() error {
+	entries, err := os.ReadDir(d.config.TrustedCertsDir)
+	if err != nil {
+		return fmt.Errorf("failed to read OPC UA trusted certificates: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		der, err := readDER(filepath.Join(d.config.TrustedCertsDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read OPC UA trusted certificate: %w", err)
+		}
+		d.trusted = append(d.trusted, der)
+	}
+	return nil
+}
+
+// trust checks a server certificate against the trusted certificates
+func (d *opcuaDriver) trust(endpoint string, certDER []byte) (*rsa.PublicKey, error) {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		// The server may send its chain; the leaf comes first
+		certs, chainErr := x509.ParseCertificates(certDER)
+		if chainErr != nil || len(certs) == 0 {
+			return nil, fmt.Errorf("invalid server certificate: %w", err)
+		}
+		cert = certs[0]
+	}
+	thumbprint := sha1.Sum(cert.Raw)
+	switch {
+	case d.config.TrustedCertsDir == "" && !d.config.InsecureAcceptAnyCert:
+		return nil, fmt.Errorf("server certificate %s cannot be verified without opcua trusted_certs_dir", hex.EncodeToString(thumbprint[:]))
+	case d.config.TrustedCertsDir != "":
+		trusted := false
+		for _, der := range d.trusted {
+			if bytes.Equal(der, cert.Raw) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			return nil, fmt.Errorf("server certificate %s is not in %s", hex.EncodeToString(thumbprint[:]), d.config.TrustedCertsDir)
+		}
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("server certificate has no RSA key")
+	}
+	log.Printf("[DEBUG] OPC UA server %s certificate %s", endpoint, hex.EncodeToString(thumbprint[:]))
+	return key, nil
+}
+
+// session returns the shared session of a sensor's endpoint and login
+func (d *opcuaDriver) session(sensor *SensorConfig) *uaSession {
+	policy, mode := opcuaSecurity(sensor)
+	key := strings.Join([]string{sensor.Address, policy, strconv.Itoa(int(mode)), sensor.Username}, "|")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.sessions[key]
+	if !ok {
+		s = &uaSession{
+			driver:   d,
+			endpoint: sensor.Address,
+			policy:   policy,
+			mode:     mode,
+			username: sensor.Username,
+			password: os.ExpandEnv(sensor.Password),
+		}
+		d.sessions[key] = s
+	}
+	return s
+}
+
+// read reads a sensor's node
+func (d *opcuaDriver) read(sensor *SensorConfig) (float64, string, error) {
+	start := time.Now()
+	dv, err := d.session(sensor).read(sensor.opcuaNode)
+	d.latency.observe("opcua", sensor.Address, time.Since(start), err)
+	if err != nil {
+		return 0, "", fmt.Errorf("OPC UA read error: %w", err)
+	}
+	if uaStatusBad(dv.status) {
+		return 0, "", fmt.Errorf("OPC UA read error: node %s: %w", sensor.NodeID, uaStatusError(dv.status))
+	}
+	if dv.valueErr != nil {
+		return 0, "", fmt.Errorf("OPC UA read error: node %s: %w", sensor.NodeID, dv.valueErr)
+	}
+	v := dv.value
+	switch {
+	case v.isText:
+		text := strings.TrimSpace(v.text)
+		if code, ok := lookupEnumCode(sensor.EnumMap, text); ok {
+			return code, text, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, text, nil
+		}
+		if len(sensor.EnumMap) > 0 {
+			return 0, text, fmt.Errorf("OPC UA state %q not found in enum_map", text)
+		}
+		return 0, text, nil
+	case v.isBool:
+		return v.number, v.text, nil
+	case v.text != "":
+		return v.number, v.text, nil
+	default:
+		return v.number, sensor.enumText[v.number], nil
+	}
+}
+
+func (d *opcuaDriver) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, s := range d.sessions {
+		s.mu.Lock()
+		s.disconnect()
+		s.mu.Unlock()
+	}
+}
+
+// uaSession is a session on one endpoint over its own secure channel
+type uaSession struct {
+	driver   *opcuaDriver
+	endpoint string
+	policy   string
+	mode     uint32
+	username string
+	password string
+
+	mu        sync.Mutex
+	ch        *uaChannel
+	authToken []byte
+}
+
+// read reads the Value attribute of a node, connecting first if needed. A
+// failed channel or session is dropped so the next read reconnects.
+func (s *uaSession) read(node uaNodeID) (uaDataValue, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch != nil && s.ch.expired() {
+		s.disconnect()
+	}
+	if s.ch == nil {
+		if err := s.connect(); err != nil {
+			return uaDataValue{}, err
+		}
+	}
+	d, err := s.ch.call(uaReadRequest, s.authToken, func(e *uaEncoder) {
+		e.float64(0) // max age
+		e.uint32(uaTimestampsSource)
+		e.int32(1)
+		e.nodeID(node)
+		e.uint32(uaAttributeValue)
+		e.string("") // index range
+		e.uint16(0)  // data encoding
+		e.string("")
+	})
+	if err != nil {
+		if sessionFailed(err) {
+			s.ch.conn.Close()
+			s.ch = nil
+		}
+		return uaDataValue{}, err
+	}
+	if d.arrayLength() != 1 {
+		if d.err != nil {
+			return uaDataValue{}, d.err
+		}
+		return uaDataValue{}, errors.New("read returned no result")
+	}
+	dv := d.dataValue()
+	return dv, d.err
+}
+
+// sessionFailed reports whether an error leaves the session unusable
+func sessionFailed(err error) bool {
+	var status uaStatusError
+	if !errors.As(err, &status) {
+		return true // transport or protocol error
+	}
+	switch status {
+	case uaStatusBadSessionIDInvalid, uaStatusBadSessionClosed, uaStatusBadSecureChannelIDInvalid, uaStatusBadSecureChannelClosed:
+		return true
+	}
+	return false
+}
+
+func (s *uaSession) timeout() time.Duration {
+	return time.Duration(s.driver.config.TimeoutMs) * time.Millisecond
+}
+
+// security prepares the channel security; secure policies first fetch the
+// server certificate from the endpoint's GetEndpoints service
+func (s *uaSession) security() (*uaSecurity, error) {
+	sec := &uaSecurity{policy: s.policy, mode: s.mode}
+	if !sec.secure() {
+		return sec, nil
+	}
+	sec.cert, sec.key = s.driver.cert, s.driver.key
+	ch, err := dialUAChannel(s.endpoint, &uaSecurity{policy: uaPolicyNone, mode: uaModeNone}, s.timeout())
+	if err != nil {
+		return nil, err
+	}
+	defer ch.close()
+	d, err := ch.call(uaGetEndpointsRequest, nil, func(e *uaEncoder) {
+		e.string(s.endpoint)
+		e.int32(0) // locale IDs
+		e.int32(0) // profile URIs
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetEndpoints failed: %w", err)
+	}
+	endpoints := d.endpointDescriptions()
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, ep := range endpoints {
+		if ep.securityPolicy == s.policy && ep.securityMode == s.mode {
+			key, err := s.driver.trust(s.endpoint, ep.certificate)
+			if err != nil {
+				return nil, err
+			}
+			sec.serverCert, sec.serverKey = ep.certificate, key
+			return sec, nil
+		}
+	}
+	return nil, fmt.Errorf("endpoint offers no %s endpoint with mode %d", s.policy, s.mode)
+}
+
+// connect opens the channel, creates the session and logs in
+func (s *uaSession) connect() error {
+	sec, err := s.security()
+	if err != nil {
+		return err
+	}
+	ch, err := dialUAChannel(s.endpoint, sec, s.timeout())
+	if err != nil {
+		return err
+	}
+	clientNonce := make([]byte, uaNonceLength)
+	if _, err := rand.Read(clientNonce); err != nil {
+		ch.close()
+		return err
+	}
+	d, err := ch.call(uaCreateSessionRequest, nil, func(e *uaEncoder) {
+		e.string(s.driver.appURI)
+		e.string("urn:smart-building:golang-gateway")
+		e.localizedText("smart-building gateway")
+		e.uint32(uaApplicationTypeClient)
+		e.string("") // gateway server URI
+		e.string("") // discovery profile URI
+		e.int32(0)   // discovery URLs
+		e.string("") // server URI
+		e.string(s.endpoint)
+		e.string("smart-building gateway")
+		e.byteString(clientNonce)
+		if sec.secure() {
+			e.byteString(sec.cert)
+		} else {
+			e.byteString(nil)
+		}
+		e.float64(float64(time.Hour / time.Millisecond)) // requested session timeout
+		e.uint32(0)                                      // max response message size
+	})
+	if err != nil {
+		ch.close()
+		return fmt.Errorf("CreateSession failed: %w", err)
+	}
+	d.nodeIDBytes() // session ID
+	authToken := append([]byte(nil), d.nodeIDBytes()...)
+	d.float64() // revised session timeout
+	serverNonce := append([]byte(nil), d.byteString()...)
+	serverCert := append([]byte(nil), d.byteString()...)
+	endpoints := d.endpointDescriptions()
+	if d.err != nil {
+		ch.close()
+		return d.err
+	}
+
+	token, err := s.identityToken(endpoints, serverCert, serverNonce, sec)
+	if err != nil {
+		ch.close()
+		return err
+	}
+	var signature []byte
+	if sec.secure() {
+		digest := sha256.Sum256(append(append([]byte(nil), serverCert...), serverNonce...))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, sec.key, crypto.SHA256, digest[:]); err != nil {
+			ch.close()
+			return err
+		}
+	}
+	_, err = ch.call(uaActivateSessionRequest, authToken, func(e *uaEncoder) {
+		if signature != nil {
+			e.signatureData(uaSignatureRSASHA256, signature)
+		} else {
+			e.signatureData("", nil)
+		}
+		e.int32(0) // client software certificates
+		e.int32(0) // locale IDs
+		e.b = append(e.b, token...)
+		e.signatureData("", nil)
+	})
+	if err != nil {
+		ch.close()
+		return fmt.Errorf("ActivateSession failed: %w", err)
+	}
+	s.ch, s.authToken = ch, authToken
+	user := "anonymous"
+	if s.username != "" {
+		user = s.username
+	}
+	log.Printf("OPC UA session on %s (%s, %s)", s.endpoint, strings.TrimPrefix(s.policy, "http://opcfoundation.org/UA/SecurityPolicy#"), user)
+	return nil
+}
+
+// identityToken encodes the anonymous or user name identity token for the
+// matching user token policy of the endpoint
+func (s *uaSession) identityToken(endpoints []uaEndpoint, serverCert, serverNonce []byte, sec *uaSecurity) ([]byte, error) {
+	tokenType := uint32(uaUserTokenAnonymous)
+	policy := uaUserTokenPolicy{policyID: "anonymous"}
+	if s.username != "" {
+		tokenType = uaUserTokenUserName
+		policy.policyID = "username"
+	}
+	for _, ep := range endpoints {
+		if ep.securityPolicy != s.policy || ep.securityMode != s.mode {
+			continue
+		}
+		found := false
+		for _, p := range ep.userTokens {
+			if p.tokenType == tokenType {
+				policy, found = p, true
+				break
+			}
+		}
+		if !found && s.username != "" {
+			return nil, errors.New("endpoint does not accept user name logins")
+		}
+		if !found {
+			return nil, errors.New("endpoint does not accept anonymous logins")
+		}
+		break
+	}
+
+	e := uaEncoder{}
+	if tokenType == uaUserTokenAnonymous {
+		body := uaEncoder{}
+		body.string(policy.policyID)
+		e.extensionObject(uaAnonymousIdentityToken, body.b)
+		return e.b, nil
+	}
+
+	password, algorithm := []byte(s.password), ""
+	tokenPolicy := policy.securityPolicy
+	if tokenPolicy == "" {
+		tokenPolicy = sec.policy
+	}
+	switch tokenPolicy {
+	case uaPolicyNone:
+		if !sec.secure() {
+			log.Printf("[WARN] OPC UA password for %s sent unencrypted (security policy None)", s.endpoint)
+		}
+	case uaPolicyBasic256Sha256:
+		key := sec.serverKey
+		if key == nil {
+			var err error
+			if key, err = s.driver.trust(s.endpoint, serverCert); err != nil {
+				return nil, err
+			}
+		}
+		secret := binary.LittleEndian.AppendUint32(nil, uint32(len(password)+len(serverNonce)))
+		secret = append(append(secret, password...), serverNonce...)
+		var encrypted []byte
+		plainBlock := key.Size() - 2*sha1.Size - 2
+		for i := 0; i < len(secret); i += plainBlock {
+			block, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, secret[i:min(i+plainBlock, len(secret))], nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encrypt password: %w", err)
+			}
+			encrypted = append(encrypted, block...)
+		}
+		password, algorithm = encrypted, uaEncryptionRSAOAEP
+	default:
+		return nil, fmt.Errorf("unsupported user token security policy %s", tokenPolicy)
+	}
+	body := uaEncoder{}
+	body.string(policy.policyID)
+	body.string(s.username)
+	body.byteString(password)
+	body.string(algorithm)
+	e.extensionObject(uaUserNameIdentityToken, body.b)
+	return e.b, nil
+}
+
+// disconnect closes the session and channel, ignoring errors
+func (s *uaSession) disconnect() {
+	if s.ch == nil {
+		return
+	}
+	s.ch.call(uaCloseSessionRequest, s.authToken, func(e *uaEncoder) {
+		e.bool(true) // delete subscriptions
+	})
+	s.ch.close()
+	s.ch, s.authToken = nil, nil
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// OPC UA security policies and message security modes supported by the
+// driver
+const (
+	uaPolicyNone           = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	uaPolicyBasic256Sha256 = "http://opcfoundation.org/UA/SecurityPolicy#Basic256Sha256"
+
+	uaModeNone           = 1
+	uaModeSign           = 2
+	uaModeSignAndEncrypt = 3
+
+	uaSignatureRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	uaEncryptionRSAOAEP  = "http://www.w3.org/2001/04/xmlenc#rsa-oaep"
+)
+
+// UA-TCP limits (IEC 62541-6 clause 7.1)
+const (
+	uaDefaultPort     = "4840"
+	uaBufferSize      = 65536
+	uaMaxChunkSize    = 16 << 20
+	uaChannelLifetime = time.Hour
+	uaNonceLength     = 32
+	uaSymmetricBlock  = aes.BlockSize
+	uaSymmetricKeyLen = 32
+)
+
+// uaDialAddress returns the TCP address of an opc.tcp:// endpoint URL
+func uaDialAddress(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "opc.tcp" || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid OPC UA endpoint %q: expected opc.tcp://host[:port][/path]", endpoint)
+	}
+	port := u.Port()
+	if port == "" {
+		port = uaDefaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// uaKeys are the symmetric keys of one direction of a secure channel
+type uaKeys struct {
+	sign, encrypt, iv []byte
+}
+
+// uaSecurity signs and encrypts the chunks of a secure channel. With the
+// None policy chunks pass unchanged; Basic256Sha256 secures the
+// OpenSecureChannel exchange with RSA (OAEP-SHA1 encryption, PKCS#1 v1.5
+// SHA-256 signatures) and later messages with keys derived from both nonces
+// (HMAC-SHA256, AES-256-CBC).
+type uaSecurity struct {
+	policy     string
+	mode       uint32
+	cert       []byte // client certificate (DER)
+	key        *rsa.PrivateKey
+	serverCert []byte
+	serverKey  *rsa.PublicKey
+
+	clientNonce []byte
+	send, recv  uaKeys
+}
+
+func (s *uaSecurity) secure() bool {
+	return s.policy != uaPolicyNone
+}
+
+// pSHA256 is the P_SHA256 pseudo-random function of TLS 1.2
+func pSHA256(secret, seed []byte, length int) []byte {
+	var out []byte
+	a := seed
+	for len(out) < length {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+// deriveKeys computes the symmetric keys once the server nonce is known
+func (s *uaSecurity) deriveKeys(serverNonce []byte) error {
+	if !s.secure() {
+		return nil
+	}
+	if len(serverNonce) < uaNonceLength {
+		return fmt.Errorf("server nonce of %d bytes is too short", len(serverNonce))
+	}
+	split := func(k []byte) uaKeys {
+		return uaKeys{sign: k[:uaSymmetricKeyLen], encrypt: k[uaSymmetricKeyLen : 2*uaSymmetricKeyLen], iv: k[2*uaSymmetricKeyLen:]}
+	}
+	length := 2*uaSymmetricKeyLen + uaSymmetricBlock
+	s.send = split(pSHA256(serverNonce, s.clientNonce, length))
+	s.recv = split(pSHA256(s.clientNonce, serverNonce, length))
+	return nil
+}
+
+// appendPadding pads plain so that plain, the padding and a signature of
+// sigSize fill whole blocks; every padding byte holds the padding length,
+// followed by its high byte when extra is set
+func appendPadding(plain []byte, block, sigSize int, extra bool) []byte {
+	sizeBytes := 1
+	if extra {
+		sizeBytes = 2
+	}
+	padding := block - (len(plain)+sizeBytes+sigSize)%block
+	if padding == block {
+		padding = 0
+	}
+	for i := 0; i <= padding; i++ {
+		plain = append(plain, byte(padding))
+	}
+	if extra {
+		plain = append(plain, byte(padding>>8))
+	}
+	return plain
+}
+
+// stripPadding removes the padding written by appendPadding
+func stripPadding(plain []byte, extra bool) ([]byte, error) {
+	if len(plain) == 0 {
+		return nil, errUATruncated
+	}
+	n, count := int(plain[len(plain)-1]), 1
+	if extra {
+		if len(plain) < 2 {
+			return nil, errUATruncated
+		}
+		n, count = n<<8|int(plain[len(plain)-2]), 2
+	}
+	if n+count > len(plain) {
+		return nil, errors.New("invalid OPC UA padding")
+	}
+	return plain[:len(plain)-n-count], nil
+}
+
+// encodeAsymmetric builds an OpenSecureChannel chunk around payload (the
+// sequence header and message body)
+func (s *uaSecurity) encodeAsymmetric(channelID uint32, payload []byte) ([]byte, error) {
+	h := uaEncoder{b: []byte("OPNF\x00\x00\x00\x00")}
+	h.uint32(channelID)
+	h.string(s.policy)
+	if !s.secure() {
+		h.byteString(nil)
+		h.byteString(nil)
+		chunk := append(h.b, payload...)
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(chunk)))
+		return chunk, nil
+	}
+	h.byteString(s.cert)
+	thumbprint := sha1.Sum(s.serverCert)
+	h.byteString(thumbprint[:])
+
+	cipherBlock := s.serverKey.Size()
+	plainBlock := cipherBlock - 2*sha1.Size - 2
+	sigSize := s.key.Size()
+	plain := appendPadding(append([]byte(nil), payload...), plainBlock, sigSize, cipherBlock > 256)
+	size := len(h.b) + (len(plain)+sigSize)/plainBlock*cipherBlock
+	binary.LittleEndian.PutUint32(h.b[4:], uint32(size))
+
+	digest := sha256.Sum256(append(append([]byte(nil), h.b...), plain...))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	plain = append(plain, signature...)
+	chunk := h.b
+	for i := 0; i < len(plain); i += plainBlock {
+		block, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, s.serverKey, plain[i:i+plainBlock], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt: %w", err)
+		}
+		chunk = append(chunk, block...)
+	}
+	return chunk, nil
+}
+
+// decodeAsymmetric verifies and decrypts an OpenSecureChannel response
+// chunk and returns its sequence header and body
+func (s *uaSecurity) decodeAsymmetric(chunk []byte) ([]byte, error) {
+	if len(chunk) < 12 {
+		return nil, errUATruncated
+	}
+	d := uaDecoder{b: chunk[12:]}
+	policy := d.string()
+	d.byteString() // sender certificate
+	d.byteString() // receiver thumbprint
+	if d.err != nil {
+		return nil, d.err
+	}
+	if policy != s.policy {
+		return nil, fmt.Errorf("server answered with security policy %s", policy)
+	}
+	if !s.secure() {
+		return d.b, nil
+	}
+	headerLen := len(chunk) - len(d.b)
+	keySize := s.key.Size()
+	if len(d.b) == 0 || len(d.b)%keySize != 0 {
+		return nil, errors.New("invalid OPC UA encrypted chunk length")
+	}
+	var plain []byte
+	for i := 0; i < len(d.b); i += keySize {
+		block, err := rsa.DecryptOAEP(sha1.New(), nil, s.key, d.b[i:i+keySize], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt: %w", err)
+		}
+		plain = append(plain, block...)
+	}
+	sigSize := s.serverKey.Size()
+	if len(plain) < sigSize {
+		return nil, errUATruncated
+	}
+	body, signature := plain[:len(plain)-sigSize], plain[len(plain)-sigSize:]
+	digest := sha256.Sum256(append(append([]byte(nil), chunk[:headerLen]...), body...))
+	if err := rsa.VerifyPKCS1v15(s.serverKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid server signature")
+	}
+	return stripPadding(body, keySize > 256)
+}
+
+// encodeSymmetric builds a MSG or CLO chunk around payload
+func (s *uaSecurity) encodeSymmetric(msgType string, channelID, tokenID uint32, payload []byte) []byte {
+	h := uaEncoder{b: []byte(msgType + "F\x00\x00\x00\x00")}
+	h.uint32(channelID)
+	h.uint32(tokenID)
+	if !s.secure() || s.mode == uaModeNone {
+		chunk := append(h.b, payload...)
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(chunk)))
+		return chunk
+	}
+	plain := append([]byte(nil), payload...)
+	encrypt := s.mode == uaModeSignAndEncrypt
+	if encrypt {
+		plain = appendPadding(plain, uaSymmetricBlock, sha256.Size, false)
+	}
+	binary.LittleEndian.PutUint32(h.b[4:], uint32(len(h.b)+len(plain)+sha256.Size))
+	mac := hmac.New(sha256.New, s.send.sign)
+	mac.Write(h.b)
+	mac.Write(plain)
+	data := mac.Sum(plain)
+	if encrypt {
+		block, _ := aes.NewCipher(s.send.encrypt)
+		cipher.NewCBCEncrypter(block, s.send.iv).CryptBlocks(data, data)
+	}
+	return append(h.b, data...)
+}
+
+// decodeSymmetric verifies and decrypts a MSG chunk and returns its sequence
+// header and body
+func (s *uaSecurity) decodeSymmetric(chunk []byte) ([]byte, error) {
+	if len(chunk) < 16 {
+		return nil, errUATruncated
+	}
+	if !s.secure() || s.mode == uaModeNone {
+		return chunk[16:], nil
+	}
+	data := append([]byte(nil), chunk[16:]...)
+	encrypt := s.mode == uaModeSignAndEncrypt
+	if encrypt {
+		if len(data) == 0 || len(data)%uaSymmetricBlock != 0 {
+			return nil, errors.New("invalid OPC UA encrypted chunk length")
+		}
+		block, _ := aes.NewCipher(s.recv.encrypt)
+		cipher.NewCBCDecrypter(block, s.recv.iv).CryptBlocks(data, data)
+	}
+	if len(data) < sha256.Size {
+		return nil, errUATruncated
+	}
+	body, signature := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	mac := hmac.New(sha256.New, s.recv.sign)
+	mac.Write(chunk[:16])
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, errors.New("invalid server signature")
+	}
+	if encrypt {
+		return stripPadding(body, false)
+	}
+	return body, nil
+}
+
+// uaChannel is a UA-TCP connection carrying one secure channel. Requests
+// are sent one at a time.
+type uaChannel struct {
+	conn      net.Conn
+	endpoint  string
+	timeout   time.Duration
+	sec       *uaSecurity
+	channelID uint32
+	tokenID   uint32
+	sequence  uint32
+	requestID uint32
+	sendLimit int
+	renewAt   time.Time
+}
+
+// dialUAChannel connects to an endpoint and opens a secure channel
+func dialUAChannel(endpoint string, sec *uaSecurity, timeout time.Duration) (*uaChannel, error) {
+	address, err := uaDialAddress(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &uaChannel{conn: conn, endpoint: endpoint, timeout: timeout, sec: sec}
+	if err := c.hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.open(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open secure channel: %w", err)
+	}
+	return c, nil
+}
+
+// hello exchanges the UA-TCP Hello and Acknowledge messages
+func (c *uaChannel) hello() error {
+	e := uaEncoder{b: []byte("HELF\x00\x00\x00\x00")}
+	e.uint32(0) // protocol version
+	e.uint32(uaBufferSize)
+	e.uint32(uaBufferSize)
+	e.uint32(0) // max message size
+	e.uint32(0) // max chunk count
+	e.string(c.endpoint)
+	binary.LittleEndian.PutUint32(e.b[4:], uint32(len(e.b)))
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(e.b); err != nil {
+		return err
+	}
+	chunk, err := c.readChunk()
+	if err != nil {
+		return err
+	}
+	if string(chunk[:4]) != "ACKF" {
+		return fmt.Errorf("unexpected %q message instead of Acknowledge", chunk[:3])
+	}
+	d := uaDecoder{b: chunk[8:]}
+	d.uint32() // protocol version
+	// The server's receive buffer limits the chunks it accepts
+	c.sendLimit = int(d.uint32())
+	return d.err
+}
+
+// readChunk reads one message chunk, turning Error messages into errors
+func (c *uaChannel) readChunk() ([]byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header[4:]))
+	if size < 8 || size > uaMaxChunkSize {
+		return nil, fmt.Errorf("invalid OPC UA chunk size %d", size)
+	}
+	chunk := make([]byte, size)
+	copy(chunk, header)
+	if _, err := io.ReadFull(c.conn, chunk[8:]); err != nil {
+		return nil, err
+	}
+	if string(chunk[:3]) == "ERR" {
+		d := uaDecoder{b: chunk[8:]}
+		code := d.uint32()
+		reason := d.string()
+		return nil, fmt.Errorf("server error %v: %s", uaStatusError(code), reason)
+	}
+	return chunk, nil
+}
+
+func (c *uaChannel) nextSequence() (uint32, uint32) {
+	c.sequence++
+	c.requestID++
+	return c.sequence, c.requestID
+}
+
+// requestHeader writes a request header with the session's authentication
+// token (nil before a session exists)
+func (c *uaChannel) requestHeader(e *uaEncoder, authToken []byte, handle uint32) {
+	if authToken == nil {
+		e.nodeID(uaNumericNodeID(0))
+	} else {
+		e.b = append(e.b, authToken...)
+	}
+	e.dateTime(time.Now())
+	e.uint32(handle)
+	e.uint32(0) // return diagnostics
+	e.string("")
+	e.uint32(uint32(c.timeout / time.Millisecond))
+	e.emptyExtensionObject()
+}
+
+// open issues a secure channel token
+func (c *uaChannel) open() error {
+	if c.sec.secure() {
+		c.sec.clientNonce = make([]byte, uaNonceLength)
+		if _, err := rand.Read(c.sec.clientNonce); err != nil {
+			return err
+		}
+	}
+	sequence, requestID := c.nextSequence()
+	e := uaEncoder{}
+	e.uint32(sequence)
+	e.uint32(requestID)
+	e.nodeID(uaNumericNodeID(uaOpenSecureChannelRequest))
+	c.requestHeader(&e, nil, requestID)
+	e.uint32(0) // client protocol version
+	e.uint32(0) // issue
+	e.uint32(c.sec.mode)
+	e.byteString(c.sec.clientNonce)
+	e.uint32(uint32(uaChannelLifetime / time.Millisecond))
+	chunk, err := c.sec.encodeAsymmetric(0, e.b)
+	if err != nil {
+		return err
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(chunk); err != nil {
+		return err
+	}
+	if chunk, err = c.readChunk(); err != nil {
+		return err
+	}
+	if string(chunk[:4]) != "OPNF" {
+		return fmt.Errorf("unexpected %q message instead of OpenSecureChannel response", chunk[:3])
+	}
+	payload, err := c.sec.decodeAsymmetric(chunk)
+	if err != nil {
+		return err
+	}
+	d := &uaDecoder{b: payload}
+	d.uint32() // sequence number
+	d.uint32() // request ID
+	if err := checkUAResponse(d, uaOpenSecureChannelResponse); err != nil {
+		return err
+	}
+	d.uint32() // server protocol version
+	c.channelID = d.uint32()
+	c.tokenID = d.uint32()
+	d.dateTime()
+	lifetime := time.Duration(d.uint32()) * time.Millisecond
+	serverNonce := d.byteString()
+	if d.err != nil {
+		return d.err
+	}
+	// Reconnect at three quarters of the token lifetime rather than renew
+	c.renewAt = time.Now().Add(lifetime * 3 / 4)
+	return c.sec.deriveKeys(serverNonce)
+}
+
+// expired reports whether the channel's token is due for renewal
+func (c *uaChannel) expired() bool {
+	return time.Now().After(c.renewAt)
+}
+
+// checkUAResponse reads the type ID and response header of a service
+// response, turning service faults and bad results into errors
+func checkUAResponse(d *uaDecoder, expected uint32) error {
+	typeID := d.numericNodeID()
+	result := d.responseHeader()
+	if d.err != nil {
+		return d.err
+	}
+	if uaStatusBad(result) {
+		return uaStatusError(result)
+	}
+	if typeID != expected {
+		if typeID == uaServiceFault {
+			return errors.New("service fault")
+		}
+		return fmt.Errorf("unexpected response type %d", typeID)
+	}
+	return nil
+}
+
+// call sends a service request and returns the decoder positioned after the
+// response header
+func (c *uaChannel) call(requestType uint32, authToken []byte, body func(*uaEncoder)) (*uaDecoder, error) {
+	sequence, requestID := c.nextSequence()
+	e := uaEncoder{}
+	e.uint32(sequence)
+	e.uint32(requestID)
+	e.nodeID(uaNumericNodeID(requestType))
+	c.requestHeader(&e, authToken, requestID)
+	body(&e)
+	chunk := c.sec.encodeSymmetric("MSG", c.channelID, c.tokenID, e.b)
+	if len(chunk) > c.sendLimit {
+		return nil, fmt.Errorf("request of %d bytes exceeds the server's buffer", len(chunk))
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(chunk); err != nil {
+		return nil, err
+	}
+	payload, err := c.receive(requestID)
+	if err != nil {
+		return nil, err
+	}
+	d := &uaDecoder{b: payload}
+	if err := checkUAResponse(d, requestType+3); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// receive reassembles the response to a request from its chunks; chunks of
+// earlier requests that timed out are skipped
+func (c *uaChannel) receive(requestID uint32) ([]byte, error) {
+	var body []byte
+	for {
+		chunk, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+		if string(chunk[:3]) != "MSG" {
+			return nil, fmt.Errorf("unexpected %q message", chunk[:3])
+		}
+		payload, err := c.sec.decodeSymmetric(chunk)
+		if err != nil {
+			return nil, err
+		}
+		d := uaDecoder{b: payload}
+		d.uint32() // sequence number
+		id := d.uint32()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if id != requestID {
+			continue
+		}
+		switch chunk[3] {
+		case 'A':
+			code := d.uint32()
+			return nil, fmt.Errorf("response aborted: %v: %s", uaStatusError(code), d.string())
+		case 'C':
+			body = append(body, d.b...)
+		default:
+			return append(body, d.b...), nil
+		}
+	}
+}
+
+// close closes the secure channel and the connection
+func (c *uaChannel) close() {
+	sequence, requestID := c.nextSequence()
+	e := uaEncoder{}
+	e.uint32(sequence)
+	e.uint32(requestID)
+	e.nodeID(uaNumericNodeID(uaCloseSecureChannelRequest))
+	c.requestHeader(&e, nil, requestID)
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.conn.Write(c.sec.encodeSymmetric("CLO", c.channelID, c.tokenID, e.b))
+	c.conn.Close()
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OPC UA binary encoding (IEC 62541-6 clause 5.2): little-endian integers,
+// strings and byte strings prefixed by an int32 length (-1 for null)
+
+// Type IDs of the binary encodings of the services and structures used by
+// the driver; responses are their request's ID plus 3
+const (
+	uaServiceFault              = 397
+	uaGetEndpointsRequest       = 428
+	uaOpenSecureChannelRequest  = 446
+	uaOpenSecureChannelResponse = 449
+	uaCloseSecureChannelRequest = 452
+	uaCreateSessionRequest      = 461
+	uaActivateSessionRequest    = 467
+	uaCloseSessionRequest       = 473
+	uaReadRequest               = 631
+	uaAnonymousIdentityToken    = 321
+	uaUserNameIdentityToken     = 324
+)
+
+const (
+	uaAttributeValue        = 13
+	uaTimestampsSource      = 0
+	uaApplicationTypeClient = 1
+	uaUserTokenAnonymous    = 0
+	uaUserTokenUserName     = 1
+	uaMaxArrayLength        = 1 << 16
+	// 100 ns intervals from 1601-01-01, the DateTime epoch, to 1970-01-01
+	uaDateTimeEpochOffset = 116444736000000000
+)
+
+// Status code severities and the codes that invalidate a session
+const (
+	uaStatusSeverityMask              = 0xC0000000
+	uaStatusSeverityBad               = 0x80000000
+	uaStatusBadSecureChannelIDInvalid = 0x80220000
+	uaStatusBadSessionIDInvalid       = 0x80250000
+	uaStatusBadSessionClosed          = 0x80260000
+	uaStatusBadSecureChannelClosed    = 0x80860000
+)
+
+// uaStatusNames names the status codes a gateway operator is likely to see
+var uaStatusNames = map[uint32]string{
+	0x800A0000: "BadTimeout",
+	0x80130000: "BadSecurityChecksFailed",
+	0x801A0000: "BadCertificateUntrusted",
+	0x801F0000: "BadUserAccessDenied",
+	0x80200000: "BadIdentityTokenInvalid",
+	0x80210000: "BadIdentityTokenRejected",
+	0x80220000: "BadSecureChannelIdInvalid",
+	0x80250000: "BadSessionIdInvalid",
+	0x80260000: "BadSessionClosed",
+	0x80310000: "BadNoCommunication",
+	0x80320000: "BadWaitingForInitialData",
+	0x80330000: "BadNodeIdInvalid",
+	0x80340000: "BadNodeIdUnknown",
+	0x80350000: "BadAttributeIdInvalid",
+	0x803A0000: "BadNotReadable",
+	0x80550000: "BadSecurityPolicyRejected",
+	0x80560000: "BadTooManySessions",
+	0x80860000: "BadSecureChannelClosed",
+}
+
+// uaStatusError is a bad service result or value status
+type uaStatusError uint32
+
+func (e uaStatusError) Error() string {
+	if name, ok := uaStatusNames[uint32(e)]; ok {
+		return fmt.Sprintf("%s (0x%08X)", name, uint32(e))
+	}
+	return fmt.Sprintf("status 0x%08X", uint32(e))
+}
+
+func uaStatusBad(code uint32) bool {
+	return code&uaStatusSeverityMask == uaStatusSeverityBad
+}
+
+// uaNodeID is a parsed node ID: numeric (i=), string (s=), GUID (g=) or
+// opaque (b=)
+type uaNodeID struct {
+	ns      uint16
+	kind    byte
+	numeric uint32
+	str     string
+	bytes   []byte // GUID in its binary encoding, or the opaque value
+}
+
+// parseUANodeID parses the standard string form, e.g. ns=2;s=AHU1.SAT or
+// i=2258
+func parseUANodeID(s string) (uaNodeID, error) {
+	var id uaNodeID
+	rest := strings.TrimSpace(s)
+	if ns, ok := strings.CutPrefix(rest, "ns="); ok {
+		idx, tail, found := strings.Cut(ns, ";")
+		n, err := strconv.ParseUint(idx, 10, 16)
+		if !found || err != nil {
+			return id, fmt.Errorf("invalid node ID %q: bad namespace index", s)
+		}
+		id.ns, rest = uint16(n), tail
+	}
+	if len(rest) < 2 || rest[1] != '=' {
+		return id, fmt.Errorf("invalid node ID %q: expected [ns=<n>;]i=, s=, g= or b=", s)
+	}
+	id.kind = rest[0]
+	value := rest[2:]
+	switch id.kind {
+	case 'i':
+		n, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return id, fmt.Errorf("invalid node ID %q: bad numeric identifier", s)
+		}
+		id.numeric = uint32(n)
+	case 's':
+		if value == "" {
+			return id, fmt.Errorf("invalid node ID %q: empty string identifier", s)
+		}
+		id.str = value
+	case 'g':
+		raw, err := hex.DecodeString(strings.ReplaceAll(value, "-", ""))
+		if err != nil || len(raw) != 16 {
+			return id, fmt.Errorf("invalid node ID %q: bad GUID", s)
+		}
+		// Data1-3 are little-endian in the binary encoding
+		id.bytes = []byte{raw[3], raw[2], raw[1], raw[0], raw[5], raw[4], raw[7], raw[6]}
+		id.bytes = append(id.bytes, raw[8:]...)
+	case 'b':
+		raw, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return id, fmt.Errorf("invalid node ID %q: bad base64 identifier", s)
+		}
+		id.bytes = raw
+	default:
+		return id, fmt.Errorf("invalid node ID %q: expected [ns=<n>;]i=, s=, g= or b=", s)
+	}
+	return id, nil
+}
+
+func uaNumericNodeID(id uint32) uaNodeID {
+	return uaNodeID{kind: 'i', numeric: id}
+}
+
+// uaEncoder appends binary encoded values
+type uaEncoder struct {
+	b []byte
+}
+
+func (e *uaEncoder) byte(v byte)     { e.b = append(e.b, v) }
+func (e *uaEncoder) uint16(v uint16) { e.b = binary.LittleEndian.AppendUint16(e.b, v) }
+func (e *uaEncoder) uint32(v uint32) { e.b = binary.LittleEndian.AppendUint32(e.b, v) }
+func (e *uaEncoder) int32(v int32)   { e.uint32(uint32(v)) }
+func (e *uaEncoder) int64(v int64)   { e.b = binary.LittleEndian.AppendUint64(e.b, uint64(v)) }
+func (e *uaEncoder) float64(v float64) {
+	e.b = binary.LittleEndian.AppendUint64(e.b, math.Float64bits(v))
+}
+
+func (e *uaEncoder) bool(v bool) {
+	if v {
+		e.byte(1)
+	} else {
+		e.byte(0)
+	}
+}
+
+// string encodes "" as a null string
+func (e *uaEncoder) string(s string) {
+	if s == "" {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// byteString encodes nil as a null byte string
+func (e *uaEncoder) byteString(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *uaEncoder) stringArray(values []string) {
+	e.int32(int32(len(values)))
+	for _, s := range values {
+		e.string(s)
+	}
+}
+
+func (e *uaEncoder) dateTime(t time.Time) {
+	if t.IsZero() {
+		e.int64(0)
+		return
+	}
+	e.int64(t.UnixNano()/100 + uaDateTimeEpochOffset)
+}
+
+func (e *uaEncoder) nodeID(id uaNodeID) {
+	switch {
+	case id.kind == 'i' && id.ns == 0 && id.numeric <= 0xFF:
+		e.byte(0x00)
+		e.byte(byte(id.numeric))
+	case id.kind == 'i' && id.ns <= 0xFF && id.numeric <= 0xFFFF:
+		e.byte(0x01)
+		e.byte(byte(id.ns))
+		e.uint16(uint16(id.numeric))
+	case id.kind == 'i':
+		e.byte(0x02)
+		e.uint16(id.ns)
+		e.uint32(id.numeric)
+	case id.kind == 's':
+		e.byte(0x03)
+		e.uint16(id.ns)
+		e.string(id.str)
+	case id.kind == 'g':
+		e.byte(0x04)
+		e.uint16(id.ns)
+		e.b = append(e.b, id.bytes...)
+	default:
+		e.byte(0x05)
+		e.uint16(id.ns)
+		e.byteString(id.bytes)
+	}
+}
+
+func (e *uaEncoder) localizedText(text string) {
+	if text == "" {
+		e.byte(0)
+		return
+	}
+	e.byte(0x02)
+	e.string(text)
+}
+
+// extensionObject encodes a structure as a byte string body
+func (e *uaEncoder) extensionObject(typeID uint32, body []byte) {
+	e.nodeID(uaNumericNodeID(typeID))
+	e.byte(0x01)
+	e.byteString(body)
+}
+
+// emptyExtensionObject encodes an extension object without body
+func (e *uaEncoder) emptyExtensionObject() {
+	e.nodeID(uaNumericNodeID(0))
+	e.byte(0x00)
+}
+
+// signatureData encodes a SignatureData structure
+func (e *uaEncoder) signatureData(algorithm string, signature []byte) {
+	e.string(algorithm)
+	e.byteString(signature)
+}
+
+var errUATruncated = errors.New("truncated OPC UA message")
+
+// uaDecoder reads binary encoded values; the first error sticks and later
+// reads return zero values
+type uaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *uaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errUATruncated
+		d.b = nil
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *uaDecoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *uaDecoder) bool() bool { return d.byte() != 0 }
+
+func (d *uaDecoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) int32() int32 { return int32(d.uint32()) }
+
+func (d *uaDecoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *uaDecoder) float64() float64 { return math.Float64frombits(d.uint64()) }
+
+func (d *uaDecoder) byteString() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func (d *uaDecoder) string() string { return string(d.byteString()) }
+
+func (d *uaDecoder) dateTime() time.Time {
+	v := int64(d.uint64())
+	if v <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, (v-uaDateTimeEpochOffset)*100)
+}
+
+// arrayLength reads an array length; null arrays have length 0
+func (d *uaDecoder) arrayLength() int {
+	n := d.int32()
+	if n > uaMaxArrayLength {
+		d.err = fmt.Errorf("OPC UA array of %d elements too long", n)
+		return 0
+	}
+	if n < 0 || d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *uaDecoder) stringArray() []string {
+	values := make([]string, d.arrayLength())
+	for i := range values {
+		values[i] = d.string()
+	}
+	return values
+}
+
+// nodeIDBytes returns the encoded form of a node ID, for tokens echoed back
+// unchanged
+func (d *uaDecoder) nodeIDBytes() []byte {
+	start := d.b
+	d.skipNodeID(d.byte())
+	if d.err != nil {
+		return nil
+	}
+	return start[:len(start)-len(d.b)]
+}
+
+func (d *uaDecoder) skipNodeID(encoding byte) {
+	switch encoding & 0x0F {
+	case 0x00:
+		d.take(1)
+	case 0x01:
+		d.take(3)
+	case 0x02:
+		d.take(6)
+	case 0x03, 0x05:
+		d.take(2)
+		d.byteString()
+	case 0x04:
+		d.take(18)
+	default:
+		d.err = fmt.Errorf("invalid OPC UA node ID encoding 0x%02X", encoding)
+	}
+}
+
+// numericNodeID reads a node ID and returns its identifier when numeric
+func (d *uaDecoder) numericNodeID() uint32 {
+	encoding := d.byte()
+	switch encoding & 0x0F {
+	case 0x00:
+		return uint32(d.byte())
+	case 0x01:
+		d.byte()
+		return uint32(d.uint16())
+	case 0x02:
+		d.uint16()
+		return d.uint32()
+	}
+	d.skipNodeID(encoding)
+	return 0
+}
+
+// expandedNodeID skips an expanded node ID
+func (d *uaDecoder) expandedNodeID() {
+	encoding := d.byte()
+	d.skipNodeID(encoding)
+	if encoding&0x80 != 0 {
+		d.string() // namespace URI
+	}
+	if encoding&0x40 != 0 {
+		d.uint32() // server index
+	}
+}
+
+func (d *uaDecoder) localizedText() string {
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		d.string() // locale
+	}
+	if mask&0x02 != 0 {
+		return d.string()
+	}
+	return ""
+}
+
+func (d *uaDecoder) qualifiedName() string {
+	d.uint16()
+	return d.string()
+}
+
+func (d *uaDecoder) diagnosticInfo() {
+	mask := d.byte()
+	for _, bit := range []byte{0x01, 0x02, 0x08, 0x04} { // symbolic ID, namespace, locale, localized text
+		if mask&bit != 0 {
+			d.int32()
+		}
+	}
+	if mask&0x10 != 0 {
+		d.string()
+	}
+	if mask&0x20 != 0 {
+		d.uint32()
+	}
+	if mask&0x40 != 0 {
+		d.diagnosticInfo()
+	}
+}
+
+// extensionObject returns the type ID and body of an extension object
+func (d *uaDecoder) extensionObject() (uint32, []byte) {
+	typeID := d.numericNodeID()
+	switch d.byte() {
+	case 0x00:
+		return typeID, nil
+	case 0x01, 0x02:
+		return typeID, d.byteString()
+	default:
+		d.err = errors.New("invalid OPC UA extension object encoding")
+		return 0, nil
+	}
+}
+
+// responseHeader reads a response header and returns its service result
+func (d *uaDecoder) responseHeader() uint32 {
+	d.dateTime()
+	d.uint32() // request handle
+	result := d.uint32()
+	d.diagnosticInfo()
+	d.stringArray()
+	d.extensionObject()
+	return result
+}
+
+// uaApplication is the part of an ApplicationDescription the driver uses
+type uaApplication struct {
+	uri string
+}
+
+func (d *uaDecoder) applicationDescription() uaApplication {
+	app := uaApplication{uri: d.string()}
+	d.string() // product URI
+	d.localizedText()
+	d.uint32() // application type
+	d.string() // gateway server URI
+	d.string() // discovery profile URI
+	d.stringArray()
+	return app
+}
+
+// uaUserTokenPolicy is a UserTokenPolicy of an endpoint
+type uaUserTokenPolicy struct {
+	policyID       string
+	tokenType      uint32
+	securityPolicy string
+}
+
+// uaEndpoint is an EndpointDescription
+type uaEndpoint struct {
+	url            string
+	server         uaApplication
+	certificate    []byte
+	securityMode   uint32
+	securityPolicy string
+	userTokens     []uaUserTokenPolicy
+}
+
+func (d *uaDecoder) endpointDescription() uaEndpoint {
+	ep := uaEndpoint{url: d.string()}
+	ep.server = d.applicationDescription()
+	ep.certificate = d.byteString()
+	ep.securityMode = d.uint32()
+	ep.securityPolicy = d.string()
+	ep.userTokens = make([]uaUserTokenPolicy, d.arrayLength())
+	for i := range ep.userTokens {
+		ep.userTokens[i] = uaUserTokenPolicy{policyID: d.string(), tokenType: d.uint32()}
+		d.string() // issued token type
+		d.string() // issuer endpoint URL
+		ep.userTokens[i].securityPolicy = d.string()
+	}
+	d.string() // transport profile URI
+	d.byte()   // security level
+	return ep
+}
+
+func (d *uaDecoder) endpointDescriptions() []uaEndpoint {
+	endpoints := make([]uaEndpoint, d.arrayLength())
+	for i := range endpoints {
+		endpoints[i] = d.endpointDescription()
+	}
+	return endpoints
+}
+
+// uaValue is a decoded scalar variant: a number, a bool, or text
+type uaValue struct {
+	number  float64
+	text    string
+	isBool  bool
+	isText  bool
+	numeric bool
+}
+
+// variant reads a variant; arrays and structured values are rejected after
+// being skipped so the rest of the message stays readable
+func (d *uaDecoder) variant() (uaValue, error) {
+	mask := d.byte()
+	typ := mask & 0x3F
+	if mask&0x80 != 0 {
+		n := d.arrayLength()
+		for i := 0; i < n && d.err == nil; i++ {
+			d.variantValue(typ)
+		}
+		if mask&0x40 != 0 {
+			for i, dims := 0, d.arrayLength(); i < dims; i++ {
+				d.int32()
+			}
+		}
+		return uaValue{}, fmt.Errorf("array values are not supported")
+	}
+	return d.variantValue(typ)
+}
+
+func (d *uaDecoder) variantValue(typ byte) (uaValue, error) {
+	number := func(v float64) (uaValue, error) { return uaValue{number: v, numeric: true}, nil }
+	switch typ {
+	case 0:
+		return uaValue{}, fmt.Errorf("node has no value")
+	case 1:
+		v := d.bool()
+		value := uaValue{isBool: true, text: "false"}
+		if v {
+			value.number, value.text = 1, "true"
+		}
+		return value, nil
+	case 2:
+		return number(float64(int8(d.byte())))
+	case 3:
+		return number(float64(d.byte()))
+	case 4:
+		return number(float64(int16(d.uint16())))
+	case 5:
+		return number(float64(d.uint16()))
+	case 6:
+		return number(float64(d.int32()))
+	case 7, 19: // UInt32, StatusCode
+		return number(float64(d.uint32()))
+	case 8:
+		return number(float64(int64(d.uint64())))
+	case 9:
+		return number(float64(d.uint64()))
+	case 10:
+		return number(float64(math.Float32frombits(d.uint32())))
+	case 11:
+		return number(d.float64())
+	case 12:
+		return uaValue{text: d.string(), isText: true}, nil
+	case 13:
+		t := d.dateTime()
+		return uaValue{number: float64(t.Unix()), text: t.UTC().Format(time.RFC3339), numeric: true}, nil
+	case 20:
+		return uaValue{text: d.qualifiedName(), isText: true}, nil
+	case 21:
+		return uaValue{text: d.localizedText(), isText: true}, nil
+	case 14:
+		d.take(16)
+	case 15, 16:
+		d.byteString()
+	case 17:
+		d.skipNodeID(d.byte())
+	case 18:
+		d.expandedNodeID()
+	case 22:
+		d.extensionObject()
+	case 23:
+		d.dataValue()
+	case 24:
+		d.variant()
+	case 25:
+		d.diagnosticInfo()
+	default:
+		d.err = fmt.Errorf("invalid OPC UA variant type %d", typ)
+		return uaValue{}, d.err
+	}
+	return uaValue{}, fmt.Errorf("unsupported OPC UA value type %d", typ)
+}
+
+// uaDataValue is a decoded DataValue
+type uaDataValue struct {
+	value     uaValue
+	valueErr  error
+	status    uint32
+	timestamp time.Time
+}
+
+func (d *uaDecoder) dataValue() uaDataValue {
+	var dv uaDataValue
+	mask := d.byte()
+	if mask&0x01 != 0 {
+		dv.value, dv.valueErr = d.variant()
+	} else {
+		dv.valueErr = fmt.Errorf("node returned no value")
+	}
+	if mask&0x02 != 0 {
+		dv.status = d.uint32()
+	}
+	if mask&0x04 != 0 {
+		dv.timestamp = d.dateTime()
+	}
+	if mask&0x08 != 0 {
+		d.dateTime()
+	}
+	if mask&0x10 != 0 {
+		d.uint16()
+	}
+	if mask&0x20 != 0 {
+		d.uint16()
+	}
+	return dv
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testCertificate(t *testing.T, key *rsa.PrivateKey, serial int64) []byte {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "opcua-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// uaChannelPair returns the client and server ends of a secure channel with
+// derived symmetric keys
+func uaChannelPair(t *testing.T, mode uint32) (client, server *uaSecurity) {
+	t.Helper()
+	client = &uaSecurity{policy: uaPolicyBasic256Sha256, mode: mode, clientNonce: bytes.Repeat([]byte{1}, uaNonceLength)}
+	server = &uaSecurity{policy: uaPolicyBasic256Sha256, mode: mode, clientNonce: bytes.Repeat([]byte{2}, uaNonceLength)}
+	if err := client.deriveKeys(server.clientNonce); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.deriveKeys(client.clientNonce); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestPSHA256(t *testing.T) {
+	a := pSHA256([]byte("secret"), []byte("seed"), 80)
+	if len(a) != 80 {
+		t.Fatalf("len = %d, want 80", len(a))
+	}
+	if b := pSHA256([]byte("secret"), []byte("seed"), 32); !bytes.Equal(a[:32], b) {
+		t.Fatal("shorter output is not a prefix of the longer one")
+	}
+	if b := pSHA256([]byte("other"), []byte("seed"), 80); bytes.Equal(a, b) {
+		t.Fatal("output does not depend on the secret")
+	}
+}
+
+func TestUADeriveKeys(t *testing.T) {
+	client, server := uaChannelPair(t, uaModeSignAndEncrypt)
+	if !bytes.Equal(client.send.sign, server.recv.sign) || !bytes.Equal(client.send.encrypt, server.recv.encrypt) || !bytes.Equal(client.send.iv, server.recv.iv) {
+		t.Fatal("client send keys differ from server receive keys")
+	}
+	if bytes.Equal(client.send.sign, client.recv.sign) {
+		t.Fatal("both directions share a signing key")
+	}
+	if len(client.send.encrypt) != uaSymmetricKeyLen || len(client.send.iv) != uaSymmetricBlock {
+		t.Fatalf("key lengths %d/%d", len(client.send.encrypt), len(client.send.iv))
+	}
+	if err := client.deriveKeys(make([]byte, uaNonceLength-1)); err == nil {
+		t.Fatal("short server nonce accepted")
+	}
+}
+
+func TestUAPadding(t *testing.T) {
+	for _, extra := range []bool{false, true} {
+		for n := 0; n < 40; n++ {
+			plain := bytes.Repeat([]byte{0xaa}, n)
+			padded := appendPadding(append([]byte(nil), plain...), 16, 32, extra)
+			if (len(padded)+32)%16 != 0 {
+				t.Fatalf("extra=%v n=%d: padded length %d does not fill blocks", extra, n, len(padded))
+			}
+			got, err := stripPadding(padded, extra)
+			if err != nil || !bytes.Equal(got, plain) {
+				t.Fatalf("extra=%v n=%d: stripPadding = %v, %v", extra, n, got, err)
+			}
+		}
+	}
+	if _, err := stripPadding([]byte{1, 2, 9}, false); err == nil {
+		t.Fatal("padding longer than the message accepted")
+	}
+	if _, err := stripPadding(nil, false); err == nil {
+		t.Fatal("empty message accepted")
+	}
+}
+
+func TestUASymmetric(t *testing.T) {
+	payload := []byte("sequence header and ReadRequest body")
+	for _, mode := range []uint32{uaModeSign, uaModeSignAndEncrypt} {
+		client, server := uaChannelPair(t, mode)
+		chunk := client.encodeSymmetric("MSG", 7, 1, payload)
+		if got := int(chunk[4]) | int(chunk[5])<<8; got != len(chunk) {
+			t.Fatalf("mode %d: chunk size field %d, want %d", mode, got, len(chunk))
+		}
+		if encrypted := !bytes.Contains(chunk, payload); encrypted != (mode == uaModeSignAndEncrypt) {
+			t.Fatalf("mode %d: payload encrypted = %v", mode, encrypted)
+		}
+		got, err := server.decodeSymmetric(chunk)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatalf("mode %d: decodeSymmetric = %q, %v", mode, got, err)
+		}
+
+		// A flipped bit in the header or body fails the signature
+		for _, i := range []int{9, 20, len(chunk) - 1} {
+			tampered := append([]byte(nil), chunk...)
+			tampered[i] ^= 1
+			if _, err := server.decodeSymmetric(tampered); err == nil {
+				t.Fatalf("mode %d: chunk tampered at byte %d accepted", mode, i)
+			}
+		}
+		// Messages are not accepted in the direction they were sent
+		if _, err := client.decodeSymmetric(chunk); err == nil {
+			t.Fatalf("mode %d: reflected chunk accepted", mode)
+		}
+	}
+}
+
+func TestUASymmetricNone(t *testing.T) {
+	sec := &uaSecurity{policy: uaPolicyNone, mode: uaModeNone}
+	chunk := sec.encodeSymmetric("MSG", 7, 1, []byte("body"))
+	if got, err := sec.decodeSymmetric(chunk); err != nil || string(got) != "body" {
+		t.Fatalf("decodeSymmetric = %q, %v", got, err)
+	}
+}
+
+func TestUAAsymmetric(t *testing.T) {
+	clientKey, serverKey := testRSAKey(t), testRSAKey(t)
+	clientCert, serverCert := testCertificate(t, clientKey, 1), testCertificate(t, serverKey, 2)
+	client := &uaSecurity{
+		policy: uaPolicyBasic256Sha256, mode: uaModeSignAndEncrypt,
+		cert: clientCert, key: clientKey, serverCert: serverCert, serverKey: &serverKey.PublicKey,
+	}
+	// The server's view of the same channel
+	server := &uaSecurity{
+		policy: uaPolicyBasic256Sha256, mode: uaModeSignAndEncrypt,
+		cert: serverCert, key: serverKey, serverCert: clientCert, serverKey: &clientKey.PublicKey,
+	}
+
+	payload := bytes.Repeat([]byte("OpenSecureChannelRequest"), 20)
+	chunk, err := client.encodeAsymmetric(0, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16; got != len(chunk) {
+		t.Fatalf("chunk size field %d, want %d", got, len(chunk))
+	}
+	if bytes.Contains(chunk, payload[:24]) {
+		t.Fatal("payload sent in the clear")
+	}
+	got, err := server.decodeAsymmetric(chunk)
+	if err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("decodeAsymmetric = %d bytes, %v", len(got), err)
+	}
+
+	tampered := append([]byte(nil), chunk...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := server.decodeAsymmetric(tampered); err == nil {
+		t.Fatal("tampered chunk accepted")
+	}
+
+	// A chunk signed by another key fails verification
+	impostor := *client
+	impostor.key = testRSAKey(t)
+	forged, err := impostor.encodeAsymmetric(0, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.decodeAsymmetric(forged); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("forged chunk: %v", err)
+	}
+
+	none := &uaSecurity{policy: uaPolicyNone, mode: uaModeNone}
+	plain, err := none.encodeAsymmetric(0, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.decodeAsymmetric(plain); err == nil || !strings.Contains(err.Error(), "security policy") {
+		t.Fatalf("downgraded chunk: %v", err)
+	}
+}
+
+func TestOPCUATrust(t *testing.T) {
+	// Two certificates for the same key: only the trusted one is accepted
+	key := testRSAKey(t)
+	cert, other := testCertificate(t, key, 1), testCertificate(t, key, 2)
+
+	tests := []struct {
+		name   string
+		config OPCUAConfig
+		cert   []byte
+		ok     bool
+	}{
+		{"trusted", OPCUAConfig{TrustedCertsDir: "pki/trusted"}, cert, true},
+		{"not trusted", OPCUAConfig{TrustedCertsDir: "pki/trusted"}, other, false},
+		{"no trust store", OPCUAConfig{}, cert, false},
+		{"insecure accept", OPCUAConfig{InsecureAcceptAnyCert: true}, other, true},
+		{"trust store wins over insecure", OPCUAConfig{TrustedCertsDir: "pki/trusted", InsecureAcceptAnyCert: true}, other, false},
+		{"chain", OPCUAConfig{TrustedCertsDir: "pki/trusted"}, append(append([]byte(nil), cert...), other...), true},
+		{"garbage", OPCUAConfig{InsecureAcceptAnyCert: true}, []byte("not a certificate"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &opcuaDriver{config: &tt.config, trusted: [][]byte{cert}}
+			pub, err := d.trust("opc.tcp://plc:4840", tt.cert)
+			if (err == nil) != tt.ok {
+				t.Fatalf("trust() = %v, want ok=%v", err, tt.ok)
+			}
+			if tt.ok && !pub.Equal(&key.PublicKey) {
+				t.Fatal("trust() returned the wrong key")
+			}
+		})
+	}
+}
+
+func TestValidateOPCUASecurity(t *testing.T) {
+	tests := []struct {
+		name   string
+		config OPCUAConfig
+		sensor SensorConfig
+		err    string
+	}{
+		{"none", OPCUAConfig{}, SensorConfig{}, ""},
+		{"secure", OPCUAConfig{CertFile: "c", KeyFile: "k", TrustedCertsDir: "t"}, SensorConfig{SecurityPolicy: "Basic256Sha256"}, ""},
+		{"sign only", OPCUAConfig{CertFile: "c", KeyFile: "k", TrustedCertsDir: "t"}, SensorConfig{SecurityPolicy: "Basic256Sha256", SecurityMode: "Sign"}, ""},
+		{"unknown policy", OPCUAConfig{}, SensorConfig{SecurityPolicy: "Basic128Rsa15"}, "unsupported security_policy"},
+		{"unknown mode", OPCUAConfig{}, SensorConfig{SecurityMode: "Encrypt"}, "unknown security_mode"},
+		{"mode without policy", OPCUAConfig{}, SensorConfig{SecurityMode: "Sign"}, "security_mode None requires"},
+		{"policy without mode", OPCUAConfig{CertFile: "c", KeyFile: "k", TrustedCertsDir: "t"}, SensorConfig{SecurityPolicy: "Basic256Sha256", SecurityMode: "None"}, "security_mode None requires"},
+		{"no certificate", OPCUAConfig{TrustedCertsDir: "t"}, SensorConfig{SecurityPolicy: "Basic256Sha256"}, "requires opcua cert_file"},
+		{"no trust store", OPCUAConfig{CertFile: "c", KeyFile: "k"}, SensorConfig{SecurityPolicy: "Basic256Sha256"}, "trusted_certs_dir"},
+		{"password without trust store", OPCUAConfig{}, SensorConfig{Username: "op", Password: "pw"}, "trusted_certs_dir"},
+		{"password with insecure accept", OPCUAConfig{InsecureAcceptAnyCert: true}, SensorConfig{Username: "op", Password: "pw"}, ""},
+		{"username only", OPCUAConfig{TrustedCertsDir: "t"}, SensorConfig{Username: "op"}, "set together"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sensor := tt.sensor
+			sensor.Protocol = "opcua"
+			sensor.Address = "opc.tcp://plc:4840"
+			sensor.NodeID = "ns=2;s=Temperature"
+			sensor.PollIntervalMs = 1000
+			gw := &Gateway{sensors: map[string]*SensorConfig{"s1": &sensor}}
+			gw.settings.OPCUA = tt.config
+			err := gw.validateOPCUASensors()
+			if tt.err == "" && err != nil {
+				t.Fatalf("validateOPCUASensors() = %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("validateOPCUASensors() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
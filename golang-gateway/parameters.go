@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexbeltran/gobacnet"
+	"github.com/alexbeltran/gobacnet/property"
+	"github.com/alexbeltran/gobacnet/types"
+	"gopkg.in/yaml.v3"
+)
+
+var parametersBucket = []byte("parameters")
+
+// ParametersConfig configures device parameter pushes. The desired device
+// parameters are declared in File, which is re-read on every request so it
+// can be edited during commissioning without a restart. Pushes are only
+// accepted while the gateway is in maintenance mode, which an admin enters
+// for at most MaxMaintenanceMin minutes.
+type ParametersConfig struct {
+	File              string `yaml:"file,omitempty"`
+	MaxMaintenanceMin int    `yaml:"max_maintenance_min"`
+}
+
+func (c *ParametersConfig) normalize() {
+	if c.File == "" {
+		c.File = "/app/config/parameters.yaml"
+	}
+	if c.MaxMaintenanceMin <= 0 {
+		c.MaxMaintenanceMin = 60
+	}
+}
+
+// ParametersFile is the declarative parameter file
+type ParametersFile struct {
+	Devices []DeviceParameters `yaml:"devices"`
+}
+
+// DeviceParameters lists the parameters of one device
+type DeviceParameters struct {
+	Device   string `yaml:"device" json:"device"`
+	Protocol string `yaml:"protocol" json:"protocol"` // "bacnet" or "modbus"
+	// Address is the BACnet device address, or the Modbus endpoint
+	// (MODBUS_ADDRESS when empty) with its UnitID
+	Address    string            `yaml:"address,omitempty" json:"address,omitempty"`
+	UnitID     int               `yaml:"unit_id,omitempty" json:"unit_id,omitempty"`
+	Parameters []DeviceParameter `yaml:"parameters" json:"parameters,omitempty"`
+}
+
+// DeviceParameter is one BACnet property or Modbus holding register block.
+// BACnet values are numbers (written as REAL, or in the present value type
+// of binary and multi-state objects) or strings (CharacterString);
+// Modbus values are a list of raw 16-bit register contents starting at
+// Register.
+type DeviceParameter struct {
+	Name       string      `yaml:"name,omitempty" json:"name,omitempty"`
+	ObjectType string      `yaml:"object_type,omitempty" json:"object_type,omitempty"`
+	Instance   int         `yaml:"instance,omitempty" json:"instance,omitempty"`
+	Property   string      `yaml:"property,omitempty" json:"property,omitempty"`
+	Register   int         `yaml:"register,omitempty" json:"register,omitempty"`
+	Value      interface{} `yaml:"value" json:"value,omitempty"`
+}
+
+// key identifies a parameter within the file
+func (p *DeviceParameter) key(device *DeviceParameters) string {
+	if p.Name != "" {
+		return device.Device + "/" + p.Name
+	}
+	if device.Protocol == "modbus" {
+		return fmt.Sprintf("%s/hr:%d", device.Device, p.Register)
+	}
+	return fmt.Sprintf("%s/%s:%d/%s", device.Device, p.ObjectType, p.Instance, p.Property)
+}
+
+// loadParametersFile reads and validates the parameter file
+func loadParametersFile(path string) (*ParametersFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parameters file: %w", err)
+	}
+	var file ParametersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse parameters file: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i := range file.Devices {
+		device := &file.Devices[i]
+		if device.Protocol != "bacnet" && device.Protocol != "modbus" {
+			return nil, fmt.Errorf("device %s: unsupported protocol %q", device.Device, device.Protocol)
+		}
+		for j := range device.Parameters {
+			p := &device.Parameters[j]
+			key := p.key(device)
+			if seen[key] {
+				return nil, fmt.Errorf("duplicate parameter %s", key)
+			}
+			seen[key] = true
+			if device.Protocol == "bacnet" {
+				if _, ok := bacnetObjectTypes[p.ObjectType]; !ok {
+					return nil, fmt.Errorf("parameter %s: unsupported object_type %q", key, p.ObjectType)
+				}
+				if _, ok := bacnetProperties[p.Property]; !ok {
+					return nil, fmt.Errorf("parameter %s: unsupported property %q", key, p.Property)
+				}
+			}
+			value, err := p.coerce(device, p.Value)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %w", key, err)
+			}
+			p.Value = value
+		}
+	}
+	return &file, nil
+}
+
+// coerce converts a value from YAML or JSON to the parameter's value type:
+// float64 or string for BACnet, []uint16 for Modbus
+func (p *DeviceParameter) coerce(device *DeviceParameters, raw interface{}) (interface{}, error) {
+	if device.Protocol == "modbus" {
+		items, ok := raw.([]interface{})
+		if !ok {
+			items = []interface{}{raw}
+		}
+		registers := make([]uint16, len(items))
+		for i, item := range items {
+			f, ok := toFloat(item)
+			if !ok || f < 0 || f > math.MaxUint16 || f != math.Trunc(f) {
+				return nil, fmt.Errorf("register value %v is not a 16-bit unsigned integer", item)
+			}
+			registers[i] = uint16(f)
+		}
+		if len(registers) == 0 || len(registers) > 123 {
+			return nil, fmt.Errorf("register block must have 1 to 123 values")
+		}
+		return registers, nil
+	}
+	switch v := raw.(type) {
+	case string:
+		return v, nil
+	case []uint16, []interface{}, nil:
+		return nil, fmt.Errorf("BACnet values must be a number or a string")
+	}
+	f, ok := toFloat(raw)
+	if !ok {
+		return nil, fmt.Errorf("unsupported value %v", raw)
+	}
+	return f, nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// parameterValuesEqual compares values of the same parameter; REALs are
+// compared at float32 precision
+func parameterValuesEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		return ok && float32(a) == float32(b)
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	case []uint16:
+		b, ok := b.([]uint16)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// readParameter reads the current value of a parameter from its device
+func (gw *Gateway) readParameter(device *DeviceParameters, p *DeviceParameter) (interface{}, error) {
+	if device.Protocol == "modbus" {
+		count := len(p.Value.([]uint16))
+		client, _ := gw.modbus.client(device.Address, device.UnitID)
+		results, err := client.ReadHoldingRegisters(uint16(p.Register), uint16(count))
+		if err != nil {
+			return nil, fmt.Errorf("Modbus read error: %w", err)
+		}
+		if len(results) < 2*count {
+			return nil, fmt.Errorf("insufficient data returned")
+		}
+		registers := make([]uint16, count)
+		for i := range registers {
+			registers[i] = uint16(results[2*i])<<8 | uint16(results[2*i+1])
+		}
+		return registers, nil
+	}
+
+	if gw.bacnet == nil {
+		return nil, fmt.Errorf("BACnet client not initialized")
+	}
+	resp, err := gw.bacnet.readProperty(context.Background(), device.Address, types.ReadPropertyData{
+		Object: types.Object{
+			ID: types.ObjectID{
+				Type:     bacnetObjectTypes[p.ObjectType],
+				Instance: types.ObjectInstance(p.Instance),
+			},
+			Properties: []types.Property{{
+				Type:       bacnetProperties[p.Property],
+				ArrayIndex: gobacnet.ArrayAll,
+			}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("BACnet read error: %w", err)
+	}
+	if len(resp.Object.Properties) == 0 {
+		return nil, fmt.Errorf("BACnet response contained no properties")
+	}
+	if text, ok := resp.Object.Properties[0].Data.(string); ok {
+		return text, nil
+	}
+	return parseBACnetNumeric(resp.Object.Properties[0].Data)
+}
+
+// writeParameter writes a parameter value to its device
+func (gw *Gateway) writeParameter(device *DeviceParameters, p *DeviceParameter, value interface{}) error {
+	if device.Protocol == "modbus" {
+		registers := value.([]uint16)
+		data := make([]byte, 2*len(registers))
+		for i, v := range registers {
+			data[2*i], data[2*i+1] = byte(v>>8), byte(v)
+		}
+		client, _ := gw.modbus.client(device.Address, device.UnitID)
+		if _, err := client.WriteMultipleRegisters(uint16(p.Register), uint16(len(registers)), data); err != nil {
+			return fmt.Errorf("Modbus write error: %w", err)
+		}
+		return nil
+	}
+
+	if gw.bacnet == nil {
+		return fmt.Errorf("BACnet client not initialized")
+	}
+	req := bacnetWriteRequest{
+		ObjectType: bacnetObjectTypes[p.ObjectType],
+		Instance:   types.ObjectInstance(p.Instance),
+		Property:   bacnetProperties[p.Property],
+	}
+	switch v := value.(type) {
+	case string:
+		req.Text = &v
+	case float64:
+		f := float32(v)
+		req.Value = &f
+	}
+	if req.Property == property.PresentValue {
+		req.Priority = defaultWritePriority
+	}
+	if err := gw.bacnet.writeProperty(device.Address, req); err != nil {
+		return fmt.Errorf("BACnet write error: %w", err)
+	}
+	return nil
+}
+
+// ParameterDiff compares a declared parameter with its device
+type ParameterDiff struct {
+	Key     string      `json:"key"`
+	Current interface{} `json:"current"`
+	Desired interface{} `json:"desired"`
+	Changed bool        `json:"changed"`
+	Error   string      `json:"error,omitempty"`
+
+	device *DeviceParameters
+	param  *DeviceParameter
+}
+
+// diffParameters reads every declared parameter from its device
+func (gw *Gateway) diffParameters(file *ParametersFile) []ParameterDiff {
+	var diffs []ParameterDiff
+	for i := range file.Devices {
+		device := &file.Devices[i]
+		for j := range device.Parameters {
+			p := &device.Parameters[j]
+			diff := ParameterDiff{Key: p.key(device), Desired: p.Value, device: device, param: p}
+			current, err := gw.readParameter(device, p)
+			if err != nil {
+				diff.Error = err.Error()
+			} else {
+				diff.Current = current
+				diff.Changed = !parameterValuesEqual(p.Value, current)
+			}
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+// parameterBackup is the value a parameter had before the last push,
+// persisted in the state store for rollback
+type parameterBackup struct {
+	Device    DeviceParameters `json:"device"`
+	Parameter DeviceParameter  `json:"parameter"`
+	SavedAt   time.Time        `json:"saved_at"`
+}
+
+// maintenanceMode guards parameter pushes
+type maintenanceMode struct {
+	mu    sync.Mutex
+	until time.Time
+	by    string
+	// pushing serializes pushes and rollbacks
+	pushing sync.Mutex
+}
+
+// MaintenanceStatus is served by /parameters/maintenance
+type MaintenanceStatus struct {
+	Active bool   `json:"active"`
+	Until  string `json:"until,omitempty"`
+	By     string `json:"by,omitempty"`
+}
+
+func (m *maintenanceMode) status(now time.Time) MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !now.Before(m.until) {
+		return MaintenanceStatus{}
+	}
+	return MaintenanceStatus{Active: true, Until: m.until.Format(time.RFC3339), By: m.by}
+}
+
+// handleParameters routes /parameters/{maintenance,diff,apply,rollback}
+func (gw *Gateway) handleParameters(w http.ResponseWriter, r *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/parameters/"), "/")
+	switch {
+	case action == "maintenance":
+		gw.handleMaintenance(w, r)
+	case action == "diff" && r.Method == http.MethodGet:
+		file, err := loadParametersFile(gw.settings.Parameters.File)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"parameters": gw.diffParameters(file)})
+	case (action == "apply" || action == "rollback") && r.Method == http.MethodPost:
+		if !gw.maintenance.status(time.Now()).Active {
+			writeJSONError(w, http.StatusConflict, "parameter pushes require maintenance mode")
+			return
+		}
+		if !gw.maintenance.pushing.TryLock() {
+			writeJSONError(w, http.StatusConflict, "a parameter push is already in progress")
+			return
+		}
+		defer gw.maintenance.pushing.Unlock()
+		if action == "apply" {
+			gw.applyParameters(w, r)
+		} else {
+			gw.rollbackParameters(w, r)
+		}
+	case action == "diff" || action == "apply" || action == "rollback":
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleMaintenance serves GET (status), POST {"minutes": n} (enter) and
+// DELETE (leave) on /parameters/maintenance
+func (gw *Gateway) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	m := gw.maintenance
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var body struct {
+			Minutes int `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+			return
+		}
+		if body.Minutes <= 0 || body.Minutes > gw.settings.Parameters.MaxMaintenanceMin {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("minutes must be between 1 and %d", gw.settings.Parameters.MaxMaintenanceMin))
+			return
+		}
+		m.mu.Lock()
+		m.until = time.Now().Add(time.Duration(body.Minutes) * time.Minute)
+		m.by = apiClient(r)
+		m.mu.Unlock()
+		log.Printf("[EVENT] Maintenance mode entered by %s for %d minutes", apiClient(r), body.Minutes)
+	case http.MethodDelete:
+		m.mu.Lock()
+		m.until = time.Time{}
+		m.by = ""
+		m.mu.Unlock()
+		log.Printf("[EVENT] Maintenance mode left by %s", apiClient(r))
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, m.status(time.Now()))
+}
+
+// applyParameters serves POST /parameters/apply. Changed parameters are
+// backed up, written and read back; on the first failure the parameters
+// already written are restored. ?dry_run=true returns the diff only.
+func (gw *Gateway) applyParameters(w http.ResponseWriter, r *http.Request) {
+	file, err := loadParametersFile(gw.settings.Parameters.File)
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	diffs := gw.diffParameters(file)
+	var changed []ParameterDiff
+	for _, diff := range diffs {
+		if diff.Error != "" {
+			writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+				"error":      "failed to read " + diff.Key + ": " + diff.Error,
+				"parameters": diffs,
+			})
+			return
+		}
+		if diff.Changed {
+			changed = append(changed, diff)
+		}
+	}
+	if r.URL.Query().Get("dry_run") == "true" || len(changed) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"applied": 0, "parameters": diffs})
+		return
+	}
+
+	// The backup replaces the previous one, so rollback always returns to
+	// the state before the latest push
+	now := time.Now()
+	backups := make(map[string]interface{}, len(changed))
+	for _, diff := range changed {
+		device := *diff.device
+		device.Parameters = nil
+		param := *diff.param
+		param.Value = diff.Current
+		backups[diff.Key] = parameterBackup{Device: device, Parameter: param, SavedAt: now}
+	}
+	if err := gw.store.save(parametersBucket, backups); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "failed to save parameter backup: "+err.Error())
+		return
+	}
+
+	for i, diff := range changed {
+		err := gw.writeParameter(diff.device, diff.param, diff.Desired)
+		if err == nil {
+			var readBack interface{}
+			readBack, err = gw.readParameter(diff.device, diff.param)
+			if err == nil && !parameterValuesEqual(diff.Desired, readBack) {
+				err = fmt.Errorf("read back %v after writing %v", readBack, diff.Desired)
+			}
+		}
+		if err != nil {
+			log.Printf("[ERROR] Parameter push failed at %s: %v; restoring %d parameters", diff.Key, err, i+1)
+			restored := gw.restoreParameters(changed[:i+1])
+			writeJSON(w, http.StatusBadGateway, map[string]interface{}{
+				"error":    fmt.Sprintf("failed to write %s: %v", diff.Key, err),
+				"restored": restored,
+			})
+			return
+		}
+		log.Printf("[EVENT] Parameter %s: %v -> %v", diff.Key, diff.Current, diff.Desired)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"applied": len(changed), "parameters": diffs})
+}
+
+// restoreParameters writes the pre-push values back in reverse order and
+// returns the keys that could not be restored
+func (gw *Gateway) restoreParameters(diffs []ParameterDiff) map[string]string {
+	failed := make(map[string]string)
+	for i := len(diffs) - 1; i >= 0; i-- {
+		diff := diffs[i]
+		if err := gw.writeParameter(diff.device, diff.param, diff.Current); err != nil {
+			log.Printf("[ERROR] Failed to restore parameter %s: %v", diff.Key, err)
+			failed[diff.Key] = err.Error()
+		}
+	}
+	return failed
+}
+
+// rollbackParameters serves POST /parameters/rollback, writing back the
+// values saved by the last push
+func (gw *Gateway) rollbackParameters(w http.ResponseWriter, r *http.Request) {
+	var backups []parameterBackup
+	var keys []string
+	err := gw.store.load(parametersBucket, func(key string, data []byte) error {
+		var backup parameterBackup
+		if err := json.Unmarshal(data, &backup); err != nil {
+			return fmt.Errorf("invalid backup for %s: %w", key, err)
+		}
+		value, err := backup.Parameter.coerce(&backup.Device, backup.Parameter.Value)
+		if err != nil {
+			return fmt.Errorf("invalid backup for %s: %w", key, err)
+		}
+		backup.Parameter.Value = value
+		backups = append(backups, backup)
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(backups) == 0 {
+		writeJSONError(w, http.StatusNotFound, "no parameter backup to roll back to")
+		return
+	}
+
+	failed := make(map[string]string)
+	for i := range backups {
+		backup := &backups[i]
+		if err := gw.writeParameter(&backup.Device, &backup.Parameter, backup.Parameter.Value); err != nil {
+			log.Printf("[ERROR] Failed to roll back parameter %s: %v", keys[i], err)
+			failed[keys[i]] = err.Error()
+			continue
+		}
+		log.Printf("[EVENT] Parameter %s rolled back to %v", keys[i], backup.Parameter.Value)
+	}
+	if len(failed) > 0 {
+		writeJSON(w, http.StatusBadGateway, map[string]interface{}{"error": "rollback incomplete", "failed": failed})
+		return
+	}
+	// Keep nothing to roll back to twice
+	if err := gw.store.save(parametersBucket, nil); err != nil {
+		log.Printf("[ERROR] Failed to clear parameter backup: %v", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rolled_back": keys})
+}
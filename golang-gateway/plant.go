@@ -0,0 +1,109 @@
+package main
+
+import "math"
+
+// Additional equipment point roles used by the plant calculations. Readings
+// are taken in the canonical units of their sensor types (°C, %RH, m³/h for
+// air flow, L/min for water flow).
+const (
+	pointSupplyHumidity = "supply_humidity"
+	pointReturnHumidity = "return_humidity"
+	pointAirFlow        = "air_flow"
+	pointWaterFlow      = "water_flow"
+)
+
+const (
+	// standardPressureKPa is used for psychrometrics unless the equipment
+	// sets pressure_kpa (e.g. for sites at altitude)
+	standardPressureKPa = 101.325
+	// waterHeatCapacity is the specific heat of water in kJ/(kg·K); water is
+	// taken at 1 kg/L
+	waterHeatCapacity = 4.186
+	// airHeatCapacity is the specific heat of dry air in kJ/(kg·K)
+	airHeatCapacity = 1.006
+)
+
+// equipmentMedium returns the heat transfer medium of equipment: its
+// configured medium, otherwise water for hydronic plant and air for the rest
+func equipmentMedium(eq *EquipmentConfig) string {
+	if eq.Medium != "" {
+		return eq.Medium
+	}
+	switch eq.Type {
+	case "chiller", "boiler", "heat_exchanger", "cooling_tower", "heat_pump":
+		return "water"
+	}
+	return "air"
+}
+
+// saturationPressureKPa is the saturation vapour pressure over water at t °C
+// (Magnus formula, Alduchov & Eskridge coefficients)
+func saturationPressureKPa(t float64) float64 {
+	return 0.61094 * math.Exp(17.625*t/(t+243.04))
+}
+
+// humidityRatio returns kg of water vapour per kg of dry air
+func humidityRatio(t, rh, pressureKPa float64) float64 {
+	pw := rh / 100 * saturationPressureKPa(t)
+	return 0.621945 * pw / (pressureKPa - pw)
+}
+
+// moistAirEnthalpy returns the specific enthalpy of moist air in kJ per kg
+// of dry air
+func moistAirEnthalpy(t, w float64) float64 {
+	return airHeatCapacity*t + w*(2501+1.86*t)
+}
+
+// dryAirDensity returns kg of dry air per m³ of moist air
+func dryAirDensity(t, w, pressureKPa float64) float64 {
+	pw := pressureKPa * w / (0.621945 + w)
+	return (pressureKPa - pw) / (0.287042 * (t + 273.15))
+}
+
+// computePlantMetrics derives delta-T, air enthalpies and the thermal load
+// from the supply and return points. DeltaT is return minus supply, so the
+// load is positive when the equipment removes heat (cooling) and negative
+// when it adds heat. Air loads use enthalpies when both humidities are known
+// and are sensible-only otherwise.
+func computePlantMetrics(eq *EquipmentConfig, t *EquipmentTelemetry) {
+	if t.SupplyTemp == nil || t.ReturnTemp == nil {
+		return
+	}
+	supply, ret := *t.SupplyTemp, *t.ReturnTemp
+	t.DeltaT = floatPtr(ret - supply)
+
+	pressure := eq.PressureKPa
+	if pressure <= 0 {
+		pressure = standardPressureKPa
+	}
+
+	if equipmentMedium(eq) == "water" {
+		if flow, ok := t.Points[pointWaterFlow]; ok {
+			kgPerSec := flow / 60
+			t.ThermalLoadKW = floatPtr(kgPerSec * waterHeatCapacity * (ret - supply))
+		}
+		return
+	}
+
+	var wSupply, wReturn float64
+	rhSupply, okSupply := t.Points[pointSupplyHumidity]
+	rhReturn, okReturn := t.Points[pointReturnHumidity]
+	latent := okSupply && okReturn
+	if latent {
+		wSupply = humidityRatio(supply, rhSupply, pressure)
+		wReturn = humidityRatio(ret, rhReturn, pressure)
+		t.SupplyEnthalpy = floatPtr(moistAirEnthalpy(supply, wSupply))
+		t.ReturnEnthalpy = floatPtr(moistAirEnthalpy(ret, wReturn))
+	}
+	flow, ok := t.Points[pointAirFlow]
+	if !ok {
+		return
+	}
+	// The air flow is measured at the supply fan
+	kgPerSec := flow / 3600 * dryAirDensity(supply, wSupply, pressure)
+	if latent {
+		t.ThermalLoadKW = floatPtr(kgPerSec * (*t.ReturnEnthalpy - *t.SupplyEnthalpy))
+	} else {
+		t.ThermalLoadKW = floatPtr(kgPerSec * airHeatCapacity * (ret - supply))
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang-gateway/wasm"
+)
+
+// maxPluginOutput bounds the JSON a plugin call may return
+const maxPluginOutput = 1 << 20
+
+// PluginsConfig loads WebAssembly plugins, so odd vendor payloads and custom
+// KPIs can be handled without forking the gateway. Decoders turn the value a
+// sensor's driver returned into the reading (sensors select one with
+// decoder: <name>); rules run on every room's telemetry each tick and add
+// KPIs to it or raise events on events/<room_id>/<rule>.
+//
+// A plugin is a module exporting memory, alloc(size i32) i32 and an entry
+// point, decode for decoders and evaluate for rules, taking (ptr i32,
+// len i32) of a JSON request and returning i64 ptr<<32|len of its JSON
+// response. Reactor modules built for wasip1 (Go -buildmode=c-shared,
+// TinyGo, Rust) work as is; _initialize is called once after loading.
+// Plugins run sandboxed in an interpreter: no files, network or
+// environment, memory capped at MaxMemoryMB and every call bounded by Fuel.
+// Files are checked every ReloadIntervalSec and reloaded when they change.
+type PluginsConfig struct {
+	// Dir resolves relative plugin files
+	Dir      string         `yaml:"dir"`
+	Decoders []PluginConfig `yaml:"decoders"`
+	Rules    []PluginConfig `yaml:"rules"`
+
+	MaxMemoryMB       int   `yaml:"max_memory_mb"`
+	Fuel              int64 `yaml:"fuel"`
+	ReloadIntervalSec int   `yaml:"reload_interval_sec"`
+}
+
+// PluginConfig names a plugin module; Config is passed to every call
+type PluginConfig struct {
+	Name   string                 `yaml:"name"`
+	File   string                 `yaml:"file"`
+	Config map[string]interface{} `yaml:"config,omitempty"`
+}
+
+func (c *PluginsConfig) normalize() error {
+	if c.Dir == "" {
+		c.Dir = "/app/config/plugins"
+	}
+	if c.MaxMemoryMB <= 0 {
+		c.MaxMemoryMB = 64
+	}
+	if c.Fuel <= 0 {
+		c.Fuel = 100000000
+	}
+	if c.ReloadIntervalSec <= 0 {
+		c.ReloadIntervalSec = 5
+	}
+	seen := make(map[string]bool)
+	for _, list := range [][]PluginConfig{c.Decoders, c.Rules} {
+		for i := range list {
+			p := &list[i]
+			if p.Name == "" || p.File == "" {
+				return errors.New("plugins: every plugin needs a name and a file")
+			}
+			if seen[p.Name] {
+				return fmt.Errorf("plugins: duplicate plugin name %s", p.Name)
+			}
+			seen[p.Name] = true
+			if !filepath.IsAbs(p.File) {
+				p.File = filepath.Join(c.Dir, p.File)
+			}
+		}
+	}
+	return nil
+}
+
+// DecoderRequest is the JSON a decoder receives
+type DecoderRequest struct {
+	SensorID    string                 `json:"sensor_id"`
+	Type        string                 `json:"type"`
+	Address     string                 `json:"address,omitempty"`
+	Unit        string                 `json:"unit,omitempty"`
+	Value       float64                `json:"value"`
+	StringValue string                 `json:"string_value,omitempty"`
+	Config      map[string]interface{} `json:"config,omitempty"`
+}
+
+// DecoderResponse is the JSON a decoder returns; a non-empty Error marks
+// the reading as failed
+type DecoderResponse struct {
+	Value       float64 `json:"value"`
+	StringValue string  `json:"string_value,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// RuleRequest is the JSON a rule receives every tick
+type RuleRequest struct {
+	Room      *RoomTelemetry         `json:"room"`
+	Zone      string                 `json:"zone,omitempty"`
+	Floor     int                    `json:"floor"`
+	Config    map[string]interface{} `json:"config,omitempty"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+// RuleResponse is the JSON a rule returns
+type RuleResponse struct {
+	KPIs   map[string]float64 `json:"kpis,omitempty"`
+	Events []RuleEvent        `json:"events,omitempty"`
+}
+
+// RuleEvent is raised by a rule and published on events/<room_id>/<rule>
+type RuleEvent struct {
+	Rule      string `json:"rule"`
+	RoomID    string `json:"room_id"`
+	Name      string `json:"name"`
+	Severity  string `json:"severity,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// wasmPlugin is one loaded plugin. Instances are not reentrant, so calls
+// are serialized; an instance that trapped is discarded and recreated on
+// the next call.
+type wasmPlugin struct {
+	name     string
+	entry    string
+	config   PluginConfig
+	settings *PluginsConfig
+
+	mu       sync.Mutex
+	module   *wasm.Module
+	instance *wasm.Instance
+	modTime  time.Time
+	size     int64
+}
+
+type pluginHost struct {
+	decoders map[string]*wasmPlugin
+	rules    []*wasmPlugin
+}
+
+// newPluginHost loads the configured plugins
+func newPluginHost(settings *PluginsConfig) (*pluginHost, error) {
+	host := &pluginHost{decoders: make(map[string]*wasmPlugin)}
+	for _, pc := range settings.Decoders {
+		p := &wasmPlugin{name: pc.Name, entry: "decode", config: pc, settings: settings}
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+		host.decoders[pc.Name] = p
+	}
+	for _, pc := range settings.Rules {
+		p := &wasmPlugin{name: pc.Name, entry: "evaluate", config: pc, settings: settings}
+		if err := p.load(); err != nil {
+			return nil, err
+		}
+		host.rules = append(host.rules, p)
+	}
+	if n := len(host.decoders) + len(host.rules); n > 0 {
+		log.Printf("Loaded %d plugin(s)", n)
+	}
+	return host, nil
+}
+
+func (host *pluginHost) plugins() []*wasmPlugin {
+	all := make([]*wasmPlugin, 0, len(host.decoders)+len(host.rules))
+	for _, p := range host.decoders {
+		all = append(all, p)
+	}
+	return append(all, host.rules...)
+}
+
+// validateDecoders checks that sensors name configured decoders
+func (gw *Gateway) validateDecoders() error {
+	names := make(map[string]bool)
+	for _, pc := range gw.settings.Plugins.Decoders {
+		names[pc.Name] = true
+	}
+	for id, sensor := range gw.sensors {
+		if sensor.Decoder != "" && !names[sensor.Decoder] {
+			return fmt.Errorf("sensor %s: unknown decoder %s", id, sensor.Decoder)
+		}
+	}
+	return nil
+}
+
+// load compiles the plugin file and replaces the running module
+func (p *wasmPlugin) load() error {
+	info, err := os.Stat(p.config.File)
+	if err != nil {
+		return fmt.Errorf("failed to load plugin %s: %w", p.name, err)
+	}
+	data, err := os.ReadFile(p.config.File)
+	if err != nil {
+		return fmt.Errorf("failed to load plugin %s: %w", p.name, err)
+	}
+	module, err := wasm.Compile(data)
+	if err != nil {
+		return fmt.Errorf("failed to compile plugin %s: %w", p.name, err)
+	}
+	if err := checkPluginExports(module, p.entry); err != nil {
+		return fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	instance, err := p.instantiate(module)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.module, p.instance = module, instance
+	p.modTime, p.size = info.ModTime(), info.Size()
+	p.mu.Unlock()
+	return nil
+}
+
+func checkPluginExports(module *wasm.Module, entry string) error {
+	alloc, ok := module.ExportedFunction("alloc")
+	if !ok || len(alloc.Params) != 1 || len(alloc.Results) != 1 {
+		return errors.New("must export alloc(size i32) i32")
+	}
+	call, ok := module.ExportedFunction(entry)
+	if !ok || len(call.Params) != 2 || len(call.Results) != 1 || call.Results[0] != wasm.I64 {
+		return fmt.Errorf("must export %s(ptr i32, len i32) i64", entry)
+	}
+	return nil
+}
+
+// instantiate creates a sandboxed instance and runs its initializer
+func (p *wasmPlugin) instantiate(module *wasm.Module) (*wasm.Instance, error) {
+	output := &pluginOutput{name: p.name}
+	instance, err := wasm.Instantiate(module, wasm.WASI(output.write), wasm.Config{
+		MaxMemoryPages: uint32(p.settings.MaxMemoryMB) * 16,
+		Fuel:           p.settings.Fuel,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate plugin %s: %w", p.name, err)
+	}
+	if _, ok := module.ExportedFunction("_initialize"); ok {
+		if _, err := instance.Call("_initialize"); err != nil {
+			return nil, fmt.Errorf("failed to initialize plugin %s: %w", p.name, err)
+		}
+	}
+	return instance, nil
+}
+
+// pluginOutput logs what a plugin writes to stdout and stderr line by line
+type pluginOutput struct {
+	name    string
+	pending []byte
+}
+
+func (o *pluginOutput) write(fd uint32, b []byte) {
+	o.pending = append(o.pending, b...)
+	for {
+		i := bytes.IndexByte(o.pending, '\n')
+		if i < 0 {
+			break
+		}
+		log.Printf("[DEBUG] plugin %s: %s", o.name, o.pending[:i])
+		o.pending = o.pending[i+1:]
+	}
+	if len(o.pending) > 4096 {
+		log.Printf("[DEBUG] plugin %s: %s", o.name, o.pending)
+		o.pending = nil
+	}
+}
+
+// reloadIfChanged reloads the plugin when its file changed, keeping the
+// running module when the new one fails to load
+func (p *wasmPlugin) reloadIfChanged() {
+	info, err := os.Stat(p.config.File)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	changed := !info.ModTime().Equal(p.modTime) || info.Size() != p.size
+	p.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := p.load(); err != nil {
+		log.Printf("[ERROR] %v; keeping the running version", err)
+		// Do not retry until the file changes again
+		p.mu.Lock()
+		p.modTime, p.size = info.ModTime(), info.Size()
+		p.mu.Unlock()
+		return
+	}
+	log.Printf("Reloaded plugin %s from %s", p.name, p.config.File)
+}
+
+// call passes request to the plugin's entry point as JSON and decodes its
+// JSON response
+func (p *wasmPlugin) call(request, response interface{}) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.instance == nil {
+		instance, err := p.instantiate(p.module)
+		if err != nil {
+			return err
+		}
+		p.instance = instance
+	}
+	out, err := p.invoke(payload)
+	if err != nil {
+		// The module's state is unknown after a trap
+		p.instance = nil
+		return fmt.Errorf("plugin %s: %w", p.name, err)
+	}
+	if err := json.Unmarshal(out, response); err != nil {
+		return fmt.Errorf("plugin %s returned invalid JSON: %w", p.name, err)
+	}
+	return nil
+}
+
+func (p *wasmPlugin) invoke(payload []byte) ([]byte, error) {
+	results, err := p.instance.Call("alloc", uint64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(results[0])
+	if !p.instance.Write(ptr, payload) {
+		return nil, errors.New("alloc returned an invalid buffer")
+	}
+	results, err = p.instance.Call(p.entry, uint64(ptr), uint64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	if outLen > maxPluginOutput {
+		return nil, fmt.Errorf("response of %d bytes exceeds the limit", outLen)
+	}
+	out, ok := p.instance.Read(outPtr, outLen)
+	if !ok {
+		return nil, errors.New("response is outside plugin memory")
+	}
+	return out, nil
+}
+
+// decode runs a sensor's decoder on the value its driver returned
+func (host *pluginHost) decode(sensor *SensorConfig, value float64, text string) (float64, string, error) {
+	p := host.decoders[sensor.Decoder]
+	request := &DecoderRequest{
+		SensorID:    sensor.ID,
+		Type:        sensor.Type,
+		Address:     sensor.Address,
+		Unit:        sensor.Unit,
+		Value:       value,
+		StringValue: text,
+		Config:      p.config.Config,
+	}
+	var response DecoderResponse
+	if err := p.call(request, &response); err != nil {
+		return 0, "", fmt.Errorf("decoder failed: %w", err)
+	}
+	if response.Error != "" {
+		return 0, "", fmt.Errorf("decoder %s: %s", p.name, response.Error)
+	}
+	return response.Value, response.StringValue, nil
+}
+
+// applyRules runs every rule on each room's telemetry, merging returned
+// KPIs into the telemetry and publishing returned events
+func (gw *Gateway) applyRules(telemetries []*RoomTelemetry, now time.Time) {
+	if gw.plugins == nil || len(gw.plugins.rules) == 0 {
+		return
+	}
+	for _, telemetry := range telemetries {
+		room := gw.rooms[telemetry.RoomID]
+		for _, p := range gw.plugins.rules {
+			request := &RuleRequest{
+				Room:      telemetry,
+				Zone:      room.Zone,
+				Floor:     room.Floor,
+				Config:    p.config.Config,
+				Timestamp: now.Format(time.RFC3339),
+			}
+			var response RuleResponse
+			if err := p.call(request, &response); err != nil {
+				log.Printf("[ERROR] Rule %s failed for room %s: %v", p.name, telemetry.RoomID, err)
+				continue
+			}
+			for name, value := range response.KPIs {
+				if telemetry.KPIs == nil {
+					telemetry.KPIs = make(map[string]float64)
+				}
+				telemetry.KPIs[name] = value
+			}
+			for _, event := range response.Events {
+				event.Rule = p.name
+				event.RoomID = telemetry.RoomID
+				event.Timestamp = now.Format(time.RFC3339)
+				gw.publishRuleEvent(&event)
+				// Rule events of rooms with sensors in maintenance may
+				// stem from the work, so they raise no alarm
+				if gw.alarms != nil && severityRank(event.Severity) >= 0 && len(telemetry.MaintenanceSensors) == 0 {
+					gw.raiseAlarm(event.RoomID, event.Rule+"."+event.Name, "rule", event.Severity, event.Message, true)
+				}
+			}
+		}
+	}
+}
+
+func (gw *Gateway) publishRuleEvent(event *RuleEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal rule event: %v", err)
+		return
+	}
+	topic := fmt.Sprintf("events/%s/%s", event.RoomID, event.Rule)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[EVENT] %s %s in %s: %s", event.Rule, event.Name, event.RoomID, event.Message)
+}
+
+// watchPlugins reloads plugin files that changed on disk
+func (gw *Gateway) watchPlugins() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(gw.settings.Plugins.ReloadIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			for _, p := range gw.plugins.plugins() {
+				p.reloadIfChanged()
+			}
+		}
+	}
+}
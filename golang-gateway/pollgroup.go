@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PollGroupConfig reads correlated sensors (e.g. supply and return
+// temperatures across a coil) on the same tick. The group's reads are issued
+// concurrently while individual pollers are held back, and every reading of a
+// tick carries the tick's timestamp, so calculations combine coherent
+// samples. Grouped sensors are not polled on their own poll_interval_ms.
+type PollGroupConfig struct {
+	Name    string   `yaml:"name"`
+	Sensors []string `yaml:"sensors"`
+	// IntervalMs defaults to the shortest poll interval of the members
+	IntervalMs int `yaml:"interval_ms,omitempty"`
+	// Schedule is a cron expression reading the group at clock times
+	// instead of every interval_ms (see schedule.go)
+	Schedule string `yaml:"schedule,omitempty"`
+	cron     *cronSchedule
+}
+
+// validatePollGroups checks group members and fills in default intervals
+func (gw *Gateway) validatePollGroups() error {
+	member := make(map[string]string)
+	names := make(map[string]bool)
+	for i := range gw.settings.PollGroups {
+		group := &gw.settings.PollGroups[i]
+		if group.Name == "" {
+			return fmt.Errorf("poll group without name")
+		}
+		if names[group.Name] {
+			return fmt.Errorf("duplicate poll group %s", group.Name)
+		}
+		names[group.Name] = true
+		if len(group.Sensors) == 0 {
+			return fmt.Errorf("poll group %s has no sensors", group.Name)
+		}
+		shortest := 0
+		for _, sensorID := range group.Sensors {
+			sensor, ok := gw.sensors[sensorID]
+			if !ok {
+				return fmt.Errorf("poll group %s references unknown sensor %s", group.Name, sensorID)
+			}
+			if other, ok := member[sensorID]; ok {
+				return fmt.Errorf("sensor %s is in poll groups %s and %s", sensorID, other, group.Name)
+			}
+			member[sensorID] = group.Name
+			if shortest == 0 || sensor.PollIntervalMs < shortest {
+				shortest = sensor.PollIntervalMs
+			}
+		}
+		if group.IntervalMs <= 0 && group.cron == nil {
+			group.IntervalMs = shortest
+		}
+		if group.IntervalMs <= 0 && group.cron == nil {
+			return fmt.Errorf("poll group %s has no interval", group.Name)
+		}
+	}
+	return nil
+}
+
+// pollGroup reads all sensors of a group on each tick, or at the times of
+// its schedule
+func (gw *Gateway) pollGroup(group *PollGroupConfig) {
+	defer gw.wg.Done()
+
+	if group.cron != nil {
+		for {
+			at := group.cron.next(time.Now())
+			if !gw.waitUntil(at) {
+				return
+			}
+			gw.readPollGroup(group, at)
+		}
+	}
+
+	interval := time.Duration(group.IntervalMs) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			gw.readPollGroup(group, time.Now())
+		}
+	}
+}
+
+// readPollGroup performs one coherent read of a group stamped sampledAt and
+// records the spread between its first and last completed read
+func (gw *Gateway) readPollGroup(group *PollGroupConfig, sampledAt time.Time) {
+	gw.pollGate.Lock()
+	defer gw.pollGate.Unlock()
+
+	var mu sync.Mutex
+	var first, last time.Time
+	var wg sync.WaitGroup
+	for _, sensorID := range group.Sensors {
+		if gw.control.isPaused(sensorID) || !gw.allowPoll(sensorID, sampledAt) {
+			continue
+		}
+		wg.Add(1)
+		go func(sensorID string) {
+			defer wg.Done()
+			_, err := gw.readSensorAt(sensorID, gw.sensors[sensorID], sampledAt)
+			if err != nil {
+				return
+			}
+			done := time.Now()
+			mu.Lock()
+			if first.IsZero() || done.Before(first) {
+				first = done
+			}
+			if done.After(last) {
+				last = done
+			}
+			mu.Unlock()
+		}(sensorID)
+	}
+	wg.Wait()
+
+	if first.IsZero() {
+		return
+	}
+	spread := last.Sub(first)
+	gw.pollGroups.observe(group.Name, spread, time.Since(sampledAt))
+	log.Printf("[DEBUG] Poll group %s read in %v (spread %v)", group.Name, time.Since(sampledAt).Round(time.Millisecond), spread.Round(time.Millisecond))
+}
+
+// pollGroupStats keeps the latest timing of each poll group for /metrics
+type pollGroupStats struct {
+	mu     sync.Mutex
+	spread map[string]time.Duration
+	total  map[string]time.Duration
+}
+
+func newPollGroupStats() *pollGroupStats {
+	return &pollGroupStats{spread: make(map[string]time.Duration), total: make(map[string]time.Duration)}
+}
+
+func (s *pollGroupStats) observe(group string, spread, total time.Duration) {
+	s.mu.Lock()
+	s.spread[group] = spread
+	s.total[group] = total
+	s.mu.Unlock()
+}
+
+func (s *pollGroupStats) writePrometheus(b *strings.Builder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.spread) == 0 {
+		return
+	}
+	groups := make([]string, 0, len(s.spread))
+	for group := range s.spread {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	b.WriteString("# HELP gateway_poll_group_spread_ms Time between the first and last completed read of the latest poll group tick.\n")
+	b.WriteString("# TYPE gateway_poll_group_spread_ms gauge\n")
+	for _, group := range groups {
+		fmt.Fprintf(b, "gateway_poll_group_spread_ms{group=%q} %g\n", group, float64(s.spread[group])/float64(time.Millisecond))
+	}
+	b.WriteString("# HELP gateway_poll_group_duration_ms Duration of the latest poll group tick.\n")
+	b.WriteString("# TYPE gateway_poll_group_duration_ms gauge\n")
+	for _, group := range groups {
+		fmt.Fprintf(b, "gateway_poll_group_duration_ms{group=%q} %g\n", group, float64(s.total[group])/float64(time.Millisecond))
+	}
+}
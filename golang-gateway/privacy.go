@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Privacy modes
+const (
+	// privacyKAnonymity publishes a room's occupancy only while at least K
+	// people are present
+	privacyKAnonymity = "k_anonymity"
+	// privacyAggregateOnly never publishes per-room occupancy or motion
+	privacyAggregateOnly = "aggregate_only"
+)
+
+// PrivacyConfig minimizes personal data in published telemetry, as works
+// councils require in some jurisdictions. Per-room occupancy counts and
+// motion are suppressed (zeroed and flagged occupancy_suppressed) unless the
+// mode allows them, before telemetry reaches MQTT, the history API or live
+// streams. Rooms are instead summed per zone or floor and published on
+// occupancy/<zone|floor>/<id>; a group's figures are themselves suppressed
+// while fewer than K people are present.
+type PrivacyConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Mode    string `yaml:"mode"`
+	K       int    `yaml:"k"`
+	// AggregateBy groups rooms by zone (default) or floor
+	AggregateBy string `yaml:"aggregate_by"`
+}
+
+func (c *PrivacyConfig) normalize() error {
+	if c.Mode == "" {
+		c.Mode = privacyKAnonymity
+	}
+	if c.Mode != privacyKAnonymity && c.Mode != privacyAggregateOnly {
+		return fmt.Errorf("privacy: unknown mode %q", c.Mode)
+	}
+	if c.K <= 0 {
+		c.K = 5
+	}
+	if c.AggregateBy == "" {
+		c.AggregateBy = "zone"
+	}
+	if c.AggregateBy != "zone" && c.AggregateBy != "floor" {
+		return fmt.Errorf("privacy: aggregate_by must be zone or floor, not %q", c.AggregateBy)
+	}
+	return nil
+}
+
+// OccupancyAggregate is published on occupancy/<zone|floor>/<id>. Counts
+// are omitted while the group is below the k-anonymity threshold.
+type OccupancyAggregate struct {
+	Group           string `json:"group"`
+	ID              string `json:"id"`
+	Rooms           int    `json:"rooms"`
+	OccupancyCount  *int   `json:"occupancy_count,omitempty"`
+	RoomsWithMotion *int   `json:"rooms_with_motion,omitempty"`
+	Suppressed      bool   `json:"suppressed"`
+	K               int    `json:"k"`
+	Timestamp       string `json:"timestamp"`
+}
+
+// roomHasSensorType reports whether a room has a sensor of the given type
+func (gw *Gateway) roomHasSensorType(room *RoomConfig, sensorType string) bool {
+	for _, sensorID := range room.Sensors {
+		if sensor, ok := gw.sensors[sensorID]; ok && sensor.Type == sensorType {
+			return true
+		}
+	}
+	return false
+}
+
+// privateReading reports whether privacy mode keeps a reading out of logs
+// and retained state: occupancy and motion are personal data
+func (gw *Gateway) privateReading(reading *SensorReading) bool {
+	return gw.settings.Privacy.Enabled && (reading.Type == "occupancy" || reading.Type == "motion")
+}
+
+// privacyGroup returns the aggregation group of a room
+func (gw *Gateway) privacyGroup(room *RoomConfig) string {
+	if gw.settings.Privacy.AggregateBy == "floor" {
+		return strconv.Itoa(room.Floor)
+	}
+	if room.Zone == "" {
+		return "unzoned"
+	}
+	return room.Zone
+}
+
+// applyPrivacy sums occupancy per group and then suppresses per-room
+// occupancy and motion the mode does not allow. It returns the group
+// aggregates to publish, or nil when privacy mode is off.
+func (gw *Gateway) applyPrivacy(telemetries []*RoomTelemetry, now time.Time) []*OccupancyAggregate {
+	config := &gw.settings.Privacy
+	if !config.Enabled {
+		return nil
+	}
+
+	type groupTotals struct {
+		rooms, occupancy, motion int
+		// published sums the rooms that keep their count; hidden counts
+		// the counted rooms that are suppressed
+		published, hidden int
+		counted           bool
+	}
+	groups := make(map[string]*groupTotals)
+	for _, telemetry := range telemetries {
+		room := gw.rooms[telemetry.RoomID]
+		counter := gw.roomHasSensorType(room, "occupancy")
+		motion := gw.roomHasSensorType(room, "motion")
+		if !counter && !motion {
+			continue
+		}
+
+		id := gw.privacyGroup(room)
+		totals, ok := groups[id]
+		if !ok {
+			totals = &groupTotals{}
+			groups[id] = totals
+		}
+		totals.rooms++
+		if counter {
+			totals.counted = true
+			totals.occupancy += int(telemetry.OccupancyCount)
+		}
+		if telemetry.MotionDetected {
+			totals.motion++
+		}
+
+		// A room keeps its figures only with a counter showing at least K
+		// people; zero is suppressed too, so suppression never implies
+		// presence
+		keep := config.Mode == privacyKAnonymity && counter && int(telemetry.OccupancyCount) >= config.K
+		if keep {
+			totals.published += int(telemetry.OccupancyCount)
+		} else {
+			if counter {
+				totals.hidden++
+			}
+			telemetry.OccupancyCount = 0
+			telemetry.MotionDetected = false
+			telemetry.OccupancySuppressed = true
+		}
+	}
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	aggregates := make([]*OccupancyAggregate, 0, len(ids))
+	for _, id := range ids {
+		totals := groups[id]
+		aggregate := &OccupancyAggregate{
+			Group:     config.AggregateBy,
+			ID:        id,
+			Rooms:     totals.rooms,
+			K:         config.K,
+			Timestamp: now.Format(time.RFC3339),
+		}
+		// Each room with motion holds at least one person. The total of a
+		// group mixing published and suppressed rooms must leave at least K
+		// people in the suppressed ones, or subtracting the published rooms
+		// would reveal them.
+		switch {
+		case totals.counted && totals.occupancy >= config.K &&
+			(totals.hidden == 0 || totals.occupancy-totals.published >= config.K):
+			occupancy, motion := totals.occupancy, totals.motion
+			aggregate.OccupancyCount = &occupancy
+			aggregate.RoomsWithMotion = &motion
+		case !totals.counted && totals.motion >= config.K:
+			motion := totals.motion
+			aggregate.RoomsWithMotion = &motion
+		default:
+			aggregate.Suppressed = true
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+	return aggregates
+}
+
+// publishOccupancyAggregates publishes the group aggregates of a tick
+func (gw *Gateway) publishOccupancyAggregates(aggregates []*OccupancyAggregate) {
+	for _, aggregate := range aggregates {
+		payload, err := json.Marshal(aggregate)
+		if err != nil {
+			log.Printf("[ERROR] Failed to marshal occupancy aggregate for %s %s: %v", aggregate.Group, aggregate.ID, err)
+			continue
+		}
+		topic := fmt.Sprintf("occupancy/%s/%s", aggregate.Group, aggregate.ID)
+		token := gw.mqttClient.Publish(topic, 0, false, payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+			continue
+		}
+		log.Printf("[MQTT] Published to %s", topic)
+	}
+}
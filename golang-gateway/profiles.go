@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// OutputProfilesConfig converts values served to API consumers into a
+// profile's units, e.g. °F and cfm for U.S. facility teams, while MQTT
+// telemetry, the history and the archive stay in the canonical units.
+// Consumers choose a profile with ?units=<profile> on /export,
+// /api/v1/query, /api/v1/query_range, /stream and /sensors/{id}/read;
+// requests without one get Default. The built-in profiles are "si" (the
+// canonical units) and "imperial".
+type OutputProfilesConfig struct {
+	Default string `yaml:"default,omitempty"`
+	// Profiles adds profiles or overrides built-in ones: sensor type to unit;
+	// sensor types a profile leaves out keep their canonical unit
+	Profiles map[string]map[string]string `yaml:"profiles,omitempty"`
+}
+
+func (c *OutputProfilesConfig) normalize() error {
+	if c.Default == "" {
+		c.Default = "si"
+	}
+	if _, ok := c.Profiles[c.Default]; !ok {
+		if _, ok := builtinProfiles[c.Default]; !ok {
+			return fmt.Errorf("output_profiles default %q is not a known profile", c.Default)
+		}
+	}
+	return nil
+}
+
+// builtinProfiles are the units of each profile by sensor type
+var builtinProfiles = map[string]map[string]string{
+	"si": {},
+	"imperial": {
+		"temperature":  "[degF]",
+		"light":        "[ft_i]-2.[cd_i]",
+		"pressure":     "[in_i'H2O]",
+		"air_flow":     "[ft_i]3/min",
+		"water_flow":   "[gal_us]/min",
+		"water_volume": "[gal_us]",
+		"vibration":    "[in_i]/s",
+	},
+}
+
+// telemetryFieldTypes maps the numeric room telemetry fields, which are
+// also the history metric names, to the sensor type they aggregate
+var telemetryFieldTypes = map[string]string{
+	"temperature":        "temperature",
+	"humidity":           "humidity",
+	"co2_ppm":            "co2",
+	"light_lux":          "light",
+	"energy_kwh":         "energy",
+	"static_pressure_pa": "pressure",
+	"air_flow":           "air_flow",
+	"water_flow":         "water_flow",
+	"water_volume_m3":    "water_volume",
+	"pm25_ugm3":          "pm25",
+	"pm10_ugm3":          "pm10",
+	"tvoc_ppb":           "tvoc",
+	"power_w":            "power",
+	"noise_db":           "noise_db",
+	"vibration_rms":      "vibration",
+	"vibration_peak":     "vibration",
+}
+
+// outputProfile holds the conversions of one profile from the canonical
+// unit of each sensor type it changes
+type outputProfile struct {
+	types map[string]*unitConversion
+}
+
+// canonicalUnit returns the unit a sensor type is archived in
+func (gw *Gateway) canonicalUnit(sensorType string) (unitDefinition, bool) {
+	name, ok := gw.settings.Units.Canonical[sensorType]
+	if !ok {
+		name, ok = canonicalUnits[sensorType]
+	}
+	if !ok {
+		return unitDefinition{}, false
+	}
+	return lookupUnit(name)
+}
+
+// resolveOutputProfiles checks the units of every profile against the
+// canonical unit of its sensor types and prepares the conversions
+func (gw *Gateway) resolveOutputProfiles() error {
+	config := gw.settings.OutputProfiles.Profiles
+	profiles := make(map[string]*outputProfile, len(builtinProfiles)+len(config))
+	for _, defs := range []map[string]map[string]string{builtinProfiles, config} {
+		for name, units := range defs {
+			profile := &outputProfile{types: make(map[string]*unitConversion)}
+			for sensorType, unitName := range units {
+				canonical, ok := gw.canonicalUnit(sensorType)
+				if !ok {
+					return fmt.Errorf("output profile %s: unknown sensor type %s", name, sensorType)
+				}
+				unit, ok := lookupUnit(unitName)
+				if !ok {
+					return fmt.Errorf("output profile %s: unknown unit %q for %s", name, unitName, sensorType)
+				}
+				if unit.dimension != canonical.dimension {
+					return fmt.Errorf("output profile %s: unit %q (%s) is incompatible with %s (%s)", name, unitName, unit.dimension, sensorType, canonical.code)
+				}
+				if unit.code != canonical.code {
+					profile.types[sensorType] = &unitConversion{from: unit, to: canonical}
+				}
+			}
+			profiles[name] = profile
+		}
+	}
+	gw.profiles = profiles
+	return nil
+}
+
+// outputProfile returns the profile a request asks for with ?units=, or nil
+// when values are served in the canonical units
+func (gw *Gateway) outputProfile(r *http.Request) (*outputProfile, error) {
+	name := r.FormValue("units")
+	if name == "" {
+		name = gw.settings.OutputProfiles.Default
+	}
+	profile, ok := gw.profiles[name]
+	if !ok {
+		names := make([]string, 0, len(gw.profiles))
+		for n := range gw.profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown units profile %q (known: %v)", name, names)
+	}
+	if len(profile.types) == 0 {
+		return nil, nil
+	}
+	return profile, nil
+}
+
+// convert converts a telemetry field or history metric from its canonical
+// unit
+func (p *outputProfile) convert(field string, v float64) float64 {
+	if p == nil {
+		return v
+	}
+	if c := p.types[telemetryFieldTypes[field]]; c != nil {
+		return c.fromCanonical(v)
+	}
+	return v
+}
+
+// unit returns the UCUM code a telemetry field is converted to, or an empty
+// string when the profile leaves it in its canonical unit
+func (p *outputProfile) unit(field string) string {
+	if p == nil {
+		return ""
+	}
+	if c := p.types[telemetryFieldTypes[field]]; c != nil {
+		return c.from.code
+	}
+	return ""
+}
+
+// convertReading returns a converted copy of a sensor reading; the reading
+// itself is shared with the gateway state and left untouched
+func (p *outputProfile) convertReading(reading *SensorReading) *SensorReading {
+	if p == nil || reading == nil {
+		return reading
+	}
+	c := p.types[reading.Type]
+	if c == nil || reading.StringValue != "" {
+		return reading
+	}
+	converted := *reading
+	converted.Value = c.fromCanonical(reading.Value)
+	converted.Unit = c.from.code
+	return &converted
+}
+
+// convertTelemetry re-encodes a JSON room telemetry payload with its fields
+// converted and a "units" object naming the unit of each converted field
+func (p *outputProfile) convertTelemetry(payload []byte) []byte {
+	if p == nil {
+		return payload
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	units := make(map[string]string)
+	for name, v := range fields {
+		f, ok := v.(float64)
+		if unit := p.unit(name); ok && unit != "" {
+			fields[name] = p.convert(name, f)
+			units[name] = unit
+		}
+	}
+	if len(units) == 0 {
+		return payload
+	}
+	fields["units"] = units
+	converted, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return converted
+}
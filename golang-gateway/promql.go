@@ -0,0 +1,1030 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryConfig tunes the PromQL-style query API (GET /api/v1/query and
+// /api/v1/query_range) over the in-memory telemetry history, which keeps
+// serving local dashboards and edge analytics while the WAN link is down.
+// Series are the numeric telemetry fields (temperature, co2_ppm, ...)
+// labelled with room, zone, floor and tenant.
+type QueryConfig struct {
+	// LookbackSec is how far back an instant selector looks for the
+	// latest sample, default 300
+	LookbackSec int `yaml:"lookback_sec,omitempty"`
+	// MaxPoints caps the steps of a range query, default 11000
+	MaxPoints int `yaml:"max_points,omitempty"`
+}
+
+func (c *QueryConfig) normalize() {
+	if c.LookbackSec <= 0 {
+		c.LookbackSec = 300
+	}
+	if c.MaxPoints <= 0 {
+		c.MaxPoints = 11000
+	}
+}
+
+// The supported subset: number literals, instant selectors with label
+// matchers (=, !=, =~, !~), range selectors inside the *_over_time, delta,
+// increase and rate functions, abs, the sum, avg, min, max and count
+// aggregations with by or without, and arithmetic and comparison operators
+// between vectors and scalars.
+type promExpr interface{}
+
+type promNumber struct {
+	value float64
+}
+
+type promSelector struct {
+	metric   string
+	matchers []promMatcher
+	window   time.Duration // range selectors only
+}
+
+type promMatcher struct {
+	label string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+type promCall struct {
+	function string
+	arg      promExpr
+}
+
+type promAggregate struct {
+	op      string
+	without bool
+	labels  []string
+	arg     promExpr
+}
+
+type promBinary struct {
+	op       string
+	lhs, rhs promExpr
+}
+
+// promRangeFunctions reduce the samples of a range selector
+var promRangeFunctions = map[string]func(values []float64, window time.Duration) float64{
+	"avg_over_time": func(values []float64, _ time.Duration) float64 { return promSum(values) / float64(len(values)) },
+	"sum_over_time": func(values []float64, _ time.Duration) float64 { return promSum(values) },
+	"min_over_time": func(values []float64, _ time.Duration) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Min(m, v)
+		}
+		return m
+	},
+	"max_over_time": func(values []float64, _ time.Duration) float64 {
+		m := values[0]
+		for _, v := range values[1:] {
+			m = math.Max(m, v)
+		}
+		return m
+	},
+	"count_over_time": func(values []float64, _ time.Duration) float64 { return float64(len(values)) },
+	"last_over_time":  func(values []float64, _ time.Duration) float64 { return values[len(values)-1] },
+	// delta is not extrapolated to the window edges
+	"delta":    func(values []float64, _ time.Duration) float64 { return values[len(values)-1] - values[0] },
+	"increase": func(values []float64, _ time.Duration) float64 { return promIncrease(values) },
+	"rate": func(values []float64, window time.Duration) float64 {
+		return promIncrease(values) / window.Seconds()
+	},
+}
+
+var promAggregations = map[string]bool{"sum": true, "avg": true, "min": true, "max": true, "count": true}
+
+var promBinaryPrecedence = map[string]int{
+	"==": 1, "!=": 1, ">": 1, "<": 1, ">=": 1, "<=": 1,
+	"+": 2, "-": 2,
+	"*": 3, "/": 3,
+}
+
+func promSum(values []float64) float64 {
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// promIncrease sums the rises of a counter such as energy, treating a drop
+// as a reset
+func promIncrease(values []float64) float64 {
+	increase := 0.0
+	for i := 1; i < len(values); i++ {
+		if values[i] >= values[i-1] {
+			increase += values[i] - values[i-1]
+		} else {
+			increase += values[i]
+		}
+	}
+	return increase
+}
+
+type promToken struct {
+	kind byte // 'i' identifier, 'n' number, 'd' duration, 's' string, 'o' operator, 0 end
+	text string
+}
+
+func lexPromQL(query string) ([]promToken, error) {
+	var tokens []promToken
+	isIdent := func(c byte, first bool) bool {
+		return c == '_' || c == ':' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+	}
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' || c == '.' }
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdent(c, true):
+			j := i + 1
+			for j < len(query) && isIdent(query[j], false) {
+				j++
+			}
+			tokens = append(tokens, promToken{'i', query[i:j]})
+			i = j
+		case isDigit(c):
+			j := i
+			for j < len(query) && isDigit(query[j]) {
+				j++
+			}
+			if j < len(query) && strings.IndexByte("smhdw", query[j]) >= 0 {
+				for j < len(query) && (isDigit(query[j]) || strings.IndexByte("smhdw", query[j]) >= 0) {
+					j++
+				}
+				tokens = append(tokens, promToken{'d', query[i:j]})
+			} else {
+				tokens = append(tokens, promToken{'n', query[i:j]})
+			}
+			i = j
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(query) && query[j] != c; j++ {
+				if query[j] == '\\' && j+1 < len(query) {
+					j++
+				}
+				b.WriteByte(query[j])
+			}
+			if j >= len(query) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			tokens = append(tokens, promToken{'s', b.String()})
+			i = j + 1
+		default:
+			if i+1 < len(query) {
+				switch op := query[i : i+2]; op {
+				case "==", "!=", ">=", "<=", "=~", "!~":
+					tokens = append(tokens, promToken{'o', op})
+					i += 2
+					continue
+				}
+			}
+			if strings.IndexByte("+-*/<>=(){}[],", c) < 0 {
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+			tokens = append(tokens, promToken{'o', string(c)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// Limits of a query: longer queries are rejected before lexing and deeper
+// nesting of parentheses, unary operators and operands while parsing, so a
+// hostile query cannot exhaust the stack
+const (
+	maxPromQueryBytes = 64 << 10
+	maxPromDepth      = 128
+)
+
+type promParser struct {
+	tokens []promToken
+	pos    int
+	depth  int
+}
+
+// parsePromQL parses a query of the supported subset
+func parsePromQL(query string) (promExpr, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("query is empty")
+	}
+	if len(query) > maxPromQueryBytes {
+		return nil, fmt.Errorf("query is longer than %d bytes", maxPromQueryBytes)
+	}
+	tokens, err := lexPromQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &promParser{tokens: tokens}
+	expr, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != 0 {
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	if err := checkPromExpr(expr, false); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func (p *promParser) peek() promToken {
+	if p.pos >= len(p.tokens) {
+		return promToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *promParser) next() promToken {
+	t := p.peek()
+	if p.pos < len(p.tokens) {
+		p.pos++
+	}
+	return t
+}
+
+func (p *promParser) expect(text string) error {
+	if t := p.next(); t.kind != 'o' || t.text != text {
+		if t.kind == 0 {
+			return fmt.Errorf("expected %q, got end of query", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, t.text)
+	}
+	return nil
+}
+
+func (p *promParser) parseExpr(minPrecedence int) (promExpr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		precedence, ok := promBinaryPrecedence[t.text]
+		if t.kind != 'o' || !ok || precedence <= minPrecedence {
+			return lhs, nil
+		}
+		p.next()
+		rhs, err := p.parseExpr(precedence)
+		if err != nil {
+			return nil, err
+		}
+		lhs = &promBinary{op: t.text, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *promParser) parseUnary() (promExpr, error) {
+	// Every nested expression passes through here
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxPromDepth {
+		return nil, fmt.Errorf("query is nested deeper than %d levels", maxPromDepth)
+	}
+	if t := p.peek(); t.kind == 'o' && (t.text == "-" || t.text == "+") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil || t.text == "+" {
+			return expr, err
+		}
+		if n, ok := expr.(*promNumber); ok {
+			return &promNumber{value: -n.value}, nil
+		}
+		return &promBinary{op: "*", lhs: &promNumber{value: -1}, rhs: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *promParser) parsePrimary() (promExpr, error) {
+	t := p.next()
+	switch {
+	case t.kind == 'n':
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t.text)
+		}
+		return &promNumber{value: v}, nil
+	case t.kind == 'o' && t.text == "(":
+		expr, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	case t.kind == 'o' && t.text == "{":
+		return nil, fmt.Errorf("a metric name is required before {")
+	case t.kind != 'i':
+		if t.kind == 0 {
+			return nil, fmt.Errorf("unexpected end of query")
+		}
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+
+	if promAggregations[t.text] {
+		return p.parseAggregate(t.text)
+	}
+	if next := p.peek(); next.kind == 'o' && next.text == "(" {
+		if _, ok := promRangeFunctions[t.text]; !ok && t.text != "abs" {
+			return nil, fmt.Errorf("unsupported function %s", t.text)
+		}
+		p.next()
+		arg, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		return &promCall{function: t.text, arg: arg}, p.expect(")")
+	}
+
+	sel := &promSelector{metric: t.text}
+	if next := p.peek(); next.kind == 'o' && next.text == "{" {
+		p.next()
+		for {
+			if next := p.peek(); next.kind == 'o' && next.text == "}" {
+				p.next()
+				break
+			}
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			sel.matchers = append(sel.matchers, m)
+			if next := p.peek(); next.kind == 'o' && next.text == "," {
+				p.next()
+			}
+		}
+	}
+	if next := p.peek(); next.kind == 'o' && next.text == "[" {
+		p.next()
+		d := p.next()
+		if d.kind != 'd' {
+			return nil, fmt.Errorf("expected a duration such as 5m in [], got %q", d.text)
+		}
+		window, err := parsePromDuration(d.text)
+		if err != nil {
+			return nil, err
+		}
+		sel.window = window
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return sel, nil
+}
+
+func (p *promParser) parseMatcher() (promMatcher, error) {
+	label := p.next()
+	if label.kind != 'i' {
+		return promMatcher{}, fmt.Errorf("expected a label name, got %q", label.text)
+	}
+	op := p.next()
+	if op.kind != 'o' || (op.text != "=" && op.text != "!=" && op.text != "=~" && op.text != "!~") {
+		return promMatcher{}, fmt.Errorf("expected =, !=, =~ or !~ after %s", label.text)
+	}
+	value := p.next()
+	if value.kind != 's' {
+		return promMatcher{}, fmt.Errorf("expected a quoted value for %s", label.text)
+	}
+	m := promMatcher{label: label.text, op: op.text, value: value.text}
+	if op.text == "=~" || op.text == "!~" {
+		re, err := regexp.Compile("^(?:" + value.text + ")$")
+		if err != nil {
+			return promMatcher{}, fmt.Errorf("invalid regular expression for %s: %w", label.text, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// parseAggregate parses op [by|without (labels)] (expr) [by|without (labels)]
+func (p *promParser) parseAggregate(op string) (promExpr, error) {
+	agg := &promAggregate{op: op}
+	grouping := func() error {
+		t := p.peek()
+		if t.kind != 'i' || (t.text != "by" && t.text != "without") {
+			return nil
+		}
+		p.next()
+		agg.without = t.text == "without"
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		for {
+			l := p.next()
+			if l.kind == 'o' && l.text == ")" {
+				return nil
+			}
+			if l.kind != 'i' {
+				return fmt.Errorf("expected a label name in %s, got %q", t.text, l.text)
+			}
+			agg.labels = append(agg.labels, l.text)
+			if next := p.peek(); next.kind == 'o' && next.text == "," {
+				p.next()
+			}
+		}
+	}
+	if err := grouping(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	agg.arg = arg
+	if len(agg.labels) == 0 && !agg.without {
+		if err := grouping(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+// checkPromExpr rejects range selectors outside range functions and range
+// functions without one
+func checkPromExpr(expr promExpr, inRangeFunction bool) error {
+	switch e := expr.(type) {
+	case *promSelector:
+		if e.window > 0 && !inRangeFunction {
+			return fmt.Errorf("range selector %s[...] is only valid inside a function such as avg_over_time", e.metric)
+		}
+		if e.window == 0 && inRangeFunction {
+			return fmt.Errorf("expected a range selector such as %s[5m]", e.metric)
+		}
+	case *promCall:
+		_, isRange := promRangeFunctions[e.function]
+		if _, ok := e.arg.(*promSelector); isRange && !ok {
+			return fmt.Errorf("%s expects a range selector such as temperature[5m]", e.function)
+		}
+		return checkPromExpr(e.arg, isRange)
+	case *promAggregate:
+		return checkPromExpr(e.arg, false)
+	case *promBinary:
+		if err := checkPromExpr(e.lhs, false); err != nil {
+			return err
+		}
+		return checkPromExpr(e.rhs, false)
+	}
+	return nil
+}
+
+// parsePromDuration parses durations such as 30s, 5m or 1h30m
+func parsePromDuration(s string) (time.Duration, error) {
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 || i == len(rest) {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, _ := strconv.Atoi(rest[:i])
+		unit := map[byte]time.Duration{'s': time.Second, 'm': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}[rest[i]]
+		if unit == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		total += time.Duration(n) * unit
+		rest = rest[i+1:]
+	}
+	if total <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return total, nil
+}
+
+// maxPromWindow is the longest range selector in an expression
+func maxPromWindow(expr promExpr) time.Duration {
+	switch e := expr.(type) {
+	case *promSelector:
+		return e.window
+	case *promCall:
+		return maxPromWindow(e.arg)
+	case *promAggregate:
+		return maxPromWindow(e.arg)
+	case *promBinary:
+		return max(maxPromWindow(e.lhs), maxPromWindow(e.rhs))
+	}
+	return 0
+}
+
+type promSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// promResult is a scalar or an instant vector
+type promResult struct {
+	scalar bool
+	value  float64
+	vector []promSample
+}
+
+// promRoom is the history of one room visible to the caller, loaded once
+// per query
+type promRoom struct {
+	labels map[string]string
+	points []historyPoint
+}
+
+type promEvaluator struct {
+	rooms    []promRoom
+	lookback time.Duration
+	profile  *outputProfile
+}
+
+// newPromEvaluator loads the history of the caller's rooms needed to
+// evaluate expr between start and end; selected values are converted to
+// profile's units
+func (gw *Gateway) newPromEvaluator(r *http.Request, expr promExpr, start, end time.Time, profile *outputProfile) *promEvaluator {
+	ev := &promEvaluator{lookback: time.Duration(gw.settings.Query.LookbackSec) * time.Second, profile: profile}
+	from := start.Add(-max(ev.lookback, maxPromWindow(expr)))
+	ids := make([]string, 0, len(gw.rooms))
+	for id := range gw.rooms {
+		if gw.roomAllowed(r, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		room := gw.rooms[id]
+		labels := map[string]string{"room": id, "floor": strconv.Itoa(room.Floor)}
+		if room.Zone != "" {
+			labels["zone"] = room.Zone
+		}
+		if room.Tenant != "" {
+			labels["tenant"] = room.Tenant
+		}
+		ev.rooms = append(ev.rooms, promRoom{labels: labels, points: gw.history.query(id, from, end.Add(time.Nanosecond))})
+	}
+	return ev
+}
+
+func (m promMatcher) matches(labels map[string]string) bool {
+	v := labels[m.label]
+	switch m.op {
+	case "=":
+		return v == m.value
+	case "!=":
+		return v != m.value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// series returns the values of a selector's series in (t-window, t], in
+// time order
+func (ev *promEvaluator) series(sel *promSelector, t time.Time, window time.Duration) []promSeries {
+	var out []promSeries
+	for _, room := range ev.rooms {
+		labels := map[string]string{"__name__": sel.metric}
+		for k, v := range room.labels {
+			labels[k] = v
+		}
+		matched := true
+		for _, m := range sel.matchers {
+			matched = matched && m.matches(labels)
+		}
+		if !matched {
+			continue
+		}
+		var values []float64
+		for _, p := range room.points {
+			if !p.at.After(t.Add(-window)) || p.at.After(t) {
+				continue
+			}
+			if v, ok := p.metrics[sel.metric]; ok {
+				values = append(values, ev.profile.convert(sel.metric, v))
+			}
+		}
+		if len(values) > 0 {
+			out = append(out, promSeries{labels: labels, values: values})
+		}
+	}
+	return out
+}
+
+type promSeries struct {
+	labels map[string]string
+	values []float64
+}
+
+// eval evaluates an expression at t
+func (ev *promEvaluator) eval(expr promExpr, t time.Time) (promResult, error) {
+	switch e := expr.(type) {
+	case *promNumber:
+		return promResult{scalar: true, value: e.value}, nil
+	case *promSelector:
+		var vector []promSample
+		for _, s := range ev.series(e, t, ev.lookback) {
+			vector = append(vector, promSample{labels: s.labels, value: s.values[len(s.values)-1]})
+		}
+		return promResult{vector: vector}, nil
+	case *promCall:
+		if reduce, ok := promRangeFunctions[e.function]; ok {
+			sel := e.arg.(*promSelector)
+			var vector []promSample
+			for _, s := range ev.series(sel, t, sel.window) {
+				vector = append(vector, promSample{labels: withoutMetricName(s.labels), value: reduce(s.values, sel.window)})
+			}
+			return promResult{vector: vector}, nil
+		}
+		arg, err := ev.eval(e.arg, t)
+		if err != nil {
+			return promResult{}, err
+		}
+		if arg.scalar {
+			return promResult{scalar: true, value: math.Abs(arg.value)}, nil
+		}
+		for i := range arg.vector {
+			arg.vector[i] = promSample{labels: withoutMetricName(arg.vector[i].labels), value: math.Abs(arg.vector[i].value)}
+		}
+		return arg, nil
+	case *promAggregate:
+		arg, err := ev.eval(e.arg, t)
+		if err != nil {
+			return promResult{}, err
+		}
+		if arg.scalar {
+			return promResult{}, fmt.Errorf("%s expects a vector, got a scalar", e.op)
+		}
+		return promResult{vector: aggregatePromSamples(e, arg.vector)}, nil
+	case *promBinary:
+		lhs, err := ev.eval(e.lhs, t)
+		if err != nil {
+			return promResult{}, err
+		}
+		rhs, err := ev.eval(e.rhs, t)
+		if err != nil {
+			return promResult{}, err
+		}
+		return applyPromBinary(e.op, lhs, rhs)
+	}
+	return promResult{}, fmt.Errorf("unsupported expression")
+}
+
+func withoutMetricName(labels map[string]string) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if k != "__name__" {
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// promLabelsKey identifies a label set
+func promLabelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+func aggregatePromSamples(agg *promAggregate, samples []promSample) []promSample {
+	listed := make(map[string]bool, len(agg.labels))
+	for _, l := range agg.labels {
+		listed[l] = true
+	}
+	type group struct {
+		labels map[string]string
+		values []float64
+	}
+	groups := make(map[string]*group)
+	var order []string
+	for _, s := range samples {
+		labels := make(map[string]string)
+		for k, v := range s.labels {
+			if k != "__name__" && listed[k] != agg.without {
+				labels[k] = v
+			}
+		}
+		key := promLabelsKey(labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.value)
+	}
+	out := make([]promSample, 0, len(order))
+	for _, key := range order {
+		g := groups[key]
+		var v float64
+		switch agg.op {
+		case "sum":
+			v = promSum(g.values)
+		case "avg":
+			v = promSum(g.values) / float64(len(g.values))
+		case "min":
+			v = promRangeFunctions["min_over_time"](g.values, 0)
+		case "max":
+			v = promRangeFunctions["max_over_time"](g.values, 0)
+		case "count":
+			v = float64(len(g.values))
+		}
+		out = append(out, promSample{labels: g.labels, value: v})
+	}
+	return out
+}
+
+// applyPromBinary applies an operator between scalars and vectors. Vector
+// operands are matched one-to-one on their labels; comparisons filter the
+// left-hand samples.
+func applyPromBinary(op string, lhs, rhs promResult) (promResult, error) {
+	comparison := promBinaryPrecedence[op] == 1
+	if lhs.scalar && rhs.scalar {
+		if comparison {
+			return promResult{}, fmt.Errorf("comparisons between two scalars are not supported")
+		}
+		v, _ := promOperate(op, lhs.value, rhs.value)
+		return promResult{scalar: true, value: v}, nil
+	}
+	var out []promSample
+	emit := func(s promSample, l, r float64) {
+		v, keep := promOperate(op, l, r)
+		if !keep {
+			return
+		}
+		if comparison {
+			out = append(out, s)
+			return
+		}
+		out = append(out, promSample{labels: withoutMetricName(s.labels), value: v})
+	}
+	switch {
+	case rhs.scalar:
+		for _, s := range lhs.vector {
+			emit(s, s.value, rhs.value)
+		}
+	case lhs.scalar:
+		for _, s := range rhs.vector {
+			emit(s, lhs.value, s.value)
+		}
+	default:
+		right := make(map[string]promSample, len(rhs.vector))
+		for _, s := range rhs.vector {
+			right[promLabelsKey(withoutMetricName(s.labels))] = s
+		}
+		for _, s := range lhs.vector {
+			if r, ok := right[promLabelsKey(withoutMetricName(s.labels))]; ok {
+				emit(s, s.value, r.value)
+			}
+		}
+	}
+	return promResult{vector: out}, nil
+}
+
+// promOperate returns the result of an arithmetic operator, or for a
+// comparison its left operand and whether the comparison holds
+func promOperate(op string, l, r float64) (float64, bool) {
+	switch op {
+	case "+":
+		return l + r, true
+	case "-":
+		return l - r, true
+	case "*":
+		return l * r, true
+	case "/":
+		return l / r, true
+	case "==":
+		return l, l == r
+	case "!=":
+		return l, l != r
+	case ">":
+		return l, l > r
+	case "<":
+		return l, l < r
+	case ">=":
+		return l, l >= r
+	default:
+		return l, l <= r
+	}
+}
+
+// promSamplePair is a [unix seconds, "value"] pair as in the Prometheus
+// HTTP API
+func promSamplePair(t time.Time, v float64) [2]interface{} {
+	var text string
+	switch {
+	case math.IsNaN(v):
+		text = "NaN"
+	case math.IsInf(v, 1):
+		text = "+Inf"
+	case math.IsInf(v, -1):
+		text = "-Inf"
+	default:
+		text = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return [2]interface{}{float64(t.UnixMilli()) / 1000, text}
+}
+
+// parsePromTime parses unix seconds or RFC 3339, returning def when empty
+func parsePromTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.UnixMilli(int64(math.Round(f * 1000))), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType, message string) {
+	writeJSON(w, status, map[string]string{"status": "error", "errorType": errorType, "error": message})
+}
+
+func writePromData(w http.ResponseWriter, resultType string, result interface{}) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": resultType, "result": result},
+	})
+}
+
+// parsePromForm parses the parameters of a query request, with the body of
+// a POST capped at maxPromQueryBytes
+func parsePromForm(w http.ResponseWriter, r *http.Request) error {
+	if r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, maxPromQueryBytes)
+	}
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return fmt.Errorf("request body is larger than %d bytes", maxPromQueryBytes)
+		}
+		return fmt.Errorf("invalid parameters: %w", err)
+	}
+	return nil
+}
+
+// handlePromQuery serves GET or POST /api/v1/query?query=&time=, an instant
+// query answered in the Prometheus HTTP API format so dashboards can use the
+// gateway as a Prometheus data source; time defaults to now and units
+// selects an output profile
+func (gw *Gateway) handlePromQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writePromError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	if err := parsePromForm(w, r); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	expr, err := parsePromQL(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid query: "+err.Error())
+		return
+	}
+	t, err := parsePromTime(r.FormValue("time"), time.Now())
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid time: "+err.Error())
+		return
+	}
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	result, err := gw.newPromEvaluator(r, expr, t, t, profile).eval(expr, t)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+		return
+	}
+	if result.scalar {
+		writePromData(w, "scalar", promSamplePair(t, result.value))
+		return
+	}
+	type sample struct {
+		Metric map[string]string `json:"metric"`
+		Value  [2]interface{}    `json:"value"`
+	}
+	vector := make([]sample, 0, len(result.vector))
+	for _, s := range result.vector {
+		vector = append(vector, sample{Metric: s.labels, Value: promSamplePair(t, s.value)})
+	}
+	writePromData(w, "vector", vector)
+}
+
+// handlePromQueryRange serves GET or POST
+// /api/v1/query_range?query=&start=&end=&step=, evaluating the query at
+// every step between start and end (default the last hour); step is a
+// duration such as 1m or a number of seconds, default the history
+// resolution; units selects an output profile
+func (gw *Gateway) handlePromQueryRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writePromError(w, http.StatusMethodNotAllowed, "bad_data", "method not allowed")
+		return
+	}
+	if err := parsePromForm(w, r); err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	expr, err := parsePromQL(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid query: "+err.Error())
+		return
+	}
+	end, err := parsePromTime(r.FormValue("end"), time.Now())
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid end: "+err.Error())
+		return
+	}
+	start, err := parsePromTime(r.FormValue("start"), end.Add(-time.Hour))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", "invalid start: "+err.Error())
+		return
+	}
+	if end.Before(start) {
+		writePromError(w, http.StatusBadRequest, "bad_data", "end must not be before start")
+		return
+	}
+	step := time.Duration(gw.settings.History.ResolutionSec) * time.Second
+	if s := r.FormValue("step"); s != "" {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			step = time.Duration(f * float64(time.Second))
+		} else if step, err = parsePromDuration(s); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", "invalid step: "+err.Error())
+			return
+		}
+	}
+	if step <= 0 {
+		writePromError(w, http.StatusBadRequest, "bad_data", "step must be positive")
+		return
+	}
+	profile, err := gw.outputProfile(r)
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err.Error())
+		return
+	}
+	if points := int(end.Sub(start)/step) + 1; points > gw.settings.Query.MaxPoints {
+		writePromError(w, http.StatusBadRequest, "bad_data",
+			fmt.Sprintf("query would return %d points per series, more than max_points %d; increase step", points, gw.settings.Query.MaxPoints))
+		return
+	}
+
+	type series struct {
+		Metric map[string]string `json:"metric"`
+		Values [][2]interface{}  `json:"values"`
+	}
+	ev := gw.newPromEvaluator(r, expr, start, end, profile)
+	matrix := make(map[string]*series)
+	for t := start; !t.After(end); t = t.Add(step) {
+		result, err := ev.eval(expr, t)
+		if err != nil {
+			writePromError(w, http.StatusUnprocessableEntity, "execution", err.Error())
+			return
+		}
+		if result.scalar {
+			result.vector = []promSample{{labels: map[string]string{}, value: result.value}}
+		}
+		for _, s := range result.vector {
+			key := promLabelsKey(s.labels)
+			if matrix[key] == nil {
+				matrix[key] = &series{Metric: s.labels}
+			}
+			matrix[key].Values = append(matrix[key].Values, promSamplePair(t, s.value))
+		}
+	}
+	keys := make([]string, 0, len(matrix))
+	for key := range matrix {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, matrix[key])
+	}
+	writePromData(w, "matrix", result)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// formatPromExpr renders a parsed expression fully parenthesized so the
+// parse tree can be compared as a string
+func formatPromExpr(expr promExpr) string {
+	switch e := expr.(type) {
+	case *promNumber:
+		return fmt.Sprint(e.value)
+	case *promSelector:
+		var b strings.Builder
+		b.WriteString(e.metric)
+		if len(e.matchers) > 0 {
+			parts := make([]string, len(e.matchers))
+			for i, m := range e.matchers {
+				parts[i] = fmt.Sprintf("%s%s%q", m.label, m.op, m.value)
+			}
+			b.WriteString("{" + strings.Join(parts, ",") + "}")
+		}
+		if e.window > 0 {
+			b.WriteString("[" + e.window.String() + "]")
+		}
+		return b.String()
+	case *promCall:
+		return e.function + "(" + formatPromExpr(e.arg) + ")"
+	case *promAggregate:
+		grouping := "by"
+		if e.without {
+			grouping = "without"
+		}
+		return fmt.Sprintf("%s %s(%s) (%s)", e.op, grouping, strings.Join(e.labels, ","), formatPromExpr(e.arg))
+	case *promBinary:
+		return "(" + formatPromExpr(e.lhs) + " " + e.op + " " + formatPromExpr(e.rhs) + ")"
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"temperature", "temperature"},
+		{`temperature{room="101", floor!='1'}`, `temperature{room="101",floor!="1"}`},
+		{`temperature{room=~"1.*"}`, `temperature{room=~"1.*"}`},
+		{`temperature{room="a\"b"}`, `temperature{room="a\"b"}`},
+		{"avg_over_time(temperature[5m])", "avg_over_time(temperature[5m0s])"},
+		{"rate(energy_kwh[1h30m])", "rate(energy_kwh[1h30m0s])"},
+		{"abs(temperature - 21)", "abs((temperature - 21))"},
+		{"sum by (floor) (co2)", "sum by(floor) (co2)"},
+		{"avg(co2) without (room)", "avg without(room) (co2)"},
+		{"1 + 2 * 3", "(1 + (2 * 3))"},
+		{"(1 + 2) * 3", "((1 + 2) * 3)"},
+		{"10 - 4 - 3", "((10 - 4) - 3)"},
+		{"temperature > 20 + 1", "(temperature > (20 + 1))"},
+		{"-temperature", "(-1 * temperature)"},
+		{"-2.5", "-2.5"},
+		{"+humidity", "humidity"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parsePromQL(tt.query)
+			if err != nil {
+				t.Fatalf("parsePromQL() = %v", err)
+			}
+			if got := formatPromExpr(expr); got != tt.want {
+				t.Fatalf("parsePromQL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePromQLErrors(t *testing.T) {
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"", "empty"},
+		{"   ", "empty"},
+		{strings.Repeat("a", maxPromQueryBytes+1), "longer than"},
+		{strings.Repeat("(", maxPromDepth+1) + "1" + strings.Repeat(")", maxPromDepth+1), "nested deeper"},
+		{strings.Repeat("-", maxPromDepth+1) + "1", "nested deeper"},
+		{`temperature{room="101}`, "unterminated string"},
+		{"temperature # comment", "unexpected character"},
+		{"{room=\"101\"}", "metric name is required"},
+		{"temperature[5m]", "only valid inside a function"},
+		{"avg_over_time(temperature)", "expected a range selector"},
+		{"avg_over_time(temperature[5m] + 1)", "expects a range selector"},
+		{"sum(temperature[5m])", "only valid inside a function"},
+		{"histogram_quantile(0.9, latency)", "unsupported function"},
+		{"temperature[5]", "expected a duration"},
+		{"temperature[5m", `expected "]"`},
+		{"(temperature", "end of query"},
+		{"temperature 1", `unexpected "1"`},
+		{"1 +", "unexpected end of query"},
+		{`temperature{room=101}`, "quoted value"},
+		{`temperature{room~"1"}`, "unexpected character"},
+		{`temperature{room=~"("}`, "invalid regular expression"},
+		{"sum by (1) (co2)", "expected a label name"},
+	}
+	for _, tt := range tests {
+		name := tt.query
+		if len(name) > 40 {
+			name = name[:40]
+		}
+		t.Run(name, func(t *testing.T) {
+			_, err := parsePromQL(tt.query)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("parsePromQL() = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParsePromDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"30s", 30 * time.Second, true},
+		{"5m", 5 * time.Minute, true},
+		{"1h30m", 90 * time.Minute, true},
+		{"2d", 48 * time.Hour, true},
+		{"1w", 7 * 24 * time.Hour, true},
+		{"0m", 0, false},
+		{"5", 0, false},
+		{"m", 0, false},
+		{"5x", 0, false},
+		{"1.5h", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parsePromDuration(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parsePromDuration(%q) = %v, %v, want %v (ok=%v)", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMaxPromWindow(t *testing.T) {
+	expr, err := parsePromQL("avg_over_time(temperature[5m]) - max_over_time(temperature[1h]) + 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := maxPromWindow(expr); got != time.Hour {
+		t.Fatalf("maxPromWindow() = %v, want 1h", got)
+	}
+}
+
+func TestPromRangeFunctions(t *testing.T) {
+	// A counter that resets after 30
+	values := []float64{10, 20, 30, 5, 15}
+	tests := []struct {
+		function string
+		want     float64
+	}{
+		{"avg_over_time", 16},
+		{"sum_over_time", 80},
+		{"min_over_time", 5},
+		{"max_over_time", 30},
+		{"count_over_time", 5},
+		{"last_over_time", 15},
+		{"delta", 5},
+		{"increase", 35},
+		{"rate", 35.0 / 60},
+	}
+	for _, tt := range tests {
+		if got := promRangeFunctions[tt.function](values, time.Minute); got != tt.want {
+			t.Errorf("%s() = %v, want %v", tt.function, got, tt.want)
+		}
+	}
+}
+
+func TestAggregatePromSamples(t *testing.T) {
+	samples := []promSample{
+		{labels: map[string]string{"__name__": "co2", "room": "101", "floor": "1"}, value: 400},
+		{labels: map[string]string{"__name__": "co2", "room": "102", "floor": "1"}, value: 600},
+		{labels: map[string]string{"__name__": "co2", "room": "201", "floor": "2"}, value: 800},
+	}
+	tests := []struct {
+		agg  promAggregate
+		want map[string]float64 // floor label -> value
+	}{
+		{promAggregate{op: "sum", labels: []string{"floor"}}, map[string]float64{"1": 1000, "2": 800}},
+		{promAggregate{op: "avg", labels: []string{"floor"}}, map[string]float64{"1": 500, "2": 800}},
+		{promAggregate{op: "max", without: true, labels: []string{"room"}}, map[string]float64{"1": 600, "2": 800}},
+		{promAggregate{op: "count"}, map[string]float64{"": 3}},
+		{promAggregate{op: "min"}, map[string]float64{"": 400}},
+	}
+	for _, tt := range tests {
+		got := aggregatePromSamples(&tt.agg, samples)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d groups, want %d", tt.agg.op, len(got), len(tt.want))
+			continue
+		}
+		for _, s := range got {
+			if _, ok := s.labels["room"]; ok {
+				t.Errorf("%s: room label kept in %v", tt.agg.op, s.labels)
+			}
+			if want, ok := tt.want[s.labels["floor"]]; !ok || s.value != want {
+				t.Errorf("%s: group %v = %v, want %v", tt.agg.op, s.labels, s.value, want)
+			}
+		}
+	}
+}
+
+func TestApplyPromBinary(t *testing.T) {
+	temperature := promResult{vector: []promSample{
+		{labels: map[string]string{"__name__": "temperature", "room": "101"}, value: 19},
+		{labels: map[string]string{"__name__": "temperature", "room": "102"}, value: 23},
+	}}
+	setpoint := promResult{vector: []promSample{
+		{labels: map[string]string{"__name__": "setpoint", "room": "101"}, value: 21},
+		{labels: map[string]string{"__name__": "setpoint", "room": "103"}, value: 21},
+	}}
+	scalar := func(v float64) promResult { return promResult{scalar: true, value: v} }
+
+	t.Run("scalars", func(t *testing.T) {
+		got, err := applyPromBinary("*", scalar(2), scalar(3))
+		if err != nil || !got.scalar || got.value != 6 {
+			t.Fatalf("2 * 3 = %+v, %v", got, err)
+		}
+		if _, err := applyPromBinary(">", scalar(2), scalar(3)); err == nil {
+			t.Fatal("scalar comparison accepted")
+		}
+	})
+
+	t.Run("vector and scalar", func(t *testing.T) {
+		got, _ := applyPromBinary("-", temperature, scalar(20))
+		if len(got.vector) != 2 || got.vector[0].value != -1 || got.vector[1].value != 3 {
+			t.Fatalf("temperature - 20 = %+v", got.vector)
+		}
+		if _, ok := got.vector[0].labels["__name__"]; ok {
+			t.Fatal("arithmetic kept the metric name")
+		}
+		got, _ = applyPromBinary("-", scalar(30), temperature)
+		if got.vector[0].value != 11 {
+			t.Fatalf("30 - temperature = %+v", got.vector)
+		}
+	})
+
+	t.Run("comparison filters", func(t *testing.T) {
+		got, _ := applyPromBinary(">", temperature, scalar(20))
+		if len(got.vector) != 1 || got.vector[0].labels["room"] != "102" || got.vector[0].value != 23 {
+			t.Fatalf("temperature > 20 = %+v", got.vector)
+		}
+		if got.vector[0].labels["__name__"] != "temperature" {
+			t.Fatal("comparison dropped the metric name")
+		}
+	})
+
+	t.Run("vectors match on labels", func(t *testing.T) {
+		got, _ := applyPromBinary("-", temperature, setpoint)
+		if len(got.vector) != 1 || got.vector[0].labels["room"] != "101" || got.vector[0].value != -2 {
+			t.Fatalf("temperature - setpoint = %+v", got.vector)
+		}
+	})
+}
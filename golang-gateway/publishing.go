@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PublishConfig overrides the telemetry publish interval per zone. A room's
+// own publish_interval_ms in rooms.yaml takes precedence over its zone's;
+// rooms without either publish at the default interval, the shortest sensor
+// poll interval.
+type PublishConfig struct {
+	Zones []ZonePublishConfig `yaml:"zones"`
+}
+
+type ZonePublishConfig struct {
+	Zone       string `yaml:"zone"`
+	IntervalMs int    `yaml:"interval_ms"`
+}
+
+func (c *PublishConfig) normalize() error {
+	seen := make(map[string]bool, len(c.Zones))
+	for _, z := range c.Zones {
+		if z.Zone == "" {
+			return fmt.Errorf("publish zone entry without zone")
+		}
+		if seen[z.Zone] {
+			return fmt.Errorf("publish zone %s is listed twice", z.Zone)
+		}
+		seen[z.Zone] = true
+		if z.IntervalMs <= 0 {
+			return fmt.Errorf("publish zone %s needs a positive interval_ms", z.Zone)
+		}
+	}
+	return nil
+}
+
+// publishSchedule publishes each room every n-th tick of a base interval,
+// the greatest common divisor of the room intervals
+type publishSchedule struct {
+	tick  time.Duration
+	every map[string]int
+
+	// latest holds each room's last telemetry before privacy suppression,
+	// so occupancy aggregates still cover rooms that are not due
+	mu     sync.Mutex
+	latest map[string]RoomTelemetry
+}
+
+// roomPublishInterval resolves a room's publish interval: room override,
+// then zone override, then the default telemetry interval
+func (gw *Gateway) roomPublishInterval(room *RoomConfig) time.Duration {
+	if room.PublishIntervalMs > 0 {
+		return time.Duration(room.PublishIntervalMs) * time.Millisecond
+	}
+	for _, z := range gw.settings.Publish.Zones {
+		if z.Zone == room.Zone {
+			return time.Duration(z.IntervalMs) * time.Millisecond
+		}
+	}
+	return gw.telemetryInterval
+}
+
+func (gw *Gateway) configurePublishSchedule() {
+	intervals := make(map[string]int64, len(gw.rooms))
+	var base int64
+	for roomID, room := range gw.rooms {
+		ms := gw.roomPublishInterval(room).Milliseconds()
+		if ms <= 0 {
+			ms = 1
+		}
+		intervals[roomID] = ms
+		base = gcd(base, ms)
+	}
+	if base == 0 {
+		base = gw.telemetryInterval.Milliseconds()
+	}
+
+	schedule := &publishSchedule{
+		tick:   time.Duration(base) * time.Millisecond,
+		every:  make(map[string]int, len(intervals)),
+		latest: make(map[string]RoomTelemetry, len(intervals)),
+	}
+	ids := make([]string, 0, len(intervals))
+	for roomID, ms := range intervals {
+		schedule.every[roomID] = int(ms / base)
+		ids = append(ids, roomID)
+	}
+	sort.Strings(ids)
+	for _, roomID := range ids {
+		if interval := time.Duration(intervals[roomID]) * time.Millisecond; interval != gw.telemetryInterval {
+			log.Printf("Room %s publishes every %v", roomID, interval)
+		}
+	}
+	gw.schedule = schedule
+}
+
+// due returns the rooms to publish on the given tick, counted from zero
+func (s *publishSchedule) due(tick int) []string {
+	rooms := make([]string, 0, len(s.every))
+	for roomID, every := range s.every {
+		if tick%every == 0 {
+			rooms = append(rooms, roomID)
+		}
+	}
+	return rooms
+}
+
+// withLatest records the telemetries of the due rooms and returns them
+// together with copies of the last telemetry of every other room
+func (s *publishSchedule) withLatest(telemetries []*RoomTelemetry) []*RoomTelemetry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := make(map[string]bool, len(telemetries))
+	for _, telemetry := range telemetries {
+		s.latest[telemetry.RoomID] = *telemetry
+		due[telemetry.RoomID] = true
+	}
+	all := append(make([]*RoomTelemetry, 0, len(s.latest)), telemetries...)
+	for roomID, telemetry := range s.latest {
+		if !due[roomID] {
+			copied := telemetry
+			all = append(all, &copied)
+		}
+	}
+	return all
+}
+
+// forget drops the last telemetry of a room that stopped publishing
+func (s *publishSchedule) forget(roomID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.latest, roomID)
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
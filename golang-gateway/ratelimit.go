@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits how often each client may call the HTTP API and
+// send MQTT commands, so a runaway automation script cannot hammer field
+// devices. API clients are identified by their authenticated principal (or
+// remote address when auth is disabled). Commands are limited per target
+// point: the gateway cannot see which broker client sent them, and a key
+// taken from the payload could be changed by the sender at will.
+type RateLimitConfig struct {
+	API      RateLimit `yaml:"api"`
+	Commands RateLimit `yaml:"commands"`
+}
+
+// RateLimit is a token bucket per client: RatePerSec sustained, bursts of up
+// to Burst. A zero rate disables the limit.
+type RateLimit struct {
+	RatePerSec float64 `yaml:"rate_per_sec"`
+	Burst      int     `yaml:"burst"`
+}
+
+func (c *RateLimitConfig) normalize() {
+	for _, l := range []*RateLimit{&c.API, &c.Commands} {
+		if l.RatePerSec > 0 && l.Burst <= 0 {
+			l.Burst = int(math.Ceil(l.RatePerSec))
+		}
+	}
+}
+
+// maxIdleBuckets bounds the per-client buckets; full buckets are pruned
+// beyond it
+const maxIdleBuckets = 1024
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds the token buckets and counters of one interface
+type rateLimiter struct {
+	name     string
+	config   RateLimit
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	allowed  map[string]uint64
+	rejected map[string]uint64
+}
+
+func newRateLimiter(name string, config RateLimit) *rateLimiter {
+	return &rateLimiter{
+		name:     name,
+		config:   config,
+		buckets:  make(map[string]*tokenBucket),
+		allowed:  make(map[string]uint64),
+		rejected: make(map[string]uint64),
+	}
+}
+
+// allow takes a token for client and, when none is left, returns how long
+// the client should wait before retrying
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	if l.config.RatePerSec <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.config.Burst)
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.config.RatePerSec)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		l.allowed[client]++
+		return true, 0
+	}
+	l.rejected[client]++
+	if l.rejected[client]%100 == 1 {
+		log.Printf("[WARN] Rate limit exceeded on %s by %s (%d rejected)", l.name, client, l.rejected[client])
+	}
+	wait := time.Duration((1 - b.tokens) / l.config.RatePerSec * float64(time.Second))
+	return false, wait
+}
+
+// pruneLocked drops buckets that have refilled completely, with their
+// counters, so neither grows with every client ever seen
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	burst := float64(l.config.Burst)
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.config.RatePerSec >= burst {
+			delete(l.buckets, client)
+			delete(l.allowed, client)
+			delete(l.rejected, client)
+		}
+	}
+}
+
+func (l *rateLimiter) writePrometheus(b *strings.Builder) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	clients := make([]string, 0, len(l.allowed)+len(l.rejected))
+	seen := make(map[string]bool)
+	for _, m := range []map[string]uint64{l.allowed, l.rejected} {
+		for client := range m {
+			if !seen[client] {
+				seen[client] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		fmt.Fprintf(b, "gateway_rate_limit_allowed_total{interface=%q,client=%q} %d\n", l.name, client, l.allowed[client])
+		fmt.Fprintf(b, "gateway_rate_limit_rejected_total{interface=%q,client=%q} %d\n", l.name, client, l.rejected[client])
+	}
+}
+
+// rateLimits groups the limiters of the API and command interfaces
+type rateLimits struct {
+	api      *rateLimiter
+	commands *rateLimiter
+}
+
+func newRateLimits(config *RateLimitConfig) *rateLimits {
+	return &rateLimits{
+		api:      newRateLimiter("api", config.API),
+		commands: newRateLimiter("commands", config.Commands),
+	}
+}
+
+func (r *rateLimits) writePrometheus(b *strings.Builder) {
+	b.WriteString("# HELP gateway_rate_limit_allowed_total Requests admitted by the per-client rate limit.\n")
+	b.WriteString("# TYPE gateway_rate_limit_allowed_total counter\n")
+	b.WriteString("# HELP gateway_rate_limit_rejected_total Requests rejected by the per-client rate limit.\n")
+	b.WriteString("# TYPE gateway_rate_limit_rejected_total counter\n")
+	r.api.writePrometheus(b)
+	r.commands.writePrometheus(b)
+}
+
+type principalKey struct{}
+
+// apiClient identifies the caller for rate limiting: the authenticated
+// principal when there is one, otherwise the remote address
+func apiClient(r *http.Request) string {
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return p.name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// rateLimited wraps an API handler with the per-client API limit; rejected
+// requests get 429 with a Retry-After header
+func (gw *Gateway) rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := gw.limits.api.allow(apiClient(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
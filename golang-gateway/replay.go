@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/types"
+)
+
+// ReplayConfig configures the replay driver used by sensors with protocol
+// "replay". Values come from a recorded trace instead of the field bus, so
+// control logic, alarms and the bridge can be exercised deterministically
+// against real building behavior.
+//
+// The trace is CSV, Parquet or JSON lines (by File extension, or Format).
+// CSV and Parquet are either long (timestamp, sensor_id, value[,
+// string_value] columns) or wide (a timestamp column and one column per
+// sensor); JSON lines use the sensor reading fields timestamp, sensor_id,
+// value and string_value. A sensor
+// reads the trace series named by its address, or its ID when the address
+// is empty.
+type ReplayConfig struct {
+	File   string `yaml:"file"`
+	Format string `yaml:"format,omitempty"`
+	// Speed scales trace time: 1 replays in real time, 60 replays an hour
+	// per minute
+	Speed float64 `yaml:"speed"`
+	// Loop restarts the trace at its end instead of holding the last values
+	Loop bool `yaml:"loop"`
+}
+
+func (c *ReplayConfig) normalize() error {
+	if c.Speed <= 0 {
+		c.Speed = 1
+	}
+	if c.Format == "" && c.File != "" {
+		switch ext := strings.ToLower(filepath.Ext(c.File)); ext {
+		case ".csv":
+			c.Format = "csv"
+		case ".parquet":
+			c.Format = "parquet"
+		case ".jsonl", ".json", ".ndjson":
+			c.Format = "jsonl"
+		default:
+			return fmt.Errorf("replay: cannot tell the format of %s from its extension %q; set format to csv, parquet or jsonl", c.File, ext)
+		}
+	}
+	switch c.Format {
+	case "", "csv", "parquet", "jsonl":
+	default:
+		return fmt.Errorf("replay: unsupported format %q (csv, parquet or jsonl)", c.Format)
+	}
+	return nil
+}
+
+type replaySample struct {
+	at    time.Time
+	value float64
+	text  string
+}
+
+// replayDriver maps wall-clock time onto trace time and returns the latest
+// sample of each series at that point
+type replayDriver struct {
+	config   *ReplayConfig
+	series   map[string][]replaySample
+	start    time.Time // first trace timestamp
+	length   time.Duration
+	started  time.Time // wall-clock start of the replay
+	mu       sync.Mutex
+	finished bool
+}
+
+func (gw *Gateway) setupReplay() error {
+	used := false
+	for _, sensor := range gw.sensors {
+		if sensor.Protocol == "replay" {
+			used = true
+			break
+		}
+	}
+	if !used {
+		return nil
+	}
+	if gw.settings.Replay.File == "" {
+		return fmt.Errorf("sensors use the replay protocol but replay.file is not set")
+	}
+	driver, err := newReplayDriver(&gw.settings.Replay, time.Now())
+	if err != nil {
+		return err
+	}
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol == "replay" {
+			if _, ok := driver.series[replaySeries(sensor)]; !ok {
+				log.Printf("[WARN] Replay trace has no series %s for sensor %s", replaySeries(sensor), id)
+			}
+		}
+	}
+	gw.replay = driver
+	return nil
+}
+
+func newReplayDriver(config *ReplayConfig, now time.Time) (*replayDriver, error) {
+	series := make(map[string][]replaySample)
+	add := func(id string, s replaySample) {
+		series[id] = append(series[id], s)
+	}
+	var err error
+	if config.Format == "parquet" {
+		err = readParquetTrace(config.File, add)
+	} else {
+		f, openErr := os.Open(config.File)
+		if openErr != nil {
+			return nil, fmt.Errorf("failed to open replay trace: %w", openErr)
+		}
+		defer f.Close()
+		switch config.Format {
+		case "csv":
+			err = readCSVTrace(f, add)
+		case "jsonl":
+			err = readJSONTrace(f, add)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replay trace %s: %w", config.File, err)
+	}
+	if len(series) == 0 {
+		return nil, fmt.Errorf("replay trace %s is empty", config.File)
+	}
+
+	d := &replayDriver{config: config, series: series, started: now}
+	var end time.Time
+	samples := 0
+	for id, s := range series {
+		sort.SliceStable(s, func(i, j int) bool { return s[i].at.Before(s[j].at) })
+		series[id] = s
+		if d.start.IsZero() || s[0].at.Before(d.start) {
+			d.start = s[0].at
+		}
+		if last := s[len(s)-1].at; last.After(end) {
+			end = last
+		}
+		samples += len(s)
+	}
+	d.length = end.Sub(d.start)
+	log.Printf("Replay trace %s: %d series, %d samples over %v at %gx speed",
+		config.File, len(series), samples, d.length, config.Speed)
+	return d, nil
+}
+
+func readCSVTrace(r io.Reader, add func(string, replaySample)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	tsCol, ok := columns["timestamp"]
+	if !ok {
+		return errors.New("missing timestamp column")
+	}
+	idCol, long := columns["sensor_id"]
+	valueCol, hasValue := columns["value"]
+	textCol, hasText := columns["string_value"]
+	if long && !hasValue && !hasText {
+		return errors.New("missing value column")
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if tsCol >= len(record) {
+			continue
+		}
+		at, err := parseTraceTime(record[tsCol])
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if long {
+			if idCol >= len(record) {
+				continue
+			}
+			s := replaySample{at: at}
+			if hasText && textCol < len(record) {
+				s.text = record[textCol]
+			}
+			if hasValue && valueCol < len(record) && record[valueCol] != "" {
+				if s.value, err = strconv.ParseFloat(record[valueCol], 64); err != nil {
+					return fmt.Errorf("line %d: invalid value %q", line, record[valueCol])
+				}
+			}
+			add(record[idCol], s)
+			continue
+		}
+		for i, field := range record {
+			if i == tsCol || i >= len(header) || field == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				add(header[i], replaySample{at: at, text: field})
+				continue
+			}
+			add(header[i], replaySample{at: at, value: value})
+		}
+	}
+}
+
+func readJSONTrace(r io.Reader, add func(string, replaySample)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var row struct {
+			Timestamp   string  `json:"timestamp"`
+			SensorID    string  `json:"sensor_id"`
+			Value       float64 `json:"value"`
+			StringValue string  `json:"string_value"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		at, err := parseTraceTime(row.Timestamp)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		add(row.SensorID, replaySample{at: at, value: row.Value, text: row.StringValue})
+	}
+	return scanner.Err()
+}
+
+// parquetTraceBatch is the number of rows read from a Parquet trace at once
+const parquetTraceBatch = 1024
+
+// readParquetTrace reads a long or wide Parquet trace, e.g. sensor readings
+// archived by the bridge. Timestamps are Parquet timestamps, RFC 3339
+// strings or Unix seconds, milliseconds, microseconds or nanoseconds.
+func readParquetTrace(path string, add func(string, replaySample)) error {
+	fr, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return err
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, nil, 1)
+	if err != nil {
+		return err
+	}
+	defer pr.ReadStop()
+
+	// Top-level columns in field order of the rows; nested groups are
+	// skipped with their children
+	var names []string
+	var elements []*parquet.SchemaElement
+	schema := pr.Footer.Schema
+	for i := 1; i < len(schema); {
+		names = append(names, pr.SchemaHandler.Infos[i].ExName)
+		elements = append(elements, schema[i])
+		i = skipParquetElement(schema, i)
+	}
+	columns := make(map[string]int)
+	for i, name := range names {
+		columns[name] = i
+	}
+	tsCol, ok := columns["timestamp"]
+	if !ok {
+		return errors.New("missing timestamp column")
+	}
+	idCol, long := columns["sensor_id"]
+	valueCol, hasValue := columns["value"]
+	textCol, hasText := columns["string_value"]
+	if long && !hasValue && !hasText {
+		return errors.New("missing value column")
+	}
+
+	for row, total := 0, int(pr.GetNumRows()); row < total; {
+		rows, err := pr.ReadByNumber(parquetTraceBatch)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, r := range rows {
+			row++
+			record := reflect.Indirect(reflect.ValueOf(r))
+			field := func(i int) interface{} {
+				if i >= record.NumField() {
+					return nil
+				}
+				v := record.Field(i)
+				for v.Kind() == reflect.Ptr {
+					if v.IsNil() {
+						return nil
+					}
+					v = v.Elem()
+				}
+				return v.Interface()
+			}
+			ts := field(tsCol)
+			if ts == nil {
+				continue
+			}
+			at, err := parquetTraceTime(elements[tsCol], ts)
+			if err != nil {
+				return fmt.Errorf("row %d: %w", row, err)
+			}
+			if long {
+				id, _ := field(idCol).(string)
+				if id == "" {
+					continue
+				}
+				s := replaySample{at: at}
+				if hasText {
+					s.text, _ = field(textCol).(string)
+				}
+				if hasValue {
+					if v := field(valueCol); v != nil {
+						value, ok := parquetNumber(v)
+						if !ok {
+							return fmt.Errorf("row %d: invalid value %v", row, v)
+						}
+						s.value = value
+					}
+				}
+				add(id, s)
+				continue
+			}
+			for i, name := range names {
+				v := field(i)
+				if i == tsCol || v == nil {
+					continue
+				}
+				if value, ok := parquetNumber(v); ok {
+					add(name, replaySample{at: at, value: value})
+				} else if text, ok := v.(string); ok && text != "" {
+					add(name, replaySample{at: at, text: text})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// skipParquetElement returns the index of the schema element following i
+// and all of its descendants
+func skipParquetElement(elements []*parquet.SchemaElement, i int) int {
+	children := int(elements[i].GetNumChildren())
+	i++
+	for ; children > 0; children-- {
+		i = skipParquetElement(elements, i)
+	}
+	return i
+}
+
+// parquetTraceTime decodes a timestamp column value
+func parquetTraceTime(e *parquet.SchemaElement, v interface{}) (time.Time, error) {
+	switch x := v.(type) {
+	case string:
+		if e.GetType() == parquet.Type_INT96 {
+			return types.INT96ToTime(x), nil
+		}
+		return parseTraceTime(x)
+	case int64:
+		if ts := e.GetLogicalType().GetTIMESTAMP(); ts != nil {
+			switch unit := ts.GetUnit(); {
+			case unit != nil && unit.IsSetMILLIS():
+				return time.UnixMilli(x), nil
+			case unit != nil && unit.IsSetMICROS():
+				return time.UnixMicro(x), nil
+			}
+			return time.Unix(0, x), nil
+		}
+		switch e.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return time.UnixMilli(x), nil
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return time.UnixMicro(x), nil
+		}
+		// Plain integers by magnitude
+		switch {
+		case x > 1e17:
+			return time.Unix(0, x), nil
+		case x > 1e14:
+			return time.UnixMicro(x), nil
+		case x > 1e11:
+			return time.UnixMilli(x), nil
+		}
+		return time.Unix(x, 0), nil
+	}
+	if n, ok := parquetNumber(v); ok {
+		return parseTraceTime(strconv.FormatFloat(n, 'f', -1, 64))
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %v", v)
+}
+
+// parquetNumber converts a numeric or boolean column value
+func parquetNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case int32:
+		return float64(x), true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		n, err := strconv.ParseFloat(x, 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// parseTraceTime accepts RFC 3339 timestamps and Unix seconds or milliseconds
+func parseTraceTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if n > 1e11 {
+			return time.UnixMilli(int64(n)), nil
+		}
+		return time.Unix(0, int64(n*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+func replaySeries(sensor *SensorConfig) string {
+	if sensor.Address != "" {
+		return sensor.Address
+	}
+	return sensor.ID
+}
+
+// traceTime maps a wall-clock time onto the trace
+func (d *replayDriver) traceTime(now time.Time) time.Time {
+	elapsed := time.Duration(float64(now.Sub(d.started)) * d.config.Speed)
+	if elapsed > d.length {
+		if d.config.Loop && d.length > 0 {
+			elapsed %= d.length
+		} else {
+			d.mu.Lock()
+			if !d.finished {
+				d.finished = true
+				log.Printf("[EVENT] Replay trace finished; holding the last values")
+			}
+			d.mu.Unlock()
+			elapsed = d.length
+		}
+	}
+	return d.start.Add(elapsed)
+}
+
+// read returns the value of the sensor's series at the current trace time
+func (d *replayDriver) read(sensor *SensorConfig, now time.Time) (float64, string, error) {
+	samples, ok := d.series[replaySeries(sensor)]
+	if !ok {
+		return 0, "", fmt.Errorf("replay trace has no series %s", replaySeries(sensor))
+	}
+	at := d.traceTime(now)
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].at.After(at) })
+	if i == 0 {
+		return 0, "", fmt.Errorf("no replay sample for %s before %s", replaySeries(sensor), at.Format(time.RFC3339))
+	}
+	s := samples[i-1]
+	if s.text != "" && sensor.EnumMap != nil {
+		code, ok := sensor.EnumMap[s.text]
+		if !ok {
+			return 0, s.text, fmt.Errorf("unmapped state %q", s.text)
+		}
+		return code, s.text, nil
+	}
+	return s.value, s.text, nil
+}
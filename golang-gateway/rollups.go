@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RollupConfig publishes zone and building rollups of the latest room
+// telemetry on zones/<zone> and building/<gateway_id>. Averaged metrics
+// such as temperature and CO2 are weighted by the area_m2 or volume_m3 of
+// the rooms in rooms.yaml, so a large open-plan office outweighs a meeting
+// booth; summed metrics such as energy are totals.
+type RollupConfig struct {
+	Enabled     bool     `yaml:"enabled"`
+	IntervalSec int      `yaml:"interval_sec,omitempty"` // default 60
+	Weighting   string   `yaml:"weighting,omitempty"`    // area (default), volume or none
+	Average     []string `yaml:"average,omitempty"`      // telemetry fields, default temperature, humidity, co2_ppm
+	Sum         []string `yaml:"sum,omitempty"`          // telemetry fields, default energy_kwh
+}
+
+func (c *RollupConfig) normalize() error {
+	if c.IntervalSec <= 0 {
+		c.IntervalSec = 60
+	}
+	switch c.Weighting {
+	case "":
+		c.Weighting = "area"
+	case "area", "volume", "none":
+	default:
+		return fmt.Errorf("rollups: unknown weighting %q (area, volume or none)", c.Weighting)
+	}
+	if len(c.Average) == 0 {
+		c.Average = []string{"temperature", "humidity", "co2_ppm"}
+	}
+	if len(c.Sum) == 0 {
+		c.Sum = []string{"energy_kwh"}
+	}
+	return nil
+}
+
+// rollupFieldTypes maps the telemetry fields reported even without a
+// sensor (as zero) to the sensor type a room needs to contribute to them
+var rollupFieldTypes = map[string]string{
+	"temperature":     "temperature",
+	"humidity":        "humidity",
+	"co2_ppm":         "co2",
+	"light_lux":       "light",
+	"occupancy_count": "occupancy",
+	"motion_detected": "motion",
+	"energy_kwh":      "energy",
+}
+
+// RollupTelemetry is published on zones/<zone> and building/<gateway_id>
+type RollupTelemetry struct {
+	Zone      string             `json:"zone,omitempty"`
+	Rooms     int                `json:"rooms"`
+	AreaM2    float64            `json:"area_m2,omitempty"`
+	VolumeM3  float64            `json:"volume_m3,omitempty"`
+	Weighting string             `json:"weighting"`
+	Averages  map[string]float64 `json:"averages"`
+	Sums      map[string]float64 `json:"sums,omitempty"`
+	Timestamp string             `json:"timestamp"`
+}
+
+// validateRollups checks that every room declares the size the rollups
+// are weighted by
+func (gw *Gateway) validateRollups() error {
+	var missing []string
+	for id, room := range gw.rooms {
+		if room.AreaM2 < 0 || room.VolumeM3 < 0 {
+			return fmt.Errorf("room %s: area_m2 and volume_m3 must not be negative", id)
+		}
+		if !gw.settings.Rollups.Enabled {
+			continue
+		}
+		if gw.settings.Rollups.Weighting == "area" && room.AreaM2 == 0 || gw.settings.Rollups.Weighting == "volume" && room.VolumeM3 == 0 {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		field := map[string]string{"area": "area_m2", "volume": "volume_m3"}[gw.settings.Rollups.Weighting]
+		return fmt.Errorf("rollups weighted by %s need %s on every room, missing on %s", gw.settings.Rollups.Weighting, field, strings.Join(missing, ", "))
+	}
+	if gw.settings.Rollups.Enabled && gw.settings.Privacy.Enabled {
+		for _, field := range append(gw.settings.Rollups.Average, gw.settings.Rollups.Sum...) {
+			if field == "occupancy_count" {
+				return fmt.Errorf("rollups: occupancy_count is only published through privacy aggregates while privacy is enabled")
+			}
+		}
+	}
+	return nil
+}
+
+// roomWeight is a room's weight in averaged rollups
+func (gw *Gateway) roomWeight(room *RoomConfig) float64 {
+	switch gw.settings.Rollups.Weighting {
+	case "area":
+		return room.AreaM2
+	case "volume":
+		return room.VolumeM3
+	}
+	return 1
+}
+
+func (gw *Gateway) publishRollups() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(gw.settings.Rollups.IntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			zones, building := gw.aggregateRollups(gw.schedule.withLatest(nil))
+			names := make([]string, 0, len(zones))
+			for zone := range zones {
+				names = append(names, zone)
+			}
+			sort.Strings(names)
+			for _, zone := range names {
+				gw.publishRollup("zones/"+zone, zones[zone])
+			}
+			gw.publishRollup("building/"+gw.settings.GatewayID, building)
+		}
+	}
+}
+
+// aggregateRollups rolls the latest telemetry of every room up into its
+// zone and the building; rooms without a zone only count for the building
+func (gw *Gateway) aggregateRollups(telemetries []*RoomTelemetry) (map[string]*RollupTelemetry, *RollupTelemetry) {
+	type accumulator struct {
+		rollup  *RollupTelemetry
+		weights map[string]float64
+	}
+	config := &gw.settings.Rollups
+	now := time.Now().Format(time.RFC3339)
+	newAccumulator := func(zone string) *accumulator {
+		return &accumulator{
+			rollup: &RollupTelemetry{
+				Zone:      zone,
+				Weighting: config.Weighting,
+				Averages:  make(map[string]float64),
+				Sums:      make(map[string]float64),
+				Timestamp: now,
+			},
+			weights: make(map[string]float64),
+		}
+	}
+	building := newAccumulator("")
+	zones := make(map[string]*accumulator)
+
+	for _, telemetry := range telemetries {
+		room := gw.rooms[telemetry.RoomID]
+		if room == nil {
+			continue
+		}
+		metrics := telemetryMetrics(telemetry)
+		for field, sensorType := range rollupFieldTypes {
+			if _, ok := metrics[field]; ok && !gw.roomHasSensorType(room, sensorType) {
+				delete(metrics, field)
+			}
+		}
+		targets := []*accumulator{building}
+		if room.Zone != "" {
+			if zones[room.Zone] == nil {
+				zones[room.Zone] = newAccumulator(room.Zone)
+			}
+			targets = append(targets, zones[room.Zone])
+		}
+		weight := gw.roomWeight(room)
+		for _, acc := range targets {
+			acc.rollup.Rooms++
+			acc.rollup.AreaM2 += room.AreaM2
+			acc.rollup.VolumeM3 += room.VolumeM3
+			for _, field := range config.Average {
+				if v, ok := metrics[field]; ok && weight > 0 {
+					acc.rollup.Averages[field] += v * weight
+					acc.weights[field] += weight
+				}
+			}
+			for _, field := range config.Sum {
+				if v, ok := metrics[field]; ok {
+					acc.rollup.Sums[field] += v
+				}
+			}
+		}
+	}
+
+	finish := func(acc *accumulator) *RollupTelemetry {
+		for field, weighted := range acc.rollup.Averages {
+			acc.rollup.Averages[field] = weighted / acc.weights[field]
+		}
+		return acc.rollup
+	}
+	result := make(map[string]*RollupTelemetry, len(zones))
+	for zone, acc := range zones {
+		result[zone] = finish(acc)
+	}
+	return result, finish(building)
+}
+
+func (gw *Gateway) publishRollup(topic string, rollup *RollupTelemetry) {
+	payload, err := json.Marshal(rollup)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal rollup for %s: %v", topic, err)
+		return
+	}
+
+	token := gw.mqttClient.Publish(topic, 0, false, payload)
+	token.Wait()
+
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	} else {
+		log.Printf("[MQTT] Published to %s", topic)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// RuntimeConfig controls runtime-hour and cycle-count tracking for binary
+// status points (fans, pumps, compressors). Counters are kept in the state
+// store; StateFile is the legacy JSON file, imported once when the store has
+// no counters yet.
+type RuntimeConfig struct {
+	StateFile          string `yaml:"state_file,omitempty"`
+	PublishIntervalSec int    `yaml:"publish_interval_sec,omitempty"`
+}
+
+func (c *RuntimeConfig) normalize() {
+	if c.StateFile == "" {
+		c.StateFile = "/app/data/runtime_state.json"
+	}
+	if c.PublishIntervalSec <= 0 {
+		c.PublishIntervalSec = 60
+	}
+}
+
+// RuntimeCounter is the persisted usage of one status point. It is also the
+// payload published on maintenance/<sensor_id>.
+type RuntimeCounter struct {
+	SensorID       string    `json:"sensor_id"`
+	RuntimeSeconds float64   `json:"runtime_seconds"`
+	RuntimeHours   float64   `json:"runtime_hours"`
+	Cycles         int64     `json:"cycle_count"`
+	Running        bool      `json:"running"`
+	LastChange     time.Time `json:"last_change,omitempty"`
+	lastSeen       time.Time
+}
+
+type runtimeTracker struct {
+	mu         sync.Mutex
+	counters   map[string]*RuntimeCounter
+	store      *stateStore
+	legacyPath string
+}
+
+func newRuntimeTracker(store *stateStore, legacyPath string) *runtimeTracker {
+	return &runtimeTracker{
+		counters:   make(map[string]*RuntimeCounter),
+		store:      store,
+		legacyPath: legacyPath,
+	}
+}
+
+// load restores counters from the state store, importing the legacy state
+// file if the store has none. Time spent while the gateway was down is not
+// counted because lastSeen starts out zero.
+func (t *runtimeTracker) load() error {
+	if t.store.isEmpty(runtimeBucket) {
+		return t.importLegacy()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := t.store.load(runtimeBucket, func(id string, data []byte) error {
+		var c RuntimeCounter
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("failed to parse runtime counter %s: %w", id, err)
+		}
+		c.SensorID = id
+		t.counters[id] = &c
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore runtime counters: %w", err)
+	}
+	log.Printf("Restored runtime counters for %d points", len(t.counters))
+	return nil
+}
+
+// importLegacy reads counters from the JSON state file used before the
+// state store existed
+func (t *runtimeTracker) importLegacy() error {
+	data, err := os.ReadFile(t.legacyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read runtime state: %w", err)
+	}
+
+	var counters map[string]*RuntimeCounter
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return fmt.Errorf("failed to parse runtime state: %w", err)
+	}
+
+	t.mu.Lock()
+	for id, c := range counters {
+		c.SensorID = id
+		t.counters[id] = c
+	}
+	t.mu.Unlock()
+	log.Printf("Imported runtime counters for %d points from %s", len(counters), t.legacyPath)
+	return t.save()
+}
+
+// save writes all counters to the state store
+func (t *runtimeTracker) save() error {
+	t.mu.Lock()
+	docs := make(map[string]interface{}, len(t.counters))
+	for id, c := range t.counters {
+		copied := *c
+		docs[id] = &copied
+	}
+	t.mu.Unlock()
+	return t.store.save(runtimeBucket, docs)
+}
+
+// observe accumulates runtime since the previous observation and counts a
+// cycle on every off→on transition
+func (t *runtimeTracker) observe(sensorID string, running bool, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.counters[sensorID]
+	if !ok {
+		c = &RuntimeCounter{SensorID: sensorID}
+		t.counters[sensorID] = c
+	}
+	if !c.lastSeen.IsZero() && c.Running {
+		c.RuntimeSeconds += now.Sub(c.lastSeen).Seconds()
+	}
+	if running != c.Running {
+		if running {
+			c.Cycles++
+		}
+		c.Running = running
+		c.LastChange = now
+	}
+	c.lastSeen = now
+	c.RuntimeHours = c.RuntimeSeconds / 3600
+}
+
+// counter returns a copy of a sensor's counter
+func (t *runtimeTracker) counter(sensorID string) (RuntimeCounter, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.counters[sensorID]
+	if !ok {
+		return RuntimeCounter{}, false
+	}
+	return *c, true
+}
+
+// merge takes a counter recovered from elsewhere (the retained maintenance
+// topic) when it is ahead of the local one, e.g. after the store was lost
+func (t *runtimeTracker) merge(c RuntimeCounter) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if current, ok := t.counters[c.SensorID]; ok && current.RuntimeSeconds >= c.RuntimeSeconds && current.Cycles >= c.Cycles {
+		return false
+	}
+	c.lastSeen = time.Time{}
+	t.counters[c.SensorID] = &c
+	return true
+}
+
+// snapshot returns copies of all counters
+func (t *runtimeTracker) snapshot() []RuntimeCounter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counters := make([]RuntimeCounter, 0, len(t.counters))
+	for _, c := range t.counters {
+		counters = append(counters, *c)
+	}
+	return counters
+}
+
+// tracksRuntime reports whether a sensor's status should feed the runtime
+// tracker, either explicitly or as an equipment status point
+func (gw *Gateway) tracksRuntime(sensorID string, config *SensorConfig) bool {
+	if config.TrackRuntime {
+		return true
+	}
+	for _, eq := range gw.settings.Equipment {
+		if eq.Points[pointStatus] == sensorID {
+			return true
+		}
+	}
+	return false
+}
+
+func (gw *Gateway) hasRuntimeTracking() bool {
+	for sensorID, config := range gw.sensors {
+		if gw.tracksRuntime(sensorID, config) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishRuntimeCounters periodically publishes the counters on
+// maintenance/<sensor_id> for maintenance scheduling
+func (gw *Gateway) publishRuntimeCounters() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(gw.settings.Runtime.PublishIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			for _, c := range gw.runtime.snapshot() {
+				topic := fmt.Sprintf("maintenance/%s", c.SensorID)
+				payload, err := json.Marshal(c)
+				if err != nil {
+					log.Printf("[ERROR] Failed to marshal runtime counter for %s: %v", c.SensorID, err)
+					continue
+				}
+				token := gw.mqttClient.Publish(topic, 1, true, payload)
+				token.Wait()
+				if token.Error() != nil {
+					log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron schedules. A sensor or poll group with a schedule instead of a poll
+// interval is read at the times of a five-field cron expression (minute
+// hour day-of-month month day-of-week, with *, lists, ranges, /steps and
+// JAN-DEC/SUN-SAT names, or @hourly, @daily, @weekly, @monthly, @yearly),
+// e.g. "0 * * * *" for an energy meter at the top of every hour or
+// "0 6 * * *" for a water meter daily at 06:00. Times are in
+// poll_schedule.timezone (default the gateway's local time zone) and
+// readings are stamped with the scheduled time, so billing reads align to
+// clock boundaries even when the read itself takes a moment.
+
+// PollScheduleConfig sets the time zone of cron schedules
+type PollScheduleConfig struct {
+	// Timezone is an IANA time zone such as Europe/Berlin
+	Timezone string `yaml:"timezone,omitempty"`
+}
+
+// cronSchedule is a parsed cron expression; each field is a bit set of the
+// allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domRestricted, dowRestricted  bool
+	loc                           *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var (
+	cronMonthNames = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronDayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCronSchedule parses a five-field cron expression or descriptor
+func parseCronSchedule(expr string, loc *time.Location) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 1 {
+		spec, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown schedule %q", expr)
+		}
+		fields = strings.Fields(spec)
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q must have 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+	c := &cronSchedule{loc: loc}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: minute: %w", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: hour: %w", expr, err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of month: %w", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, fmt.Errorf("schedule %q: month: %w", expr, err)
+	}
+	if c.dow, err = parseCronField(fields[4], 0, 7, cronDayNames); err != nil {
+		return nil, fmt.Errorf("schedule %q: day of week: %w", expr, err)
+	}
+	// 7 is Sunday too
+	if c.dow&(1<<7) != 0 {
+		c.dow = c.dow&^(1<<7) | 1
+	}
+	c.domRestricted = fields[2] != "*" && !strings.HasPrefix(fields[2], "*/")
+	c.dowRestricted = fields[4] != "*" && !strings.HasPrefix(fields[4], "*/")
+	if c.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("schedule %q never fires", expr)
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps
+// into a bit set
+func parseCronField(field string, first, last int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if name != "" && strings.EqualFold(s, name) {
+				return i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < first || n > last {
+			return 0, fmt.Errorf("invalid value %q (want %d-%d)", s, first, last)
+		}
+		return n, nil
+	}
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		lo, hi := first, last
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = value(from); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = value(to); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = last
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+// matchesDay reports whether a day is scheduled: with both day fields
+// restricted either may match, as in cron
+func (c *cronSchedule) matchesDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<t.Weekday()) != 0
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first scheduled time after t, or the zero time for a
+// schedule that never fires
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.In(c.loc)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, c.loc)
+	// Impossible dates such as 30 February are given up after five years
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<t.Month()) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if !c.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.hour&(1<<t.Hour()) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			continue
+		}
+		if c.minute&(1<<t.Minute()) == 0 {
+			// Jump to the next allowed minute of the hour, if any
+			if rest := c.minute >> (t.Minute() + 1); rest != 0 {
+				t = t.Add(time.Duration(bits.TrailingZeros64(rest)+1) * time.Minute)
+			} else {
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, c.loc)
+			}
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// polled reports whether a sensor is polled, on an interval or a schedule
+func (s *SensorConfig) polled() bool {
+	return s.PollIntervalMs > 0 || s.Schedule != ""
+}
+
+// validateSchedules parses the schedules of sensors and poll groups
+func (gw *Gateway) validateSchedules() error {
+	loc := time.Local
+	if tz := gw.settings.PollSchedule.Timezone; tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return fmt.Errorf("poll_schedule: invalid timezone %q: %w", tz, err)
+		}
+	}
+	grouped := make(map[string]string)
+	for i := range gw.settings.PollGroups {
+		group := &gw.settings.PollGroups[i]
+		for _, sensorID := range group.Sensors {
+			grouped[sensorID] = group.Name
+		}
+		if group.Schedule == "" {
+			continue
+		}
+		if group.IntervalMs > 0 {
+			return fmt.Errorf("poll group %s: interval_ms and schedule are exclusive", group.Name)
+		}
+		schedule, err := parseCronSchedule(group.Schedule, loc)
+		if err != nil {
+			return fmt.Errorf("poll group %s: %w", group.Name, err)
+		}
+		group.cron = schedule
+	}
+	for id, sensor := range gw.sensors {
+		if sensor.Schedule == "" {
+			continue
+		}
+		switch {
+		case sensor.PollIntervalMs > 0:
+			return fmt.Errorf("sensor %s: poll_interval_ms and schedule are exclusive", id)
+		case sensor.Subscribe:
+			return fmt.Errorf("sensor %s: subscribed sensors have no schedule", id)
+		case grouped[id] != "":
+			return fmt.Errorf("sensor %s: polled by poll group %s, which takes the schedule instead", id, grouped[id])
+		}
+		schedule, err := parseCronSchedule(sensor.Schedule, loc)
+		if err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		sensor.cron = schedule
+	}
+	return nil
+}
+
+// waitUntil sleeps until t, in steps so a clock step (e.g. NTP) does not
+// move the wake-up, and returns false on shutdown
+func (gw *Gateway) waitUntil(t time.Time) bool {
+	for {
+		wait := time.Until(t)
+		if wait <= 0 {
+			return true
+		}
+		timer := time.NewTimer(min(wait, time.Minute))
+		select {
+		case <-gw.shutdown:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// pollScheduled reads a sensor at the times of its schedule
+func (gw *Gateway) pollScheduled(sensorID string, config *SensorConfig) {
+	defer gw.wg.Done()
+
+	for {
+		at := config.cron.next(time.Now())
+		log.Printf("[DEBUG] Next scheduled read of %s at %s", sensorID, at.Format(time.RFC3339))
+		if !gw.waitUntil(at) {
+			return
+		}
+		if gw.control.isPaused(sensorID) || !gw.allowPoll(sensorID, at) {
+			continue
+		}
+		gw.pollGate.RLock()
+		_, err := gw.readSensorAt(sensorID, config, at)
+		gw.pollGate.RUnlock()
+		if err != nil && errors.Is(err, errUnknownProtocol) {
+			log.Printf("[WARN] Unknown protocol for sensor %s: %s", sensorID, config.Protocol)
+		}
+	}
+}
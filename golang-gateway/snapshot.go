@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// SnapshotConfig publishes all rooms due in a publish cycle as one message
+// on telemetry/building/<building_id>/snapshot instead of one message per
+// room, cutting per-message overhead on constrained brokers. The payload has
+// the constrained-link batch shape, which the bridge splits into one record
+// per room. Constrained-link mode takes precedence when both are enabled.
+type SnapshotConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BuildingID names the building in the topic (default the gateway ID)
+	BuildingID string `yaml:"building_id"`
+	// RoomTopics keeps publishing telemetry/<room_id> as well, e.g. for the
+	// eKuiper streams; tenant and flat topics are published either way
+	RoomTopics bool `yaml:"room_topics"`
+}
+
+func (c *SnapshotConfig) normalize(gatewayID string) {
+	if c.BuildingID == "" {
+		c.BuildingID = gatewayID
+	}
+}
+
+func (c *SnapshotConfig) topic() string {
+	return fmt.Sprintf("telemetry/building/%s/snapshot", c.BuildingID)
+}
+
+// snapshotRoom encodes a room's telemetry once, publishes it on the per-room
+// topics still enabled and returns it for the snapshot
+func (gw *Gateway) snapshotRoom(telemetry *RoomTelemetry) json.RawMessage {
+	payload, err := gw.encodeTelemetry(telemetry)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal telemetry for room %s: %v", telemetry.RoomID, err)
+		return nil
+	}
+	if gw.settings.Snapshot.RoomTopics {
+		gw.publishRoomPayload(telemetry, payload)
+	} else {
+		gw.publishTenantTelemetry(telemetry.RoomID, payload, gw.telemetryQoS())
+		if gw.settings.FlatTopics.Enabled {
+			gw.publishFlatTelemetry(telemetry)
+		}
+	}
+	return payload
+}
+
+// publishSnapshot publishes the encoded room payloads of one cycle
+func (gw *Gateway) publishSnapshot(rooms []json.RawMessage) {
+	if len(rooms) == 0 {
+		return
+	}
+	payload, err := json.Marshal(TelemetryBatch{
+		GatewayID: gw.settings.GatewayID,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Rooms:     rooms,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal telemetry snapshot: %v", err)
+		return
+	}
+
+	topic := gw.settings.Snapshot.topic()
+	token := gw.mqttClient.Publish(topic, gw.telemetryQoS(), false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[MQTT] Published %d rooms to %s (%d bytes)", len(rooms), topic, len(payload))
+}
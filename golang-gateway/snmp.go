@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// SNMPConfig holds the gateway-wide SNMP client settings. Sensors with
+// protocol snmp Get one OID from the agent in address (host[:port],
+// default port 161); sensors of the same agent and credentials share a
+// client.
+type SNMPConfig struct {
+	TimeoutMs int `yaml:"timeout_ms,omitempty"` // per request, default 2000
+	Retries   int `yaml:"retries,omitempty"`    // default 1
+}
+
+func (c *SNMPConfig) normalize() {
+	if c.TimeoutMs <= 0 {
+		c.TimeoutMs = 2000
+	}
+	if c.Retries <= 0 {
+		c.Retries = 1
+	}
+}
+
+// SNMPv3Config is the user-based security of an SNMPv3 sensor. Without
+// auth_protocol the user is noAuthNoPriv, without priv_protocol
+// authNoPriv. Passphrases may reference environment variables.
+type SNMPv3Config struct {
+	Username       string `yaml:"username"`
+	AuthProtocol   string `yaml:"auth_protocol,omitempty"` // MD5, SHA, SHA224, SHA256, SHA384 or SHA512
+	AuthPassphrase string `yaml:"auth_passphrase,omitempty"`
+	PrivProtocol   string `yaml:"priv_protocol,omitempty"` // DES, AES, AES192, AES256, AES192C or AES256C
+	PrivPassphrase string `yaml:"priv_passphrase,omitempty"`
+	ContextName    string `yaml:"context_name,omitempty"`
+}
+
+// SNMPv3 authentication and privacy protocol names accepted in sensor
+// configs
+var (
+	snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+		"MD5":    gosnmp.MD5,
+		"SHA":    gosnmp.SHA,
+		"SHA224": gosnmp.SHA224,
+		"SHA256": gosnmp.SHA256,
+		"SHA384": gosnmp.SHA384,
+		"SHA512": gosnmp.SHA512,
+	}
+	snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+		"DES":     gosnmp.DES,
+		"AES":     gosnmp.AES,
+		"AES192":  gosnmp.AES192,
+		"AES256":  gosnmp.AES256,
+		"AES192C": gosnmp.AES192C,
+		"AES256C": gosnmp.AES256C,
+	}
+)
+
+// validateSNMPSensors checks the SNMP settings of sensors
+func (gw *Gateway) validateSNMPSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "snmp" {
+			if sensor.OID != "" || sensor.SNMPVersion != "" || sensor.Community != "" || sensor.SNMPv3 != nil {
+				return fmt.Errorf("sensor %s: oid, snmp_version, community and snmp_v3 are only valid for protocol snmp", id)
+			}
+			continue
+		}
+		if _, _, err := snmpAgent(sensor.Address); err != nil {
+			return fmt.Errorf("sensor %s: %w", id, err)
+		}
+		oid := strings.TrimPrefix(sensor.OID, ".")
+		if oid == "" || strings.Trim(oid, "0123456789.") != "" || strings.Contains(oid, "..") || strings.HasSuffix(oid, ".") {
+			return fmt.Errorf("sensor %s: invalid oid %q, expected numeric dotted form such as 1.3.6.1.2.1.33.1.4.4.1.5.1", id, sensor.OID)
+		}
+		sensor.OID = "." + oid
+		switch sensor.SNMPVersion {
+		case "", "v2c":
+			sensor.SNMPVersion = "v2c"
+			if sensor.SNMPv3 != nil {
+				return fmt.Errorf("sensor %s: snmp_v3 requires snmp_version v3", id)
+			}
+			if sensor.Community == "" {
+				sensor.Community = "public"
+			}
+		case "v3":
+			if sensor.Community != "" {
+				return fmt.Errorf("sensor %s: community is only valid for snmp_version v2c", id)
+			}
+			if err := validateSNMPv3(sensor.SNMPv3); err != nil {
+				return fmt.Errorf("sensor %s: %w", id, err)
+			}
+		default:
+			return fmt.Errorf("sensor %s: unknown snmp_version %q (v2c or v3)", id, sensor.SNMPVersion)
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol snmp", id)
+		}
+		if !sensor.polled() {
+			return fmt.Errorf("sensor %s: poll_interval_ms or schedule is required", id)
+		}
+	}
+	return nil
+}
+
+func validateSNMPv3(v3 *SNMPv3Config) error {
+	if v3 == nil || v3.Username == "" {
+		return fmt.Errorf("snmp_version v3 requires snmp_v3 with a username")
+	}
+	if _, ok := snmpAuthProtocols[v3.AuthProtocol]; v3.AuthProtocol != "" && !ok {
+		return fmt.Errorf("unknown snmp_v3 auth_protocol %q (MD5, SHA, SHA224, SHA256, SHA384 or SHA512)", v3.AuthProtocol)
+	}
+	if _, ok := snmpPrivProtocols[v3.PrivProtocol]; v3.PrivProtocol != "" && !ok {
+		return fmt.Errorf("unknown snmp_v3 priv_protocol %q (DES, AES, AES192, AES256, AES192C or AES256C)", v3.PrivProtocol)
+	}
+	if (v3.AuthProtocol == "") != (v3.AuthPassphrase == "") {
+		return fmt.Errorf("snmp_v3 auth_protocol and auth_passphrase must be set together")
+	}
+	if (v3.PrivProtocol == "") != (v3.PrivPassphrase == "") {
+		return fmt.Errorf("snmp_v3 priv_protocol and priv_passphrase must be set together")
+	}
+	if v3.PrivProtocol != "" && v3.AuthProtocol == "" {
+		return fmt.Errorf("snmp_v3 priv_protocol requires auth_protocol")
+	}
+	return nil
+}
+
+// snmpAgent splits an agent address into host and port
+func snmpAgent(address string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		host, portStr = address, "161"
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if host == "" || err != nil {
+		return "", 0, fmt.Errorf("invalid SNMP agent address %q: expected host[:port]", address)
+	}
+	return host, uint16(port), nil
+}
+
+// snmpDriver keeps one client per agent and credentials; a client whose
+// request fails is reconnected on the next read
+type snmpDriver struct {
+	config  *SNMPConfig
+	latency *latencyRecorder
+
+	mu      sync.Mutex
+	clients map[string]*snmpClient
+}
+
+// snmpClient serializes the requests of one gosnmp client, which is not
+// safe for concurrent use
+type snmpClient struct {
+	mu        sync.Mutex
+	snmp      *gosnmp.GoSNMP
+	connected bool
+}
+
+func newSNMPDriver(config *SNMPConfig, latency *latencyRecorder) *snmpDriver {
+	return &snmpDriver{config: config, latency: latency, clients: make(map[string]*snmpClient)}
+}
+
+// client returns the shared client of a sensor's agent and credentials
+func (d *snmpDriver) client(sensor *SensorConfig) *snmpClient {
+	key := strings.Join([]string{sensor.Address, sensor.SNMPVersion, sensor.Community}, "|")
+	if v3 := sensor.SNMPv3; v3 != nil {
+		key += "|" + strings.Join([]string{v3.Username, v3.AuthProtocol, v3.PrivProtocol, v3.ContextName}, "|")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.clients[key]
+	if !ok {
+		c = &snmpClient{snmp: d.newClient(sensor)}
+		d.clients[key] = c
+	}
+	return c
+}
+
+func (d *snmpDriver) newClient(sensor *SensorConfig) *gosnmp.GoSNMP {
+	host, port, _ := snmpAgent(sensor.Address)
+	client := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Transport: "udp",
+		Community: sensor.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Duration(d.config.TimeoutMs) * time.Millisecond,
+		Retries:   d.config.Retries,
+		MaxOids:   gosnmp.MaxOids,
+	}
+	if v3 := sensor.SNMPv3; sensor.SNMPVersion == "v3" && v3 != nil {
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:               v3.Username,
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+		}
+		client.MsgFlags = gosnmp.NoAuthNoPriv
+		if v3.AuthProtocol != "" {
+			params.AuthenticationProtocol = snmpAuthProtocols[v3.AuthProtocol]
+			params.AuthenticationPassphrase = os.ExpandEnv(v3.AuthPassphrase)
+			client.MsgFlags = gosnmp.AuthNoPriv
+		}
+		if v3.PrivProtocol != "" {
+			params.PrivacyProtocol = snmpPrivProtocols[v3.PrivProtocol]
+			params.PrivacyPassphrase = os.ExpandEnv(v3.PrivPassphrase)
+			client.MsgFlags = gosnmp.AuthPriv
+		}
+		client.Version = gosnmp.Version3
+		client.SecurityModel = gosnmp.UserSecurityModel
+		client.SecurityParameters = params
+		client.ContextName = v3.ContextName
+	}
+	return client
+}
+
+// read gets a sensor's OID
+func (d *snmpDriver) read(sensor *SensorConfig) (float64, string, error) {
+	start := time.Now()
+	pdu, err := d.client(sensor).get(sensor.OID)
+	d.latency.observe("snmp", sensor.Address, time.Since(start), err)
+	if err != nil {
+		return 0, "", fmt.Errorf("SNMP read error: %w", err)
+	}
+
+	switch pdu.Type {
+	case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+		return 0, "", fmt.Errorf("SNMP read error: %s: %s", sensor.OID, pdu.Type)
+	case gosnmp.OctetString:
+		raw, _ := pdu.Value.([]byte)
+		text := strings.TrimSpace(string(raw))
+		if code, ok := lookupEnumCode(sensor.EnumMap, text); ok {
+			return code, text, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, text, nil
+		}
+		if len(sensor.EnumMap) > 0 {
+			return 0, text, fmt.Errorf("SNMP state %q not found in enum_map", text)
+		}
+		return 0, text, nil
+	case gosnmp.OpaqueFloat:
+		v, _ := pdu.Value.(float32)
+		return float64(v), "", nil
+	case gosnmp.OpaqueDouble:
+		v, _ := pdu.Value.(float64)
+		return v, "", nil
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		raw, _ := new(big.Float).SetInt(gosnmp.ToBigInt(pdu.Value)).Float64()
+		return raw, sensor.enumText[raw], nil
+	default:
+		return 0, "", fmt.Errorf("SNMP read error: %s: unsupported value type %s", sensor.OID, pdu.Type)
+	}
+}
+
+// get requests one OID, connecting first if needed
+func (c *snmpClient) get(oid string) (gosnmp.SnmpPDU, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		if err := c.snmp.Connect(); err != nil {
+			return gosnmp.SnmpPDU{}, err
+		}
+		c.connected = true
+	}
+	result, err := c.snmp.Get([]string{oid})
+	if err != nil {
+		c.snmp.Conn.Close()
+		c.connected = false
+		return gosnmp.SnmpPDU{}, err
+	}
+	if result.Error != gosnmp.NoError {
+		return gosnmp.SnmpPDU{}, fmt.Errorf("%s: %s", oid, result.Error)
+	}
+	if len(result.Variables) != 1 {
+		return gosnmp.SnmpPDU{}, fmt.Errorf("%s: agent returned %d variables", oid, len(result.Variables))
+	}
+	return result.Variables[0], nil
+}
+
+func (d *snmpDriver) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, c := range d.clients {
+		c.mu.Lock()
+		if c.connected {
+			c.snmp.Conn.Close()
+			c.connected = false
+		}
+		c.mu.Unlock()
+	}
+}
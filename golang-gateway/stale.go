@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// StaleReadingsConfig marks readings stale when no successful read arrives
+// in time. A sensor's reading goes stale after its max_age_sec, or with
+// enabled after StaleFactor poll intervals for polled sensors without one.
+// Stale readings keep their value and timestamp but are left out of room
+// telemetry like failed reads; a sensor-status event is published on
+// events/<room_id>/<sensor_id>/status when a reading goes stale and when
+// the sensor reads again.
+type StaleReadingsConfig struct {
+	Enabled     bool    `yaml:"enabled"`
+	StaleFactor float64 `yaml:"stale_factor"`
+}
+
+func (c *StaleReadingsConfig) normalize() {
+	if c.StaleFactor <= 1 {
+		c.StaleFactor = 3
+	}
+}
+
+// SensorStatusEvent is published when a sensor's reading goes stale or the
+// sensor recovers
+type SensorStatusEvent struct {
+	SensorID string `json:"sensor_id"`
+	RoomID   string `json:"room_id"`
+	Status   string `json:"status"` // stale or ok
+	// LastReading is the time of the last successful reading
+	LastReading string  `json:"last_reading,omitempty"`
+	MaxAgeSec   float64 `json:"max_age_sec"`
+	Timestamp   string  `json:"timestamp"`
+}
+
+// staleReadings tracks the sensors whose reading is stale
+type staleReadings struct {
+	maxAge  map[string]time.Duration
+	started time.Time
+	mu      sync.Mutex
+	stale   map[string]time.Time // sensor → time of its last ok reading
+}
+
+// validateMaxAges checks the max_age_sec of sensors against their poll
+// intervals
+func (gw *Gateway) validateMaxAges() error {
+	intervals := gw.sensorIntervals()
+	for id, sensor := range gw.sensors {
+		if sensor.MaxAgeSec < 0 {
+			return fmt.Errorf("sensor %s: max_age_sec must not be negative", id)
+		}
+		maxAge := time.Duration(sensor.MaxAgeSec) * time.Second
+		if interval := intervals[id]; sensor.MaxAgeSec > 0 && maxAge <= interval {
+			return fmt.Errorf("sensor %s: max_age_sec must be longer than its poll interval (%s)", id, interval)
+		}
+	}
+	return nil
+}
+
+// newStaleReadings returns the tracker of the sensors with a maximum
+// reading age, or nil when there are none
+func (gw *Gateway) newStaleReadings(now time.Time) *staleReadings {
+	config := &gw.settings.StaleReadings
+	intervals := gw.sensorIntervals()
+	maxAge := make(map[string]time.Duration)
+	for id, sensor := range gw.sensors {
+		switch {
+		case sensor.MaxAgeSec > 0:
+			maxAge[id] = time.Duration(sensor.MaxAgeSec) * time.Second
+		case config.Enabled && intervals[id] > 0:
+			maxAge[id] = time.Duration(config.StaleFactor * float64(intervals[id]))
+		}
+	}
+	if len(maxAge) == 0 {
+		return nil
+	}
+	return &staleReadings{maxAge: maxAge, started: now, stale: make(map[string]time.Time)}
+}
+
+// checkStaleReadings marks readings stale once a second and publishes the
+// status changes
+func (gw *Gateway) checkStaleReadings() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			for _, event := range gw.updateStaleReadings(now) {
+				gw.publishSensorStatus(event)
+			}
+		}
+	}
+}
+
+// updateStaleReadings replaces the ok readings older than their sensor's
+// maximum age by stale copies and returns the events of sensors that went
+// stale or read successfully again
+func (gw *Gateway) updateStaleReadings(now time.Time) []SensorStatusEvent {
+	s := gw.staleReadings
+	var events []SensorStatusEvent
+	var changed []*SensorReading
+
+	gw.readingsMutex.Lock()
+	s.mu.Lock()
+	for sensorID, maxAge := range s.maxAge {
+		reading, ok := gw.lastReadings[sensorID]
+		lastOK, stale := s.stale[sensorID]
+		switch {
+		case stale && ok && reading.Status == "ok" && reading.Timestamp.After(lastOK):
+			delete(s.stale, sensorID)
+			events = append(events, s.event(reading, "ok", now))
+		case stale:
+		case now.Sub(s.started) <= maxAge:
+			// Restored readings get a first poll before they are judged
+		case ok && reading.Status == "ok" && now.Sub(reading.Timestamp) > maxAge:
+			marked := *reading
+			marked.Status = "stale"
+			gw.lastReadings[sensorID] = &marked
+			s.stale[sensorID] = reading.Timestamp
+			changed = append(changed, &marked)
+			events = append(events, s.event(reading, "stale", now))
+		}
+	}
+	s.mu.Unlock()
+	gw.readingsMutex.Unlock()
+
+	for _, reading := range changed {
+		gw.deadbands.observe(reading.RoomID, gw.sensors[reading.SensorID], reading)
+	}
+	return events
+}
+
+func (s *staleReadings) event(reading *SensorReading, status string, now time.Time) SensorStatusEvent {
+	return SensorStatusEvent{
+		SensorID:    reading.SensorID,
+		RoomID:      reading.RoomID,
+		Status:      status,
+		LastReading: reading.Timestamp.Format(time.RFC3339),
+		MaxAgeSec:   s.maxAge[reading.SensorID].Seconds(),
+		Timestamp:   now.Format(time.RFC3339),
+	}
+}
+
+// publishSensorStatus publishes a sensor-status event
+func (gw *Gateway) publishSensorStatus(event SensorStatusEvent) {
+	if event.Status == "stale" {
+		log.Printf("[WARN] Sensor %s has no successful reading since %s, marking it stale", event.SensorID, event.LastReading)
+	} else {
+		log.Printf("[EVENT] Sensor %s reads again", event.SensorID)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal status event for %s: %v", event.SensorID, err)
+		return
+	}
+	topic := fmt.Sprintf("events/%s/%s/status", event.RoomID, event.SensorID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Reasons reported in the retained gateway status
+const (
+	offlineReasonSignal       = "signal"
+	offlineReasonConfigReload = "config_reload"
+	offlineReasonCrash        = "crash"
+)
+
+// GatewayStatus is published retained on status/gateway/<gateway_id> so
+// dashboards can tell "building quiet" apart from "gateway down"
+type GatewayStatus struct {
+	GatewayID string `json:"gateway_id"`
+	Status    string `json:"status"` // "online" or "offline"
+	Reason    string `json:"reason,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+func (gw *Gateway) statusTopic() string {
+	return fmt.Sprintf("status/gateway/%s", gw.settings.GatewayID)
+}
+
+func (gw *Gateway) statusPayload(status, reason string) []byte {
+	payload, _ := json.Marshal(GatewayStatus{
+		GatewayID: gw.settings.GatewayID,
+		Status:    status,
+		Reason:    reason,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+	return payload
+}
+
+// configureStatusWill registers the last will so the broker marks the
+// gateway offline if it disappears without a clean shutdown
+func (gw *Gateway) configureStatusWill(opts *mqtt.ClientOptions) {
+	opts.SetBinaryWill(gw.statusTopic(), gw.statusPayload("offline", offlineReasonCrash), 1, true)
+}
+
+// publishStatus publishes the retained gateway status
+func (gw *Gateway) publishStatus(client mqtt.Client, status, reason string) {
+	token := client.Publish(gw.statusTopic(), 1, true, gw.statusPayload(status, reason))
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish gateway status: %v", token.Error())
+		return
+	}
+	log.Printf("[MQTT] Gateway status %s (%s)", status, reason)
+}
+
+// flushTelemetry publishes a final aggregation for every room and piece of
+// equipment so the last readings before shutdown are not lost
+func (gw *Gateway) flushTelemetry() {
+	gw.publishRooms(nil)
+	for i := range gw.settings.Equipment {
+		eq := &gw.settings.Equipment[i]
+		gw.publishEquipmentTelemetry(eq, gw.aggregateEquipmentData(eq))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	readingsBucket = []byte("readings")
+	runtimeBucket  = []byte("runtime")
+)
+
+// StoreConfig configures the local state store that keeps last-known
+// readings and runtime counters across restarts
+type StoreConfig struct {
+	Path             string `yaml:"path,omitempty"`
+	FlushIntervalSec int    `yaml:"flush_interval_sec,omitempty"`
+	// RestoreMaxAgeSec drops persisted readings older than this at startup so
+	// long outages don't resurface old values
+	RestoreMaxAgeSec int `yaml:"restore_max_age_sec,omitempty"`
+}
+
+func (c *StoreConfig) normalize() {
+	if c.Path == "" {
+		c.Path = "/app/data/gateway.db"
+	}
+	if c.FlushIntervalSec <= 0 {
+		c.FlushIntervalSec = 30
+	}
+	if c.RestoreMaxAgeSec <= 0 {
+		c.RestoreMaxAgeSec = 3600
+	}
+}
+
+// stateStore is a bbolt database holding one JSON document per sensor in
+// each bucket
+type stateStore struct {
+	db *bolt.DB
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state store directory: %w", err)
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{readingsBucket, runtimeBucket, configBucket, parametersBucket, baselineBucket, meterBucket, ventilationBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state store: %w", err)
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// save replaces the contents of a bucket with the given documents
+func (s *stateStore) save(bucket []byte, docs map[string]interface{}) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucket(bucket)
+		if err != nil {
+			return err
+		}
+		for key, doc := range docs {
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return fmt.Errorf("failed to marshal %s/%s: %w", bucket, key, err)
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load calls fn with every document in a bucket
+func (s *stateStore) load(bucket []byte, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// isEmpty reports whether a bucket has no documents
+func (s *stateStore) isEmpty(bucket []byte) bool {
+	empty := true
+	s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(bucket); b != nil {
+			k, _ := b.Cursor().First()
+			empty = k == nil
+		}
+		return nil
+	})
+	return empty
+}
+
+// restoreReadings loads persisted last-known readings for configured sensors
+func (gw *Gateway) restoreReadings() error {
+	cutoff := time.Now().Add(-time.Duration(gw.settings.Store.RestoreMaxAgeSec) * time.Second)
+	restored := 0
+
+	gw.readingsMutex.Lock()
+	defer gw.readingsMutex.Unlock()
+	err := gw.store.load(readingsBucket, func(sensorID string, data []byte) error {
+		if _, ok := gw.sensors[sensorID]; !ok {
+			return nil
+		}
+		var reading SensorReading
+		if err := json.Unmarshal(data, &reading); err != nil {
+			log.Printf("[WARN] Skipping persisted reading for %s: %v", sensorID, err)
+			return nil
+		}
+		if reading.Timestamp.Before(cutoff) {
+			return nil
+		}
+		gw.lastReadings[sensorID] = &reading
+		restored++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore readings: %w", err)
+	}
+	log.Printf("Restored %d last-known readings from %s", restored, gw.settings.Store.Path)
+	return nil
+}
+
+// persistState writes last-known readings and runtime counters to the store
+func (gw *Gateway) persistState() error {
+	gw.readingsMutex.RLock()
+	readings := make(map[string]interface{}, len(gw.lastReadings))
+	for sensorID, reading := range gw.lastReadings {
+		copied := *reading
+		readings[sensorID] = &copied
+	}
+	gw.readingsMutex.RUnlock()
+
+	if err := gw.store.save(readingsBucket, readings); err != nil {
+		return fmt.Errorf("failed to persist readings: %w", err)
+	}
+	if err := gw.runtime.save(); err != nil {
+		return fmt.Errorf("failed to persist runtime counters: %w", err)
+	}
+	if err := gw.saveMeterHour(); err != nil {
+		return fmt.Errorf("failed to persist energy meter readings: %w", err)
+	}
+	return nil
+}
+
+// flushState periodically persists gateway state
+func (gw *Gateway) flushState() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(gw.settings.Store.FlushIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case <-ticker.C:
+			if err := gw.persistState(); err != nil {
+				log.Printf("[ERROR] %v", err)
+			}
+			if gw.settings.WarmStart.Enabled {
+				gw.publishReadingState()
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// TenancyConfig controls how room tenants (the tenant field in rooms.yaml)
+// are carried outside the gateway. Telemetry always includes the tenant;
+// with TenantTopics each room is also published on
+// tenants/<tenant>/telemetry/<room_id>, so broker ACLs can give a tenant
+// access to its own topics only.
+type TenancyConfig struct {
+	TenantTopics bool `yaml:"tenant_topics"`
+}
+
+// roomAllowed reports whether the caller of an API request may see a room.
+// Callers without a tenant (and all callers when auth is disabled) see every
+// room.
+func (gw *Gateway) roomAllowed(r *http.Request, roomID string) bool {
+	p, ok := r.Context().Value(principalKey{}).(*principal)
+	if !ok || p.tenant == "" {
+		return true
+	}
+	room, ok := gw.rooms[roomID]
+	return ok && room.Tenant == p.tenant
+}
+
+// publishTenantTelemetry republishes a room's payload on its tenant topic
+func (gw *Gateway) publishTenantTelemetry(roomID string, payload []byte, qos byte) {
+	room := gw.rooms[roomID]
+	if !gw.settings.Tenancy.TenantTopics || room == nil || room.Tenant == "" {
+		return
+	}
+	topic := fmt.Sprintf("tenants/%s/telemetry/%s", room.Tenant, roomID)
+	token := gw.mqttClient.Publish(topic, qos, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Read timeouts. Every sensor read runs under a context deadline: the
+// sensor's timeout_ms, else its protocol's timeout (bacnet_apdu.timeout_ms,
+// modbus.timeout_ms or the timeout_ms of the driver's section). BACnet
+// requests are cancelled at the deadline, releasing their invoke ID. Reads
+// of other drivers are abandoned at the deadline so the poller moves on,
+// and finish in the background within the driver's own timeout; a sensor's
+// timeout_ms can therefore only shorten those, except for Modbus endpoints,
+// which wait as long as the longest timeout of their sensors.
+
+// protocolTimeout returns the read timeout of a protocol, 0 for protocols
+// read without I/O
+func (gw *Gateway) protocolTimeout(protocol string) time.Duration {
+	ms := 0
+	switch protocol {
+	case "bacnet":
+		ms = gw.settings.BACnetAPDU.TimeoutMs
+	case "modbus":
+		ms = gw.settings.Modbus.TimeoutMs
+	case "opcua":
+		ms = gw.settings.OPCUA.TimeoutMs
+	case "snmp":
+		ms = gw.settings.SNMP.TimeoutMs
+	case "knx":
+		ms = gw.settings.KNX.TimeoutMs
+	case "mbus":
+		ms = gw.settings.MBus.TimeoutMs
+	case "http":
+		ms = gw.settings.HTTP.TimeoutMs
+	case "dali":
+		ms = gw.settings.DALI.TimeoutMs
+	case "grpc":
+		return driverCallTimeout
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// readTimeout returns the deadline of a sensor's reads, 0 for none
+func (gw *Gateway) readTimeout(sensor *SensorConfig) time.Duration {
+	if sensor.TimeoutMs > 0 {
+		return time.Duration(sensor.TimeoutMs) * time.Millisecond
+	}
+	return gw.protocolTimeout(sensor.Protocol)
+}
+
+// readContext returns the context of one read of a sensor
+func (gw *Gateway) readContext(sensor *SensorConfig) (context.Context, context.CancelFunc) {
+	if timeout := gw.readTimeout(sensor); timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// validateReadTimeouts checks the timeout_ms of sensors
+func (gw *Gateway) validateReadTimeouts() error {
+	for id, sensor := range gw.sensors {
+		if sensor.TimeoutMs < 0 {
+			return fmt.Errorf("sensor %s: timeout_ms must not be negative", id)
+		}
+	}
+	return nil
+}
+
+// readWithContext runs a driver read until ctx ends; a read still running
+// then is left to finish and its result discarded
+func readWithContext(ctx context.Context, read func() (float64, string, error)) (float64, string, error) {
+	type result struct {
+		value float64
+		text  string
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, text, err := read()
+		done <- result{value, text, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.text, r.err
+	case <-ctx.Done():
+		return 0, "", fmt.Errorf("read timed out: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Tombstone is published retained on status/sensor/<id> or status/room/<id>
+// when a sensor or room is removed from the configuration, so downstream
+// systems stop expecting its data. The bridge records it as an end-of-life
+// marker. Re-adding the ID clears the retained tombstone.
+type Tombstone struct {
+	Kind             string `json:"kind"` // sensor or room
+	ID               string `json:"id"`
+	GatewayID        string `json:"gateway_id"`
+	Status           string `json:"status"`
+	DecommissionedAt string `json:"decommissioned_at"`
+	// RoomID is the room a removed sensor belonged to
+	RoomID string `json:"room_id,omitempty"`
+	// LastSeen is the time of the last persisted reading, when known
+	LastSeen string `json:"last_seen,omitempty"`
+}
+
+// retainedMessage is a retained publish waiting for the broker; an empty
+// payload clears the topic
+type retainedMessage struct {
+	topic   string
+	payload []byte
+}
+
+func tombstoneTopic(kind, id string) string {
+	return fmt.Sprintf("status/%s/%s", kind, id)
+}
+
+// queueTombstones queues tombstones for the sensors and rooms removed since
+// the previous configuration, and clears those of re-added ones. Removed
+// sensors also get their retained warm-start reading and runtime counters
+// cleared.
+func (gw *Gateway) queueTombstones(entry ConfigAuditEntry, previous map[string]map[string]interface{}) {
+	if len(entry.Sensors.Removed) == 0 && len(entry.Rooms.Removed) == 0 && len(entry.Sensors.Added) == 0 && len(entry.Rooms.Added) == 0 {
+		return
+	}
+	lastSeen := gw.persistedReadingTimes()
+	sensorRoom := make(map[string]string)
+	for key, doc := range previous {
+		if !strings.HasPrefix(key, "room/") {
+			continue
+		}
+		sensors, _ := doc["sensors"].([]interface{})
+		for _, sensorID := range sensors {
+			sensorRoom[fmt.Sprint(sensorID)] = strings.TrimPrefix(key, "room/")
+		}
+	}
+
+	var messages []retainedMessage
+	tombstone := func(kind, id, roomID string, seen time.Time) {
+		t := Tombstone{
+			Kind:             kind,
+			ID:               id,
+			GatewayID:        gw.settings.GatewayID,
+			Status:           "decommissioned",
+			DecommissionedAt: entry.Timestamp,
+			RoomID:           roomID,
+		}
+		if !seen.IsZero() {
+			t.LastSeen = seen.Format(time.RFC3339)
+		}
+		payload, _ := json.Marshal(t)
+		messages = append(messages, retainedMessage{tombstoneTopic(kind, id), payload})
+		log.Printf("[EVENT] %s %s decommissioned", kind, id)
+	}
+	for _, sensorID := range entry.Sensors.Removed {
+		tombstone("sensor", sensorID, sensorRoom[sensorID], lastSeen[sensorID])
+		messages = append(messages,
+			retainedMessage{topic: gw.readingStateTopic(sensorID)},
+			retainedMessage{topic: fmt.Sprintf("maintenance/%s", sensorID)})
+	}
+	for _, roomID := range entry.Rooms.Removed {
+		var seen time.Time
+		for sensorID, room := range sensorRoom {
+			if room == roomID && lastSeen[sensorID].After(seen) {
+				seen = lastSeen[sensorID]
+			}
+		}
+		tombstone("room", roomID, "", seen)
+		messages = append(messages, retainedMessage{topic: roomDataTopic(roomID)})
+	}
+	if !entry.Initial {
+		for _, sensorID := range entry.Sensors.Added {
+			messages = append(messages, retainedMessage{topic: tombstoneTopic("sensor", sensorID)})
+		}
+		for _, roomID := range entry.Rooms.Added {
+			messages = append(messages, retainedMessage{topic: tombstoneTopic("room", roomID)})
+		}
+	}
+
+	gw.audit.mu.Lock()
+	gw.audit.retained = append(gw.audit.retained, messages...)
+	gw.audit.mu.Unlock()
+}
+
+// persistedReadingTimes returns the time of every reading in the store,
+// including sensors no longer configured
+func (gw *Gateway) persistedReadingTimes() map[string]time.Time {
+	times := make(map[string]time.Time)
+	err := gw.store.load(readingsBucket, func(sensorID string, data []byte) error {
+		var reading SensorReading
+		if json.Unmarshal(data, &reading) == nil {
+			times[sensorID] = reading.Timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to read persisted readings for tombstones: %v", err)
+	}
+	return times
+}
+
+// publishTombstones publishes queued tombstones and clears; messages that
+// fail stay queued for the next connect
+func (gw *Gateway) publishTombstones(client mqtt.Client) {
+	gw.audit.mu.Lock()
+	pending := gw.audit.retained
+	gw.audit.retained = nil
+	gw.audit.mu.Unlock()
+
+	for i, msg := range pending {
+		token := client.Publish(msg.topic, 1, true, msg.payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("[ERROR] Failed to publish to %s: %v", msg.topic, token.Error())
+			gw.audit.mu.Lock()
+			gw.audit.retained = append(pending[i:], gw.audit.retained...)
+			gw.audit.mu.Unlock()
+			return
+		}
+		log.Printf("[MQTT] Published retained %s (%d bytes)", msg.topic, len(msg.payload))
+	}
+}
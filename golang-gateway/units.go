@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// UnitsConfig controls unit normalization. Every sensor type has a canonical
+// UCUM unit; readings in any other compatible unit are converted on read
+// (and commands converted back on write). A sensor whose configured unit is
+// unknown or measures a different quantity than its type is rejected when
+// Strict is set; otherwise it is flagged and its readings are marked
+// "invalid_unit" so they never reach the archive.
+type UnitsConfig struct {
+	Strict bool `yaml:"strict"`
+	// Canonical overrides the canonical unit of a sensor type
+	Canonical map[string]string `yaml:"canonical,omitempty"`
+}
+
+// unitDefinition converts a unit to its dimension's base unit:
+// base = value*scale + offset
+type unitDefinition struct {
+	code      string
+	dimension string
+	scale     float64
+	offset    float64
+}
+
+// unitRegistry holds the known units by UCUM code
+var unitRegistry = map[string]unitDefinition{}
+
+// unitAliases maps common spellings to UCUM codes
+var unitAliases = map[string]string{}
+
+func registerUnit(code, dimension string, scale, offset float64, aliases ...string) {
+	unitRegistry[code] = unitDefinition{code: code, dimension: dimension, scale: scale, offset: offset}
+	for _, alias := range aliases {
+		unitAliases[strings.ToLower(alias)] = code
+	}
+}
+
+func init() {
+	registerUnit("Cel", "temperature", 1, 0, "celsius", "degC", "°C", "C")
+	registerUnit("[degF]", "temperature", 5.0/9, -32*5.0/9, "fahrenheit", "degF", "°F", "F")
+	registerUnit("K", "temperature", 1, -273.15, "kelvin")
+	registerUnit("%", "fraction", 1, 0, "percent", "pct", "%RH", "RH")
+	registerUnit("1", "fraction", 100, 0, "ratio")
+	registerUnit("ppm", "concentration", 1, 0, "[ppm]")
+	registerUnit("ppb", "concentration", 0.001, 0, "[ppb]")
+	registerUnit("lx", "illuminance", 1, 0, "lux")
+	registerUnit("[ft_i]-2.[cd_i]", "illuminance", 10.7639, 0, "footcandle", "fc")
+	registerUnit("kW.h", "energy", 1, 0, "kwh", "kWh")
+	registerUnit("W.h", "energy", 0.001, 0, "wh", "Wh")
+	registerUnit("MW.h", "energy", 1000, 0, "mwh", "MWh")
+	registerUnit("MJ", "energy", 1/3.6, 0, "megajoule")
+	registerUnit("GJ", "energy", 1000/3.6, 0, "gigajoule")
+	registerUnit("W", "power", 1, 0, "watt")
+	registerUnit("kW", "power", 1000, 0, "kilowatt")
+	registerUnit("Pa", "pressure", 1, 0, "pascal")
+	registerUnit("hPa", "pressure", 100, 0, "mbar")
+	registerUnit("kPa", "pressure", 1000, 0)
+	registerUnit("bar", "pressure", 100000, 0)
+	registerUnit("[psi]", "pressure", 6894.757, 0, "psi")
+	registerUnit("[in_i'H2O]", "pressure", 249.0889, 0, "inH2O", "in_wc")
+	registerUnit("m3", "volume", 1, 0, "m³")
+	registerUnit("L", "volume", 0.001, 0, "l", "liter", "litre")
+	registerUnit("[gal_us]", "volume", 0.003785411784, 0, "gal", "gallon")
+	registerUnit("m3/h", "volume_flow", 1, 0, "m³/h", "cmh")
+	registerUnit("L/s", "volume_flow", 3.6, 0, "l/s", "lps")
+	registerUnit("L/min", "volume_flow", 0.06, 0, "l/min", "lpm")
+	registerUnit("[ft_i]3/min", "volume_flow", 1.699011, 0, "cfm")
+	registerUnit("[gal_us]/min", "volume_flow", 0.2271247, 0, "gpm")
+	registerUnit("ug/m3", "mass_concentration", 1, 0, "µg/m³", "ug/m³", "µg/m3")
+	registerUnit("mg/m3", "mass_concentration", 1000, 0, "mg/m³")
+	registerUnit("dB", "level", 1, 0, "db", "dBA", "dB(A)")
+	registerUnit("mm/s", "velocity", 1, 0)
+	registerUnit("m/s", "velocity", 1000, 0)
+	registerUnit("[in_i]/s", "velocity", 25.4, 0, "in/s", "ips")
+	registerUnit("{count}", "count", 1, 0, "count", "people", "persons")
+	registerUnit("{bool}", "boolean", 1, 0, "boolean", "bool", "state")
+	registerUnit("{index}", "index", 1, 0, "index", "aqi")
+	registerUnit("{enum}", "enum", 1, 0, "enum", "mode")
+}
+
+// canonicalUnits is the unit each sensor type is archived in
+var canonicalUnits = map[string]string{
+	"temperature":     "Cel",
+	"humidity":        "%",
+	"co2":             "ppm",
+	"tvoc":            "ppb",
+	"light":           "lx",
+	"energy":          "kW.h",
+	"pressure":        "Pa",
+	"air_flow":        "m3/h",
+	"water_flow":      "L/min",
+	"water_volume":    "m3",
+	"valve_position":  "%",
+	"damper_position": "%",
+	"pm25":            "ug/m3",
+	"pm10":            "ug/m3",
+	"noise_db":        "dB",
+	"vibration":       "mm/s",
+	"occupancy":       "{count}",
+	"motion":          "{bool}",
+	"leak":            "{bool}",
+	"contact":         "{bool}",
+	"air_quality":     "{index}",
+	"power":           "W",
+	"ups_load":        "%",
+	"dimmer_level":    "%",
+	"blind_position":  "%",
+	"battery":         "%",
+}
+
+// lookupUnit resolves a UCUM code or alias
+func lookupUnit(name string) (unitDefinition, bool) {
+	if u, ok := unitRegistry[name]; ok {
+		return u, true
+	}
+	if code, ok := unitAliases[strings.ToLower(name)]; ok {
+		return unitRegistry[code], true
+	}
+	return unitDefinition{}, false
+}
+
+// unitConversion converts a sensor's configured unit to its canonical unit
+type unitConversion struct {
+	from, to unitDefinition
+}
+
+func (c *unitConversion) toCanonical(v float64) float64 {
+	return (v*c.from.scale + c.from.offset - c.to.offset) / c.to.scale
+}
+
+func (c *unitConversion) fromCanonical(v float64) float64 {
+	return (v*c.to.scale + c.to.offset - c.from.offset) / c.from.scale
+}
+
+// resolveUnits checks every sensor's unit against the canonical unit of its
+// type and prepares the conversions
+func (gw *Gateway) resolveUnits() error {
+	config := &gw.settings.Units
+	for sensorType, name := range config.Canonical {
+		if _, ok := lookupUnit(name); !ok {
+			return fmt.Errorf("unknown canonical unit %q for %s", name, sensorType)
+		}
+	}
+
+	ids := make([]string, 0, len(gw.sensors))
+	for id := range gw.sensors {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	converted := 0
+	for _, id := range ids {
+		sensor := gw.sensors[id]
+		canonicalName, ok := config.Canonical[sensor.Type]
+		if !ok {
+			canonicalName, ok = canonicalUnits[sensor.Type]
+		}
+		if !ok {
+			continue
+		}
+		canonical, _ := lookupUnit(canonicalName)
+		if sensor.Unit == "" {
+			sensor.units = &unitConversion{from: canonical, to: canonical}
+			continue
+		}
+
+		unit, known := lookupUnit(sensor.Unit)
+		var err error
+		switch {
+		case !known:
+			err = fmt.Errorf("sensor %s has unknown unit %q", id, sensor.Unit)
+		case unit.dimension != canonical.dimension:
+			err = fmt.Errorf("sensor %s unit %q (%s) is incompatible with type %s (%s)", id, sensor.Unit, unit.dimension, sensor.Type, canonical.code)
+		}
+		if err != nil {
+			if config.Strict {
+				return err
+			}
+			log.Printf("[ERROR] %v; its readings are flagged invalid_unit", err)
+			sensor.unitInvalid = true
+			continue
+		}
+		sensor.units = &unitConversion{from: unit, to: canonical}
+		if unit.code != canonical.code {
+			converted++
+			log.Printf("Sensor %s: converting %s to %s", id, unit.code, canonical.code)
+		}
+	}
+	if converted > 0 {
+		log.Printf("Unit normalization active for %d sensors", converted)
+	}
+	return nil
+}
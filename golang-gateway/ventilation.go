@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ventilationBucket = []byte("ventilation")
+
+// VentilationConfig reports CO2 ventilation compliance: every minute the
+// CO2 of each occupied room is compared with the thresholds, and at the end
+// of each local day the minutes above each threshold are published per room
+// on ventilation/<room_id>/daily. Reports of the last RetainDays days, and
+// the running figures of today, are served by GET /ventilation. Occupancy
+// is determined as for comfort compliance.
+type VentilationConfig struct {
+	Enabled          bool      `yaml:"enabled"`
+	ThresholdsPPM    []float64 `yaml:"thresholds_ppm"`
+	RetainDays       int       `yaml:"retain_days"`
+	OccupiedSchedule `yaml:",inline"`
+}
+
+func (c *VentilationConfig) normalize() error {
+	if len(c.ThresholdsPPM) == 0 {
+		c.ThresholdsPPM = []float64{1000, 1500}
+	}
+	for _, ppm := range c.ThresholdsPPM {
+		if ppm <= 0 {
+			return fmt.Errorf("ventilation threshold %.0f ppm is invalid", ppm)
+		}
+	}
+	sort.Float64s(c.ThresholdsPPM)
+	if c.RetainDays <= 0 {
+		c.RetainDays = 31
+	}
+	return c.OccupiedSchedule.normalize("ventilation")
+}
+
+// VentilationReport is one room's CO2 exposure over a day. MinutesAbove is
+// keyed by threshold in ppm; occupied minutes without a CO2 reading are
+// NoDataMinutes.
+type VentilationReport struct {
+	RoomID          string             `json:"room_id"`
+	Date            string             `json:"date"`
+	OccupiedMinutes float64            `json:"occupied_minutes"`
+	MinutesAbove    map[string]float64 `json:"minutes_above_ppm"`
+	MeanCO2PPM      *float64           `json:"mean_co2_ppm,omitempty"`
+	MaxCO2PPM       *float64           `json:"max_co2_ppm,omitempty"`
+	NoDataMinutes   float64            `json:"no_data_minutes"`
+	// Occupancy is "sensor" or "schedule"
+	Occupancy string `json:"occupancy"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ventilationDay accumulates one room's occupied seconds for the current
+// day
+type ventilationDay struct {
+	occupied, noData float64
+	above            []float64
+	ppmSeconds, max  float64
+	sensed           bool
+}
+
+type ventilationTracker struct {
+	mu     sync.Mutex
+	config *VentilationConfig
+	day    time.Time
+	last   time.Time
+	rooms  map[string]*ventilationDay
+	// history holds the reports of completed days by date
+	history map[string][]VentilationReport
+}
+
+func newVentilationTracker(config *VentilationConfig) *ventilationTracker {
+	return &ventilationTracker{
+		config:  config,
+		rooms:   make(map[string]*ventilationDay),
+		history: make(map[string][]VentilationReport),
+	}
+}
+
+// loadVentilationReports restores the report history from the state store
+func (gw *Gateway) loadVentilationReports() error {
+	t := gw.ventilation
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	err := gw.store.load(ventilationBucket, func(date string, data []byte) error {
+		var reports []VentilationReport
+		if err := json.Unmarshal(data, &reports); err != nil {
+			return fmt.Errorf("failed to parse ventilation reports of %s: %w", date, err)
+		}
+		t.history[date] = reports
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore ventilation reports: %w", err)
+	}
+	return nil
+}
+
+// trackVentilation samples every room each minute and publishes the daily
+// reports when the local date changes
+func (gw *Gateway) trackVentilation() {
+	defer gw.wg.Done()
+
+	ticker := time.NewTicker(occupancySampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case now := <-ticker.C:
+			gw.sampleVentilation(now)
+		}
+	}
+}
+
+func (gw *Gateway) sampleVentilation(now time.Time) {
+	t := gw.ventilation
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	conditions := gw.allRoomConditions()
+
+	t.mu.Lock()
+	var reports []VentilationReport
+	if !t.day.IsZero() && day.After(t.day) {
+		reports = t.reportsLocked(now)
+		t.history[t.day.Format("2006-01-02")] = reports
+		cutoff := day.AddDate(0, 0, -t.config.RetainDays).Format("2006-01-02")
+		for date := range t.history {
+			if date < cutoff {
+				delete(t.history, date)
+			}
+		}
+	}
+	if t.day.IsZero() || day.After(t.day) {
+		t.day = day
+		t.rooms = make(map[string]*ventilationDay)
+	}
+	elapsed := now.Sub(t.last).Seconds()
+	if t.last.IsZero() || elapsed > 2*occupancySampleInterval.Seconds() {
+		elapsed = occupancySampleInterval.Seconds()
+	}
+	t.last = now
+	for roomID, rc := range conditions {
+		acc := t.rooms[roomID]
+		if acc == nil {
+			acc = &ventilationDay{above: make([]float64, len(t.config.ThresholdsPPM))}
+			t.rooms[roomID] = acc
+		}
+		acc.sensed = rc.sensed
+		occupied := rc.occupied
+		if !rc.sensed {
+			occupied = t.config.scheduled(now)
+		}
+		if !occupied {
+			continue
+		}
+		acc.occupied += elapsed
+		if !rc.hasCO2 {
+			acc.noData += elapsed
+			continue
+		}
+		acc.ppmSeconds += rc.co2 * elapsed
+		acc.max = math.Max(acc.max, rc.co2)
+		for i, ppm := range t.config.ThresholdsPPM {
+			if rc.co2 > ppm {
+				acc.above[i] += elapsed
+			}
+		}
+	}
+	var history map[string]interface{}
+	if len(reports) > 0 {
+		history = make(map[string]interface{}, len(t.history))
+		for date, r := range t.history {
+			history[date] = r
+		}
+	}
+	t.mu.Unlock()
+
+	if len(reports) == 0 {
+		return
+	}
+	if err := gw.store.save(ventilationBucket, history); err != nil {
+		log.Printf("[ERROR] Failed to persist ventilation reports: %v", err)
+	}
+	for i := range reports {
+		gw.publishVentilationReport(&reports[i])
+	}
+}
+
+// reportsLocked builds the reports of the current day so far, ordered by
+// room
+func (t *ventilationTracker) reportsLocked(now time.Time) []VentilationReport {
+	minutes := func(sec float64) float64 {
+		return math.Round(sec/60*10) / 10
+	}
+	reports := make([]VentilationReport, 0, len(t.rooms))
+	for roomID, acc := range t.rooms {
+		report := VentilationReport{
+			RoomID:          roomID,
+			Date:            t.day.Format("2006-01-02"),
+			OccupiedMinutes: minutes(acc.occupied),
+			MinutesAbove:    make(map[string]float64, len(t.config.ThresholdsPPM)),
+			NoDataMinutes:   minutes(acc.noData),
+			Occupancy:       "schedule",
+			Timestamp:       now.Format(time.RFC3339),
+		}
+		if acc.sensed {
+			report.Occupancy = "sensor"
+		}
+		for i, ppm := range t.config.ThresholdsPPM {
+			report.MinutesAbove[strconv.FormatFloat(ppm, 'f', -1, 64)] = minutes(acc.above[i])
+		}
+		if measured := acc.occupied - acc.noData; measured > 0 {
+			report.MeanCO2PPM = floatPtr(math.Round(acc.ppmSeconds / measured))
+			report.MaxCO2PPM = floatPtr(acc.max)
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].RoomID < reports[j].RoomID })
+	return reports
+}
+
+func (gw *Gateway) publishVentilationReport(report *VentilationReport) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal ventilation report for room %s: %v", report.RoomID, err)
+		return
+	}
+	topic := fmt.Sprintf("ventilation/%s/daily", report.RoomID)
+	token := gw.mqttClient.Publish(topic, 1, false, payload)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to publish to %s: %v", topic, token.Error())
+		return
+	}
+	log.Printf("[MQTT] Published to %s", topic)
+}
+
+// handleVentilation serves GET /ventilation?date=YYYY-MM-DD, the reports
+// of a retained day (today's running figures without date)
+func (gw *Gateway) handleVentilation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if gw.ventilation == nil {
+		writeJSONError(w, http.StatusNotFound, "ventilation reporting is disabled")
+		return
+	}
+	date := r.URL.Query().Get("date")
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "date must be YYYY-MM-DD")
+			return
+		}
+	}
+
+	t := gw.ventilation
+	t.mu.Lock()
+	var reports []VentilationReport
+	var ok bool
+	if date == "" || (!t.day.IsZero() && date == t.day.Format("2006-01-02")) {
+		reports, ok = t.reportsLocked(time.Now()), true
+	} else {
+		reports, ok = t.history[date]
+	}
+	t.mu.Unlock()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no ventilation report for "+date)
+		return
+	}
+
+	rooms := make([]VentilationReport, 0, len(reports))
+	for _, report := range reports {
+		if gw.roomAllowed(r, report.RoomID) {
+			rooms = append(rooms, report)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"thresholds_ppm": gw.settings.Ventilation.ThresholdsPPM,
+		"rooms":          rooms,
+	})
+}
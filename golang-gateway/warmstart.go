@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// WarmStartConfig pre-populates the gateway after a restart from its own
+// retained MQTT topics: last readings (published retained on
+// <topic_prefix>/<gateway_id>/readings/<sensor_id> with every state flush)
+// and runtime counters (maintenance/<sensor_id>). It shortens the blind
+// period until every slow-interval sensor has been polled once, and
+// recovers state when the local store was lost with its volume.
+type WarmStartConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	TopicPrefix string `yaml:"topic_prefix,omitempty"`
+	// WaitMs is how long the broker is given to deliver retained messages
+	WaitMs int `yaml:"wait_ms,omitempty"`
+}
+
+func (c *WarmStartConfig) normalize() {
+	if c.TopicPrefix == "" {
+		c.TopicPrefix = "state"
+	}
+	if c.WaitMs <= 0 {
+		c.WaitMs = 2000
+	}
+}
+
+func (gw *Gateway) readingStateTopic(sensorID string) string {
+	return fmt.Sprintf("%s/%s/readings/%s", gw.settings.WarmStart.TopicPrefix, gw.settings.GatewayID, sensorID)
+}
+
+// publishReadingState publishes readings taken since the previous call
+// retained, so the next start can pick them up. Occupancy and motion are
+// left out under privacy mode.
+func (gw *Gateway) publishReadingState() {
+	gw.readingsMutex.RLock()
+	changed := make([]SensorReading, 0)
+	for sensorID, reading := range gw.lastReadings {
+		if reading.Status != "ok" || !reading.Timestamp.After(gw.stateSent[sensorID]) {
+			continue
+		}
+		if gw.privateReading(reading) {
+			continue
+		}
+		changed = append(changed, *reading)
+	}
+	gw.readingsMutex.RUnlock()
+
+	for _, reading := range changed {
+		payload, err := json.Marshal(reading)
+		if err != nil {
+			log.Printf("[ERROR] Failed to marshal reading state for %s: %v", reading.SensorID, err)
+			continue
+		}
+		token := gw.mqttClient.Publish(gw.readingStateTopic(reading.SensorID), 1, true, payload)
+		token.Wait()
+		if token.Error() != nil {
+			log.Printf("[ERROR] Failed to publish reading state for %s: %v", reading.SensorID, token.Error())
+			continue
+		}
+		gw.readingsMutex.Lock()
+		gw.stateSent[reading.SensorID] = reading.Timestamp
+		gw.readingsMutex.Unlock()
+	}
+}
+
+// warmStart collects the retained readings and runtime counters and merges
+// them into state restored from the local store: readings replace older or
+// missing ones (within store.restore_max_age_sec) and runtime counters are
+// taken when they are ahead of the local ones.
+func (gw *Gateway) warmStart() {
+	if !gw.mqttClient.IsConnectionOpen() {
+		log.Printf("[WARN] Warm start skipped: MQTT broker not connected")
+		return
+	}
+
+	var mu sync.Mutex
+	readings := make(map[string]SensorReading)
+	counters := make(map[string]RuntimeCounter)
+	readingsFilter := gw.readingStateTopic("+")
+	readingsPrefix := strings.TrimSuffix(readingsFilter, "+")
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		if !msg.Retained() {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		topic := msg.Topic()
+		switch {
+		case strings.HasPrefix(topic, readingsPrefix):
+			var reading SensorReading
+			if err := json.Unmarshal(msg.Payload(), &reading); err != nil {
+				log.Printf("[WARN] Ignoring retained reading on %s: %v", topic, err)
+				return
+			}
+			readings[strings.TrimPrefix(topic, readingsPrefix)] = reading
+		case strings.HasPrefix(topic, "maintenance/"):
+			var counter RuntimeCounter
+			if err := json.Unmarshal(msg.Payload(), &counter); err != nil {
+				log.Printf("[WARN] Ignoring retained runtime counter on %s: %v", topic, err)
+				return
+			}
+			counters[strings.TrimPrefix(topic, "maintenance/")] = counter
+		}
+	}
+
+	filters := map[string]byte{readingsFilter: 1, "maintenance/+": 1}
+	token := gw.mqttClient.SubscribeMultiple(filters, handler)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[WARN] Warm start skipped: failed to subscribe: %v", token.Error())
+		return
+	}
+	time.Sleep(time.Duration(gw.settings.WarmStart.WaitMs) * time.Millisecond)
+	if token := gw.mqttClient.Unsubscribe(readingsFilter, "maintenance/+"); token.Wait() && token.Error() != nil {
+		log.Printf("[WARN] Failed to unsubscribe warm start topics: %v", token.Error())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	cutoff := time.Now().Add(-time.Duration(gw.settings.Store.RestoreMaxAgeSec) * time.Second)
+	restored := 0
+	gw.readingsMutex.Lock()
+	for sensorID, reading := range readings {
+		if _, ok := gw.sensors[sensorID]; !ok || reading.SensorID != sensorID || reading.Timestamp.Before(cutoff) {
+			continue
+		}
+		if current, ok := gw.lastReadings[sensorID]; ok && !reading.Timestamp.After(current.Timestamp) {
+			continue
+		}
+		copied := reading
+		gw.lastReadings[sensorID] = &copied
+		gw.stateSent[sensorID] = reading.Timestamp
+		restored++
+	}
+	gw.readingsMutex.Unlock()
+
+	merged := 0
+	for sensorID, counter := range counters {
+		config, ok := gw.sensors[sensorID]
+		if !ok || !gw.tracksRuntime(sensorID, config) {
+			continue
+		}
+		counter.SensorID = sensorID
+		if gw.runtime.merge(counter) {
+			merged++
+		}
+	}
+	log.Printf("Warm start: %d readings and %d runtime counters taken from retained MQTT state", restored, merged)
+}
@@ -0,0 +1,541 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// WebAssembly opcodes with immediates or control semantics; plain numeric
+// opcodes are executed under their own byte value
+const (
+	opUnreachable  = 0x00
+	opNop          = 0x01
+	opBlock        = 0x02
+	opLoop         = 0x03
+	opIf           = 0x04
+	opElse         = 0x05
+	opEnd          = 0x0b
+	opBr           = 0x0c
+	opBrIf         = 0x0d
+	opBrTable      = 0x0e
+	opReturn       = 0x0f
+	opCall         = 0x10
+	opCallIndirect = 0x11
+	opDrop         = 0x1a
+	opSelect       = 0x1b
+	opSelectT      = 0x1c
+	opLocalGet     = 0x20
+	opLocalSet     = 0x21
+	opLocalTee     = 0x22
+	opGlobalGet    = 0x23
+	opGlobalSet    = 0x24
+	opTableGet     = 0x25
+	opTableSet     = 0x26
+	opI32Load      = 0x28
+	opI64Store32   = 0x3e
+	opMemorySize   = 0x3f
+	opMemoryGrow   = 0x40
+	opI32Const     = 0x41
+	opI64Const     = 0x42
+	opF32Const     = 0x43
+	opF64Const     = 0x44
+	opRefNull      = 0xd0
+	opRefIsNull    = 0xd1
+	opRefFunc      = 0xd2
+	opPrefixFC     = 0xfc
+)
+
+// Internal instructions. Unused opcode bytes carry the compiled control
+// flow; 0xfc-prefixed instructions run as fcBase plus their subopcode.
+const (
+	iJump       = 0x06 // a: target
+	iJumpIfZero = 0x07 // pop condition; a: target
+	iBr         = 0x08 // a: target, b: arity, c: height
+	iBrIf       = 0x09 // pop condition; as iBr
+	iBrTable    = 0x0a // pop index; a: brTables index
+	iConst      = 0x12 // c: value
+
+	fcBase = 0xe0
+)
+
+// 0xfc subopcodes
+const (
+	fcMemoryInit = 8
+	fcDataDrop   = 9
+	fcMemoryCopy = 10
+	fcMemoryFill = 11
+	fcTableInit  = 12
+	fcElemDrop   = 13
+	fcTableCopy  = 14
+	fcTableGrow  = 15
+	fcTableSize  = 16
+	fcTableFill  = 17
+)
+
+type instr struct {
+	op uint16
+	a  uint32
+	b  uint32
+	c  uint64
+}
+
+// brTarget is a resolved branch: jump to pc, keeping the top arity values
+// on top of the label's operand height
+type brTarget struct {
+	pc     uint32
+	arity  uint32
+	height uint32
+}
+
+type compiledFunc struct {
+	numParams  int
+	numLocals  int // including parameters
+	numResults int
+	maxHeight  int
+	code       []instr
+	brTables   [][]brTarget
+}
+
+type ctrlFrame struct {
+	op          byte // opBlock, opLoop, opIf, opElse, or 0 for the function
+	params      int
+	results     int
+	height      int // operand height below the block's parameters
+	loopPC      int
+	fixups      []fixup
+	elseFixup   int
+	unreachable bool
+}
+
+// fixup is a forward branch patched when its block ends: the a operand of
+// instruction instr, or target slot of its branch table
+type fixup struct {
+	instr int
+	slot  int
+}
+
+type compiler struct {
+	m       *Module
+	r       *reader
+	f       *compiledFunc
+	locals  int
+	height  int
+	ctrl    []ctrlFrame
+	globals int
+}
+
+// stackEffect is the operand height change of plain numeric instructions
+// 0x45 to 0xc4
+func stackEffect(op byte) int {
+	switch {
+	case op == 0x45 || op == 0x50:
+		return 0 // eqz
+	case op <= 0x66:
+		return -1 // comparisons
+	case op <= 0x69, op >= 0x79 && op <= 0x7b, op >= 0x8b && op <= 0x91, op >= 0x99 && op <= 0x9f:
+		return 0 // unary
+	case op <= 0xa6:
+		return -1 // binary
+	}
+	return 0 // conversions and sign extensions
+}
+
+func compileFunc(m *Module, t FuncType, body funcBody) (cf *compiledFunc, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			cf, err = nil, decodeFailure(r)
+		}
+	}()
+
+	f := &compiledFunc{
+		numParams:  len(t.Params),
+		numLocals:  len(t.Params) + len(body.locals),
+		numResults: len(t.Results),
+	}
+	c := &compiler{m: m, r: &reader{b: body.code}, f: f, locals: f.numLocals, globals: len(m.globals)}
+	c.ctrl = append(c.ctrl, ctrlFrame{results: len(t.Results), elseFixup: -1})
+	c.compile()
+	if c.r.pos != len(c.r.b) {
+		return nil, errors.New("trailing bytes after function end")
+	}
+	return f, nil
+}
+
+func (c *compiler) emit(op uint16, a, b uint32, v uint64) int {
+	c.f.code = append(c.f.code, instr{op: op, a: a, b: b, c: v})
+	return len(c.f.code) - 1
+}
+
+func (c *compiler) push(n int) {
+	c.height += n
+	if c.height > c.f.maxHeight {
+		c.f.maxHeight = c.height
+	}
+}
+
+func (c *compiler) pop(n int) {
+	frame := &c.ctrl[len(c.ctrl)-1]
+	if c.height-n < frame.height {
+		if !frame.unreachable {
+			fail("operand stack underflow")
+		}
+		c.height = frame.height
+		return
+	}
+	c.height -= n
+}
+
+// setUnreachable marks the rest of the current block as dead code, where
+// the operand stack is polymorphic
+func (c *compiler) setUnreachable() {
+	frame := &c.ctrl[len(c.ctrl)-1]
+	frame.unreachable = true
+	c.height = frame.height
+}
+
+// blockType returns the parameter and result counts of a block
+func (c *compiler) blockType() (int, int) {
+	if c.r.pos >= len(c.r.b) {
+		fail("unexpected end of function")
+	}
+	b := c.r.b[c.r.pos]
+	if b == 0x40 {
+		c.r.pos++
+		return 0, 0
+	}
+	if b >= 0x6f && b <= 0x7f {
+		c.r.valueType()
+		return 0, 1
+	}
+	index := c.r.signed(33)
+	if index < 0 || int(index) >= len(c.m.types) {
+		fail("invalid block type %d", index)
+	}
+	t := c.m.types[index]
+	return len(t.Params), len(t.Results)
+}
+
+// branch emits a branch to the label depth blocks out
+func (c *compiler) branch(op uint16, depth uint32) {
+	if int(depth) >= len(c.ctrl) {
+		fail("invalid branch depth %d", depth)
+	}
+	frame := &c.ctrl[len(c.ctrl)-1-int(depth)]
+	if frame.op == opLoop {
+		c.emit(op, uint32(frame.loopPC), uint32(frame.params), uint64(frame.height))
+		return
+	}
+	i := c.emit(op, 0, uint32(frame.results), uint64(frame.height))
+	frame.fixups = append(frame.fixups, fixup{instr: i, slot: -1})
+}
+
+func (c *compiler) checkLocal(index uint32) {
+	if int(index) >= c.locals {
+		fail("invalid local %d", index)
+	}
+}
+
+func (c *compiler) checkFunc(index uint32) {
+	if int(index) >= c.m.numFuncs() {
+		fail("invalid function %d", index)
+	}
+}
+
+func (c *compiler) checkTable(index uint32) {
+	if int(index) >= len(c.m.tables) {
+		fail("invalid table %d", index)
+	}
+}
+
+func (c *compiler) checkMemory() {
+	if c.m.memory == nil {
+		fail("memory instruction without memory")
+	}
+}
+
+func (c *compiler) compile() {
+	r := c.r
+	for {
+		op := r.byte()
+		switch op {
+		case opUnreachable:
+			c.emit(opUnreachable, 0, 0, 0)
+			c.setUnreachable()
+		case opNop:
+		case opBlock, opLoop:
+			params, results := c.blockType()
+			c.pop(params)
+			c.ctrl = append(c.ctrl, ctrlFrame{op: op, params: params, results: results, height: c.height, loopPC: len(c.f.code), elseFixup: -1})
+			c.push(params)
+		case opIf:
+			params, results := c.blockType()
+			c.pop(1)
+			c.pop(params)
+			jump := c.emit(iJumpIfZero, 0, 0, 0)
+			c.ctrl = append(c.ctrl, ctrlFrame{op: opIf, params: params, results: results, height: c.height, elseFixup: jump})
+			c.push(params)
+		case opElse:
+			frame := &c.ctrl[len(c.ctrl)-1]
+			if frame.op != opIf {
+				fail("else without if")
+			}
+			jump := c.emit(iJump, 0, 0, 0)
+			frame.fixups = append(frame.fixups, fixup{instr: jump, slot: -1})
+			c.f.code[frame.elseFixup].a = uint32(len(c.f.code))
+			frame.elseFixup = -1
+			frame.op = opElse
+			frame.unreachable = false
+			c.height = frame.height
+			c.push(frame.params)
+		case opEnd:
+			frame := c.ctrl[len(c.ctrl)-1]
+			c.ctrl = c.ctrl[:len(c.ctrl)-1]
+			end := uint32(len(c.f.code))
+			if frame.elseFixup >= 0 {
+				if frame.params != frame.results {
+					fail("if without else must not change the operand stack")
+				}
+				c.f.code[frame.elseFixup].a = end
+			}
+			for _, fx := range frame.fixups {
+				if fx.slot < 0 {
+					c.f.code[fx.instr].a = end
+				} else {
+					c.f.brTables[c.f.code[fx.instr].a][fx.slot].pc = end
+				}
+			}
+			c.height = frame.height
+			c.push(frame.results)
+			if len(c.ctrl) == 0 {
+				c.emit(opReturn, 0, 0, 0)
+				return
+			}
+		case opBr:
+			c.branch(iBr, r.u32())
+			c.setUnreachable()
+		case opBrIf:
+			c.pop(1)
+			c.branch(iBrIf, r.u32())
+		case opBrTable:
+			n := r.count()
+			labels := make([]uint32, n+1)
+			for i := range labels {
+				labels[i] = r.u32()
+			}
+			c.pop(1)
+			table := uint32(len(c.f.brTables))
+			targets := make([]brTarget, len(labels))
+			i := c.emit(iBrTable, table, 0, 0)
+			for slot, depth := range labels {
+				if int(depth) >= len(c.ctrl) {
+					fail("invalid branch depth %d", depth)
+				}
+				frame := &c.ctrl[len(c.ctrl)-1-int(depth)]
+				targets[slot].height = uint32(frame.height)
+				if frame.op == opLoop {
+					targets[slot].pc = uint32(frame.loopPC)
+					targets[slot].arity = uint32(frame.params)
+					continue
+				}
+				targets[slot].arity = uint32(frame.results)
+				frame.fixups = append(frame.fixups, fixup{instr: i, slot: slot})
+			}
+			c.f.brTables = append(c.f.brTables, targets)
+			c.setUnreachable()
+		case opReturn:
+			c.emit(opReturn, 0, 0, 0)
+			c.setUnreachable()
+		case opCall:
+			index := r.u32()
+			c.checkFunc(index)
+			t := c.m.funcType(index)
+			c.pop(len(t.Params))
+			c.push(len(t.Results))
+			c.emit(opCall, index, 0, 0)
+		case opCallIndirect:
+			index, table := r.u32(), r.u32()
+			if int(index) >= len(c.m.types) {
+				fail("invalid type %d", index)
+			}
+			c.checkTable(table)
+			t := c.m.types[index]
+			c.pop(1)
+			c.pop(len(t.Params))
+			c.push(len(t.Results))
+			c.emit(opCallIndirect, index, table, 0)
+		case opDrop:
+			c.pop(1)
+			c.emit(opDrop, 0, 0, 0)
+		case opSelect, opSelectT:
+			if op == opSelectT {
+				for n := r.count(); n > 0; n-- {
+					r.valueType()
+				}
+			}
+			c.pop(3)
+			c.push(1)
+			c.emit(opSelect, 0, 0, 0)
+		case opLocalGet, opLocalSet, opLocalTee:
+			index := r.u32()
+			c.checkLocal(index)
+			switch op {
+			case opLocalGet:
+				c.push(1)
+			case opLocalSet:
+				c.pop(1)
+			}
+			c.emit(uint16(op), index, 0, 0)
+		case opGlobalGet, opGlobalSet:
+			index := r.u32()
+			if int(index) >= c.globals {
+				fail("invalid global %d", index)
+			}
+			if op == opGlobalGet {
+				c.push(1)
+			} else {
+				if !c.m.globals[index].mutable {
+					fail("global %d is immutable", index)
+				}
+				c.pop(1)
+			}
+			c.emit(uint16(op), index, 0, 0)
+		case opTableGet, opTableSet:
+			table := r.u32()
+			c.checkTable(table)
+			if op == opTableGet {
+				c.pop(1)
+				c.push(1)
+			} else {
+				c.pop(2)
+			}
+			c.emit(uint16(op), table, 0, 0)
+		case opMemorySize, opMemoryGrow:
+			if r.byte() != 0 {
+				fail("multiple memories are not supported")
+			}
+			c.checkMemory()
+			if op == opMemorySize {
+				c.push(1)
+			}
+			c.emit(uint16(op), 0, 0, 0)
+		case opI32Const:
+			c.push(1)
+			c.emit(iConst, 0, 0, uint64(uint32(r.s32())))
+		case opI64Const:
+			c.push(1)
+			c.emit(iConst, 0, 0, uint64(r.s64()))
+		case opF32Const:
+			c.push(1)
+			c.emit(iConst, 0, 0, uint64(binary.LittleEndian.Uint32(r.bytes(4))))
+		case opF64Const:
+			c.push(1)
+			c.emit(iConst, 0, 0, binary.LittleEndian.Uint64(r.bytes(8)))
+		case opRefNull:
+			r.refType()
+			c.push(1)
+			c.emit(iConst, 0, 0, 0)
+		case opRefIsNull:
+			c.pop(1)
+			c.push(1)
+			c.emit(opRefIsNull, 0, 0, 0)
+		case opRefFunc:
+			index := r.u32()
+			c.checkFunc(index)
+			c.push(1)
+			// Function references are stored as index+1 so that zero is null
+			c.emit(iConst, 0, 0, uint64(index)+1)
+		case opPrefixFC:
+			c.compileFC(r.u32())
+		default:
+			switch {
+			case op >= opI32Load && op <= opI64Store32:
+				r.u32() // alignment hint
+				offset := r.u32()
+				c.checkMemory()
+				if op >= 0x36 {
+					c.pop(2)
+				} else {
+					c.pop(1)
+					c.push(1)
+				}
+				c.emit(uint16(op), offset, 0, 0)
+			case op >= 0x45 && op <= 0xc4:
+				if d := stackEffect(op); d < 0 {
+					c.pop(1 - d)
+				} else {
+					c.pop(1)
+				}
+				c.push(1)
+				c.emit(uint16(op), 0, 0, 0)
+			default:
+				fail("unsupported opcode 0x%02x", op)
+			}
+		}
+	}
+}
+
+func (c *compiler) compileFC(sub uint32) {
+	r := c.r
+	var a, b uint32
+	switch {
+	case sub <= 7:
+		// saturating truncation
+		c.pop(1)
+		c.push(1)
+	case sub == fcMemoryInit:
+		a = r.u32()
+		if int(a) >= len(c.m.datas) {
+			fail("invalid data segment %d", a)
+		}
+		r.byte()
+		c.checkMemory()
+		c.pop(3)
+	case sub == fcDataDrop:
+		a = r.u32()
+		if int(a) >= len(c.m.datas) {
+			fail("invalid data segment %d", a)
+		}
+	case sub == fcMemoryCopy:
+		r.byte()
+		r.byte()
+		c.checkMemory()
+		c.pop(3)
+	case sub == fcMemoryFill:
+		r.byte()
+		c.checkMemory()
+		c.pop(3)
+	case sub == fcTableInit:
+		a, b = r.u32(), r.u32()
+		if int(a) >= len(c.m.elems) {
+			fail("invalid element segment %d", a)
+		}
+		c.checkTable(b)
+		c.pop(3)
+	case sub == fcElemDrop:
+		a = r.u32()
+		if int(a) >= len(c.m.elems) {
+			fail("invalid element segment %d", a)
+		}
+	case sub == fcTableCopy:
+		a, b = r.u32(), r.u32()
+		c.checkTable(a)
+		c.checkTable(b)
+		c.pop(3)
+	case sub == fcTableGrow:
+		a = r.u32()
+		c.checkTable(a)
+		c.pop(2)
+		c.push(1)
+	case sub == fcTableSize:
+		a = r.u32()
+		c.checkTable(a)
+		c.push(1)
+	case sub == fcTableFill:
+		a = r.u32()
+		c.checkTable(a)
+		c.pop(3)
+	default:
+		fail("unsupported opcode 0xfc %d", sub)
+	}
+	c.emit(uint16(fcBase+sub), a, b, 0)
+}
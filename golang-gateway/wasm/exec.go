@@ -0,0 +1,1067 @@
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+const pageSize = 65536
+
+// maxTableSize caps the elements of a table, declared or grown
+const maxTableSize = 1 << 20
+
+// HostFunc implements an imported function. It receives the arguments and
+// returns the results the import's type declares.
+type HostFunc func(in *Instance, args []uint64) []uint64
+
+// ImportResolver supplies the host function for an import, or an error when
+// the host does not provide it
+type ImportResolver func(imp Import) (HostFunc, error)
+
+// Config bounds the resources of an instance
+type Config struct {
+	// MaxMemoryPages caps linear memory (64 KiB pages)
+	MaxMemoryPages uint32
+	// Fuel is consumed by every taken branch and call; a call that runs out
+	// traps with ErrFuelExhausted
+	Fuel int64
+	// StackSize is the number of value slots for locals and operands
+	StackSize int
+	// MaxCallDepth limits recursion
+	MaxCallDepth int
+}
+
+// ErrFuelExhausted is returned by calls that exceed their fuel budget
+var ErrFuelExhausted = errors.New("fuel exhausted")
+
+// Trap is a runtime error raised by the module
+type Trap struct {
+	Reason string
+}
+
+func (t *Trap) Error() string {
+	return "wasm trap: " + t.Reason
+}
+
+// ExitError is returned when the module exits through a host function that
+// calls Exit (such as WASI proc_exit)
+type ExitError struct {
+	Code uint32
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("module exited with code %d", e.Code)
+}
+
+func trap(reason string) {
+	panic(&Trap{Reason: reason})
+}
+
+type function struct {
+	typ    FuncType
+	typeID int // canonical type for call_indirect checks
+	host   HostFunc
+	code   *compiledFunc
+}
+
+// Instance is an instantiated module. Calls are not safe for concurrent use.
+type Instance struct {
+	module      *Module
+	config      Config
+	funcs       []function
+	globals     []uint64
+	memory      []byte
+	maxPages    uint32
+	tables      [][]uint64
+	elemDropped []bool
+	dataDropped []bool
+	typeIDs     []int
+	stack       []uint64
+	fuel        int64
+	depth       int
+}
+
+// Instantiate creates an instance of a module, resolving its imports and
+// running its start function
+func Instantiate(m *Module, resolve ImportResolver, config Config) (in *Instance, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			in, err = nil, recoveredError(r)
+		}
+	}()
+	if config.StackSize <= 0 {
+		config.StackSize = 1 << 16
+	}
+	if config.MaxCallDepth <= 0 {
+		config.MaxCallDepth = 10000
+	}
+	if config.MaxMemoryPages == 0 || config.MaxMemoryPages > 65536 {
+		config.MaxMemoryPages = 65536
+	}
+	in = &Instance{
+		module:      m,
+		config:      config,
+		stack:       make([]uint64, config.StackSize),
+		elemDropped: make([]bool, len(m.elems)),
+		dataDropped: make([]bool, len(m.datas)),
+	}
+
+	// Canonical type IDs make call_indirect signature checks an integer
+	// comparison
+	in.typeIDs = make([]int, len(m.types))
+	for i := range m.types {
+		in.typeIDs[i] = i
+		for j := 0; j < i; j++ {
+			if m.types[i].equal(m.types[j]) {
+				in.typeIDs[i] = in.typeIDs[j]
+				break
+			}
+		}
+	}
+	canonical := func(t FuncType) int {
+		for i := range m.types {
+			if m.types[i].equal(t) {
+				return in.typeIDs[i]
+			}
+		}
+		return -1
+	}
+	for _, imp := range m.imports {
+		host, err := resolve(imp)
+		if err != nil {
+			return nil, fmt.Errorf("import %s.%s: %w", imp.Module, imp.Name, err)
+		}
+		in.funcs = append(in.funcs, function{typ: imp.Type, typeID: canonical(imp.Type), host: host})
+	}
+	for i, t := range m.funcs {
+		in.funcs = append(in.funcs, function{typ: m.types[t], typeID: in.typeIDs[t], code: m.compiled[i]})
+	}
+
+	if m.memory != nil {
+		in.maxPages = config.MaxMemoryPages
+		if m.memory.hasMax && m.memory.max < in.maxPages {
+			in.maxPages = m.memory.max
+		}
+		if m.memory.min > in.maxPages {
+			return nil, fmt.Errorf("module needs %d memory pages, limit is %d", m.memory.min, in.maxPages)
+		}
+		in.memory = make([]byte, int(m.memory.min)*pageSize)
+	}
+	for _, t := range m.tables {
+		in.tables = append(in.tables, make([]uint64, t.min))
+	}
+	for _, g := range m.globals {
+		in.globals = append(in.globals, in.evalConst(g.init))
+	}
+
+	for i, seg := range m.elems {
+		if seg.mode == segActive {
+			in.tableInit(seg.table, uint32(i), uint32(in.evalConst(seg.offset)), 0, uint32(len(seg.init)))
+		}
+		if seg.mode != segPassive {
+			in.elemDropped[i] = true
+		}
+	}
+	for i, seg := range m.datas {
+		if seg.mode == segActive {
+			in.memoryInit(uint32(i), uint32(in.evalConst(seg.offset)), 0, uint32(len(seg.init)))
+			in.dataDropped[i] = true
+		}
+	}
+	if m.start != nil {
+		in.fuel = config.Fuel
+		in.invoke(*m.start, 0)
+	}
+	return in, nil
+}
+
+func (in *Instance) evalConst(e constExpr) uint64 {
+	switch e.op {
+	case opGlobalGet:
+		if int(e.value) < len(in.globals) {
+			return in.globals[e.value]
+		}
+		return 0
+	case opRefNull:
+		return 0
+	case opRefFunc:
+		return e.value + 1
+	}
+	return e.value
+}
+
+// recoveredError turns a panic raised while running module code into an
+// error
+func recoveredError(r interface{}) error {
+	switch e := r.(type) {
+	case *Trap:
+		return e
+	case *ExitError:
+		return e
+	case error:
+		if errors.Is(e, ErrFuelExhausted) {
+			return e
+		}
+		return &Trap{Reason: e.Error()}
+	}
+	return &Trap{Reason: fmt.Sprint(r)}
+}
+
+// Call runs an exported function with a fresh fuel budget
+func (in *Instance) Call(name string, args ...uint64) (results []uint64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results, err = nil, recoveredError(r)
+			in.depth = 0
+		}
+	}()
+	e, ok := in.module.exports[name]
+	if !ok || e.kind != kindFunc {
+		return nil, fmt.Errorf("function %s is not exported", name)
+	}
+	f := &in.funcs[e.index]
+	if len(args) != len(f.typ.Params) {
+		return nil, fmt.Errorf("function %s takes %d arguments, got %d", name, len(f.typ.Params), len(args))
+	}
+	in.fuel = in.config.Fuel
+	copy(in.stack, args)
+	in.invoke(e.index, 0)
+	return append([]uint64(nil), in.stack[:len(f.typ.Results)]...), nil
+}
+
+// Memory returns the linear memory. The slice is replaced when memory grows.
+func (in *Instance) Memory() []byte {
+	return in.memory
+}
+
+// Read returns a copy of size bytes of memory at ptr
+func (in *Instance) Read(ptr, size uint32) ([]byte, bool) {
+	end := uint64(ptr) + uint64(size)
+	if end > uint64(len(in.memory)) {
+		return nil, false
+	}
+	return append([]byte(nil), in.memory[ptr:end]...), true
+}
+
+// Write copies data into memory at ptr
+func (in *Instance) Write(ptr uint32, data []byte) bool {
+	end := uint64(ptr) + uint64(len(data))
+	if end > uint64(len(in.memory)) {
+		return false
+	}
+	copy(in.memory[ptr:end], data)
+	return true
+}
+
+// Exit aborts the running call with an ExitError; host functions use it to
+// implement process exit
+func (in *Instance) Exit(code uint32) {
+	panic(&ExitError{Code: code})
+}
+
+// invoke calls a function whose arguments start at stack[fp] and leaves its
+// results there
+func (in *Instance) invoke(index uint32, fp int) {
+	f := &in.funcs[index]
+	if f.host != nil {
+		np := len(f.typ.Params)
+		results := f.host(in, in.stack[fp:fp+np:fp+np])
+		if len(results) != len(f.typ.Results) {
+			trap(fmt.Sprintf("host function returned %d results, want %d", len(results), len(f.typ.Results)))
+		}
+		copy(in.stack[fp:], results)
+		return
+	}
+	in.depth++
+	if in.depth > in.config.MaxCallDepth {
+		trap("call stack exhausted")
+	}
+	in.execute(f.code, fp)
+	in.depth--
+}
+
+func (in *Instance) growMemory(delta uint32) uint32 {
+	old := uint32(len(in.memory) / pageSize)
+	if uint64(old)+uint64(delta) > uint64(in.maxPages) {
+		return math.MaxUint32
+	}
+	if delta > 0 {
+		grown := make([]byte, int(old+delta)*pageSize)
+		copy(grown, in.memory)
+		in.memory = grown
+	}
+	return old
+}
+
+// checkRange traps unless [offset, offset+n) lies within size
+func checkRange(offset, n uint64, size int, what string) {
+	if offset+n > uint64(size) {
+		trap("out of bounds " + what + " access")
+	}
+}
+
+func (in *Instance) memoryInit(seg, dst, src, n uint32) {
+	data := in.module.datas[seg].init
+	if in.dataDropped[seg] {
+		data = nil
+	}
+	checkRange(uint64(src), uint64(n), len(data), "data segment")
+	checkRange(uint64(dst), uint64(n), len(in.memory), "memory")
+	copy(in.memory[dst:], data[src:src+n])
+}
+
+func (in *Instance) tableInit(table, seg, dst, src, n uint32) {
+	init := in.module.elems[seg].init
+	if in.elemDropped[seg] {
+		init = nil
+	}
+	t := in.tables[table]
+	checkRange(uint64(src), uint64(n), len(init), "element segment")
+	checkRange(uint64(dst), uint64(n), len(t), "table")
+	for i := uint32(0); i < n; i++ {
+		t[dst+i] = in.evalConst(init[src+i])
+	}
+}
+
+func (in *Instance) useFuel() {
+	in.fuel--
+	if in.fuel < 0 && in.config.Fuel > 0 {
+		panic(ErrFuelExhausted)
+	}
+}
+
+// branch moves the top arity values down to dst and returns the new stack
+// pointer
+func branch(stack []uint64, sp, dst, arity int) int {
+	if arity > 0 && dst != sp-arity {
+		copy(stack[dst:dst+arity], stack[sp-arity:sp])
+	}
+	return dst + arity
+}
+
+func truncRange(x float64, lo, hi float64) float64 {
+	if x != x {
+		trap("invalid conversion to integer")
+	}
+	t := math.Trunc(x)
+	if t < lo || t >= hi {
+		trap("integer overflow")
+	}
+	return t
+}
+
+func satI32(x float64) uint64 {
+	switch {
+	case x != x:
+		return 0
+	case x <= math.MinInt32:
+		return 1 << 31
+	case x >= math.MaxInt32:
+		return math.MaxInt32
+	}
+	return uint64(uint32(int32(x)))
+}
+
+func satU32(x float64) uint64 {
+	switch {
+	case x != x || x <= 0:
+		return 0
+	case x >= math.MaxUint32:
+		return math.MaxUint32
+	}
+	return uint64(uint32(x))
+}
+
+func satI64(x float64) uint64 {
+	switch {
+	case x != x:
+		return 0
+	case x <= math.MinInt64:
+		return 1 << 63
+	case x >= math.MaxInt64:
+		return math.MaxInt64
+	}
+	return uint64(int64(x))
+}
+
+func satU64(x float64) uint64 {
+	switch {
+	case x != x || x <= 0:
+		return 0
+	case x >= math.MaxUint64:
+		return math.MaxUint64
+	}
+	return f64ToU64(x)
+}
+
+func f64ToU64(x float64) uint64 {
+	if x >= 1<<63 {
+		return uint64(x-(1<<63)) | 1<<63
+	}
+	return uint64(x)
+}
+
+// execute runs a compiled function with its arguments at stack[fp]
+func (in *Instance) execute(f *compiledFunc, fp int) {
+	stack := in.stack
+	base := fp + f.numLocals
+	if base+f.maxHeight > len(stack) {
+		trap("value stack exhausted")
+	}
+	for i := fp + f.numParams; i < base; i++ {
+		stack[i] = 0
+	}
+	code := f.code
+	sp := base
+	pc := 0
+	for {
+		ins := &code[pc]
+		pc++
+		switch ins.op {
+		case opUnreachable:
+			trap("unreachable")
+		case iJump:
+			pc = int(ins.a)
+		case iJumpIfZero:
+			sp--
+			if uint32(stack[sp]) == 0 {
+				pc = int(ins.a)
+			}
+		case iBr:
+			in.useFuel()
+			sp = branch(stack, sp, base+int(ins.c), int(ins.b))
+			pc = int(ins.a)
+		case iBrIf:
+			sp--
+			if uint32(stack[sp]) != 0 {
+				in.useFuel()
+				sp = branch(stack, sp, base+int(ins.c), int(ins.b))
+				pc = int(ins.a)
+			}
+		case iBrTable:
+			in.useFuel()
+			sp--
+			targets := f.brTables[ins.a]
+			i := uint32(stack[sp])
+			if int(i) >= len(targets)-1 {
+				i = uint32(len(targets) - 1)
+			}
+			t := &targets[i]
+			sp = branch(stack, sp, base+int(t.height), int(t.arity))
+			pc = int(t.pc)
+		case opReturn:
+			if f.numResults > 0 {
+				copy(stack[fp:fp+f.numResults], stack[sp-f.numResults:sp])
+			}
+			return
+		case opCall:
+			in.useFuel()
+			callee := &in.funcs[ins.a]
+			args := sp - len(callee.typ.Params)
+			in.invoke(ins.a, args)
+			sp = args + len(callee.typ.Results)
+		case opCallIndirect:
+			in.useFuel()
+			sp--
+			i := uint32(stack[sp])
+			table := in.tables[ins.b]
+			if int(i) >= len(table) {
+				trap("undefined element")
+			}
+			ref := table[i]
+			if ref == 0 {
+				trap("uninitialized element")
+			}
+			callee := &in.funcs[ref-1]
+			if callee.typeID != in.typeIDs[ins.a] {
+				trap("indirect call type mismatch")
+			}
+			want := &callee.typ
+			args := sp - len(want.Params)
+			in.invoke(uint32(ref-1), args)
+			sp = args + len(want.Results)
+		case opDrop:
+			sp--
+		case opSelect:
+			sp -= 2
+			if uint32(stack[sp+1]) == 0 {
+				stack[sp-1] = stack[sp]
+			}
+		case opLocalGet:
+			stack[sp] = stack[fp+int(ins.a)]
+			sp++
+		case opLocalSet:
+			sp--
+			stack[fp+int(ins.a)] = stack[sp]
+		case opLocalTee:
+			stack[fp+int(ins.a)] = stack[sp-1]
+		case opGlobalGet:
+			stack[sp] = in.globals[ins.a]
+			sp++
+		case opGlobalSet:
+			sp--
+			in.globals[ins.a] = stack[sp]
+		case opTableGet:
+			t := in.tables[ins.a]
+			i := uint32(stack[sp-1])
+			if int(i) >= len(t) {
+				trap("out of bounds table access")
+			}
+			stack[sp-1] = t[i]
+		case opTableSet:
+			sp -= 2
+			t := in.tables[ins.a]
+			i := uint32(stack[sp])
+			if int(i) >= len(t) {
+				trap("out of bounds table access")
+			}
+			t[i] = stack[sp+1]
+
+		// Loads and stores
+		case 0x28, 0x2a:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 4, len(in.memory), "memory")
+			stack[sp-1] = uint64(binary.LittleEndian.Uint32(in.memory[ea:]))
+		case 0x29, 0x2b:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 8, len(in.memory), "memory")
+			stack[sp-1] = binary.LittleEndian.Uint64(in.memory[ea:])
+		case 0x2c:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 1, len(in.memory), "memory")
+			stack[sp-1] = uint64(uint32(int32(int8(in.memory[ea]))))
+		case 0x2d, 0x31:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 1, len(in.memory), "memory")
+			stack[sp-1] = uint64(in.memory[ea])
+		case 0x2e:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 2, len(in.memory), "memory")
+			stack[sp-1] = uint64(uint32(int32(int16(binary.LittleEndian.Uint16(in.memory[ea:])))))
+		case 0x2f, 0x33:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 2, len(in.memory), "memory")
+			stack[sp-1] = uint64(binary.LittleEndian.Uint16(in.memory[ea:]))
+		case 0x30:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 1, len(in.memory), "memory")
+			stack[sp-1] = uint64(int64(int8(in.memory[ea])))
+		case 0x32:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 2, len(in.memory), "memory")
+			stack[sp-1] = uint64(int64(int16(binary.LittleEndian.Uint16(in.memory[ea:]))))
+		case 0x34:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 4, len(in.memory), "memory")
+			stack[sp-1] = uint64(int64(int32(binary.LittleEndian.Uint32(in.memory[ea:]))))
+		case 0x35:
+			ea := uint64(uint32(stack[sp-1])) + uint64(ins.a)
+			checkRange(ea, 4, len(in.memory), "memory")
+			stack[sp-1] = uint64(binary.LittleEndian.Uint32(in.memory[ea:]))
+		case 0x36, 0x38, 0x3e:
+			sp -= 2
+			ea := uint64(uint32(stack[sp])) + uint64(ins.a)
+			checkRange(ea, 4, len(in.memory), "memory")
+			binary.LittleEndian.PutUint32(in.memory[ea:], uint32(stack[sp+1]))
+		case 0x37, 0x39:
+			sp -= 2
+			ea := uint64(uint32(stack[sp])) + uint64(ins.a)
+			checkRange(ea, 8, len(in.memory), "memory")
+			binary.LittleEndian.PutUint64(in.memory[ea:], stack[sp+1])
+		case 0x3a, 0x3c:
+			sp -= 2
+			ea := uint64(uint32(stack[sp])) + uint64(ins.a)
+			checkRange(ea, 1, len(in.memory), "memory")
+			in.memory[ea] = byte(stack[sp+1])
+		case 0x3b, 0x3d:
+			sp -= 2
+			ea := uint64(uint32(stack[sp])) + uint64(ins.a)
+			checkRange(ea, 2, len(in.memory), "memory")
+			binary.LittleEndian.PutUint16(in.memory[ea:], uint16(stack[sp+1]))
+		case opMemorySize:
+			stack[sp] = uint64(len(in.memory) / pageSize)
+			sp++
+		case opMemoryGrow:
+			stack[sp-1] = uint64(in.growMemory(uint32(stack[sp-1])))
+
+		case iConst:
+			stack[sp] = ins.c
+			sp++
+		case opRefIsNull:
+			stack[sp-1] = b2u(stack[sp-1] == 0)
+
+		// i32 comparisons
+		case 0x45:
+			stack[sp-1] = b2u(uint32(stack[sp-1]) == 0)
+		case 0x46:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) == uint32(stack[sp]))
+		case 0x47:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) != uint32(stack[sp]))
+		case 0x48:
+			sp--
+			stack[sp-1] = b2u(int32(stack[sp-1]) < int32(stack[sp]))
+		case 0x49:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) < uint32(stack[sp]))
+		case 0x4a:
+			sp--
+			stack[sp-1] = b2u(int32(stack[sp-1]) > int32(stack[sp]))
+		case 0x4b:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) > uint32(stack[sp]))
+		case 0x4c:
+			sp--
+			stack[sp-1] = b2u(int32(stack[sp-1]) <= int32(stack[sp]))
+		case 0x4d:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) <= uint32(stack[sp]))
+		case 0x4e:
+			sp--
+			stack[sp-1] = b2u(int32(stack[sp-1]) >= int32(stack[sp]))
+		case 0x4f:
+			sp--
+			stack[sp-1] = b2u(uint32(stack[sp-1]) >= uint32(stack[sp]))
+
+		// i64 comparisons
+		case 0x50:
+			stack[sp-1] = b2u(stack[sp-1] == 0)
+		case 0x51:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] == stack[sp])
+		case 0x52:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] != stack[sp])
+		case 0x53:
+			sp--
+			stack[sp-1] = b2u(int64(stack[sp-1]) < int64(stack[sp]))
+		case 0x54:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] < stack[sp])
+		case 0x55:
+			sp--
+			stack[sp-1] = b2u(int64(stack[sp-1]) > int64(stack[sp]))
+		case 0x56:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] > stack[sp])
+		case 0x57:
+			sp--
+			stack[sp-1] = b2u(int64(stack[sp-1]) <= int64(stack[sp]))
+		case 0x58:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] <= stack[sp])
+		case 0x59:
+			sp--
+			stack[sp-1] = b2u(int64(stack[sp-1]) >= int64(stack[sp]))
+		case 0x5a:
+			sp--
+			stack[sp-1] = b2u(stack[sp-1] >= stack[sp])
+
+		// f32 comparisons
+		case 0x5b:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) == f32(stack[sp]))
+		case 0x5c:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) != f32(stack[sp]))
+		case 0x5d:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) < f32(stack[sp]))
+		case 0x5e:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) > f32(stack[sp]))
+		case 0x5f:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) <= f32(stack[sp]))
+		case 0x60:
+			sp--
+			stack[sp-1] = b2u(f32(stack[sp-1]) >= f32(stack[sp]))
+
+		// f64 comparisons
+		case 0x61:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) == f64(stack[sp]))
+		case 0x62:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) != f64(stack[sp]))
+		case 0x63:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) < f64(stack[sp]))
+		case 0x64:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) > f64(stack[sp]))
+		case 0x65:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) <= f64(stack[sp]))
+		case 0x66:
+			sp--
+			stack[sp-1] = b2u(f64(stack[sp-1]) >= f64(stack[sp]))
+
+		// i32 arithmetic
+		case 0x67:
+			stack[sp-1] = uint64(bits.LeadingZeros32(uint32(stack[sp-1])))
+		case 0x68:
+			stack[sp-1] = uint64(bits.TrailingZeros32(uint32(stack[sp-1])))
+		case 0x69:
+			stack[sp-1] = uint64(bits.OnesCount32(uint32(stack[sp-1])))
+		case 0x6a:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) + uint32(stack[sp]))
+		case 0x6b:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) - uint32(stack[sp]))
+		case 0x6c:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) * uint32(stack[sp]))
+		case 0x6d:
+			sp--
+			a, b := int32(stack[sp-1]), int32(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if a == math.MinInt32 && b == -1 {
+				trap("integer overflow")
+			}
+			stack[sp-1] = uint64(uint32(a / b))
+		case 0x6e:
+			sp--
+			a, b := uint32(stack[sp-1]), uint32(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			stack[sp-1] = uint64(a / b)
+		case 0x6f:
+			sp--
+			a, b := int32(stack[sp-1]), int32(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if b == -1 {
+				stack[sp-1] = 0
+			} else {
+				stack[sp-1] = uint64(uint32(a % b))
+			}
+		case 0x70:
+			sp--
+			a, b := uint32(stack[sp-1]), uint32(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			stack[sp-1] = uint64(a % b)
+		case 0x71:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) & uint32(stack[sp]))
+		case 0x72:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) | uint32(stack[sp]))
+		case 0x73:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) ^ uint32(stack[sp]))
+		case 0x74:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) << (stack[sp] & 31))
+		case 0x75:
+			sp--
+			stack[sp-1] = uint64(uint32(int32(stack[sp-1]) >> (stack[sp] & 31)))
+		case 0x76:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1]) >> (stack[sp] & 31))
+		case 0x77:
+			sp--
+			stack[sp-1] = uint64(bits.RotateLeft32(uint32(stack[sp-1]), int(stack[sp]&31)))
+		case 0x78:
+			sp--
+			stack[sp-1] = uint64(bits.RotateLeft32(uint32(stack[sp-1]), -int(stack[sp]&31)))
+
+		// i64 arithmetic
+		case 0x79:
+			stack[sp-1] = uint64(bits.LeadingZeros64(stack[sp-1]))
+		case 0x7a:
+			stack[sp-1] = uint64(bits.TrailingZeros64(stack[sp-1]))
+		case 0x7b:
+			stack[sp-1] = uint64(bits.OnesCount64(stack[sp-1]))
+		case 0x7c:
+			sp--
+			stack[sp-1] += stack[sp]
+		case 0x7d:
+			sp--
+			stack[sp-1] -= stack[sp]
+		case 0x7e:
+			sp--
+			stack[sp-1] *= stack[sp]
+		case 0x7f:
+			sp--
+			a, b := int64(stack[sp-1]), int64(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if a == math.MinInt64 && b == -1 {
+				trap("integer overflow")
+			}
+			stack[sp-1] = uint64(a / b)
+		case 0x80:
+			sp--
+			if stack[sp] == 0 {
+				trap("integer divide by zero")
+			}
+			stack[sp-1] /= stack[sp]
+		case 0x81:
+			sp--
+			a, b := int64(stack[sp-1]), int64(stack[sp])
+			if b == 0 {
+				trap("integer divide by zero")
+			}
+			if b == -1 {
+				stack[sp-1] = 0
+			} else {
+				stack[sp-1] = uint64(a % b)
+			}
+		case 0x82:
+			sp--
+			if stack[sp] == 0 {
+				trap("integer divide by zero")
+			}
+			stack[sp-1] %= stack[sp]
+		case 0x83:
+			sp--
+			stack[sp-1] &= stack[sp]
+		case 0x84:
+			sp--
+			stack[sp-1] |= stack[sp]
+		case 0x85:
+			sp--
+			stack[sp-1] ^= stack[sp]
+		case 0x86:
+			sp--
+			stack[sp-1] <<= stack[sp] & 63
+		case 0x87:
+			sp--
+			stack[sp-1] = uint64(int64(stack[sp-1]) >> (stack[sp] & 63))
+		case 0x88:
+			sp--
+			stack[sp-1] >>= stack[sp] & 63
+		case 0x89:
+			sp--
+			stack[sp-1] = bits.RotateLeft64(stack[sp-1], int(stack[sp]&63))
+		case 0x8a:
+			sp--
+			stack[sp-1] = bits.RotateLeft64(stack[sp-1], -int(stack[sp]&63))
+
+		// f32 arithmetic
+		case 0x8b:
+			stack[sp-1] &^= 1 << 31
+		case 0x8c:
+			stack[sp-1] = uint64(uint32(stack[sp-1]) ^ 1<<31)
+		case 0x8d:
+			stack[sp-1] = pf32(float32(math.Ceil(float64(f32(stack[sp-1])))))
+		case 0x8e:
+			stack[sp-1] = pf32(float32(math.Floor(float64(f32(stack[sp-1])))))
+		case 0x8f:
+			stack[sp-1] = pf32(float32(math.Trunc(float64(f32(stack[sp-1])))))
+		case 0x90:
+			stack[sp-1] = pf32(float32(math.RoundToEven(float64(f32(stack[sp-1])))))
+		case 0x91:
+			stack[sp-1] = pf32(float32(math.Sqrt(float64(f32(stack[sp-1])))))
+		case 0x92:
+			sp--
+			stack[sp-1] = pf32(f32(stack[sp-1]) + f32(stack[sp]))
+		case 0x93:
+			sp--
+			stack[sp-1] = pf32(f32(stack[sp-1]) - f32(stack[sp]))
+		case 0x94:
+			sp--
+			stack[sp-1] = pf32(f32(stack[sp-1]) * f32(stack[sp]))
+		case 0x95:
+			sp--
+			stack[sp-1] = pf32(f32(stack[sp-1]) / f32(stack[sp]))
+		case 0x96:
+			sp--
+			stack[sp-1] = pf32(float32(math.Min(float64(f32(stack[sp-1])), float64(f32(stack[sp])))))
+		case 0x97:
+			sp--
+			stack[sp-1] = pf32(float32(math.Max(float64(f32(stack[sp-1])), float64(f32(stack[sp])))))
+		case 0x98:
+			sp--
+			stack[sp-1] = uint64(uint32(stack[sp-1])&^(1<<31) | uint32(stack[sp])&(1<<31))
+
+		// f64 arithmetic
+		case 0x99:
+			stack[sp-1] &^= 1 << 63
+		case 0x9a:
+			stack[sp-1] ^= 1 << 63
+		case 0x9b:
+			stack[sp-1] = pf64(math.Ceil(f64(stack[sp-1])))
+		case 0x9c:
+			stack[sp-1] = pf64(math.Floor(f64(stack[sp-1])))
+		case 0x9d:
+			stack[sp-1] = pf64(math.Trunc(f64(stack[sp-1])))
+		case 0x9e:
+			stack[sp-1] = pf64(math.RoundToEven(f64(stack[sp-1])))
+		case 0x9f:
+			stack[sp-1] = pf64(math.Sqrt(f64(stack[sp-1])))
+		case 0xa0:
+			sp--
+			stack[sp-1] = pf64(f64(stack[sp-1]) + f64(stack[sp]))
+		case 0xa1:
+			sp--
+			stack[sp-1] = pf64(f64(stack[sp-1]) - f64(stack[sp]))
+		case 0xa2:
+			sp--
+			stack[sp-1] = pf64(f64(stack[sp-1]) * f64(stack[sp]))
+		case 0xa3:
+			sp--
+			stack[sp-1] = pf64(f64(stack[sp-1]) / f64(stack[sp]))
+		case 0xa4:
+			sp--
+			stack[sp-1] = pf64(math.Min(f64(stack[sp-1]), f64(stack[sp])))
+		case 0xa5:
+			sp--
+			stack[sp-1] = pf64(math.Max(f64(stack[sp-1]), f64(stack[sp])))
+		case 0xa6:
+			sp--
+			stack[sp-1] = stack[sp-1]&^(1<<63) | stack[sp]&(1<<63)
+
+		// Conversions
+		case 0xa7:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xa8:
+			stack[sp-1] = uint64(uint32(int32(truncRange(float64(f32(stack[sp-1])), math.MinInt32, 1<<31))))
+		case 0xa9:
+			stack[sp-1] = uint64(uint32(truncRange(float64(f32(stack[sp-1])), 0, 1<<32)))
+		case 0xaa:
+			stack[sp-1] = uint64(uint32(int32(truncRange(f64(stack[sp-1]), math.MinInt32, 1<<31))))
+		case 0xab:
+			stack[sp-1] = uint64(uint32(truncRange(f64(stack[sp-1]), 0, 1<<32)))
+		case 0xac:
+			stack[sp-1] = uint64(int64(int32(stack[sp-1])))
+		case 0xad:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xae:
+			stack[sp-1] = uint64(int64(truncRange(float64(f32(stack[sp-1])), math.MinInt64, 1<<63)))
+		case 0xaf:
+			stack[sp-1] = f64ToU64(truncRange(float64(f32(stack[sp-1])), 0, 1<<64))
+		case 0xb0:
+			stack[sp-1] = uint64(int64(truncRange(f64(stack[sp-1]), math.MinInt64, 1<<63)))
+		case 0xb1:
+			stack[sp-1] = f64ToU64(truncRange(f64(stack[sp-1]), 0, 1<<64))
+		case 0xb2:
+			stack[sp-1] = pf32(float32(int32(stack[sp-1])))
+		case 0xb3:
+			stack[sp-1] = pf32(float32(uint32(stack[sp-1])))
+		case 0xb4:
+			stack[sp-1] = pf32(float32(int64(stack[sp-1])))
+		case 0xb5:
+			stack[sp-1] = pf32(float32(stack[sp-1]))
+		case 0xb6:
+			stack[sp-1] = pf32(float32(f64(stack[sp-1])))
+		case 0xb7:
+			stack[sp-1] = pf64(float64(int32(stack[sp-1])))
+		case 0xb8:
+			stack[sp-1] = pf64(float64(uint32(stack[sp-1])))
+		case 0xb9:
+			stack[sp-1] = pf64(float64(int64(stack[sp-1])))
+		case 0xba:
+			stack[sp-1] = pf64(float64(stack[sp-1]))
+		case 0xbb:
+			stack[sp-1] = pf64(float64(f32(stack[sp-1])))
+		case 0xbc, 0xbe:
+			stack[sp-1] = uint64(uint32(stack[sp-1]))
+		case 0xbd, 0xbf:
+			// reinterpretations keep the bits
+		case 0xc0:
+			stack[sp-1] = uint64(uint32(int32(int8(stack[sp-1]))))
+		case 0xc1:
+			stack[sp-1] = uint64(uint32(int32(int16(stack[sp-1]))))
+		case 0xc2:
+			stack[sp-1] = uint64(int64(int8(stack[sp-1])))
+		case 0xc3:
+			stack[sp-1] = uint64(int64(int16(stack[sp-1])))
+		case 0xc4:
+			stack[sp-1] = uint64(int64(int32(stack[sp-1])))
+
+		// Saturating truncation
+		case fcBase + 0:
+			stack[sp-1] = satI32(float64(f32(stack[sp-1])))
+		case fcBase + 1:
+			stack[sp-1] = satU32(float64(f32(stack[sp-1])))
+		case fcBase + 2:
+			stack[sp-1] = satI32(f64(stack[sp-1]))
+		case fcBase + 3:
+			stack[sp-1] = satU32(f64(stack[sp-1]))
+		case fcBase + 4:
+			stack[sp-1] = satI64(float64(f32(stack[sp-1])))
+		case fcBase + 5:
+			stack[sp-1] = satU64(float64(f32(stack[sp-1])))
+		case fcBase + 6:
+			stack[sp-1] = satI64(f64(stack[sp-1]))
+		case fcBase + 7:
+			stack[sp-1] = satU64(f64(stack[sp-1]))
+
+		// Bulk memory and tables
+		case fcBase + fcMemoryInit:
+			sp -= 3
+			in.memoryInit(ins.a, uint32(stack[sp]), uint32(stack[sp+1]), uint32(stack[sp+2]))
+		case fcBase + fcDataDrop:
+			in.dataDropped[ins.a] = true
+		case fcBase + fcMemoryCopy:
+			sp -= 3
+			dst, src, n := uint64(uint32(stack[sp])), uint64(uint32(stack[sp+1])), uint64(uint32(stack[sp+2]))
+			checkRange(src, n, len(in.memory), "memory")
+			checkRange(dst, n, len(in.memory), "memory")
+			copy(in.memory[dst:dst+n], in.memory[src:src+n])
+		case fcBase + fcMemoryFill:
+			sp -= 3
+			dst, v, n := uint64(uint32(stack[sp])), byte(stack[sp+1]), uint64(uint32(stack[sp+2]))
+			checkRange(dst, n, len(in.memory), "memory")
+			fill := in.memory[dst : dst+n]
+			for i := range fill {
+				fill[i] = v
+			}
+		case fcBase + fcTableInit:
+			sp -= 3
+			in.tableInit(ins.b, ins.a, uint32(stack[sp]), uint32(stack[sp+1]), uint32(stack[sp+2]))
+		case fcBase + fcElemDrop:
+			in.elemDropped[ins.a] = true
+		case fcBase + fcTableCopy:
+			sp -= 3
+			dst, src := in.tables[ins.a], in.tables[ins.b]
+			d, s, n := uint64(uint32(stack[sp])), uint64(uint32(stack[sp+1])), uint64(uint32(stack[sp+2]))
+			checkRange(s, n, len(src), "table")
+			checkRange(d, n, len(dst), "table")
+			copy(dst[d:d+n], src[s:s+n])
+		case fcBase + fcTableGrow:
+			sp--
+			t := in.tables[ins.a]
+			n := uint32(stack[sp])
+			limit := in.module.tables[ins.a]
+			old := uint32(len(t))
+			if uint64(old)+uint64(n) > maxTableSize || limit.hasMax && uint64(old)+uint64(n) > uint64(limit.max) {
+				stack[sp-1] = math.MaxUint32
+				break
+			}
+			init := stack[sp-1]
+			for i := uint32(0); i < n; i++ {
+				t = append(t, init)
+			}
+			in.tables[ins.a] = t
+			stack[sp-1] = uint64(old)
+		case fcBase + fcTableSize:
+			stack[sp] = uint64(len(in.tables[ins.a]))
+			sp++
+		case fcBase + fcTableFill:
+			sp -= 3
+			t := in.tables[ins.a]
+			d, v, n := uint64(uint32(stack[sp])), stack[sp+1], uint64(uint32(stack[sp+2]))
+			checkRange(d, n, len(t), "table")
+			for i := d; i < d+n; i++ {
+				t[i] = v
+			}
+		default:
+			trap(fmt.Sprintf("invalid instruction 0x%x", ins.op))
+		}
+	}
+}
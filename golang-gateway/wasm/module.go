@@ -0,0 +1,607 @@
+// Package wasm is a small, sandboxed WebAssembly interpreter for gateway
+// plugins. It runs WebAssembly 2.0 modules without SIMD or threads: function
+// bodies are compiled once into an internal instruction stream with
+// resolved branch targets and interpreted on a fixed-size value stack.
+// Modules only reach the host through the imports the embedder resolves, and
+// every call runs with a fuel budget so a runaway plugin is aborted instead
+// of stalling its caller.
+package wasm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"unicode/utf8"
+)
+
+// ValueType is a WebAssembly value type
+type ValueType byte
+
+// Value types
+const (
+	I32       ValueType = 0x7f
+	I64       ValueType = 0x7e
+	F32       ValueType = 0x7d
+	F64       ValueType = 0x7c
+	V128      ValueType = 0x7b
+	FuncRef   ValueType = 0x70
+	ExternRef ValueType = 0x6f
+)
+
+// FuncType is the signature of a function
+type FuncType struct {
+	Params  []ValueType
+	Results []ValueType
+}
+
+func (t FuncType) String() string {
+	return fmt.Sprintf("%v -> %v", t.Params, t.Results)
+}
+
+func (t FuncType) equal(o FuncType) bool {
+	if len(t.Params) != len(o.Params) || len(t.Results) != len(o.Results) {
+		return false
+	}
+	for i := range t.Params {
+		if t.Params[i] != o.Params[i] {
+			return false
+		}
+	}
+	for i := range t.Results {
+		if t.Results[i] != o.Results[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Import kinds
+const (
+	kindFunc   = 0x00
+	kindTable  = 0x01
+	kindMemory = 0x02
+	kindGlobal = 0x03
+)
+
+// Import is a function the module expects from its host
+type Import struct {
+	Module string
+	Name   string
+	Type   FuncType
+}
+
+type limits struct {
+	min    uint32
+	max    uint32
+	hasMax bool
+}
+
+type global struct {
+	typ     ValueType
+	mutable bool
+	init    constExpr
+}
+
+// constExpr is an initializer expression: a constant, global.get, ref.null
+// or ref.func
+type constExpr struct {
+	op    byte
+	value uint64
+}
+
+type export struct {
+	kind  byte
+	index uint32
+}
+
+type elemSegment struct {
+	mode   byte // segActive, segPassive or segDeclarative
+	table  uint32
+	offset constExpr
+	init   []constExpr
+}
+
+type dataSegment struct {
+	mode   byte
+	offset constExpr
+	init   []byte
+}
+
+// Segment modes
+const (
+	segActive = iota
+	segPassive
+	segDeclarative
+)
+
+// Module is a decoded and compiled module, ready to be instantiated any
+// number of times
+type Module struct {
+	types    []FuncType
+	imports  []Import
+	funcs    []uint32 // type index of each function defined by the module
+	tables   []limits
+	memory   *limits
+	globals  []global
+	exports  map[string]export
+	start    *uint32
+	elems    []elemSegment
+	datas    []dataSegment
+	bodies   []funcBody
+	compiled []*compiledFunc
+}
+
+type funcBody struct {
+	locals []ValueType
+	code   []byte
+}
+
+// Imports returns the functions the module imports
+func (m *Module) Imports() []Import {
+	return m.imports
+}
+
+// ExportedFunction returns the signature of an exported function
+func (m *Module) ExportedFunction(name string) (FuncType, bool) {
+	e, ok := m.exports[name]
+	if !ok || e.kind != kindFunc {
+		return FuncType{}, false
+	}
+	return m.funcType(e.index), true
+}
+
+// funcType returns the type of a function in the index space (imports
+// first, then the module's own functions)
+func (m *Module) funcType(index uint32) FuncType {
+	if int(index) < len(m.imports) {
+		return m.imports[index].Type
+	}
+	return m.types[m.funcs[int(index)-len(m.imports)]]
+}
+
+func (m *Module) numFuncs() int {
+	return len(m.imports) + len(m.funcs)
+}
+
+// decodeError aborts decoding; Compile recovers it into an error
+type decodeError struct{ err error }
+
+func fail(format string, args ...interface{}) {
+	panic(decodeError{fmt.Errorf(format, args...)})
+}
+
+// decodeFailure turns a panic raised while decoding or compiling into an
+// error, so malformed input (e.g. a plugin file caught mid-copy) never
+// takes the process down
+func decodeFailure(r interface{}) error {
+	if de, ok := r.(decodeError); ok {
+		return de.err
+	}
+	return fmt.Errorf("malformed module: %v", r)
+}
+
+// Compile decodes and compiles a module from its binary encoding
+func Compile(binary []byte) (m *Module, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, decodeFailure(r)
+		}
+	}()
+
+	r := &reader{b: binary}
+	if len(binary) < 8 || string(binary[:4]) != "\x00asm" {
+		return nil, errors.New("not a WebAssembly module")
+	}
+	if v := binary[4:8]; v[0] != 1 || v[1] != 0 || v[2] != 0 || v[3] != 0 {
+		return nil, fmt.Errorf("unsupported WebAssembly version %x", v)
+	}
+	r.pos = 8
+
+	m = &Module{exports: make(map[string]export)}
+	var funcCount uint32
+	var haveFuncs bool
+	for r.pos < len(r.b) {
+		id := r.byte()
+		size := r.u32()
+		end := r.pos + int(size)
+		if end > len(r.b) {
+			fail("section %d exceeds module size", id)
+		}
+		sr := &reader{b: r.b[:end], pos: r.pos}
+		switch id {
+		case 0:
+			// custom section (names, producers): ignored
+		case 1:
+			m.decodeTypes(sr)
+		case 2:
+			m.decodeImports(sr)
+		case 3:
+			m.funcs = sr.indices()
+			funcCount, haveFuncs = uint32(len(m.funcs)), true
+		case 4:
+			for n := sr.count(); n > 0; n-- {
+				sr.refType()
+				l := sr.limits()
+				if l.min > maxTableSize {
+					fail("table of %d elements exceeds the limit of %d", l.min, maxTableSize)
+				}
+				m.tables = append(m.tables, l)
+			}
+		case 5:
+			n := sr.u32()
+			if n > 1 {
+				fail("multiple memories are not supported")
+			}
+			if n == 1 {
+				l := sr.limits()
+				m.memory = &l
+			}
+		case 6:
+			for n := sr.count(); n > 0; n-- {
+				g := global{typ: sr.valueType()}
+				g.mutable = sr.byte() == 1
+				g.init = sr.constExpr()
+				m.globals = append(m.globals, g)
+			}
+		case 7:
+			for n := sr.count(); n > 0; n-- {
+				name := sr.name()
+				m.exports[name] = export{kind: sr.byte(), index: sr.u32()}
+			}
+		case 8:
+			start := sr.u32()
+			m.start = &start
+		case 9:
+			m.decodeElems(sr)
+		case 10:
+			n := sr.count()
+			if !haveFuncs && n > 0 || n != funcCount {
+				fail("function and code section counts differ")
+			}
+			m.bodies = make([]funcBody, n)
+			for i := range m.bodies {
+				m.bodies[i] = sr.funcBody()
+			}
+		case 11:
+			m.decodeDatas(sr)
+		case 12:
+			sr.u32() // data count, only needed by single-pass validators
+		default:
+			fail("unknown section %d", id)
+		}
+		if id != 0 && sr.pos != end {
+			fail("section %d has trailing bytes", id)
+		}
+		r.pos = end
+	}
+	if len(m.bodies) != len(m.funcs) {
+		fail("function and code section counts differ")
+	}
+	for i := range m.funcs {
+		if int(m.funcs[i]) >= len(m.types) {
+			fail("function %d has invalid type %d", i, m.funcs[i])
+		}
+	}
+	m.checkExports()
+	if m.start != nil && int(*m.start) >= m.numFuncs() {
+		fail("start function %d does not exist", *m.start)
+	}
+
+	m.compiled = make([]*compiledFunc, len(m.bodies))
+	for i := range m.bodies {
+		index := uint32(len(m.imports) + i)
+		cf, err := compileFunc(m, m.funcType(index), m.bodies[i])
+		if err != nil {
+			return nil, fmt.Errorf("function %d: %w", index, err)
+		}
+		m.compiled[i] = cf
+	}
+	m.bodies = nil
+	return m, nil
+}
+
+// checkExports rejects exports of functions, tables, memories or globals the
+// module does not have; the embedder looks exports up by index
+func (m *Module) checkExports() {
+	names := make([]string, 0, len(m.exports))
+	for name := range m.exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e := m.exports[name]
+		var n int
+		switch e.kind {
+		case kindFunc:
+			n = m.numFuncs()
+		case kindTable:
+			n = len(m.tables)
+		case kindMemory:
+			if m.memory != nil {
+				n = 1
+			}
+		case kindGlobal:
+			n = len(m.globals)
+		default:
+			fail("export %q has unknown kind %d", name, e.kind)
+		}
+		if int(e.index) >= n {
+			fail("export %q refers to missing index %d", name, e.index)
+		}
+	}
+}
+
+func (m *Module) decodeTypes(r *reader) {
+	for n := r.count(); n > 0; n-- {
+		if r.byte() != 0x60 {
+			fail("malformed function type")
+		}
+		var t FuncType
+		for p := r.count(); p > 0; p-- {
+			t.Params = append(t.Params, r.valueType())
+		}
+		for p := r.count(); p > 0; p-- {
+			t.Results = append(t.Results, r.valueType())
+		}
+		m.types = append(m.types, t)
+	}
+}
+
+func (m *Module) decodeImports(r *reader) {
+	for n := r.count(); n > 0; n-- {
+		module, name := r.name(), r.name()
+		kind := r.byte()
+		if kind != kindFunc {
+			fail("import %s.%s: only function imports are supported", module, name)
+		}
+		t := r.u32()
+		if int(t) >= len(m.types) {
+			fail("import %s.%s has invalid type %d", module, name, t)
+		}
+		m.imports = append(m.imports, Import{Module: module, Name: name, Type: m.types[t]})
+	}
+}
+
+func (m *Module) decodeElems(r *reader) {
+	for n := r.count(); n > 0; n-- {
+		flags := r.u32()
+		var seg elemSegment
+		switch {
+		case flags&1 == 0:
+			seg.mode = segActive
+			if flags&2 != 0 {
+				seg.table = r.u32()
+			}
+			seg.offset = r.constExpr()
+		case flags&2 == 0:
+			seg.mode = segPassive
+		default:
+			seg.mode = segDeclarative
+		}
+		exprs := flags&4 != 0
+		if flags&3 != 0 {
+			// element kind (0x00 funcref) or reference type
+			r.byte()
+		}
+		for c := r.count(); c > 0; c-- {
+			if exprs {
+				seg.init = append(seg.init, r.constExpr())
+			} else {
+				seg.init = append(seg.init, constExpr{op: opRefFunc, value: uint64(r.u32())})
+			}
+		}
+		if flags > 7 {
+			fail("malformed element segment")
+		}
+		m.elems = append(m.elems, seg)
+	}
+}
+
+func (m *Module) decodeDatas(r *reader) {
+	for n := r.count(); n > 0; n-- {
+		var seg dataSegment
+		switch r.u32() {
+		case 0:
+			seg.offset = r.constExpr()
+		case 1:
+			seg.mode = segPassive
+		case 2:
+			if r.u32() != 0 {
+				fail("multiple memories are not supported")
+			}
+			seg.offset = r.constExpr()
+		default:
+			fail("malformed data segment")
+		}
+		seg.init = r.bytes(int(r.u32()))
+		m.datas = append(m.datas, seg)
+	}
+}
+
+// reader decodes the binary format, failing with a decodeError on
+// malformed input
+type reader struct {
+	b   []byte
+	pos int
+}
+
+func (r *reader) byte() byte {
+	if r.pos >= len(r.b) {
+		fail("unexpected end of module")
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *reader) bytes(n int) []byte {
+	if n < 0 || r.pos+n > len(r.b) {
+		fail("unexpected end of module")
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *reader) u32() uint32 {
+	var result uint32
+	for shift := 0; ; shift += 7 {
+		c := r.byte()
+		if shift == 28 && c > 0x0f {
+			fail("integer too large")
+		}
+		result |= uint32(c&0x7f) << shift
+		if c < 0x80 {
+			return result
+		}
+	}
+}
+
+// signed decodes a signed LEB128 integer of up to bits bits
+func (r *reader) signed(bits uint) int64 {
+	var result int64
+	var shift uint
+	for {
+		c := r.byte()
+		result |= int64(c&0x7f) << shift
+		shift += 7
+		if c < 0x80 {
+			if shift < 64 && c&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result
+		}
+		if shift >= bits {
+			fail("integer too large")
+		}
+	}
+}
+
+func (r *reader) s32() int32 { return int32(r.signed(32)) }
+func (r *reader) s64() int64 { return r.signed(64) }
+
+func (r *reader) name() string {
+	b := r.bytes(int(r.u32()))
+	if !utf8.Valid(b) {
+		fail("malformed UTF-8 name")
+	}
+	return string(b)
+}
+
+// count reads the number of entries of a vector, each of which takes at
+// least one byte, so a count beyond the remaining input is malformed and
+// never reaches make
+func (r *reader) count() uint32 {
+	n := r.u32()
+	if int64(n) > int64(len(r.b)-r.pos) {
+		fail("count %d exceeds the remaining %d bytes", n, len(r.b)-r.pos)
+	}
+	return n
+}
+
+func (r *reader) indices() []uint32 {
+	n := r.count()
+	out := make([]uint32, n)
+	for i := range out {
+		out[i] = r.u32()
+	}
+	return out
+}
+
+func (r *reader) valueType() ValueType {
+	t := ValueType(r.byte())
+	switch t {
+	case I32, I64, F32, F64, FuncRef, ExternRef:
+		return t
+	case V128:
+		fail("SIMD is not supported")
+	}
+	fail("unknown value type 0x%x", byte(t))
+	return 0
+}
+
+func (r *reader) refType() ValueType {
+	t := r.valueType()
+	if t != FuncRef && t != ExternRef {
+		fail("expected reference type")
+	}
+	return t
+}
+
+func (r *reader) limits() limits {
+	flags := r.byte()
+	if flags > 3 {
+		fail("unsupported limits flags 0x%x", flags)
+	}
+	l := limits{min: r.u32()}
+	if flags&1 != 0 {
+		l.max, l.hasMax = r.u32(), true
+	}
+	return l
+}
+
+func (r *reader) constExpr() constExpr {
+	var e constExpr
+	e.op = r.byte()
+	switch e.op {
+	case opI32Const:
+		e.value = uint64(uint32(r.s32()))
+	case opI64Const:
+		e.value = uint64(r.s64())
+	case opF32Const:
+		e.value = uint64(binary.LittleEndian.Uint32(r.bytes(4)))
+	case opF64Const:
+		e.value = binary.LittleEndian.Uint64(r.bytes(8))
+	case opGlobalGet:
+		e.value = uint64(r.u32())
+	case opRefNull:
+		r.refType()
+	case opRefFunc:
+		e.value = uint64(r.u32())
+	default:
+		fail("unsupported constant expression opcode 0x%x", e.op)
+	}
+	if r.byte() != opEnd {
+		fail("constant expression must be a single instruction")
+	}
+	return e
+}
+
+func (r *reader) funcBody() funcBody {
+	size := r.u32()
+	end := r.pos + int(size)
+	if end > len(r.b) {
+		fail("function body exceeds section")
+	}
+	br := &reader{b: r.b[:end], pos: r.pos}
+	var body funcBody
+	var total uint64
+	for n := br.count(); n > 0; n-- {
+		count := br.u32()
+		t := br.valueType()
+		total += uint64(count)
+		if total > 50000 {
+			fail("too many locals")
+		}
+		for i := uint32(0); i < count; i++ {
+			body.locals = append(body.locals, t)
+		}
+	}
+	body.code = br.b[br.pos:end]
+	r.pos = end
+	return body
+}
+
+// f32 and f64 convert between stack slots and floats
+func f32(v uint64) float32  { return math.Float32frombits(uint32(v)) }
+func f64(v uint64) float64  { return math.Float64frombits(v) }
+func pf32(f float32) uint64 { return uint64(math.Float32bits(f)) }
+func pf64(f float64) uint64 { return math.Float64bits(f) }
+func b2u(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
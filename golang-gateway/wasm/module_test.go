@@ -0,0 +1,144 @@
+package wasm
+
+import (
+	"strings"
+	"testing"
+)
+
+// addModule exports add(i32, i32) -> i32
+const addModule = "\x00asm\x01\x00\x00\x00" +
+	"\x01\x07\x01\x60\x02\x7f\x7f\x01\x7f" + // type 0: (i32, i32) -> i32
+	"\x03\x02\x01\x00" + // func 0: type 0
+	"\x07\x07\x01\x03add\x00\x00" + // export "add" = func 0
+	"\x0a\x09\x01\x07\x00\x20\x00\x20\x01\x6a\x0b" // local.get 0, local.get 1, i32.add
+
+// constModule has one function () -> i32 returning 48 and a section list
+// for the exports to be appended to
+const constModule = "\x00asm\x01\x00\x00\x00" +
+	"\x01\x05\x01\x60\x00\x01\x7f" +
+	"\x03\x02\x01\x00"
+
+const constCode = "\x0a\x06\x01\x04\x00\x41\x30\x0b"
+
+func TestCompileAndCall(t *testing.T) {
+	m, err := Compile([]byte(addModule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	typ, ok := m.ExportedFunction("add")
+	if !ok || len(typ.Params) != 2 || len(typ.Results) != 1 {
+		t.Fatalf("ExportedFunction(add) = %v, %v", typ, ok)
+	}
+	in, err := Instantiate(m, nil, Config{Fuel: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := in.Call("add", 40, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != 42 {
+		t.Errorf("add(40, 2) = %v", results)
+	}
+	if _, err := in.Call("add", 1); err == nil {
+		t.Error("call with missing argument succeeded")
+	}
+	if _, err := in.Call("missing"); err == nil {
+		t.Error("call of a missing export succeeded")
+	}
+}
+
+func TestCompileRejectsInvalidIndices(t *testing.T) {
+	tests := []struct {
+		name   string
+		module string
+		err    string
+	}{
+		{"function export", constModule + "\x07\x05\x01\x010\x00\x30" + constCode, "missing index 48"},
+		{"function export past defined", constModule + "\x07\x05\x01\x01f\x00\x01" + constCode, "missing index 1"},
+		{"memory export", constModule + "\x07\x05\x01\x01m\x02\x00" + constCode, "missing index 0"},
+		{"table export", constModule + "\x07\x05\x01\x01t\x01\x00" + constCode, "missing index 0"},
+		{"global export", constModule + "\x07\x05\x01\x01g\x03\x00" + constCode, "missing index 0"},
+		{"export kind", constModule + "\x07\x05\x01\x01x\x04\x00" + constCode, "unknown kind"},
+		{"start function", constModule + "\x08\x01\x05" + constCode, "start function 5"},
+		{"function type", "\x00asm\x01\x00\x00\x00\x03\x02\x01\x00\x0a\x04\x01\x02\x00\x0b", "invalid type"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Compile([]byte(tt.module))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Compile() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCompileMalformed(t *testing.T) {
+	for _, module := range []string{
+		"",
+		"\x00asm",
+		"\x00asm\x02\x00\x00\x00",
+		"\x00asm\x01\x00\x00\x00\x01\xff\xff\xff\xff\x0f",         // section past the end
+		"\x00asm\x01\x00\x00\x00\x01\x05\xff\xff\xff\xff\x0f",     // count past the end
+		"\x00asm\x01\x00\x00\x00\x0d\x00",                         // unknown section
+		addModule[:len(addModule)-1],                              // truncated body
+		"\x00asm\x01\x00\x00\x00\x03\x02\x01\x00",                 // function without code
+		"\x00asm\x01\x00\x00\x00\x04\x05\x01\x70\x00\xff\xff\x7f", // oversized table
+	} {
+		if _, err := Compile([]byte(module)); err == nil {
+			t.Errorf("Compile(%q) succeeded", module)
+		}
+	}
+}
+
+func TestCallTraps(t *testing.T) {
+	// loop: br 0 forever
+	module := "\x00asm\x01\x00\x00\x00" +
+		"\x01\x04\x01\x60\x00\x00" +
+		"\x03\x02\x01\x00" +
+		"\x07\x08\x01\x04spin\x00\x00" +
+		"\x0a\x09\x01\x07\x00\x03\x40\x0c\x00\x0b\x0b"
+	m, err := Compile([]byte(module))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := Instantiate(m, nil, Config{Fuel: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := in.Call("spin"); err != ErrFuelExhausted {
+		t.Errorf("Call(spin) error = %v, want %v", err, ErrFuelExhausted)
+	}
+}
+
+// FuzzCompile checks that no input makes the decoder, compiler or
+// interpreter panic
+func FuzzCompile(f *testing.F) {
+	f.Add([]byte(addModule))
+	f.Add([]byte(constModule + "\x07\x05\x01\x010\x00\x30" + constCode))
+	f.Add([]byte(constModule + "\x07\x05\x01\x010\x00\x00" + constCode))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Compile(data)
+		if err != nil {
+			return
+		}
+		for _, imp := range m.Imports() {
+			_ = imp.Type.String()
+		}
+		stub := func(imp Import) (HostFunc, error) {
+			n := len(imp.Type.Results)
+			return func(in *Instance, args []uint64) []uint64 { return make([]uint64, n) }, nil
+		}
+		in, err := Instantiate(m, stub, Config{Fuel: 10000, MaxMemoryPages: 16, StackSize: 1024, MaxCallDepth: 64})
+		if err != nil {
+			return
+		}
+		for name := range m.exports {
+			typ, ok := m.ExportedFunction(name)
+			if !ok {
+				continue
+			}
+			in.Call(name, make([]uint64, len(typ.Params))...)
+		}
+	})
+}
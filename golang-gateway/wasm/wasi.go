@@ -0,0 +1,217 @@
+package wasm
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// WASI preview 1 errno values
+const (
+	errnoSuccess = 0
+	errnoBadf    = 8
+	errnoFault   = 21
+	errnoInval   = 28
+	errnoNosys   = 52
+)
+
+// WASIModule is the import module name of WASI preview 1
+const WASIModule = "wasi_snapshot_preview1"
+
+// WASI resolves the WASI preview 1 imports of plugins built for wasip1
+// (Go, TinyGo, Rust) with a sandbox: no arguments, environment, files or
+// sockets. Writes to stdout and stderr are passed to output, clocks and
+// random numbers are real, and poll_oneoff returns at once instead of
+// sleeping. Every other WASI function fails with ENOSYS.
+func WASI(output func(fd uint32, p []byte)) ImportResolver {
+	return func(imp Import) (HostFunc, error) {
+		if imp.Module != WASIModule {
+			return nil, fmt.Errorf("unknown import module %q", imp.Module)
+		}
+		want := func(params, results int) error {
+			if len(imp.Type.Params) != params || len(imp.Type.Results) != results {
+				return fmt.Errorf("unexpected signature %s", imp.Type)
+			}
+			return nil
+		}
+		switch imp.Name {
+		case "args_sizes_get", "environ_sizes_get":
+			if err := want(2, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				if !putU32(in, args[0], 0) || !putU32(in, args[1], 0) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "args_get", "environ_get", "sched_yield":
+			return func(in *Instance, args []uint64) []uint64 {
+				return errno(errnoSuccess)
+			}, nil
+		case "proc_exit":
+			return func(in *Instance, args []uint64) []uint64 {
+				in.Exit(uint32(args[0]))
+				return nil
+			}, nil
+		case "clock_time_get":
+			if err := want(3, 1); err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			return func(in *Instance, args []uint64) []uint64 {
+				var now uint64
+				switch uint32(args[0]) {
+				case 0: // realtime
+					now = uint64(time.Now().UnixNano())
+				case 1: // monotonic
+					now = uint64(time.Since(start).Nanoseconds())
+				default:
+					return errno(errnoInval)
+				}
+				if !putU64(in, args[2], now) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "clock_res_get":
+			if err := want(2, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				if !putU64(in, args[1], 1000) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "random_get":
+			if err := want(2, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				ptr, n := uint32(args[0]), uint32(args[1])
+				if uint64(ptr)+uint64(n) > uint64(len(in.memory)) {
+					return errno(errnoFault)
+				}
+				rand.Read(in.memory[ptr : ptr+n])
+				return errno(errnoSuccess)
+			}, nil
+		case "fd_write":
+			if err := want(4, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				fd := uint32(args[0])
+				if fd != 1 && fd != 2 {
+					return errno(errnoBadf)
+				}
+				var written uint32
+				for i := uint32(0); i < uint32(args[2]); i++ {
+					iov, ok := in.Read(uint32(args[1])+8*i, 8)
+					if !ok {
+						return errno(errnoFault)
+					}
+					p, ok := in.Read(binary.LittleEndian.Uint32(iov), binary.LittleEndian.Uint32(iov[4:]))
+					if !ok {
+						return errno(errnoFault)
+					}
+					if output != nil {
+						output(fd, p)
+					}
+					written += uint32(len(p))
+				}
+				if !putU32(in, args[3], written) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "fd_read":
+			if err := want(4, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				if uint32(args[0]) != 0 {
+					return errno(errnoBadf)
+				}
+				// stdin is always at end of file
+				if !putU32(in, args[3], 0) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "fd_fdstat_get":
+			if err := want(2, 1); err != nil {
+				return nil, err
+			}
+			return func(in *Instance, args []uint64) []uint64 {
+				if uint32(args[0]) > 2 {
+					return errno(errnoBadf)
+				}
+				// character device, no flags, no rights beyond reading and
+				// writing the standard streams
+				stat := make([]byte, 24)
+				stat[0] = 2
+				binary.LittleEndian.PutUint64(stat[8:], 1<<1|1<<6)
+				if !in.Write(uint32(args[1]), stat) {
+					return errno(errnoFault)
+				}
+				return errno(errnoSuccess)
+			}, nil
+		case "fd_close", "fd_prestat_get", "fd_prestat_dir_name", "fd_fdstat_set_flags":
+			// no preopened directories or other descriptors
+			return func(in *Instance, args []uint64) []uint64 {
+				return errno(errnoBadf)
+			}, nil
+		case "poll_oneoff":
+			if err := want(4, 1); err != nil {
+				return nil, err
+			}
+			return pollOneoff, nil
+		}
+		if len(imp.Type.Results) == 1 && imp.Type.Results[0] == I32 {
+			return func(in *Instance, args []uint64) []uint64 {
+				return errno(errnoNosys)
+			}, nil
+		}
+		return nil, fmt.Errorf("unsupported WASI function %s", imp.Name)
+	}
+}
+
+// pollOneoff reports every subscription as ready without blocking: clock
+// subscriptions fire at once so plugins never put the host to sleep
+func pollOneoff(in *Instance, args []uint64) []uint64 {
+	subs, events, n := uint32(args[0]), uint32(args[1]), uint32(args[2])
+	for i := uint32(0); i < n; i++ {
+		sub, ok := in.Read(subs+48*i, 48)
+		if !ok {
+			return errno(errnoFault)
+		}
+		event := make([]byte, 32)
+		copy(event[0:8], sub[0:8]) // userdata
+		event[10] = sub[8]         // event type
+		if !in.Write(events+32*i, event) {
+			return errno(errnoFault)
+		}
+	}
+	if !putU32(in, args[3], n) {
+		return errno(errnoFault)
+	}
+	return errno(errnoSuccess)
+}
+
+func errno(code uint64) []uint64 {
+	return []uint64{code}
+}
+
+func putU32(in *Instance, ptr uint64, v uint32) bool {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	return in.Write(uint32(ptr), b[:])
+}
+
+func putU64(in *Instance, ptr uint64, v uint64) bool {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	return in.Write(uint32(ptr), b[:])
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Zigbee2MQTTConfig configures the zigbee driver. Sensors with protocol
+// zigbee name a zigbee2mqtt device by its friendly name in address and read
+// one JSON attribute of the state it publishes on <base_topic>/<name>
+// (attribute, by default the usual attribute of the sensor type, e.g.
+// temperature, occupancy, illuminance_lux or battery). The driver uses the
+// gateway's own broker, so zigbee2mqtt must publish there or be bridged to
+// it. Device availability on <base_topic>/<name>/availability sets the
+// status of the device's sensors to "offline" until it is back online.
+type Zigbee2MQTTConfig struct {
+	BaseTopic string `yaml:"base_topic,omitempty"` // default zigbee2mqtt
+}
+
+func (c *Zigbee2MQTTConfig) normalize() error {
+	if c.BaseTopic == "" {
+		c.BaseTopic = "zigbee2mqtt"
+	}
+	c.BaseTopic = strings.TrimRight(c.BaseTopic, "/")
+	if strings.ContainsAny(c.BaseTopic, "+#") {
+		return fmt.Errorf("zigbee2mqtt base_topic %q must not contain wildcards", c.BaseTopic)
+	}
+	return nil
+}
+
+// zigbeeAttributes are the attributes read by default per sensor type, in
+// order of preference (zigbee2mqtt renamed some across versions)
+var zigbeeAttributes = map[string][]string{
+	"temperature":    {"temperature"},
+	"humidity":       {"humidity"},
+	"co2":            {"co2"},
+	"light":          {"illuminance_lux", "illuminance"},
+	"occupancy":      {"occupancy"},
+	"motion":         {"occupancy"},
+	"contact":        {"contact"},
+	"leak":           {"water_leak"},
+	"battery":        {"battery"},
+	"power":          {"power"},
+	"energy":         {"energy"},
+	"pm25":           {"pm25"},
+	"pressure":       {"pressure"},
+	"blind_position": {"position"},
+}
+
+// errDeviceOffline marks readings of sensors whose device reported itself
+// unavailable; they get status "offline"
+var errDeviceOffline = errors.New("device offline")
+
+// validateZigbeeSensors checks the zigbee settings of sensors
+func (gw *Gateway) validateZigbeeSensors() error {
+	for id, sensor := range gw.sensors {
+		if sensor.Protocol != "zigbee" {
+			if sensor.Attribute != "" {
+				return fmt.Errorf("sensor %s: attribute is only valid for protocol zigbee", id)
+			}
+			continue
+		}
+		if sensor.Address == "" || strings.ContainsAny(sensor.Address, "+#") {
+			return fmt.Errorf("sensor %s: address must be a zigbee2mqtt friendly name without wildcards", id)
+		}
+		if sensor.Attribute == "" && len(zigbeeAttributes[sensor.Type]) == 0 {
+			return fmt.Errorf("sensor %s: attribute is required for type %s", id, sensor.Type)
+		}
+		if sensor.Writable {
+			return fmt.Errorf("sensor %s: writes are not supported for protocol zigbee", id)
+		}
+	}
+	return nil
+}
+
+// zigbeeDevice is the last state and availability of one device
+type zigbeeDevice struct {
+	sensors []*SensorConfig
+	state   map[string]interface{}
+	offline bool
+}
+
+// zigbeeBacklog is how many zigbee2mqtt messages may wait for the recorder
+// before new ones are dropped
+const zigbeeBacklog = 1024
+
+// zigbeeDriver records the readings of zigbee2mqtt devices from the
+// messages they publish; sensors are never polled
+type zigbeeDriver struct {
+	config   *Zigbee2MQTTConfig
+	latency  *latencyRecorder
+	mu       sync.Mutex
+	devices  map[string]*zigbeeDevice
+	messages chan mqtt.Message
+}
+
+func newZigbeeDriver(config *Zigbee2MQTTConfig, sensors map[string]*SensorConfig, latency *latencyRecorder) *zigbeeDriver {
+	d := &zigbeeDriver{
+		config:   config,
+		latency:  latency,
+		devices:  make(map[string]*zigbeeDevice),
+		messages: make(chan mqtt.Message, zigbeeBacklog),
+	}
+	for _, sensor := range sensors {
+		if sensor.Protocol != "zigbee" {
+			continue
+		}
+		device := d.devices[sensor.Address]
+		if device == nil {
+			device = &zigbeeDevice{}
+			d.devices[sensor.Address] = device
+		}
+		device.sensors = append(device.sensors, sensor)
+	}
+	return d
+}
+
+// subscribeZigbee subscribes to the state and availability topics of every
+// device from the OnConnect handler
+func (gw *Gateway) subscribeZigbee(client mqtt.Client) {
+	d := gw.zigbee
+	filters := make(map[string]byte, 2*len(d.devices))
+	for name := range d.devices {
+		filters[d.config.BaseTopic+"/"+name] = 1
+		filters[d.config.BaseTopic+"/"+name+"/availability"] = 1
+	}
+	token := client.SubscribeMultiple(filters, d.enqueue)
+	token.Wait()
+	if token.Error() != nil {
+		log.Printf("[ERROR] Failed to subscribe to zigbee2mqtt topics: %v", token.Error())
+		return
+	}
+	log.Printf("Subscribed to %d zigbee2mqtt device(s) under %s", len(d.devices), d.config.BaseTopic)
+}
+
+// enqueue runs on the paho router goroutine, which must not wait on the
+// publishes that recording a reading can make
+func (d *zigbeeDriver) enqueue(client mqtt.Client, msg mqtt.Message) {
+	select {
+	case d.messages <- msg:
+	default:
+		log.Printf("[WARN] Dropping zigbee2mqtt message on %s: recorder backlog full", msg.Topic())
+	}
+}
+
+// recordZigbee records the queued zigbee2mqtt messages in order until
+// shutdown
+func (gw *Gateway) recordZigbee() {
+	defer gw.wg.Done()
+	for {
+		select {
+		case <-gw.shutdown:
+			return
+		case msg := <-gw.zigbee.messages:
+			gw.handleZigbeeMessage(msg)
+		}
+	}
+}
+
+// handleZigbeeMessage records the readings of a device state message, or
+// the availability of a device
+func (gw *Gateway) handleZigbeeMessage(msg mqtt.Message) {
+	d := gw.zigbee
+	name := strings.TrimPrefix(msg.Topic(), d.config.BaseTopic+"/")
+	if device, ok := strings.CutSuffix(name, "/availability"); ok && d.devices[device] != nil {
+		gw.zigbeeAvailability(device, msg.Payload())
+		return
+	}
+	device := d.devices[name]
+	if device == nil {
+		return
+	}
+
+	var state map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&state); err != nil {
+		d.latency.observe("zigbee", name, 0, err)
+		log.Printf("[WARN] Ignoring malformed zigbee2mqtt state of %s: %v", name, err)
+		return
+	}
+	d.mu.Lock()
+	if device.offline && msg.Retained() {
+		// A retained state of a device known to be offline is stale
+		d.mu.Unlock()
+		return
+	}
+	device.offline = false
+	if device.state == nil {
+		device.state = make(map[string]interface{})
+	}
+	for k, v := range state {
+		device.state[k] = v
+	}
+	sensors := device.sensors
+	d.mu.Unlock()
+	d.latency.observe("zigbee", name, 0, nil)
+
+	for _, sensor := range sensors {
+		if gw.control.isPaused(sensor.ID) {
+			continue
+		}
+		value, text, ok, err := zigbeeValue(sensor, state)
+		if !ok {
+			continue
+		}
+		gw.recordReading(sensor.ID, sensor, value, text, err, time.Time{}, newTraceID())
+	}
+}
+
+// zigbeeAvailability records an offline reading for every sensor of a
+// device that reported itself unavailable. The payload is "online" or
+// "offline", or {"state": "online"} since zigbee2mqtt 1.32.
+func (gw *Gateway) zigbeeAvailability(name string, payload []byte) {
+	d := gw.zigbee
+	availability := strings.TrimSpace(string(payload))
+	var object struct {
+		State string `json:"state"`
+	}
+	if json.Unmarshal(payload, &object) == nil && object.State != "" {
+		availability = object.State
+	}
+	offline := availability == "offline"
+
+	d.mu.Lock()
+	device := d.devices[name]
+	changed := device.offline != offline
+	device.offline = offline
+	sensors := device.sensors
+	d.mu.Unlock()
+	if !changed {
+		return
+	}
+	if !offline {
+		log.Printf("[EVENT] Zigbee device %s is online", name)
+		return
+	}
+	log.Printf("[EVENT] Zigbee device %s is offline", name)
+	err := fmt.Errorf("zigbee2mqtt: %s: %w", name, errDeviceOffline)
+	d.latency.observe("zigbee", name, 0, err)
+	for _, sensor := range sensors {
+		gw.recordReading(sensor.ID, sensor, 0, "", err, time.Time{}, newTraceID())
+	}
+}
+
+// read returns the last value of a sensor for on-demand reads
+func (d *zigbeeDriver) read(sensor *SensorConfig) (float64, string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	device := d.devices[sensor.Address]
+	if device == nil {
+		return 0, "", fmt.Errorf("zigbee2mqtt: unknown device %s", sensor.Address)
+	}
+	if device.offline {
+		return 0, "", fmt.Errorf("zigbee2mqtt: %s: %w", sensor.Address, errDeviceOffline)
+	}
+	value, text, ok, err := zigbeeValue(sensor, device.state)
+	if !ok {
+		return 0, "", fmt.Errorf("zigbee2mqtt: %s has not reported %s yet", sensor.Address, zigbeeAttribute(sensor, device.state))
+	}
+	return value, text, err
+}
+
+// zigbeeAttribute returns the attribute a sensor reads from a state
+func zigbeeAttribute(sensor *SensorConfig, state map[string]interface{}) string {
+	if sensor.Attribute != "" {
+		return sensor.Attribute
+	}
+	candidates := zigbeeAttributes[sensor.Type]
+	for _, name := range candidates {
+		if _, ok := state[name]; ok {
+			return name
+		}
+	}
+	return candidates[0]
+}
+
+// zigbeeValue extracts a sensor's value from a state; ok is false when the
+// state does not carry its attribute. zigbee2mqtt reports contact true for
+// a closed contact, so the default contact attribute is inverted to the
+// gateway's 1 = open.
+func zigbeeValue(sensor *SensorConfig, state map[string]interface{}) (value float64, text string, ok bool, err error) {
+	attribute := zigbeeAttribute(sensor, state)
+	raw, ok := state[attribute]
+	if !ok {
+		return 0, "", false, nil
+	}
+	switch v := raw.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, "", true, fmt.Errorf("zigbee2mqtt: %s.%s: %w", sensor.Address, attribute, err)
+		}
+		return f, sensor.enumText[f], true, nil
+	case bool:
+		if sensor.Type == "contact" && sensor.Attribute == "" {
+			v = !v
+		}
+		if v {
+			return 1, sensor.enumText[1], true, nil
+		}
+		return 0, sensor.enumText[0], true, nil
+	case string:
+		text := strings.TrimSpace(v)
+		if code, ok := lookupEnumCode(sensor.EnumMap, text); ok {
+			return code, text, true, nil
+		}
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, text, true, nil
+		}
+		if len(sensor.EnumMap) > 0 {
+			return 0, text, true, fmt.Errorf("zigbee2mqtt state %q not found in enum_map", text)
+		}
+		return 0, text, true, nil
+	case nil:
+		return 0, "", true, fmt.Errorf("zigbee2mqtt: %s.%s is null", sensor.Address, attribute)
+	default:
+		return 0, "", true, fmt.Errorf("zigbee2mqtt: %s.%s is an object or array, not a value", sensor.Address, attribute)
+	}
+}